@@ -0,0 +1,328 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// An archive file holds the nodes of a single version, in post-order so that the children of
+// an inner node precede it, between a header and a footer:
+//
+//	header: archiveMagic
+//	node:   height, size, version, nonce, key, hash, then value (leaf) or left, right offsets (inner)
+//	footer: version, root offset (-1 if empty), archiveMagic
+//
+// Integers are varints, except the fixed size footer fields, and byte slices are prefixed with
+// their length.
+var archiveMagic = []byte("IAVLARC1")
+
+const archiveFooterSize = 2*int64Size + 8
+
+// ErrInvalidArchiveFile is returned when opening or reading a corrupted archive file.
+var ErrInvalidArchiveFile = errors.New("invalid archive file")
+
+// ArchiveFile is an archive file opened by OpenArchiveFile. Its content is memory mapped and
+// read in place, so the trees it returns stay valid until it's closed.
+type ArchiveFile struct {
+	data    []byte
+	version int64
+	root    int64
+	ndb     *nodeDB
+}
+
+// ExportToArchiveFile writes the tree to a new archive file at path, to be opened with
+// OpenArchiveFile. The tree must be saved, i.e. have no unsaved changes.
+func (t *ImmutableTree) ExportToArchiveFile(path string) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	w := &archiveWriter{w: bufio.NewWriter(f)}
+	if _, err := w.Write(archiveMagic); err != nil {
+		return err
+	}
+	root := int64(-1)
+	if t.root != nil {
+		if root, err = w.writeNode(t, t.root); err != nil {
+			return err
+		}
+	}
+
+	footer := make([]byte, 0, archiveFooterSize)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(t.version))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(root))
+	footer = append(footer, archiveMagic...)
+	if _, err := w.Write(footer); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// archiveWriter tracks the offset of the written archive nodes.
+type archiveWriter struct {
+	w      *bufio.Writer
+	offset int64
+	buf    bytes.Buffer
+}
+
+func (w *archiveWriter) Write(bz []byte) (int, error) {
+	n, err := w.w.Write(bz)
+	w.offset += int64(n)
+	return n, err
+}
+
+// writeNode writes the subtree of node in post-order, and returns the offset of node.
+func (w *archiveWriter) writeNode(t *ImmutableTree, node *Node) (int64, error) {
+	if node.nodeKey == nil || node.hash == nil {
+		return 0, errors.New("cannot archive a tree with unsaved changes")
+	}
+
+	var left, right int64
+	if !node.isLeaf() {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return 0, err
+		}
+		if left, err = w.writeNode(t, leftNode); err != nil {
+			return 0, err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return 0, err
+		}
+		if right, err = w.writeNode(t, rightNode); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := &w.buf
+	buf.Reset()
+	err := errors.Join(
+		encoding.EncodeVarint(buf, int64(node.subtreeHeight)),
+		encoding.EncodeVarint(buf, node.size),
+		encoding.EncodeVarint(buf, node.nodeKey.version),
+		encoding.EncodeUvarint(buf, uint64(node.nodeKey.nonce)),
+		encoding.EncodeBytes(buf, node.key),
+		encoding.EncodeBytes(buf, node.hash),
+	)
+	if node.isLeaf() {
+		value, valueErr := t.ndb.leafValue(node)
+		err = errors.Join(err, valueErr, encoding.EncodeBytes(buf, value))
+	} else {
+		err = errors.Join(err, encoding.EncodeUvarint(buf, uint64(left)), encoding.EncodeUvarint(buf, uint64(right)))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	offset := w.offset
+	_, err = w.Write(buf.Bytes())
+	return offset, err
+}
+
+// OpenArchiveFile memory maps the archive file at path, written by ExportToArchiveFile. The
+// options apply to the trees it returns, e.g. UnsafeNoCopy to return the keys and values
+// mapped from the file.
+func OpenArchiveFile(path string, options ...Option) (_ *ArchiveFile, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(len(archiveMagic))+archiveFooterSize || size > math.MaxInt {
+		return nil, fmt.Errorf("%w: unexpected size %d", ErrInvalidArchiveFile, size)
+	}
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			munmapFile(data) //nolint:errcheck
+		}
+	}()
+
+	footer := data[len(data)-archiveFooterSize:]
+	if !bytes.Equal(data[:len(archiveMagic)], archiveMagic) || !bytes.Equal(footer[2*int64Size:], archiveMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidArchiveFile)
+	}
+
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	a := &ArchiveFile{
+		data:    data,
+		version: int64(binary.BigEndian.Uint64(footer)),
+		root:    int64(binary.BigEndian.Uint64(footer[int64Size:])),
+	}
+	// the nodes don't go through the database, nor the caches.
+	a.ndb = &nodeDB{
+		logger:         NewNopLogger(),
+		opts:           opts,
+		archive:        a,
+		nodeCache:      cache.New(0),
+		fastNodeCache:  cache.New(0),
+		versionReaders: make(map[int64]uint32),
+		storageVersion: defaultStorageVersionValue,
+		latestVersion:  a.version,
+	}
+	if a.root != -1 {
+		if _, err := a.node(a.root); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Version returns the version of the archived tree.
+func (a *ArchiveFile) Version() int64 {
+	return a.version
+}
+
+// Tree returns the archived tree. It reads its nodes from the archive file, and never from a
+// database.
+func (a *ArchiveFile) Tree() (*ImmutableTree, error) {
+	t := &ImmutableTree{
+		logger:                 a.ndb.logger,
+		ndb:                    a.ndb,
+		version:                a.version,
+		skipFastStorageUpgrade: true,
+	}
+	if a.root != -1 {
+		var err error
+		if t.root, err = a.node(a.root); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Close unmaps the archive file. The trees returned by Tree, and the keys and values they
+// returned with the UnsafeNoCopy option, must not be used anymore.
+func (a *ArchiveFile) Close() error {
+	if a.data == nil {
+		return nil
+	}
+	data := a.data
+	a.data = nil
+	return munmapFile(data)
+}
+
+// archiveNodeKey returns the key of the archived node at offset, which is what the child node keys of
+// the archived inner nodes are.
+func archiveNodeKey(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+// getNode returns the node with the given archive node key.
+func (a *ArchiveFile) getNode(nk []byte) (*Node, error) {
+	if len(nk) != int64Size {
+		return nil, fmt.Errorf("%w: bad node key %x", ErrInvalidArchiveFile, nk)
+	}
+	return a.node(int64(binary.BigEndian.Uint64(nk)))
+}
+
+// node decodes the node at offset, referencing its key and value in place.
+func (a *ArchiveFile) node(offset int64) (*Node, error) {
+	if a.data == nil {
+		return nil, errors.New("archive file is closed")
+	}
+	end := int64(len(a.data)) - archiveFooterSize
+	if offset < int64(len(archiveMagic)) || offset >= end {
+		return nil, fmt.Errorf("%w: node offset %d out of range", ErrInvalidArchiveFile, offset)
+	}
+	buf := a.data[offset:end]
+
+	var (
+		height, size, version int64
+		nonce                 uint64
+		n                     int
+		err                   error
+	)
+	corrupted := func(field string, err error) error {
+		return fmt.Errorf("%w: decoding node.%s at offset %d, %v", ErrInvalidArchiveFile, field, offset, err)
+	}
+	if height, n, err = encoding.DecodeVarint(buf); err != nil {
+		return nil, corrupted("height", err)
+	}
+	buf = buf[n:]
+	if size, n, err = encoding.DecodeVarint(buf); err != nil {
+		return nil, corrupted("size", err)
+	}
+	buf = buf[n:]
+	if version, n, err = encoding.DecodeVarint(buf); err != nil {
+		return nil, corrupted("version", err)
+	}
+	buf = buf[n:]
+	if nonce, n, err = encoding.DecodeUvarint(buf); err != nil {
+		return nil, corrupted("nonce", err)
+	}
+	buf = buf[n:]
+	if height < 0 || height > math.MaxInt8 || size < 1 || nonce > math.MaxUint32 {
+		return nil, corrupted("header", errors.New("out of range"))
+	}
+
+	node := &Node{
+		subtreeHeight: int8(height),
+		size:          size,
+		nodeKey:       &NodeKey{version: version, nonce: uint32(nonce)},
+	}
+	if node.key, n, err = encoding.DecodeBytes(buf); err != nil {
+		return nil, corrupted("key", err)
+	}
+	buf = buf[n:]
+	if node.hash, n, err = encoding.DecodeBytes(buf); err != nil {
+		return nil, corrupted("hash", err)
+	}
+	buf = buf[n:]
+
+	if node.isLeaf() {
+		if node.value, _, err = encoding.DecodeBytes(buf); err != nil {
+			return nil, corrupted("value", err)
+		}
+		return node, nil
+	}
+
+	left, n, err := encoding.DecodeUvarint(buf)
+	if err != nil {
+		return nil, corrupted("left", err)
+	}
+	buf = buf[n:]
+	right, _, err := encoding.DecodeUvarint(buf)
+	if err != nil {
+		return nil, corrupted("right", err)
+	}
+	// the children precede their parent, which rules out cycles.
+	if left >= uint64(offset) || right >= uint64(offset) {
+		return nil, corrupted("children", errors.New("out of order"))
+	}
+	node.leftNodeKey = archiveNodeKey(int64(left))
+	node.rightNodeKey = archiveNodeKey(int64(right))
+	return node, nil
+}
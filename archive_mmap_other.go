@@ -0,0 +1,26 @@
+//go:build !unix
+
+package iavl
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the whole file into memory where mmap isn't available.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// mmapAnonymous allocates the memory on the heap where mmap isn't available.
+func mmapAnonymous(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func munmapFile([]byte) error {
+	return nil
+}
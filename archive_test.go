@@ -0,0 +1,170 @@
+package iavl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// requireSameTree checks that two trees serve the same queries and proofs.
+func requireSameTree(t *testing.T, expected, actual *ImmutableTree, keys int) {
+	t.Helper()
+	require.Equal(t, expected.Version(), actual.Version())
+	require.Equal(t, expected.Hash(), actual.Hash())
+	require.Equal(t, expected.Size(), actual.Size())
+	require.Equal(t, expected.Height(), actual.Height())
+
+	for i := -1; i <= keys; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		value, err := expected.Get(key)
+		require.NoError(t, err)
+		archived, err := actual.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, archived)
+
+		_, version, err := expected.GetWithVersion(key)
+		require.NoError(t, err)
+		_, archivedVersion, err := actual.GetWithVersion(key)
+		require.NoError(t, err)
+		require.Equal(t, version, archivedVersion)
+
+		proof, err := expected.GetProof(key)
+		require.NoError(t, err)
+		archivedProof, err := actual.GetProof(key)
+		require.NoError(t, err)
+		require.Equal(t, proof, archivedProof)
+		ok, err := actual.VerifyProof(archivedProof, key)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	var expectedKeys, actualKeys []string
+	expected.IterateRange(nil, nil, false, func(key, value []byte) bool {
+		expectedKeys = append(expectedKeys, string(key)+"="+string(value))
+		return false
+	})
+	actual.IterateRange(nil, nil, false, func(key, value []byte) bool {
+		actualKeys = append(actualKeys, string(key)+"="+string(value))
+		return false
+	})
+	require.Equal(t, expectedKeys, actualKeys)
+}
+
+func TestArchiveFile(t *testing.T) {
+	const keys = 300
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < keys; i += v {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%04d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// archive a pinned set of versions.
+	dir := t.TempDir()
+	for _, version := range []int64{2, 3} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		path := filepath.Join(dir, fmt.Sprintf("v%d.iavl", version))
+		require.NoError(t, itree.ExportToArchiveFile(path))
+
+		archive, err := OpenArchiveFile(path)
+		require.NoError(t, err)
+		require.Equal(t, version, archive.Version())
+		archived, err := archive.Tree()
+		require.NoError(t, err)
+		require.Nil(t, archived.ndb.db)
+		requireSameTree(t, itree, archived, keys)
+
+		// an archive can be exported again, to an identical file.
+		copyPath := path + ".copy"
+		require.NoError(t, archived.ExportToArchiveFile(copyPath))
+		original, err := os.ReadFile(path)
+		require.NoError(t, err)
+		copied, err := os.ReadFile(copyPath)
+		require.NoError(t, err)
+		require.Equal(t, original, copied)
+
+		require.NoError(t, archive.Close())
+		require.NoError(t, archive.Close())
+		_, err = archive.Tree()
+		require.Error(t, err)
+	}
+
+	// the existing files aren't overwritten.
+	require.Error(t, tree.ExportToArchiveFile(filepath.Join(dir, "v3.iavl")))
+	// nor is the working tree archived with its unsaved changes.
+	_, err := tree.Set([]byte("key-unsaved"), []byte("value"))
+	require.NoError(t, err)
+	require.Error(t, tree.ExportToArchiveFile(filepath.Join(dir, "unsaved.iavl")))
+	_, err = os.Stat(filepath.Join(dir, "unsaved.iavl"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestArchiveFile_Empty(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "empty.iavl")
+	require.NoError(t, tree.ExportToArchiveFile(path))
+	archive, err := OpenArchiveFile(path)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	archived, err := archive.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), archived.Version())
+	require.Zero(t, archived.Size())
+	require.Equal(t, tree.Hash(), archived.Hash())
+	value, err := archived.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestArchiveFile_Invalid(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "valid.iavl")
+	require.NoError(t, tree.ExportToArchiveFile(path))
+	valid, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	testCases := map[string][]byte{
+		"empty":     {},
+		"truncated": valid[:len(valid)-1],
+		"bad magic": append([]byte("IAVLARC0"), valid[8:]...),
+		"bad root": func() []byte {
+			bz := append([]byte{}, valid...)
+			bz[len(bz)-archiveFooterSize+int64Size]++
+			return bz
+		}(),
+	}
+	for name, bz := range testCases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, bz, 0o600))
+			_, err := OpenArchiveFile(path)
+			require.ErrorIs(t, err, ErrInvalidArchiveFile)
+		})
+	}
+
+	_, err = OpenArchiveFile(filepath.Join(dir, "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,222 @@
+package iavl
+
+import (
+	"sync"
+	"time"
+)
+
+// asyncPruneRetryDelay is the delay after which the async pruner retries a version it failed to
+// delete, e.g. while the version is being read.
+const asyncPruneRetryDelay = time.Second
+
+// pruneRun is a run of consecutive versions to delete, from from to to inclusive.
+type pruneRun struct {
+	from, to int64
+}
+
+// asyncPruner deletes the versions queued by the pruning policy in a background goroutine, one
+// version at a time, so that SaveVersion doesn't wait for them, see PruningOptions.Async. Each
+// version is deleted and committed under the writeMtx of the nodeDB, which SaveVersion holds,
+// so that the deletions don't interleave with the writes of a version.
+type asyncPruner struct {
+	ndb       *nodeDB
+	rateLimit int
+	onPruned  func() // called once a version is deleted
+
+	mtx     sync.Mutex // guards the fields below
+	cond    *sync.Cond // broadcast when runs are queued, a version is processed, or the pruner stops
+	runs    []pruneRun
+	busy    bool  // whether a version is being deleted
+	err     error // error of the last deletion, cleared by the next successful one
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// startAsyncPruner starts the async pruner of the nodeDB, if it isn't running, calling onPruned
+// once a version is deleted.
+func (ndb *nodeDB) startAsyncPruner(rateLimit int, onPruned func()) *asyncPruner {
+	ndb.prunerMtx.Lock()
+	defer ndb.prunerMtx.Unlock()
+	if ndb.pruner != nil {
+		return ndb.pruner
+	}
+	p := &asyncPruner{
+		ndb:       ndb,
+		rateLimit: rateLimit,
+		onPruned:  onPruned,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	ndb.pruner = p
+	go p.run()
+	return p
+}
+
+// stopAsyncPruner stops the async pruner of the nodeDB, if any, once the version it is deleting
+// is committed. The queued versions are left as they are, and deleted again by the pruning
+// policy once it restarts.
+func (ndb *nodeDB) stopAsyncPruner() {
+	ndb.prunerMtx.Lock()
+	p := ndb.pruner
+	ndb.pruner = nil
+	ndb.prunerMtx.Unlock()
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	p.stopped = true
+	close(p.stop)
+	p.cond.Broadcast()
+	p.mtx.Unlock()
+	<-p.done
+}
+
+// asyncPruner returns the running async pruner of the nodeDB, nil if none.
+func (ndb *nodeDB) asyncPruner() *asyncPruner {
+	ndb.prunerMtx.Lock()
+	defer ndb.prunerMtx.Unlock()
+	return ndb.pruner
+}
+
+// enqueue queues the deletion of the versions from from to to inclusive.
+func (p *asyncPruner) enqueue(from, to int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.runs = append(p.runs, pruneRun{from: from, to: to})
+	p.cond.Broadcast()
+}
+
+// pending returns the number of versions queued for deletion.
+func (p *asyncPruner) pending() int64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	n := int64(0)
+	for _, run := range p.runs {
+		n += run.to - run.from + 1
+	}
+	return n
+}
+
+// wait waits until the queued versions are deleted, and returns the error of the last deletion,
+// which is retried later, if it failed.
+func (p *asyncPruner) wait() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for (len(p.runs) > 0 || p.busy) && p.err == nil && !p.stopped {
+		p.cond.Wait()
+	}
+	return p.err
+}
+
+func (p *asyncPruner) run() {
+	defer close(p.done)
+	for {
+		p.mtx.Lock()
+		for len(p.runs) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.mtx.Unlock()
+			return
+		}
+		version := p.runs[0].from
+		p.busy = true
+		p.mtx.Unlock()
+
+		err := p.ndb.pruneVersion(version)
+		if err == nil {
+			p.onPruned()
+		}
+
+		p.mtx.Lock()
+		p.busy = false
+		p.err = err
+		if err == nil {
+			if p.runs[0].from++; p.runs[0].from > p.runs[0].to {
+				p.runs = p.runs[1:]
+			}
+		}
+		p.cond.Broadcast()
+		p.mtx.Unlock()
+
+		delay := time.Duration(0)
+		if err != nil {
+			p.ndb.logger.Error("async pruning failed, retrying", "version", version, "err", err)
+			delay = asyncPruneRetryDelay
+		} else if p.rateLimit > 0 {
+			delay = time.Second / time.Duration(p.rateLimit)
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-p.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// pruneVersion deletes the version for the async pruner, as DeleteVersionsTo if it is the first
+// version and as the pruning policy does otherwise, and commits the deletion. The versions which
+// were deleted meanwhile are skipped, as the legacy versions which aren't the first one.
+func (ndb *nodeDB) pruneVersion(version int64) error {
+	ndb.writeMtx.Lock()
+	defer ndb.writeMtx.Unlock()
+
+	first, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	// the version may have been deleted meanwhile, or overwritten.
+	if version < first || version >= latest {
+		return nil
+	}
+	if pruned, err := ndb.isPrunedVersion(version); err != nil || pruned {
+		return err
+	}
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == first:
+		err = ndb.DeleteVersionsTo(version)
+	case version <= legacyLatestVersion:
+		return nil
+	default:
+		err = ndb.deleteVersionsBetween(version, version)
+	}
+	if err != nil {
+		return err
+	}
+	return ndb.Commit()
+}
+
+// WaitForPruning waits until the versions queued by the async pruning are deleted, e.g. before
+// shutting down, see PruningOptions.Async. It returns the error of the last deletion if it
+// failed, in which case the pruning is retried in the background. It returns immediately if
+// the pruning isn't async.
+func (tree *MutableTree) WaitForPruning() error {
+	p := tree.ndb.asyncPruner()
+	if p == nil {
+		return nil
+	}
+	return p.wait()
+}
+
+// PendingPrunes returns the number of versions queued for deletion by the async pruning.
+func (tree *MutableTree) PendingPrunes() int64 {
+	p := tree.ndb.asyncPruner()
+	if p == nil {
+		return 0
+	}
+	return p.pending()
+}
@@ -0,0 +1,110 @@
+package iavl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestAsyncPruning(t *testing.T) {
+	opts := PruningOptions{KeepRecent: 3, KeepEvery: 5, Async: true}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(opts))
+
+	for latest := int64(1); latest <= 60; latest++ {
+		savePolicyTestVersion(t, tree, reference)
+		if latest%10 == 0 {
+			require.NoError(t, tree.WaitForPruning())
+			require.Equal(t, expectedRetainedVersions(opts, 1, latest), tree.AvailableVersions(), "latest %d", latest)
+		}
+	}
+	require.Zero(t, tree.PendingPrunes())
+	requirePrunedConsistently(t, tree, reference, db)
+	require.NoError(t, tree.Close())
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 58, 59, 60}, reloaded.AvailableVersions())
+}
+
+func TestAsyncPruning_RateLimit(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1, Async: true, RateLimit: 20}))
+
+	for i := 0; i < 11; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	start := time.Now()
+	require.NoError(t, tree.WaitForPruning())
+	// the 10 versions queued are deleted 50ms apart.
+	require.GreaterOrEqual(t, time.Since(start), 350*time.Millisecond)
+	require.Equal(t, []int{11}, tree.AvailableVersions())
+
+	// the versions still queued once closed are pruned again once the policy applies.
+	for i := 0; i < 10; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Positive(t, tree.PendingPrunes())
+	require.NoError(t, tree.Close())
+	require.NoError(t, tree.WaitForPruning())
+}
+
+func TestAsyncPruning_Restart(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 2, Async: true, RateLimit: 1}))
+	for i := 0; i < 10; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Positive(t, tree.PendingPrunes())
+	require.NoError(t, tree.Close())
+	require.Zero(t, tree.PendingPrunes())
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Greater(t, len(reloaded.AvailableVersions()), 2)
+	require.NoError(t, reloaded.ConfigurePruning(PruningOptions{KeepRecent: 2}))
+	savePolicyTestVersion(t, reloaded)
+	require.Equal(t, []int{10, 11}, reloaded.AvailableVersions())
+}
+
+func TestAsyncPruning_Readers(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1, Async: true}))
+	for i := 0; i < 4; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.NoError(t, tree.WaitForPruning())
+	require.Equal(t, []int{4}, tree.AvailableVersions())
+
+	// a version being read isn't deleted, which is retried once it is no longer read.
+	tree.ndb.incrVersionReaders(4)
+	savePolicyTestVersion(t, tree)
+	require.Error(t, tree.WaitForPruning())
+	require.Equal(t, []int{4, 5}, tree.AvailableVersions())
+	tree.ndb.decrVersionReaders(4)
+	require.Eventually(t, func() bool {
+		return tree.WaitForPruning() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []int{5}, tree.AvailableVersions())
+}
+
+func TestAsyncPruning_Sync(t *testing.T) {
+	// the pruning isn't async by default, so there is nothing to wait for.
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1}))
+	for i := 0; i < 3; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Nil(t, tree.ndb.asyncPruner())
+	require.NoError(t, tree.WaitForPruning())
+	require.Zero(t, tree.PendingPrunes())
+	require.Equal(t, []int{3}, tree.AvailableVersions())
+}
@@ -178,9 +178,9 @@ func TestUnit(t *testing.T) {
 		// ensure node was added & structure is as expected.
 		if updated || P(tree.root, tree.ImmutableTree) != repr {
 			t.Fatalf("Adding %v to %v:\nExpected         %v\nUnexpectedly got %v updated:%v",
-				i, P(tree.lastSaved.root, tree.lastSaved), repr, P(tree.root, tree.ImmutableTree), updated)
+				i, P(tree.lastSaved.Load().root, tree.lastSaved.Load()), repr, P(tree.root, tree.ImmutableTree), updated)
 		}
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.lastSaved.Load().clone()
 	}
 
 	expectRemove := func(tree *MutableTree, i int, repr string) {
@@ -190,9 +190,9 @@ func TestUnit(t *testing.T) {
 		// ensure node was added & structure is as expected.
 		if len(value) != 0 || !removed || P(tree.root, tree.ImmutableTree) != repr {
 			t.Fatalf("Removing %v from %v:\nExpected         %v\nUnexpectedly got %v value:%v removed:%v",
-				i, P(tree.lastSaved.root, tree.lastSaved), repr, P(tree.root, tree.ImmutableTree), value, removed)
+				i, P(tree.lastSaved.Load().root, tree.lastSaved.Load()), repr, P(tree.root, tree.ImmutableTree), value, removed)
 		}
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.lastSaved.Load().clone()
 	}
 
 	// Test Set cases:
@@ -432,6 +432,72 @@ func TestIterateRange(t *testing.T) {
 	expectTraverse(t, trav, "low", "good", 2)
 }
 
+func TestIterateRangeReverse(t *testing.T) {
+	tree := getTestTree(0)
+	for _, key := range []string{"abc", "fan", "foml", "foo", "foobang", "foobar", "foobaz", "food", "good", "low"} {
+		_, err := tree.Set([]byte(key), []byte("v-"+key))
+		require.NoError(t, err)
+	}
+
+	collect := func(start, end []byte, ascending bool) []string {
+		keys := []string{}
+		tree.IterateRange(start, end, ascending, func(key, value []byte) bool {
+			require.Equal(t, "v-"+string(key), string(value))
+			keys = append(keys, string(key))
+			return false
+		})
+		return keys
+	}
+
+	testCases := []struct {
+		name       string
+		start, end []byte
+	}{
+		{"unbounded", nil, nil},
+		{"start only", []byte("foob"), nil},
+		{"end only", nil, []byte("foobar")},
+		{"both bounds", []byte("fan"), []byte("food")},
+		{"bounds on missing keys", []byte("b"), []byte("goo")},
+		{"start equals end", []byte("foo"), []byte("foo")},
+		{"start after end", []byte("low"), []byte("abc")},
+		{"empty range", []byte("aaa"), []byte("abb")},
+		{"beyond last key", []byte("very"), nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expected := collect(tc.start, tc.end, true)
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+
+			actual := []string{}
+			stopped := tree.IterateRangeReverse(tc.start, tc.end, func(key, _ []byte) bool {
+				actual = append(actual, string(key))
+				return false
+			})
+			require.False(t, stopped)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	// end is exclusive and start is inclusive, also when descending
+	first := ""
+	stopped := tree.IterateRangeReverse([]byte("foo"), []byte("food"), func(key, _ []byte) bool {
+		first = string(key)
+		return true
+	})
+	require.True(t, stopped)
+	require.Equal(t, "foobaz", first)
+	require.Equal(t, []string{"foobaz", "foobar", "foobang", "foo"}, func() []string {
+		keys := []string{}
+		tree.IterateRangeReverse([]byte("foo"), []byte("food"), func(key, _ []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		return keys
+	}())
+}
+
 func TestPersistence(t *testing.T) {
 	db := dbm.NewMemDB()
 
@@ -9,18 +9,23 @@ import (
 // BatchWithFlusher is a wrapper
 // around batch that flushes batch's data to disk
 // as soon as the configurable limit is reached.
+// A limit of 0 or less disables the flushes.
 type BatchWithFlusher struct {
 	mtx   sync.Mutex
 	db    dbm.DB    // This is only used to create new batch
 	batch dbm.Batch // Batched writing buffer.
 
-	flushThreshold int // The threshold to flush the batch to disk.
+	flushThreshold int  // The threshold to flush the batch to disk, disabled if not positive.
+	syncFlushes    bool // Whether the flushes triggered by the threshold are synchronous.
 }
 
 var _ dbm.Batch = (*BatchWithFlusher)(nil)
 
 // NewBatchWithFlusher returns new BatchWithFlusher wrapping the passed in batch
 func NewBatchWithFlusher(db dbm.DB, flushThreshold int) *BatchWithFlusher {
+	if flushThreshold < 0 {
+		flushThreshold = 0
+	}
 	return &BatchWithFlusher{
 		db:             db,
 		batch:          db.NewBatchWithSize(flushThreshold),
@@ -28,6 +33,14 @@ func NewBatchWithFlusher(db dbm.DB, flushThreshold int) *BatchWithFlusher {
 	}
 }
 
+// flush writes the batch to disk once it reached the threshold.
+func (b *BatchWithFlusher) flush() error {
+	if b.syncFlushes {
+		return b.WriteSync()
+	}
+	return b.Write()
+}
+
 // estimateSizeAfterSetting estimates the batch's size after setting a key / value
 func (b *BatchWithFlusher) estimateSizeAfterSetting(key []byte, value []byte) (int, error) {
 	currentSize, err := b.batch.GetByteSize()
@@ -56,12 +69,13 @@ func (b *BatchWithFlusher) Set(key, value []byte) error {
 	if err != nil {
 		return err
 	}
-	if batchSizeAfter > b.flushThreshold {
+	if b.flushThreshold > 0 && batchSizeAfter > b.flushThreshold {
 		b.mtx.Unlock()
-		if err := b.Write(); err != nil {
+		err := b.flush()
+		b.mtx.Lock()
+		if err != nil {
 			return err
 		}
-		b.mtx.Lock()
 	}
 	return b.batch.Set(key, value)
 }
@@ -78,12 +92,13 @@ func (b *BatchWithFlusher) Delete(key []byte) error {
 	if err != nil {
 		return err
 	}
-	if batchSizeAfter > b.flushThreshold {
+	if b.flushThreshold > 0 && batchSizeAfter > b.flushThreshold {
 		b.mtx.Unlock()
-		if err := b.Write(); err != nil {
+		err := b.flush()
+		b.mtx.Lock()
+		if err != nil {
 			return err
 		}
-		b.mtx.Lock()
 	}
 	return b.batch.Delete(key)
 }
@@ -69,3 +69,166 @@ func testBatchWithFlusher(t *testing.T, backend string) {
 		keyNonce++
 	}
 }
+
+func TestBatchWithFlusher_NoThreshold(t *testing.T) {
+	for _, threshold := range []int{0, -1} {
+		db := &syncCountingDB{DB: dbm.NewMemDB()}
+		batch := NewBatchWithFlusher(db, threshold)
+		for keyNonce := uint16(0); keyNonce < 100; keyNonce++ {
+			require.NoError(t, batch.Set(makeKey(keyNonce), bytesArrayOfSize10KB[:]))
+			require.NoError(t, batch.Delete(makeKey(keyNonce+100)))
+		}
+		require.Zero(t, db.writes)
+		require.NoError(t, batch.Write())
+		require.Equal(t, 1, db.writes)
+
+		value, err := db.Get(makeKey(99))
+		require.NoError(t, err)
+		require.Equal(t, bytesArrayOfSize10KB[:], value)
+	}
+}
+
+// syncCountingDB counts the asynchronous and synchronous writes of its batches.
+type syncCountingDB struct {
+	dbm.DB
+	writes, syncs int
+}
+
+func (db *syncCountingDB) NewBatch() dbm.Batch {
+	return &syncCountingBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+func (db *syncCountingDB) NewBatchWithSize(size int) dbm.Batch {
+	return &syncCountingBatch{Batch: db.DB.NewBatchWithSize(size), db: db}
+}
+
+type syncCountingBatch struct {
+	dbm.Batch
+	db *syncCountingDB
+}
+
+func (b *syncCountingBatch) Write() error {
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+func (b *syncCountingBatch) WriteSync() error {
+	b.db.syncs++
+	return b.Batch.WriteSync()
+}
+
+func TestSyncMode(t *testing.T) {
+	const versions = 5
+
+	testCases := []struct {
+		name    string
+		options []Option
+		check   func(t *testing.T, writes, syncs int)
+	}{
+		{"default", nil, func(t *testing.T, writes, syncs int) {
+			require.Positive(t, writes)
+			require.Equal(t, versions, syncs)
+		}},
+		{"none", []Option{SyncModeOption(SyncNone)}, func(t *testing.T, writes, syncs int) {
+			require.Greater(t, writes, versions)
+			require.Zero(t, syncs)
+		}},
+		{"batch", []Option{SyncModeOption(SyncBatch)}, func(t *testing.T, writes, syncs int) {
+			require.Positive(t, writes)
+			require.Equal(t, versions, syncs)
+		}},
+		{"always", []Option{SyncModeOption(SyncAlways)}, func(t *testing.T, writes, syncs int) {
+			require.Zero(t, writes)
+			require.Greater(t, syncs, versions)
+		}},
+		{"legacy sync", []Option{SyncOption(true)}, func(t *testing.T, writes, syncs int) {
+			require.Positive(t, writes)
+			require.Equal(t, versions, syncs)
+		}},
+		{"legacy no sync", []Option{SyncOption(false)}, func(t *testing.T, writes, syncs int) {
+			require.Zero(t, syncs)
+		}},
+		{"deprecated sync field", []Option{func(opts *Options) {
+			opts.SyncMode, opts.Sync = 0, true
+		}}, func(t *testing.T, writes, syncs int) {
+			require.Positive(t, writes)
+			require.Equal(t, versions, syncs)
+		}},
+		{"deprecated no sync field", []Option{func(opts *Options) {
+			opts.SyncMode, opts.Sync = 0, false
+		}}, func(t *testing.T, writes, syncs int) {
+			require.Zero(t, syncs)
+		}},
+		{"sync mode over sync field", []Option{func(opts *Options) {
+			opts.SyncMode, opts.Sync = SyncNone, true
+		}}, func(t *testing.T, writes, syncs int) {
+			require.Zero(t, syncs)
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &syncCountingDB{DB: dbm.NewMemDB()}
+			// a small threshold makes every version flush the batch several times.
+			options := append([]Option{FlushThresholdOption(2000)}, tc.options...)
+			tree := NewMutableTree(db, 0, true, NewNopLogger(), options...)
+			for v := 0; v < versions; v++ {
+				for i := 0; i < 50; i++ {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), bytesArrayOfSize10KB[:100])
+					require.NoError(t, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+			tc.check(t, db.writes, db.syncs)
+		})
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	for _, mode := range []SyncMode{SyncBatch, SyncAlways, SyncNone} {
+		t.Run(mode.String(), func(t *testing.T) {
+			db := &syncCountingDB{DB: dbm.NewMemDB()}
+			// the syncs done when each version is flushed.
+			var flushed []int64
+			var syncs []int
+			onFlush := func(version int64) {
+				flushed = append(flushed, version)
+				syncs = append(syncs, db.syncs)
+			}
+			tree := NewMutableTree(db, 0, true, NewNopLogger(), SyncModeOption(mode), OnFlushOption(onFlush))
+			for v := int64(1); v <= 3; v++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte("value"))
+				require.NoError(t, err)
+				_, _, err = tree.SaveVersion()
+				require.NoError(t, err)
+				if mode == SyncNone {
+					// the flush is deferred until the versions are synced.
+					require.Empty(t, flushed)
+				} else {
+					require.Equal(t, v, flushed[len(flushed)-1])
+					require.Len(t, flushed, int(v))
+					require.Positive(t, syncs[len(syncs)-1])
+				}
+			}
+			require.NoError(t, tree.Sync())
+			if mode == SyncNone {
+				require.Equal(t, []int64{3}, flushed)
+				require.Equal(t, []int{1}, syncs)
+				// the versions are synced once.
+				require.NoError(t, tree.Sync())
+				require.Len(t, flushed, 1)
+			} else {
+				// nothing is left to sync.
+				require.Equal(t, []int64{1, 2, 3}, flushed)
+			}
+
+			// the tree is unchanged by the sync.
+			reloaded := NewMutableTree(db, 0, true, NewNopLogger())
+			version, err := reloaded.Load()
+			require.NoError(t, err)
+			require.EqualValues(t, 3, version)
+			require.Equal(t, tree.Hash(), reloaded.Hash())
+		})
+	}
+}
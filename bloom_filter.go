@@ -0,0 +1,309 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+const (
+	bloomFilterKey = "bloom_filter"
+
+	bloomFilterBitsPerKey = 10 // about 1% of false positives with bloomFilterHashes
+	bloomFilterHashes     = 7
+	bloomFilterPageSize   = 4096 // bytes of a page, the unit the filter is written by
+	bloomFilterPageWords  = bloomFilterPageSize / 8
+	bloomFilterHeaderLen  = 3*int64Size + 1
+)
+
+// Key Format for the pages of the bloom filter of the BloomFilterKeys option.
+var bloomFilterPageKeyFormat = keyformat.NewFastPrefixFormatter('b', int32Size) // b<page>
+
+// bloomFilter is the filter of the keys of a tree consulted by Get and Has, see the
+// BloomFilterKeys option. Keys are only ever added, when they are set in the working tree, so it
+// holds the keys of every version from fromVersion, the latest version it was built from, to
+// toVersion, the latest version saved with it, and of the working tree. The bits are read and
+// set atomically, so that the readers of the saved versions don't wait for the writer.
+type bloomFilter struct {
+	words       []uint64
+	fromVersion int64
+	toVersion   atomic.Int64
+
+	mtx   sync.Mutex
+	dirty map[uint32]struct{} // Pages changed since the last SaveVersion.
+}
+
+// newBloomFilter returns an empty filter sized for the given number of keys.
+func newBloomFilter(keys int, fromVersion int64) *bloomFilter {
+	pages := (keys*bloomFilterBitsPerKey + bloomFilterPageSize*8 - 1) / (bloomFilterPageSize * 8)
+	if pages == 0 {
+		pages = 1
+	}
+	f := &bloomFilter{
+		words:       make([]uint64, pages*bloomFilterPageWords),
+		fromVersion: fromVersion,
+		dirty:       make(map[uint32]struct{}),
+	}
+	f.toVersion.Store(fromVersion)
+	return f
+}
+
+// bloomHash returns the two hashes of key the bits of the filter are derived from: FNV-1a,
+// whose bits are then mixed as by splitmix64, and a second hash derived from it.
+func bloomHash(key []byte) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h, h>>32 | h<<32 | 1
+}
+
+// add adds key to the filter.
+func (f *bloomFilter) add(key []byte) {
+	bits := uint64(len(f.words)) * 64
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < bloomFilterHashes; i++ {
+		bit := (h1 + i*h2) % bits
+		word, mask := &f.words[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 {
+				break
+			}
+			if atomic.CompareAndSwapUint64(word, old, old|mask) {
+				f.mtx.Lock()
+				f.dirty[uint32(bit/64/bloomFilterPageWords)] = struct{}{}
+				f.mtx.Unlock()
+				break
+			}
+		}
+	}
+}
+
+// mayContain returns false if key was never added to the filter.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	bits := uint64(len(f.words)) * 64
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < bloomFilterHashes; i++ {
+		bit := (h1 + i*h2) % bits
+		if atomic.LoadUint64(&f.words[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// covers returns whether the filter holds all the keys of the given version.
+func (f *bloomFilter) covers(version int64) bool {
+	return version >= f.fromVersion && version <= f.toVersion.Load()
+}
+
+// page returns the encoding of the given page.
+func (f *bloomFilter) page(page uint32) []byte {
+	bz := make([]byte, bloomFilterPageSize)
+	for i := 0; i < bloomFilterPageWords; i++ {
+		binary.BigEndian.PutUint64(bz[i*8:], atomic.LoadUint64(&f.words[int(page)*bloomFilterPageWords+i]))
+	}
+	return bz
+}
+
+// header returns the encoding of the filter metadata, for toVersion.
+func (f *bloomFilter) header(toVersion int64) []byte {
+	bz := make([]byte, bloomFilterHeaderLen)
+	binary.BigEndian.PutUint64(bz, uint64(f.fromVersion))
+	binary.BigEndian.PutUint64(bz[int64Size:], uint64(toVersion))
+	binary.BigEndian.PutUint64(bz[2*int64Size:], uint64(len(f.words)/bloomFilterPageWords))
+	bz[3*int64Size] = bloomFilterHashes
+	return bz
+}
+
+// bloomMayContain returns false if the bloom filter tells that key isn't in the tree of the
+// given version, and true if it may be or if there is no filter of the version.
+func (ndb *nodeDB) bloomMayContain(version int64, key []byte) bool {
+	f := ndb.bloom.Load()
+	if f == nil || !f.covers(version) || f.mayContain(key) {
+		return true
+	}
+	ndb.opts.Stat.IncBloomFilterNegativeCnt()
+	return false
+}
+
+// addToBloomFilter adds a key set in the working tree to the bloom filter, if any.
+func (ndb *nodeDB) addToBloomFilter(key []byte) {
+	if f := ndb.bloom.Load(); f != nil {
+		f.add(key)
+	}
+}
+
+// saveBloomFilter adds the pages of the bloom filter changed since the last version to the
+// batch, along with its metadata for the given version, so that it is written atomically with
+// the version. See bloomFilterSaved once the version is committed.
+func (ndb *nodeDB) saveBloomFilter(version int64) error {
+	if f := ndb.bloom.Load(); f != nil {
+		return ndb.writeBloomFilter(f, version)
+	}
+	return nil
+}
+
+// writeBloomFilter adds the changed pages of f and its metadata for version to the batch.
+func (ndb *nodeDB) writeBloomFilter(f *bloomFilter, version int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for page := range f.dirty {
+		if err := ndb.batch.Set(bloomFilterPageKeyFormat.Key(binary.BigEndian.AppendUint32(nil, page)), f.page(page)); err != nil {
+			return err
+		}
+	}
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(bloomFilterKey)), f.header(version))
+}
+
+// bloomFilterSaved extends the bloom filter to the given version, once it is committed.
+func (ndb *nodeDB) bloomFilterSaved(version int64) {
+	f := ndb.bloom.Load()
+	if f == nil {
+		return
+	}
+	f.mtx.Lock()
+	clear(f.dirty)
+	f.mtx.Unlock()
+	f.toVersion.Store(version)
+}
+
+// dropBloomFilter discards the bloom filter, e.g. when versions are deleted from the latest one,
+// since the versions saved again in their place may hold keys it lacks. It is rebuilt by the
+// next load.
+func (ndb *nodeDB) dropBloomFilter() error {
+	ndb.bloom.Store(nil)
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Delete(metadataKeyFormat.Key([]byte(bloomFilterKey)))
+}
+
+// syncBloomFilter loads the bloom filter of the BloomFilterKeys option, or rebuilds it from the
+// latest version if it doesn't match the latest version or the option, e.g. when the option was
+// just enabled or the versions were saved without it.
+func (tree *MutableTree) syncBloomFilter() error {
+	if tree.ndb.opts.BloomFilterKeys <= 0 {
+		return nil
+	}
+	latest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	f, err := tree.ndb.loadBloomFilter(latest)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		if f, err = tree.ndb.rebuildBloomFilter(latest); err != nil {
+			return err
+		}
+	}
+	tree.ndb.bloom.Store(f)
+	return nil
+}
+
+// loadBloomFilter returns the bloom filter stored in the DB, or nil if there is none for the
+// given latest version and the BloomFilterKeys option.
+func (ndb *nodeDB) loadBloomFilter(latest int64) (*bloomFilter, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(bloomFilterKey)))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	if len(bz) != bloomFilterHeaderLen {
+		return nil, fmt.Errorf("invalid bloom filter header %X", bz)
+	}
+	from := int64(binary.BigEndian.Uint64(bz))
+	to := int64(binary.BigEndian.Uint64(bz[int64Size:]))
+	pages := binary.BigEndian.Uint64(bz[2*int64Size:])
+	f := newBloomFilter(ndb.opts.BloomFilterKeys, from)
+	if to != latest || from > latest || pages != uint64(len(f.words)/bloomFilterPageWords) || bz[3*int64Size] != bloomFilterHashes {
+		return nil, nil
+	}
+	f.toVersion.Store(to)
+
+	if err := ndb.traversePrefix(bloomFilterPageKeyFormat.Prefix(), func(k, v []byte) error {
+		if len(k) != 1+int32Size || len(v) != bloomFilterPageSize {
+			return fmt.Errorf("invalid bloom filter page %X", k)
+		}
+		page := uint64(binary.BigEndian.Uint32(k[1:]))
+		if page >= pages {
+			return nil
+		}
+		for i := 0; i < bloomFilterPageWords; i++ {
+			f.words[page*bloomFilterPageWords+uint64(i)] = binary.BigEndian.Uint64(v[i*8:])
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// rebuildBloomFilter replaces the bloom filter in the DB with a filter of the keys of the given
+// latest version, and commits.
+func (ndb *nodeDB) rebuildBloomFilter(latest int64) (*bloomFilter, error) {
+	ndb.logger.Info("bloom filter rebuild started", "version", latest)
+
+	// the header is deleted ahead of the pages, in case the batch is flushed.
+	ndb.mtx.Lock()
+	err := ndb.batch.Delete(metadataKeyFormat.Key([]byte(bloomFilterKey)))
+	ndb.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := ndb.traversePrefix(bloomFilterPageKeyFormat.Prefix(), func(k, _ []byte) error {
+		ndb.mtx.Lock()
+		defer ndb.mtx.Unlock()
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return nil, err
+	}
+
+	f := newBloomFilter(ndb.opts.BloomFilterKeys, latest)
+	var added uint64
+	if latest > 0 {
+		t := &ImmutableTree{ndb: ndb, version: latest, skipFastStorageUpgrade: true}
+		rootKey, err := ndb.GetRoot(latest)
+		if err != nil {
+			return nil, err
+		}
+		if rootKey != nil {
+			if t.root, err = ndb.GetNode(rootKey); err != nil {
+				return nil, err
+			}
+		}
+		itr := NewIterator(nil, nil, true, t)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			f.add(itr.Key())
+			added++
+		}
+		if err := itr.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ndb.writeBloomFilter(f, latest); err != nil {
+		return nil, err
+	}
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+	clear(f.dirty)
+
+	ndb.logger.Info("bloom filter rebuild finished", "keys", added)
+	return f, nil
+}
@@ -0,0 +1,99 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestBloomFilter(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%04d", i)) }
+	stat := &Statistics{}
+	open := func(db dbm.DB, options ...Option) *MutableTree {
+		tree := NewMutableTree(db, 0, false, log.NewNopLogger(), append([]Option{StatOption(stat)}, options...)...)
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	// requireKeys checks the even keys of tree below n but key 1, which is checked apart, and
+	// that most of the absent keys are answered by the filter.
+	type reader interface {
+		Get(key []byte) ([]byte, error)
+		Has(key []byte) (bool, error)
+	}
+	requireKeys := func(tree reader, n int) {
+		stat.Reset()
+		for i := 0; i < n; i++ {
+			if i == 1 {
+				continue
+			}
+			value, err := tree.Get(key(i))
+			require.NoError(t, err)
+			has, err := tree.Has(key(i))
+			require.NoError(t, err)
+			require.Equal(t, i%2 == 0, value != nil, i)
+			require.Equal(t, i%2 == 0, has, i)
+		}
+		require.Greater(t, stat.GetBloomFilterNegativeCnt(), uint64(n*9/10))
+	}
+
+	// version 1 is saved without the filter, with a key removed by version 2.
+	db := dbm.NewMemDB()
+	tree := open(db)
+	for i := 0; i < 1000; i += 2 {
+		_, err := tree.Set(key(i), []byte{1})
+		require.NoError(t, err)
+	}
+	_, err := tree.Set(key(1), []byte{1})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove(key(1))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the filter is built from version 2, and serves the working tree and the next versions.
+	tree = open(db, BloomFilterKeysOption(1000))
+	requireKeys(tree, 1000)
+	for i := 1000; i < 2000; i += 2 {
+		_, err := tree.Set(key(i), []byte{1})
+		require.NoError(t, err)
+	}
+	requireKeys(tree, 2000)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	requireKeys(itree, 2000)
+	itree, err = tree.GetImmutable(1)
+	require.NoError(t, err)
+	stat.Reset()
+	value, err := itree.Get(key(1))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	require.Zero(t, stat.GetBloomFilterNegativeCnt())
+
+	// the filter is loaded along with the tree.
+	tree = open(db, BloomFilterKeysOption(1000))
+	require.Equal(t, int64(2), tree.ndb.bloom.Load().fromVersion)
+	requireKeys(tree, 2000)
+
+	// it is rebuilt when the versions it covers are deleted.
+	require.NoError(t, tree.LoadVersionForOverwriting(1))
+	require.Equal(t, int64(1), tree.ndb.bloom.Load().fromVersion)
+	value, err = tree.Get(key(1))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	requireKeys(tree, 1000)
+
+	// and when its size changes.
+	tree = open(db, BloomFilterKeysOption(100000))
+	require.Equal(t, int64(1), tree.ndb.bloom.Load().fromVersion)
+	require.Len(t, tree.ndb.bloom.Load().words, 31*bloomFilterPageWords)
+	requireKeys(tree, 1000)
+}
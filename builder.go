@@ -0,0 +1,163 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// Builder builds the first version of an empty tree from its keys and values in ascending key
+// order, e.g. the genesis state of a chain, much faster than setting them one at a time. It is
+// created by MutableTree.Build. Users must call Close() when done.
+//
+// The tree is built bottom-up as the pairs are added, without any rotation: each node splits its
+// leaves evenly between its children, the left one taking the extra leaf, so that its shape only
+// depends on the number of pairs, and the same pairs always give the same root hash. The nodes
+// are written once, by an Importer, keeping only the path to the next leaf in memory.
+//
+// The number of pairs must be known up front, e.g. from the genesis file: the shape depends on
+// it down to the first leaves, which are written as soon as their parent is complete, so a
+// stream of unknown length could only be built this way by buffering it whole. Setting the
+// pairs instead needs no count, but rebalances the tree.
+//
+// Builder is not concurrency-safe, it is the caller's responsibility to ensure the tree is not
+// modified while building it.
+type Builder struct {
+	inner   *Importer
+	version int64
+	count   int64
+	added   int64
+	last    []byte
+	frames  []builderFrame // subtrees from the root to the next leaf
+}
+
+// builderFrame is a subtree of a Builder being built, whose left child is built once hasLeft is
+// set.
+type builderFrame struct {
+	size       int64
+	hasLeft    bool
+	leftKey    []byte // smallest key of the left child
+	leftHeight int8
+}
+
+// Build returns a builder of the first version of the tree, which must be empty as for Import,
+// from the given number of pairs. The version is 1, or the InitialVersion option if set.
+func (tree *MutableTree) Build(count int64) (*Builder, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("negative number of pairs %d: %w", count, ErrInvalidInputs)
+	}
+	version := tree.WorkingVersion()
+	importer, err := tree.Import(version)
+	if err != nil {
+		return nil, err
+	}
+	b := &Builder{inner: importer, version: version, count: count}
+	if count > 0 {
+		b.frames = append(b.frames, builderFrame{size: count})
+		b.descend()
+	}
+	return b, nil
+}
+
+// BuildFromIterator builds the first version of the tree, which must be empty, from the count
+// pairs of itr in ascending key order, and commits it, see Build. It fails if itr doesn't have
+// exactly count pairs. It doesn't close itr.
+func (tree *MutableTree) BuildFromIterator(itr dbm.Iterator, count int64) error {
+	b, err := tree.Build(count)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	for ; itr.Valid(); itr.Next() {
+		// the builder keeps the keys and values, which the iterator may reuse.
+		if err := b.Add(bytes.Clone(itr.Key()), bytes.Clone(itr.Value())); err != nil {
+			return err
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// descend pushes the left subtrees of the top frame down to the next leaf.
+func (b *Builder) descend() {
+	for size := b.frames[len(b.frames)-1].size; size > 1; size -= size / 2 {
+		b.frames = append(b.frames, builderFrame{size: size - size/2})
+	}
+}
+
+// Add adds the next pair, whose key must follow the key of the previous one. The key and value
+// must not be modified after this call, as for MutableTree.Set. The nodes are periodically
+// flushed to the database, but the version is not visible until Commit() is called.
+func (b *Builder) Add(key, value []byte) error {
+	if b.inner == nil {
+		return ErrNoImport
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if value == nil {
+		return fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	if b.added == b.count {
+		return fmt.Errorf("more than the %d pairs of the builder: %w", b.count, ErrInvalidInputs)
+	}
+	if b.last != nil && b.inner.tree.ndb.compare(key, b.last) <= 0 {
+		return fmt.Errorf("key %X is not after %X: %w", key, b.last, ErrInvalidInputs)
+	}
+
+	if err := b.inner.Add(&ExportNode{Key: key, Value: value, Version: b.version}); err != nil {
+		return err
+	}
+	b.last = key
+	b.added++
+
+	// the subtrees completed by the leaf are added, up to the first one it is the left child of.
+	minKey, height := key, int8(0)
+	for {
+		b.frames = b.frames[:len(b.frames)-1]
+		if len(b.frames) == 0 {
+			return nil
+		}
+		parent := &b.frames[len(b.frames)-1]
+		if !parent.hasLeft {
+			parent.hasLeft, parent.leftKey, parent.leftHeight = true, minKey, height
+			b.frames = append(b.frames, builderFrame{size: parent.size / 2})
+			b.descend()
+			return nil
+		}
+		// an inner node is keyed by the smallest key of its right child.
+		height = maxInt8(parent.leftHeight, height) + 1
+		if err := b.inner.Add(&ExportNode{Key: minKey, Version: b.version, Height: height}); err != nil {
+			return err
+		}
+		minKey = parent.leftKey
+	}
+}
+
+// Commit finalizes the build once all the pairs are added, writing the version and loading the
+// tree at it, see Importer.Commit. It can only be called once, and calls Close() internally.
+func (b *Builder) Commit() error {
+	if b.inner == nil {
+		return ErrNoImport
+	}
+	if b.added != b.count {
+		return fmt.Errorf("%d of the %d pairs of the builder added: %w", b.added, b.count, ErrInvalidInputs)
+	}
+	if err := b.inner.Commit(); err != nil {
+		return err
+	}
+	b.Close()
+	return nil
+}
+
+// Close frees all resources. It is safe to call multiple times. Uncommitted nodes may already have
+// been flushed to the database, but will not be visible.
+func (b *Builder) Close() {
+	if b.inner != nil {
+		b.inner.Close()
+	}
+	b.inner = nil
+}
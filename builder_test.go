@@ -0,0 +1,120 @@
+package iavl
+
+import (
+	"fmt"
+	"math/bits"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestBuilder(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%04d", i)) }
+	build := func(count int, options ...Option) *MutableTree {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), options...)
+		builder, err := tree.Build(int64(count))
+		require.NoError(t, err)
+		defer builder.Close()
+		for i := 0; i < count; i++ {
+			require.NoError(t, builder.Add(key(i), []byte{byte(i)}))
+		}
+		require.NoError(t, builder.Commit())
+		return tree
+	}
+	// requireBalanced checks that the subtree of node is an AVL tree of minimal height.
+	var requireBalanced func(tree *MutableTree, node *Node)
+	requireBalanced = func(tree *MutableTree, node *Node) {
+		require.EqualValues(t, bits.Len64(uint64(node.size-1)), node.subtreeHeight)
+		if node.isLeaf() {
+			return
+		}
+		balance, err := node.calcBalance(tree.ImmutableTree)
+		require.NoError(t, err)
+		require.LessOrEqual(t, balance, 1)
+		require.GreaterOrEqual(t, balance, -1)
+		for _, get := range []func(*ImmutableTree) (*Node, error){node.getLeftNode, node.getRightNode} {
+			child, err := get(tree.ImmutableTree)
+			require.NoError(t, err)
+			requireBalanced(tree, child)
+		}
+	}
+
+	for _, count := range []int{0, 1, 2, 3, 7, 8, 9, 1000} {
+		tree := build(count)
+		require.EqualValues(t, 1, tree.Version())
+		require.Equal(t, build(count).Hash(), tree.Hash(), "same pairs, same root hash")
+		if count == 0 {
+			require.Nil(t, tree.root)
+			continue
+		}
+		requireBalanced(tree, tree.root)
+		for i := 0; i < count; i++ {
+			value, err := tree.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(i)}, value)
+		}
+		// the built version is followed by the usual ones.
+		_, err := tree.Set(key(count), []byte{1})
+		require.NoError(t, err)
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, 2, version)
+	}
+
+	tree := build(3, InitialVersionOption(10))
+	require.EqualValues(t, 10, tree.Version())
+
+	// the pairs must be sorted, and as many as announced.
+	builder, err := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).Build(2)
+	require.NoError(t, err)
+	defer builder.Close()
+	require.NoError(t, builder.Add(key(1), []byte{1}))
+	require.ErrorIs(t, builder.Add(key(1), []byte{1}), ErrInvalidInputs)
+	require.ErrorIs(t, builder.Add(key(0), []byte{1}), ErrInvalidInputs)
+	require.ErrorIs(t, builder.Commit(), ErrInvalidInputs)
+	require.NoError(t, builder.Add(key(2), []byte{1}))
+	require.ErrorIs(t, builder.Add(key(3), []byte{1}), ErrInvalidInputs)
+	require.NoError(t, builder.Commit())
+	require.ErrorIs(t, builder.Add(key(4), []byte{1}), ErrNoImport)
+
+	_, err = tree.Build(1)
+	require.Error(t, err, "the tree isn't empty")
+}
+
+func TestBuildFromIterator(t *testing.T) {
+	db := dbm.NewMemDB()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte{byte(i)}))
+	}
+	build := func(count int64, ascending bool) (*MutableTree, error) {
+		itr, err := db.Iterator(nil, nil)
+		if !ascending {
+			itr, err = db.ReverseIterator(nil, nil)
+		}
+		require.NoError(t, err)
+		defer itr.Close()
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+		return tree, tree.BuildFromIterator(itr, count)
+	}
+
+	tree, err := build(100, true)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, tree.Version())
+	require.EqualValues(t, 100, tree.Size())
+	for i := 0; i < 100; i++ {
+		value, err := tree.Get([]byte(fmt.Sprintf("key-%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, value)
+	}
+
+	// the pairs must be sorted, and as many as announced.
+	_, err = build(100, false)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	for _, count := range []int64{99, 101} {
+		_, err = build(count, true)
+		require.ErrorIs(t, err, ErrInvalidInputs, count)
+	}
+}
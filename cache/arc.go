@@ -0,0 +1,190 @@
+package cache
+
+import "fmt"
+
+// arcCache is an Adaptive Replacement Cache, see "ARC: A Self-Tuning, Low Overhead Replacement
+// Cache" by Megiddo and Modha. It holds the nodes accessed once since they were added in t1,
+// and the ones accessed again in t2, both LRU lists, and remembers the keys recently evicted
+// from each in the ghost lists b1 and b2. The target size p of t1 grows when a key of b1 is
+// added again, and shrinks when a key of b2 is, so that the cache adapts to the workload, and
+// a scan only evicts nodes from t1 once p has shrunk.
+//
+// arcCache is not safe for concurrent use, callers must synchronize access.
+type arcCache struct {
+	maxElementCount int
+	p               int
+	t1, t2          *segment
+	b1, b2          *segment
+}
+
+var (
+	_ Cache              = (*arcCache)(nil)
+	_ ConsistencyChecker = (*arcCache)(nil)
+	_ Enumerator         = (*arcCache)(nil)
+	_ Resetter           = (*arcCache)(nil)
+	_ Bounded            = (*arcCache)(nil)
+)
+
+// NewARC returns a Cache of at most maxElementCount nodes evicting them by the ARC policy, which
+// is scan-resistant, see Policy. It also remembers the keys of the recently evicted nodes, up to
+// 2*maxElementCount keys with the ones of the cached nodes.
+func NewARC(maxElementCount int) Cache {
+	return &arcCache{
+		maxElementCount: maxElementCount,
+		t1:              newSegment(),
+		t2:              newSegment(),
+		b1:              newSegment(),
+		b2:              newSegment(),
+	}
+}
+
+// Add adds node to the cache, to t2 if its key was recently evicted, and returns the node it
+// evicted, if any, or the replaced node if the key was cached.
+func (c *arcCache) Add(node Node) Node {
+	if c.maxElementCount <= 0 {
+		return node
+	}
+	key := node.GetKey()
+	if elem := c.t1.get(key); elem != nil {
+		e := c.t1.remove(elem)
+		old := e.node
+		e.node = node
+		c.t2.pushFront(e)
+		return old
+	}
+	if elem := c.t2.get(key); elem != nil {
+		e := elem.Value.(*entry)
+		old := e.node
+		e.node = node
+		c.t2.ll.MoveToFront(elem)
+		return old
+	}
+
+	var evicted Node
+	if elem := c.b1.get(key); elem != nil {
+		c.p = min(c.maxElementCount, c.p+max(c.b2.len()/c.b1.len(), 1))
+		c.b1.remove(elem)
+		evicted = c.replace(false)
+		c.t2.pushFront(&entry{key: string(key), node: node})
+		return evicted
+	}
+	if elem := c.b2.get(key); elem != nil {
+		c.p = max(0, c.p-max(c.b1.len()/c.b2.len(), 1))
+		c.b2.remove(elem)
+		evicted = c.replace(true)
+		c.t2.pushFront(&entry{key: string(key), node: node})
+		return evicted
+	}
+
+	if c.t1.len()+c.b1.len() >= c.maxElementCount {
+		if c.t1.len() < c.maxElementCount {
+			c.b1.removeBack()
+			evicted = c.replace(false)
+		} else {
+			evicted = c.t1.removeBack().node
+		}
+	} else if total := c.t1.len() + c.t2.len() + c.b1.len() + c.b2.len(); total >= c.maxElementCount {
+		if total >= 2*c.maxElementCount {
+			c.b2.removeBack()
+		}
+		evicted = c.replace(false)
+	}
+	c.t1.pushFront(&entry{key: string(key), node: node})
+	return evicted
+}
+
+// replace evicts the least recently used node of t1 or t2 to its ghost list if the cache is
+// full, depending on the target size of t1, and returns it. inB2 tells whether the key being
+// added is in b2.
+func (c *arcCache) replace(inB2 bool) Node {
+	if c.t1.len()+c.t2.len() < c.maxElementCount {
+		return nil
+	}
+	if c.t2.len() == 0 || (c.t1.len() > 0 && (c.t1.len() > c.p || (inB2 && c.t1.len() == c.p))) {
+		e := c.t1.removeBack()
+		c.b1.pushFront(&entry{key: e.key})
+		return e.node
+	}
+	e := c.t2.removeBack()
+	c.b2.pushFront(&entry{key: e.key})
+	return e.node
+}
+
+// Get returns the node with the key, moving it to the front of t2.
+func (c *arcCache) Get(key []byte) Node {
+	if elem := c.t1.get(key); elem != nil {
+		e := c.t1.remove(elem)
+		c.t2.pushFront(e)
+		return e.node
+	}
+	if elem := c.t2.get(key); elem != nil {
+		c.t2.ll.MoveToFront(elem)
+		return elem.Value.(*entry).node
+	}
+	return nil
+}
+
+func (c *arcCache) Has(key []byte) bool {
+	return c.t1.get(key) != nil || c.t2.get(key) != nil
+}
+
+// Remove removes the node with the key, and forgets the key if it was evicted.
+func (c *arcCache) Remove(key []byte) Node {
+	if elem := c.t1.get(key); elem != nil {
+		return c.t1.remove(elem).node
+	}
+	if elem := c.t2.get(key); elem != nil {
+		return c.t2.remove(elem).node
+	}
+	if elem := c.b1.get(key); elem != nil {
+		c.b1.remove(elem)
+	} else if elem := c.b2.get(key); elem != nil {
+		c.b2.remove(elem)
+	}
+	return nil
+}
+
+func (c *arcCache) Len() int {
+	return c.t1.len() + c.t2.len()
+}
+
+func (c *arcCache) MaxLen() int {
+	return c.maxElementCount
+}
+
+// Nodes returns the nodes of t2, then the ones of t1, each from the most to the least recently
+// used, so that the nodes accessed again are kept by a smaller cache they are migrated to.
+func (c *arcCache) Nodes() []Node {
+	return c.t1.nodes(c.t2.nodes(make([]Node, 0, c.Len())))
+}
+
+func (c *arcCache) Reset() {
+	for _, s := range []*segment{c.t1, c.t2, c.b1, c.b2} {
+		s.reset()
+	}
+	c.p = 0
+}
+
+// ConsistencyCheck verifies that the lists match their indices, that a key is in one of them
+// at most, and that they are bounded as by the ARC policy.
+func (c *arcCache) ConsistencyCheck() error {
+	seen := make(map[string]struct{})
+	for i, s := range []*segment{c.t1, c.t2, c.b1, c.b2} {
+		if err := s.check([]string{"t1", "t2", "b1", "b2"}[i], seen); err != nil {
+			return err
+		}
+	}
+	if n := c.Len(); n > c.maxElementCount {
+		return fmt.Errorf("cache has %d nodes, more than the maximum of %d", n, c.maxElementCount)
+	}
+	if n := c.t1.len() + c.b1.len(); n > c.maxElementCount {
+		return fmt.Errorf("t1 and b1 have %d keys, more than the maximum of %d", n, c.maxElementCount)
+	}
+	if n := c.Len() + c.b1.len() + c.b2.len(); n > 2*c.maxElementCount {
+		return fmt.Errorf("cache has %d keys, more than the maximum of %d", n, 2*c.maxElementCount)
+	}
+	if c.p < 0 || c.p > c.maxElementCount {
+		return fmt.Errorf("target size %d of t1 is out of [0, %d]", c.p, c.maxElementCount)
+	}
+	return nil
+}
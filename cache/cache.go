@@ -2,6 +2,8 @@ package cache
 
 import (
 	"container/list"
+	"fmt"
+	"math"
 
 	ibytes "github.com/cosmos/iavl/internal/bytes"
 )
@@ -34,49 +36,149 @@ type Cache interface {
 	Len() int
 }
 
+// ConsistencyChecker is implemented by caches able to verify their internal
+// bookkeeping. It is meant for tests and debugging.
+type ConsistencyChecker interface {
+	// ConsistencyCheck returns an error describing the first inconsistency
+	// found in the internal state of the cache, nil if there is none.
+	ConsistencyCheck() error
+}
+
+// Enumerator is implemented by caches able to list their nodes, e.g. to
+// migrate them to another cache.
+type Enumerator interface {
+	// Nodes returns the cached nodes, from the most to the least recently used.
+	Nodes() []Node
+}
+
+// KeyLister is implemented by caches able to list the keys of their nodes,
+// e.g. to dump them when debugging.
+type KeyLister interface {
+	// Keys returns the keys of the cached nodes, from the most to the least
+	// recently used.
+	Keys() [][]byte
+}
+
+// Resetter is implemented by caches able to remove all their nodes at once,
+// keeping the memory they allocated for reuse.
+type Resetter interface {
+	// Reset removes all the nodes from the cache.
+	Reset()
+}
+
+// SizedNode represents a node reporting its encoded size, so that it can be cached by a cache
+// with a bytes limit, see NewWithBytesLimit.
+type SizedNode interface {
+	Node
+	EncodedSize() int
+}
+
+// ByteBounded is implemented by caches holding a bounded number of bytes of nodes.
+type ByteBounded interface {
+	// MaxBytes returns the maximum total encoded size of the nodes the cache holds.
+	MaxBytes() int64
+
+	// Bytes returns the total encoded size of the cached nodes.
+	Bytes() int64
+}
+
+// Bounded is implemented by caches holding a bounded number of nodes, e.g. so
+// that a preload doesn't evict the nodes it loaded.
+type Bounded interface {
+	// MaxLen returns the maximum number of nodes the cache holds.
+	MaxLen() int
+}
+
 // lruCache is an LRU cache implementation.
 // The motivation for using a custom cache implementation is to
 // allow for a custom max policy.
 //
-// Currently, the cache maximum is implemented in terms of the
-// number of nodes which is not intuitive to configure.
-// Instead, we are planning to add a byte maximum.
+// The cache maximum is implemented in terms of the number of nodes,
+// which is not intuitive to configure, and optionally of the total
+// encoded size of the nodes, see NewWithBytesLimit.
 // The alternative implementations do not allow for
 // customization and the ability to estimate the byte
 // size of the cache.
+//
+// lruCache is not safe for concurrent use, callers must synchronize access
+// (nodeDB guards its caches with its mutex).
 type lruCache struct {
 	dict            map[string]*list.Element // FastNode cache.
 	maxElementCount int                      // FastNode the maximum number of nodes in the cache.
 	ll              *list.List               // LRU queue of cache elements. Used for deletion.
+	maxBytes        int64                    // the maximum total encoded size of the nodes, none if 0.
+	bytes           int64                    // the total encoded size of the nodes, if maxBytes is set.
 }
 
-var _ Cache = (*lruCache)(nil)
+var (
+	_ Cache              = (*lruCache)(nil)
+	_ ConsistencyChecker = (*lruCache)(nil)
+	_ Enumerator         = (*lruCache)(nil)
+	_ KeyLister          = (*lruCache)(nil)
+	_ Resetter           = (*lruCache)(nil)
+	_ Bounded            = (*lruCache)(nil)
+	_ ByteBounded        = (*lruCache)(nil)
+)
 
 func New(maxElementCount int) Cache {
+	return NewWithLimits(maxElementCount, 0)
+}
+
+// NewWithBytesLimit returns a Cache of nodes whose total encoded size is at most maxBytes,
+// evicting the least recently used ones.
+// CONTRACT: the added nodes must implement SizedNode. Otherwise, cache panics.
+func NewWithBytesLimit(maxBytes int64) Cache {
+	return NewWithLimits(math.MaxInt, maxBytes)
+}
+
+// NewWithLimits returns a Cache of at most maxElementCount nodes, whose total encoded size is
+// at most maxBytes, evicting the least recently used ones when either limit is exceeded. A
+// maxBytes of 0 is no bytes limit, as for New.
+// CONTRACT: the added nodes must implement SizedNode if maxBytes is set. Otherwise, cache panics.
+func NewWithLimits(maxElementCount int, maxBytes int64) Cache {
 	return &lruCache{
 		dict:            make(map[string]*list.Element),
 		maxElementCount: maxElementCount,
 		ll:              list.New(),
+		maxBytes:        maxBytes,
 	}
 }
 
+// Add adds node to the cache. With a bytes limit, several nodes may be evicted to make room for
+// it, and the last one evicted is returned, or the replaced node if the key was cached.
 func (c *lruCache) Add(node Node) Node {
 	key := node.GetKey()
 	if e, exists := c.dict[string(key)]; exists {
 		c.ll.MoveToFront(e)
-		old := e.Value
+		old := e.Value.(Node)
 		e.Value = node
-		return old.(Node)
+		c.bytes += c.sizeOf(node) - c.sizeOf(old)
+		c.evict()
+		return old
 	}
 
 	elem := c.ll.PushFront(node)
 	c.dict[string(key)] = elem
+	c.bytes += c.sizeOf(node)
+	return c.evict()
+}
 
-	if c.ll.Len() > c.maxElementCount {
-		oldest := c.ll.Back()
-		return c.remove(oldest)
+// evict removes the least recently used nodes while a limit is exceeded, and returns the last
+// one removed, if any.
+func (c *lruCache) evict() Node {
+	var evicted Node
+	for c.ll.Len() > c.maxElementCount || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		evicted = c.remove(c.ll.Back())
 	}
-	return nil
+	return evicted
+}
+
+// sizeOf returns the encoded size of node, if the cache has a bytes limit. 0 otherwise.
+func (c *lruCache) sizeOf(node Node) int64 {
+	if c.maxBytes <= 0 {
+		return 0
+	}
+	return int64(node.(SizedNode).EncodedSize())
 }
 
 func (c *lruCache) Get(key []byte) Node {
@@ -96,6 +198,18 @@ func (c *lruCache) Len() int {
 	return c.ll.Len()
 }
 
+func (c *lruCache) MaxLen() int {
+	return c.maxElementCount
+}
+
+func (c *lruCache) MaxBytes() int64 {
+	return c.maxBytes
+}
+
+func (c *lruCache) Bytes() int64 {
+	return c.bytes
+}
+
 func (c *lruCache) Remove(key []byte) Node {
 	if elem, exists := c.dict[string(key)]; exists {
 		return c.removeWithKey(elem, string(key))
@@ -103,14 +217,79 @@ func (c *lruCache) Remove(key []byte) Node {
 	return nil
 }
 
+func (c *lruCache) Nodes() []Node {
+	nodes := make([]Node, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		nodes = append(nodes, e.Value.(Node))
+	}
+	return nodes
+}
+
+// Keys returns copies of the keys of the cached nodes, from the most to the least recently
+// used, e.g. to dump the cache when debugging. It copies the whole cache, so it is not meant
+// for hot paths, and it is atomic as long as the callers hold the lock they guard the cache
+// with, as for the other methods.
+func (c *lruCache) Keys() [][]byte {
+	keys := make([][]byte, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		keys = append(keys, append([]byte(nil), e.Value.(Node).GetKey()...))
+	}
+	return keys
+}
+
+func (c *lruCache) Reset() {
+	clear(c.dict)
+	c.ll.Init()
+	c.bytes = 0
+}
+
 func (c *lruCache) remove(e *list.Element) Node {
 	removed := c.ll.Remove(e).(Node)
+	c.bytes -= c.sizeOf(removed)
 	delete(c.dict, ibytes.UnsafeBytesToStr(removed.GetKey()))
 	return removed
 }
 
 func (c *lruCache) removeWithKey(e *list.Element, key string) Node {
 	removed := c.ll.Remove(e).(Node)
+	c.bytes -= c.sizeOf(removed)
 	delete(c.dict, key)
 	return removed
 }
+
+// ConsistencyCheck verifies that every element of the LRU list has a matching
+// dict entry and vice versa, that Len() matches the size of both, and that the
+// counted bytes match the nodes.
+func (c *lruCache) ConsistencyCheck() error {
+	if c.ll.Len() != len(c.dict) {
+		return fmt.Errorf("list has %d elements but dict has %d entries", c.ll.Len(), len(c.dict))
+	}
+	if c.Len() != len(c.dict) {
+		return fmt.Errorf("Len() is %d but dict has %d entries", c.Len(), len(c.dict))
+	}
+	if c.ll.Len() > c.maxElementCount {
+		return fmt.Errorf("list has %d elements, more than the maximum of %d", c.ll.Len(), c.maxElementCount)
+	}
+	if c.maxBytes > 0 && c.bytes > c.maxBytes {
+		return fmt.Errorf("nodes have %d bytes, more than the maximum of %d", c.bytes, c.maxBytes)
+	}
+	var bytes int64
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		bytes += c.sizeOf(e.Value.(Node))
+		key := e.Value.(Node).GetKey()
+		if elem, ok := c.dict[string(key)]; !ok {
+			return fmt.Errorf("list element %X has no dict entry", key)
+		} else if elem != e {
+			return fmt.Errorf("dict entry for list element %X points to another element", key)
+		}
+	}
+	if bytes != c.bytes {
+		return fmt.Errorf("nodes have %d bytes but %d are counted", bytes, c.bytes)
+	}
+	for key, elem := range c.dict {
+		if nodeKey := elem.Value.(Node).GetKey(); string(nodeKey) != key {
+			return fmt.Errorf("dict entry %X points to a node with key %X", key, nodeKey)
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package cache_test
 
 import (
 	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/cosmos/iavl/cache"
@@ -67,3 +68,36 @@ func BenchmarkRemove(b *testing.B) {
 		_ = cache.Remove(key)
 	}
 }
+
+func BenchmarkParallelGet(b *testing.B) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = randBytes(20)
+	}
+	caches := map[string]cache.Cache{
+		"lru":     cache.New(len(keys)),
+		"sharded": cache.NewSharded(16, len(keys)),
+	}
+	for name, c := range caches {
+		for _, key := range keys {
+			c.Add(&testNode{key: key})
+		}
+		var mtx sync.Mutex
+		_, concurrent := c.(cache.Concurrent)
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					key := keys[i%len(keys)]
+					// the caches which aren't concurrent are locked by their callers.
+					if concurrent {
+						c.Get(key)
+						continue
+					}
+					mtx.Lock()
+					c.Get(key)
+					mtx.Unlock()
+				}
+			})
+		})
+	}
+}
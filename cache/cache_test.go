@@ -3,6 +3,7 @@ package cache_test
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/cosmos/iavl/cache"
@@ -297,6 +298,43 @@ func validateCacheContentsAfterTest(t *testing.T, tc testcase, cache cache.Cache
 		require.True(t, cache.Has(expectedNode.GetKey()))
 		require.Equal(t, expectedNode, cache.Get(expectedNode.GetKey()))
 	}
+	require.NoError(t, cache.(interface{ ConsistencyCheck() error }).ConsistencyCheck())
+}
+
+func Test_Cache_ConsistencyStress(t *testing.T) {
+	const (
+		workers = 8
+		ops     = 20000
+		keys    = 300
+	)
+	c := cache.New(100)
+	// the cache itself is not safe for concurrent use, mirror the locking done by nodeDB.
+	var mtx sync.Mutex
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := []byte(fmt.Sprintf("%s%d", testKey, (i*(w+1))%keys))
+				mtx.Lock()
+				switch i % 4 {
+				case 0, 1:
+					c.Add(&testNode{key: key})
+				case 2:
+					c.Get(key)
+				case 3:
+					c.Remove(key)
+				}
+				mtx.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, c.Len(), 100)
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
 }
 
 func randBytes(length int) []byte {
@@ -307,3 +345,129 @@ func randBytes(length int) []byte {
 	rand.Read(key) //nolint:errcheck
 	return key
 }
+
+func Test_Cache_Nodes(t *testing.T) {
+	c := cache.New(2)
+	require.Empty(t, c.(cache.Enumerator).Nodes())
+
+	c.Add(testNodes[0])
+	c.Add(testNodes[1])
+	c.Add(testNodes[2]) // evicts testNodes[0]
+	c.Get(testNodes[1].GetKey())
+	require.Equal(t, []cache.Node{testNodes[1], testNodes[2]}, c.(cache.Enumerator).Nodes())
+}
+
+func Test_Cache_Reset(t *testing.T) {
+	c := cache.New(2)
+	c.Add(testNodes[0])
+	c.Add(testNodes[1])
+
+	c.(cache.Resetter).Reset()
+	require.Equal(t, 0, c.Len())
+	require.False(t, c.Has(testNodes[0].GetKey()))
+	require.Nil(t, c.Get(testNodes[1].GetKey()))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// the cache is usable again, with the same capacity.
+	c.Add(testNodes[2])
+	c.Add(testNodes[0])
+	require.Equal(t, testNodes[2], c.Add(testNodes[1]))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+func Test_Cache_MaxLen(t *testing.T) {
+	c := cache.New(2)
+	require.Equal(t, 2, c.(cache.Bounded).MaxLen())
+	c.Add(testNodes[0])
+	c.Add(testNodes[1])
+	c.Add(testNodes[2])
+	require.Equal(t, c.(cache.Bounded).MaxLen(), c.Len())
+}
+
+func Test_Cache_Keys(t *testing.T) {
+	c := cache.New(3)
+	require.Empty(t, c.(cache.KeyLister).Keys())
+
+	c.Add(testNodes[0])
+	c.Add(testNodes[1])
+	c.Add(testNodes[2])
+	c.Get(testNodes[0].GetKey())
+	require.Equal(t, [][]byte{testNodes[0].GetKey(), testNodes[2].GetKey(), testNodes[1].GetKey()}, c.(cache.KeyLister).Keys())
+
+	c.Add(testNodes[1])
+	c.Remove(testNodes[2].GetKey())
+	keys := c.(cache.KeyLister).Keys()
+	require.Equal(t, [][]byte{testNodes[1].GetKey(), testNodes[0].GetKey()}, keys)
+
+	// the keys are copies.
+	keys[0][0] = 'x'
+	require.True(t, c.Has(testNodes[1].GetKey()))
+}
+
+// sizedNode is a testNode reporting its encoded size.
+type sizedNode struct {
+	testNode
+	size int
+}
+
+func (sn *sizedNode) EncodedSize() int {
+	return sn.size
+}
+
+func Test_Cache_BytesLimit(t *testing.T) {
+	node := func(key string, size int) *sizedNode {
+		return &sizedNode{testNode: testNode{key: []byte(key)}, size: size}
+	}
+	c := cache.NewWithBytesLimit(10)
+	a, b, d := node("a", 4), node("b", 4), node("d", 5)
+	require.Nil(t, c.Add(a))
+	require.Nil(t, c.Add(b))
+	require.EqualValues(t, 8, c.(cache.ByteBounded).Bytes())
+	require.EqualValues(t, 10, c.(cache.ByteBounded).MaxBytes())
+
+	// the least recently used nodes are evicted until the nodes fit.
+	c.Get(a.GetKey())
+	require.Same(t, b, c.Add(d))
+	require.True(t, c.Has(a.GetKey()))
+	require.EqualValues(t, 9, c.(cache.ByteBounded).Bytes())
+	require.Same(t, d, c.Add(node("e", 7)))
+	require.False(t, c.Has(a.GetKey()))
+	require.EqualValues(t, 7, c.(cache.ByteBounded).Bytes())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// a replaced node is counted with its new size, and a node larger than the limit isn't kept.
+	replaced := node("e", 2)
+	require.Equal(t, "e", string(c.Add(replaced).GetKey()))
+	require.EqualValues(t, 2, c.(cache.ByteBounded).Bytes())
+	require.Nil(t, c.Add(node("f", 3)))
+	require.EqualValues(t, 5, c.(cache.ByteBounded).Bytes())
+	require.Equal(t, "g", string(c.Add(node("g", 11)).GetKey()))
+	require.Equal(t, 0, c.Len())
+	require.EqualValues(t, 0, c.(cache.ByteBounded).Bytes())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// the removed nodes aren't counted.
+	c.Add(a)
+	c.Add(b)
+	require.Same(t, a, c.Remove(a.GetKey()))
+	require.EqualValues(t, 4, c.(cache.ByteBounded).Bytes())
+	c.(cache.Resetter).Reset()
+	require.EqualValues(t, 0, c.(cache.ByteBounded).Bytes())
+}
+
+func Test_Cache_Limits(t *testing.T) {
+	c := cache.NewWithLimits(2, 100)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Add(&sizedNode{testNode: testNode{key: []byte(key)}, size: 1})
+	}
+	// the count limit is reached before the bytes limit.
+	require.Equal(t, 2, c.Len())
+	require.False(t, c.Has([]byte("a")))
+	require.EqualValues(t, 2, c.(cache.ByteBounded).Bytes())
+
+	c.Add(&sizedNode{testNode: testNode{key: []byte("d")}, size: 99})
+	require.Equal(t, 2, c.Len())
+	require.False(t, c.Has([]byte("b")))
+	require.EqualValues(t, 100, c.(cache.ByteBounded).Bytes())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
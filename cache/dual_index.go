@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// HashedNode represents a node eligible for caching by both its key and its hash.
+type HashedNode interface {
+	Node
+	GetHash() []byte
+}
+
+// DualIndexCache is a Cache whose nodes can also be retrieved by their hash, so that a node
+// looked up both ways is only cached once.
+type DualIndexCache interface {
+	Cache
+
+	// GetByHash returns the Node with the hash, if exists. nil otherwise. If several cached
+	// nodes have the same hash, e.g. a node saved again under another key, the most recently
+	// added one is returned.
+	GetByHash(hash []byte) Node
+}
+
+// dualIndexCache is an lruCache with a second index of its elements by hash. Both indices
+// point to the elements of the same LRU list, so a node is evicted from both at once. The
+// elements of the nodes sharing a hash are indexed in the order they were added.
+//
+// dualIndexCache is not safe for concurrent use, callers must synchronize access.
+type dualIndexCache struct {
+	lruCache
+	byHash map[string][]*list.Element
+}
+
+var (
+	_ DualIndexCache     = (*dualIndexCache)(nil)
+	_ ConsistencyChecker = (*dualIndexCache)(nil)
+	_ Enumerator         = (*dualIndexCache)(nil)
+	_ KeyLister          = (*dualIndexCache)(nil)
+	_ Resetter           = (*dualIndexCache)(nil)
+)
+
+// NewDualIndex returns a DualIndexCache of at most maxElementCount nodes.
+// CONTRACT: the added nodes must implement HashedNode. Otherwise, cache panics.
+func NewDualIndex(maxElementCount int) DualIndexCache {
+	return &dualIndexCache{
+		lruCache: lruCache{
+			dict:            make(map[string]*list.Element),
+			maxElementCount: maxElementCount,
+			ll:              list.New(),
+		},
+		byHash: make(map[string][]*list.Element),
+	}
+}
+
+func (c *dualIndexCache) Add(node Node) Node {
+	hash := node.(HashedNode).GetHash()
+	if e, exists := c.dict[string(node.GetKey())]; exists {
+		c.ll.MoveToFront(e)
+		old := e.Value.(Node)
+		c.unindexHash(e)
+		e.Value = node
+		c.byHash[string(hash)] = append(c.byHash[string(hash)], e)
+		return old
+	}
+
+	elem := c.ll.PushFront(node)
+	c.dict[string(node.GetKey())] = elem
+	c.byHash[string(hash)] = append(c.byHash[string(hash)], elem)
+
+	if c.ll.Len() > c.maxElementCount {
+		return c.remove(c.ll.Back())
+	}
+	return nil
+}
+
+func (c *dualIndexCache) GetByHash(hash []byte) Node {
+	if elems, hit := c.byHash[string(hash)]; hit {
+		ele := elems[len(elems)-1]
+		c.ll.MoveToFront(ele)
+		return ele.Value.(Node)
+	}
+	return nil
+}
+
+func (c *dualIndexCache) Remove(key []byte) Node {
+	if elem, exists := c.dict[string(key)]; exists {
+		return c.remove(elem)
+	}
+	return nil
+}
+
+func (c *dualIndexCache) Reset() {
+	c.lruCache.Reset()
+	clear(c.byHash)
+}
+
+func (c *dualIndexCache) remove(e *list.Element) Node {
+	c.unindexHash(e)
+	return c.lruCache.remove(e)
+}
+
+// unindexHash removes the element from the hash index.
+func (c *dualIndexCache) unindexHash(e *list.Element) {
+	hash := ibytes.UnsafeBytesToStr(e.Value.(HashedNode).GetHash())
+	elems := c.byHash[hash]
+	for i, elem := range elems {
+		if elem == e {
+			elems = append(elems[:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(c.byHash, hash)
+	} else {
+		c.byHash[hash] = elems
+	}
+}
+
+// ConsistencyCheck verifies the key index as lruCache does, and that the hash index has every
+// element of the LRU list exactly once, under the hash of its node.
+func (c *dualIndexCache) ConsistencyCheck() error {
+	if err := c.lruCache.ConsistencyCheck(); err != nil {
+		return err
+	}
+	indexed := make(map[*list.Element]bool, c.ll.Len())
+	for hash, elems := range c.byHash {
+		if len(elems) == 0 {
+			return fmt.Errorf("hash index entry %X is empty", hash)
+		}
+		for _, elem := range elems {
+			if c.dict[string(elem.Value.(Node).GetKey())] != elem {
+				return fmt.Errorf("hash index entry %X points to an element not in the list", hash)
+			}
+			if nodeHash := elem.Value.(HashedNode).GetHash(); string(nodeHash) != hash {
+				return fmt.Errorf("hash index entry %X points to a node with hash %X", hash, nodeHash)
+			}
+			if indexed[elem] {
+				return fmt.Errorf("list element %X is indexed twice", elem.Value.(Node).GetKey())
+			}
+			indexed[elem] = true
+		}
+	}
+	if len(indexed) != c.ll.Len() {
+		return fmt.Errorf("hash index has %d elements but list has %d", len(indexed), c.ll.Len())
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// testHashedNode is the node used for testing the dual index cache.
+type testHashedNode struct {
+	key  []byte
+	hash []byte
+}
+
+func (tn *testHashedNode) GetKey() []byte {
+	return tn.key
+}
+
+func (tn *testHashedNode) GetHash() []byte {
+	return tn.hash
+}
+
+var _ cache.HashedNode = (*testHashedNode)(nil)
+
+func newTestHashedNode(i int) *testHashedNode {
+	return &testHashedNode{key: []byte(fmt.Sprintf("%s%d", testKey, i)), hash: []byte(fmt.Sprintf("hash%d", i))}
+}
+
+func Test_DualIndexCache_Get(t *testing.T) {
+	c := cache.NewDualIndex(3)
+	nodes := []*testHashedNode{newTestHashedNode(0), newTestHashedNode(1), newTestHashedNode(2)}
+	for _, node := range nodes {
+		require.Nil(t, c.Add(node))
+	}
+	require.Equal(t, 3, c.Len())
+	for _, node := range nodes {
+		require.True(t, c.Has(node.key))
+		require.Equal(t, node, c.Get(node.key))
+		require.Equal(t, node, c.GetByHash(node.hash))
+	}
+	require.Nil(t, c.Get(newTestHashedNode(3).key))
+	require.Nil(t, c.GetByHash([]byte("hash3")))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// a node replaced under the same key is only retrievable by its new hash.
+	replaced := &testHashedNode{key: nodes[1].key, hash: []byte("other")}
+	require.Equal(t, nodes[1], c.Add(replaced))
+	require.Equal(t, 3, c.Len())
+	require.Nil(t, c.GetByHash(nodes[1].hash))
+	require.Equal(t, replaced, c.GetByHash(replaced.hash))
+	require.Equal(t, replaced, c.Get(nodes[1].key))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+func Test_DualIndexCache_Evict(t *testing.T) {
+	c := cache.NewDualIndex(2)
+	nodes := []*testHashedNode{newTestHashedNode(0), newTestHashedNode(1), newTestHashedNode(2), newTestHashedNode(3)}
+	c.Add(nodes[0])
+	c.Add(nodes[1])
+
+	// a lookup by hash marks the node as recently used, as a lookup by key does.
+	require.Equal(t, nodes[0], c.GetByHash(nodes[0].hash))
+	require.Equal(t, nodes[1], c.Add(nodes[2]))
+	require.False(t, c.Has(nodes[1].key))
+	require.Nil(t, c.Get(nodes[1].key))
+	require.Nil(t, c.GetByHash(nodes[1].hash))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	require.Equal(t, nodes[0], c.Get(nodes[0].key))
+	require.Equal(t, nodes[2], c.Add(nodes[3]))
+	require.Nil(t, c.Get(nodes[2].key))
+	require.Nil(t, c.GetByHash(nodes[2].hash))
+	require.Equal(t, []cache.Node{nodes[3], nodes[0]}, c.(cache.Enumerator).Nodes())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+func Test_DualIndexCache_Remove(t *testing.T) {
+	c := cache.NewDualIndex(3)
+	nodes := []*testHashedNode{newTestHashedNode(0), newTestHashedNode(1)}
+	c.Add(nodes[0])
+	c.Add(nodes[1])
+
+	require.Equal(t, nodes[0], c.Remove(nodes[0].key))
+	require.Nil(t, c.Remove(nodes[0].key))
+	require.Nil(t, c.Get(nodes[0].key))
+	require.Nil(t, c.GetByHash(nodes[0].hash))
+	require.Equal(t, nodes[1], c.GetByHash(nodes[1].hash))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	c.(cache.Resetter).Reset()
+	require.Equal(t, 0, c.Len())
+	require.Nil(t, c.GetByHash(nodes[1].hash))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+func Test_DualIndexCache_SameHash(t *testing.T) {
+	c := cache.NewDualIndex(2)
+	first := &testHashedNode{key: []byte("first"), hash: []byte("hash")}
+	second := &testHashedNode{key: []byte("second"), hash: []byte("hash")}
+	c.Add(first)
+	c.Add(second)
+
+	// the most recently added node is returned, and the other one once it is removed.
+	require.Equal(t, second, c.GetByHash([]byte("hash")))
+	require.Equal(t, second, c.Remove(second.key))
+	require.Equal(t, first, c.GetByHash([]byte("hash")))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	c.Add(second)
+	c.Add(newTestHashedNode(0)) // evicts first
+	require.Equal(t, []cache.Node{newTestHashedNode(0), second}, c.(cache.Enumerator).Nodes())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+	c.Add(newTestHashedNode(1)) // evicts second
+	require.Nil(t, c.GetByHash([]byte("hash")))
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+func Test_DualIndexCache_ConsistencyStress(t *testing.T) {
+	c := cache.NewDualIndex(50)
+	for i := 0; i < 20000; i++ {
+		// the hashes are shared by a few keys each.
+		node := &testHashedNode{key: []byte(fmt.Sprintf("%s%d", testKey, (i*7)%300)), hash: []byte(fmt.Sprintf("hash%d", (i*13)%100))}
+		switch i % 4 {
+		case 0, 1:
+			c.Add(node)
+		case 2:
+			c.GetByHash(node.hash)
+		case 3:
+			c.Remove(node.key)
+		}
+	}
+	require.LessOrEqual(t, c.Len(), 50)
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// Policy returns a Cache of at most maxElementCount nodes evicting them by an eviction policy.
+// New is the LRU one, but an LRU is emptied by the scans of more nodes than it holds, e.g. the
+// iterations over a range, which evict the hot nodes of the paths from the root. NewARC and
+// New2Q are scan-resistant: they keep the nodes accessed more than once apart from the ones
+// accessed once.
+type Policy func(maxElementCount int) Cache
+
+var (
+	_ Policy = New
+	_ Policy = NewARC
+	_ Policy = New2Q
+)
+
+// entry is an element of a segment: a cached node, or the key of an evicted node in the ghost
+// segments remembering the recently evicted keys.
+type entry struct {
+	key  string
+	node Node
+}
+
+// segment is a list of entries indexed by key, from the most to the least recently inserted or
+// moved to the front, which the policies combine.
+type segment struct {
+	ll   *list.List
+	dict map[string]*list.Element
+}
+
+func newSegment() *segment {
+	return &segment{ll: list.New(), dict: make(map[string]*list.Element)}
+}
+
+func (s *segment) len() int {
+	return s.ll.Len()
+}
+
+func (s *segment) get(key []byte) *list.Element {
+	return s.dict[string(key)]
+}
+
+func (s *segment) pushFront(e *entry) {
+	s.dict[e.key] = s.ll.PushFront(e)
+}
+
+func (s *segment) remove(elem *list.Element) *entry {
+	e := s.ll.Remove(elem).(*entry)
+	delete(s.dict, e.key)
+	return e
+}
+
+func (s *segment) removeBack() *entry {
+	return s.remove(s.ll.Back())
+}
+
+func (s *segment) reset() {
+	clear(s.dict)
+	s.ll.Init()
+}
+
+// nodes appends the nodes of the segment to nodes, from the front.
+func (s *segment) nodes(nodes []Node) []Node {
+	for elem := s.ll.Front(); elem != nil; elem = elem.Next() {
+		nodes = append(nodes, elem.Value.(*entry).node)
+	}
+	return nodes
+}
+
+// check verifies that the list and the index of the segment match, and that none of its keys
+// is in seen, to which they are added.
+func (s *segment) check(name string, seen map[string]struct{}) error {
+	if s.ll.Len() != len(s.dict) {
+		return fmt.Errorf("%s has %d elements but %d indexed", name, s.ll.Len(), len(s.dict))
+	}
+	for elem := s.ll.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry)
+		if s.dict[e.key] != elem {
+			return fmt.Errorf("%s element %X isn't indexed", name, e.key)
+		}
+		if _, ok := seen[e.key]; ok {
+			return fmt.Errorf("%s element %X is in another segment", name, e.key)
+		}
+		seen[e.key] = struct{}{}
+	}
+	return nil
+}
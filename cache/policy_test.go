@@ -0,0 +1,121 @@
+package cache_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+var policies = map[string]cache.Policy{
+	"LRU": cache.New,
+	"ARC": cache.NewARC,
+	"2Q":  cache.New2Q,
+}
+
+func Test_Policy(t *testing.T) {
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			c := policy(3)
+			require.Equal(t, 3, c.(cache.Bounded).MaxLen())
+			nodes := make([]*testNode, 4)
+			for i := range nodes {
+				nodes[i] = &testNode{key: []byte(fmt.Sprintf("key-%d", i))}
+			}
+			for _, node := range nodes[:3] {
+				require.Nil(t, c.Add(node))
+			}
+			require.Same(t, nodes[1], c.Get(nodes[1].GetKey()))
+			require.True(t, c.Has(nodes[2].GetKey()))
+
+			// a replaced node is returned, and the cache holds 3 nodes at most.
+			replaced := &testNode{key: nodes[1].GetKey()}
+			require.Same(t, nodes[1], c.Add(replaced))
+			require.Same(t, replaced, c.Get(nodes[1].GetKey()))
+			require.NotNil(t, c.Add(nodes[3]))
+			require.Equal(t, 3, c.Len())
+			require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+			require.Same(t, nodes[3], c.Remove(nodes[3].GetKey()))
+			require.Nil(t, c.Remove(nodes[3].GetKey()))
+			require.False(t, c.Has(nodes[3].GetKey()))
+			require.Len(t, c.(cache.Enumerator).Nodes(), 2)
+			c.(cache.Resetter).Reset()
+			require.Zero(t, c.Len())
+			require.Nil(t, c.Get(nodes[0].GetKey()))
+			require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+			// a cache of no node doesn't keep the added ones.
+			c = policy(0)
+			require.Same(t, nodes[0], c.Add(nodes[0]))
+			require.Zero(t, c.Len())
+		})
+	}
+}
+
+func Test_Policy_Consistency(t *testing.T) {
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			c := policy(50)
+			for i := 0; i < 20000; i++ {
+				key := []byte(fmt.Sprintf("key-%d", r.Intn(200)))
+				switch r.Intn(4) {
+				case 0:
+					c.Add(&testNode{key: key})
+				case 1:
+					c.Remove(key)
+				default:
+					if c.Get(key) == nil {
+						c.Add(&testNode{key: key})
+					}
+				}
+				if i%100 == 0 {
+					require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck(), "operation %d", i)
+				}
+				require.LessOrEqual(t, c.Len(), 50)
+			}
+		})
+	}
+}
+
+// hotHitRate returns the hit rate of the accesses to a hot set of nodes, accessed twice per
+// round, interleaved with the scans of new nodes, e.g. the paths from the root and the
+// iterations over a range.
+func hotHitRate(policy cache.Policy, size, hot, scan int) float64 {
+	c := policy(size)
+	hits, accesses, next := 0, 0, 0
+	access := func(key []byte) bool {
+		if c.Get(key) != nil {
+			return true
+		}
+		c.Add(&testNode{key: key})
+		return false
+	}
+	for round := 0; round < 50; round++ {
+		for i := 0; i < 2*hot; i++ {
+			hit := access([]byte(fmt.Sprintf("hot-%d", i%hot)))
+			// the first rounds warm the cache up.
+			if round >= 10 {
+				accesses++
+				if hit {
+					hits++
+				}
+			}
+		}
+		for i := 0; i < scan; i++ {
+			access([]byte(fmt.Sprintf("scan-%d", next)))
+			next++
+		}
+	}
+	return float64(hits) / float64(accesses)
+}
+
+func Test_Policy_ScanResistance(t *testing.T) {
+	// the scans evict the hot nodes of an LRU, which are only hit by their second access.
+	require.InDelta(t, 0.5, hotHitRate(cache.New, 100, 50, 100), 0.01)
+	require.Equal(t, 1.0, hotHitRate(cache.NewARC, 100, 50, 100))
+	require.Equal(t, 1.0, hotHitRate(cache.New2Q, 100, 50, 100))
+}
@@ -0,0 +1,58 @@
+package cache
+
+// KeyAccess is an access to the node with the key, in a trace recorded to size a cache with
+// RecommendCacheSize.
+type KeyAccess struct {
+	Key []byte
+}
+
+// GetKey returns the key of the accessed node, so that an access is cached as its node.
+func (a KeyAccess) GetKey() []byte {
+	return a.Key
+}
+
+// RecommendCacheSize replays the trace of accesses against an LRU cache, adding the nodes
+// missing from it as the tree does, and returns the smallest maximum number of nodes for which
+// the ratio of the accesses hitting the cache is at least targetHitRate. The first access of a
+// key always misses, so -1 is returned if the target isn't reached even by a cache holding all the
+// keys. It is an offline analysis, e.g. to size the cache of a node from a trace recorded in
+// production: the hit rate of an LRU cache only grows with its size, so it replays the trace a
+// logarithmic number of times.
+func RecommendCacheSize(samples []KeyAccess, targetHitRate float64) int {
+	if len(samples) == 0 || targetHitRate <= 0 {
+		return 0
+	}
+	distinct := make(map[string]struct{})
+	for _, sample := range samples {
+		distinct[string(sample.Key)] = struct{}{}
+	}
+	if hitRate(samples, len(distinct)) < targetHitRate {
+		return -1
+	}
+
+	low, high := 1, len(distinct)
+	for low < high {
+		size := low + (high-low)/2
+		if hitRate(samples, size) >= targetHitRate {
+			high = size
+		} else {
+			low = size + 1
+		}
+	}
+	return low
+}
+
+// hitRate returns the ratio of the accesses hitting an LRU cache of size nodes at most, replaying
+// samples.
+func hitRate(samples []KeyAccess, size int) float64 {
+	c := New(size)
+	hits := 0
+	for _, sample := range samples {
+		if c.Get(sample.Key) != nil {
+			hits++
+			continue
+		}
+		c.Add(sample)
+	}
+	return float64(hits) / float64(len(samples))
+}
@@ -0,0 +1,51 @@
+package cache_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// zipfTrace returns n accesses to keys following a Zipfian distribution.
+func zipfTrace(n int) []cache.KeyAccess {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, 10000)
+	samples := make([]cache.KeyAccess, n)
+	for i := range samples {
+		samples[i] = cache.KeyAccess{Key: []byte(fmt.Sprintf("key-%d", zipf.Uint64()))}
+	}
+	return samples
+}
+
+// replayHitRate returns the hit rate of a cache of the size replaying samples.
+func replayHitRate(samples []cache.KeyAccess, size int) float64 {
+	c := cache.New(size)
+	hits := 0
+	for _, sample := range samples {
+		if c.Has(sample.Key) {
+			hits++
+		}
+		c.Add(&testNode{key: sample.Key})
+	}
+	return float64(hits) / float64(len(samples))
+}
+
+func Test_RecommendCacheSize(t *testing.T) {
+	samples := zipfTrace(50000)
+	for _, target := range []float64{0.5, 0.7, 0.8} {
+		size := cache.RecommendCacheSize(samples, target)
+		require.Positive(t, size, "target %v", target)
+		require.GreaterOrEqual(t, replayHitRate(samples, size), target, "target %v", target)
+		// the recommended size is the smallest one.
+		require.Less(t, replayHitRate(samples, size-1), target, "target %v", target)
+	}
+
+	// the first access of every key misses.
+	samples = []cache.KeyAccess{{Key: []byte("a")}, {Key: []byte("b")}, {Key: []byte("a")}, {Key: []byte("b")}}
+	require.Equal(t, 2, cache.RecommendCacheSize(samples, 0.5))
+	require.Equal(t, -1, cache.RecommendCacheSize(samples, 0.6))
+	require.Equal(t, 0, cache.RecommendCacheSize(samples, 0))
+	require.Equal(t, 0, cache.RecommendCacheSize(nil, 0.5))
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sync"
+)
+
+// Concurrent is implemented by caches which are safe for concurrent use, so that their callers
+// don't need to synchronize access, e.g. to serve the cache hits without locking the tree.
+type Concurrent interface {
+	// ConcurrentSafe is a marker method.
+	ConcurrentSafe()
+}
+
+// shardedCache is a Cache of independent lruCache shards, each guarded by its own mutex, the
+// shard of a node being chosen by the hash of its key. The concurrent accesses to the nodes of
+// different shards don't contend, so that the gets of read-mostly workloads scale across cores.
+// Each shard evicts its least recently used nodes independently, so the evicted nodes are only
+// approximately the least recently used ones of the cache.
+type shardedCache struct {
+	seed            maphash.Seed
+	shards          []cacheShard
+	maxElementCount int
+}
+
+type cacheShard struct {
+	mtx sync.Mutex
+	lru *lruCache
+}
+
+var (
+	_ Cache              = (*shardedCache)(nil)
+	_ Concurrent         = (*shardedCache)(nil)
+	_ ConsistencyChecker = (*shardedCache)(nil)
+	_ Resetter           = (*shardedCache)(nil)
+	_ Bounded            = (*shardedCache)(nil)
+)
+
+// NewSharded returns a Cache of at most maxElementCount nodes split into the given number of
+// shards, at least 1, which is safe for concurrent use.
+func NewSharded(shards, maxElementCount int) Cache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &shardedCache{
+		seed:            maphash.MakeSeed(),
+		shards:          make([]cacheShard, shards),
+		maxElementCount: maxElementCount,
+	}
+	for i := range c.shards {
+		// the remainder is spread over the first shards.
+		size := maxElementCount / shards
+		if i < maxElementCount%shards {
+			size++
+		}
+		c.shards[i].lru = New(size).(*lruCache)
+	}
+	return c
+}
+
+func (c *shardedCache) shard(key []byte) *cacheShard {
+	return &c.shards[maphash.Bytes(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (c *shardedCache) ConcurrentSafe() {}
+
+// Add adds node to its shard, and returns the node it evicted from the shard, if any.
+func (c *shardedCache) Add(node Node) Node {
+	s := c.shard(node.GetKey())
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Add(node)
+}
+
+func (c *shardedCache) Get(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Get(key)
+}
+
+func (c *shardedCache) Has(key []byte) bool {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Has(key)
+}
+
+func (c *shardedCache) Remove(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lru.Remove(key)
+}
+
+// Len returns the number of nodes of all the shards, which are locked in turn, so it isn't
+// atomic with respect to the concurrent accesses.
+func (c *shardedCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		n += s.lru.Len()
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+func (c *shardedCache) MaxLen() int {
+	return c.maxElementCount
+}
+
+func (c *shardedCache) Reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		s.lru.Reset()
+		s.mtx.Unlock()
+	}
+}
+
+// ConsistencyCheck verifies every shard, and that its nodes belong to it.
+func (c *shardedCache) ConsistencyCheck() error {
+	for i := range c.shards {
+		if err := c.checkShard(i); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *shardedCache) checkShard(i int) error {
+	s := &c.shards[i]
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.lru.ConsistencyCheck(); err != nil {
+		return err
+	}
+	for key := range s.lru.dict {
+		if c.shard([]byte(key)) != s {
+			return fmt.Errorf("node %X belongs to another shard", key)
+		}
+	}
+	return nil
+}
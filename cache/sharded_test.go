@@ -0,0 +1,65 @@
+package cache_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ShardedCache(t *testing.T) {
+	c := cache.NewSharded(4, 10)
+	require.Implements(t, (*cache.Concurrent)(nil), c)
+	require.Equal(t, 10, c.(cache.Bounded).MaxLen())
+
+	nodes := make([]*testNode, 100)
+	for i := range nodes {
+		nodes[i] = &testNode{key: []byte(fmt.Sprintf("key-%d", i))}
+		c.Add(nodes[i])
+	}
+	// every shard holds its share of the nodes.
+	require.Equal(t, 10, c.Len())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+	last := nodes[len(nodes)-1]
+	require.True(t, c.Has(last.GetKey()))
+	require.Same(t, last, c.Get(last.GetKey()))
+	require.Same(t, last, c.Remove(last.GetKey()))
+	require.Nil(t, c.Get(last.GetKey()))
+	require.Equal(t, 9, c.Len())
+
+	c.(cache.Resetter).Reset()
+	require.Zero(t, c.Len())
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// a single shard is an LRU.
+	c = cache.NewSharded(0, 2)
+	c.Add(nodes[0])
+	c.Add(nodes[1])
+	c.Get(nodes[0].GetKey())
+	require.Same(t, nodes[1], c.Add(nodes[2]))
+}
+
+func Test_ShardedCache_Concurrent(t *testing.T) {
+	c := cache.NewSharded(8, 500)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d", (g*7+i)%800))
+				if c.Get(key) == nil {
+					c.Add(&testNode{key: key})
+				}
+				if i%10 == 0 {
+					c.Remove(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Len(), 500)
+	require.NoError(t, c.(cache.ConsistencyChecker).ConsistencyCheck())
+}
@@ -0,0 +1,143 @@
+package cache
+
+import "sync/atomic"
+
+// Stats are the statistics of a cache, see Recorder.
+type Stats struct {
+	// Hits is the number of lookups which found their node.
+	Hits uint64
+	// Misses is the number of lookups which didn't find their node.
+	Misses uint64
+	// Evictions is the number of nodes evicted to make room for the added ones.
+	Evictions uint64
+	// Elements is the number of cached nodes.
+	Elements int
+	// Bytes is the total encoded size of the cached nodes, if the cache has a bytes limit, see
+	// ByteBounded. 0 otherwise.
+	Bytes int64
+}
+
+// HitRate returns the ratio of the lookups which found their node, 0 if there was none.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Add returns the sum of the statistics of two caches.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Hits:      s.Hits + other.Hits,
+		Misses:    s.Misses + other.Misses,
+		Evictions: s.Evictions + other.Evictions,
+		Elements:  s.Elements + other.Elements,
+		Bytes:     s.Bytes + other.Bytes,
+	}
+}
+
+// StatsHook is notified of the events of a cache as they are recorded, e.g. to export them as
+// Prometheus counters. It is called from the goroutine accessing the cache, possibly
+// concurrently, so it must be fast and safe for concurrent use.
+type StatsHook interface {
+	OnHit()
+	OnMiss()
+	OnEviction()
+}
+
+// Recorder records the statistics of the accesses to a cache by its callers, so that they are
+// tracked whatever the Cache implementation, and notifies its hook. It is safe for concurrent
+// use, and a nil Recorder records nothing.
+type Recorder struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+	hook      StatsHook
+}
+
+// NewRecorder returns a Recorder notifying hook, if not nil.
+func NewRecorder(hook StatsHook) *Recorder {
+	return &Recorder{hook: hook}
+}
+
+// RecordHit records a lookup which found its node.
+func (r *Recorder) RecordHit() {
+	if r == nil {
+		return
+	}
+	r.hits.Add(1)
+	if r.hook != nil {
+		r.hook.OnHit()
+	}
+}
+
+// RecordMiss records a lookup which didn't find its node.
+func (r *Recorder) RecordMiss() {
+	if r == nil {
+		return
+	}
+	r.misses.Add(1)
+	if r.hook != nil {
+		r.hook.OnMiss()
+	}
+}
+
+// RecordEviction records the eviction of a node.
+func (r *Recorder) RecordEviction() {
+	if r == nil {
+		return
+	}
+	r.evictions.Add(1)
+	if r.hook != nil {
+		r.hook.OnEviction()
+	}
+}
+
+// Get returns the node with the key from c, recording a hit or a miss.
+func (r *Recorder) Get(c Cache, key []byte) Node {
+	node := c.Get(key)
+	if node != nil {
+		r.RecordHit()
+	} else {
+		r.RecordMiss()
+	}
+	return node
+}
+
+// Add adds node to c, recording the evictions of the nodes removed to make room for it, which
+// doesn't include the replaced node with the same key. A cache with a bytes limit may evict
+// several nodes, which are counted from its length.
+func (r *Recorder) Add(c Cache, node Node) Node {
+	if b, ok := c.(ByteBounded); ok && b.MaxBytes() > 0 {
+		before := c.Len()
+		if !c.Has(node.GetKey()) {
+			before++
+		}
+		evicted := c.Add(node)
+		for n := before - c.Len(); n > 0; n-- {
+			r.RecordEviction()
+		}
+		return evicted
+	}
+
+	evicted := c.Add(node)
+	if evicted == nil {
+		return nil
+	}
+	if string(evicted.GetKey()) != string(node.GetKey()) || !c.Has(node.GetKey()) {
+		r.RecordEviction()
+	}
+	return evicted
+}
+
+// Stats returns the recorded statistics, with the current size of c.
+func (r *Recorder) Stats(c Cache) Stats {
+	s := Stats{Elements: c.Len()}
+	if r != nil {
+		s.Hits, s.Misses, s.Evictions = r.hits.Load(), r.misses.Load(), r.evictions.Load()
+	}
+	if b, ok := c.(ByteBounded); ok {
+		s.Bytes = b.Bytes()
+	}
+	return s
+}
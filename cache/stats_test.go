@@ -0,0 +1,65 @@
+package cache_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// countingHook is a StatsHook counting the events.
+type countingHook struct {
+	hits, misses, evictions atomic.Int64
+}
+
+func (h *countingHook) OnHit()      { h.hits.Add(1) }
+func (h *countingHook) OnMiss()     { h.misses.Add(1) }
+func (h *countingHook) OnEviction() { h.evictions.Add(1) }
+
+func Test_Recorder(t *testing.T) {
+	hook := &countingHook{}
+	r := cache.NewRecorder(hook)
+	c := cache.NewWithBytesLimit(10)
+	a := &sizedNode{testNode: testNode{key: []byte("a")}, size: 4}
+	b := &sizedNode{testNode: testNode{key: []byte("b")}, size: 4}
+
+	require.Nil(t, r.Get(c, a.GetKey()))
+	require.Nil(t, r.Add(c, a))
+	require.Same(t, a, r.Get(c, a.GetKey()))
+	require.Nil(t, r.Add(c, b))
+	// a replaced node isn't evicted, unlike the nodes removed to make room.
+	require.Same(t, b, r.Add(c, &sizedNode{testNode: testNode{key: []byte("b")}, size: 5}))
+	require.Same(t, a, r.Add(c, &sizedNode{testNode: testNode{key: []byte("c")}, size: 5}))
+	// a node too large for the cache is evicted as soon as it is added.
+	require.NotNil(t, r.Add(c, &sizedNode{testNode: testNode{key: []byte("d")}, size: 11}))
+
+	stats := r.Stats(c)
+	require.Equal(t, cache.Stats{Hits: 1, Misses: 1, Evictions: 4, Elements: 0, Bytes: 0}, stats)
+	require.Equal(t, 0.5, stats.HitRate())
+	require.EqualValues(t, 1, hook.hits.Load())
+	require.EqualValues(t, 1, hook.misses.Load())
+	require.EqualValues(t, 4, hook.evictions.Load())
+
+	r.Add(c, a)
+	stats = r.Stats(c)
+	require.Equal(t, 1, stats.Elements)
+	require.EqualValues(t, 4, stats.Bytes)
+	require.Equal(t, cache.Stats{Hits: 2, Misses: 2, Evictions: 8, Elements: 2, Bytes: 8}, stats.Add(stats))
+
+	// a nil recorder only reports the size of the cache.
+	var nop *cache.Recorder
+	require.Same(t, a, nop.Get(c, a.GetKey()))
+	require.Equal(t, cache.Stats{Elements: 1, Bytes: 4}, nop.Stats(c))
+	require.Zero(t, cache.Stats{}.HitRate())
+
+	// an LRU evicts a node at most per add.
+	r = cache.NewRecorder(nil)
+	c = cache.New(1)
+	r.Add(c, a)
+	r.Add(c, a)
+	require.Zero(t, r.Stats(c).Evictions)
+	require.Same(t, a, r.Add(c, b))
+	require.Same(t, b, r.Add(cache.New(0), b))
+	require.EqualValues(t, 2, r.Stats(c).Evictions)
+}
@@ -0,0 +1,99 @@
+package cache
+
+// SecondaryStore is the second tier of a tiered cache, larger and slower than the in-memory
+// LRU, e.g. an off-heap cache or a small file, which holds the nodes evicted from memory. It is
+// called with the lock the callers guard the cache with held, like the cache itself. A store
+// implementing Resetter is reset along with the cache.
+type SecondaryStore interface {
+	// Put stores node, replacing the node with the same key, if any.
+	Put(node Node)
+
+	// Get returns the stored Node with the key, if exists. nil otherwise.
+	Get(key []byte) Node
+
+	// Delete removes the node with the key, if any.
+	Delete(key []byte)
+}
+
+// tieredCache is an lruCache backed by a SecondaryStore: the nodes evicted from the LRU are put
+// into the store, and the nodes missing from the LRU are looked up in the store, being moved
+// back to the LRU when found. A node is in one of the tiers at most, so that a node removed
+// or replaced in the LRU can't be found in the store.
+//
+// tieredCache is not safe for concurrent use, callers must synchronize access.
+type tieredCache struct {
+	primary   *lruCache
+	secondary SecondaryStore
+}
+
+var (
+	_ Cache    = (*tieredCache)(nil)
+	_ Bounded  = (*tieredCache)(nil)
+	_ Resetter = (*tieredCache)(nil)
+)
+
+// NewTiered returns a Cache of at most maxElementCount nodes in memory, evicting the least
+// recently used ones to secondary.
+func NewTiered(maxElementCount int, secondary SecondaryStore) Cache {
+	return &tieredCache{primary: New(maxElementCount).(*lruCache), secondary: secondary}
+}
+
+// Add adds node to the LRU, and returns the node it evicted to the SecondaryStore, if any.
+func (c *tieredCache) Add(node Node) Node {
+	c.secondary.Delete(node.GetKey())
+	evicted := c.primary.Add(node)
+	if evicted != nil && string(evicted.GetKey()) != string(node.GetKey()) {
+		c.secondary.Put(evicted)
+	}
+	return evicted
+}
+
+// Get returns the node with the key from the LRU, or from the SecondaryStore on a miss, moving
+// it back to the LRU.
+func (c *tieredCache) Get(key []byte) Node {
+	if node := c.primary.Get(key); node != nil {
+		return node
+	}
+	node := c.secondary.Get(key)
+	if node == nil {
+		return nil
+	}
+	c.Add(node)
+	return node
+}
+
+// Has returns true if the node with the key is in either tier.
+func (c *tieredCache) Has(key []byte) bool {
+	return c.primary.Has(key) || c.secondary.Get(key) != nil
+}
+
+// Remove removes the node with the key from both tiers, and returns it.
+func (c *tieredCache) Remove(key []byte) Node {
+	if node := c.primary.Remove(key); node != nil {
+		return node
+	}
+	node := c.secondary.Get(key)
+	if node != nil {
+		c.secondary.Delete(key)
+	}
+	return node
+}
+
+// Len returns the number of nodes in memory.
+func (c *tieredCache) Len() int {
+	return c.primary.Len()
+}
+
+// MaxLen returns the maximum number of nodes in memory.
+func (c *tieredCache) MaxLen() int {
+	return c.primary.MaxLen()
+}
+
+// Reset removes all the nodes from the LRU, and from the SecondaryStore if it implements
+// Resetter.
+func (c *tieredCache) Reset() {
+	c.primary.Reset()
+	if r, ok := c.secondary.(Resetter); ok {
+		r.Reset()
+	}
+}
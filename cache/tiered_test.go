@@ -0,0 +1,94 @@
+package cache_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// mapStore is a SecondaryStore backed by a map.
+type mapStore map[string]cache.Node
+
+func (s mapStore) Put(node cache.Node) {
+	s[string(node.GetKey())] = node
+}
+
+func (s mapStore) Get(key []byte) cache.Node {
+	return s[string(key)]
+}
+
+func (s mapStore) Delete(key []byte) {
+	delete(s, string(key))
+}
+
+func (s mapStore) has(key string) bool {
+	_, ok := s[key]
+	return ok
+}
+
+func tieredKey(i int) string {
+	return fmt.Sprintf("key-%d", i)
+}
+
+func requireTieredLen(t *testing.T, c cache.Cache, s mapStore, memory, stored int) {
+	t.Helper()
+	require.Equal(t, memory, c.Len())
+	require.Len(t, s, stored)
+}
+
+func Test_TieredCache(t *testing.T) {
+	store := mapStore{}
+	c := cache.NewTiered(3, store)
+	nodes := make([]*testNode, 5)
+	for i := range nodes {
+		nodes[i] = &testNode{key: []byte(tieredKey(i))}
+		c.Add(nodes[i])
+	}
+	// the least recently used nodes were evicted to the store.
+	requireTieredLen(t, c, store, 3, 2)
+	require.True(t, store.has(tieredKey(0)))
+	require.True(t, store.has(tieredKey(1)))
+	require.Equal(t, 3, c.(cache.Bounded).MaxLen())
+
+	// an evicted node is retrieved from the store, and promoted back to memory, evicting the
+	// least recently used node of the memory.
+	require.True(t, c.Has([]byte(tieredKey(0))))
+	require.Same(t, nodes[0], c.Get([]byte(tieredKey(0))))
+	requireTieredLen(t, c, store, 3, 2)
+	require.False(t, store.has(tieredKey(0)))
+	require.True(t, store.has(tieredKey(2)))
+	require.Same(t, nodes[0], c.Get([]byte(tieredKey(0))))
+
+	// a node replaced or removed in memory isn't found in the store.
+	replaced := &testNode{key: []byte(tieredKey(1))}
+	c.Add(replaced)
+	require.False(t, store.has(tieredKey(1)))
+	require.Same(t, replaced, c.Get([]byte(tieredKey(1))))
+	require.Same(t, nodes[2], c.Remove([]byte(tieredKey(2))))
+	require.Nil(t, c.Get([]byte(tieredKey(2))))
+	require.False(t, c.Has([]byte(tieredKey(2))))
+	require.Nil(t, c.Remove([]byte(tieredKey(2))))
+	require.Nil(t, c.Get([]byte("missing")))
+
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			continue
+		}
+		require.NotNil(t, c.Get([]byte(tieredKey(i))), "key %d", i)
+	}
+	requireTieredLen(t, c, store, 3, 1)
+}
+
+func Test_TieredCache_Reset(t *testing.T) {
+	store := mapStore{}
+	c := cache.NewTiered(3, store)
+	for i := 0; i < 5; i++ {
+		c.Add(&testNode{key: []byte(tieredKey(i))})
+	}
+	c.(cache.Resetter).Reset()
+	// the store doesn't implement Resetter, so it keeps the evicted nodes.
+	requireTieredLen(t, c, store, 0, 2)
+	require.Nil(t, c.Get([]byte(tieredKey(4))))
+}
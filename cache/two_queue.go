@@ -0,0 +1,158 @@
+package cache
+
+import "fmt"
+
+// twoQueueCache is a 2Q cache, see "2Q: A Low Overhead High Performance Buffer Management
+// Replacement Algorithm" by Johnson and Shasha. The added nodes enter the FIFO queue in, and
+// the keys of the nodes evicted from it are remembered in the FIFO queue of keys out: a node
+// added again while its key is in out is accessed again after a while, so it enters the LRU
+// list main. A scan thus only evicts the nodes of in, while it holds more than its share.
+//
+// twoQueueCache is not safe for concurrent use, callers must synchronize access.
+type twoQueueCache struct {
+	maxElementCount int
+	maxIn, maxOut   int
+	in, out, main   *segment
+}
+
+var (
+	_ Cache              = (*twoQueueCache)(nil)
+	_ ConsistencyChecker = (*twoQueueCache)(nil)
+	_ Enumerator         = (*twoQueueCache)(nil)
+	_ Resetter           = (*twoQueueCache)(nil)
+	_ Bounded            = (*twoQueueCache)(nil)
+)
+
+// New2Q returns a Cache of at most maxElementCount nodes evicting them by the 2Q policy, which
+// is scan-resistant, see Policy. A quarter of the nodes are the ones added once, and it also
+// remembers the keys of the last maxElementCount/2 nodes evicted from them, as the paper
+// recommends.
+func New2Q(maxElementCount int) Cache {
+	return &twoQueueCache{
+		maxElementCount: maxElementCount,
+		maxIn:           max(maxElementCount/4, 1),
+		maxOut:          max(maxElementCount/2, 1),
+		in:              newSegment(),
+		out:             newSegment(),
+		main:            newSegment(),
+	}
+}
+
+// Add adds node to the cache, to main if its key is in out, and returns the node it evicted, if
+// any, or the replaced node if the key was cached.
+func (c *twoQueueCache) Add(node Node) Node {
+	if c.maxElementCount <= 0 {
+		return node
+	}
+	key := node.GetKey()
+	if elem := c.main.get(key); elem != nil {
+		e := elem.Value.(*entry)
+		old := e.node
+		e.node = node
+		c.main.ll.MoveToFront(elem)
+		return old
+	}
+	if elem := c.in.get(key); elem != nil {
+		e := elem.Value.(*entry)
+		old := e.node
+		e.node = node
+		return old
+	}
+
+	if elem := c.out.get(key); elem != nil {
+		c.out.remove(elem)
+		evicted := c.reclaim()
+		c.main.pushFront(&entry{key: string(key), node: node})
+		return evicted
+	}
+	evicted := c.reclaim()
+	c.in.pushFront(&entry{key: string(key), node: node})
+	return evicted
+}
+
+// reclaim evicts a node if the cache is full, from in if it holds more than its share, and
+// returns it.
+func (c *twoQueueCache) reclaim() Node {
+	if c.Len() < c.maxElementCount {
+		return nil
+	}
+	if c.in.len() > c.maxIn || c.main.len() == 0 {
+		e := c.in.removeBack()
+		c.out.pushFront(&entry{key: e.key})
+		if c.out.len() > c.maxOut {
+			c.out.removeBack()
+		}
+		return e.node
+	}
+	return c.main.removeBack().node
+}
+
+// Get returns the node with the key, moving it to the front of main if it is there. The nodes
+// of in keep their position, so that the accesses of a scan don't count.
+func (c *twoQueueCache) Get(key []byte) Node {
+	if elem := c.main.get(key); elem != nil {
+		c.main.ll.MoveToFront(elem)
+		return elem.Value.(*entry).node
+	}
+	if elem := c.in.get(key); elem != nil {
+		return elem.Value.(*entry).node
+	}
+	return nil
+}
+
+func (c *twoQueueCache) Has(key []byte) bool {
+	return c.main.get(key) != nil || c.in.get(key) != nil
+}
+
+// Remove removes the node with the key, and forgets the key if it was evicted.
+func (c *twoQueueCache) Remove(key []byte) Node {
+	if elem := c.main.get(key); elem != nil {
+		return c.main.remove(elem).node
+	}
+	if elem := c.in.get(key); elem != nil {
+		return c.in.remove(elem).node
+	}
+	if elem := c.out.get(key); elem != nil {
+		c.out.remove(elem)
+	}
+	return nil
+}
+
+func (c *twoQueueCache) Len() int {
+	return c.in.len() + c.main.len()
+}
+
+func (c *twoQueueCache) MaxLen() int {
+	return c.maxElementCount
+}
+
+// Nodes returns the nodes of main, from the most to the least recently used, then the ones of
+// in, from the last added, so that the nodes accessed again are kept by a smaller cache they
+// are migrated to.
+func (c *twoQueueCache) Nodes() []Node {
+	return c.in.nodes(c.main.nodes(make([]Node, 0, c.Len())))
+}
+
+func (c *twoQueueCache) Reset() {
+	for _, s := range []*segment{c.in, c.out, c.main} {
+		s.reset()
+	}
+}
+
+// ConsistencyCheck verifies that the queues match their indices, that a key is in one of them
+// at most, and that they are bounded as by the 2Q policy.
+func (c *twoQueueCache) ConsistencyCheck() error {
+	seen := make(map[string]struct{})
+	for i, s := range []*segment{c.in, c.out, c.main} {
+		if err := s.check([]string{"in", "out", "main"}[i], seen); err != nil {
+			return err
+		}
+	}
+	if n := c.Len(); n > c.maxElementCount {
+		return fmt.Errorf("cache has %d nodes, more than the maximum of %d", n, c.maxElementCount)
+	}
+	if n := c.out.len(); n > c.maxOut {
+		return fmt.Errorf("out has %d keys, more than the maximum of %d", n, c.maxOut)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cosmos/iavl"
+)
+
+// PrintRange prints the keys and values of the loaded version in [start, end), a nil start or
+// end leaving that side unbounded.
+func PrintRange(tree *iavl.MutableTree, start, end []byte) error {
+	itr, err := tree.Iterator(start, end, true)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		fmt.Printf("  %s\n    %s\n", parseWeaveKey(itr.Key()), encodeID(itr.Value()))
+		count++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	fmt.Printf("Keys: %d\n", count)
+	return nil
+}
+
+// PrintProof prints the ics23 proof of the key in the loaded version, of membership if the key
+// is in the tree and of non-membership otherwise.
+func PrintProof(tree *iavl.MutableTree, key []byte) error {
+	itree, err := tree.GetImmutable(tree.Version())
+	if err != nil {
+		return err
+	}
+	value, err := itree.Get(key)
+	if err != nil {
+		return err
+	}
+	proof, err := itree.GetProof(key)
+	if err != nil {
+		return err
+	}
+	bz, err := json.MarshalIndent(proof, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Version: %d\n", itree.Version())
+	fmt.Printf("Hash: %X\n", itree.Hash())
+	fmt.Printf("Key: %s\n", parseWeaveKey(key))
+	if value == nil {
+		fmt.Println("Value: <absent>")
+	} else {
+		fmt.Printf("Value: %s\n", encodeID(value))
+	}
+	fmt.Printf("Proof: %s\n", bz)
+	return nil
+}
+
+// statsSamples is the number of leaves the stats command samples to estimate the statistics of
+// the trees with more leaves.
+const statsSamples = 10000
+
+// PrintStats prints the stats of the loaded version: its size and shape, the number of its
+// nodes and the bytes it takes, and the available versions.
+func PrintStats(tree *iavl.MutableTree) error {
+	version := tree.Version()
+	fmt.Printf("Version: %d\n", version)
+	fmt.Printf("Hash: %X\n", tree.Hash())
+	fmt.Printf("Size: %d\n", tree.Size())
+	fmt.Printf("Height: %d\n", tree.Height())
+	if version == 0 {
+		return nil
+	}
+
+	unique, shared, err := tree.UniqueNodeCount(version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Nodes: %d (%d unique to the version, %d shared with the next one)\n", unique+shared, unique, shared)
+
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return err
+	}
+	stats, err := itree.SampleStats(statsSamples)
+	if err != nil {
+		return err
+	}
+	estimate := ""
+	if stats.Samples > 0 {
+		estimate = fmt.Sprintf(" (estimated from %d leaves)", stats.Samples)
+	}
+	fmt.Printf("Key bytes: %d, value bytes: %d%s\n", stats.KeyBytes, stats.ValueBytes, estimate)
+	fmt.Printf("Leaf depth: %.2f on average, %.0f at most%s\n", stats.AvgLeafDepth, stats.MaxLeafDepth, estimate)
+	nodeVersions := make([]int64, 0, len(stats.NodesByVersion))
+	for v := range stats.NodesByVersion {
+		nodeVersions = append(nodeVersions, v)
+	}
+	sort.Slice(nodeVersions, func(i, j int) bool { return nodeVersions[i] < nodeVersions[j] })
+	fmt.Printf("Nodes by version%s:\n", estimate)
+	for _, v := range nodeVersions {
+		fmt.Printf("  %d: %d\n", v, stats.NodesByVersion[v])
+	}
+	if nodeBytes, fastNodeBytes, orphanBytes, err := tree.VersionSizeEstimate(version); err == nil {
+		fmt.Printf("Bytes written by the version: %d of nodes, %d of fast nodes\n", nodeBytes, fastNodeBytes)
+		fmt.Printf("Bytes orphaned by the version: %d\n", orphanBytes)
+	}
+
+	versions := tree.AvailableVersions()
+	if len(versions) > 0 {
+		fmt.Printf("Versions: %d, from %d to %d\n", len(versions), versions[0], versions[len(versions)-1])
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,45 +24,201 @@ const (
 	DefaultCacheSize int = 10000
 )
 
+const usage = `Usage: iaviewer [-backend <db backend>] <command> <db dir> <prefix> [args]
+
+Commands:
+  data [version]             print the keys with hashed values, the hash and the size
+  shape [version]            print the shape of the tree
+  versions                   print the available versions
+  range <version> [start] [end]
+                             print the keys and values in [start, end)
+  proof <version> <key>      print the ics23 proof of the key, as JSON
+  stats [version]            print the stats of the tree and the database
+  delete <from> <to>         delete the versions from <from> to <to>, which must include
+                             the first or the latest version
+  export <version> <file>    export a snapshot of the version into the file
+  import <version> <file>    import a snapshot into the version of an empty tree
+
+<prefix> is the prefix of db, and the iavl tree of different modules in cosmos-sdk uses
+different <prefix> to identify, just like "s/k:gov/" represents the prefix of gov module.
+A version of 0 is the latest version. The keys are read as is, or hex-decoded if prefixed
+with 0x. The rocksdb and pebbledb backends require building with the rocksdb and pebbledb
+tags.
+`
+
 func main() {
-	args := os.Args[1:]
-	if len(args) < 3 || (args[0] != "data" && args[0] != "shape" && args[0] != "versions") {
-		fmt.Fprintln(os.Stderr, "Usage: iaviewer <data|shape|versions> <leveldb dir> <prefix> [version number]")
-		fmt.Fprintln(os.Stderr, "<prefix> is the prefix of db, and the iavl tree of different modules in cosmos-sdk uses ")
-		fmt.Fprintln(os.Stderr, "different <prefix> to identify, just like \"s/k:gov/\" represents the prefix of gov module")
+	backend := flag.String("backend", string(dbm.GoLevelDBBackend), "database backend: goleveldb, rocksdb or pebbledb")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 3 {
+		flag.Usage()
 		os.Exit(1)
 	}
+	if err := run(dbm.BackendType(*backend), args[0], args[1], []byte(args[2]), args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
 
-	version := 0
-	if len(args) == 4 {
-		var err error
-		version, err = strconv.Atoi(args[3])
+// run runs the command on the tree of the database.
+func run(backend dbm.BackendType, command, dir string, prefix []byte, args []string) error {
+	switch command {
+	case "data", "shape", "stats":
+		version, err := optionalVersion(args)
+		if err != nil {
+			return err
+		}
+		tree, err := ReadTree(dir, backend, version, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		switch command {
+		case "data":
+			PrintKeys(tree)
+			hash := tree.Hash()
+			fmt.Printf("Hash: %X\n", hash)
+			fmt.Printf("Size: %X\n", tree.Size())
+		case "shape":
+			PrintShape(tree)
+		default:
+			return PrintStats(tree)
+		}
+	case "versions":
+		tree, err := ReadTree(dir, backend, 0, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		PrintVersions(tree)
+	case "range":
+		if len(args) < 1 || len(args) > 3 {
+			return errors.New("usage: range <version> [start] [end]")
+		}
+		version, err := parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		var start, end []byte
+		if len(args) > 1 {
+			if start, err = parseKey(args[1]); err != nil {
+				return err
+			}
+		}
+		if len(args) > 2 {
+			if end, err = parseKey(args[2]); err != nil {
+				return err
+			}
+		}
+		tree, err := ReadTree(dir, backend, version, prefix)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid version number: %s\n", err)
-			os.Exit(1)
+			return fmt.Errorf("reading data: %w", err)
 		}
+		return PrintRange(tree, start, end)
+	case "proof":
+		if len(args) != 2 {
+			return errors.New("usage: proof <version> <key>")
+		}
+		version, err := parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		key, err := parseKey(args[1])
+		if err != nil {
+			return err
+		}
+		tree, err := ReadTree(dir, backend, version, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		return PrintProof(tree, key)
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: delete <from> <to>")
+		}
+		from, err := parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		to, err := parseVersion(args[1])
+		if err != nil {
+			return err
+		}
+		tree, err := ReadTree(dir, backend, 0, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		defer tree.Close()
+		return DeleteVersions(tree, from, to)
+	case "export":
+		if len(args) != 2 {
+			return errors.New("usage: export <version> <file>")
+		}
+		version, err := parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		tree, err := ReadTree(dir, backend, version, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		return ExportSnapshot(tree, args[1])
+	case "import":
+		if len(args) != 2 {
+			return errors.New("usage: import <version> <file>")
+		}
+		version, err := parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		if version <= 0 {
+			return errors.New("the version to import must be positive")
+		}
+		tree, err := ReadTree(dir, backend, 0, prefix)
+		if err != nil {
+			return fmt.Errorf("reading data: %w", err)
+		}
+		defer tree.Close()
+		return ImportSnapshot(tree, int64(version), args[1])
+	default:
+		return fmt.Errorf("unknown command %q, run iaviewer -h for the usage", command)
 	}
+	return nil
+}
 
-	tree, err := ReadTree(args[1], version, []byte(args[2]))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading data: %s\n", err)
-		os.Exit(1)
+// optionalVersion parses the optional version argument, 0 if it is missing.
+func optionalVersion(args []string) (int, error) {
+	switch len(args) {
+	case 0:
+		return 0, nil
+	case 1:
+		return parseVersion(args[0])
+	default:
+		return 0, fmt.Errorf("unexpected arguments %v", args[1:])
+	}
+}
+
+func parseVersion(arg string) (int, error) {
+	version, err := strconv.Atoi(arg)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid version number %q", arg)
 	}
+	return version, nil
+}
 
-	switch args[0] {
-	case "data":
-		PrintKeys(tree)
-		hash := tree.Hash()
-		fmt.Printf("Hash: %X\n", hash)
-		fmt.Printf("Size: %X\n", tree.Size())
-	case "shape":
-		PrintShape(tree)
-	case "versions":
-		PrintVersions(tree)
+// parseKey returns the key of an argument, hex-decoded if it is prefixed with 0x.
+func parseKey(arg string) ([]byte, error) {
+	if !strings.HasPrefix(arg, "0x") {
+		return []byte(arg), nil
+	}
+	key, err := hex.DecodeString(arg[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex key %q: %w", arg, err)
 	}
+	return key, nil
 }
 
-func OpenDB(dir string) (dbm.DB, error) {
+func OpenDB(dir string, backend dbm.BackendType) (dbm.DB, error) {
 	switch {
 	case strings.HasSuffix(dir, ".db"):
 		dir = dir[:len(dir)-3]
@@ -81,7 +239,7 @@ func OpenDB(dir string) (dbm.DB, error) {
 		return nil, fmt.Errorf("cannot cut paths on %s", dir)
 	}
 	name := dir[cut+1:]
-	db, err := dbm.NewGoLevelDB(name, dir[:cut], nil)
+	db, err := dbm.NewDB(name, backend, dir[:cut])
 	if err != nil {
 		return nil, err
 	}
@@ -114,8 +272,8 @@ func PrintDBStats(db dbm.DB) {
 // ReadTree loads an iavl tree from the directory
 // If version is 0, load latest, otherwise, load named version
 // The prefix represents which iavl tree you want to read. The iaviwer will always set a prefix.
-func ReadTree(dir string, version int, prefix []byte) (*iavl.MutableTree, error) {
-	db, err := OpenDB(dir)
+func ReadTree(dir string, backend dbm.BackendType, version int, prefix []byte) (*iavl.MutableTree, error) {
+	db, err := OpenDB(dir, backend)
 	if err != nil {
 		return nil, err
 	}
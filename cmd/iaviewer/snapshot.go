@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cosmos/iavl"
+)
+
+// DeleteVersions deletes the versions from from to to inclusive, which must include the first
+// version, whose deletion is the pruning of the oldest versions, or the latest one, whose
+// deletion is a rollback to the version before from.
+func DeleteVersions(tree *iavl.MutableTree, from, to int) error {
+	versions := tree.AvailableVersions()
+	if len(versions) == 0 {
+		return errors.New("the tree has no versions")
+	}
+	if from > to {
+		return fmt.Errorf("invalid version range %d to %d", from, to)
+	}
+	first, latest := versions[0], versions[len(versions)-1]
+	switch {
+	case from <= first:
+		if err := tree.DeleteVersionsTo(int64(to)); err != nil {
+			return err
+		}
+	case to >= latest:
+		if err := tree.LoadVersionForOverwriting(int64(from - 1)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("versions %d to %d include neither the first version %d nor the latest version %d", from, to, first, latest)
+	}
+	fmt.Printf("Deleted versions %d to %d\n", from, to)
+	return nil
+}
+
+// ExportSnapshot exports the nodes of the loaded version into the file, each encoded with
+// iavl.BinaryNodeCodec and prefixed with its uvarint length, as ImportSnapshot reads them.
+func ExportSnapshot(tree *iavl.MutableTree, file string) (err error) {
+	itree, err := tree.GetImmutable(tree.Version())
+	if err != nil {
+		return err
+	}
+	exporter, err := itree.Export()
+	if err != nil {
+		return err
+	}
+	defer exporter.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	encoded := iavl.NewEncodedExporter(exporter, iavl.BinaryNodeCodec{})
+
+	count := 0
+	var header [binary.MaxVarintLen64]byte
+	for {
+		bz, err := encoded.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(header[:], uint64(len(bz)))
+		if _, err := w.Write(header[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(bz); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d nodes of version %d, hash %X\n", count, itree.Version(), itree.Hash())
+	return nil
+}
+
+// ImportSnapshot imports the nodes exported by ExportSnapshot into the version of the tree, which
+// must be empty.
+func ImportSnapshot(tree *iavl.MutableTree, version int64, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	encoded := iavl.NewEncodedImporter(importer, iavl.BinaryNodeCodec{})
+
+	r := bufio.NewReader(f)
+	count := 0
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading node %d: %w", count, err)
+		}
+		bz := make([]byte, size)
+		if _, err := io.ReadFull(r, bz); err != nil {
+			return fmt.Errorf("reading node %d: %w", count, err)
+		}
+		if err := encoded.Add(bz); err != nil {
+			return fmt.Errorf("importing node %d: %w", count, err)
+		}
+		count++
+	}
+	if err := importer.Commit(); err != nil {
+		return err
+	}
+	if _, err := tree.LoadVersion(version); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d nodes into version %d, hash %X\n", count, version, tree.Hash())
+	return nil
+}
@@ -0,0 +1,434 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// errCoalescedBatchClosed is returned when a written or closed coalesced batch is used.
+var errCoalescedBatchClosed = errors.New("batch has been written or closed")
+
+// coalescingDB holds the writes of the versions saved during the CoalesceWindow in memory, and
+// writes them to the underlying DB together once the window expires or CoalesceMaxVersions
+// versions are pending. The reads are served from the pending writes first, so that the
+// pending versions can be queried before they are written.
+type coalescingDB struct {
+	dbm.DB // underlying DB
+
+	logger      Logger
+	window      time.Duration
+	maxVersions int
+	sync        bool                // whether the flushes are synced
+	onFlush     func(version int64) // called with the latest version of the synced flushes
+
+	mtx      sync.RWMutex
+	pending  map[string][]byte // pending writes, a nil value being a deletion
+	flushing map[string][]byte // writes being flushed, read after the pending ones
+	versions int               // number of pending versions
+	latest   int64             // latest pending version
+	timer    *time.Timer       // flushes once the window expires, nil without pending version
+
+	flushMtx sync.Mutex // serializes the flushes
+}
+
+var _ dbm.DB = (*coalescingDB)(nil)
+
+func newCoalescingDB(db dbm.DB, opts Options, lg Logger) *coalescingDB {
+	return &coalescingDB{
+		DB:          db,
+		logger:      lg,
+		window:      opts.CoalesceWindow,
+		maxVersions: opts.CoalesceMaxVersions,
+		sync:        opts.SyncMode != SyncNone,
+		onFlush:     opts.OnFlush,
+		pending:     make(map[string][]byte),
+	}
+}
+
+// lookup returns the pending write of a key, if any.
+func (db *coalescingDB) lookup(key []byte) (value []byte, ok bool) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+	if value, ok = db.pending[string(key)]; ok {
+		return value, true
+	}
+	value, ok = db.flushing[string(key)]
+	return value, ok
+}
+
+// Get implements dbm.DB.
+func (db *coalescingDB) Get(key []byte) ([]byte, error) {
+	if value, ok := db.lookup(key); ok {
+		return value, nil
+	}
+	return db.DB.Get(key)
+}
+
+// Has implements dbm.DB.
+func (db *coalescingDB) Has(key []byte) (bool, error) {
+	if value, ok := db.lookup(key); ok {
+		return value != nil, nil
+	}
+	return db.DB.Has(key)
+}
+
+// Iterator implements dbm.DB.
+func (db *coalescingDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	return db.iterator(start, end, true)
+}
+
+// ReverseIterator implements dbm.DB.
+func (db *coalescingDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	return db.iterator(start, end, false)
+}
+
+// iterator merges the pending writes in [start, end), copied when it is created, with an
+// iterator of the underlying DB.
+func (db *coalescingDB) iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
+	itr := &coalescedIterator{start: start, end: end, ascending: ascending}
+	inRange := func(key []byte) bool {
+		return (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0)
+	}
+	db.mtx.RLock()
+	writes := make(map[string][]byte)
+	for key, value := range db.flushing {
+		if inRange([]byte(key)) {
+			writes[key] = value
+		}
+	}
+	for key, value := range db.pending {
+		if inRange([]byte(key)) {
+			writes[key] = value
+		}
+	}
+	db.mtx.RUnlock()
+	for key := range writes {
+		itr.keys = append(itr.keys, []byte(key))
+	}
+	sort.Slice(itr.keys, func(i, j int) bool {
+		if ascending {
+			return bytes.Compare(itr.keys[i], itr.keys[j]) < 0
+		}
+		return bytes.Compare(itr.keys[i], itr.keys[j]) > 0
+	})
+	for _, key := range itr.keys {
+		itr.values = append(itr.values, writes[string(key)])
+	}
+
+	var err error
+	if ascending {
+		itr.underlying, err = db.DB.Iterator(start, end)
+	} else {
+		itr.underlying, err = db.DB.ReverseIterator(start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+	itr.advance()
+	return itr, nil
+}
+
+// NewBatch implements dbm.DB.
+func (db *coalescingDB) NewBatch() dbm.Batch {
+	return &coalescedBatch{db: db}
+}
+
+// NewBatchWithSize implements dbm.DB.
+func (db *coalescingDB) NewBatchWithSize(size int) dbm.Batch {
+	return &coalescedBatch{db: db, ops: make([]coalescedWrite, 0, size/100)}
+}
+
+// apply adds the writes of a batch to the pending ones.
+func (db *coalescingDB) apply(ops []coalescedWrite) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	for _, op := range ops {
+		db.pending[string(op.key)] = op.value
+	}
+}
+
+// versionSaved records a version whose writes are pending, and flushes them if
+// CoalesceMaxVersions versions are.
+func (db *coalescingDB) versionSaved(version int64) error {
+	db.mtx.Lock()
+	db.versions++
+	db.latest = version
+	if db.timer == nil {
+		db.timer = time.AfterFunc(db.window, func() {
+			if err := db.flush(); err != nil {
+				db.logger.Error("failed to flush the coalesced versions", "err", err)
+			}
+		})
+	}
+	full := db.maxVersions > 0 && db.versions >= db.maxVersions
+	db.mtx.Unlock()
+
+	if full {
+		return db.flush()
+	}
+	return nil
+}
+
+// flush writes the pending writes to the underlying DB in a single batch. They are pending
+// again if it fails, until the next flush.
+func (db *coalescingDB) flush() error {
+	db.flushMtx.Lock()
+	defer db.flushMtx.Unlock()
+
+	writes, versions, latest := db.take()
+	if len(writes) == 0 {
+		return nil
+	}
+	err := db.write(writes)
+	db.release(writes, versions, err)
+	if err != nil {
+		return fmt.Errorf("failed to flush the writes of %d coalesced versions: %w", versions, err)
+	}
+
+	if db.sync && db.onFlush != nil && latest > 0 {
+		db.onFlush(latest)
+	}
+	return nil
+}
+
+// take starts a flush, moving the pending writes to the flushing ones, which it returns with
+// the number of pending versions and the latest one. The caller must hold flushMtx, and call
+// release once the writes are flushed if there are any.
+func (db *coalescingDB) take() (writes map[string][]byte, versions int, latest int64) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.timer != nil {
+		db.timer.Stop()
+		db.timer = nil
+	}
+	writes, versions, latest = db.pending, db.versions, db.latest
+	if len(writes) == 0 {
+		return nil, 0, 0
+	}
+	db.flushing = writes
+	db.pending = make(map[string][]byte)
+	db.versions = 0
+	return writes, versions, latest
+}
+
+// release ends a flush of the writes returned by take, which are pending again if it failed.
+func (db *coalescingDB) release(writes map[string][]byte, versions int, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if err != nil {
+		// the writes made meanwhile are newer.
+		for key, value := range writes {
+			if _, ok := db.pending[key]; !ok {
+				db.pending[key] = value
+			}
+		}
+		db.versions += versions
+	}
+	db.flushing = nil
+}
+
+func (db *coalescingDB) write(writes map[string][]byte) error {
+	batch := db.DB.NewBatch()
+	defer batch.Close()
+	for key, value := range writes {
+		var err error
+		if value == nil {
+			err = batch.Delete([]byte(key))
+		} else {
+			err = batch.Set([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if db.sync {
+		return batch.WriteSync()
+	}
+	return batch.Write()
+}
+
+// coalescedWrite is a write of a coalesced batch, a nil value being a deletion.
+type coalescedWrite struct {
+	key   []byte
+	value []byte
+}
+
+// coalescedBatch is a batch of a coalescingDB, whose writes are added to the pending ones when
+// it is written.
+type coalescedBatch struct {
+	db     *coalescingDB
+	ops    []coalescedWrite
+	size   int
+	closed bool
+}
+
+var _ dbm.Batch = (*coalescedBatch)(nil)
+
+// Set implements dbm.Batch.
+func (b *coalescedBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key: %w", ErrInvalidInputs)
+	}
+	if value == nil {
+		return fmt.Errorf("nil value: %w", ErrInvalidInputs)
+	}
+	return b.add(key, value)
+}
+
+// Delete implements dbm.Batch.
+func (b *coalescedBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key: %w", ErrInvalidInputs)
+	}
+	return b.add(key, nil)
+}
+
+func (b *coalescedBatch) add(key, value []byte) error {
+	if b.closed {
+		return errCoalescedBatchClosed
+	}
+	b.ops = append(b.ops, coalescedWrite{key: key, value: value})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Write implements dbm.Batch.
+func (b *coalescedBatch) Write() error {
+	if b.closed {
+		return errCoalescedBatchClosed
+	}
+	b.db.apply(b.ops)
+	return b.Close()
+}
+
+// WriteSync implements dbm.Batch. The writes are only synced by the flush of the coalesced
+// versions.
+func (b *coalescedBatch) WriteSync() error {
+	return b.Write()
+}
+
+// Close implements dbm.Batch.
+func (b *coalescedBatch) Close() error {
+	b.ops = nil
+	b.closed = true
+	return nil
+}
+
+// GetByteSize implements dbm.Batch.
+func (b *coalescedBatch) GetByteSize() (int, error) {
+	if b.closed {
+		return 0, errCoalescedBatchClosed
+	}
+	return b.size, nil
+}
+
+// coalescedIterator merges the pending writes of a coalescingDB with an iterator of the
+// underlying DB, the pending writes shadowing the keys they write.
+type coalescedIterator struct {
+	underlying dbm.Iterator
+	keys       [][]byte // pending keys, in the iteration order
+	values     [][]byte // pending values, nil for the deletions
+	i          int      // position in keys
+
+	start, end  []byte
+	ascending   bool
+	fromPending bool // whether the current key is keys[i]
+	valid       bool
+}
+
+var _ dbm.Iterator = (*coalescedIterator)(nil)
+
+// advance moves to the next key which isn't deleted, from the current positions.
+func (itr *coalescedIterator) advance() {
+	for {
+		pendingValid := itr.i < len(itr.keys)
+		if !itr.underlying.Valid() {
+			if !pendingValid {
+				itr.valid = false
+				return
+			}
+		} else if pendingValid {
+			cmp := bytes.Compare(itr.keys[itr.i], itr.underlying.Key())
+			if !itr.ascending {
+				cmp = -cmp
+			}
+			if cmp == 0 {
+				// shadowed by the pending write.
+				itr.underlying.Next()
+			} else if cmp > 0 {
+				pendingValid = false
+			}
+		}
+		if !pendingValid {
+			itr.fromPending, itr.valid = false, true
+			return
+		}
+		if itr.values[itr.i] != nil {
+			itr.fromPending, itr.valid = true, true
+			return
+		}
+		itr.i++
+	}
+}
+
+// Domain implements dbm.Iterator.
+func (itr *coalescedIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements dbm.Iterator.
+func (itr *coalescedIterator) Valid() bool {
+	return itr.valid
+}
+
+// Next implements dbm.Iterator.
+func (itr *coalescedIterator) Next() {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	if itr.fromPending {
+		itr.i++
+	} else {
+		itr.underlying.Next()
+	}
+	itr.advance()
+}
+
+// Key implements dbm.Iterator.
+func (itr *coalescedIterator) Key() []byte {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	if itr.fromPending {
+		return itr.keys[itr.i]
+	}
+	return itr.underlying.Key()
+}
+
+// Value implements dbm.Iterator.
+func (itr *coalescedIterator) Value() []byte {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+	if itr.fromPending {
+		return itr.values[itr.i]
+	}
+	return itr.underlying.Value()
+}
+
+// Error implements dbm.Iterator.
+func (itr *coalescedIterator) Error() error {
+	return itr.underlying.Error()
+}
+
+// Close implements dbm.Iterator.
+func (itr *coalescedIterator) Close() error {
+	itr.valid = false
+	return itr.underlying.Close()
+}
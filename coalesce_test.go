@@ -0,0 +1,199 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// hasRoot returns whether the root of a version is written to db.
+func hasRoot(t *testing.T, db dbm.DB, version int64) bool {
+	t.Helper()
+	has, err := db.Has(nodeKeyFormat.Key(GetRootKey(version)))
+	require.NoError(t, err)
+	return has
+}
+
+// saveCoalesceVersion applies the same changes of a version to the trees, and returns the
+// version saved.
+func saveCoalesceVersion(t *testing.T, version int, trees ...*MutableTree) int64 {
+	t.Helper()
+	var saved int64
+	for _, tree := range trees {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", (version*7+i)%50)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+		if version > 0 {
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", version*3%50)))
+			require.NoError(t, err)
+		}
+		var err error
+		_, saved, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return saved
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	db := dbm.NewMemDB()
+	var mtx sync.Mutex
+	var flushed []int64
+	onFlush := func(version int64) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		flushed = append(flushed, version)
+	}
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(),
+		CoalesceWindowOption(time.Hour), CoalesceMaxVersionsOption(3), OnFlushOption(onFlush))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+
+	// the pending versions are served from memory.
+	for i := 0; i < 2; i++ {
+		version := saveCoalesceVersion(t, i, tree, reference)
+		require.False(t, hasRoot(t, db, version))
+		require.Equal(t, reference.Hash(), tree.Hash())
+	}
+	require.Empty(t, flushed)
+	require.Equal(t, reference.AvailableVersions(), tree.AvailableVersions())
+	for version := int64(1); version <= 2; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		expected, err := reference.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash())
+		var keys, expectedKeys []string
+		_, err = itree.Iterate(func(key, _ []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		require.NoError(t, err)
+		_, err = expected.Iterate(func(key, _ []byte) bool {
+			expectedKeys = append(expectedKeys, string(key))
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, expectedKeys, keys)
+		value, err := tree.GetVersioned([]byte("key-05"), version)
+		require.NoError(t, err)
+		expectedValue, err := reference.GetVersioned([]byte("key-05"), version)
+		require.NoError(t, err)
+		require.Equal(t, expectedValue, value)
+	}
+
+	// the versions are written together once CoalesceMaxVersions are pending.
+	version := saveCoalesceVersion(t, 2, tree, reference)
+	require.Equal(t, []int64{3}, flushed)
+	for v := int64(1); v <= version; v++ {
+		require.True(t, hasRoot(t, db, v))
+	}
+
+	// the pending versions are written when the tree is closed.
+	version = saveCoalesceVersion(t, 3, tree, reference)
+	require.False(t, hasRoot(t, db, version))
+	require.NoError(t, tree.Close())
+	require.True(t, hasRoot(t, db, version))
+	require.Equal(t, []int64{3, 4}, flushed)
+
+	loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	latest, err := loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, latest)
+	require.Equal(t, reference.Hash(), loaded.Hash())
+	for v := int64(1); v <= version; v++ {
+		itree, err := loaded.GetImmutable(v)
+		require.NoError(t, err)
+		expected, err := reference.GetImmutable(v)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash())
+	}
+}
+
+func TestCoalesceWindow_Expiry(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), CoalesceWindowOption(20*time.Millisecond))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	var version int64
+	for i := 0; i < 3; i++ {
+		version = saveCoalesceVersion(t, i, tree, reference)
+	}
+	require.Eventually(t, func() bool {
+		return hasRoot(t, db, version)
+	}, 5*time.Second, 5*time.Millisecond)
+
+	loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	latest, err := loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, latest)
+	require.Equal(t, reference.Hash(), loaded.Hash())
+}
+
+func TestCoalescedIterator(t *testing.T) {
+	underlying := dbm.NewMemDB()
+	expected := dbm.NewMemDB()
+	for _, key := range []string{"b", "c", "d", "f"} {
+		require.NoError(t, underlying.Set([]byte(key), []byte("old-"+key)))
+		require.NoError(t, expected.Set([]byte(key), []byte("old-"+key)))
+	}
+	db := newCoalescingDB(underlying, DefaultOptions(), NewNopLogger())
+	batch := db.NewBatch()
+	for _, key := range []string{"a", "c", "e", "g"} {
+		require.NoError(t, batch.Set([]byte(key), []byte("new-"+key)))
+		require.NoError(t, expected.Set([]byte(key), []byte("new-"+key)))
+	}
+	for _, key := range []string{"d", "g", "x"} {
+		require.NoError(t, batch.Delete([]byte(key)))
+		require.NoError(t, expected.Delete([]byte(key)))
+	}
+	require.NoError(t, batch.Write())
+	require.ErrorIs(t, batch.Set([]byte("h"), []byte("h")), errCoalescedBatchClosed)
+
+	pairs := func(itr dbm.Iterator) []string {
+		defer itr.Close()
+		var pairs []string
+		for ; itr.Valid(); itr.Next() {
+			pairs = append(pairs, string(itr.Key())+"="+string(itr.Value()))
+		}
+		require.NoError(t, itr.Error())
+		return pairs
+	}
+	for _, bounds := range [][2][]byte{{nil, nil}, {[]byte("b"), []byte("e")}, {[]byte("c"), nil}, {nil, []byte("c")}, {[]byte("x"), nil}} {
+		for _, ascending := range []bool{true, false} {
+			var itr, expectedItr dbm.Iterator
+			var err error
+			if ascending {
+				itr, err = db.Iterator(bounds[0], bounds[1])
+				require.NoError(t, err)
+				expectedItr, err = expected.Iterator(bounds[0], bounds[1])
+			} else {
+				itr, err = db.ReverseIterator(bounds[0], bounds[1])
+				require.NoError(t, err)
+				expectedItr, err = expected.ReverseIterator(bounds[0], bounds[1])
+			}
+			require.NoError(t, err)
+			require.Equal(t, pairs(expectedItr), pairs(itr), "bounds %q, ascending %v", bounds, ascending)
+		}
+	}
+
+	value, err := db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new-c"), value)
+	has, err := db.Has([]byte("d"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the flush writes the pending writes to the underlying db.
+	require.NoError(t, db.flush())
+	require.Empty(t, db.pending)
+	itr, err := underlying.Iterator(nil, nil)
+	require.NoError(t, err)
+	expectedItr, err := expected.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pairs(expectedItr), pairs(itr))
+}
@@ -0,0 +1,268 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// CommitGroup commits the versions of several trees sharing a DB together, e.g. the stores of
+// the modules of an application, so that a crash can't leave some of them committed and the
+// others not. The trees are created by NewMutableTree, each storing its keys under its own
+// prefix of the DB. Their versions are saved as usual by StageSaveVersion, with the same root
+// hashes, but their writes are staged in memory, where they are read from, until Flush writes
+// the writes of all of them in a single batch.
+type CommitGroup struct {
+	db dbm.DB
+
+	mtx   sync.Mutex
+	trees []*commitGroupTree
+}
+
+// commitGroupTree is a tree of a CommitGroup, with its staged writes.
+type commitGroupTree struct {
+	prefix []byte
+	staged *coalescingDB
+	tree   *MutableTree
+}
+
+// NewCommitGroup returns a CommitGroup of trees stored in db.
+func NewCommitGroup(db dbm.DB) *CommitGroup {
+	return &CommitGroup{db: db}
+}
+
+// NewMutableTree returns a tree of the group, as the NewMutableTree function does, whose keys
+// are stored under prefix in the DB of the group. The prefixes of the trees of a group can't
+// be prefixes of one another. The CoalesceWindow option can't be set, since the writes are
+// already staged until the group is flushed.
+func (g *CommitGroup) NewMutableTree(prefix []byte, cacheSize int, skipFastStorageUpgrade bool, lg Logger, options ...Option) (*MutableTree, error) {
+	if len(prefix) == 0 {
+		return nil, fmt.Errorf("empty prefix: %w", ErrInvalidInputs)
+	}
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.CoalesceWindow > 0 {
+		return nil, fmt.Errorf("the trees of a commit group can't coalesce their versions: %w", ErrInvalidInputs)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, t := range g.trees {
+		if bytes.HasPrefix(t.prefix, prefix) || bytes.HasPrefix(prefix, t.prefix) {
+			return nil, fmt.Errorf("prefix %X overlaps the prefix %X of another tree: %w", prefix, t.prefix, ErrInvalidInputs)
+		}
+	}
+	prefix = bytes.Clone(prefix)
+	staged := newCoalescingDB(&prefixDB{db: g.db, prefix: prefix}, Options{}, ensureLogger(lg))
+	tree := NewMutableTree(staged, cacheSize, skipFastStorageUpgrade, lg, options...)
+	tree.commitGroup = g
+	g.trees = append(g.trees, &commitGroupTree{prefix: prefix, staged: staged, tree: tree})
+	return tree, nil
+}
+
+// StageSaveVersion saves a new version of a tree of a CommitGroup, as SaveVersion does, which
+// the trees of a group also do. The version is readable once it returns, but only written to
+// the DB by the next CommitGroup.Flush, and lost if the process stops before.
+func (tree *MutableTree) StageSaveVersion() ([]byte, int64, error) {
+	if tree.commitGroup == nil {
+		return nil, 0, fmt.Errorf("tree isn't in a commit group: %w", ErrInvalidInputs)
+	}
+	return tree.SaveVersion()
+}
+
+// Flush writes the staged writes of all the trees of the group in a single synced batch, so
+// that either all of them are written or none is. They stay staged if it fails, and are written
+// by the next Flush. The trees must not be saved while the group is flushed.
+func (g *CommitGroup) Flush() error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	var staged []stagedWrites
+	for _, t := range g.trees {
+		t.staged.flushMtx.Lock()
+		defer t.staged.flushMtx.Unlock()
+		if writes, versions, _ := t.staged.take(); len(writes) > 0 {
+			staged = append(staged, stagedWrites{tree: t, writes: writes, versions: versions})
+		}
+	}
+	if len(staged) == 0 {
+		return nil
+	}
+
+	err := g.write(staged)
+	for _, s := range staged {
+		s.tree.staged.release(s.writes, s.versions, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to flush the staged writes of %d trees: %w", len(staged), err)
+	}
+	return nil
+}
+
+// discard drops the staged writes of all the trees of the group, and resets the trees, which
+// must then be loaded again.
+func (g *CommitGroup) discard() error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for _, t := range g.trees {
+		t.staged.flushMtx.Lock()
+		writes, versions, _ := t.staged.take()
+		t.staged.release(writes, versions, nil)
+		t.staged.flushMtx.Unlock()
+		if err := t.tree.Reset(t.staged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stagedWrites are the staged writes of a tree being flushed, see coalescingDB.take.
+type stagedWrites struct {
+	tree     *commitGroupTree
+	writes   map[string][]byte
+	versions int
+}
+
+func (g *CommitGroup) write(staged []stagedWrites) error {
+	batch := g.db.NewBatch()
+	defer batch.Close()
+	for _, s := range staged {
+		for key, value := range s.writes {
+			var err error
+			if value == nil {
+				err = batch.Delete(s.tree.key([]byte(key)))
+			} else {
+				err = batch.Set(s.tree.key([]byte(key)), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return batch.WriteSync()
+}
+
+// key returns the key of the DB of the group of a key of the tree.
+func (t *commitGroupTree) key(key []byte) []byte {
+	return prefixKey(t.prefix, key)
+}
+
+// prefixKey returns key prefixed by prefix.
+func prefixKey(prefix, key []byte) []byte {
+	prefixed := make([]byte, 0, len(prefix)+len(key))
+	return append(append(prefixed, prefix...), key...)
+}
+
+// prefixDB is the view of the keys of a DB with a prefix, without it.
+type prefixDB struct {
+	db     dbm.DB
+	prefix []byte
+}
+
+var _ dbm.DB = (*prefixDB)(nil)
+
+// withKeyPrefix returns the view of the keys of db with the prefix, if any, see the KeyPrefix
+// option.
+func withKeyPrefix(db dbm.DB, prefix []byte) dbm.DB {
+	if len(prefix) == 0 {
+		return db
+	}
+	return &prefixDB{db: db, prefix: bytes.Clone(prefix)}
+}
+
+// Get implements dbm.DB.
+func (db *prefixDB) Get(key []byte) ([]byte, error) {
+	return db.db.Get(prefixKey(db.prefix, key))
+}
+
+// Has implements dbm.DB.
+func (db *prefixDB) Has(key []byte) (bool, error) {
+	return db.db.Has(prefixKey(db.prefix, key))
+}
+
+// Iterator implements dbm.DB.
+func (db *prefixDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	pstart, pend := db.bounds(start, end)
+	itr, err := db.db.Iterator(pstart, pend)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixIterator{Iterator: itr, prefix: db.prefix, start: start, end: end}, nil
+}
+
+// ReverseIterator implements dbm.DB.
+func (db *prefixDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	pstart, pend := db.bounds(start, end)
+	itr, err := db.db.ReverseIterator(pstart, pend)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixIterator{Iterator: itr, prefix: db.prefix, start: start, end: end}, nil
+}
+
+// bounds returns the bounds of the DB of an iteration of the view, the nil bounds being the
+// bounds of the prefix. The prefix itself would be an empty key of the view, so it is skipped.
+func (db *prefixDB) bounds(start, end []byte) (pstart, pend []byte) {
+	if start == nil {
+		start = []byte{0}
+	}
+	pstart = prefixKey(db.prefix, start)
+	if end != nil {
+		return pstart, prefixKey(db.prefix, end)
+	}
+	// the end of the prefix is the first key after all the keys it prefixes, if any.
+	return pstart, prefixSuccessor(db.prefix)
+}
+
+// Close implements dbm.DB. The DB is shared, so it isn't closed.
+func (db *prefixDB) Close() error {
+	return nil
+}
+
+// NewBatch implements dbm.DB.
+func (db *prefixDB) NewBatch() dbm.Batch {
+	return &prefixBatch{Batch: db.db.NewBatch(), prefix: db.prefix}
+}
+
+// NewBatchWithSize implements dbm.DB.
+func (db *prefixDB) NewBatchWithSize(size int) dbm.Batch {
+	return &prefixBatch{Batch: db.db.NewBatchWithSize(size), prefix: db.prefix}
+}
+
+// prefixIterator is an iterator of a prefixDB, which strips the prefix of the keys.
+type prefixIterator struct {
+	dbm.Iterator
+	prefix     []byte
+	start, end []byte
+}
+
+// Domain implements dbm.Iterator.
+func (itr *prefixIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Key implements dbm.Iterator.
+func (itr *prefixIterator) Key() []byte {
+	return itr.Iterator.Key()[len(itr.prefix):]
+}
+
+// prefixBatch is a batch of a prefixDB, which prefixes the keys.
+type prefixBatch struct {
+	dbm.Batch
+	prefix []byte
+}
+
+// Set implements dbm.Batch.
+func (b *prefixBatch) Set(key, value []byte) error {
+	return b.Batch.Set(prefixKey(b.prefix, key), value)
+}
+
+// Delete implements dbm.Batch.
+func (b *prefixBatch) Delete(key []byte) error {
+	return b.Batch.Delete(prefixKey(b.prefix, key))
+}
@@ -0,0 +1,164 @@
+package iavl
+
+import (
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// newGroupTrees returns the trees of prefixes "a/" and "b/" of a new commit group over db,
+// loaded.
+func newGroupTrees(t *testing.T, db dbm.DB) (*CommitGroup, []*MutableTree) {
+	t.Helper()
+	group := NewCommitGroup(db)
+	var trees []*MutableTree
+	for _, prefix := range []string{"a/", "b/"} {
+		tree, err := group.NewMutableTree([]byte(prefix), 0, false, log.NewNopLogger())
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		trees = append(trees, tree)
+	}
+	return group, trees
+}
+
+func TestCommitGroup(t *testing.T) {
+	db := NewFaultInjectingDB()
+	group, trees := newGroupTrees(t, db)
+	references := []*MutableTree{
+		NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()),
+		NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()),
+	}
+
+	for version := 1; version <= 3; version++ {
+		for i, tree := range trees {
+			setFaultVersion(t, version*(i+1), tree, references[i])
+			hash, _, err := tree.StageSaveVersion()
+			require.NoError(t, err)
+			expectedHash, _, err := references[i].SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, expectedHash, hash)
+		}
+		// the staged versions are readable, but aren't written until the group is flushed.
+		itree, err := trees[0].GetImmutable(int64(version))
+		require.NoError(t, err)
+		value, err := itree.Get([]byte("key-11"))
+		require.NoError(t, err)
+		expected, err := references[0].Get([]byte("key-11"))
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+		if version == 2 {
+			require.Zero(t, db.Writes())
+			require.NoError(t, group.Flush())
+		}
+	}
+
+	// the trees are loaded at the flushed version, the later one being lost.
+	_, loaded := newGroupTrees(t, db)
+	for i, tree := range loaded {
+		require.EqualValues(t, 2, tree.Version())
+		expected, err := references[i].GetImmutable(2)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), tree.Hash())
+	}
+	require.NoError(t, group.Flush())
+	require.NoError(t, group.Flush())
+	for i, reference := range references {
+		requireLoadedTree(t, &prefixDB{db: db, prefix: []byte{"ab"[i], '/'}}, reference)
+	}
+}
+
+func TestCommitGroup_FlushFailure(t *testing.T) {
+	for name, inject := range map[string]func(db *FaultInjectingDB){
+		"batch write": func(db *FaultInjectingDB) { db.DelayFlush(1, 0) },
+		// the write of the second tree fails once the writes of the first one are batched.
+		"second tree": func(db *FaultInjectingDB) { db.FailWrite([]byte("b/"), 1) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := NewFaultInjectingDB()
+			group, trees := newGroupTrees(t, db)
+			for i, tree := range trees {
+				setFaultVersion(t, i, tree)
+				_, _, err := tree.StageSaveVersion()
+				require.NoError(t, err)
+			}
+			require.NoError(t, group.Flush())
+			for i, tree := range trees {
+				setFaultVersion(t, i+2, tree)
+				_, _, err := tree.StageSaveVersion()
+				require.NoError(t, err)
+			}
+
+			inject(db)
+			require.ErrorIs(t, group.Flush(), errInjected)
+			// neither version is written.
+			_, loaded := newGroupTrees(t, db)
+			for _, tree := range loaded {
+				require.EqualValues(t, 1, tree.Version())
+			}
+
+			// the writes stay staged, and are written by the next flush.
+			require.NoError(t, group.Flush())
+			_, loaded = newGroupTrees(t, db)
+			for i, tree := range loaded {
+				require.EqualValues(t, 2, tree.Version())
+				require.Equal(t, trees[i].Hash(), tree.Hash())
+			}
+		})
+	}
+}
+
+func TestCommitGroup_Invalid(t *testing.T) {
+	group := NewCommitGroup(dbm.NewMemDB())
+	_, err := group.NewMutableTree([]byte("ab"), 0, false, log.NewNopLogger())
+	require.NoError(t, err)
+	for _, prefix := range []string{"", "a", "ab", "abc"} {
+		_, err = group.NewMutableTree([]byte(prefix), 0, false, log.NewNopLogger())
+		require.ErrorIs(t, err, ErrInvalidInputs, prefix)
+	}
+	_, err = group.NewMutableTree([]byte("b"), 0, false, log.NewNopLogger(), CoalesceWindowOption(1))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+
+	_, _, err = NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).StageSaveVersion()
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
+
+func TestPrefixDB(t *testing.T) {
+	db := dbm.NewMemDB()
+	for _, key := range []string{"a", "p", "p\x00", "p1", "p2", "p\xff", "q"} {
+		require.NoError(t, db.Set([]byte(key), []byte(key)))
+	}
+	view := &prefixDB{db: db, prefix: []byte("p")}
+	keys := func(itr dbm.Iterator, err error) []string {
+		require.NoError(t, err)
+		defer itr.Close()
+		var keys []string
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key()))
+		}
+		return keys
+	}
+	require.Equal(t, []string{"\x00", "1", "2", "\xff"}, keys(view.Iterator(nil, nil)))
+	require.Equal(t, []string{"\xff", "2", "1", "\x00"}, keys(view.ReverseIterator(nil, nil)))
+	require.Equal(t, []string{"1"}, keys(view.Iterator([]byte("1"), []byte("2"))))
+
+	value, err := view.Get([]byte("1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("p1"), value)
+	batch := view.NewBatch()
+	require.NoError(t, batch.Set([]byte("3"), []byte("value")))
+	require.NoError(t, batch.Delete([]byte("1")))
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	has, err := db.Has([]byte("p3"))
+	require.NoError(t, err)
+	require.True(t, has)
+	require.Equal(t, []string{"\x00", "2", "3", "\xff"}, keys(view.Iterator(nil, nil)))
+
+	// a prefix of 0xff bytes ends with the keys.
+	require.NoError(t, db.Set([]byte("\xff\xff1"), []byte("value")))
+	require.Equal(t, []string{"1"}, keys((&prefixDB{db: db, prefix: []byte("\xff\xff")}).Iterator(nil, nil)))
+}
@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CommitListener receives the changes of every version saved by a MutableTree, e.g. to stream
+// them to an external write-ahead log or indexer (see ADR-038).
+type CommitListener interface {
+	// OnCommit is called by SaveVersion with the changes of the version about to be committed,
+	// sorted by key, in the order of the Comparator option if set. If it returns an error,
+	// SaveVersion fails without committing the version. The ChangeSet must not be modified.
+	OnCommit(version int64, cs *ChangeSet) error
+}
+
+// AddCommitListener registers a listener notified of the changes of every saved version. The
+// listeners are called in registration order, and the first error returned aborts SaveVersion,
+// in which case the later listeners aren't called. A version may still fail to commit after its
+// listeners were notified, e.g. on a database error.
+//
+// Only changes made after the registration are tracked, so listeners should be registered
+// before modifying the working tree.
+func (tree *MutableTree) AddCommitListener(listener CommitListener) {
+	tree.commitListeners = append(tree.commitListeners, listener)
+}
+
+// notifyCommitListeners passes the unsaved changes of the working tree to the commit listeners.
+func (tree *MutableTree) notifyCommitListeners(version int64) error {
+	if len(tree.commitListeners) == 0 {
+		return nil
+	}
+
+	cs := tree.unsavedChangeSet()
+	for i, listener := range tree.commitListeners {
+		if err := listener.OnCommit(version, cs); err != nil {
+			return fmt.Errorf("commit listener %d failed on version %d: %w", i, version, err)
+		}
+	}
+	return nil
+}
+
+// unsavedChangeSet returns the unsaved changes of the working tree, sorted by key.
+func (tree *MutableTree) unsavedChangeSet() *ChangeSet {
+	cs := &ChangeSet{}
+	for key, change := range tree.unsavedChanges {
+		switch {
+		case change.noop():
+		case change.value == nil:
+			cs.Pairs = append(cs.Pairs, &KVPair{Delete: true, Key: []byte(key)})
+		default:
+			cs.Pairs = append(cs.Pairs, &KVPair{Key: []byte(key), Value: change.value})
+		}
+	}
+	sort.Slice(cs.Pairs, func(i, j int) bool {
+		return tree.ndb.compare(cs.Pairs[i].Key, cs.Pairs[j].Key) < 0
+	})
+	return cs
+}
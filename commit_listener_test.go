@@ -0,0 +1,133 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+type commitEvent struct {
+	listener string
+	version  int64
+	cs       *ChangeSet
+}
+
+// testCommitListener records its calls into events, and returns err.
+type testCommitListener struct {
+	name   string
+	events *[]commitEvent
+	err    error
+}
+
+func (l *testCommitListener) OnCommit(version int64, cs *ChangeSet) error {
+	*l.events = append(*l.events, commitEvent{listener: l.name, version: version, cs: cs})
+	return l.err
+}
+
+func TestCommitListener(t *testing.T) {
+	var events []commitEvent
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	tree.AddCommitListener(&testCommitListener{name: "first", events: &events})
+	tree.AddCommitListener(&testCommitListener{name: "second", events: &events})
+
+	for _, key := range []string{"c", "a", "b", "d"} {
+		_, err := tree.Set([]byte(key), []byte(key+"1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// overwrites, removals and keys added then removed within the version.
+	_, err = tree.Set([]byte("a"), []byte("a2"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("a3"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("e"), []byte("e2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("e"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("d"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("d"), []byte("d2"))
+	require.NoError(t, err)
+	_, err = tree.Append([]byte("f"), []byte("f2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// an empty version is notified as well.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	expected := []*ChangeSet{
+		{Pairs: []*KVPair{
+			{Key: []byte("a"), Value: []byte("a1")},
+			{Key: []byte("b"), Value: []byte("b1")},
+			{Key: []byte("c"), Value: []byte("c1")},
+			{Key: []byte("d"), Value: []byte("d1")},
+		}},
+		{Pairs: []*KVPair{
+			{Key: []byte("a"), Value: []byte("a3")},
+			{Key: []byte("b"), Delete: true},
+			{Key: []byte("d"), Value: []byte("d2")},
+			{Key: []byte("f"), Value: []byte("f2")},
+		}},
+		{},
+	}
+	require.Len(t, events, 2*len(expected))
+	for i, cs := range expected {
+		version := int64(i + 1)
+		require.Equal(t, commitEvent{listener: "first", version: version, cs: cs}, events[2*i])
+		require.Equal(t, commitEvent{listener: "second", version: version, cs: cs}, events[2*i+1])
+	}
+
+	// the change sets match the state changes extracted from the saved versions.
+	err = tree.TraverseStateChanges(1, 3, func(version int64, cs *ChangeSet) error {
+		require.Equal(t, expected[version-1].Pairs, cs.Pairs)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCommitListener_Error(t *testing.T) {
+	db := dbm.NewMemDB()
+	var events []commitEvent
+	errListener := errors.New("stream unavailable")
+	failing := &testCommitListener{name: "failing", events: &events, err: errListener}
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	tree.AddCommitListener(failing)
+	tree.AddCommitListener(&testCommitListener{name: "next", events: &events})
+
+	_, err := tree.Set([]byte("a"), []byte("a1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errListener)
+
+	// the version isn't committed, and the next listeners aren't called.
+	require.Len(t, events, 1)
+	require.False(t, tree.VersionExists(1))
+	require.Zero(t, tree.Version())
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+
+	// the working tree is intact, so saving can be retried.
+	failing.err = nil
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Len(t, events, 3)
+	expected := &ChangeSet{Pairs: []*KVPair{{Key: []byte("a"), Value: []byte("a1")}}}
+	require.Equal(t, commitEvent{listener: "failing", version: 1, cs: expected}, events[1])
+	require.Equal(t, commitEvent{listener: "next", version: 1, cs: expected}, events[2])
+
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a1"), value)
+}
@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const commitMarkerKey = "pending_commit"
+
+// The operations recorded by the commit marker.
+const (
+	commitSave           byte = iota + 1 // SaveVersion of the version from
+	commitDeleteTo                       // deletion of the versions from to to by DeleteVersionsTo
+	commitDeleteBetween                  // deletion of the versions from to to by the pruning policy
+	commitDeleteFrom                     // deletion of the versions from to to by DeleteVersionsFrom
+	commitMarkerValueLen = 1 + 2*int64Size
+)
+
+// RepairInfo reports the repair of an operation interrupted by a crash, e.g. a SaveVersion whose
+// batch was partially written, see MutableTree.LastRepair.
+type RepairInfo struct {
+	// Operation is the interrupted operation: "SaveVersion", "DeleteVersionsTo",
+	// "DeleteVersionsFrom", or "prune" for the deletion of the versions by the pruning policy.
+	Operation string
+	// FromVersion and ToVersion are the versions of the operation, inclusive. Both are the
+	// version saved for SaveVersion.
+	FromVersion, ToVersion int64
+	// RolledBack is true if the writes of the operation were discarded, as for SaveVersion, and
+	// false if the operation was completed, as for the deletions.
+	RolledBack bool
+}
+
+// beginCommit adds the commit marker of an operation to the batch, ahead of its writes, so that
+// the operation is repaired on the next load if the batch is only partially written, i.e. if the
+// batch is flushed, see Options.FlushThreshold, or spilled, see Options.SpillThreshold, and the
+// process crashes or the operation fails before the final Commit, which deletes the marker. The
+// batch is written in order, so the writes of the operation all follow the marker.
+func (ndb *nodeDB) beginCommit(op byte, from, to int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	value := make([]byte, commitMarkerValueLen)
+	value[0] = op
+	binary.BigEndian.PutUint64(value[1:], uint64(from))
+	binary.BigEndian.PutUint64(value[1+int64Size:], uint64(to))
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(commitMarkerKey)), value); err != nil {
+		return err
+	}
+	ndb.pendingCommit = true
+	return nil
+}
+
+// endCommit deletes the commit marker in the batch, if any, for the Commit writing it. The
+// caller must hold ndb.mtx.
+func (ndb *nodeDB) endCommit() error {
+	if !ndb.pendingCommit {
+		return nil
+	}
+	if err := ndb.batch.Delete(metadataKeyFormat.Key([]byte(commitMarkerKey))); err != nil {
+		return err
+	}
+	ndb.pendingCommit = false
+	return nil
+}
+
+// repairCommit repairs the operation whose commit marker was left in the DB, if any, and returns
+// its report, nil if there was none. An interrupted SaveVersion is rolled back: the nodes of the
+// version are deleted, along with its key count, and the fast storage and the latest store,
+// which may hold some of its changes, are marked to be rebuilt by the load. An interrupted
+// deletion is completed instead, since the nodes it deleted may be missing from its versions.
+func (ndb *nodeDB) repairCommit() (*RepairInfo, error) {
+	value, err := ndb.db.Get(metadataKeyFormat.Key([]byte(commitMarkerKey)))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	if len(value) != commitMarkerValueLen {
+		return nil, fmt.Errorf("invalid commit marker %X", value)
+	}
+	op := value[0]
+	from := int64(binary.BigEndian.Uint64(value[1:]))
+	to := int64(binary.BigEndian.Uint64(value[1+int64Size:]))
+
+	info := &RepairInfo{FromVersion: from, ToVersion: to}
+	switch op {
+	case commitSave:
+		info.Operation, info.RolledBack = "SaveVersion", true
+		err = ndb.rollbackVersion(from)
+	case commitDeleteTo:
+		info.Operation = "DeleteVersionsTo"
+		err = ndb.completeDeleteVersions(from, to, false)
+	case commitDeleteBetween:
+		info.Operation = "prune"
+		err = ndb.completeDeleteVersions(from, to, true)
+	case commitDeleteFrom:
+		info.Operation = "DeleteVersionsFrom"
+		err = ndb.completeDeleteVersionsFrom(from, to)
+	default:
+		return nil, fmt.Errorf("invalid commit marker operation %d", op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to repair the interrupted %s of versions %d to %d: %w", info.Operation, from, to, err)
+	}
+	// the marker is deleted along with the repair.
+	ndb.mtx.Lock()
+	ndb.pendingCommit = true
+	ndb.mtx.Unlock()
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+	ndb.resetFirstVersion(0)
+	ndb.resetLatestVersion(0)
+	ndb.logger.Info("repaired interrupted operation", "operation", info.Operation, "from", from, "to", to, "rolledBack", info.RolledBack)
+	return info, nil
+}
+
+// rollbackVersion discards the writes of the version whose SaveVersion was interrupted.
+func (ndb *nodeDB) rollbackVersion(version int64) error {
+	var deleted [][]byte
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1), func(k, _ []byte) error {
+		deleted = append(deleted, append([]byte{}, k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range deleted {
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+	}
+	if err := ndb.deleteValues(version, version); err != nil {
+		return err
+	}
+	if err := ndb.deleteKeyCounts(version, version); err != nil {
+		return err
+	}
+
+	// the fast storage version of the interrupted version doesn't match the latest version, so
+	// that the load rebuilds the fast storage.
+	if ndb.getStorageVersion() >= fastStorageVersionValue {
+		if err := ndb.SetFastStorageVersionToBatch(version); err != nil {
+			return err
+		}
+	}
+	if _, ok, err := ndb.getLatestStoreVersion(); err != nil {
+		return err
+	} else if ok {
+		if err := ndb.setLatestStoreVersionToBatch(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeDeleteVersions completes the deletion of the versions from from to to, as
+// deleteVersionRange. The nodes older than from it deletes first are deleted again only if the
+// first version is left, since its tree must be walked to find them; they were all deleted
+// otherwise, since the batch is written in order.
+func (ndb *nodeDB) completeDeleteVersions(from, to int64, between bool) error {
+	retainsPrevious := between
+	if !retainsPrevious {
+		has, err := ndb.hasVersion(from)
+		if err != nil {
+			return err
+		}
+		retainsPrevious = !has
+	}
+	if _, err := ndb.deleteVersionRange(from, to, retainsPrevious); err != nil {
+		return err
+	}
+	if !between {
+		return ndb.deletePrunedVersionMarks(from, to)
+	}
+	for version := from; version <= to; version++ {
+		if err := ndb.batch.Set(prunedVersionKeyFormat.KeyInt64(version), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeDeleteVersionsFrom completes the deletion of the versions from from to latest, as
+// DeleteVersionsFrom.
+func (ndb *nodeDB) completeDeleteVersionsFrom(from, latest int64) error {
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(from), nodeKeyPrefixFormat.KeyInt64(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	if err := ndb.deletePrunedVersionMarks(from, latest); err != nil {
+		return err
+	}
+	if err := ndb.deleteValues(from, latest); err != nil {
+		return err
+	}
+	return ndb.deleteKeyCounts(from, latest)
+}
+
+// LastRepair returns the report of the operation interrupted by a crash which the last load
+// repaired, nil if none was. The load rolls back a SaveVersion whose batch was partially
+// written, and completes an interrupted deletion of versions, e.g. by the pruning, so that the
+// nodes of the versions are consistent again.
+func (tree *MutableTree) LastRepair() *RepairInfo {
+	return tree.lastRepair
+}
@@ -0,0 +1,136 @@
+package iavl
+
+import (
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// versionNodes returns the number of node records of the version in db.
+func versionNodes(t *testing.T, db dbm.DB, version int64) int {
+	t.Helper()
+	itr, err := db.Iterator(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1))
+	require.NoError(t, err)
+	defer itr.Close()
+	n := 0
+	for ; itr.Valid(); itr.Next() {
+		n++
+	}
+	return n
+}
+
+func TestRepairCommit_SaveVersion(t *testing.T) {
+	for _, prefix := range []string{"s", fastKeyFormat.Prefix()} {
+		for n := 1; ; n++ {
+			db := NewFaultInjectingDB()
+			tree := NewMutableTree(db, 0, false, log.NewNopLogger(), FlushThresholdOption(200))
+			previous := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+			setFaultVersion(t, 0, tree, previous)
+			for _, tree := range []*MutableTree{tree, previous} {
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+
+			setFaultVersion(t, 1, tree)
+			db.FailWrite([]byte(prefix), n)
+			_, _, err := tree.SaveVersion()
+			if err == nil {
+				require.Greater(t, n, 1)
+				break
+			}
+			require.ErrorIs(t, err, errInjected)
+
+			// the writes flushed before the failure are rolled back by the next load.
+			loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+			version, err := loaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, int64(1), version)
+			if repair := loaded.LastRepair(); repair != nil {
+				require.Equal(t, &RepairInfo{Operation: "SaveVersion", FromVersion: 2, ToVersion: 2, RolledBack: true}, repair)
+			}
+			require.Zero(t, versionNodes(t, db, 2), "prefix %q, write %d", prefix, n)
+			requireLoadedTree(t, db, previous)
+
+			// the version is saved again from the loaded tree.
+			setFaultVersion(t, 1, loaded, previous)
+			hash, _, err := loaded.SaveVersion()
+			require.NoError(t, err)
+			expectedHash, _, err := previous.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, expectedHash, hash)
+			require.Nil(t, NewMutableTree(db, 0, false, log.NewNopLogger()).LastRepair())
+			requireLoadedTree(t, db, previous)
+		}
+	}
+}
+
+func TestRepairCommit_Repaired(t *testing.T) {
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), FlushThresholdOption(200))
+	setFaultVersion(t, 0, tree)
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	setFaultVersion(t, 1, tree)
+	db.FailWrite(nodeKeyFormat.Prefix(), 20)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errInjected)
+	require.NotZero(t, versionNodes(t, db, 2))
+
+	loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	require.NotNil(t, loaded.LastRepair())
+	require.Zero(t, versionNodes(t, db, 2))
+
+	// the marker is deleted along with the repair.
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	require.Nil(t, loaded.LastRepair())
+}
+
+func TestRepairCommit_DeleteVersionsTo(t *testing.T) {
+	for n := 1; ; n++ {
+		db := NewFaultInjectingDB()
+		tree := NewMutableTree(db, 0, false, log.NewNopLogger(), FlushThresholdOption(200))
+		referenceDB := dbm.NewMemDB()
+		reference := NewMutableTree(referenceDB, 0, false, log.NewNopLogger())
+		for version := 0; version < 5; version++ {
+			setFaultVersion(t, version, tree, reference)
+			for _, tree := range []*MutableTree{tree, reference} {
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, reference.DeleteVersionsTo(3))
+
+		db.DelayFlush(n, 0)
+		err := tree.DeleteVersionsTo(3)
+		if err == nil {
+			require.Greater(t, n, 1)
+			break
+		}
+		require.ErrorIs(t, err, errInjected)
+
+		// the deletion is completed by the next load.
+		loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+		_, err = loaded.Load()
+		require.NoError(t, err)
+		if loaded.LastRepair() == nil {
+			// nothing was written.
+			require.Equal(t, []int{1, 2, 3, 4, 5}, loaded.AvailableVersions())
+			continue
+		}
+		require.Equal(t, &RepairInfo{Operation: "DeleteVersionsTo", FromVersion: 1, ToVersion: 3}, loaded.LastRepair())
+		require.Equal(t, []int{4, 5}, loaded.AvailableVersions(), "flush %d", n)
+		for version := int64(1); version <= 3; version++ {
+			require.Equal(t, versionNodes(t, referenceDB, version), versionNodes(t, db, version))
+		}
+		require.NoError(t, loaded.VerifyIntegrity(4, 1))
+		require.NoError(t, loaded.VerifyIntegrity(5, 1))
+		require.Equal(t, reference.ndb.size(), loaded.ndb.size())
+		requireLoadedTree(t, db, reference)
+	}
+}
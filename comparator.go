@@ -0,0 +1,84 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// Comparator orders the keys of a tree. It returns a negative number if a sorts before b, a
+// positive number if a sorts after b, and zero if a and b are the same key. It must define a
+// strict total order, where only identical keys compare equal.
+type Comparator func(a, b []byte) int
+
+// compare compares two keys with the Comparator option, or lexicographically if it isn't set.
+// The result is normalized to -1, 0 or +1.
+func (ndb *nodeDB) compare(a, b []byte) int {
+	if ndb.opts.Comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	switch c := ndb.opts.Comparator(a, b); {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// VerifyNonMembershipWithComparator is like ics23.VerifyNonMembership with the IAVL spec, but
+// orders the key and the neighbors of the proof with the given comparator, as required for the
+// proofs of a tree built with the Comparator option. A nil comparator orders the keys
+// lexicographically. Batch proofs are not supported.
+func VerifyNonMembershipWithComparator(compare Comparator, root []byte, proof *ics23.CommitmentProof, key []byte) bool {
+	nonexist := ics23.Decompress(proof).GetNonexist()
+	if nonexist == nil || !bytes.Equal(nonexist.Key, key) {
+		return false
+	}
+	return verifyNonExistence(ics23.IavlSpec, compare, root, nonexist) == nil
+}
+
+// verifyNonExistence mirrors ics23.NonExistenceProof.Verify with a custom key order.
+func verifyNonExistence(spec *ics23.ProofSpec, compare Comparator, root []byte, proof *ics23.NonExistenceProof) error {
+	if compare == nil {
+		compare = bytes.Compare
+	}
+	left, right := proof.Left, proof.Right
+	if left == nil && right == nil {
+		return errors.New("both left and right proofs missing")
+	}
+	if left != nil {
+		if err := left.Verify(spec, root, left.Key, left.Value); err != nil {
+			return err
+		}
+		if compare(proof.Key, left.Key) <= 0 {
+			return errors.New("key is not right of left proof")
+		}
+	}
+	if right != nil {
+		if err := right.Verify(spec, root, right.Key, right.Value); err != nil {
+			return err
+		}
+		if compare(proof.Key, right.Key) >= 0 {
+			return errors.New("key is not left of right proof")
+		}
+	}
+
+	switch {
+	case left == nil:
+		if !ics23.IsLeftMost(spec.InnerSpec, right.Path) {
+			return errors.New("left proof missing, right proof must be left-most")
+		}
+	case right == nil:
+		if !ics23.IsRightMost(spec.InnerSpec, left.Path) {
+			return errors.New("right proof missing, left proof must be right-most")
+		}
+	default:
+		if !ics23.IsLeftNeighbor(spec.InnerSpec, left.Path, right.Path) {
+			return errors.New("left and right proofs are not neighbors")
+		}
+	}
+	return nil
+}
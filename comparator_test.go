@@ -0,0 +1,178 @@
+package iavl
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// numericComparator orders decimal keys by their numeric value.
+func numericComparator(a, b []byte) int {
+	x, errA := strconv.Atoi(string(a))
+	y, errB := strconv.Atoi(string(b))
+	if errA != nil || errB != nil {
+		return bytes.Compare(a, b)
+	}
+	return x - y
+}
+
+func numericKeys(from, to, step int) []string {
+	var keys []string
+	for i := from; i <= to; i += step {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	return keys
+}
+
+func TestComparator(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ComparatorOption(numericComparator))
+	for _, key := range numericKeys(2, 400, 2) {
+		_, err := tree.Set([]byte(key), []byte("v1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for _, key := range numericKeys(10, 90, 40) {
+		_, err := tree.Set([]byte(key), []byte("v2"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte("4"))
+	require.NoError(t, err)
+
+	collect := func(itr interface {
+		Valid() bool
+		Next()
+		Key() []byte
+		Close() error
+	},
+	) []string {
+		defer itr.Close()
+		var keys []string
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key()))
+		}
+		return keys
+	}
+
+	// the unsaved changes are iterated in order too.
+	expected := append([]string{"2"}, numericKeys(6, 400, 2)...)
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.Equal(t, expected, collect(itr))
+
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the iteration and range queries follow the comparator, with and without the fast storage.
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	itr, err = itree.Iterator([]byte("5"), []byte("50"), true)
+	require.NoError(t, err)
+	require.Equal(t, numericKeys(6, 48, 2), collect(itr))
+	itr, err = tree.Iterator([]byte("300"), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"400", "398"}, collect(itr)[:2])
+	var keys []string
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, keys)
+	keys = nil
+	itree.IterateRange([]byte("90"), []byte("110"), false, func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.Equal(t, []string{"108", "106", "104", "102", "100", "98", "96", "94", "92", "90"}, keys)
+
+	key, _, err := itree.GetByIndex(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), key)
+	index, value, err := itree.GetWithIndex([]byte("90"))
+	require.NoError(t, err)
+	require.Equal(t, int64(43), index)
+	require.Equal(t, []byte("v2"), value)
+
+	// the state changes are streamed in order.
+	require.NoError(t, itree.TraverseStateChanges(2, 2, func(_ int64, cs *ChangeSet) error {
+		keys = nil
+		for _, pair := range cs.Pairs {
+			keys = append(keys, string(pair.Key))
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"4", "10", "50", "90"}, keys)
+
+	// the root hash is the same once reloaded with the comparator.
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), ComparatorOption(numericComparator))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, reloaded.Hash())
+	value, err = reloaded.Get([]byte("90"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+}
+
+func TestComparator_Proofs(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ComparatorOption(numericComparator))
+	for _, key := range numericKeys(2, 400, 2) {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	for _, key := range []string{"2", "36", "100", "400"} {
+		proof, err := tree.GetProof([]byte(key))
+		require.NoError(t, err)
+		ok, err := tree.VerifyProof(proof, []byte(key))
+		require.NoError(t, err)
+		require.True(t, ok, key)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, []byte(key), []byte("value-"+key)), key)
+	}
+
+	for _, key := range []string{"1", "35", "101", "401", "1001"} {
+		proof, err := tree.GetProof([]byte(key))
+		require.NoError(t, err)
+		require.NotNil(t, proof.GetNonexist(), key)
+		ok, err := tree.VerifyProof(proof, []byte(key))
+		require.NoError(t, err)
+		require.True(t, ok, key)
+		require.True(t, VerifyNonMembershipWithComparator(numericComparator, root, proof, []byte(key)), key)
+
+		// another key isn't proven absent by the proof.
+		require.False(t, VerifyNonMembershipWithComparator(numericComparator, root, proof, []byte("36")), key)
+	}
+
+	// the proofs of keys whose neighbors are ordered differently only verify with the comparator.
+	proof, err := tree.GetProof([]byte("1001"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("400"), proof.GetNonexist().Left.Key)
+	require.Nil(t, proof.GetNonexist().Right)
+	require.False(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, []byte("1001")))
+	require.False(t, VerifyNonMembershipWithComparator(nil, root, proof, []byte("1001")))
+	require.False(t, VerifyNonMembershipWithComparator(numericComparator, []byte("bad root"), proof, []byte("1001")))
+
+	// a proof built for a lexicographic tree with the same keys doesn't verify with the comparator.
+	lexical := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range numericKeys(2, 400, 2) {
+		_, err := lexical.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err = lexical.SaveVersion()
+	require.NoError(t, err)
+	require.NotEqual(t, root, lexical.Hash())
+	proof, err = lexical.GetProof([]byte("35"))
+	require.NoError(t, err)
+	require.True(t, VerifyNonMembershipWithComparator(nil, lexical.Hash(), proof, []byte("35")))
+	require.False(t, VerifyNonMembershipWithComparator(numericComparator, lexical.Hash(), proof, []byte("35")))
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, lexical.Hash(), proof, []byte("35")))
+}
@@ -34,6 +34,10 @@ func (e *CompressExporter) Next() (*ExportNode, error) {
 	if err != nil {
 		return nil, err
 	}
+	if n.Deleted {
+		// tombstones are not part of the tree structure, so they are left as is.
+		return n, nil
+	}
 
 	if n.Height == 0 {
 		// apply delta encoding to leaf keys
@@ -69,6 +73,9 @@ func NewCompressImporter(importer NodeImporter) NodeImporter {
 }
 
 func (i *CompressImporter) Add(node *ExportNode) error {
+	if node.Deleted {
+		return i.inner.Add(node)
+	}
 	if node.Height == 0 {
 		key, err := deltaDecode(node.Key, i.lastKey)
 		if err != nil {
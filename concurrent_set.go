@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+// concurrentSetShards is the number of buffers the ConcurrentSet writes are spread over.
+const concurrentSetShards = 64
+
+// ErrConcurrentSetDisabled is returned by ConcurrentSet when the ConcurrentSet option isn't set.
+var ErrConcurrentSetDisabled = errors.New("concurrent set is disabled")
+
+// concurrentSets buffers the ConcurrentSet writes until they are applied to the working tree.
+// The keys are spread over shards by hash, each guarded by its own lock, so that the buffering
+// of different keys seldom contends. The tree itself isn't sharded.
+type concurrentSets struct {
+	seed   maphash.Seed
+	shards [concurrentSetShards]struct {
+		mtx    sync.Mutex
+		writes map[string][]byte
+	}
+}
+
+func newConcurrentSets() *concurrentSets {
+	return &concurrentSets{seed: maphash.MakeSeed()}
+}
+
+// ConcurrentSet buffers the write of a key to the working tree, and may be called concurrently
+// with itself from multiple goroutines. It is EXPERIMENTAL and requires the ConcurrentSet option.
+//
+// It is a buffered write, not a concurrent mutation of the tree: only the buffering runs in
+// parallel, the writes being applied to the working tree serially, in key order, by
+// ApplyConcurrentSets or SaveVersion. Until then, they are not visible to reads, and they override
+// the other writes to the same keys. The root hash is thus the same as if the writes had been
+// Set serially in key order. The writes of concurrent calls to the same key are applied in an
+// unspecified order, so concurrent writers should use disjoint keys.
+func (tree *MutableTree) ConcurrentSet(key, value []byte) error {
+	if tree.concurrentSets == nil {
+		return ErrConcurrentSetDisabled
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if value == nil {
+		return fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	shard := &tree.concurrentSets.shards[maphash.Bytes(tree.concurrentSets.seed, key)%concurrentSetShards]
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if shard.writes == nil {
+		shard.writes = make(map[string][]byte)
+	}
+	shard.writes[string(key)] = value
+	return nil
+}
+
+// ApplyConcurrentSets applies the writes buffered by ConcurrentSet to the working tree, in key
+// order. It is called by SaveVersion, and must not be called concurrently with ConcurrentSet for
+// the outcome to be deterministic.
+func (tree *MutableTree) ApplyConcurrentSets() error {
+	if tree.concurrentSets == nil {
+		return nil
+	}
+	writes := tree.concurrentSets.take()
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return tree.ndb.compare([]byte(keys[i]), []byte(keys[j])) < 0
+	})
+	for _, key := range keys {
+		if _, err := tree.set([]byte(key), writes[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take returns the buffered writes and resets the buffers.
+func (c *concurrentSets) take() map[string][]byte {
+	writes := make(map[string][]byte)
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mtx.Lock()
+		for key, value := range shard.writes {
+			writes[key] = value
+		}
+		shard.writes = nil
+		shard.mtx.Unlock()
+	}
+	return writes
+}
@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestConcurrentSet(t *testing.T) {
+	const writers, keysPerWriter = 16, 200
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ConcurrentSetOption(true))
+	serial := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	for version := 1; version <= 3; version++ {
+		// every writer sets its own keys, in a random order.
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(version*writers + w)))
+				for _, i := range r.Perm(keysPerWriter) {
+					key := []byte(fmt.Sprintf("key-%02d-%04d", w, i*version))
+					value := []byte(fmt.Sprintf("value-%d", version))
+					if err := tree.ConcurrentSet(key, value); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// the same writes are applied serially, in key order.
+		for w := 0; w < writers; w++ {
+			for i := 0; i < keysPerWriter; i++ {
+				_, err := serial.Set([]byte(fmt.Sprintf("key-%02d-%04d", w, i*version)), []byte(fmt.Sprintf("value-%d", version)))
+				require.NoError(t, err)
+			}
+		}
+
+		hash, v, err := tree.SaveVersion()
+		require.NoError(t, err)
+		serialHash, serialV, err := serial.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, serialV, v)
+		require.Equal(t, serialHash, hash)
+		require.Equal(t, serial.Size(), tree.Size())
+	}
+
+	value, err := tree.Get([]byte("key-03-0010"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-2"), value)
+}
+
+func TestConcurrentSet_Buffered(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ConcurrentSetOption(true))
+	_, err := tree.Set([]byte("a"), []byte("set"))
+	require.NoError(t, err)
+	require.NoError(t, tree.ConcurrentSet([]byte("a"), []byte("concurrent")))
+	require.Error(t, tree.ConcurrentSet([]byte("b"), nil))
+
+	// the writes are only visible once applied, and override the other writes.
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("set"), value)
+	require.NoError(t, tree.ApplyConcurrentSets())
+	value, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("concurrent"), value)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the buffered writes are discarded by Rollback.
+	require.NoError(t, tree.ConcurrentSet([]byte("b"), []byte("b")))
+	tree.Rollback()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	has, err := tree.Has([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the option is required.
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.ErrorIs(t, tree.ConcurrentSet([]byte("a"), []byte("a")), ErrConcurrentSetDisabled)
+	require.NoError(t, tree.ApplyConcurrentSets())
+}
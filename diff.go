@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"bytes"
+	"errors"
 
 	"github.com/cosmos/iavl/proto"
 )
@@ -14,14 +15,97 @@ type (
 // KVPairReceiver is callback parameter of method `extractStateChanges` to receive stream of `KVPair`s.
 type KVPairReceiver func(pair *KVPair) error
 
-// extractStateChanges extracts the state changes by between two versions of the tree.
+// extractStateChanges extracts the state changes by between two versions of the tree, as a
+// stream of `KVPair`s passed to the receiver, see extractLeafChanges.
+func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte, receiver KVPairReceiver) error {
+	return ndb.extractLeafChanges(prevVersion, prevRoot, root, func(orphaned, newLeaf *Node) error {
+		if newLeaf == nil {
+			return receiver(&KVPair{
+				Delete: true,
+				Key:    orphaned.key,
+			})
+		}
+		value, err := ndb.leafValue(newLeaf)
+		if err != nil {
+			return err
+		}
+		return receiver(&KVPair{
+			Key:   newLeaf.key,
+			Value: value,
+		})
+	})
+}
+
+// errStopValueChanges stops the extraction of the changes of IterateValueChanges.
+var errStopValueChanges = errors.New("stop value changes")
+
+// IterateValueChanges calls fn with every key whose value differs between the given version and
+// the previous one, in ascending order, with its value in both versions: the old value is nil for
+// a key added by the version, and the new value is nil for a key it removes. The keys set to the
+// value they already had are skipped. The changes are derived by comparing the leaves orphaned by
+// the version with the leaves it adds, so the previous version must still be available, unless
+// the version is the first one of the tree, whose keys are all added. The iteration stops when fn
+// returns true.
+func (tree *MutableTree) IterateValueChanges(version int64, fn func(key, oldValue, newValue []byte) bool) error {
+	root, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	prev, err := tree.previousVersion(version)
+	if err != nil {
+		return err
+	}
+	var prevRoot []byte
+	if prev > 0 {
+		if prevRoot, err = tree.ndb.GetRoot(prev); err != nil {
+			return err
+		}
+	}
+
+	err = tree.ndb.extractLeafChanges(prev, prevRoot, root, func(orphaned, newLeaf *Node) error {
+		var (
+			key, oldValue, newValue []byte
+			err                     error
+		)
+		if orphaned != nil {
+			key = orphaned.key
+			if oldValue, err = tree.ndb.leafValue(orphaned); err != nil {
+				return err
+			}
+		}
+		if newLeaf != nil {
+			key = newLeaf.key
+			if newValue, err = tree.ndb.leafValue(newLeaf); err != nil {
+				return err
+			}
+		}
+		if orphaned != nil && newLeaf != nil && bytes.Equal(oldValue, newValue) {
+			return nil
+		}
+		if fn(tree.ndb.copyBytes(key), tree.ndb.copyBytes(oldValue), tree.ndb.copyBytes(newValue)) {
+			return errStopValueChanges
+		}
+		return nil
+	})
+	if errors.Is(err, errStopValueChanges) {
+		return nil
+	}
+	return err
+}
+
+// leafChangeReceiver is callback parameter of method `extractLeafChanges` to receive the changed
+// leaves, in key order: the orphaned leaf is nil for an insertion, the new leaf is nil for a
+// removal, and both have the same key for an update.
+type leafChangeReceiver func(orphaned, newLeaf *Node) error
+
+// extractLeafChanges extracts the changed leaves between two versions of the tree.
 // it first traverse the `root` tree until the first `sharedNode` and record the new leave nodes,
 // then traverse the `prevRoot` tree until the current `sharedNode` to find out orphaned leave nodes,
-// compare orphaned leave nodes and new leave nodes to produce stream of `KVPair`s and passed to callback.
+// compare orphaned leave nodes and new leave nodes to produce stream of changes and passed to callback.
 //
 // The algorithm don't run in constant memory strictly, but it tried the best the only
 // keep minimal intermediate states in memory.
-func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte, receiver KVPairReceiver) error {
+func (ndb *nodeDB) extractLeafChanges(prevVersion int64, prevRoot, root []byte, receiver leafChangeReceiver) error {
 	curIter, err := NewNodeIterator(root, ndb)
 	if err != nil {
 		return err
@@ -43,10 +127,7 @@ func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte,
 	// consumeNewLeaves concumes remaining `newLeaves` nodes and produce insertion `KVPair`.
 	consumeNewLeaves := func() error {
 		for _, node := range newLeaves {
-			if err := receiver(&KVPair{
-				Key:   node.key,
-				Value: node.value,
-			}); err != nil {
+			if err := receiver(nil, node); err != nil {
 				return err
 			}
 		}
@@ -87,40 +168,28 @@ func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte,
 	addOrphanedLeave := func(orphaned *Node) error {
 		for len(newLeaves) > 0 {
 			newLeave := newLeaves[0]
-			switch bytes.Compare(orphaned.key, newLeave.key) {
+			switch ndb.compare(orphaned.key, newLeave.key) {
 			case 1:
 				// consume a new node as insertion and continue
 				newLeaves = newLeaves[1:]
-				if err := receiver(&KVPair{
-					Key:   newLeave.key,
-					Value: newLeave.value,
-				}); err != nil {
+				if err := receiver(nil, newLeave); err != nil {
 					return err
 				}
 				continue
 
 			case -1:
 				// removal, don't consume new nodes
-				return receiver(&KVPair{
-					Delete: true,
-					Key:    orphaned.key,
-				})
+				return receiver(orphaned, nil)
 
 			case 0:
 				// update, consume the new node and stop
 				newLeaves = newLeaves[1:]
-				return receiver(&KVPair{
-					Key:   newLeave.key,
-					Value: newLeave.value,
-				})
+				return receiver(orphaned, newLeave)
 			}
 		}
 
 		// removal
-		return receiver(&KVPair{
-			Delete: true,
-			Key:    orphaned.key,
-		})
+		return receiver(orphaned, nil)
 	}
 
 	// Traverse `prevIter` to find orphaned nodes in the previous version,
@@ -101,3 +101,67 @@ func genChangeSets(r *rand.Rand, n int) []*ChangeSet {
 	}
 	return changeSets
 }
+
+func TestIterateValueChanges(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 30; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("key-05"), []byte("changed"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-10"), []byte("value-10")) // same value
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-15a"), []byte("added"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-20"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-99"), []byte("added"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-00"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	type change struct{ key, oldValue, newValue string }
+	changes := func(version int64, limit int) []change {
+		var changes []change
+		str := func(bz []byte) string {
+			if bz == nil {
+				return "<nil>"
+			}
+			return string(bz)
+		}
+		require.NoError(t, tree.IterateValueChanges(version, func(key, oldValue, newValue []byte) bool {
+			changes = append(changes, change{string(key), str(oldValue), str(newValue)})
+			return len(changes) == limit
+		}))
+		return changes
+	}
+	expected := []change{
+		{"key-00", "value-0", "<nil>"},
+		{"key-05", "value-5", "changed"},
+		{"key-15a", "<nil>", "added"},
+		{"key-20", "value-20", "<nil>"},
+		{"key-99", "<nil>", "added"},
+	}
+	require.Equal(t, expected, changes(2, 0))
+	require.Equal(t, expected[:2], changes(2, 2))
+
+	// the keys of the first version are all added.
+	first := changes(1, 0)
+	require.Len(t, first, 30)
+	require.Equal(t, change{"key-00", "<nil>", "value-0"}, first[0])
+
+	// a version without changes.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, changes(3, 0))
+
+	require.ErrorIs(t, tree.IterateValueChanges(4, func(_, _, _ []byte) bool { return false }), ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.ErrorIs(t, tree.IterateValueChanges(2, func(_, _, _ []byte) bool { return false }), ErrVersionDoesNotExist)
+}
@@ -0,0 +1,150 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ChangesetIterator streams the changes between two versions of a tree, returned by
+// MutableTree.DiffVersions, in ascending key order: a set for every key added or updated, with
+// its new value, and a delete for every key removed. Callers must call Close when done.
+type ChangesetIterator struct {
+	ndb      *nodeDB
+	versions [2]int64
+	ch       chan *KVPair
+	cancel   context.CancelFunc
+	pair     *KVPair
+	err      error // set before ch is closed
+	closed   bool
+}
+
+// DiffVersions returns an iterator over the changes transforming version from into version to,
+// e.g. to replay the deltas of a tree in another store without diffing their exports. The
+// versions may be any two available versions, to being before from as well, and they are read
+// directly, so the versions in between may have been pruned. The subtrees both versions share
+// are skipped, so the whole trees aren't read. The keys set to the value they already had are
+// skipped too.
+//
+// Both versions are protected from deletion until the iterator is closed.
+func (tree *MutableTree) DiffVersions(from, to int64) (*ChangesetIterator, error) {
+	for _, version := range []int64{from, to} {
+		if !tree.VersionExists(version) {
+			return nil, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+		}
+	}
+	fromRoot, err := tree.ndb.GetRoot(from)
+	if err != nil {
+		return nil, err
+	}
+	toRoot, err := tree.ndb.GetRoot(to)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := &ChangesetIterator{
+		ndb:      tree.ndb,
+		versions: [2]int64{from, to},
+		ch:       make(chan *KVPair, exportBufferSize),
+		cancel:   cancel,
+	}
+	tree.ndb.incrVersionReaders(from)
+	tree.ndb.incrVersionReaders(to)
+	go iter.diff(ctx, from, fromRoot, to, toRoot)
+	iter.Next()
+	return iter, nil
+}
+
+// errStopDiff stops the extraction of the changes once the iterator is closed.
+var errStopDiff = errors.New("stop diff")
+
+// diff extracts the changes into the channel, from the earlier version, whose nodes the later
+// one may share, so the leaves are swapped when diffing backwards.
+func (iter *ChangesetIterator) diff(ctx context.Context, from int64, fromRoot []byte, to int64, toRoot []byte) {
+	defer close(iter.ch)
+	if from == to {
+		return
+	}
+	backwards := to < from
+	if backwards {
+		from, fromRoot, to, toRoot = to, toRoot, from, fromRoot
+	}
+	err := iter.ndb.extractLeafChanges(from, fromRoot, toRoot, func(orphaned, newLeaf *Node) error {
+		if backwards {
+			orphaned, newLeaf = newLeaf, orphaned
+		}
+		var pair *KVPair
+		if newLeaf == nil {
+			pair = &KVPair{Delete: true, Key: iter.ndb.copyBytes(orphaned.key)}
+		} else {
+			value, err := iter.ndb.leafValue(newLeaf)
+			if err != nil {
+				return err
+			}
+			if orphaned != nil {
+				oldValue, err := iter.ndb.leafValue(orphaned)
+				if err != nil {
+					return err
+				}
+				if bytes.Equal(oldValue, value) {
+					return nil
+				}
+			}
+			pair = &KVPair{Key: iter.ndb.copyBytes(newLeaf.key), Value: iter.ndb.copyBytes(value)}
+		}
+		select {
+		case iter.ch <- pair:
+			return nil
+		case <-ctx.Done():
+			return errStopDiff
+		}
+	})
+	if err != nil && !errors.Is(err, errStopDiff) {
+		iter.err = err
+	}
+}
+
+// Valid returns whether the iterator is at a change, false once the changes are exhausted, the
+// diff failed, see Error, or the iterator is closed.
+func (iter *ChangesetIterator) Valid() bool {
+	return iter.pair != nil
+}
+
+// Next moves the iterator to the next change.
+func (iter *ChangesetIterator) Next() {
+	if iter.closed {
+		return
+	}
+	iter.pair = <-iter.ch
+}
+
+// Pair returns the current change: the key and its new value for a set, or the key with Delete
+// set for a delete. It is nil if the iterator isn't valid.
+func (iter *ChangesetIterator) Pair() *KVPair {
+	return iter.pair
+}
+
+// Error returns the error which stopped the diff, if any, once the iterator is no longer valid.
+func (iter *ChangesetIterator) Error() error {
+	if iter.Valid() {
+		return nil
+	}
+	return iter.err
+}
+
+// Close stops the diff and releases both versions. It is safe to call multiple times.
+func (iter *ChangesetIterator) Close() error {
+	if iter.closed {
+		return nil
+	}
+	iter.closed = true
+	iter.cancel()
+	for range iter.ch { //nolint:revive
+	} // drain channel
+	iter.pair = nil
+	iter.ndb.decrVersionReaders(iter.versions[0])
+	iter.ndb.decrVersionReaders(iter.versions[1])
+	return nil
+}
@@ -0,0 +1,137 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// expectedDiff returns the changes transforming the from state into the to one, in key order.
+func expectedDiff(from, to map[string]string) []*KVPair {
+	var pairs []*KVPair
+	for key, value := range to {
+		if fromValue, ok := from[key]; !ok || fromValue != value {
+			pairs = append(pairs, &KVPair{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			pairs = append(pairs, &KVPair{Delete: true, Key: []byte(key)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return string(pairs[i].Key) < string(pairs[j].Key) })
+	return pairs
+}
+
+func collectDiff(t *testing.T, tree *MutableTree, from, to int64) []*KVPair {
+	iter, err := tree.DiffVersions(from, to)
+	require.NoError(t, err)
+	defer iter.Close()
+	var pairs []*KVPair
+	for ; iter.Valid(); iter.Next() {
+		pairs = append(pairs, iter.Pair())
+	}
+	require.NoError(t, iter.Error())
+	return pairs
+}
+
+func TestDiffVersions(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	states := []map[string]string{nil}
+	state := make(map[string]string)
+	for version := 1; version <= 20; version++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key-%03d", r.Intn(200))
+			switch r.Intn(4) {
+			case 0:
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+				delete(state, key)
+			case 1:
+				// setting the same value doesn't change the key.
+				if value, ok := state[key]; ok {
+					_, err := tree.Set([]byte(key), []byte(value))
+					require.NoError(t, err)
+					continue
+				}
+				fallthrough
+			default:
+				value := fmt.Sprintf("value-%d-%d", version, i)
+				_, err := tree.Set([]byte(key), []byte(value))
+				require.NoError(t, err)
+				state[key] = value
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		snapshot := make(map[string]string, len(state))
+		for k, v := range state {
+			snapshot[k] = v
+		}
+		states = append(states, snapshot)
+	}
+
+	for from := int64(1); from <= 20; from++ {
+		for to := int64(1); to <= 20; to++ {
+			expected := expectedDiff(states[from], states[to])
+			require.Equal(t, expected, collectDiff(t, tree, from, to), "from %d to %d", from, to)
+		}
+	}
+
+	// the versions in between aren't needed.
+	opts := PruningOptions{KeepRecent: 1, KeepEvery: 5}
+	require.NoError(t, tree.ConfigurePruning(opts))
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 15, 20, 21}, tree.AvailableVersions())
+	require.Equal(t, expectedDiff(states[5], states[20]), collectDiff(t, tree, 5, 20))
+	require.Equal(t, expectedDiff(states[15], states[10]), collectDiff(t, tree, 15, 10))
+
+	_, err = tree.DiffVersions(5, 7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.DiffVersions(0, 5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestDiffVersions_Close(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%03d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the versions can't be deleted while the iterator is open.
+	iter, err := tree.DiffVersions(1, 2)
+	require.NoError(t, err)
+	require.True(t, iter.Valid())
+	require.Equal(t, &KVPair{Delete: true, Key: []byte("key-000")}, iter.Pair())
+	require.Error(t, tree.DeleteVersionsTo(1))
+
+	// closing it before the end stops the diff.
+	require.NoError(t, iter.Close())
+	require.False(t, iter.Valid())
+	require.Nil(t, iter.Pair())
+	require.NoError(t, iter.Error())
+	require.NoError(t, iter.Close())
+	require.NoError(t, tree.DeleteVersionsTo(1))
+
+	// there are no changes between a version and itself.
+	require.Empty(t, collectDiff(t, tree, 2, 2))
+	require.Empty(t, collectDiff(t, tree, 2, 3))
+}
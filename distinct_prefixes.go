@@ -0,0 +1,70 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DistinctPrefixes returns the distinct prefixes of the given length of the keys of the tree, in
+// ascending order, e.g. to list the namespaces of a store. Rather than iterating all the keys,
+// it seeks the first key of each prefix from the root, so it reads a path of the tree per
+// prefix. The keys shorter than length are returned as is, as the prefixes of their own, and a
+// length of 0 returns the empty prefix of all the keys. The keys of a prefix are only
+// contiguous in lexicographic order, so the tree can't use a custom Comparator.
+func (t *ImmutableTree) DistinctPrefixes(length int) ([][]byte, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("negative prefix length %d: %w", length, ErrInvalidInputs)
+	}
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return nil, fmt.Errorf("the prefixes of a tree with a custom comparator aren't contiguous: %w", ErrInvalidInputs)
+	}
+	if t.root == nil {
+		return nil, nil
+	}
+	if length == 0 {
+		return [][]byte{{}}, nil
+	}
+
+	var prefixes [][]byte
+	for start := []byte(nil); ; {
+		itr := NewIterator(start, nil, true, t)
+		var key []byte
+		if itr.Valid() {
+			key = itr.Key()
+		}
+		err := itr.Error()
+		itr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return prefixes, nil
+		}
+
+		if len(key) < length {
+			// the next key is the first one after key.
+			prefixes = append(prefixes, bytes.Clone(key))
+			start = append(bytes.Clone(key), 0)
+			continue
+		}
+		prefix := bytes.Clone(key[:length])
+		prefixes = append(prefixes, prefix)
+		if start = prefixSuccessor(prefix); start == nil {
+			return prefixes, nil
+		}
+	}
+}
+
+// prefixSuccessor returns the first key after all the keys with the prefix, or nil if there is
+// none, i.e. the prefix only has 0xff bytes.
+func prefixSuccessor(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
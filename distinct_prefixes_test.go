@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestDistinctPrefixes(t *testing.T) {
+	db := &readCountingDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, log.NewNopLogger())
+	for _, namespace := range []string{"aa", "ab", "ba", "zz", "\xff\xff"} {
+		for i := 0; i < 300; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("%s/%04d", namespace, i)), []byte{1})
+			require.NoError(t, err)
+		}
+	}
+	// a key shorter than the prefixes is a prefix of its own.
+	_, err := tree.Set([]byte("b"), []byte{1})
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	db.gets = 0
+	prefixes, err := itree.DistinctPrefixes(2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("aa"), []byte("ab"), []byte("b"), []byte("ba"), []byte("zz"), []byte("\xff\xff")}, prefixes)
+	prefixGets := db.gets
+
+	// the prefixes are found without reading most of the nodes.
+	db.gets = 0
+	keys := 0
+	itr := NewIterator(nil, nil, true, itree)
+	for ; itr.Valid(); itr.Next() {
+		keys++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 1501, keys)
+	require.Less(t, 10*prefixGets, db.gets)
+
+	prefixes, err = itree.DistinctPrefixes(1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("z"), []byte("\xff")}, prefixes)
+	prefixes, err = itree.DistinctPrefixes(0)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{}}, prefixes)
+	_, err = itree.DistinctPrefixes(-1)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+
+	prefixes, err = NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).ImmutableTree.DistinctPrefixes(2)
+	require.NoError(t, err)
+	require.Empty(t, prefixes)
+}
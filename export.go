@@ -23,6 +23,10 @@ type ExportNode struct {
 	Value   []byte
 	Version int64
 	Height  int8
+	// Deleted marks a tombstone exported by ImmutableTree.ExportWithTombstones, i.e. a key
+	// deleted since the given version, without value. Tombstones are exported as leaves of
+	// the exported version, and are never part of the tree structure.
+	Deleted bool
 }
 
 // Exporter exports nodes from an ImmutableTree. It is created by ImmutableTree.Export().
@@ -32,12 +36,19 @@ type ExportNode struct {
 // the same tree structure.
 type Exporter struct {
 	tree   *ImmutableTree
+	root   *Node          // the root of the exported subtree of the tree, see ExportPrefix
+	since  *ImmutableTree // the tree whose deleted keys are exported as tombstones, if any
 	ch     chan *ExportNode
 	cancel context.CancelFunc
+	err    error // error ending the export, set before ch is closed
 }
 
-// NewExporter creates a new Exporter. Callers must call Close() when done.
-func newExporter(tree *ImmutableTree) (*Exporter, error) {
+// NewExporter creates a new Exporter of the subtree of root, which buffers at most bufSize nodes
+// ahead of the consumer. Callers must call Close() when done.
+func newExporter(tree *ImmutableTree, root *Node, since *ImmutableTree, bufSize int) (*Exporter, error) {
+	if bufSize < 0 {
+		return nil, fmt.Errorf("export buffer size cannot be negative, got %d", bufSize)
+	}
 	if tree == nil {
 		return nil, fmt.Errorf("tree is nil: %w", ErrNotInitalizedTree)
 	}
@@ -49,11 +60,16 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	exporter := &Exporter{
 		tree:   tree,
-		ch:     make(chan *ExportNode, exportBufferSize),
+		root:   root,
+		since:  since,
+		ch:     make(chan *ExportNode, bufSize),
 		cancel: cancel,
 	}
 
 	tree.ndb.incrVersionReaders(tree.version)
+	if since != nil {
+		tree.ndb.incrVersionReaders(since.version)
+	}
 	go exporter.export(ctx)
 
 	return exporter, nil
@@ -61,10 +77,19 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 
 // export exports nodes
 func (e *Exporter) export(ctx context.Context) {
-	e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
+	defer close(e.ch)
+	if e.since != nil && !e.exportTombstones(ctx) {
+		return
+	}
+	e.root.traversePost(e.tree, true, func(node *Node) bool {
+		value, err := e.tree.ndb.leafValue(node)
+		if err != nil {
+			e.err = err
+			return true
+		}
 		exportNode := &ExportNode{
 			Key:     node.key,
-			Value:   node.value,
+			Value:   value,
 			Version: node.nodeKey.version,
 			Height:  node.subtreeHeight,
 		}
@@ -76,7 +101,31 @@ func (e *Exporter) export(ctx context.Context) {
 			return true
 		}
 	})
-	close(e.ch)
+}
+
+// exportTombstones exports the keys of the since tree which aren't in the tree in ascending
+// order, by iterating both trees, and returns false if the export was cancelled meanwhile.
+func (e *Exporter) exportTombstones(ctx context.Context) bool {
+	defer e.tree.ndb.decrVersionReaders(e.since.version)
+
+	deleted := NewIterator(nil, nil, true, e.since)
+	defer deleted.Close()
+	live := NewIterator(nil, nil, true, e.tree)
+	defer live.Close()
+	for ; deleted.Valid(); deleted.Next() {
+		for live.Valid() && e.tree.ndb.compare(live.Key(), deleted.Key()) < 0 {
+			live.Next()
+		}
+		if live.Valid() && e.tree.ndb.compare(live.Key(), deleted.Key()) == 0 {
+			continue
+		}
+		select {
+		case e.ch <- &ExportNode{Key: deleted.Key(), Version: e.tree.version, Deleted: true}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
 
 // Next fetches the next exported node, or returns ExportDone when done.
@@ -84,6 +133,9 @@ func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
 		return exportNode, nil
 	}
+	if e.err != nil {
+		return nil, e.err
+	}
 	return nil, ErrorExportDone
 }
 
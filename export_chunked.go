@@ -0,0 +1,235 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ChunkedExportFormat is the format of the chunked exports, recorded in their manifest, the flat
+// node stream of Exporter being the first one.
+const ChunkedExportFormat uint32 = 2
+
+// ErrChunkChecksumMismatch is returned when a chunk of a chunked export doesn't match the
+// checksum of its manifest, e.g. because it was corrupted in transit.
+var ErrChunkChecksumMismatch = errors.New("chunk checksum mismatch")
+
+// ChunkManifest describes a chunked export, see ImmutableTree.ExportChunked: the version and root
+// hash of the exported tree, and the SHA-256 checksum of each chunk, so that the chunks can be
+// fetched from untrusted peers, as by the state sync, and verified one at a time.
+type ChunkManifest struct {
+	Format      uint32   `json:"format"`
+	Version     int64    `json:"version"`
+	RootHash    []byte   `json:"root_hash"`
+	ChunkSize   int      `json:"chunk_size"`
+	ChunkHashes [][]byte `json:"chunk_hashes"`
+}
+
+// Chunks returns the number of chunks of the export.
+func (m *ChunkManifest) Chunks() int {
+	return len(m.ChunkHashes)
+}
+
+// Marshal encodes the manifest, as JSON.
+func (m *ChunkManifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// UnmarshalChunkManifest decodes a manifest encoded by ChunkManifest.Marshal, and validates it.
+func UnmarshalChunkManifest(bz []byte) (*ChunkManifest, error) {
+	m := &ChunkManifest{}
+	if err := json.Unmarshal(bz, m); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInputs, err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validate checks that the manifest is of a chunked export.
+func (m *ChunkManifest) validate() error {
+	if m.Format != ChunkedExportFormat {
+		return fmt.Errorf("unsupported export format %d: %w", m.Format, ErrInvalidInputs)
+	}
+	if m.Version < 0 || m.ChunkSize <= 0 {
+		return fmt.Errorf("invalid version %d or chunk size %d: %w", m.Version, m.ChunkSize, ErrInvalidInputs)
+	}
+	for i, hash := range m.ChunkHashes {
+		if len(hash) != sha256.Size {
+			return fmt.Errorf("invalid checksum %X of chunk %d: %w", hash, i, ErrInvalidInputs)
+		}
+	}
+	return nil
+}
+
+// ChunkedExporter exports the nodes of a tree in fixed-size chunks. It is created by
+// ImmutableTree.ExportChunked.
+type ChunkedExporter struct {
+	inner    *Exporter
+	encoded  *EncodedExporter
+	manifest *ChunkManifest
+	buf      []byte
+	done     bool // whether all the nodes were read
+	finished bool // whether all the chunks were returned
+}
+
+// ExportChunked returns an exporter of the tree nodes, in the order of Export, which splits the
+// stream of the nodes into chunks of chunkSize bytes, the last one being possibly shorter. Each
+// node is encoded with BinaryNodeCodec, prefixed with its uvarint length, and may span several
+// chunks. The manifest of the export, with the checksums of the chunks, is complete once all the
+// chunks are exported. Callers must call Close() when done.
+func (t *ImmutableTree) ExportChunked(chunkSize int) (*ChunkedExporter, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d: %w", chunkSize, ErrInvalidInputs)
+	}
+	exporter, err := t.Export()
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedExporter{
+		inner:   exporter,
+		encoded: NewEncodedExporter(exporter, BinaryNodeCodec{}),
+		manifest: &ChunkManifest{
+			Format:    ChunkedExportFormat,
+			Version:   t.version,
+			RootHash:  t.Hash(),
+			ChunkSize: chunkSize,
+		},
+	}, nil
+}
+
+// Next returns the next chunk, or ErrorExportDone when done.
+func (e *ChunkedExporter) Next() ([]byte, error) {
+	size := e.manifest.ChunkSize
+	for !e.done && len(e.buf) < size {
+		bz, err := e.encoded.Next()
+		if errors.Is(err, ErrorExportDone) {
+			e.done = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(bz)))
+		e.buf = append(e.buf, bz...)
+	}
+	if len(e.buf) == 0 {
+		e.finished = true
+		return nil, ErrorExportDone
+	}
+
+	chunk := make([]byte, min(size, len(e.buf)))
+	copy(chunk, e.buf)
+	e.buf = append(e.buf[:0], e.buf[len(chunk):]...)
+	hash := sha256.Sum256(chunk)
+	e.manifest.ChunkHashes = append(e.manifest.ChunkHashes, hash[:])
+	return chunk, nil
+}
+
+// Manifest returns the manifest of the export, once Next returned ErrorExportDone.
+func (e *ChunkedExporter) Manifest() (*ChunkManifest, error) {
+	if !e.finished {
+		return nil, errors.New("the manifest is incomplete until all the chunks are exported")
+	}
+	return e.manifest, nil
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *ChunkedExporter) Close() {
+	e.inner.Close()
+}
+
+// ChunkedImporter imports the chunks of a chunked export, verifying each against the checksum of
+// the manifest before importing its nodes. A chunk which fails the verification leaves the
+// import as it was, so that the chunk can be fetched again, e.g. from another peer, and the
+// import resumed from it, see NextChunk.
+type ChunkedImporter struct {
+	inner    *Importer
+	manifest *ChunkManifest
+	next     int
+	pending  []byte // encoded nodes continued by the next chunk
+}
+
+// ImportChunked returns an importer of the chunks of the export described by manifest, into its
+// version of the tree, which must be empty as for Import. The caller must call Close() on the
+// importer when done.
+func (tree *MutableTree) ImportChunked(manifest *ChunkManifest) (*ChunkedImporter, error) {
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+	importer, err := tree.Import(manifest.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedImporter{inner: importer, manifest: manifest}, nil
+}
+
+// NextChunk returns the index of the next chunk to add, which is the number of chunks imported.
+func (i *ChunkedImporter) NextChunk() int {
+	return i.next
+}
+
+// AddChunk verifies the chunk of the given index, which must be NextChunk, and imports its nodes.
+// It returns ErrChunkChecksumMismatch if the chunk doesn't match its checksum, in which case the
+// import is unchanged.
+func (i *ChunkedImporter) AddChunk(index int, chunk []byte) error {
+	if index != i.next || index >= i.manifest.Chunks() {
+		return fmt.Errorf("chunk %d of %d added, expected chunk %d: %w", index, i.manifest.Chunks(), i.next, ErrInvalidInputs)
+	}
+	if hash := sha256.Sum256(chunk); !bytes.Equal(hash[:], i.manifest.ChunkHashes[index]) {
+		return fmt.Errorf("%w: chunk %d has checksum %X, expected %X", ErrChunkChecksumMismatch, index, hash, i.manifest.ChunkHashes[index])
+	}
+
+	i.pending = append(i.pending, chunk...)
+	bz := i.pending
+	for len(bz) > 0 {
+		size, n := binary.Uvarint(bz)
+		if n == 0 || uint64(len(bz)-n) < size {
+			break // continued by the next chunk
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid node length in chunk %d: %w", index, ErrInvalidInputs)
+		}
+		node, err := BinaryNodeCodec{}.Decode(bz[n : n+int(size)])
+		if err != nil {
+			return fmt.Errorf("decoding node of chunk %d: %w", index, err)
+		}
+		if err := i.inner.Add(&node); err != nil {
+			return fmt.Errorf("importing node of chunk %d: %w", index, err)
+		}
+		bz = bz[n+int(size):]
+	}
+	// the decoded nodes reference the chunk, so the remainder is copied.
+	i.pending = append([]byte(nil), bz...)
+	i.next++
+	return nil
+}
+
+// Commit verifies that all the chunks were imported and that the imported tree has the root
+// hash of the manifest, and then commits it as Importer.Commit does. It returns
+// ErrImportRootHashMismatch if the hash doesn't match, without committing.
+func (i *ChunkedImporter) Commit() error {
+	if i.next != i.manifest.Chunks() {
+		return fmt.Errorf("%d of %d chunks imported: %w", i.next, i.manifest.Chunks(), ErrInvalidInputs)
+	}
+	if len(i.pending) > 0 {
+		return fmt.Errorf("truncated node at the end of the last chunk: %w", ErrInvalidInputs)
+	}
+	hash, err := i.inner.rootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, i.manifest.RootHash) {
+		return fmt.Errorf("%w: got %X, expected %X", ErrImportRootHashMismatch, hash, i.manifest.RootHash)
+	}
+	return i.inner.Commit()
+}
+
+// Close frees all resources, see Importer.Close.
+func (i *ChunkedImporter) Close() {
+	i.inner.Close()
+}
@@ -0,0 +1,142 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// exportChunked returns the chunks and the manifest of a chunked export of tree.
+func exportChunked(t *testing.T, tree *ImmutableTree, chunkSize int) ([][]byte, *ChunkManifest) {
+	exporter, err := tree.ExportChunked(chunkSize)
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	_, err = exporter.Manifest()
+	require.Error(t, err)
+	var chunks [][]byte
+	for {
+		chunk, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	manifest, err := exporter.Manifest()
+	require.NoError(t, err)
+	return chunks, manifest
+}
+
+func TestExportChunked(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	chunks, manifest := exportChunked(t, tree, 16)
+
+	require.Equal(t, ChunkedExportFormat, manifest.Format)
+	require.Equal(t, tree.Version(), manifest.Version)
+	require.Equal(t, tree.Hash(), manifest.RootHash)
+	require.Equal(t, len(chunks), manifest.Chunks())
+	require.Greater(t, len(chunks), 1)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		require.Len(t, chunk, 16)
+	}
+
+	bz, err := manifest.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalChunkManifest(bz)
+	require.NoError(t, err)
+	require.Equal(t, manifest, decoded)
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.ImportChunked(decoded)
+	require.NoError(t, err)
+	defer importer.Close()
+	for i, chunk := range chunks {
+		require.Equal(t, i, importer.NextChunk())
+		require.NoError(t, importer.AddChunk(i, chunk))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, tree.Hash(), newTree.Hash())
+	require.Equal(t, tree.Size(), newTree.Size())
+}
+
+func TestExportChunked_Empty(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	chunks, manifest := exportChunked(t, itree, 1024)
+	require.Empty(t, chunks)
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.ImportChunked(manifest)
+	require.NoError(t, err)
+	require.NoError(t, importer.Commit())
+	require.EqualValues(t, 1, newTree.Version())
+}
+
+func TestImportChunked_Resume(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	chunks, manifest := exportChunked(t, tree, 32)
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.ImportChunked(manifest)
+	require.NoError(t, err)
+	defer importer.Close()
+
+	require.NoError(t, importer.AddChunk(0, chunks[0]))
+	// a corrupted chunk is rejected without changing the import, which resumes once the chunk
+	// is added again.
+	corrupted := append([]byte{}, chunks[1]...)
+	corrupted[0] ^= 0xff
+	require.ErrorIs(t, importer.AddChunk(1, corrupted), ErrChunkChecksumMismatch)
+	require.ErrorIs(t, importer.AddChunk(1, chunks[1][:len(chunks[1])-1]), ErrChunkChecksumMismatch)
+	require.Equal(t, 1, importer.NextChunk())
+	// the chunks must be added in order.
+	require.ErrorIs(t, importer.AddChunk(2, chunks[2]), ErrInvalidInputs)
+	require.ErrorIs(t, importer.AddChunk(0, chunks[0]), ErrInvalidInputs)
+
+	for i := 1; i < len(chunks)-1; i++ {
+		require.NoError(t, importer.AddChunk(i, chunks[i]))
+	}
+	require.ErrorIs(t, importer.Commit(), ErrInvalidInputs)
+	require.NoError(t, importer.AddChunk(len(chunks)-1, chunks[len(chunks)-1]))
+	require.ErrorIs(t, importer.AddChunk(len(chunks), chunks[0]), ErrInvalidInputs)
+	require.NoError(t, importer.Commit())
+	require.Equal(t, tree.Hash(), newTree.Hash())
+}
+
+func TestImportChunked_RootHashMismatch(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	chunks, manifest := exportChunked(t, tree, 64)
+	manifest.RootHash = EmptyHash()
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.ImportChunked(manifest)
+	require.NoError(t, err)
+	defer importer.Close()
+	for i, chunk := range chunks {
+		require.NoError(t, importer.AddChunk(i, chunk))
+	}
+	require.ErrorIs(t, importer.Commit(), ErrImportRootHashMismatch)
+	require.EqualValues(t, 0, newTree.Version())
+}
+
+func TestChunkManifest_Invalid(t *testing.T) {
+	for name, bz := range map[string]string{
+		"json":     `{`,
+		"format":   `{"format":1,"version":1,"chunk_size":16}`,
+		"size":     `{"format":2,"version":1,"chunk_size":0}`,
+		"checksum": `{"format":2,"version":1,"chunk_size":16,"chunk_hashes":["AAAA"]}`,
+	} {
+		_, err := UnmarshalChunkManifest([]byte(bz))
+		require.ErrorIs(t, err, ErrInvalidInputs, name)
+	}
+
+	tree := setupExportTreeBasic(t)
+	_, err := tree.ExportChunked(0)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
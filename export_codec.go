@@ -0,0 +1,183 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// NodeCodec serializes the nodes of an export, e.g. to store a snapshot in a format other tools
+// can parse. It is used by EncodedExporter and EncodedImporter.
+type NodeCodec interface {
+	Encode(node ExportNode) ([]byte, error)
+	Decode(bz []byte) (ExportNode, error)
+}
+
+var (
+	_ NodeCodec = BinaryNodeCodec{}
+	_ NodeCodec = JSONNodeCodec{}
+)
+
+// BinaryNodeCodec is the default NodeCodec. It encodes the nodes as the Protobuf message the
+// Cosmos SDK stores the IAVL nodes of its snapshots with, i.e. with the fields key = 1,
+// value = 2, version = 3 and height = 4, so that its encoding is byte-compatible with them. The
+// tombstones have the additional field deleted = 5, which the other nodes omit.
+type BinaryNodeCodec struct{}
+
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+// Encode implements NodeCodec.
+func (BinaryNodeCodec) Encode(node ExportNode) ([]byte, error) {
+	bz := make([]byte, 0, len(node.Key)+len(node.Value)+2*binary.MaxVarintLen64+8)
+	// as Protobuf does, the fields with the zero value are omitted.
+	if len(node.Key) > 0 {
+		bz = binary.AppendUvarint(append(bz, 1<<3|protoWireBytes), uint64(len(node.Key)))
+		bz = append(bz, node.Key...)
+	}
+	if len(node.Value) > 0 {
+		bz = binary.AppendUvarint(append(bz, 2<<3|protoWireBytes), uint64(len(node.Value)))
+		bz = append(bz, node.Value...)
+	}
+	if node.Version != 0 {
+		bz = binary.AppendUvarint(append(bz, 3<<3|protoWireVarint), uint64(node.Version))
+	}
+	if node.Height != 0 {
+		// int32 fields are sign-extended to 64 bits.
+		bz = binary.AppendUvarint(append(bz, 4<<3|protoWireVarint), uint64(int64(node.Height)))
+	}
+	if node.Deleted {
+		bz = append(bz, 5<<3|protoWireVarint, 1)
+	}
+	return bz, nil
+}
+
+// Decode implements NodeCodec. The value of a leaf is empty rather than nil when it is
+// omitted, since Protobuf doesn't tell them apart.
+func (BinaryNodeCodec) Decode(bz []byte) (ExportNode, error) {
+	var node ExportNode
+	for len(bz) > 0 {
+		tag, n := binary.Uvarint(bz)
+		if n <= 0 {
+			return ExportNode{}, fmt.Errorf("invalid field tag: %w", ErrInvalidInputs)
+		}
+		bz = bz[n:]
+		field, wire := tag>>3, tag&7
+
+		switch wire {
+		case protoWireVarint:
+			v, n := binary.Uvarint(bz)
+			if n <= 0 {
+				return ExportNode{}, fmt.Errorf("invalid varint of field %d: %w", field, ErrInvalidInputs)
+			}
+			bz = bz[n:]
+			switch field {
+			case 3:
+				node.Version = int64(v)
+			case 4:
+				height := int64(v)
+				if height < 0 || height > math.MaxInt8 {
+					return ExportNode{}, fmt.Errorf("invalid height %d: %w", height, ErrInvalidInputs)
+				}
+				node.Height = int8(height)
+			case 5:
+				node.Deleted = v != 0
+			}
+		case protoWireBytes:
+			size, n := binary.Uvarint(bz)
+			if n <= 0 || size > uint64(len(bz)-n) {
+				return ExportNode{}, fmt.Errorf("invalid length of field %d: %w", field, ErrInvalidInputs)
+			}
+			value := bz[n : n+int(size) : n+int(size)]
+			bz = bz[n+int(size):]
+			switch field {
+			case 1:
+				node.Key = value
+			case 2:
+				node.Value = value
+			}
+		default:
+			return ExportNode{}, fmt.Errorf("unsupported wire type %d of field %d: %w", wire, field, ErrInvalidInputs)
+		}
+	}
+	if node.Height == 0 && node.Value == nil && !node.Deleted {
+		node.Value = []byte{}
+	}
+	return node, nil
+}
+
+// JSONNodeCodec encodes the nodes as JSON objects with the fields "key", "value", "version" and
+// "height", the keys and values being base64-encoded, and the value being null for the inner
+// nodes. The tombstones have the additional field "deleted".
+type JSONNodeCodec struct{}
+
+type jsonExportNode struct {
+	Key     []byte `json:"key"`
+	Value   []byte `json:"value"`
+	Version int64  `json:"version"`
+	Height  int8   `json:"height"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Encode implements NodeCodec.
+func (JSONNodeCodec) Encode(node ExportNode) ([]byte, error) {
+	return json.Marshal(jsonExportNode(node))
+}
+
+// Decode implements NodeCodec.
+func (JSONNodeCodec) Decode(bz []byte) (ExportNode, error) {
+	var node jsonExportNode
+	if err := json.Unmarshal(bz, &node); err != nil {
+		return ExportNode{}, fmt.Errorf("%w: %w", ErrInvalidInputs, err)
+	}
+	return ExportNode(node), nil
+}
+
+// EncodedExporter exports the nodes of a NodeExporter encoded with a NodeCodec.
+type EncodedExporter struct {
+	inner NodeExporter
+	codec NodeCodec
+}
+
+// NewEncodedExporter wraps exporter to encode its nodes with codec, BinaryNodeCodec if nil.
+func NewEncodedExporter(exporter NodeExporter, codec NodeCodec) *EncodedExporter {
+	if codec == nil {
+		codec = BinaryNodeCodec{}
+	}
+	return &EncodedExporter{inner: exporter, codec: codec}
+}
+
+// Next returns the next exported node encoded, or ErrorExportDone when done.
+func (e *EncodedExporter) Next() ([]byte, error) {
+	node, err := e.inner.Next()
+	if err != nil {
+		return nil, err
+	}
+	return e.codec.Encode(*node)
+}
+
+// EncodedImporter imports the nodes encoded by an EncodedExporter with the same NodeCodec.
+type EncodedImporter struct {
+	inner NodeImporter
+	codec NodeCodec
+}
+
+// NewEncodedImporter wraps importer to decode the nodes with codec, BinaryNodeCodec if nil.
+func NewEncodedImporter(importer NodeImporter, codec NodeCodec) *EncodedImporter {
+	if codec == nil {
+		codec = BinaryNodeCodec{}
+	}
+	return &EncodedImporter{inner: importer, codec: codec}
+}
+
+// Add decodes a node and adds it to the importer, in the order they were exported.
+func (i *EncodedImporter) Add(bz []byte) error {
+	node, err := i.codec.Decode(bz)
+	if err != nil {
+		return err
+	}
+	return i.inner.Add(&node)
+}
@@ -0,0 +1,112 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrImportRootHashMismatch is returned when the imported tree doesn't have the expected root
+// hash.
+var ErrImportRootHashMismatch = errors.New("imported root hash mismatch")
+
+// DeduplicatedExporter exports the nodes of a tree like Exporter, but with the values of the
+// leaves replaced by their SHA-256 hashes, and collects a dictionary of the values by hash, where
+// each distinct value appears once. It is created by ImmutableTree.ExportDeduplicated, and
+// trades a two-pass import for smaller snapshots when the same values recur under many keys:
+// the dictionary is complete once the export is done, and must be given to the
+// DeduplicatedImporter before importing the nodes.
+type DeduplicatedExporter struct {
+	inner  *Exporter
+	values map[string][]byte
+}
+
+var _ NodeExporter = (*DeduplicatedExporter)(nil)
+
+// ExportDeduplicated returns an exporter of the tree nodes with the leaf values deduplicated,
+// see DeduplicatedExporter. Callers must call Close() when done.
+func (t *ImmutableTree) ExportDeduplicated() (*DeduplicatedExporter, error) {
+	exporter, err := t.Export()
+	if err != nil {
+		return nil, err
+	}
+	return &DeduplicatedExporter{inner: exporter, values: make(map[string][]byte)}, nil
+}
+
+// Next fetches the next exported node, whose value is the hash of the leaf value, or returns
+// ErrorExportDone when done.
+func (e *DeduplicatedExporter) Next() (*ExportNode, error) {
+	node, err := e.inner.Next()
+	if err != nil {
+		return nil, err
+	}
+	if node.Height == 0 && !node.Deleted {
+		hash := sha256.Sum256(node.Value)
+		if _, ok := e.values[string(hash[:])]; !ok {
+			e.values[string(hash[:])] = node.Value
+		}
+		node = &ExportNode{Key: node.Key, Value: hash[:], Version: node.Version, Height: node.Height}
+	}
+	return node, nil
+}
+
+// Values returns the dictionary of the leaf values of the nodes exported so far, by the hashes
+// the nodes refer to them with. It is complete once Next returns ErrorExportDone.
+func (e *DeduplicatedExporter) Values() map[string][]byte {
+	return e.values
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *DeduplicatedExporter) Close() {
+	e.inner.Close()
+}
+
+// DeduplicatedImporter imports the nodes exported by a DeduplicatedExporter, restoring the leaf
+// values from the dictionary of the export.
+type DeduplicatedImporter struct {
+	inner  *Importer
+	values map[string][]byte
+}
+
+var _ NodeImporter = (*DeduplicatedImporter)(nil)
+
+// NewDeduplicatedImporter wraps importer to import the nodes of a deduplicated export, given its
+// complete dictionary of values.
+func NewDeduplicatedImporter(importer *Importer, values map[string][]byte) *DeduplicatedImporter {
+	return &DeduplicatedImporter{inner: importer, values: values}
+}
+
+// Add adds a node of the deduplicated export, in the order they were exported. It fails if the
+// value of a leaf is missing from the dictionary, or doesn't match its hash.
+func (i *DeduplicatedImporter) Add(node *ExportNode) error {
+	if node != nil && node.Height == 0 && !node.Deleted {
+		value, ok := i.values[string(node.Value)]
+		if !ok {
+			return fmt.Errorf("value of key %X with hash %X is missing from the dictionary", node.Key, node.Value)
+		}
+		if hash := sha256.Sum256(value); !bytes.Equal(hash[:], node.Value) {
+			return fmt.Errorf("value of key %X doesn't match its hash %X", node.Key, node.Value)
+		}
+		node = &ExportNode{Key: node.Key, Value: value, Version: node.Version, Height: node.Height}
+	}
+	return i.inner.Add(node)
+}
+
+// Commit verifies that the imported tree has the given root hash, and then commits it as
+// Importer.Commit does. It returns ErrImportRootHashMismatch otherwise, without committing.
+func (i *DeduplicatedImporter) Commit(rootHash []byte) error {
+	hash, err := i.inner.rootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, rootHash) {
+		return fmt.Errorf("%w: got %X, expected %X", ErrImportRootHashMismatch, hash, rootHash)
+	}
+	return i.inner.Commit()
+}
+
+// Close frees all resources, see Importer.Close.
+func (i *DeduplicatedImporter) Close() {
+	i.inner.Close()
+}
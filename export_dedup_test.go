@@ -0,0 +1,142 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// setupExportTreeDuplicated sets up a tree whose keys share a few large values.
+func setupExportTreeDuplicated(t *testing.T) *ImmutableTree {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	values := make([][]byte, 5)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte{byte(i)}, 1024)
+	}
+	for version := 0; version < 3; version++ {
+		for i := 0; i < 200; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d-%d", i, version)), values[(i+version)%len(values)])
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	return itree
+}
+
+// exportDeduplicated returns the nodes and the dictionary of a deduplicated export of tree.
+func exportDeduplicated(t *testing.T, tree *ImmutableTree) ([]*ExportNode, map[string][]byte) {
+	exporter, err := tree.ExportDeduplicated()
+	require.NoError(t, err)
+	defer exporter.Close()
+	var nodes []*ExportNode
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			return nodes, exporter.Values()
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+}
+
+// importDeduplicated imports the nodes of a deduplicated export into a new tree.
+func importDeduplicated(t *testing.T, nodes []*ExportNode, values map[string][]byte, version int64, rootHash []byte) (*MutableTree, error) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	innerImporter, err := tree.Import(version)
+	require.NoError(t, err)
+	defer innerImporter.Close()
+	importer := NewDeduplicatedImporter(innerImporter, values)
+	for _, node := range nodes {
+		if err := importer.Add(node); err != nil {
+			return nil, err
+		}
+	}
+	return tree, importer.Commit(rootHash)
+}
+
+func TestExportDeduplicated(t *testing.T) {
+	tree := setupExportTreeDuplicated(t)
+	nodes, values := exportDeduplicated(t, tree)
+	require.Len(t, values, 5)
+
+	// the deduplicated export is much smaller than the plain one.
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	plainSize := 0
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		plainSize += len(node.Key) + len(node.Value)
+	}
+	exporter.Close()
+	size := 0
+	for _, node := range nodes {
+		size += len(node.Key) + len(node.Value)
+	}
+	for hash, value := range values {
+		size += len(hash) + len(value)
+	}
+	require.Less(t, size*10, plainSize)
+
+	imported, err := importDeduplicated(t, nodes, values, tree.Version(), tree.Hash())
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), imported.Hash())
+	require.Equal(t, tree.Size(), imported.Size())
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		importedValue, err := imported.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, importedValue)
+		return false
+	})
+	require.NoError(t, err)
+
+	// an empty tree round trips as well.
+	empty := NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	nodes, values = exportDeduplicated(t, empty)
+	require.Empty(t, nodes)
+	require.Empty(t, values)
+	imported, err = importDeduplicated(t, nodes, values, 0, empty.Hash())
+	require.NoError(t, err)
+	require.Equal(t, empty.Hash(), imported.Hash())
+}
+
+func TestExportDeduplicated_Invalid(t *testing.T) {
+	tree := setupExportTreeDuplicated(t)
+	nodes, values := exportDeduplicated(t, tree)
+
+	// the root hash is verified before committing.
+	imported, err := importDeduplicated(t, nodes, values, tree.Version(), []byte("wrong"))
+	require.ErrorIs(t, err, ErrImportRootHashMismatch)
+	require.Zero(t, imported.Version())
+	require.True(t, imported.IsEmpty())
+
+	// the values must be in the dictionary and match their hashes.
+	var hash string
+	for hash = range values {
+		break
+	}
+	missing := make(map[string][]byte)
+	tampered := make(map[string][]byte)
+	for h, v := range values {
+		tampered[h] = v
+		if h != hash {
+			missing[h] = v
+		}
+	}
+	tampered[hash] = []byte("tampered")
+	_, err = importDeduplicated(t, nodes, missing, tree.Version(), tree.Hash())
+	require.ErrorContains(t, err, "missing from the dictionary")
+	_, err = importDeduplicated(t, nodes, tampered, tree.Version(), tree.Hash())
+	require.ErrorContains(t, err, "doesn't match its hash")
+}
@@ -0,0 +1,31 @@
+package iavl
+
+import "fmt"
+
+// ExportPrefix returns an exporter of the nodes of the smallest subtree covering the keys with
+// the given prefix, in the order of Export, e.g. to ship the namespace of a single store for a
+// fraud proof or a partial state sync, and the RangeProof tying the subtree to the root hash of
+// the tree. The subtree may cover keys around the prefix, as RangeHash. Imported into an empty
+// tree at the version of the tree, the nodes give a tree whose root hash is verified with
+// RangeProof.Verify against the root hash of the full tree. Without any key with the prefix,
+// nothing is exported, and the proof is nil. A nil or empty prefix exports the whole tree. As
+// Export, the tree must be saved, and callers must call Close() on the exporter when done. It
+// fails with the Comparator option, under which the keys of a prefix aren't contiguous.
+func (t *ImmutableTree) ExportPrefix(prefix []byte) (*Exporter, *RangeProof, error) {
+	if t.ndb.opts.Comparator != nil {
+		return nil, nil, fmt.Errorf("prefix export isn't supported with a custom comparator: %w", ErrInvalidInputs)
+	}
+	var start, end []byte
+	if len(prefix) > 0 {
+		start, end = prefix, prefixEnd(prefix)
+	}
+	root, proof, err := t.rangeSubtree(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	exporter, err := newExporter(t, root, nil, exportBufferSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exporter, proof, nil
+}
@@ -0,0 +1,87 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestExportPrefix(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		for _, prefix := range []string{"a/", "b/", "c/"} {
+			for i := version; i < 30; i += version {
+				_, err := tree.Set([]byte(fmt.Sprintf("%s%02d", prefix, i)), []byte(fmt.Sprintf("%d-%d", version, i)))
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	// importPrefix imports the subtree of the prefix into an empty tree, and verifies it.
+	importPrefix := func(prefix string) *MutableTree {
+		exporter, proof, err := itree.ExportPrefix([]byte(prefix))
+		require.NoError(t, err)
+		defer exporter.Close()
+		imported := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+		importer, err := imported.Import(itree.Version())
+		require.NoError(t, err)
+		defer importer.Close()
+		count := 0
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+			count++
+		}
+		if count == 0 {
+			require.Nil(t, proof)
+			return nil
+		}
+		require.NoError(t, importer.Commit())
+		require.NoError(t, proof.Verify(itree.Hash(), imported.Hash()))
+		return imported
+	}
+
+	imported := importPrefix("c/")
+	require.Less(t, imported.Size(), itree.Size())
+	itr, err := itree.IteratePrefix([]byte("c/"), true)
+	require.NoError(t, err)
+	defer itr.Close()
+	keys := 0
+	for ; itr.Valid(); itr.Next() {
+		value, err := imported.Get(itr.Key())
+		require.NoError(t, err)
+		require.Equal(t, itr.Value(), value)
+		keys++
+	}
+	require.Equal(t, 29, keys)
+
+	// a single key gives a single leaf.
+	imported = importPrefix("a/29")
+	require.EqualValues(t, 1, imported.Size())
+
+	require.Equal(t, itree.Hash(), importPrefix("").Hash())
+	require.Nil(t, importPrefix("d/"))
+
+	// the proof doesn't verify the subtree of another tree.
+	exporter, proof, err := itree.ExportPrefix([]byte("a/"))
+	require.NoError(t, err)
+	exporter.Close()
+	require.ErrorIs(t, proof.Verify(itree.Hash(), imported.Hash()), ErrInvalidProof)
+
+	numeric := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), ComparatorOption(numericComparator))
+	_, _, err = numeric.ImmutableTree.ExportPrefix([]byte("a/"))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
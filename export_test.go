@@ -1,9 +1,13 @@
 package iavl
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
 	"testing"
+	"time"
 
 	"cosmossdk.io/log"
 	"github.com/stretchr/testify/assert"
@@ -191,6 +195,79 @@ func TestExporter(t *testing.T) {
 	assert.Equal(t, expect, actual)
 }
 
+func TestExporter_WithTombstones(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+
+	exportAll := func(exporter NodeExporter) []*ExportNode {
+		var nodes []*ExportNode
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				return nodes
+			}
+			require.NoError(t, err)
+			nodes = append(nodes, node)
+		}
+	}
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	live := exportAll(exporter)
+	exporter.Close()
+
+	// x and z were deleted after version 1, and b was deleted by version 2 but set again.
+	for since, deleted := range map[int64][]string{1: {"x", "z"}, 2: {"z"}, 3: nil} {
+		exporter, err := tree.ExportWithTombstones(since)
+		require.NoError(t, err)
+		nodes := exportAll(exporter)
+		exporter.Close()
+
+		expect := make([]*ExportNode, 0, len(deleted)+len(live))
+		for _, key := range deleted {
+			expect = append(expect, &ExportNode{Key: []byte(key), Version: 3, Deleted: true})
+		}
+		require.Equal(t, append(expect, live...), nodes, "since version %d", since)
+	}
+
+	_, err = tree.ExportWithTombstones(4)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.ExportWithTombstones(0)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the tombstones survive the encodings, and are skipped by the import.
+	for name, codec := range map[string]NodeCodec{"binary": BinaryNodeCodec{}, "json": JSONNodeCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			exporter, err := tree.ExportWithTombstones(1)
+			require.NoError(t, err)
+			defer exporter.Close()
+			encoded := NewEncodedExporter(NewCompressExporter(exporter), codec)
+
+			newTree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			defer importer.Close()
+			decoded := NewEncodedImporter(NewCompressImporter(importer), codec)
+			var tombstones []string
+			for {
+				bz, err := encoded.Next()
+				if errors.Is(err, ErrorExportDone) {
+					break
+				}
+				require.NoError(t, err)
+				node, err := codec.Decode(bz)
+				require.NoError(t, err)
+				if node.Deleted {
+					require.Nil(t, node.Value)
+					tombstones = append(tombstones, string(node.Key))
+				}
+				require.NoError(t, decoded.Add(bz))
+			}
+			require.NoError(t, importer.Commit())
+			require.Equal(t, []string{"x", "z"}, tombstones)
+			require.Equal(t, tree.Hash(), newTree.Hash())
+		})
+	}
+}
+
 func TestExporterCompress(t *testing.T) {
 	tree := setupExportTreeBasic(t)
 
@@ -375,3 +452,60 @@ func BenchmarkExport(b *testing.B) {
 		exporter.Close()
 	}
 }
+
+func TestExporter_WithBuffer(t *testing.T) {
+	tree := setupExportTreeSized(t, 1024)
+
+	_, err := tree.ExportWithBuffer(-1)
+	require.Error(t, err)
+
+	for _, bufSize := range []int{0, 1, 8} {
+		t.Run(fmt.Sprintf("bufSize=%d", bufSize), func(t *testing.T) {
+			exporter, err := tree.ExportWithBuffer(bufSize)
+			require.NoError(t, err)
+			defer exporter.Close()
+			require.Equal(t, bufSize, cap(exporter.ch))
+
+			count := 0
+			peak := 0
+			for {
+				// a slow consumer gives the producer time to run ahead as far as it can
+				if count < 64 {
+					time.Sleep(time.Millisecond)
+					if n := len(exporter.ch); n > peak {
+						peak = n
+					}
+				}
+				_, err := exporter.Next()
+				if errors.Is(err, ErrorExportDone) {
+					break
+				}
+				require.NoError(t, err)
+				count++
+			}
+			require.Equal(t, tree.nodeSize(), count)
+			require.LessOrEqual(t, peak, bufSize)
+			require.Equal(t, bufSize, peak, "producer should fill the buffer and then block")
+		})
+	}
+}
+
+func TestExporter_CloseNoLeak(t *testing.T) {
+	tree := setupExportTreeSized(t, 4096)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		exporter, err := tree.ExportWithBuffer(4)
+		require.NoError(t, err)
+		_, err = exporter.Next()
+		require.NoError(t, err)
+		exporter.Close()
+	}
+
+	// poll manually, require.Eventually runs the condition in its own goroutine
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
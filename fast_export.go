@@ -0,0 +1,130 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// fastNodeExportChunkSize is the number of fast nodes the FastNodeExporter reads per iteration
+// of the database, so that it doesn't hold an iterator open between the calls to Next.
+const fastNodeExportChunkSize = 1000
+
+// ErrFastStorageNotUpgraded is returned when exporting the fast nodes of a tree whose fast
+// storage isn't enabled or doesn't match its latest version.
+var ErrFastStorageNotUpgraded = errors.New("fast storage is not upgraded")
+
+// ExportFastNode contains exported fast node data.
+type ExportFastNode struct {
+	Key     []byte
+	Value   []byte
+	Version int64 // version at which the value was last updated
+}
+
+// FastNodeExporter exports the fast nodes of the latest version of a tree, in ascending key
+// order. It is created by MutableTree.ExportFastNodes, and the exported fast nodes can be
+// imported with MutableTree.ImportFastNodes. Callers must call Close() when done.
+//
+// The fast nodes are read from the database in chunks, so the tree must not be saved while they
+// are exported: Next fails if the latest version changes.
+type FastNodeExporter struct {
+	ndb     *nodeDB
+	version int64
+	chunk   []*ExportFastNode
+	after   []byte // key of the last fast node read, nil before the first chunk
+	done    bool
+}
+
+// ExportFastNodes returns an exporter of the fast nodes of version, which must be the latest
+// version of the tree, with its fast storage enabled. It returns ErrFastStorageNotUpgraded
+// otherwise.
+func (tree *MutableTree) ExportFastNodes(version int64) (*FastNodeExporter, error) {
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version != latestVersion {
+		return nil, fmt.Errorf("version %d isn't the latest version %d: %w", version, latestVersion, ErrInvalidInputs)
+	}
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return nil, err
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() || shouldForce {
+		return nil, ErrFastStorageNotUpgraded
+	}
+
+	tree.ndb.incrVersionReaders(version)
+	return &FastNodeExporter{ndb: tree.ndb, version: version}, nil
+}
+
+// Next fetches the next exported fast node, or returns ErrorExportDone when done.
+func (e *FastNodeExporter) Next() (*ExportFastNode, error) {
+	if e.ndb == nil {
+		return nil, ErrorExportDone
+	}
+	if len(e.chunk) == 0 && !e.done {
+		if err := e.readChunk(); err != nil {
+			return nil, err
+		}
+	}
+	if len(e.chunk) == 0 {
+		return nil, ErrorExportDone
+	}
+	node := e.chunk[0]
+	e.chunk = e.chunk[1:]
+	return node, nil
+}
+
+// readChunk reads the next fastNodeExportChunkSize fast nodes.
+func (e *FastNodeExporter) readChunk() error {
+	latestVersion, err := e.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latestVersion != e.version {
+		return fmt.Errorf("the latest version changed from %d to %d during the export", e.version, latestVersion)
+	}
+
+	start := []byte(fastKeyFormat.Prefix())
+	if e.after != nil {
+		// the smallest key after it.
+		start = append(e.ndb.fastNodeKey(e.after), 0)
+	}
+	end := []byte{fastKeyFormat.Prefix()[0] + 1}
+	itr, err := e.ndb.db.Iterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid() && len(e.chunk) < fastNodeExportChunkSize; itr.Next() {
+		key := bytes.Clone(itr.Key()[1:])
+		node, err := fastnode.DeserializeNode(key, itr.Value())
+		if err != nil {
+			return fmt.Errorf("error reading fast node %X: %w", key, err)
+		}
+		e.chunk = append(e.chunk, &ExportFastNode{
+			Key:     key,
+			Value:   bytes.Clone(node.GetValue()),
+			Version: node.GetVersionLastUpdatedAt(),
+		})
+		e.after = key
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	e.done = len(e.chunk) < fastNodeExportChunkSize
+	return nil
+}
+
+// Close closes the exporter. It is safe to call multiple times.
+func (e *FastNodeExporter) Close() {
+	if e.ndb != nil {
+		e.ndb.decrVersionReaders(e.version)
+	}
+	e.ndb = nil
+	e.chunk = nil
+}
@@ -0,0 +1,237 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// setupFastExportTree returns a tree saved with a few versions, and its db.
+func setupFastExportTree(t *testing.T) (*MutableTree, dbm.DB) {
+	t.Helper()
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	for version := 0; version < 4; version++ {
+		for i := 0; i < 1500; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", (version*500+i)%2500)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+		for i := 0; i < 50; i++ {
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%04d", (version*37+i*11)%2500)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return tree, db
+}
+
+// exportFastNodes returns all the fast nodes exported from the latest version of tree.
+func exportFastNodes(t *testing.T, tree *MutableTree) []*ExportFastNode {
+	t.Helper()
+	exporter, err := tree.ExportFastNodes(tree.Version())
+	require.NoError(t, err)
+	defer exporter.Close()
+	var nodes []*ExportFastNode
+	for {
+		node, err := exporter.Next()
+		if err == ErrorExportDone {
+			break
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// fastNodePairs returns the keys and values of the fast nodes, whose versions are the latest
+// version once the fast storage is rebuilt.
+func fastNodePairs(nodes []*ExportFastNode) []string {
+	pairs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		pairs = append(pairs, string(node.Key)+"="+string(node.Value))
+	}
+	return pairs
+}
+
+// copyNodes returns a db with the nodes and the roots of db, but no fast storage.
+func copyNodes(t *testing.T, db dbm.DB) dbm.DB {
+	t.Helper()
+	copied := dbm.NewMemDB()
+	itr, err := db.Iterator(nodeKeyFormat.Prefix(), []byte{nodeKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		require.NoError(t, copied.Set(itr.Key(), itr.Value()))
+	}
+	require.NoError(t, itr.Error())
+	return copied
+}
+
+func TestExportImportFastNodes(t *testing.T) {
+	tree, db := setupFastExportTree(t)
+	nodes := exportFastNodes(t, tree)
+	require.EqualValues(t, tree.Size(), len(nodes))
+	for i, node := range nodes {
+		if i > 0 {
+			require.Negative(t, bytes.Compare(nodes[i-1].Key, node.Key))
+		}
+		value, err := tree.Get(node.Key)
+		require.NoError(t, err)
+		require.Equal(t, value, node.Value)
+	}
+
+	// the fast storage is imported into a db which only has the nodes, without rebuilding it.
+	copied := copyNodes(t, db)
+	target := NewMutableTree(copied, 0, true, log.NewNopLogger())
+	version, err := target.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.Version(), version)
+	importer, err := target.ImportFastNodes(version)
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.ErrorIs(t, importer.Add(nodes[0]), ErrNoImport)
+
+	loaded := NewMutableTree(copied, 0, false, log.NewNopLogger())
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	enabled, err := loaded.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	upgradeable, err := loaded.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, upgradeable)
+	require.Equal(t, nodes, exportFastNodes(t, loaded))
+
+	// the latest state reads are the same, served from the imported fast nodes.
+	for i := 0; i < 2500; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		expected, err := tree.Get(key)
+		require.NoError(t, err)
+		value, err := loaded.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+	}
+	var keys, expectedKeys []string
+	_, err = loaded.Iterate(func(key, value []byte) bool {
+		keys = append(keys, string(key)+"="+string(value))
+		return false
+	})
+	require.NoError(t, err)
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		expectedKeys = append(expectedKeys, string(key)+"="+string(value))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, expectedKeys, keys)
+}
+
+func TestImportFastNodes_Mismatch(t *testing.T) {
+	tree, db := setupFastExportTree(t)
+	nodes := exportFastNodes(t, tree)
+
+	for name, tc := range map[string]struct {
+		nodes     []*ExportFastNode
+		addErr    bool // whether Add fails, else Commit
+		errTarget error
+	}{
+		"missing last": {nodes: nodes[:len(nodes)-1], errTarget: ErrFastNodesMismatch},
+		"missing":      {nodes: append(append([]*ExportFastNode{}, nodes[:10]...), nodes[11:]...), addErr: true, errTarget: ErrFastNodesMismatch},
+		"extra":        {nodes: append([]*ExportFastNode{{Key: []byte("extra"), Value: []byte("value")}}, nodes...), addErr: true, errTarget: ErrFastNodesMismatch},
+		"value": {nodes: append(append([]*ExportFastNode{}, nodes[:10]...),
+			append([]*ExportFastNode{{Key: nodes[10].Key, Value: []byte("other"), Version: nodes[10].Version}}, nodes[11:]...)...), addErr: true, errTarget: ErrFastNodesMismatch},
+		"unsorted": {nodes: []*ExportFastNode{nodes[0], nodes[1], nodes[0]}, addErr: true, errTarget: ErrInvalidInputs},
+	} {
+		t.Run(name, func(t *testing.T) {
+			copied := copyNodes(t, db)
+			target := NewMutableTree(copied, 0, true, log.NewNopLogger())
+			version, err := target.Load()
+			require.NoError(t, err)
+			importer, err := target.ImportFastNodes(version)
+			require.NoError(t, err)
+			defer importer.Close()
+
+			for _, node := range tc.nodes {
+				if err = importer.Add(node); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				require.False(t, tc.addErr)
+				err = importer.Commit()
+			}
+			require.ErrorIs(t, err, tc.errTarget)
+			importer.Close()
+
+			// the fast storage isn't enabled, and is rebuilt by the next load.
+			loaded := NewMutableTree(copied, 0, true, log.NewNopLogger())
+			_, err = loaded.Load()
+			require.NoError(t, err)
+			require.False(t, loaded.ndb.hasUpgradedToFastStorage())
+			loaded = NewMutableTree(copied, 0, false, log.NewNopLogger())
+			_, err = loaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, fastNodePairs(nodes), fastNodePairs(exportFastNodes(t, loaded)))
+		})
+	}
+}
+
+func TestImportFastNodes_ReplacesFastStorage(t *testing.T) {
+	tree, _ := setupFastExportTree(t)
+	nodes := exportFastNodes(t, tree)
+
+	// a stale fast node is deleted by the import.
+	require.NoError(t, tree.ndb.SaveFastNode(fastnode.NewNode([]byte("stale"), []byte("value"), 1)))
+	require.NoError(t, tree.ndb.Commit())
+	value, err := tree.Get([]byte("stale"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	importer, err := tree.ImportFastNodes(tree.Version())
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, nodes, exportFastNodes(t, tree))
+	value, err = tree.Get([]byte("stale"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestExportFastNodes_Invalid(t *testing.T) {
+	tree, db := setupFastExportTree(t)
+	_, err := tree.ExportFastNodes(tree.Version() - 1)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.ImportFastNodes(tree.Version() - 1)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+
+	target := NewMutableTree(copyNodes(t, db), 0, true, log.NewNopLogger())
+	_, err = target.Load()
+	require.NoError(t, err)
+	_, err = target.ExportFastNodes(target.Version())
+	require.ErrorIs(t, err, ErrFastStorageNotUpgraded)
+
+	// the export fails if a version is saved meanwhile.
+	exporter, err := tree.ExportFastNodes(tree.Version())
+	require.NoError(t, err)
+	defer exporter.Close()
+	_, err = exporter.Next()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for err == nil {
+		_, err = exporter.Next()
+	}
+	require.NotErrorIs(t, err, ErrorExportDone)
+}
@@ -0,0 +1,197 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// ErrFastNodesMismatch is returned when the imported fast nodes don't match the latest version
+// of the tree.
+var ErrFastNodesMismatch = errors.New("fast nodes don't match the tree")
+
+// FastNodeImporter imports the fast nodes exported by a FastNodeExporter into a tree, replacing
+// its fast storage. It is created by MutableTree.ImportFastNodes. Users must call Close() when
+// done.
+//
+// The fast nodes must be added in ascending key order, as exported. They are validated against
+// the leaves of the latest version of the tree as they are added, and the fast storage is only
+// enabled once Commit has checked that none is missing.
+//
+// FastNodeImporter is not concurrency-safe, it is the caller's responsibility to ensure the tree
+// is not modified while performing an import.
+type FastNodeImporter struct {
+	tree    *MutableTree
+	version int64
+	leaves  dbm.Iterator // leaves of the version, read from the nodes
+	last    []byte       // key of the last fast node added
+	added   int64
+}
+
+// ImportFastNodes returns an importer of the fast nodes of version, which must be the latest
+// version of the tree, loaded without unsaved changes. The existing fast nodes are deleted, and
+// the fast storage is disabled until the import is committed, so that it is rebuilt by the next
+// load if the import isn't.
+func (tree *MutableTree) ImportFastNodes(version int64) (*FastNodeImporter, error) {
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version != latestVersion || version != tree.version {
+		return nil, fmt.Errorf("version %d isn't the latest version %d of the loaded tree: %w", version, latestVersion, ErrInvalidInputs)
+	}
+	if tree.root != nil && tree.root.nodeKey == nil {
+		return nil, errors.New("tree has unsaved changes")
+	}
+	if err := tree.WaitForFastStorageMigration(); err != nil {
+		return nil, fmt.Errorf("fast storage migration failed: %w", err)
+	}
+
+	tree.ndb.setFastStorageMigrating(true)
+	if err := tree.ndb.deleteFastNodes(); err != nil {
+		tree.ndb.endFastStorageMigration(false)
+		return nil, err
+	}
+
+	t := tree.ImmutableTree.clone()
+	return &FastNodeImporter{
+		tree:    tree,
+		version: version,
+		leaves:  NewIterator(nil, nil, true, t),
+	}, nil
+}
+
+// Add adds an ExportFastNode to the import. It returns ErrFastNodesMismatch if it isn't the next
+// leaf of the tree, with the same value. The fast nodes are flushed to the database
+// periodically, but only used once Commit() is called.
+func (i *FastNodeImporter) Add(node *ExportFastNode) error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if node == nil {
+		return errors.New("fast node cannot be nil")
+	}
+	if i.last != nil && bytes.Compare(node.Key, i.last) <= 0 {
+		return fmt.Errorf("fast node %X is not after %X: %w", node.Key, i.last, ErrInvalidInputs)
+	}
+	if node.Version > i.version {
+		return fmt.Errorf("fast node version %v can't be greater than import version %v", node.Version, i.version)
+	}
+	if err := i.validate(node); err != nil {
+		return err
+	}
+
+	if err := i.tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(node.Key, node.Value, node.Version)); err != nil {
+		return err
+	}
+	i.last = node.Key
+	i.added++
+	return nil
+}
+
+// validate checks that node is the next leaf of the tree.
+func (i *FastNodeImporter) validate(node *ExportFastNode) error {
+	if err := i.leaves.Error(); err != nil {
+		return err
+	}
+	if !i.leaves.Valid() {
+		return fmt.Errorf("fast node %X isn't in the tree: %w", node.Key, ErrFastNodesMismatch)
+	}
+	switch key := i.leaves.Key(); {
+	case bytes.Compare(node.Key, key) > 0:
+		return fmt.Errorf("fast node of key %X is missing: %w", key, ErrFastNodesMismatch)
+	case bytes.Compare(node.Key, key) < 0:
+		return fmt.Errorf("fast node %X isn't in the tree: %w", node.Key, ErrFastNodesMismatch)
+	}
+	if !bytes.Equal(node.Value, i.leaves.Value()) {
+		return fmt.Errorf("fast node %X doesn't have the value of the tree: %w", node.Key, ErrFastNodesMismatch)
+	}
+	i.leaves.Next()
+	return nil
+}
+
+// Commit checks that the fast nodes of all the leaves of the tree were added, and enables the
+// fast storage. It returns ErrFastNodesMismatch otherwise. It can only be called once, and calls
+// Close() internally.
+func (i *FastNodeImporter) Commit() error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if err := i.leaves.Error(); err != nil {
+		return err
+	}
+	if i.leaves.Valid() {
+		return fmt.Errorf("fast node of key %X is missing: %w", i.leaves.Key(), ErrFastNodesMismatch)
+	}
+
+	ndb := i.tree.ndb
+	if err := ndb.SetFastStorageVersionToBatch(i.version); err != nil {
+		return err
+	}
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+	ndb.endFastStorageMigration(true)
+	i.tree.logger.Info("fast nodes imported", "version", i.version, "imported", i.added)
+	i.tree = nil
+	i.Close()
+	return nil
+}
+
+// Close frees all resources. It is safe to call multiple times. If the import isn't committed,
+// the fast nodes not flushed yet are discarded, and the fast storage stays disabled until the
+// tree is loaded again, which rebuilds it.
+func (i *FastNodeImporter) Close() {
+	if i.leaves != nil {
+		i.leaves.Close()
+		i.leaves = nil
+	}
+	if i.tree == nil {
+		return
+	}
+	if err := i.tree.ndb.discardBatch(nil, nil); err != nil {
+		i.tree.logger.Error("failed to discard the imported fast nodes", "err", err)
+	}
+	i.tree.ndb.endFastStorageMigration(false)
+	i.tree = nil
+}
+
+// deleteFastNodes deletes all the fast nodes, and the fast storage version along with them, so
+// that the fast storage is rebuilt by the next load until it is written again.
+func (ndb *nodeDB) deleteFastNodes() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	// the keys are collected first, since the iterator may lock db until it is closed.
+	itr, err := ndb.db.Iterator([]byte(fastKeyFormat.Prefix()), []byte{fastKeyFormat.Prefix()[0] + 1})
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, bytes.Clone(itr.Key()))
+	}
+	err = itr.Error()
+	itr.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(defaultStorageVersionValue)); err != nil {
+		return err
+	}
+	if err := ndb.batch.WriteSync(); err != nil {
+		return fmt.Errorf("failed to write batch, %w", err)
+	}
+	ndb.storageVersion = defaultStorageVersionValue
+	resetCache(ndb.fastNodeCache)
+	return nil
+}
@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"bytes"
 	"errors"
 
 	dbm "github.com/cosmos/cosmos-db"
@@ -27,6 +28,9 @@ type FastIterator struct {
 	nextFastNode *fastnode.Node
 
 	fastIterator dbm.Iterator
+
+	closed    bool
+	exhausted bool // sought past its domain, fastIterator being nil
 }
 
 var _ dbm.Iterator = (*FastIterator)(nil)
@@ -47,29 +51,10 @@ func NewFastIterator(start, end []byte, ascending bool, ndb *nodeDB) *FastIterat
 }
 
 // Domain implements dbm.Iterator.
-// Maps the underlying nodedb iterator domain, to the 'logical' keys involved.
+// The domain of the underlying nodedb iterator is narrowed by Seek, so the domain given is
+// returned instead.
 func (iter *FastIterator) Domain() ([]byte, []byte) {
-	if iter.fastIterator == nil {
-		return iter.start, iter.end
-	}
-
-	start, end := iter.fastIterator.Domain()
-
-	if start != nil {
-		start = start[1:]
-		if len(start) == 0 {
-			start = nil
-		}
-	}
-
-	if end != nil {
-		end = end[1:]
-		if len(end) == 0 {
-			end = nil
-		}
-	}
-
-	return start, end
+	return iter.start, iter.end
 }
 
 // Valid implements dbm.Iterator.
@@ -79,14 +64,24 @@ func (iter *FastIterator) Valid() bool {
 
 // Key implements dbm.Iterator
 func (iter *FastIterator) Key() []byte {
+	return iter.ndb.copyBytes(iter.key())
+}
+
+// Value implements dbm.Iterator
+func (iter *FastIterator) Value() []byte {
+	return iter.ndb.copyBytes(iter.value())
+}
+
+// key returns the current key without copying it.
+func (iter *FastIterator) key() []byte {
 	if iter.valid {
 		return iter.nextFastNode.GetKey()
 	}
 	return nil
 }
 
-// Value implements dbm.Iterator
-func (iter *FastIterator) Value() []byte {
+// value returns the current value without copying it.
+func (iter *FastIterator) value() []byte {
 	if iter.valid {
 		return iter.nextFastNode.GetValue()
 	}
@@ -101,13 +96,27 @@ func (iter *FastIterator) Next() {
 		return
 	}
 
+	if iter.closed || iter.exhausted {
+		return
+	}
+
 	if iter.fastIterator == nil {
-		iter.fastIterator, iter.err = iter.ndb.getFastIterator(iter.start, iter.end, iter.ascending)
-		iter.valid = true
-	} else {
-		iter.fastIterator.Next()
+		iter.open(iter.start, iter.end)
+		return
 	}
+	iter.fastIterator.Next()
+	iter.load()
+}
 
+// open opens the underlying nodedb iterator over [start, end), and loads its first fast node.
+func (iter *FastIterator) open(start, end []byte) {
+	iter.fastIterator, iter.err = iter.ndb.getFastIterator(start, end, iter.ascending)
+	iter.valid = true
+	iter.load()
+}
+
+// load loads the fast node at the position of the underlying nodedb iterator.
+func (iter *FastIterator) load() {
 	if iter.err == nil {
 		iter.err = iter.fastIterator.Error()
 	}
@@ -119,12 +128,41 @@ func (iter *FastIterator) Next() {
 	}
 }
 
+// Seek implements Seeker. The underlying nodedb iterator is opened again from key, the fast
+// nodes being sorted by key.
+func (iter *FastIterator) Seek(key []byte) {
+	if iter.ndb == nil || iter.closed {
+		return
+	}
+	start, end := iter.start, iter.end
+	if len(key) > 0 {
+		if iter.ascending && (start == nil || bytes.Compare(key, start) > 0) {
+			start = key
+		}
+		if !iter.ascending && (end == nil || bytes.Compare(key, end) < 0) {
+			// the end is exclusive, so it is the key right after key.
+			end = append(bytes.Clone(key), 0)
+		}
+	}
+	if iter.fastIterator != nil {
+		iter.err = iter.fastIterator.Close()
+		iter.fastIterator = nil
+	}
+	iter.valid = false
+	// the backends may not accept an iterator whose start isn't before its end.
+	iter.exhausted = start != nil && end != nil && bytes.Compare(start, end) >= 0
+	if iter.err == nil && !iter.exhausted {
+		iter.open(start, end)
+	}
+}
+
 // Close implements dbm.Iterator
 func (iter *FastIterator) Close() error {
 	if iter.fastIterator != nil {
 		iter.err = iter.fastIterator.Close()
 	}
 	iter.valid = false
+	iter.closed = true
 	iter.fastIterator = nil
 	return iter.err
 }
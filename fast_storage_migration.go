@@ -0,0 +1,142 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+const fastStorageMigrationKey = "fast_storage_migration"
+
+// fastStorageMigrationCheckpointInterval is the default number of fast nodes written between
+// the checkpoints of the fast storage migration, see the FastStorageMigrationChunkSize option.
+var fastStorageMigrationCheckpointInterval int64 = 10000
+
+// fastStorageMigrationChunkSize returns the number of fast nodes written between the
+// checkpoints of the fast storage migration.
+func (ndb *nodeDB) fastStorageMigrationChunkSize() int64 {
+	if ndb.opts.FastStorageMigrationChunkSize > 0 {
+		return ndb.opts.FastStorageMigrationChunkSize
+	}
+	return fastStorageMigrationCheckpointInterval
+}
+
+// fastStorageMigrationCheckpoint records the progress of the fast storage migration of a
+// version: the fast nodes up to key, upgraded in total, have been committed.
+type fastStorageMigrationCheckpoint struct {
+	version  int64
+	upgraded int64
+	key      []byte
+}
+
+// MigrationProgress returns the number of fast nodes written so far by the last fast storage
+// migration, and the total number of fast nodes it writes. Both are 0 if no migration ran, and
+// done equals total once it has finished. It may be called concurrently with Load, e.g. while
+// the migration runs in the background.
+func (tree *MutableTree) MigrationProgress() (done, total int64) {
+	return tree.migrationDone.Load(), tree.migrationTotal.Load()
+}
+
+// WaitForFastStorageMigration waits for the background fast storage migration started by the
+// last load with the AsyncFastStorageMigration option, and returns its error. It returns nil
+// right away if there is none.
+//
+// SaveVersion waits for the migration as well, and fails if it did: the tree must then be
+// loaded again, which resumes the migration.
+func (tree *MutableTree) WaitForFastStorageMigration() error {
+	if tree.migrationWait == nil {
+		return nil
+	}
+	<-tree.migrationWait
+	return tree.migrationErr
+}
+
+// startFastStorageMigration runs the fast storage migration of the working tree in the
+// background, if needed. Reads are served from the tree until it finishes.
+func (tree *MutableTree) startFastStorageMigration(ctx context.Context) error {
+	tree.migrationWait, tree.migrationErr = nil, nil
+	isUpgradeable, err := tree.IsUpgradeable()
+	if err != nil || !isUpgradeable {
+		return err
+	}
+
+	// the working tree changes with the writes, the saved version is migrated.
+	t := tree.ImmutableTree.clone()
+	done := make(chan struct{})
+	tree.migrationWait = done
+	tree.ndb.setFastStorageMigrating(true)
+	go func() {
+		defer close(done)
+		err := tree.enableFastStorageAndCommit(ctx, t)
+		tree.ndb.endFastStorageMigration(err == nil)
+		if err != nil {
+			tree.logger.Error("fast storage migration failed", "version", t.version, "err", err)
+		}
+		tree.migrationErr = err
+	}()
+	return nil
+}
+
+// setFastStorageMigrating marks the fast storage as being migrated, which disables it until
+// endFastStorageMigration is called.
+func (ndb *nodeDB) setFastStorageMigrating(migrating bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.fastStorageMigrating = migrating
+}
+
+// endFastStorageMigration ends the fast storage migration. If it didn't succeed, the fast
+// storage stays disabled.
+func (ndb *nodeDB) endFastStorageMigration(succeeded bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.fastStorageMigrating = false
+	if !succeeded {
+		ndb.storageVersion = defaultStorageVersionValue
+	} else {
+		ndb.fastStorageStale = false
+	}
+}
+
+func (ndb *nodeDB) isFastStorageMigrating() bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.fastStorageMigrating
+}
+
+// getFastStorageMigrationCheckpoint returns the checkpoint of the interrupted fast storage
+// migration, or nil if there is none.
+func (ndb *nodeDB) getFastStorageMigrationCheckpoint() (*fastStorageMigrationCheckpoint, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(fastStorageMigrationKey)))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	if len(bz) < 2*int64Size {
+		return nil, fmt.Errorf("invalid fast storage migration checkpoint %X", bz)
+	}
+	return &fastStorageMigrationCheckpoint{
+		version:  int64(binary.BigEndian.Uint64(bz)),
+		upgraded: int64(binary.BigEndian.Uint64(bz[int64Size:])),
+		key:      bytes.Clone(bz[2*int64Size:]),
+	}, nil
+}
+
+// saveFastStorageMigrationCheckpoint adds the checkpoint to the batch, to be committed with the
+// fast nodes it covers.
+func (ndb *nodeDB) saveFastStorageMigrationCheckpoint(checkpoint *fastStorageMigrationCheckpoint) error {
+	bz := make([]byte, 2*int64Size, 2*int64Size+len(checkpoint.key))
+	binary.BigEndian.PutUint64(bz, uint64(checkpoint.version))
+	binary.BigEndian.PutUint64(bz[int64Size:], uint64(checkpoint.upgraded))
+	bz = append(bz, checkpoint.key...)
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(fastStorageMigrationKey)), bz)
+}
+
+func (ndb *nodeDB) deleteFastStorageMigrationCheckpoint() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Delete(metadataKeyFormat.Key([]byte(fastStorageMigrationKey)))
+}
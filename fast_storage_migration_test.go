@@ -0,0 +1,311 @@
+package iavl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// debugHookLogger records every event, and calls onDebug for every debug event.
+type debugHookLogger struct {
+	recordingLogger
+	onDebug func(msg string)
+}
+
+func (l *debugHookLogger) Debug(msg string, keyVals ...any) {
+	l.record("debug", msg, keyVals)
+	if l.onDebug != nil {
+		l.onDebug(msg)
+	}
+}
+
+const migrationTestKeys = 2500
+
+// setupMigrationTest saves two versions without fast storage, and makes the migration
+// checkpoint every 100 fast nodes.
+func setupMigrationTest(t *testing.T) dbm.DB {
+	interval := fastStorageMigrationCheckpointInterval
+	fastStorageMigrationCheckpointInterval = 100
+	t.Cleanup(func() { fastStorageMigrationCheckpointInterval = interval })
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for v := 1; v <= 2; v++ {
+		for i := 0; i < migrationTestKeys; i += v {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return db
+}
+
+// requireFastStorageConsistent checks that the fast nodes on disk match the latest version.
+func requireFastStorageConsistent(t *testing.T, tree *MutableTree) {
+	t.Helper()
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	var count int64
+	err = tree.ndb.traverseFastNodes(func(k, v []byte) error {
+		count++
+		node, err := fastnode.DeserializeNode(k[1:], v)
+		require.NoError(t, err)
+		_, value, err := tree.GetWithIndex(node.GetKey())
+		require.NoError(t, err)
+		require.Equal(t, value, node.GetValue(), "fast node %s", node.GetKey())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, tree.Size(), count)
+
+	checkpoint, err := tree.ndb.getFastStorageMigrationCheckpoint()
+	require.NoError(t, err)
+	require.Nil(t, checkpoint)
+}
+
+func TestFastStorageMigration_Resume(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	checkpoints := 0
+	logger := &debugHookLogger{onDebug: func(msg string) {
+		if msg == "fast storage migration checkpoint" {
+			if checkpoints++; checkpoints == 5 {
+				cancel()
+			}
+		}
+	}}
+	tree := NewMutableTree(db, 0, false, logger)
+	_, err := tree.LoadVersionContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	done, total := tree.MigrationProgress()
+	require.Equal(t, int64(500), done)
+	require.Equal(t, int64(migrationTestKeys), total)
+	require.False(t, tree.Health().Ready())
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	checkpoint, err := tree.ndb.getFastStorageMigrationCheckpoint()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), checkpoint.version)
+	require.Equal(t, int64(500), checkpoint.upgraded)
+	require.Equal(t, []byte("key-00499"), checkpoint.key)
+
+	// a new tree resumes the migration after the checkpoint.
+	logger = &debugHookLogger{}
+	tree = NewMutableTree(db, 0, false, logger)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	started := logger.find("fast storage migration started")
+	require.Len(t, started, 1)
+	require.Equal(t, int64(500), started[0]["resumed"])
+	require.Len(t, logger.find("fast storage migration checkpoint"), (migrationTestKeys-500)/100)
+	finished := logger.find("fast storage migration finished")
+	require.Len(t, finished, 1)
+	require.Equal(t, int64(migrationTestKeys), finished[0]["upgraded"])
+
+	done, total = tree.MigrationProgress()
+	require.Equal(t, int64(migrationTestKeys), done)
+	require.Equal(t, int64(migrationTestKeys), total)
+	require.True(t, tree.Health().Ready())
+	requireFastStorageConsistent(t, tree)
+}
+
+func TestFastStorageMigration_StaleCheckpoint(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.LoadVersionContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	tree = NewMutableTree(db, 0, false, &debugHookLogger{onDebug: func(msg string) { cancel() }})
+	_, err = tree.LoadVersionContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// another version is saved without fast storage, so the checkpoint is stale.
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-00000"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	logger := &debugHookLogger{}
+	tree = NewMutableTree(db, 0, false, logger)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	discarded := logger.find("discarding fast storage migration checkpoint")
+	require.Len(t, discarded, 1)
+	require.Equal(t, int64(2), discarded[0]["version"])
+	started := logger.find("fast storage migration started")
+	require.Len(t, started, 1)
+	require.Equal(t, int64(0), started[0]["resumed"])
+	requireFastStorageConsistent(t, tree)
+}
+
+func TestFastStorageMigration_Async(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	// the migration is held at its first checkpoint.
+	reached, release := make(chan struct{}), make(chan struct{})
+	first := true
+	logger := &debugHookLogger{onDebug: func(msg string) {
+		if msg == "fast storage migration checkpoint" && first {
+			first = false
+			close(reached)
+			<-release
+		}
+	}}
+	tree := NewMutableTree(db, 0, false, logger, AsyncFastStorageMigrationOption(true))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	<-reached
+
+	status := tree.Health()
+	require.True(t, status.Loaded)
+	require.True(t, status.MigrationInProgress)
+	require.False(t, status.Ready())
+	done, total := tree.MigrationProgress()
+	require.Equal(t, int64(100), done)
+	require.Equal(t, int64(migrationTestKeys), total)
+
+	// reads are served from the tree meanwhile.
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, enabled)
+	for _, i := range []int{0, 1, 1500, migrationTestKeys - 1} {
+		value, err := tree.Get([]byte(fmt.Sprintf("key-%05d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d-%d", 2-i%2, i)), value)
+	}
+	count := 0
+	_, err = tree.Iterate(func(_, _ []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, migrationTestKeys, count)
+
+	// writes are staged as usual, and saved once the migration has finished.
+	_, err = tree.Set([]byte("key-new"), []byte("value-new"))
+	require.NoError(t, err)
+	close(release)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.NoError(t, tree.WaitForFastStorageMigration())
+
+	require.True(t, tree.Health().Ready())
+	done, total = tree.MigrationProgress()
+	require.Equal(t, int64(migrationTestKeys), done)
+	require.Equal(t, int64(migrationTestKeys), total)
+	requireFastStorageConsistent(t, tree)
+}
+
+func TestFastStorageMigration_AsyncDeleteVersions(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	// the migration is held at its first checkpoint, while it writes the batch.
+	reached, release := make(chan struct{}), make(chan struct{})
+	first := true
+	logger := &debugHookLogger{onDebug: func(msg string) {
+		if msg == "fast storage migration checkpoint" && first {
+			first = false
+			close(reached)
+			<-release
+		}
+	}}
+	tree := NewMutableTree(db, 0, false, logger, AsyncFastStorageMigrationOption(true))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	<-reached
+
+	// the deletion waits for the chunk of the migration, rather than sharing its batch.
+	deleted := make(chan error, 1)
+	go func() { deleted <- tree.DeleteVersionsTo(1) }()
+	select {
+	case err := <-deleted:
+		t.Fatalf("versions deleted during the migration chunk: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-deleted)
+	require.NoError(t, tree.WaitForFastStorageMigration())
+
+	require.Equal(t, []int{2}, tree.AvailableVersions())
+	marker, err := db.Get(metadataKeyFormat.Key([]byte(commitMarkerKey)))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+	requireFastStorageConsistent(t, tree)
+}
+
+func TestFastStorageMigration_AsyncCancelled(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := &debugHookLogger{onDebug: func(msg string) { cancel() }}
+	tree := NewMutableTree(db, 0, false, logger, AsyncFastStorageMigrationOption(true))
+	_, err := tree.LoadVersionContext(ctx, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.WaitForFastStorageMigration(), context.Canceled)
+	require.Len(t, logger.find("fast storage migration failed"), 1)
+
+	_, err = tree.Set([]byte("key-new"), []byte("value-new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, tree.Health().Ready())
+
+	// loading again resumes the migration.
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.WaitForFastStorageMigration())
+	requireFastStorageConsistent(t, tree)
+	started := logger.find("fast storage migration started")
+	require.Len(t, started, 2)
+	require.Equal(t, int64(100), started[1]["resumed"])
+
+	_, err = tree.Set([]byte("key-new"), []byte("value-new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	requireFastStorageConsistent(t, tree)
+}
+
+func TestFastStorageMigration_ChunkSize(t *testing.T) {
+	db := setupMigrationTest(t)
+
+	checkpoints := 0
+	logger := &debugHookLogger{onDebug: func(msg string) {
+		if msg == "fast storage migration checkpoint" {
+			checkpoints++
+		}
+	}}
+	tree := NewMutableTree(db, 0, false, logger, FastStorageMigrationChunkSizeOption(1000), AsyncFastStorageMigrationOption(true))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.WaitForFastStorageMigration())
+	// the chunks of 1000 fast nodes override the checkpoints every 100 of the test.
+	require.Equal(t, migrationTestKeys/1000, checkpoints)
+	requireFastStorageConsistent(t, tree)
+}
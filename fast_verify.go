@@ -0,0 +1,107 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// FastMismatchKind tells how a fast node doesn't match the tree, see FastMismatch.
+type FastMismatchKind int
+
+const (
+	// FastNodeMissing is a key of the tree without fast node.
+	FastNodeMissing FastMismatchKind = iota
+	// FastNodeExtra is a fast node whose key isn't in the tree.
+	FastNodeExtra
+	// FastNodeValueMismatch is a fast node whose value differs from the value in the tree.
+	FastNodeValueMismatch
+)
+
+// String implements fmt.Stringer.
+func (k FastMismatchKind) String() string {
+	switch k {
+	case FastNodeMissing:
+		return "missing"
+	case FastNodeExtra:
+		return "extra"
+	case FastNodeValueMismatch:
+		return "value mismatch"
+	default:
+		return fmt.Sprintf("FastMismatchKind(%d)", int(k))
+	}
+}
+
+// FastMismatch is a key whose fast node doesn't match the tree, see VerifyFastStorage.
+type FastMismatch struct {
+	Key  []byte
+	Kind FastMismatchKind
+	// TreeValue is the value of the key in the tree, nil for FastNodeExtra.
+	TreeValue []byte
+	// FastValue is the value of the fast node, nil for FastNodeMissing.
+	FastValue []byte
+}
+
+// VerifyFastStorage checks that the fast nodes match the leaves of version, which must be the
+// latest version of the tree, with its fast storage enabled: that every key of the tree has a
+// fast node with its value, and that every fast node has a key of the tree. It returns the
+// mismatches in ascending key order, none if the fast storage is sound. It reads all the leaves
+// and the fast nodes from the database, so it is a slow diagnostic, e.g. to decide whether to
+// rebuild the fast storage. The tree must not be saved meanwhile.
+func (tree *MutableTree) VerifyFastStorage(version int64) (mismatches []FastMismatch, err error) {
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version != latestVersion {
+		return nil, fmt.Errorf("version %d isn't the latest version %d: %w", version, latestVersion, ErrInvalidInputs)
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return nil, ErrFastStorageNotUpgraded
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	tree.ndb.incrVersionReaders(version)
+	defer tree.ndb.decrVersionReaders(version)
+
+	leaves := NewIterator(nil, nil, true, itree)
+	defer leaves.Close()
+	fastNodes := NewFastIterator(nil, nil, true, tree.ndb)
+	defer fastNodes.Close()
+	for leaves.Valid() || fastNodes.Valid() {
+		cmp := -1
+		switch {
+		case !leaves.Valid():
+			cmp = 1
+		case fastNodes.Valid():
+			cmp = bytes.Compare(leaves.Key(), fastNodes.Key())
+		}
+		switch {
+		case cmp < 0:
+			mismatches = append(mismatches, FastMismatch{Key: leaves.Key(), Kind: FastNodeMissing, TreeValue: leaves.Value()})
+			leaves.Next()
+		case cmp > 0:
+			mismatches = append(mismatches, FastMismatch{Key: fastNodes.Key(), Kind: FastNodeExtra, FastValue: fastNodes.Value()})
+			fastNodes.Next()
+		default:
+			if !bytes.Equal(leaves.Value(), fastNodes.Value()) {
+				mismatches = append(mismatches, FastMismatch{
+					Key:       leaves.Key(),
+					Kind:      FastNodeValueMismatch,
+					TreeValue: leaves.Value(),
+					FastValue: fastNodes.Value(),
+				})
+			}
+			leaves.Next()
+			fastNodes.Next()
+		}
+	}
+	if err := leaves.Error(); err != nil {
+		return nil, err
+	}
+	if err := fastNodes.Error(); err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,62 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/fastnode"
+)
+
+func TestVerifyFastStorage(t *testing.T) {
+	tree, treeDB := setupFastExportTree(t)
+	db := treeDB.(*dbm.MemDB)
+	version := tree.Version()
+	mismatches, err := tree.VerifyFastStorage(version)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	setFastNode := func(key, value string) {
+		var buf bytes.Buffer
+		require.NoError(t, fastnode.NewNode([]byte(key), []byte(value), version).WriteBytes(&buf))
+		require.NoError(t, db.Set(tree.ndb.fastNodeKey([]byte(key)), buf.Bytes()))
+	}
+	// corrupt the value of a fast node.
+	value, err := tree.Get([]byte("key-0042"))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	setFastNode("key-0042", "corrupted")
+	mismatches, err = tree.VerifyFastStorage(version)
+	require.NoError(t, err)
+	require.Equal(t, []FastMismatch{{
+		Key:       []byte("key-0042"),
+		Kind:      FastNodeValueMismatch,
+		TreeValue: value,
+		FastValue: []byte("corrupted"),
+	}}, mismatches)
+
+	// a fast node without key in the tree, and a key of the tree without fast node.
+	setFastNode("key-9999", "extra")
+	value, err = tree.Get([]byte("key-0100"))
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(tree.ndb.fastNodeKey([]byte("key-0100"))))
+	mismatches, err = tree.VerifyFastStorage(version)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 3)
+	require.Equal(t, FastMismatch{Key: []byte("key-0100"), Kind: FastNodeMissing, TreeValue: value}, mismatches[1])
+	require.Equal(t, FastMismatch{Key: []byte("key-9999"), Kind: FastNodeExtra, FastValue: []byte("extra")}, mismatches[2])
+	require.Equal(t, "extra", mismatches[2].Kind.String())
+
+	_, err = tree.VerifyFastStorage(version - 1)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	skipped := NewMutableTree(dbm.NewMemDB(), 0, true, log.NewNopLogger())
+	_, err = skipped.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err = skipped.SaveVersion()
+	require.NoError(t, err)
+	_, err = skipped.VerifyFastStorage(version)
+	require.ErrorIs(t, err, ErrFastStorageNotUpgraded)
+}
@@ -0,0 +1,360 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// errInjected is the error of the operations failed by a FaultInjectingDB.
+var errInjected = errors.New("injected fault")
+
+// fault is an operation of a FaultInjectingDB to fail or delay.
+type fault struct {
+	prefix []byte        // only the keys with the prefix are counted, nil for all
+	n      int           // number of the counted operation to fail or delay, from 1
+	delay  time.Duration // delay of the operation, which fails if 0
+	seen   int           // counted operations
+}
+
+// hit counts an operation on key, and returns whether it is the faulty one.
+func (f *fault) hit(key []byte) bool {
+	if f == nil || f.n == 0 || (f.prefix != nil && !bytes.HasPrefix(key, f.prefix)) {
+		return false
+	}
+	f.seen++
+	return f.seen == f.n
+}
+
+// FaultInjectingDB is a MemDB, whose iteration order is deterministic, failing or delaying
+// chosen operations, to test how the tree handles the failures of its DB at any point. The
+// operations are counted from when the fault is set, and each fault is injected once.
+type FaultInjectingDB struct {
+	*dbm.MemDB
+
+	mtx    sync.Mutex
+	write  *fault // batch Set and Delete
+	read   *fault // Get, Has and iterator creation
+	flush  *fault // batch Write and WriteSync
+	writes int    // batch writes which succeeded
+}
+
+var _ dbm.DB = (*FaultInjectingDB)(nil)
+
+// NewFaultInjectingDB returns a FaultInjectingDB without faults.
+func NewFaultInjectingDB() *FaultInjectingDB {
+	return &FaultInjectingDB{MemDB: dbm.NewMemDB()}
+}
+
+// FailWrite fails the nth batch Set or Delete of a key with the prefix, nil for any key.
+func (db *FaultInjectingDB) FailWrite(prefix []byte, n int) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.write = &fault{prefix: prefix, n: n}
+}
+
+// FailRead fails the nth Get, Has or iterator creation on a key with the prefix, nil for any
+// key. An iterator is counted with its start.
+func (db *FaultInjectingDB) FailRead(prefix []byte, n int) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.read = &fault{prefix: prefix, n: n}
+}
+
+// DelayFlush delays the nth batch Write or WriteSync by d, or fails it if d is 0.
+func (db *FaultInjectingDB) DelayFlush(n int, d time.Duration) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.flush = &fault{n: n, delay: d}
+}
+
+// Writes returns the number of the batch Sets and Deletes which succeeded.
+func (db *FaultInjectingDB) Writes() int {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.writes
+}
+
+func (db *FaultInjectingDB) hit(f **fault, key []byte) bool {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return (*f).hit(key)
+}
+
+// Get implements dbm.DB.
+func (db *FaultInjectingDB) Get(key []byte) ([]byte, error) {
+	if db.hit(&db.read, key) {
+		return nil, fmt.Errorf("get %X: %w", key, errInjected)
+	}
+	return db.MemDB.Get(key)
+}
+
+// Has implements dbm.DB.
+func (db *FaultInjectingDB) Has(key []byte) (bool, error) {
+	if db.hit(&db.read, key) {
+		return false, fmt.Errorf("has %X: %w", key, errInjected)
+	}
+	return db.MemDB.Has(key)
+}
+
+// Iterator implements dbm.DB.
+func (db *FaultInjectingDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	if db.hit(&db.read, start) {
+		return nil, fmt.Errorf("iterator %X: %w", start, errInjected)
+	}
+	return db.MemDB.Iterator(start, end)
+}
+
+// ReverseIterator implements dbm.DB.
+func (db *FaultInjectingDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	if db.hit(&db.read, start) {
+		return nil, fmt.Errorf("reverse iterator %X: %w", start, errInjected)
+	}
+	return db.MemDB.ReverseIterator(start, end)
+}
+
+// NewBatch implements dbm.DB.
+func (db *FaultInjectingDB) NewBatch() dbm.Batch {
+	return &faultInjectingBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+// NewBatchWithSize implements dbm.DB.
+func (db *FaultInjectingDB) NewBatchWithSize(size int) dbm.Batch {
+	return &faultInjectingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type faultInjectingBatch struct {
+	dbm.Batch
+	db *FaultInjectingDB
+}
+
+func (b *faultInjectingBatch) Set(key, value []byte) error {
+	if b.db.hit(&b.db.write, key) {
+		return fmt.Errorf("set %X: %w", key, errInjected)
+	}
+	if err := b.Batch.Set(key, value); err != nil {
+		return err
+	}
+	b.db.mtx.Lock()
+	b.db.writes++
+	b.db.mtx.Unlock()
+	return nil
+}
+
+func (b *faultInjectingBatch) Delete(key []byte) error {
+	if b.db.hit(&b.db.write, key) {
+		return fmt.Errorf("delete %X: %w", key, errInjected)
+	}
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	b.db.mtx.Lock()
+	b.db.writes++
+	b.db.mtx.Unlock()
+	return nil
+}
+
+// flushed applies the flush fault, if it is hit.
+func (b *faultInjectingBatch) flushed() error {
+	b.db.mtx.Lock()
+	f := b.db.flush
+	hit := f.hit(nil)
+	b.db.mtx.Unlock()
+	if !hit {
+		return nil
+	}
+	if f.delay == 0 {
+		return fmt.Errorf("write batch: %w", errInjected)
+	}
+	time.Sleep(f.delay)
+	return nil
+}
+
+func (b *faultInjectingBatch) Write() error {
+	if err := b.flushed(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func (b *faultInjectingBatch) WriteSync() error {
+	if err := b.flushed(); err != nil {
+		return err
+	}
+	return b.Batch.WriteSync()
+}
+
+// setFaultVersion applies the same changes of a version to the trees, without saving them.
+func setFaultVersion(t *testing.T, version int, trees ...*MutableTree) {
+	t.Helper()
+	for _, tree := range trees {
+		for i := 0; i < 30; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", (version*11+i)%60)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+		for i := 0; i < 5; i++ {
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", (version*13+i*7)%60)))
+			require.NoError(t, err)
+		}
+	}
+}
+
+// requireLoadedTree checks that the latest version of tree loaded from db is the one of reference,
+// with the same keys and values, read from the fast storage as well as from the nodes.
+func requireLoadedTree(t *testing.T, db dbm.DB, reference *MutableTree) {
+	t.Helper()
+	loaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	version, err := loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, reference.Version(), version)
+	require.Equal(t, reference.Hash(), loaded.Hash())
+
+	expected, err := reference.GetImmutable(version)
+	require.NoError(t, err)
+	itree, err := loaded.GetImmutable(version)
+	require.NoError(t, err)
+	pairs := func(itr dbm.Iterator, err error) []string {
+		require.NoError(t, err)
+		defer itr.Close()
+		var pairs []string
+		for ; itr.Valid(); itr.Next() {
+			pairs = append(pairs, string(itr.Key())+"="+string(itr.Value()))
+		}
+		require.NoError(t, itr.Error())
+		return pairs
+	}
+	expectedPairs := pairs(expected.Iterator(nil, nil, true))
+	require.Equal(t, expectedPairs, pairs(loaded.Iterator(nil, nil, true)))
+	require.Equal(t, expectedPairs, pairs(itree.Iterator(nil, nil, true)))
+	enabled, err := loaded.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+}
+
+func TestSaveVersion_NodeWriteFailure(t *testing.T) {
+	for _, prefix := range []string{"s", fastKeyFormat.Prefix()} {
+		for n := 1; ; n++ {
+			db := NewFaultInjectingDB()
+			tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+			reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+			previous := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+			setFaultVersion(t, 0, tree, reference, previous)
+			for _, tree := range []*MutableTree{tree, reference, previous} {
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+
+			setFaultVersion(t, 1, tree, reference)
+			db.FailWrite([]byte(prefix), n)
+			_, _, err := tree.SaveVersion()
+			if err == nil {
+				// the version has fewer writes of the prefix.
+				require.Greater(t, n, 1)
+				break
+			}
+			require.ErrorIs(t, err, errInjected, "prefix %q, write %d", prefix, n)
+
+			// the version isn't saved, and neither the working tree nor the cached nodes are
+			// changed.
+			require.Equal(t, int64(1), tree.Version())
+			require.False(t, hasRoot(t, db, 2))
+			expected, err := reference.GetImmutable(1)
+			require.NoError(t, err)
+			itree, err := tree.GetImmutable(1)
+			require.NoError(t, err)
+			require.Equal(t, expected.Hash(), itree.Hash())
+			value, err := itree.Get([]byte("key-11"))
+			require.NoError(t, err)
+			expectedValue, err := expected.Get([]byte("key-11"))
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value)
+			requireLoadedTree(t, db, previous)
+
+			// the version is saved once retried.
+			hash, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			expectedHash, expectedVersion, err := reference.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, expectedVersion, version)
+			require.Equal(t, expectedHash, hash)
+			requireLoadedTree(t, db, reference)
+
+			// and the next versions as well.
+			setFaultVersion(t, 2, tree, reference)
+			hash, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			expectedHash, _, err = reference.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, expectedHash, hash)
+			requireLoadedTree(t, db, reference)
+		}
+	}
+}
+
+func TestSaveVersion_CommitFailure(t *testing.T) {
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	setFaultVersion(t, 0, tree, reference)
+
+	db.DelayFlush(1, 0)
+	_, _, err := tree.SaveVersion()
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, int64(0), tree.Version())
+	require.False(t, hasRoot(t, db, 1))
+	has, err := db.MemDB.Has(fastKeyFormat.Key([]byte("key-00")))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	expectedHash, _, err := reference.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, hash)
+	requireLoadedTree(t, db, reference)
+}
+
+func TestSaveVersion_DelayedFlush(t *testing.T) {
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	setFaultVersion(t, 0, tree)
+
+	db.DelayFlush(1, 50*time.Millisecond)
+	start := time.Now()
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.True(t, hasRoot(t, db, version))
+	requireLoadedTree(t, db, tree)
+}
+
+func TestFaultInjectingDB_ReadFailure(t *testing.T) {
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	setFaultVersion(t, 0, tree)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the nodes are read from db, with the cache disabled.
+	loaded := NewMutableTree(db, 0, true, log.NewNopLogger())
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	itree, err := loaded.GetImmutable(version)
+	require.NoError(t, err)
+	db.FailRead(nodeKeyFormat.Prefix(), 1)
+	_, err = itree.Get([]byte("key-05"))
+	require.ErrorIs(t, err, errInjected)
+
+	// the fault is injected once.
+	value, err := itree.Get([]byte("key-05"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-0-5"), value)
+}
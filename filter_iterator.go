@@ -0,0 +1,103 @@
+package iavl
+
+import (
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// FilterIterator is a dbm.Iterator which only yields the keys of an inner iterator accepted by
+// a filter, and exposes them through a transform, e.g. to strip a key prefix. Values are
+// yielded unchanged.
+type FilterIterator struct {
+	inner     dbm.Iterator
+	keep      func(key []byte) bool
+	transform func(key []byte) []byte
+
+	key []byte // transformed key at the current position
+	err error  // set by Seek if inner isn't a Seeker
+}
+
+var _ dbm.Iterator = (*FilterIterator)(nil)
+
+// NewFilterIterator returns an iterator over the keys of inner for which keep returns true,
+// with transform applied to the exposed keys. A nil keep accepts all keys, and a nil transform
+// leaves them unchanged. If no key is accepted, the iterator is immediately invalid. Closing
+// the returned iterator closes inner.
+func NewFilterIterator(inner dbm.Iterator, keep func(key []byte) bool, transform func(key []byte) []byte) dbm.Iterator {
+	iter := &FilterIterator{
+		inner:     inner,
+		keep:      keep,
+		transform: transform,
+	}
+	iter.skip()
+	return iter
+}
+
+// skip moves the inner iterator to the next accepted key, starting from its current position.
+func (iter *FilterIterator) skip() {
+	for ; iter.inner.Valid(); iter.inner.Next() {
+		key := iter.inner.Key()
+		if iter.keep != nil && !iter.keep(key) {
+			continue
+		}
+		if iter.transform != nil {
+			key = iter.transform(key)
+		}
+		iter.key = key
+		return
+	}
+	iter.key = nil
+}
+
+// Domain implements dbm.Iterator. It returns the domain of the inner iterator, which is not
+// transformed.
+func (iter *FilterIterator) Domain() ([]byte, []byte) {
+	return iter.inner.Domain()
+}
+
+// Valid implements dbm.Iterator.
+func (iter *FilterIterator) Valid() bool {
+	return iter.err == nil && iter.inner.Valid()
+}
+
+// Next implements dbm.Iterator.
+func (iter *FilterIterator) Next() {
+	iter.inner.Next()
+	iter.skip()
+}
+
+// Seek implements Seeker, moving the inner iterator to key, which is not transformed, and then
+// to the next accepted key. It fails if inner isn't a Seeker.
+func (iter *FilterIterator) Seek(key []byte) {
+	seeker, ok := iter.inner.(Seeker)
+	if !ok {
+		iter.err = fmt.Errorf("iterator %T can't seek: %w", iter.inner, ErrInvalidInputs)
+		return
+	}
+	seeker.Seek(key)
+	iter.skip()
+}
+
+// Key implements dbm.Iterator. It returns the transformed key.
+func (iter *FilterIterator) Key() []byte {
+	return iter.key
+}
+
+// Value implements dbm.Iterator.
+func (iter *FilterIterator) Value() []byte {
+	return iter.inner.Value()
+}
+
+// Error implements dbm.Iterator.
+func (iter *FilterIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.inner.Error()
+}
+
+// Close implements dbm.Iterator.
+func (iter *FilterIterator) Close() error {
+	return iter.inner.Close()
+}
@@ -0,0 +1,89 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/mock"
+)
+
+func newFilterTestIterator(t *testing.T) dbm.Iterator {
+	db := dbm.NewMemDB()
+	for _, key := range []string{"a/1", "a/2", "b/1", "b/2", "b/3", "c/1"} {
+		require.NoError(t, db.Set([]byte(key), []byte("value-"+key)))
+	}
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	return itr
+}
+
+func collectFilterIterator(t *testing.T, itr dbm.Iterator) (keys, values []string) {
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+		values = append(values, string(itr.Value()))
+	}
+	require.NoError(t, itr.Error())
+	require.NoError(t, itr.Close())
+	return keys, values
+}
+
+func hasPrefix(prefix string) func([]byte) bool {
+	return func(key []byte) bool { return bytes.HasPrefix(key, []byte(prefix)) }
+}
+
+func TestFilterIterator_FilterOnly(t *testing.T) {
+	keys, values := collectFilterIterator(t, NewFilterIterator(newFilterTestIterator(t), hasPrefix("b/"), nil))
+	require.Equal(t, []string{"b/1", "b/2", "b/3"}, keys)
+	require.Equal(t, []string{"value-b/1", "value-b/2", "value-b/3"}, values)
+}
+
+func TestFilterIterator_TransformOnly(t *testing.T) {
+	upper := func(key []byte) []byte { return bytes.ToUpper(key) }
+	keys, values := collectFilterIterator(t, NewFilterIterator(newFilterTestIterator(t), nil, upper))
+	require.Equal(t, []string{"A/1", "A/2", "B/1", "B/2", "B/3", "C/1"}, keys)
+	require.Equal(t, []string{"value-a/1", "value-a/2", "value-b/1", "value-b/2", "value-b/3", "value-c/1"}, values)
+}
+
+func TestFilterIterator_FilterAndTransform(t *testing.T) {
+	stripPrefix := func(key []byte) []byte { return key[len("a/"):] }
+	keys, values := collectFilterIterator(t, NewFilterIterator(newFilterTestIterator(t), hasPrefix("a/"), stripPrefix))
+	require.Equal(t, []string{"1", "2"}, keys)
+	require.Equal(t, []string{"value-a/1", "value-a/2"}, values)
+
+	// filters can be composed.
+	odd := func(key []byte) bool { return key[len(key)-1]%2 == 1 }
+	itr := NewFilterIterator(NewFilterIterator(newFilterTestIterator(t), hasPrefix("b/"), stripPrefix), odd, nil)
+	keys, _ = collectFilterIterator(t, itr)
+	require.Equal(t, []string{"1", "3"}, keys)
+}
+
+func TestFilterIterator_NothingKept(t *testing.T) {
+	itr := NewFilterIterator(newFilterTestIterator(t), hasPrefix("d/"), nil)
+	require.False(t, itr.Valid())
+	require.Nil(t, itr.Key())
+	require.NoError(t, itr.Close())
+}
+
+func TestFilterIterator_Forwarding(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	inner := mock.NewMockIterator(ctrl)
+	errInner := errors.New("inner error")
+
+	inner.EXPECT().Valid().Return(false).AnyTimes()
+	inner.EXPECT().Domain().Return([]byte("a"), []byte("z")).Times(1)
+	inner.EXPECT().Error().Return(errInner).Times(1)
+	inner.EXPECT().Close().Return(errInner).Times(1)
+
+	itr := NewFilterIterator(inner, nil, nil)
+	require.False(t, itr.Valid())
+	start, end := itr.Domain()
+	require.Equal(t, []byte("a"), start)
+	require.Equal(t, []byte("z"), end)
+	require.ErrorIs(t, itr.Error(), errInner)
+	require.ErrorIs(t, itr.Close(), errInner)
+}
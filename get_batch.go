@@ -0,0 +1,78 @@
+package iavl
+
+import (
+	"sort"
+)
+
+// GetBatch returns the values of the given keys, in the same order, nil for the absent ones, as
+// Get does for each of them. The keys are sorted and looked up in a single traversal of the tree,
+// which loads the nodes on the paths they share once rather than once per key, e.g. for a state
+// machine reading many related keys per message. The keys may be in any order, and repeated.
+// The values are copies, unless the UnsafeNoCopy option is set.
+//
+// The nodes are read from the tree rather than the fast storage, so the values of a MutableTree
+// include its unsaved changes, as its working tree does.
+func (t *ImmutableTree) GetBatch(keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrEmptyKey
+		}
+	}
+	if t.root == nil || len(keys) == 0 {
+		return values, nil
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return t.ndb.compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	if err := t.getBatch(t.root, keys, order, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// getBatch looks up the keys of the given indexes, sorted, in the subtree of node, and sets their
+// values at the same indexes.
+func (t *ImmutableTree) getBatch(node *Node, keys [][]byte, order []int, values [][]byte) error {
+	if node.isLeaf() {
+		for _, i := range order {
+			if t.ndb.compare(node.key, keys[i]) == 0 {
+				value, err := t.ndb.leafValue(node)
+				if err != nil {
+					return err
+				}
+				values[i] = t.ndb.liveValue(t.ndb.copyBytes(value))
+			}
+		}
+		return nil
+	}
+
+	// the keys before the key of the node are in its left subtree.
+	split := sort.Search(len(order), func(i int) bool {
+		return t.ndb.compare(keys[order[i]], node.key) >= 0
+	})
+	if split > 0 {
+		left, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := t.getBatch(left, keys, order[:split], values); err != nil {
+			return err
+		}
+	}
+	if split < len(order) {
+		right, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		if err := t.getBatch(right, keys, order[split:], values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestGetBatch(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 500; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("empty"), []byte{})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// unsorted, repeated and absent keys.
+	keys := [][]byte{[]byte("key-498"), []byte("key-001"), []byte("key-000"), []byte("empty"), []byte("key-250"), []byte("key-000"), []byte("z")}
+	check := func(tree *ImmutableTree) {
+		t.Helper()
+		values, err := tree.GetBatch(keys)
+		require.NoError(t, err)
+		require.Len(t, values, len(keys))
+		for i, key := range keys {
+			expected, err := tree.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expected, values[i], "key %s", key)
+		}
+	}
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	check(itree)
+	values, err := itree.GetBatch(keys)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-498"), values[0])
+	require.Nil(t, values[1])
+	require.NotNil(t, values[3])
+
+	// the unsaved changes of the working tree are seen.
+	_, err = tree.Set([]byte("key-001"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-250"))
+	require.NoError(t, err)
+	values, err = tree.GetBatch(keys)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), values[1])
+	require.Nil(t, values[4])
+
+	values, err = itree.GetBatch(nil)
+	require.NoError(t, err)
+	require.Empty(t, values)
+	_, err = itree.GetBatch([][]byte{[]byte("key-000"), nil})
+	require.ErrorIs(t, err, ErrEmptyKey)
+	values, err = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).GetBatch(keys)
+	require.NoError(t, err)
+	require.Equal(t, make([][]byte, len(keys)), values)
+}
+
+func TestGetBatch_Comparator(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ComparatorOption(numericComparator))
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprint(i)), []byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	values, err := tree.GetBatch([][]byte{[]byte("99"), []byte("9"), []byte("10"), []byte("100")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("99"), []byte("9"), []byte("10"), nil}, values)
+}
+
+func BenchmarkGetBatch(b *testing.B) {
+	tree := NewMutableTree(dbm.NewMemDB(), 100000, false, NewNopLogger())
+	for i := 0; i < 100000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%06d", i)), []byte("value"))
+		require.NoError(b, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+	keys := make([][]byte, 50)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%06d", 40000+i*3))
+	}
+	itree, err := tree.GetImmutable(1)
+	require.NoError(b, err)
+	itree.skipFastStorageUpgrade = true
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				_, err := itree.Get(key)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("GetBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := itree.GetBatch(keys)
+			require.NoError(b, err)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"lukechampine.com/blake3"
+)
+
+const hashSchemeKey = "hash_scheme"
+
+// HashScheme is the hash function hashing the nodes of a tree, see the HashScheme option. All
+// of them produce 32-byte hashes.
+type HashScheme uint8
+
+const (
+	// HashSHA256 hashes the nodes with SHA-256. It is the default, and the scheme of the trees
+	// created before the option.
+	HashSHA256 HashScheme = iota
+	// HashSHA512_256 hashes the nodes with SHA-512/256, which is faster than SHA-256 on 64-bit
+	// machines without SHA extensions.
+	HashSHA512_256
+	// HashBlake3 hashes the nodes with BLAKE3 with a 32-byte output. ics23 has no hash operation
+	// for it, so the trees using it can't produce ics23 proofs.
+	HashBlake3
+)
+
+// ErrHashSchemeMismatch is returned when loading or saving a tree with another HashScheme option
+// than the one its DB was created with.
+var ErrHashSchemeMismatch = errors.New("hash scheme mismatch")
+
+// ErrHashSchemeUnsupported is returned when producing a proof of a tree whose HashScheme the
+// proof format can't express.
+var ErrHashSchemeUnsupported = errors.New("proof format doesn't support the hash scheme")
+
+func (s HashScheme) String() string {
+	switch s {
+	case HashSHA256:
+		return "sha256"
+	case HashSHA512_256:
+		return "sha512_256"
+	case HashBlake3:
+		return "blake3"
+	default:
+		return fmt.Sprintf("HashScheme(%d)", uint8(s))
+	}
+}
+
+// New returns a new hash.Hash computing the hashes of the scheme. It panics if the scheme is
+// unknown.
+func (s HashScheme) New() hash.Hash {
+	switch s {
+	case HashSHA256:
+		return sha256.New()
+	case HashSHA512_256:
+		return sha512.New512_256()
+	case HashBlake3:
+		return blake3.New(32, nil)
+	default:
+		panic(fmt.Sprintf("unknown hash scheme %d", uint8(s)))
+	}
+}
+
+// Sum returns the hash of data.
+func (s HashScheme) Sum(data []byte) []byte {
+	switch s {
+	case HashSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case HashSHA512_256:
+		sum := sha512.Sum512_256(data)
+		return sum[:]
+	case HashBlake3:
+		sum := blake3.Sum256(data)
+		return sum[:]
+	default:
+		h := s.New()
+		h.Write(data)
+		return h.Sum(nil)
+	}
+}
+
+// EmptyHash returns the root hash of a tree without any keys with the scheme, i.e. the hash of
+// an empty input, see EmptyHash.
+func (s HashScheme) EmptyHash() []byte {
+	return s.Sum(nil)
+}
+
+// ProofSpec returns the ics23 spec verifying the proofs of the trees using the scheme, i.e.
+// ics23.IavlSpec with the hash operations of the scheme. It returns an error wrapping
+// ErrHashSchemeUnsupported if ics23 has no hash operation for it.
+func (s HashScheme) ProofSpec() (*ics23.ProofSpec, error) {
+	op, err := s.hashOp()
+	if err != nil {
+		return nil, err
+	}
+	if op == ics23.HashOp_SHA256 {
+		return ics23.IavlSpec, nil
+	}
+	leaf := *ics23.IavlSpec.LeafSpec
+	leaf.Hash, leaf.PrehashValue = op, op
+	inner := *ics23.IavlSpec.InnerSpec
+	inner.Hash = op
+	spec := *ics23.IavlSpec
+	spec.LeafSpec, spec.InnerSpec = &leaf, &inner
+	return &spec, nil
+}
+
+// hashOp returns the ics23 hash operation of the scheme.
+func (s HashScheme) hashOp() (ics23.HashOp, error) {
+	switch s {
+	case HashSHA256:
+		return ics23.HashOp_SHA256, nil
+	case HashSHA512_256:
+		return ics23.HashOp_SHA512_256, nil
+	default:
+		return ics23.HashOp_NO_HASH, fmt.Errorf("ics23 proofs with %v: %w", s, ErrHashSchemeUnsupported)
+	}
+}
+
+// hashScheme returns the HashScheme option, HashSHA256 for the in-memory trees without a nodeDB.
+func (ndb *nodeDB) hashScheme() HashScheme {
+	if ndb == nil {
+		return HashSHA256
+	}
+	return ndb.opts.HashScheme
+}
+
+// requireSHA256 returns an error wrapping ErrHashSchemeUnsupported unless the tree hashes its
+// nodes with SHA-256, which the native proofs, e.g. RangeProof, are verified with.
+func (ndb *nodeDB) requireSHA256() error {
+	if s := ndb.hashScheme(); s != HashSHA256 {
+		return fmt.Errorf("native proofs with %v: %w", s, ErrHashSchemeUnsupported)
+	}
+	return nil
+}
+
+// checkHashScheme validates the HashScheme option against the scheme the DB was created with,
+// and records it in the DB if the DB has no version yet. Only the schemes other than SHA-256
+// are recorded, so that the DBs without any record, e.g. those created before the option, use
+// SHA-256. The check is done once.
+func (ndb *nodeDB) checkHashScheme() error {
+	ndb.mtx.Lock()
+	checked := ndb.hashSchemeChecked
+	ndb.mtx.Unlock()
+	if checked {
+		return nil
+	}
+
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(hashSchemeKey)))
+	if err != nil {
+		return err
+	}
+	want := ndb.hashScheme()
+	switch {
+	case bz != nil:
+		if len(bz) != 1 {
+			return fmt.Errorf("invalid hash scheme %X", bz)
+		}
+		if stored := HashScheme(bz[0]); stored != want {
+			return fmt.Errorf("DB uses %v, but the tree is opened with %v: %w", stored, want, ErrHashSchemeMismatch)
+		}
+	case want != HashSHA256:
+		latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latest > 0 {
+			return fmt.Errorf("DB uses %v, but the tree is opened with %v: %w", HashSHA256, want, ErrHashSchemeMismatch)
+		}
+		batch := ndb.db.NewBatch()
+		defer batch.Close()
+		if err := batch.Set(metadataKeyFormat.Key([]byte(hashSchemeKey)), []byte{byte(want)}); err != nil {
+			return err
+		}
+		if err := batch.WriteSync(); err != nil {
+			return err
+		}
+	}
+
+	ndb.mtx.Lock()
+	ndb.hashSchemeChecked = true
+	ndb.mtx.Unlock()
+	return nil
+}
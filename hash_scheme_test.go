@@ -0,0 +1,86 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestHashScheme(t *testing.T) {
+	hashes := map[string]HashScheme{}
+	for _, scheme := range []HashScheme{HashSHA256, HashSHA512_256, HashBlake3} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, false, log.NewNopLogger(), HashSchemeOption(scheme), HashWorkersOption(4))
+			_, err := tree.Load()
+			require.NoError(t, err)
+			require.Equal(t, scheme.EmptyHash(), tree.WorkingHash())
+			for i := 0; i < 1000; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				require.NoError(t, err)
+			}
+			hash, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Len(t, hash, 32)
+			require.NotContains(t, hashes, string(hash))
+			hashes[string(hash)] = scheme
+			require.NoError(t, tree.VerifyIntegrity(version, 1))
+
+			loaded := NewMutableTree(db, 0, false, log.NewNopLogger(), HashSchemeOption(scheme))
+			_, err = loaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, hash, loaded.Hash())
+
+			key, value := []byte("key-0042"), []byte("value-42")
+			proof, err := loaded.GetProof(key)
+			if scheme == HashBlake3 {
+				require.ErrorIs(t, err, ErrHashSchemeUnsupported)
+				return
+			}
+			require.NoError(t, err)
+			spec, err := scheme.ProofSpec()
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(spec, hash, proof, key, value))
+			valid, err := loaded.VerifyMembership(proof, key)
+			require.NoError(t, err)
+			require.True(t, valid)
+
+			_, err = loaded.GetNativeMembershipProof(key)
+			if scheme != HashSHA256 {
+				require.ErrorIs(t, err, ErrHashSchemeUnsupported)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHashScheme_Mismatch(t *testing.T) {
+	for _, tc := range []struct {
+		created, opened HashScheme
+	}{
+		{HashBlake3, HashSHA256},
+		{HashSHA256, HashSHA512_256},
+		{HashSHA512_256, HashBlake3},
+	} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, log.NewNopLogger(), HashSchemeOption(tc.created))
+		_, err := tree.Set([]byte("key"), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		reopened := NewMutableTree(db, 0, false, log.NewNopLogger(), HashSchemeOption(tc.opened))
+		_, err = reopened.Load()
+		require.ErrorIs(t, err, ErrHashSchemeMismatch, "%v opened with %v", tc.created, tc.opened)
+
+		reopened = NewMutableTree(db, 0, false, log.NewNopLogger(), HashSchemeOption(tc.created))
+		_, err = reopened.Load()
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,44 @@
+package iavl
+
+// HealthStatus summarizes whether a tree is ready to serve queries.
+type HealthStatus struct {
+	// Loaded is true once a version has been loaded with Load or LoadVersion.
+	Loaded bool
+	// LatestVersion is the latest version saved to the database, 0 if there is none.
+	LatestVersion int64
+	// FastStorageConsistent is true if the fast storage index matches the latest version, or if
+	// the tree doesn't use fast storage.
+	FastStorageConsistent bool
+	// MigrationInProgress is true while the fast storage index is being (re)built.
+	MigrationInProgress bool
+}
+
+// Ready returns true if the tree is loaded, its fast storage is consistent and no migration is
+// in progress.
+func (s HealthStatus) Ready() bool {
+	return s.Loaded && s.FastStorageConsistent && !s.MigrationInProgress
+}
+
+// Health returns the readiness status of the tree. It only reads state tracked in memory, or a
+// single key from the database if the latest version isn't known yet, so it is cheap enough for
+// a readiness probe. Unlike the other methods of MutableTree, it may be called concurrently
+// with Load, e.g. while the fast storage migration is running.
+func (tree *MutableTree) Health() HealthStatus {
+	status := HealthStatus{
+		Loaded:              tree.loaded.Load(),
+		MigrationInProgress: tree.ndb.isFastStorageMigrating(),
+	}
+
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return status
+	}
+	status.LatestVersion = latestVersion
+
+	if status.MigrationInProgress {
+		return status
+	}
+	upgradeable, err := tree.IsUpgradeable()
+	status.FastStorageConsistent = err == nil && !upgradeable
+	return status
+}
@@ -0,0 +1,100 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// infoHookLogger calls onInfo for every info event.
+type infoHookLogger struct {
+	onInfo func(msg string)
+}
+
+var _ Logger = (*infoHookLogger)(nil)
+
+func (l *infoHookLogger) Debug(string, ...any)      {}
+func (l *infoHookLogger) Info(msg string, _ ...any) { l.onInfo(msg) }
+func (l *infoHookLogger) Warn(string, ...any)       {}
+func (l *infoHookLogger) Error(string, ...any)      {}
+
+func saveTestVersions(t *testing.T, db dbm.DB, skipFastStorageUpgrade bool, versions int) {
+	tree := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for v := 0; v < versions; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestMutableTree_Health(t *testing.T) {
+	db := dbm.NewMemDB()
+	saveTestVersions(t, db, false, 3)
+
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	status := tree.Health()
+	require.Equal(t, HealthStatus{LatestVersion: 3, FastStorageConsistent: true}, status)
+	require.False(t, status.Ready())
+
+	_, err := tree.Load()
+	require.NoError(t, err)
+	status = tree.Health()
+	require.Equal(t, HealthStatus{Loaded: true, LatestVersion: 3, FastStorageConsistent: true}, status)
+	require.True(t, status.Ready())
+}
+
+func TestMutableTree_HealthEmpty(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	status := tree.Health()
+	require.Equal(t, HealthStatus{}, status)
+	require.False(t, status.Ready())
+
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.True(t, tree.Health().Ready())
+}
+
+func TestMutableTree_HealthDuringMigration(t *testing.T) {
+	db := dbm.NewMemDB()
+	// the versions are saved without fast storage, so loading them triggers the migration.
+	saveTestVersions(t, db, true, 3)
+
+	var (
+		tree   *MutableTree
+		during []HealthStatus
+	)
+	logger := &infoHookLogger{onInfo: func(msg string) {
+		if msg == "fast storage migration started" {
+			during = append(during, tree.Health())
+		}
+	}}
+	tree = NewMutableTree(db, 0, false, logger)
+	require.Equal(t, HealthStatus{LatestVersion: 3}, tree.Health())
+
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, []HealthStatus{{LatestVersion: 3, MigrationInProgress: true}}, during)
+	require.False(t, during[0].Ready())
+
+	status := tree.Health()
+	require.Equal(t, HealthStatus{Loaded: true, LatestVersion: 3, FastStorageConsistent: true}, status)
+	require.True(t, status.Ready())
+}
+
+func TestMutableTree_HealthSkipFastStorage(t *testing.T) {
+	db := dbm.NewMemDB()
+	saveTestVersions(t, db, true, 2)
+
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, HealthStatus{Loaded: true, LatestVersion: 2, FastStorageConsistent: true}, tree.Health())
+}
@@ -0,0 +1,75 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/cosmos/iavl/cache"
+)
+
+// immutableCache keeps the trees recently returned by MutableTree.GetImmutable, see the
+// ImmutableTreeCacheSize option. The trees are read-only, so they are safely shared. A nil
+// immutableCache caches nothing.
+type immutableCache struct {
+	mtx   sync.Mutex
+	size  int
+	trees cache.Cache
+}
+
+// cachedImmutableTree is an entry of immutableCache, keyed by version.
+type cachedImmutableTree struct {
+	key  []byte
+	tree *ImmutableTree
+}
+
+var _ cache.Node = (*cachedImmutableTree)(nil)
+
+func (c *cachedImmutableTree) GetKey() []byte {
+	return c.key
+}
+
+func newImmutableCache(size int) *immutableCache {
+	if size <= 0 {
+		return nil
+	}
+	return &immutableCache{size: size, trees: cache.New(size)}
+}
+
+func immutableCacheKey(version int64) []byte {
+	var key [int64Size]byte
+	binary.BigEndian.PutUint64(key[:], uint64(version))
+	return key[:]
+}
+
+// get returns the cached tree of version, or nil.
+func (c *immutableCache) get(version int64) *ImmutableTree {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if entry := c.trees.Get(immutableCacheKey(version)); entry != nil {
+		return entry.(*cachedImmutableTree).tree
+	}
+	return nil
+}
+
+// add caches the tree, evicting the least recently used one if the cache is full.
+func (c *immutableCache) add(tree *ImmutableTree) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.trees.Add(&cachedImmutableTree{key: immutableCacheKey(tree.version), tree: tree})
+}
+
+// reset evicts every tree, once versions are deleted.
+func (c *immutableCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.trees = cache.New(c.size)
+}
@@ -0,0 +1,67 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestGetImmutable_Cache(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ImmutableTreeCacheSizeOption(2))
+	for v := 1; v <= 5; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte(fmt.Sprintf("value-%d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	getImmutable := func(version int64) *ImmutableTree {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, version, itree.Version())
+		require.EqualValues(t, version, itree.Size())
+		return itree
+	}
+
+	// the same instance is returned until evicted.
+	v1 := getImmutable(1)
+	require.Same(t, v1, getImmutable(1))
+	v2 := getImmutable(2)
+	require.Same(t, v1, getImmutable(1))
+	v3 := getImmutable(3)
+	require.Same(t, v1, getImmutable(1))
+	require.Same(t, v3, getImmutable(3))
+	reloaded := getImmutable(2)
+	require.NotSame(t, v2, reloaded)
+	require.Equal(t, v2.Hash(), reloaded.Hash())
+
+	// deleting versions evicts them.
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err := tree.GetImmutable(2)
+	require.Error(t, err)
+	require.NotSame(t, v3, getImmutable(3))
+
+	// so does overwriting them.
+	v5 := getImmutable(5)
+	require.NoError(t, tree.LoadVersionForOverwriting(4))
+	_, err = tree.Set([]byte("key-5"), []byte("overwritten"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	overwritten := getImmutable(5)
+	require.NotSame(t, v5, overwritten)
+	value, err := overwritten.Get([]byte("key-5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("overwritten"), value)
+
+	// and the cache can be disabled.
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ImmutableTreeCacheSizeOption(0))
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NotSame(t, getImmutable(1), getImmutable(1))
+}
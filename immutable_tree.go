@@ -1,11 +1,14 @@
 package iavl
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"strings"
 
-	"cosmossdk.io/log"
-
+	"github.com/cosmos/iavl/cache"
 	dbm "github.com/cosmos/iavl/db"
 )
 
@@ -16,16 +19,18 @@ import (
 // Returned key/value byte slices must not be modified, since they may point to data located inside
 // IAVL which would also be modified.
 type ImmutableTree struct {
-	logger log.Logger
+	logger Logger
 
 	root                   *Node
 	ndb                    *nodeDB
 	version                int64
 	skipFastStorageUpgrade bool
+	uncached               bool // whether the nodes are read bypassing the node cache, see MutableTree.IterateVersion
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
-func NewImmutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool, lg log.Logger, options ...Option) *ImmutableTree {
+func NewImmutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool, lg Logger, options ...Option) *ImmutableTree {
+	lg = ensureLogger(lg)
 	opts := DefaultOptions()
 	for _, opt := range options {
 		opt(&opts)
@@ -120,12 +125,43 @@ func (t *ImmutableTree) renderNode(node *Node, indent string, depth int, encoder
 	return result, nil
 }
 
-// Size returns the number of leaf nodes in the tree.
+// Size returns the number of keys in the tree, i.e. its number of leaf nodes. With the
+// SoftDeleteRetention option, the tombstones aren't counted, so the leaves are read.
 func (t *ImmutableTree) Size() int64 {
 	if t.root == nil {
 		return 0
 	}
-	return t.root.size
+	if !t.ndb.softDeletes() {
+		return t.root.size
+	}
+	size, err := t.liveSize()
+	if err != nil {
+		t.ndb.logger.Error("counting the keys without the tombstones", "err", err)
+		return t.root.size
+	}
+	return size
+}
+
+// liveSize returns the number of leaves which aren't tombstones.
+func (t *ImmutableTree) liveSize() (int64, error) {
+	size := t.root.size
+	traversal := t.root.newTraversal(t, nil, nil, true, false, false)
+	for node, err := traversal.next(); node != nil || err != nil; node, err = traversal.next() {
+		if err != nil {
+			return 0, err
+		}
+		if !node.isLeaf() {
+			continue
+		}
+		value, err := t.ndb.leafValue(node)
+		if err != nil {
+			return 0, err
+		}
+		if t.ndb.isTombstone(value) {
+			size--
+		}
+	}
+	return size, nil
 }
 
 // Version returns the version of the tree.
@@ -143,42 +179,143 @@ func (t *ImmutableTree) Height() int8 {
 
 // Has returns whether or not a key exists.
 func (t *ImmutableTree) Has(key []byte) (bool, error) {
-	if t.root == nil {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+	if t.root == nil || !t.ndb.bloomMayContain(t.version, key) {
 		return false, nil
 	}
+	if t.ndb.softDeletes() {
+		_, value, err := t.root.get(t, key)
+		return t.ndb.liveValue(value) != nil, err
+	}
 	return t.root.has(t, key)
 }
 
-// Hash returns the root hash.
+// Hash returns the root hash, or EmptyHash() if the tree has no keys.
 func (t *ImmutableTree) Hash() []byte {
-	return t.root.hashWithCount(t.version + 1)
+	return t.root.hashWithCount(t.version+1, t.ndb.hashScheme())
 }
 
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
 // imported with MutableTree.Import() to recreate an identical tree.
 func (t *ImmutableTree) Export() (*Exporter, error) {
-	return newExporter(t)
+	return newExporter(t, t.root, nil, exportBufferSize)
+}
+
+// ExportWithBuffer is like Export, but buffers at most bufSize nodes ahead of the consumer.
+// When the consumer falls behind, the producer blocks rather than accumulating nodes, so
+// memory held by the exporter stays bounded by bufSize. A bufSize of 0 hands nodes over one
+// at a time.
+func (t *ImmutableTree) ExportWithBuffer(bufSize int) (*Exporter, error) {
+	return newExporter(t, t.root, nil, bufSize)
+}
+
+// ExportWithTombstones is like Export, but first exports a tombstone for each key of the given
+// earlier version which is no longer in the tree, in ascending order, i.e. an ExportNode with
+// Deleted set, so that an importer mirroring the tree can apply the deletions since that version.
+// The version must still be available. The tombstones are skipped by MutableTree.Import, which
+// starts from an empty tree.
+func (t *ImmutableTree) ExportWithTombstones(sinceVersion int64) (*Exporter, error) {
+	if t == nil || t.ndb == nil {
+		return nil, fmt.Errorf("tree is nil: %w", ErrNotInitalizedTree)
+	}
+	if sinceVersion > t.version {
+		return nil, fmt.Errorf("version %d is after the exported version %d: %w", sinceVersion, t.version, ErrInvalidInputs)
+	}
+	rootKey, err := t.ndb.GetRoot(sinceVersion)
+	if err != nil {
+		return nil, err
+	}
+	since := &ImmutableTree{ndb: t.ndb, version: sinceVersion, skipFastStorageUpgrade: t.skipFastStorageUpgrade}
+	if rootKey != nil {
+		if since.root, err = t.ndb.GetNode(rootKey); err != nil {
+			return nil, err
+		}
+	}
+	return newExporter(t, t.root, since, exportBufferSize)
 }
 
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
-// otherwise. The returned value must not be modified, since it may point to data stored within
-// IAVL.
+// otherwise. The returned value is a copy, unless the UnsafeNoCopy option is set.
 //
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
-// It's neighbor has index 1 and so on.
+// It's neighbor has index 1 and so on. With the SoftDeleteRetention option, the tombstones are
+// leaves: a soft-deleted key returns a nil value and the index of its tombstone.
 func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	index, value, err := t.getWithIndexStored(key)
+	return index, t.ndb.liveValue(value), err
+}
+
+// getWithIndexStored is like GetWithIndex, but returns the tombstones of a tree with soft deletes.
+func (t *ImmutableTree) getWithIndexStored(key []byte) (int64, []byte, error) {
+	if len(key) == 0 {
+		return 0, nil, ErrEmptyKey
+	}
 	if t.root == nil {
 		return 0, nil, nil
 	}
-	return t.root.get(t, key)
+	index, value, err := t.root.get(t, key)
+	return index, t.ndb.copyBytes(value), err
+}
+
+// GetWithVersion returns the value of the specified key, and the version at which it was last
+// set, read from its leaf. It returns a nil value and version 0 if the key doesn't exist. Keys
+// set in the working tree of a MutableTree are reported at the working version. A soft-deleted
+// key returns a nil value and the version deleting it. The returned value is a copy, unless the
+// UnsafeNoCopy option is set.
+func (t *ImmutableTree) GetWithVersion(key []byte) (value []byte, lastModifiedVersion int64, err error) {
+	if len(key) == 0 {
+		return nil, 0, ErrEmptyKey
+	}
+	node := t.root
+	if node == nil {
+		return nil, 0, nil
+	}
+	for !node.isLeaf() {
+		if t.ndb.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if !bytes.Equal(node.key, key) {
+		return nil, 0, nil
+	}
+	if node.nodeKey == nil {
+		return t.ndb.copyBytes(t.ndb.liveValue(node.value)), t.version + 1, nil
+	}
+	if value, err = t.ndb.leafValue(node); err != nil {
+		return nil, 0, err
+	}
+	return t.ndb.copyBytes(t.ndb.liveValue(value)), node.nodeKey.version, nil
 }
 
-// Get returns the value of the specified key if it exists, or nil.
-// The returned value must not be modified, since it may point to data stored within IAVL.
+// Get returns the value of the specified key if it exists, or nil. A key set to an empty value
+// returns a non-nil empty slice, so that it is told apart from an absent key.
+// The returned value is a copy, unless the UnsafeNoCopy option is set.
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
 func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
-	if t.root == nil {
+	value, err := t.getStored(key)
+	return t.ndb.liveValue(value), err
+}
+
+// getStored is like Get, but returns the tombstones of a tree with soft deletes.
+func (t *ImmutableTree) getStored(key []byte) ([]byte, error) {
+	value, err := t.get(key)
+	return t.ndb.copyBytes(value), err
+}
+
+// get is like Get, but returns the value stored within IAVL.
+func (t *ImmutableTree) get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if t.root == nil || !t.ndb.bloomMayContain(t.version, key) {
 		return nil, nil
 	}
 
@@ -215,17 +352,82 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 	return result, err
 }
 
-// GetByIndex gets the key and value at the specified index.
+// GetByIndex gets the key and value at the specified index, see GetWithIndex. The value of a
+// soft-deleted key is nil. The returned key and value are copies, unless the UnsafeNoCopy
+// option is set.
 func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err error) {
 	if t.root == nil {
 		return nil, nil, nil
 	}
 
-	return t.root.getByIndex(t, index)
+	key, value, err = t.root.getByIndex(t, index)
+	return t.ndb.copyBytes(key), t.ndb.copyBytes(t.ndb.liveValue(value)), err
+}
+
+// Sample returns k distinct key/value pairs picked uniformly at random among the keys of the tree,
+// in key order. The sample is deterministic for a given seed and version. All the pairs are
+// returned if k is larger than the size of the tree.
+func (t *ImmutableTree) Sample(k int, seed int64) ([]KVPair, error) {
+	if k < 0 {
+		return nil, fmt.Errorf("sample size must not be negative, got %d: %w", k, ErrInvalidInputs)
+	}
+	size := t.Size()
+	if int64(k) > size {
+		k = int(size)
+	}
+	if k == 0 {
+		return []KVPair{}, nil
+	}
+
+	// Floyd's algorithm picks k distinct indexes with a single random draw each.
+	rng := rand.New(rand.NewSource(seed))
+	picked := make(map[int64]struct{}, k)
+	indexes := make([]int64, 0, k)
+	for j := size - int64(k); j < size; j++ {
+		index := rng.Int63n(j + 1)
+		if _, ok := picked[index]; ok {
+			index = j
+		}
+		picked[index] = struct{}{}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	if t.ndb.softDeletes() {
+		// the indexes are the ones of the live keys, which the tombstones don't keep.
+		return t.sampleLive(indexes)
+	}
+
+	pairs := make([]KVPair, 0, k)
+	for _, index := range indexes {
+		key, value, err := t.GetByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, KVPair{Key: key, Value: value})
+	}
+	return pairs, nil
+}
+
+// sampleLive returns the pairs of the keys at the given sorted indexes among the keys which
+// aren't soft-deleted.
+func (t *ImmutableTree) sampleLive(indexes []int64) ([]KVPair, error) {
+	itr, err := t.Iterator(nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	pairs := make([]KVPair, 0, len(indexes))
+	for index := int64(0); itr.Valid() && len(pairs) < len(indexes); itr.Next() {
+		if index == indexes[len(pairs)] {
+			pairs = append(pairs, KVPair{Key: itr.Key(), Value: itr.Value()})
+		}
+		index++
+	}
+	return pairs, itr.Error()
 }
 
-// Iterate iterates over all keys of the tree. The keys and values must not be modified,
-// since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
+// Iterate iterates over all keys of the tree. The keys and values are copies, unless the
+// UnsafeNoCopy option is set. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
 	if t.root == nil {
 		return false, nil
@@ -245,51 +447,211 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 	return false, nil
 }
 
-// Iterator returns an iterator over the immutable tree.
+// Iterator returns an iterator over the immutable tree. The keys and values it returns are
+// copies, unless the UnsafeNoCopy option is set.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
-	if !t.skipFastStorageUpgrade {
+	// the fast nodes are stored in lexicographic order, so only the tree follows a comparator.
+	if !t.skipFastStorageUpgrade && t.ndb.opts.Comparator == nil {
 		isFastCacheEnabled, err := t.IsFastCacheEnabled()
 		if err != nil {
 			return nil, err
 		}
 
 		if isFastCacheEnabled {
-			return NewFastIterator(start, end, ascending, t.ndb), nil
+			return t.ndb.trackIterator(t.ndb.filterTombstones(NewFastIterator(start, end, ascending, t.ndb))), nil
 		}
 	}
-	return NewIterator(start, end, ascending, t), nil
+	return t.ndb.trackIterator(t.ndb.filterTombstones(NewIterator(start, end, ascending, t))), nil
 }
 
-// IterateRange makes a callback for all nodes with key between start and end non-inclusive.
-// If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
-// values must not be modified, since they may point to data stored within IAVL.
+// IteratePrefix returns an iterator over the keys with the given prefix, in ascending or
+// descending order, e.g. the keys of a module store. It seeks to the first key of the prefix
+// and stops at the first key past it, skipping the subtrees whose keys are all outside it, as
+// Iterator does for its bounds. A nil or empty prefix iterates over all the keys. It fails
+// with the Comparator option, under which the keys of a prefix aren't contiguous.
+func (t *ImmutableTree) IteratePrefix(prefix []byte, ascending bool) (dbm.Iterator, error) {
+	if t.ndb.opts.Comparator != nil {
+		return nil, fmt.Errorf("prefix iteration isn't supported with a custom comparator: %w", ErrInvalidInputs)
+	}
+	if len(prefix) == 0 {
+		return t.Iterator(nil, nil, ascending)
+	}
+	return t.Iterator(prefix, prefixEnd(prefix), ascending)
+}
+
+// pageCursorVersion is the first byte of the cursors returned by IteratePaged, followed by the
+// key the next page starts from, so that their format can evolve.
+const pageCursorVersion = 1
+
+// IteratePaged returns the first limit key/value pairs with key in [start, end) from cursor, in
+// ascending order, and the cursor to pass to get the next page, nil once the range is
+// exhausted. A nil cursor starts from start, and a nil start or end leaves that side
+// unbounded, as in Iterator. Each page seeks to its first key, so paging through a range
+// doesn't walk the tree from start again. The cursor is opaque, and resumes from the same key
+// on any version of the tree, so a page of a later version doesn't repeat the keys returned
+// for the previous ones. The keys and values are copies, unless the UnsafeNoCopy option is set.
+func (t *ImmutableTree) IteratePaged(start, end []byte, limit int, cursor []byte) ([]KVPair, []byte, error) {
+	if limit <= 0 {
+		return nil, nil, fmt.Errorf("page limit must be positive, got %d: %w", limit, ErrInvalidInputs)
+	}
+	from := start
+	if cursor != nil {
+		if len(cursor) < 2 || cursor[0] != pageCursorVersion {
+			return nil, nil, fmt.Errorf("invalid cursor %X: %w", cursor, ErrInvalidInputs)
+		}
+		from = cursor[1:]
+		if (start != nil && t.ndb.compare(from, start) < 0) || (end != nil && t.ndb.compare(from, end) >= 0) {
+			return nil, nil, fmt.Errorf("cursor %X is out of the range: %w", cursor, ErrInvalidInputs)
+		}
+	}
+
+	itr, err := t.Iterator(from, end, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer itr.Close()
+	pairs := make([]KVPair, 0, limit)
+	for ; itr.Valid(); itr.Next() {
+		if len(pairs) == limit {
+			return pairs, append([]byte{pageCursorVersion}, itr.Key()...), nil
+		}
+		pairs = append(pairs, KVPair{Key: itr.Key(), Value: itr.Value()})
+	}
+	return pairs, nil, itr.Error()
+}
+
+// prefixEnd returns the smallest key greater than all the keys with the given prefix, nil if
+// there is none, i.e. if the prefix only has 0xFF bytes.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 {
+		if last := len(end) - 1; end[last] != 0xFF {
+			end[last]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
+// IterateRange makes a callback for all nodes with key in [start, end), i.e. start is inclusive
+// and end is exclusive in both ascending and descending order. If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
+// values are copies, unless the UnsafeNoCopy option is set.
 func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool) {
 	if t.root == nil {
 		return false
 	}
 	return t.root.traverseInRange(t, start, end, ascending, false, false, func(node *Node) bool {
 		if node.subtreeHeight == 0 {
-			return fn(node.key, node.value)
+			value, err := t.ndb.leafValue(node)
+			if err != nil {
+				// the traversal stops on the error, as on the ones loading the nodes.
+				return true
+			}
+			if t.ndb.isTombstone(value) {
+				// the tombstones of the soft deletes are skipped.
+				return false
+			}
+			return fn(t.ndb.copyBytes(node.key), t.ndb.copyBytes(value))
 		}
 		return false
 	})
 }
 
+// IterateRangeReverse makes a callback for all nodes with key in [start, end), visiting them
+// from the highest key to the lowest. The bounds have the same meaning as in ascending
+// iteration: start is inclusive and end is exclusive, so the first visited key is the
+// largest key strictly below end. A nil start or end leaves that side unbounded, and an
+// empty range (start >= end) makes no callbacks. The keys and values are copies, unless the
+// UnsafeNoCopy option is set. Returns true if stopped by callback.
+func (t *ImmutableTree) IterateRangeReverse(start, end []byte, fn func(key []byte, value []byte) bool) (stopped bool) {
+	return t.IterateRange(start, end, false, fn)
+}
+
 // IterateRangeInclusive makes a callback for all nodes with key between start and end inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
-// values must not be modified, since they may point to data stored within IAVL.
+// values are copies, unless the UnsafeNoCopy option is set.
 func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool, fn func(key, value []byte, version int64) bool) (stopped bool) {
 	if t.root == nil {
 		return false
 	}
 	return t.root.traverseInRange(t, start, end, ascending, true, false, func(node *Node) bool {
 		if node.subtreeHeight == 0 {
-			return fn(node.key, node.value, node.nodeKey.version)
+			value, err := t.ndb.leafValue(node)
+			if err != nil {
+				// the traversal stops on the error, as on the ones loading the nodes.
+				return true
+			}
+			if t.ndb.isTombstone(value) {
+				// the tombstones of the soft deletes are skipped.
+				return false
+			}
+			return fn(t.ndb.copyBytes(node.key), t.ndb.copyBytes(value), node.nodeKey.version)
 		}
 		return false
 	})
 }
 
+// Prefetch loads the nodes leading to the keys within [start, end) into the node cache in the
+// background, ahead of a range query over them, and returns immediately. A nil start or end
+// leaves that side unbounded. It is safe to call concurrently with other reads, and it is best
+// effort: it stops at the first error, and the nodes may be evicted again if the range doesn't
+// fit in the cache. Only the node iteration, e.g. IterateRange, and the proofs benefit from it,
+// since the fast storage iterators read the fast nodes straight from the database. The unsaved
+// working tree of a MutableTree isn't prefetched.
+func (t *ImmutableTree) Prefetch(start, end []byte) {
+	root := t.root
+	if root == nil || root.nodeKey == nil || t.ndb.archive != nil {
+		return
+	}
+	t.ndb.prefetching.Add(1)
+	go func() {
+		defer t.ndb.prefetching.Done()
+		root.traverseInRange(t, start, end, true, false, false, func(*Node) bool {
+			return false
+		})
+	}()
+}
+
+// warm loads the nodes of the given number of top levels of the tree into the node cache, see
+// MutableTree.GetImmutableWarm.
+func (t *ImmutableTree) warm(levels int) error {
+	if t.root == nil || t.root.nodeKey == nil || t.ndb.archive != nil {
+		return nil
+	}
+	t.ndb.mtx.Lock()
+	limit := math.MaxInt
+	if bounded, ok := t.ndb.nodeCache.(cache.Bounded); ok {
+		limit = bounded.MaxLen()
+	}
+	t.ndb.mtx.Unlock()
+
+	// the root is loaded along with the tree.
+	loaded := 1
+	level := []*Node{t.root}
+	for depth := 1; depth < levels && len(level) > 0; depth++ {
+		var next []*Node
+		for _, node := range level {
+			if node.isLeaf() {
+				continue
+			}
+			for _, nk := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+				if loaded >= limit {
+					return nil
+				}
+				child, err := t.ndb.GetNode(nk)
+				if err != nil {
+					return err
+				}
+				loaded++
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
 // IsFastCacheEnabled returns true if fast cache is enabled, false otherwise.
 // For fast cache to be enabled, the following 2 conditions must be met:
 // 1. The tree is of the latest version.
@@ -29,6 +29,11 @@ type Importer struct {
 	stack     []*Node
 	nonces    []uint32
 
+	// pool writes the nodes with the ImportWorkers option, and pending holds the writes of the
+	// children of the nodes of the stack.
+	pool    *importPool
+	pending [][2]*importJob
+
 	// inflightCommit tracks a batch commit, if any.
 	inflightCommit <-chan error
 }
@@ -47,19 +52,29 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 	if !tree.IsEmpty() {
 		return nil, errors.New("tree must be empty")
 	}
+	if err := tree.ndb.checkHashScheme(); err != nil {
+		return nil, err
+	}
+	if err := tree.ndb.checkNodeEncoding(); err != nil {
+		return nil, err
+	}
 
-	return &Importer{
+	importer := &Importer{
 		tree:    tree,
 		version: version,
 		batch:   tree.ndb.db.NewBatch(),
 		stack:   make([]*Node, 0, 8),
 		nonces:  make([]uint32, version+1),
-	}, nil
+	}
+	if workers := tree.ndb.opts.ImportWorkers; workers > 1 {
+		importer.pool = newImportPool(tree.ndb, workers)
+	}
+	return importer, nil
 }
 
 // writeNode writes the node content to the storage.
 func (i *Importer) writeNode(node *Node) error {
-	node._hash(node.nodeKey.version)
+	node._hash(node.nodeKey.version, i.tree.ndb.hashScheme())
 	if err := node.validate(); err != nil {
 		return err
 	}
@@ -68,7 +83,7 @@ func (i *Importer) writeNode(node *Node) error {
 	buf.Reset()
 	defer bufPool.Put(buf)
 
-	if err := node.writeBytes(buf); err != nil {
+	if err := node.writeEncodedBytes(buf, i.tree.ndb.nodeEncoding(), i.tree.ndb.valueCodec(), nil); err != nil {
 		return err
 	}
 
@@ -106,6 +121,10 @@ func (i *Importer) writeNode(node *Node) error {
 // Close frees all resources. It is safe to call multiple times. Uncommitted nodes may already have
 // been flushed to the database, but will not be visible.
 func (i *Importer) Close() {
+	if i.pool != nil {
+		i.pool.close(false) //nolint:errcheck
+		i.pool = nil
+	}
 	if i.inflightCommit != nil {
 		<-i.inflightCommit
 		i.inflightCommit = nil
@@ -127,10 +146,19 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	if exportNode == nil {
 		return errors.New("node cannot be nil")
 	}
+	if exportNode.Deleted {
+		// the imported tree starts empty, so there is nothing to delete.
+		return nil
+	}
 	if exportNode.Version > i.version {
 		return fmt.Errorf("node version %v can't be greater than import version %v",
 			exportNode.Version, i.version)
 	}
+	if i.pool != nil {
+		if err := i.pool.error(); err != nil {
+			return err
+		}
+	}
 
 	node := &Node{
 		key:           exportNode.Key,
@@ -146,8 +174,24 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	// We don't modify the stack until we've verified the built node, to avoid leaving the
 	// importer in an inconsistent state when we return an error.
 	stackSize := len(i.stack)
+	var children [2]*importJob
 	if node.subtreeHeight == 0 {
 		node.size = 1
+	} else if i.pool != nil && stackSize >= 2 && i.stack[stackSize-1].subtreeHeight < node.subtreeHeight && i.stack[stackSize-2].subtreeHeight < node.subtreeHeight {
+		leftNode := i.stack[stackSize-2]
+		rightNode := i.stack[stackSize-1]
+
+		node.leftNode = leftNode
+		node.rightNode = rightNode
+		node.leftNodeKey = leftNode.GetKey()
+		node.rightNodeKey = rightNode.GetKey()
+		node.size = leftNode.size + rightNode.size
+
+		// the children are hashed and written by the pool, which releases their own children.
+		children[0] = i.pool.submit(leftNode, i.pending[stackSize-2])
+		children[1] = i.pool.submit(rightNode, i.pending[stackSize-1])
+		i.stack = i.stack[:stackSize-2]
+		i.pending = i.pending[:stackSize-2]
 	} else if stackSize >= 2 && i.stack[stackSize-1].subtreeHeight < node.subtreeHeight && i.stack[stackSize-2].subtreeHeight < node.subtreeHeight {
 		leftNode := i.stack[stackSize-2]
 		rightNode := i.stack[stackSize-1]
@@ -181,10 +225,29 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	}
 
 	i.stack = append(i.stack, node)
+	if i.pool != nil {
+		i.pending = append(i.pending, children)
+	}
 
 	return nil
 }
 
+// rootHash returns the root hash of the tree imported so far.
+func (i *Importer) rootHash() ([]byte, error) {
+	if i.tree == nil {
+		return nil, ErrNoImport
+	}
+	switch len(i.stack) {
+	case 0:
+		return i.tree.ndb.hashScheme().EmptyHash(), nil
+	case 1:
+		return i.stack[0]._hash(i.stack[0].nodeKey.version, i.tree.ndb.hashScheme()), nil
+	default:
+		return nil, fmt.Errorf("invalid node structure, found stack size %v when committing",
+			len(i.stack))
+	}
+}
+
 // Commit finalizes the import by flushing any outstanding nodes to the database, making the
 // version visible, and updating the tree metadata. It can only be called once, and calls Close()
 // internally.
@@ -200,7 +263,9 @@ func (i *Importer) Commit() error {
 		}
 	case 1:
 		i.stack[0].nodeKey.nonce = 1
-		if err := i.writeNode(i.stack[0]); err != nil {
+		if i.pool != nil {
+			i.pool.submit(i.stack[0], i.pending[0])
+		} else if err := i.writeNode(i.stack[0]); err != nil {
 			return err
 		}
 		if i.stack[0].nodeKey.version < i.version { // it means there is no update in the given version
@@ -213,6 +278,22 @@ func (i *Importer) Commit() error {
 			len(i.stack))
 	}
 
+	// the flushed nodes, and the ones of the pool, are written before the root of the version,
+	// which makes it visible.
+	if i.inflightCommit != nil {
+		err := <-i.inflightCommit
+		i.inflightCommit = nil
+		if err != nil {
+			return err
+		}
+	}
+	if i.pool != nil {
+		err := i.pool.close(true)
+		i.pool = nil
+		if err != nil {
+			return err
+		}
+	}
 	err := i.batch.WriteSync()
 	if err != nil {
 		return err
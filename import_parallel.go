@@ -0,0 +1,130 @@
+package iavl
+
+import (
+	"bytes"
+	"sync"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// importJob is the write of a node of an import by its importPool, done once the node is hashed
+// and written to a batch, which its parent waits for to hash itself.
+type importJob struct {
+	node     *Node
+	children [2]*importJob // the writes of the children of an inner node, unless written already
+	done     chan struct{}
+}
+
+// importPool hashes, encodes and writes the nodes of an Importer with a pool of goroutines, each
+// with its own batch, see the ImportWorkers option. The nodes are submitted in the order they are
+// added, i.e. post-order, so the children of a node are always taken by the goroutines before
+// it, and a goroutine waiting for the children of its node waits for goroutines which wait for no
+// later node.
+type importPool struct {
+	ndb   *nodeDB
+	jobs  chan *importJob
+	wg    sync.WaitGroup
+	flush bool // whether the goroutines write their last batch once the jobs are done
+
+	mtx sync.Mutex
+	err error // first error of a goroutine
+}
+
+// newImportPool starts an import pool of the given number of goroutines.
+func newImportPool(ndb *nodeDB, workers int) *importPool {
+	p := &importPool{ndb: ndb, jobs: make(chan *importJob, 4*workers)}
+	p.wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit queues the write of the node, once the writes of its children, if any, are done.
+func (p *importPool) submit(node *Node, children [2]*importJob) *importJob {
+	job := &importJob{node: node, children: children, done: make(chan struct{})}
+	p.jobs <- job
+	return job
+}
+
+// error returns the first error of the goroutines, if any.
+func (p *importPool) error() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.err
+}
+
+func (p *importPool) fail(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// close waits for the queued writes, and for the goroutines to write their last batch if flush is
+// true, or to discard it otherwise, and returns the first error of the goroutines.
+func (p *importPool) close(flush bool) error {
+	p.flush = flush
+	close(p.jobs)
+	p.wg.Wait()
+	return p.error()
+}
+
+func (p *importPool) work() {
+	defer p.wg.Done()
+	batch := p.ndb.db.NewBatch()
+	size := 0
+	for job := range p.jobs {
+		for _, child := range job.children {
+			if child != nil {
+				<-child.done
+			}
+		}
+		if p.error() == nil {
+			if err := p.write(&batch, &size, job.node); err != nil {
+				p.fail(err)
+			}
+		}
+		close(job.done)
+	}
+	if p.flush && p.error() == nil && size > 0 {
+		if err := batch.Write(); err != nil {
+			p.fail(err)
+		}
+	}
+	batch.Close()
+}
+
+// write hashes the node, whose children are hashed already, and writes it to the batch, which is
+// written and replaced once it holds maxBatchSize nodes, as Importer.writeNode does.
+func (p *importPool) write(batch *dbm.Batch, size *int, node *Node) error {
+	node._hash(node.nodeKey.version, p.ndb.hashScheme())
+	if err := node.validate(); err != nil {
+		return err
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if err := node.writeEncodedBytes(buf, p.ndb.nodeEncoding(), p.ndb.valueCodec(), nil); err != nil {
+		return err
+	}
+	if err := (*batch).Set(p.ndb.nodeKey(node.GetKey()), bytes.Clone(buf.Bytes())); err != nil {
+		return err
+	}
+	// the parent of the node only reads its hash, so its children can be released.
+	node.leftNode = nil
+	node.rightNode = nil
+
+	*size++
+	if *size >= maxBatchSize {
+		if err := (*batch).Write(); err != nil {
+			return err
+		}
+		(*batch).Close()
+		*batch = p.ndb.db.NewBatch()
+		*size = 0
+	}
+	return nil
+}
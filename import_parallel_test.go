@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// exportNodes returns the exported nodes of tree.
+func exportNodes(t require.TestingT, tree *ImmutableTree) []*ExportNode {
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	var nodes []*ExportNode
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			return nodes
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+}
+
+// importNodes imports the nodes into version of a new tree with the given options, and returns
+// its database.
+func importNodes(t *testing.T, nodes []*ExportNode, version int64, options ...Option) (*MutableTree, *dbm.MemDB) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+	importer, err := tree.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	return tree, db
+}
+
+func TestImporter_ImportWorkers(t *testing.T) {
+	for name, exported := range map[string]*ImmutableTree{
+		"basic":  setupExportTreeBasic(t),
+		"random": setupExportTreeRandom(t),
+		"sized":  setupExportTreeSized(t, 2*maxBatchSize),
+	} {
+		t.Run(name, func(t *testing.T) {
+			nodes := exportNodes(t, exported)
+			sequential, sequentialDB := importNodes(t, nodes, exported.Version())
+			parallel, parallelDB := importNodes(t, nodes, exported.Version(), ImportWorkersOption(4))
+
+			require.Equal(t, exported.Hash(), parallel.Hash())
+			require.Equal(t, sequential.Hash(), parallel.Hash())
+			// the node keys are assigned as by the sequential import.
+			require.Equal(t, memDBEntries(t, sequentialDB), memDBEntries(t, parallelDB))
+		})
+	}
+}
+
+func TestImporter_ImportWorkers_Invalid(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ImportWorkersOption(4))
+	importer, err := tree.Import(1)
+	require.NoError(t, err)
+	defer importer.Close()
+
+	// the nodes are validated by the pool, so the error is returned by the next call.
+	require.NoError(t, importer.Add(&ExportNode{Key: []byte("a"), Value: []byte{1}, Version: 0}))
+	require.NoError(t, importer.Add(&ExportNode{Key: []byte("b"), Value: []byte{2}, Version: 1}))
+	require.NoError(t, importer.Add(&ExportNode{Key: []byte("b"), Version: 1, Height: 1}))
+	require.Error(t, importer.Commit())
+	require.EqualValues(t, 0, tree.Version())
+}
+
+func TestImporter_ImportWorkers_Close(t *testing.T) {
+	exported := setupExportTreeBasic(t)
+	nodes := exportNodes(t, exported)
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ImportWorkersOption(4))
+	importer, err := tree.Import(exported.Version())
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	importer.Close()
+	importer.Close()
+
+	has, err := tree.Has(nodes[0].Key)
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Equal(t, ErrNoImport, importer.Commit())
+}
+
+// memDBEntries returns the entries of db.
+func memDBEntries(t *testing.T, db *dbm.MemDB) map[string]string {
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	entries := make(map[string]string)
+	for ; itr.Valid(); itr.Next() {
+		entries[string(itr.Key())] = string(itr.Value())
+	}
+	require.NoError(t, itr.Error())
+	return entries
+}
+
+func BenchmarkImportParallel(b *testing.B) {
+	exported := setupExportTreeSized(b, maxBatchSize*10)
+	nodes := exportNodes(b, exported)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ImportWorkersOption(4))
+		importer, err := tree.Import(exported.Version())
+		require.NoError(b, err)
+		for _, node := range nodes {
+			require.NoError(b, importer.Add(node))
+		}
+		require.NoError(b, importer.Commit())
+	}
+}
@@ -0,0 +1,240 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// IntegrityError is returned by VerifyIntegrity for the bad node of a version.
+type IntegrityError struct {
+	// NodeKey is the node key of the node which can't be read or decoded, or whose stored hash
+	// doesn't match the hash recomputed from its children.
+	NodeKey []byte
+	Err     error
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("node %X: %v", e.NodeKey, e.Err)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// integritySplitFactor is the number of subtrees per worker VerifyIntegrity splits a version
+// into, so that the workers still have subtrees to verify when the others are smaller.
+const integritySplitFactor = 4
+
+// VerifyIntegrity recomputes the hashes of the nodes of the given version bottom-up, from the
+// nodes stored in the database rather than the cached ones, and returns an *IntegrityError for
+// the first node whose stored hash, size or height doesn't match its children, or which can't be
+// read, e.g. a dangling child reference. See CheckIntegrity to report all of them. The hash of a leaf is
+// computed from its contents, so a corrupted leaf is reported as its parent. The legacy nodes
+// are keyed by their hash, so their hashes are trusted.
+//
+// The subtrees of the version are verified by the given number of workers concurrently. The
+// check is read-only, and the reported node doesn't depend on the number of workers: it is the
+// first bad node in post-order, i.e. the one a single worker reports.
+func (tree *MutableTree) VerifyIntegrity(version int64, workers int) error {
+	if workers <= 0 {
+		return fmt.Errorf("worker count must be positive, got %d: %w", workers, ErrInvalidInputs)
+	}
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootKey == nil {
+		return nil
+	}
+
+	v := &integrityVerifier{ndb: tree.ndb}
+	if workers > 1 {
+		// the subtrees at splitDepth are verified by the workers, the nodes above them wait.
+		v.splitDepth = bits.Len(uint(workers * integritySplitFactor))
+		v.sem = make(chan struct{}, workers)
+	}
+	_, _, _, err = v.verify(rootKey, 0)
+	return err
+}
+
+// integrityVerifier verifies the subtrees of a version for VerifyIntegrity.
+type integrityVerifier struct {
+	ndb        *nodeDB
+	splitDepth int
+	sem        chan struct{}
+}
+
+// verify returns the hash, size and height of the node with the given node key at the given depth,
+// recomputed from its descendants, or the error for the first bad node of the subtree in
+// post-order.
+func (v *integrityVerifier) verify(nk []byte, depth int) ([]byte, int64, int8, error) {
+	if v.sem != nil && depth == v.splitDepth {
+		v.sem <- struct{}{}
+		defer func() { <-v.sem }()
+	}
+
+	node, err := v.ndb.readNode(nk)
+	if err != nil {
+		return nil, 0, 0, &IntegrityError{NodeKey: bytes.Clone(nk), Err: err}
+	}
+	if node.isLegacy || node.isLeaf() {
+		return node.hash, node.size, node.subtreeHeight, nil
+	}
+
+	var left, right []byte
+	var leftSize, rightSize int64
+	var leftHeight, rightHeight int8
+	var leftErr, rightErr error
+	if depth < v.splitDepth {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			left, leftSize, leftHeight, leftErr = v.verify(node.leftNodeKey, depth+1)
+		}()
+		right, rightSize, rightHeight, rightErr = v.verify(node.rightNodeKey, depth+1)
+		wg.Wait()
+	} else if left, leftSize, leftHeight, leftErr = v.verify(node.leftNodeKey, depth+1); leftErr == nil {
+		right, rightSize, rightHeight, rightErr = v.verify(node.rightNodeKey, depth+1)
+	}
+	// the error of the left subtree comes first in post-order.
+	if leftErr != nil {
+		return nil, 0, 0, leftErr
+	}
+	if rightErr != nil {
+		return nil, 0, 0, rightErr
+	}
+
+	if err := checkInnerNode(v.ndb.hashScheme(), node, left, right, leftSize+rightSize, maxInt8(leftHeight, rightHeight)+1); err != nil {
+		return nil, 0, 0, &IntegrityError{NodeKey: bytes.Clone(nk), Err: err}
+	}
+	return node.hash, node.size, node.subtreeHeight, nil
+}
+
+// checkInnerNode returns an error if the size, height or hash of an inner node doesn't match
+// the given ones of its children, hashed with scheme.
+func checkInnerNode(scheme HashScheme, node *Node, left, right []byte, size int64, height int8) error {
+	if node.size != size {
+		return fmt.Errorf("size %d doesn't match the size %d of the children", node.size, size)
+	}
+	if node.subtreeHeight != height {
+		return fmt.Errorf("height %d doesn't match the height %d of the children", node.subtreeHeight, height)
+	}
+	hash, err := ProofInnerNode{
+		Height:  node.subtreeHeight,
+		Size:    node.size,
+		Version: node.nodeKey.version,
+		Left:    left,
+	}.hashWith(scheme, right)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, node.hash) {
+		return fmt.Errorf("hash %X doesn't match the hash %X of the children", node.hash, hash)
+	}
+	return nil
+}
+
+// IntegrityReport is the report of CheckIntegrity.
+type IntegrityReport struct {
+	// Nodes is the number of nodes checked.
+	Nodes int
+	// Corrupted are the errors of the bad nodes, in post-order: the nodes which can't be read or
+	// decoded, e.g. the dangling child references, and the inner nodes whose stored size, height
+	// or hash doesn't match the ones re-derived from their descendants.
+	Corrupted []*IntegrityError
+	// Repaired is the number of nodes rewritten by the repair, which includes the ancestors of
+	// the repaired nodes, whose hashes change along.
+	Repaired int
+}
+
+// CheckIntegrity walks the given version as VerifyIntegrity does, single-threaded, but reports
+// every bad node instead of stopping at the first one, e.g. to diagnose a "node not found"
+// error. The size, height and hash of an inner node are checked against the ones re-derived from
+// its descendants, so that the ancestors of a bad node aren't reported along. An inner node with
+// a child which can't be read is left unchecked, and its stored values are trusted above it.
+//
+// If repair is true, the inner nodes whose size, height or hash is wrong are rewritten with the
+// ones re-derived from their children, as RecomputeVersionHash does, which changes the root hash
+// of the version if the stored one was wrong. The nodes which can't be read can't be re-derived,
+// so the version can't be repaired if any is reported, and nothing is written then. The tree is
+// reloaded, discarding its unsaved changes, if its latest version is repaired.
+func (tree *MutableTree) CheckIntegrity(version int64, repair bool) (*IntegrityReport, error) {
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	report := &IntegrityReport{}
+	if rootKey == nil {
+		return report, nil
+	}
+
+	c := &integrityChecker{ndb: tree.ndb, report: report}
+	c.check(rootKey)
+	if !repair || len(report.Corrupted) == 0 {
+		return report, nil
+	}
+	if c.unreadable > 0 {
+		return report, fmt.Errorf("version %d has %d unreadable nodes, which can't be repaired", version, c.unreadable)
+	}
+
+	// the ancestors of the repaired nodes are rewritten with their new hash.
+	if _, _, _, err := tree.ndb.recomputeHash(rootKey, &report.Repaired); err != nil {
+		return report, err
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return report, err
+	}
+	tree.logger.Info("repaired corrupted nodes", "version", version, "corrupted", len(report.Corrupted), "nodes", report.Repaired)
+	tree.immutableCache.reset()
+	if version == tree.version {
+		if _, err := tree.LoadVersion(version); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// integrityChecker walks a version for CheckIntegrity.
+type integrityChecker struct {
+	ndb        *nodeDB
+	report     *IntegrityReport
+	unreadable int // number of the reported nodes which can't be read
+}
+
+// check checks the subtree of the node with the given node key, and returns its hash, size and
+// height re-derived from its descendants, ok being false if the node can't be read.
+func (c *integrityChecker) check(nk []byte) (hash []byte, size int64, height int8, ok bool) {
+	c.report.Nodes++
+	node, err := c.ndb.readNode(nk)
+	if err != nil {
+		c.report.Corrupted = append(c.report.Corrupted, &IntegrityError{NodeKey: bytes.Clone(nk), Err: err})
+		c.unreadable++
+		return nil, 0, 0, false
+	}
+	if node.isLegacy || node.isLeaf() {
+		return node.hash, node.size, node.subtreeHeight, true
+	}
+	left, leftSize, leftHeight, leftOk := c.check(node.leftNodeKey)
+	right, rightSize, rightHeight, rightOk := c.check(node.rightNodeKey)
+	if !leftOk || !rightOk {
+		return node.hash, node.size, node.subtreeHeight, true
+	}
+	size, height = leftSize+rightSize, maxInt8(leftHeight, rightHeight)+1
+	hash, err = ProofInnerNode{
+		Height:  height,
+		Size:    size,
+		Version: node.nodeKey.version,
+		Left:    left,
+	}.hashWith(c.ndb.hashScheme(), right)
+	if err != nil {
+		c.report.Corrupted = append(c.report.Corrupted, &IntegrityError{NodeKey: bytes.Clone(nk), Err: err})
+		return node.hash, node.size, node.subtreeHeight, true
+	}
+	if err := checkInnerNode(c.ndb.hashScheme(), node, left, right, size, height); err != nil {
+		c.report.Corrupted = append(c.report.Corrupted, &IntegrityError{NodeKey: bytes.Clone(nk), Err: err})
+	}
+	return hash, size, height, true
+}
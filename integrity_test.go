@@ -0,0 +1,161 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// setupIntegrityTree returns a tree of n keys saved in a version.
+func setupIntegrityTree(t testing.TB, db dbm.DB, n int) *MutableTree {
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	for i := 0; i < n; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	return tree
+}
+
+// innerNodeKeys returns the node keys of the inner nodes of the subtree in post-order.
+func innerNodeKeys(t *testing.T, ndb *nodeDB, nk []byte) [][]byte {
+	node, err := ndb.readNode(nk)
+	require.NoError(t, err)
+	if node.isLeaf() {
+		return nil
+	}
+	keys := innerNodeKeys(t, ndb, node.leftNodeKey)
+	keys = append(keys, innerNodeKeys(t, ndb, node.rightNodeKey)...)
+	return append(keys, nk)
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := setupIntegrityTree(t, db, 1000)
+	workerCounts := []int{1, 2, 8}
+	for _, workers := range workerCounts {
+		require.NoError(t, tree.VerifyIntegrity(1, workers))
+	}
+	require.ErrorIs(t, tree.VerifyIntegrity(1, 0), ErrInvalidInputs)
+	require.ErrorIs(t, tree.VerifyIntegrity(2, 1), ErrVersionDoesNotExist)
+
+	rootKey, err := tree.ndb.GetRoot(1)
+	require.NoError(t, err)
+	keys := innerNodeKeys(t, tree.ndb, rootKey)
+	corrupt := func(nk []byte) {
+		node, err := tree.ndb.readNode(nk)
+		require.NoError(t, err)
+		node.hash = bytes.Repeat([]byte{0xab}, hashSize)
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		require.NoError(t, db.Set(tree.ndb.nodeKey(nk), buf.Bytes()))
+	}
+
+	// the first of the corrupted nodes in post-order is reported, whatever the number of workers.
+	first, second := keys[len(keys)/3], keys[2*len(keys)/3]
+	corrupt(second)
+	corrupt(first)
+	for _, workers := range workerCounts {
+		err := tree.VerifyIntegrity(1, workers)
+		var integrityErr *IntegrityError
+		require.ErrorAs(t, err, &integrityErr, "workers %d", workers)
+		require.Equal(t, first, integrityErr.NodeKey, "workers %d", workers)
+	}
+
+	// a missing node is reported too.
+	require.NoError(t, db.Delete(tree.ndb.nodeKey(second)))
+	require.NoError(t, db.Delete(tree.ndb.nodeKey(first)))
+	for _, workers := range workerCounts {
+		err := tree.VerifyIntegrity(1, workers)
+		var integrityErr *IntegrityError
+		require.ErrorAs(t, err, &integrityErr, "workers %d", workers)
+		require.Equal(t, first, integrityErr.NodeKey, "workers %d", workers)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := setupIntegrityTree(t, db, 1000)
+	hash := tree.Hash()
+	report, err := tree.CheckIntegrity(1, true)
+	require.NoError(t, err)
+	require.Equal(t, &IntegrityReport{Nodes: 1999}, report)
+	_, err = tree.CheckIntegrity(2, false)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	rootKey, err := tree.ndb.GetRoot(1)
+	require.NoError(t, err)
+	keys := innerNodeKeys(t, tree.ndb, rootKey)
+	corrupt := func(nk []byte, fn func(node *Node)) {
+		node, err := tree.ndb.readNode(nk)
+		require.NoError(t, err)
+		fn(node)
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		require.NoError(t, db.Set(tree.ndb.nodeKey(nk), buf.Bytes()))
+	}
+
+	// every bad node is reported, in post-order, but not their ancestors.
+	first, second, third := keys[len(keys)/4], keys[len(keys)/2], keys[3*len(keys)/4]
+	corrupt(first, func(node *Node) { node.size++ })
+	corrupt(second, func(node *Node) { node.subtreeHeight++ })
+	corrupt(third, func(node *Node) { node.hash = bytes.Repeat([]byte{0xab}, hashSize) })
+	report, err = tree.CheckIntegrity(1, false)
+	require.NoError(t, err)
+	require.Equal(t, 1999, report.Nodes)
+	require.Len(t, report.Corrupted, 3)
+	for i, nk := range [][]byte{first, second, third} {
+		require.Equal(t, nk, report.Corrupted[i].NodeKey)
+	}
+	require.ErrorContains(t, report.Corrupted[0], "size")
+	require.ErrorContains(t, report.Corrupted[1], "height")
+	require.ErrorContains(t, report.Corrupted[2], "hash")
+	require.Zero(t, report.Repaired)
+	var integrityErr *IntegrityError
+	require.ErrorAs(t, tree.VerifyIntegrity(1, 1), &integrityErr)
+	require.Equal(t, first, integrityErr.NodeKey)
+
+	// the nodes are re-derived from their children, which restores the original hashes.
+	report, err = tree.CheckIntegrity(1, true)
+	require.NoError(t, err)
+	require.Len(t, report.Corrupted, 3)
+	require.Equal(t, 3, report.Repaired)
+	report, err = tree.CheckIntegrity(1, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Corrupted)
+	require.NoError(t, tree.VerifyIntegrity(1, 1))
+	require.Equal(t, hash, tree.Hash())
+
+	// a dangling reference is reported, and can't be repaired.
+	corrupt(second, func(node *Node) { node.size++ })
+	node, err := tree.ndb.readNode(first)
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(tree.ndb.nodeKey(node.leftNodeKey)))
+	report, err = tree.CheckIntegrity(1, true)
+	require.Error(t, err)
+	require.Len(t, report.Corrupted, 2)
+	require.Equal(t, node.leftNodeKey, report.Corrupted[0].NodeKey)
+	require.Equal(t, second, report.Corrupted[1].NodeKey)
+	require.Zero(t, report.Repaired)
+	// nothing was written.
+	report, err = tree.CheckIntegrity(1, false)
+	require.NoError(t, err)
+	require.Len(t, report.Corrupted, 2)
+}
+
+func BenchmarkVerifyIntegrity(b *testing.B) {
+	tree := setupIntegrityTree(b, dbm.NewMemDB(), 100000)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, tree.VerifyIntegrity(1, workers))
+			}
+		})
+	}
+}
@@ -102,9 +102,9 @@ func (t *traversal) next() (*Node, error) {
 		return node, nil
 	}
 
-	afterStart := t.start == nil || bytes.Compare(t.start, node.key) < 0
+	afterStart := t.start == nil || t.tree.ndb.compare(t.start, node.key) < 0
 	startOrAfter := afterStart || bytes.Equal(t.start, node.key)
-	beforeEnd := t.end == nil || bytes.Compare(node.key, t.end) < 0
+	beforeEnd := t.end == nil || t.tree.ndb.compare(node.key, t.end) < 0
 	if t.inclusive {
 		beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
 	}
@@ -168,17 +168,43 @@ func (t *traversal) next() (*Node, error) {
 	return t.next()
 }
 
+// Seeker is implemented by the iterators of the trees, which can be moved to a key within their
+// domain without being recreated, e.g. to skip-scan a secondary index. Seek moves the iterator to
+// the first key at or after key in ascending order, or at or before key in descending order, as
+// if the iterator had been created with key as its start, or as its inclusive end. A key out of
+// the domain is bound to it: a key before the domain, in the iteration order, moves the iterator
+// to the first key of the domain, and a key after it makes the iterator invalid. A nil or empty
+// key moves it back to the first key of the domain. Seek may move the iterator in either
+// direction, but it does nothing once the iterator is closed.
+type Seeker interface {
+	Seek(key []byte)
+}
+
+var (
+	_ Seeker = (*Iterator)(nil)
+	_ Seeker = (*FastIterator)(nil)
+	_ Seeker = (*UnsavedFastIterator)(nil)
+	_ Seeker = (*FilterIterator)(nil)
+	_ Seeker = (*trackedIterator)(nil)
+)
+
 // Iterator is a dbm.Iterator for ImmutableTree
 type Iterator struct {
 	start, end []byte
 
 	key, value []byte
+	leaf       *Node // leaf of key, whose value is read by Value if stored apart
 
 	valid bool
 
 	err error
 
 	t *traversal
+
+	ndb *nodeDB
+
+	tree      *ImmutableTree // tree traversed again by Seek, nil once closed
+	ascending bool
 }
 
 var _ dbm.Iterator = (*Iterator)(nil)
@@ -186,14 +212,17 @@ var _ dbm.Iterator = (*Iterator)(nil)
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) dbm.Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
+		start:     start,
+		end:       end,
+		tree:      tree,
+		ascending: ascending,
 	}
 
 	if tree == nil {
 		iter.err = errIteratorNilTreeGiven
 	} else {
 		iter.valid = true
+		iter.ndb = tree.ndb
 		iter.t = tree.root.newTraversal(tree, start, end, ascending, false, false)
 		// Move iterator before the first element
 		iter.Next()
@@ -213,12 +242,23 @@ func (iter *Iterator) Valid() bool {
 
 // Key implements dbm.Iterator
 func (iter *Iterator) Key() []byte {
-	return iter.key
+	return iter.ndb.copyBytes(iter.key)
 }
 
-// Value implements dbm.Iterator
+// Value implements dbm.Iterator. The value of a leaf stored apart is read on the first call, and
+// a read error ends the iteration.
 func (iter *Iterator) Value() []byte {
-	return iter.value
+	if iter.leaf != nil && iter.leaf.external {
+		value, err := iter.ndb.leafValue(iter.leaf)
+		if err != nil {
+			iter.t = nil
+			iter.valid = false
+			iter.err = err
+			return nil
+		}
+		iter.value, iter.leaf = value, nil
+	}
+	return iter.ndb.copyBytes(iter.value)
 }
 
 // Next implements dbm.Iterator
@@ -228,24 +268,44 @@ func (iter *Iterator) Next() {
 	}
 
 	node, err := iter.t.next()
-	// TODO: double-check if this error is correctly handled.
 	if node == nil || err != nil {
 		iter.t = nil
 		iter.valid = false
+		iter.err = err
 		return
 	}
 
 	if node.subtreeHeight == 0 {
-		iter.key, iter.value = node.key, node.value
+		iter.key, iter.value, iter.leaf = node.key, node.value, node
 		return
 	}
 
 	iter.Next()
 }
 
+// Seek implements Seeker. The tree is traversed again from its root, down to key.
+func (iter *Iterator) Seek(key []byte) {
+	if iter.tree == nil || iter.err != nil {
+		return
+	}
+	start, end, inclusive := iter.start, iter.end, false
+	if len(key) > 0 {
+		if iter.ascending && (start == nil || iter.ndb.compare(key, start) > 0) {
+			start = key
+		}
+		if !iter.ascending && (end == nil || iter.ndb.compare(key, end) < 0) {
+			end, inclusive = key, true
+		}
+	}
+	iter.t = iter.tree.root.newTraversal(iter.tree, start, end, iter.ascending, inclusive, false)
+	iter.valid = true
+	iter.Next()
+}
+
 // Close implements dbm.Iterator
 func (iter *Iterator) Close() error {
 	iter.t = nil
+	iter.tree = nil
 	iter.valid = false
 	return iter.err
 }
@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"fmt"
 	"math/rand"
 	"sort"
 	"sync"
@@ -381,3 +382,211 @@ func syncMapCount(m *sync.Map) int {
 	})
 	return count
 }
+
+func TestIteratePrefix(t *testing.T) {
+	keys := []string{"a", "ab", "ab\x00", "abc", "ab\xff", "ab\xff\xff", "ac", "b", "\xff", "\xff\xff", "\xff\xff\x01"}
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, log.NewNopLogger())
+		for _, key := range keys {
+			_, err := tree.Set([]byte(key), []byte("value-"+key))
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		for _, prefix := range []string{"", "a", "ab", "ab\xff", "abc", "abd", "b", "c", "\xff", "\xff\xff"} {
+			var expected []string
+			for _, key := range keys {
+				if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+					expected = append(expected, key)
+				}
+			}
+			for _, ascending := range []bool{true, false} {
+				itr, err := itree.IteratePrefix([]byte(prefix), ascending)
+				require.NoError(t, err)
+				var actual []string
+				for ; itr.Valid(); itr.Next() {
+					require.Equal(t, "value-"+string(itr.Key()), string(itr.Value()))
+					actual = append(actual, string(itr.Key()))
+				}
+				require.NoError(t, itr.Close())
+				if !ascending {
+					sort.Strings(actual)
+				}
+				require.Equal(t, expected, actual, "prefix %q, ascending %t", prefix, ascending)
+			}
+		}
+	}
+
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a\xff\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff\xff")))
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), ComparatorOption(numericComparator))
+	_, err := tree.IteratePrefix([]byte("a"), true)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
+
+func TestIteratePaged(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 95; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		start, end []byte
+		limit      int
+		first      int
+		last       int
+	}{
+		{nil, nil, 10, 0, 94},
+		{nil, nil, 95, 0, 94},
+		{nil, nil, 200, 0, 94},
+		{[]byte("key-010"), []byte("key-050"), 7, 10, 49},
+		{[]byte("key-010"), []byte("key-050"), 1, 10, 49},
+		{[]byte("key-0905"), nil, 3, 91, 94},
+	} {
+		var keys []string
+		var cursor []byte
+		pages := 0
+		for {
+			pairs, next, err := itree.IteratePaged(tc.start, tc.end, tc.limit, cursor)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(pairs), tc.limit)
+			for _, pair := range pairs {
+				keys = append(keys, string(pair.Key))
+				require.Equal(t, []byte(fmt.Sprintf("value-%d", len(keys)-1+tc.first)), pair.Value)
+			}
+			pages++
+			if next == nil {
+				break
+			}
+			require.Len(t, pairs, tc.limit)
+			cursor = next
+		}
+		var expected []string
+		for i := tc.first; i <= tc.last; i++ {
+			expected = append(expected, fmt.Sprintf("key-%03d", i))
+		}
+		require.Equal(t, expected, keys)
+		require.Equal(t, (len(expected)+tc.limit-1)/tc.limit, pages)
+	}
+
+	// the cursor resumes on a later version from the same key.
+	pairs, cursor, err := itree.IteratePaged(nil, nil, 5, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("key-004"), pairs[4].Key)
+	_, _, err = tree.Remove([]byte("key-005"))
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	latest, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	pairs, _, err = latest.IteratePaged(nil, nil, 5, cursor)
+	require.NoError(t, err)
+	require.Equal(t, []byte("key-006"), pairs[0].Key)
+
+	// an empty range has a single empty page.
+	pairs, cursor, err = itree.IteratePaged([]byte("z"), nil, 5, nil)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+	require.Nil(t, cursor)
+
+	_, _, err = itree.IteratePaged(nil, nil, 0, nil)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, _, err = itree.IteratePaged(nil, nil, 5, []byte("key-010"))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, cursor, err = itree.IteratePaged(nil, nil, 5, nil)
+	require.NoError(t, err)
+	_, _, err = itree.IteratePaged([]byte("key-050"), nil, 5, cursor)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
+
+func TestIterator_Seek(t *testing.T) {
+	key := func(i int) string { return fmt.Sprintf("k%02d", i) }
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), TrackIteratorLeaksOption(true))
+	var saved, working []string
+	for i := 0; i < 40; i += 2 {
+		_, err := tree.Set([]byte(key(i)), []byte{byte(i)})
+		require.NoError(t, err)
+		saved = append(saved, key(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// the working tree has unsaved additions and removals.
+	for _, i := range []int{5, 11, 13} {
+		_, err := tree.Set([]byte(key(i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte(key(8)))
+	require.NoError(t, err)
+	for _, k := range saved {
+		if k != key(8) {
+			working = append(working, k)
+		}
+	}
+	working = append(working, key(5), key(11), key(13))
+	sort.Strings(working)
+
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	start, end := []byte(key(4)), []byte(key(30))
+	// expected returns the first keys in [start, end) at or after seek in the iteration order.
+	expected := func(keys []string, start, end []byte, ascending bool, seek string) []string {
+		var expected []string
+		for _, k := range keys {
+			if (start != nil && k < string(start)) || (end != nil && k >= string(end)) {
+				continue
+			}
+			if seek == "" || (ascending && k >= seek) || (!ascending && k <= seek) {
+				expected = append(expected, k)
+			}
+		}
+		if !ascending {
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+		if len(expected) > 3 {
+			expected = expected[:3]
+		}
+		return expected
+	}
+	for _, ascending := range []bool{true, false} {
+		fastItr, err := itree.Iterator(start, end, ascending)
+		require.NoError(t, err)
+		unsavedItr, err := tree.Iterator(start, end, ascending)
+		require.NoError(t, err)
+		closedItr := NewIterator(start, end, ascending, itree)
+		require.NoError(t, closedItr.Close())
+		for name, tc := range map[string]struct {
+			itr        dbm.Iterator
+			keys       []string
+			start, end []byte
+		}{
+			"tree":      {NewIterator(start, end, ascending, itree), saved, start, end},
+			"fast":      {fastItr, saved, start, end},
+			"unsaved":   {unsavedItr, working, start, end},
+			"no domain": {NewIterator(nil, nil, ascending, itree), saved, nil, nil},
+			"closed":    {closedItr, nil, start, end},
+		} {
+			for _, seek := range []string{key(13), key(7), key(99), "", key(10), "a", key(29), key(4)} {
+				tc.itr.(Seeker).Seek([]byte(seek))
+				var keys []string
+				for ; tc.itr.Valid() && len(keys) < 3; tc.itr.Next() {
+					keys = append(keys, string(tc.itr.Key()))
+				}
+				require.Equal(t, expected(tc.keys, tc.start, tc.end, ascending, seek), keys, "%s ascending=%v seek=%s", name, ascending, seek)
+			}
+			require.NoError(t, tc.itr.Error())
+			require.NoError(t, tc.itr.Close())
+		}
+	}
+}
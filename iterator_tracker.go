@@ -0,0 +1,184 @@
+package iavl
+
+import (
+	"errors"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// ErrIteratorIdle is returned by the Error method of an iterator closed because it wasn't used
+// for the IteratorIdleTimeout.
+var ErrIteratorIdle = errors.New("iterator closed after being idle")
+
+// trackedIterator is an iterator of the tree diagnosing the iterators which aren't closed, see
+// the TrackIteratorLeaks and IteratorIdleTimeout options. The finalizer is set on the
+// trackedIterator, whose state is shared with the idle timer, so that the timer doesn't keep a
+// leaked iterator reachable.
+type trackedIterator struct {
+	*trackedIteratorState
+}
+
+type trackedIteratorState struct {
+	mtx      sync.Mutex
+	inner    dbm.Iterator
+	closed   bool
+	err      error
+	timeout  time.Duration
+	lastUsed time.Time
+	timer    *time.Timer
+}
+
+var _ dbm.Iterator = (*trackedIterator)(nil)
+
+// trackIterator returns itr tracked as the options of the tree tell, or itr itself if they
+// don't track the iterators.
+func (ndb *nodeDB) trackIterator(itr dbm.Iterator) dbm.Iterator {
+	if !ndb.opts.TrackIteratorLeaks && ndb.opts.IteratorIdleTimeout <= 0 {
+		return itr
+	}
+	tracked := &trackedIterator{&trackedIteratorState{inner: itr}}
+	if ndb.opts.TrackIteratorLeaks {
+		logger, stack := ndb.logger, string(debug.Stack())
+		runtime.SetFinalizer(tracked, func(tracked *trackedIterator) {
+			if tracked.closeLeaked() {
+				logger.Warn("iterator garbage-collected without being closed", "stack", stack)
+			}
+		})
+	}
+	if timeout := ndb.opts.IteratorIdleTimeout; timeout > 0 {
+		state := tracked.trackedIteratorState
+		state.timeout, state.lastUsed = timeout, time.Now()
+		state.timer = time.AfterFunc(timeout, state.expire)
+	}
+	return tracked
+}
+
+// use returns the inner iterator, if it isn't closed, and marks it as used.
+func (s *trackedIteratorState) use() dbm.Iterator {
+	if s.closed {
+		return nil
+	}
+	if s.timer != nil {
+		s.lastUsed = time.Now()
+	}
+	return s.inner
+}
+
+// expire closes the iterator if it wasn't used for the timeout, and waits for the rest of the
+// timeout otherwise.
+func (s *trackedIteratorState) expire() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return
+	}
+	if idle := time.Since(s.lastUsed); idle < s.timeout {
+		s.timer.Reset(s.timeout - idle)
+		return
+	}
+	s.closed, s.err = true, ErrIteratorIdle
+	s.inner.Close()
+}
+
+// closeLeaked closes the iterator of a leaked trackedIterator, and returns whether it wasn't
+// closed by the caller.
+func (s *trackedIteratorState) closeLeaked() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed && !errors.Is(s.err, ErrIteratorIdle) {
+		return false
+	}
+	if !s.closed {
+		s.closed = true
+		s.stop()
+		s.inner.Close()
+	}
+	return true
+}
+
+// stop stops the idle timer, if any.
+func (s *trackedIteratorState) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// Domain implements dbm.Iterator.
+func (s *trackedIteratorState) Domain() ([]byte, []byte) {
+	return s.inner.Domain()
+}
+
+// Valid implements dbm.Iterator. A closed iterator is invalid.
+func (s *trackedIteratorState) Valid() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	itr := s.use()
+	return itr != nil && itr.Valid()
+}
+
+// Next implements dbm.Iterator.
+func (s *trackedIteratorState) Next() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if itr := s.use(); itr != nil {
+		itr.Next()
+	}
+}
+
+// Seek implements Seeker, the iterators of the tree being Seekers.
+func (s *trackedIteratorState) Seek(key []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if seeker, ok := s.use().(Seeker); ok {
+		seeker.Seek(key)
+	}
+}
+
+// Key implements dbm.Iterator.
+func (s *trackedIteratorState) Key() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if itr := s.use(); itr != nil {
+		return itr.Key()
+	}
+	return nil
+}
+
+// Value implements dbm.Iterator.
+func (s *trackedIteratorState) Value() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if itr := s.use(); itr != nil {
+		return itr.Value()
+	}
+	return nil
+}
+
+// Error implements dbm.Iterator. It returns ErrIteratorIdle if the iterator was closed for
+// being idle.
+func (s *trackedIteratorState) Error() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return s.err
+	}
+	return s.inner.Error()
+}
+
+// Close implements dbm.Iterator.
+func (s *trackedIteratorState) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		// the caller closed it as well, so it didn't leak.
+		s.err = nil
+		return nil
+	}
+	s.closed = true
+	s.stop()
+	return s.inner.Close()
+}
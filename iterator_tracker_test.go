@@ -0,0 +1,91 @@
+package iavl
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+const leakedIteratorMsg = "iterator garbage-collected without being closed"
+
+func newTrackedTree(t *testing.T, logger Logger, options ...Option) *MutableTree {
+	t.Helper()
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, logger, options...)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	return tree
+}
+
+// leakIterator creates an iterator of the tree and drops it without closing it.
+func leakIterator(t *testing.T, tree *MutableTree) {
+	t.Helper()
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.True(t, itr.Valid())
+}
+
+func TestTrackIteratorLeaks(t *testing.T) {
+	logger := &recordingLogger{}
+	tree := newTrackedTree(t, logger, TrackIteratorLeaksOption(true))
+
+	// the closed iterators didn't leak.
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	runtime.GC()
+
+	leakIterator(t, tree)
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return len(logger.find(leakedIteratorMsg)) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	events := logger.find(leakedIteratorMsg)
+	require.Len(t, events, 1)
+	require.Contains(t, events[0]["stack"], "leakIterator")
+
+	// the leaked iterator was closed, so the DB isn't locked by it.
+	_, err = tree.Set([]byte("key-0"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+}
+
+func TestIteratorIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tree := newTrackedTree(t, &recordingLogger{}, IteratorIdleTimeoutOption(timeout))
+
+	// an iterator in use isn't closed.
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	for deadline := time.Now().Add(3 * timeout); time.Now().Before(deadline); time.Sleep(timeout / 10) {
+		require.True(t, itr.Valid())
+		require.NoError(t, itr.Error())
+	}
+	require.NoError(t, itr.Close())
+
+	idle, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.True(t, idle.Valid())
+	require.Eventually(t, func() bool {
+		return idle.Error() != nil
+	}, 5*time.Second, timeout/10)
+	require.ErrorIs(t, idle.Error(), ErrIteratorIdle)
+	require.False(t, idle.Valid())
+	require.Nil(t, idle.Key())
+	require.NoError(t, idle.Close())
+
+	// the idle iterator was closed, so the DB isn't locked by it.
+	_, err = tree.Set([]byte("key-0"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+}
@@ -0,0 +1,66 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// The key counts of the versions recorded with the StoreKeyCounts option.
+var keyCountKeyFormat = keyformat.NewFastPrefixFormatter('k', int64Size) // k<version>
+
+// KeyCount returns the number of keys of the given version, as the Size of its tree. It is read
+// from the count recorded by SaveVersion with the StoreKeyCounts option, and the root of the
+// version is loaded otherwise, e.g. for the versions saved before the option was set.
+func (tree *MutableTree) KeyCount(version int64) (int64, error) {
+	if !tree.VersionExists(version) {
+		return 0, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+	}
+	count, ok, err := tree.ndb.getKeyCount(version)
+	if err != nil || ok {
+		return count, err
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return 0, err
+	}
+	return itree.Size(), nil
+}
+
+// saveKeyCount records the key count of a version.
+func (ndb *nodeDB) saveKeyCount(version, count int64) error {
+	return ndb.batch.Set(keyCountKeyFormat.KeyInt64(version), binary.AppendUvarint(nil, uint64(count)))
+}
+
+// getKeyCount returns the key count recorded for a version, if any.
+func (ndb *nodeDB) getKeyCount(version int64) (int64, bool, error) {
+	value, err := ndb.db.Get(keyCountKeyFormat.KeyInt64(version))
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	count, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, false, fmt.Errorf("invalid key count %X of version %d", value, version)
+	}
+	return int64(count), true, nil
+}
+
+// deleteKeyCounts deletes the key counts recorded for the versions from fromVersion to
+// toVersion, inclusive.
+func (ndb *nodeDB) deleteKeyCounts(fromVersion, toVersion int64) error {
+	var keys [][]byte
+	if err := ndb.traverseRange(keyCountKeyFormat.KeyInt64(fromVersion), keyCountKeyFormat.KeyInt64(toVersion+1), func(k, _ []byte) error {
+		keys = append(keys, bytes.Clone(k))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestKeyCount(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err := tree.Set([]byte("key-00"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree = NewMutableTree(db, 0, false, log.NewNopLogger(), StoreKeyCountsOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", v*7+i)), []byte("value"))
+			require.NoError(t, err)
+		}
+		for i := 0; i < v; i++ {
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", i*3)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// a version without changes, and an empty version.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	var keys [][]byte
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, key)
+		return false
+	})
+	require.NoError(t, err)
+	for _, key := range keys {
+		_, _, err := tree.Remove(key)
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	requireCounts := func(tree *MutableTree) {
+		t.Helper()
+		for _, version := range tree.AvailableVersions() {
+			itree, err := tree.GetImmutable(int64(version))
+			require.NoError(t, err)
+			count, err := tree.KeyCount(int64(version))
+			require.NoError(t, err)
+			require.Equal(t, itree.Size(), count, "version %d", version)
+			// only the first version, saved without the option, has no recorded count.
+			_, ok, err := tree.ndb.getKeyCount(int64(version))
+			require.NoError(t, err)
+			require.Equal(t, version != 1, ok, "version %d", version)
+		}
+	}
+	requireCounts(tree)
+	count, err := tree.KeyCount(tree.Version())
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// the counts survive a reload.
+	reloaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	requireCounts(reloaded)
+
+	// the counts of the deleted versions are deleted along.
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.NoError(t, tree.ndb.DeleteVersionsFrom(6))
+	require.NoError(t, tree.ndb.Commit())
+	for version := int64(1); version <= 7; version++ {
+		_, ok, err := tree.ndb.getKeyCount(version)
+		require.NoError(t, err)
+		require.Equal(t, version > 3 && version < 6, ok, "version %d", version)
+	}
+	_, err = tree.KeyCount(1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.KeyCount(6)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
@@ -0,0 +1,60 @@
+package iavl
+
+import (
+	"bytes"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// keyInterner shares a single copy of equal keys between the nodes read from the DB, see the
+// InternKeys option. It isn't safe for concurrent use, and is guarded by the nodeDB lock.
+type keyInterner struct {
+	keys map[string][]byte
+	size int
+}
+
+// newKeyInterner returns a keyInterner of at most size keys, or nil if size isn't positive,
+// which interns nothing.
+func newKeyInterner(size int) *keyInterner {
+	if size <= 0 {
+		return nil
+	}
+	return &keyInterner{keys: make(map[string][]byte), size: size}
+}
+
+// intern returns the interned copy of key, which is copied if there is none yet. The interned
+// keys are never modified, so the map keys point to their bytes.
+func (i *keyInterner) intern(key []byte) []byte {
+	if i == nil || key == nil {
+		return key
+	}
+	if interned, ok := i.keys[ibytes.UnsafeBytesToStr(key)]; ok {
+		return interned
+	}
+	if len(i.keys) >= i.size {
+		clear(i.keys)
+	}
+	key = bytes.Clone(key)
+	i.keys[ibytes.UnsafeBytesToStr(key)] = key
+	return key
+}
+
+// internNode makes a node read from the DB use the interned copy of its key. The fields decoded
+// from the encoding of the node point into it, so the other ones are copied out as well, which
+// lets the encoding and its copy of the key be released.
+func (i *keyInterner) internNode(node *Node) {
+	if i == nil {
+		return
+	}
+	node.key = i.intern(node.key)
+	if node.isLeaf() {
+		node.value = bytes.Clone(node.value)
+	} else {
+		node.hash = bytes.Clone(node.hash)
+	}
+	if node.isLegacy {
+		node.hash = bytes.Clone(node.hash)
+		node.leftNodeKey = bytes.Clone(node.leftNodeKey)
+		node.rightNodeKey = bytes.Clone(node.rightNodeKey)
+	}
+}
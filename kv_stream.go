@@ -0,0 +1,82 @@
+package iavl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// StreamKV writes the keys and values of the tree to w in ascending key order, each pair as the
+// uvarint length of the key, the key, the uvarint length of the value and the value. The pairs
+// are written one at a time, as w accepts them, so a slow writer blocks the stream rather than
+// the pairs accumulating in memory. The leaves are read from the nodes rather than the fast
+// storage, so that no database iterator is held open while w blocks. It stops with the context
+// error once ctx is done, checked before each pair, and deleting the version is refused until it
+// returns.
+func (t *ImmutableTree) StreamKV(ctx context.Context, w io.Writer) error {
+	if t.ndb == nil {
+		return fmt.Errorf("tree.ndb is nil: %w", ErrNotInitalizedTree)
+	}
+	if t.root == nil {
+		return ctx.Err()
+	}
+	t.ndb.incrVersionReaders(t.version)
+	defer t.ndb.decrVersionReaders(t.version)
+
+	itr := NewIterator(nil, nil, true, t)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeKV(w, itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+	return itr.Error()
+}
+
+// DumpWorkingState writes the current state of the tree to w, i.e. the last saved version with
+// the unsaved changes applied, so that the states of two nodes can be compared byte for byte
+// before they save it. It writes the uvarint length of the WorkingHash and the hash, followed by
+// the keys and values in ascending key order, in the format of StreamKV.
+func (tree *MutableTree) DumpWorkingState(w io.Writer) error {
+	if err := writeDelimited(w, tree.WorkingHash()); err != nil {
+		return fmt.Errorf("writing the working hash: %w", err)
+	}
+	var err error
+	_, iterErr := tree.IterateWorking(func(key, value []byte) bool {
+		err = writeKV(w, key, value)
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// writeKV writes a key and its value to w, each as its uvarint length followed by its bytes.
+func writeKV(w io.Writer, key, value []byte) error {
+	if err := writeDelimited(w, key); err != nil {
+		return fmt.Errorf("writing key %X: %w", key, err)
+	}
+	if err := writeDelimited(w, value); err != nil {
+		return fmt.Errorf("writing the value of key %X: %w", key, err)
+	}
+	return nil
+}
+
+// writeDelimited writes the uvarint length of bz to w, followed by bz.
+func writeDelimited(w io.Writer, bz []byte) error {
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(bz)))
+	if _, err := w.Write(header[:n]); err != nil {
+		return err
+	}
+	if len(bz) == 0 {
+		return nil
+	}
+	_, err := w.Write(bz)
+	return err
+}
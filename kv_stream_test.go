@@ -0,0 +1,203 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// readKVStream returns the pairs written by StreamKV to r, until it is closed.
+func readKVStream(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	br := bufio.NewReader(r)
+	readBytes := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		bz := make([]byte, size)
+		_, err = io.ReadFull(br, bz)
+		return bz, err
+	}
+	var pairs []string
+	for {
+		key, err := readBytes()
+		if err == io.EOF {
+			return pairs
+		}
+		require.NoError(t, err)
+		value, err := readBytes()
+		require.NoError(t, err)
+		pairs = append(pairs, string(key)+"="+string(value))
+	}
+}
+
+// gatedWriter is a writer whose writes block until they are allowed, counting them.
+type gatedWriter struct {
+	allow  chan struct{}
+	writes atomic.Int64
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.allow
+	w.writes.Add(1)
+	return len(p), nil
+}
+
+func setupStreamTree(t *testing.T) *MutableTree {
+	t.Helper()
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for version := 0; version < 2; version++ {
+		for i := 0; i < 1000; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", (version*300+i)%1200)), bytes.Repeat([]byte{byte(version + i)}, 100))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return tree
+}
+
+func TestStreamKV(t *testing.T) {
+	tree := setupStreamTree(t)
+	for _, version := range []int64{1, 2} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		var expected []string
+		_, err = itree.Iterate(func(key, value []byte) bool {
+			expected = append(expected, string(key)+"="+string(value))
+			return false
+		})
+		require.NoError(t, err)
+
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(itree.StreamKV(context.Background(), w))
+		}()
+		require.Equal(t, expected, readKVStream(t, r))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, (&ImmutableTree{ndb: tree.ndb}).StreamKV(context.Background(), &buf))
+	require.Zero(t, buf.Len())
+}
+
+func TestStreamKV_Backpressure(t *testing.T) {
+	tree := setupStreamTree(t)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	w := &gatedWriter{allow: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- itree.StreamKV(context.Background(), w)
+	}()
+
+	// the stream only progresses as the writer accepts the writes.
+	for i := 0; i < 10; i++ {
+		w.allow <- struct{}{}
+	}
+	require.Eventually(t, func() bool { return w.writes.Load() == 10 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.EqualValues(t, 10, w.writes.Load())
+	// the version is pinned while it is streamed.
+	require.Error(t, tree.DeleteVersionsTo(1))
+
+	close(w.allow)
+	require.NoError(t, <-done)
+	require.EqualValues(t, 4*itree.Size(), w.writes.Load())
+	require.NoError(t, tree.DeleteVersionsTo(1))
+}
+
+func TestStreamKV_Cancel(t *testing.T) {
+	tree := setupStreamTree(t)
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := itree.StreamKV(ctx, w)
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	// the stream stops at the next pair once cancelled.
+	br := bufio.NewReader(r)
+	for i := 0; i < 20; i++ {
+		size, err := binary.ReadUvarint(br)
+		require.NoError(t, err)
+		_, err = br.Discard(int(size))
+		require.NoError(t, err)
+	}
+	cancel()
+	_, err = io.Copy(io.Discard, br)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestDumpWorkingState(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for _, key := range []string{"b", "d", "a", "c"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// the unsaved changes are overlaid on the saved version.
+	_, err = tree.Set([]byte("c"), []byte("updated"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("e"), []byte("value-e"))
+	require.NoError(t, err)
+	_, removed, err := tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, removed)
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.DumpWorkingState(&buf))
+	r := bufio.NewReader(&buf)
+	size, err := binary.ReadUvarint(r)
+	require.NoError(t, err)
+	hash := make([]byte, size)
+	_, err = io.ReadFull(r, hash)
+	require.NoError(t, err)
+	require.Equal(t, tree.WorkingHash(), hash)
+	require.Equal(t, []string{"b=value-b", "c=updated", "d=value-d", "e=value-e"}, readKVStream(t, r))
+
+	// a tree applying the same writes in another order dumps the same bytes.
+	other := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, err := other.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err = other.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = other.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, err = other.Set([]byte("e"), []byte("value-e"))
+	require.NoError(t, err)
+	_, err = other.Set([]byte("c"), []byte("updated"))
+	require.NoError(t, err)
+	var otherBuf bytes.Buffer
+	require.NoError(t, other.DumpWorkingState(&otherBuf))
+	buf.Reset()
+	require.NoError(t, tree.DumpWorkingState(&buf))
+	require.Equal(t, buf.Bytes(), otherBuf.Bytes())
+
+	// an empty tree only dumps the empty hash.
+	buf.Reset()
+	require.NoError(t, NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).DumpWorkingState(&buf))
+	require.Equal(t, append([]byte{byte(len(EmptyHash()))}, EmptyHash()...), buf.Bytes())
+}
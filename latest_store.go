@@ -0,0 +1,172 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/keyformat"
+)
+
+const latestStoreVersionKey = "latest_store_version"
+
+// Key Format for the latest store, a plain mirror of the key/value pairs at the latest saved
+// version, see the LatestStore option.
+var latestKeyFormat = keyformat.NewKeyFormat('l', 0) // l<keystring>
+
+// ErrLatestStoreDisabled is returned when reading the latest store without the LatestStore
+// option.
+var ErrLatestStoreDisabled = errors.New("latest store is not enabled")
+
+// GetLatest returns the value of key at the latest saved version, read directly from the latest
+// store and bypassing the tree. Unsaved changes of the working tree are not visible. It requires
+// the LatestStore option, ErrLatestStoreDisabled is returned otherwise.
+func (tree *MutableTree) GetLatest(key []byte) ([]byte, error) {
+	if !tree.ndb.opts.LatestStore {
+		return nil, ErrLatestStoreDisabled
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	value, err := tree.ndb.db.Get(latestKeyFormat.KeyBytes(key))
+	if err != nil {
+		return nil, err
+	}
+	return tree.ndb.copyBytes(value), nil
+}
+
+// IterateLatest iterates over the key/value pairs within [start, end) at the latest saved
+// version, read directly from the latest store, and calls fn for each of them until it returns
+// true. Like GetLatest, it requires the LatestStore option. The keys are ordered lexicographically,
+// regardless of the Comparator option.
+func (tree *MutableTree) IterateLatest(start, end []byte, ascending bool, fn func(key, value []byte) bool) (stopped bool, err error) {
+	if !tree.ndb.opts.LatestStore {
+		return false, ErrLatestStoreDisabled
+	}
+	startFormatted := latestKeyFormat.KeyBytes(start)
+	var endFormatted []byte
+	if end != nil {
+		endFormatted = latestKeyFormat.KeyBytes(end)
+	} else {
+		endFormatted = latestKeyFormat.Key()
+		endFormatted[0]++
+	}
+
+	var itr dbm.Iterator
+	if ascending {
+		itr, err = tree.ndb.db.Iterator(startFormatted, endFormatted)
+	} else {
+		itr, err = tree.ndb.db.ReverseIterator(startFormatted, endFormatted)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if fn(tree.ndb.copyBytes(itr.Key()[1:]), tree.ndb.copyBytes(itr.Value())) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// syncLatestStore rebuilds the latest store from the working tree if it doesn't mirror its
+// version, e.g. when the option was just enabled or another version was loaded.
+func (tree *MutableTree) syncLatestStore() error {
+	if !tree.ndb.opts.LatestStore {
+		return nil
+	}
+	version, ok, err := tree.ndb.getLatestStoreVersion()
+	if err != nil {
+		return err
+	}
+	if ok && version == tree.version {
+		return nil
+	}
+	return tree.ndb.rebuildLatestStore(tree.ImmutableTree)
+}
+
+// getLatestStoreVersion returns the version mirrored by the latest store, if any.
+func (ndb *nodeDB) getLatestStoreVersion() (int64, bool, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(latestStoreVersionKey)))
+	if err != nil || bz == nil {
+		return 0, false, err
+	}
+	if len(bz) != int64Size {
+		return 0, false, fmt.Errorf("invalid latest store version %X", bz)
+	}
+	return int64(binary.BigEndian.Uint64(bz)), true, nil
+}
+
+// saveLatestChanges adds the changes of the given version to the latest store into the batch,
+// see MutableTree.addUnsavedChange.
+func (ndb *nodeDB) saveLatestChanges(version int64, changes map[string]unsavedChange) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for key, change := range changes {
+		var err error
+		switch {
+		case change.noop():
+			continue
+		case change.value == nil:
+			err = ndb.batch.Delete(latestKeyFormat.KeyBytes([]byte(key)))
+		default:
+			err = ndb.batch.Set(latestKeyFormat.KeyBytes([]byte(key)), change.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ndb.setLatestStoreVersionToBatch(version)
+}
+
+// rebuildLatestStore replaces the content of the latest store with the given tree, and commits.
+func (ndb *nodeDB) rebuildLatestStore(t *ImmutableTree) error {
+	ndb.logger.Info("latest store rebuild started", "version", t.version)
+
+	if err := ndb.traversePrefix(latestKeyFormat.Key(), func(k, _ []byte) error {
+		ndb.mtx.Lock()
+		defer ndb.mtx.Unlock()
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+
+	itr := NewIterator(nil, nil, true, t)
+	defer itr.Close()
+	var written uint64
+	for ; itr.Valid(); itr.Next() {
+		ndb.mtx.Lock()
+		err := ndb.batch.Set(latestKeyFormat.KeyBytes(itr.Key()), itr.Value())
+		ndb.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		written++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+
+	ndb.mtx.Lock()
+	err := ndb.setLatestStoreVersionToBatch(t.version)
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+
+	ndb.logger.Info("latest store rebuild finished", "written", written)
+	return nil
+}
+
+func (ndb *nodeDB) setLatestStoreVersionToBatch(version int64) error {
+	bz := make([]byte, int64Size)
+	binary.BigEndian.PutUint64(bz, uint64(version))
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(latestStoreVersionKey)), bz)
+}
@@ -0,0 +1,188 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// requireLatestStoreMatches checks that the latest store mirrors the latest saved version.
+func requireLatestStoreMatches(t *testing.T, tree *MutableTree) {
+	t.Helper()
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	var keys, values [][]byte
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		latest, err := tree.GetLatest(key)
+		require.NoError(t, err)
+		require.Equal(t, value, latest)
+		return false
+	})
+	require.NoError(t, err)
+
+	var latestKeys, latestValues [][]byte
+	stopped, err := tree.IterateLatest(nil, nil, true, func(key, value []byte) bool {
+		latestKeys = append(latestKeys, key)
+		latestValues = append(latestValues, value)
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, keys, latestKeys)
+	require.Equal(t, values, latestValues)
+}
+
+func TestLatestStore(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, log.NewNopLogger(), LatestStoreOption(true))
+			_, err := tree.Load()
+			require.NoError(t, err)
+
+			r := rand.New(rand.NewSource(1))
+			for v := 1; v <= 10; v++ {
+				for i := 0; i < 50; i++ {
+					key := []byte(fmt.Sprintf("key-%03d", r.Intn(100)))
+					if r.Intn(4) == 0 {
+						_, _, err := tree.Remove(key)
+						require.NoError(t, err)
+					} else {
+						_, err := tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", v, i)))
+						require.NoError(t, err)
+					}
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				requireLatestStoreMatches(t, tree)
+			}
+
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key-%03d", i))
+				value, err := tree.Get(key)
+				require.NoError(t, err)
+				latest, err := tree.GetLatest(key)
+				require.NoError(t, err)
+				require.Equal(t, value, latest)
+			}
+		})
+	}
+}
+
+func TestLatestStore_Unsaved(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), LatestStoreOption(true))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the working tree changes are only visible once saved.
+	_, err = tree.Set([]byte("a"), []byte("3"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Append([]byte("c"), []byte("4"))
+	require.NoError(t, err)
+
+	value, err := tree.GetLatest([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+
+	tree.Rollback()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	requireLatestStoreMatches(t, tree)
+	value, err = tree.GetLatest([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+
+	_, err = tree.Set([]byte("a"), []byte("3"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, err = tree.Append([]byte("c"), []byte("4"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	requireLatestStoreMatches(t, tree)
+	value, err = tree.GetLatest([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	var keys []string
+	stopped, err := tree.IterateLatest(nil, nil, false, func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, []string{"c", "a"}, keys)
+
+	keys = nil
+	stopped, err = tree.IterateLatest([]byte("b"), []byte("d"), true, func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, []string{"c"}, keys)
+}
+
+func TestLatestStore_Rebuild(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	for v := 1; v <= 5; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i*v%30)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// the option is disabled so far.
+	_, err := tree.GetLatest([]byte("key-00"))
+	require.ErrorIs(t, err, ErrLatestStoreDisabled)
+	_, err = tree.IterateLatest(nil, nil, true, func(_, _ []byte) bool { return false })
+	require.ErrorIs(t, err, ErrLatestStoreDisabled)
+
+	// enabling it builds the latest store on load.
+	logger := &recordingLogger{}
+	tree = NewMutableTree(db, 0, false, logger, LatestStoreOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Len(t, logger.find("latest store rebuild started"), 1)
+	requireLatestStoreMatches(t, tree)
+
+	// it is kept up to date while the option is enabled, so it isn't rebuilt on the next load.
+	_, err = tree.Set([]byte("key-99"), []byte("value-6"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	logger = &recordingLogger{}
+	tree = NewMutableTree(db, 0, false, logger, LatestStoreOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Empty(t, logger.find("latest store rebuild started"))
+	requireLatestStoreMatches(t, tree)
+
+	// loading an older version rebuilds it, stale keys included.
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	require.Len(t, logger.find("latest store rebuild started"), 1)
+	requireLatestStoreMatches(t, tree)
+	value, err := tree.GetLatest([]byte("key-99"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
@@ -0,0 +1,43 @@
+package iavl
+
+// Logger defines the structured logger that IAVL expects. Each method takes a
+// message followed by alternating key/value pairs.
+//
+// It is a subset of cosmossdk.io/log.Logger, so that logger can be passed in
+// directly, while other logging setups (e.g. log/slog) only need a thin adapter
+// and IAVL itself does not depend on any logging library.
+type Logger interface {
+	// Debug takes a message and a set of key/value pairs and logs with level DEBUG.
+	Debug(msg string, keyVals ...any)
+
+	// Info takes a message and a set of key/value pairs and logs with level INFO.
+	Info(msg string, keyVals ...any)
+
+	// Warn takes a message and a set of key/value pairs and logs with level WARN.
+	Warn(msg string, keyVals ...any)
+
+	// Error takes a message and a set of key/value pairs and logs with level ERR.
+	Error(msg string, keyVals ...any)
+}
+
+// NewNopLogger returns a Logger that discards all events.
+func NewNopLogger() Logger {
+	return &nopLogger{}
+}
+
+type nopLogger struct{}
+
+var _ Logger = (*nopLogger)(nil)
+
+func (l *nopLogger) Debug(string, ...any) {}
+func (l *nopLogger) Info(string, ...any)  {}
+func (l *nopLogger) Warn(string, ...any)  {}
+func (l *nopLogger) Error(string, ...any) {}
+
+// ensureLogger returns lg, or a no-op logger if lg is nil.
+func ensureLogger(lg Logger) Logger {
+	if lg == nil {
+		return NewNopLogger()
+	}
+	return lg
+}
@@ -0,0 +1,99 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+type loggedEvent struct {
+	level   string
+	msg     string
+	keyVals []any
+}
+
+// recordingLogger records every event emitted through it.
+type recordingLogger struct {
+	mtx    sync.Mutex
+	events []loggedEvent
+}
+
+var _ Logger = (*recordingLogger)(nil)
+
+func (l *recordingLogger) record(level, msg string, keyVals []any) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.events = append(l.events, loggedEvent{level: level, msg: msg, keyVals: keyVals})
+}
+
+func (l *recordingLogger) Debug(msg string, keyVals ...any) { l.record("debug", msg, keyVals) }
+func (l *recordingLogger) Info(msg string, keyVals ...any)  { l.record("info", msg, keyVals) }
+func (l *recordingLogger) Warn(msg string, keyVals ...any)  { l.record("warn", msg, keyVals) }
+func (l *recordingLogger) Error(msg string, keyVals ...any) { l.record("error", msg, keyVals) }
+
+// find returns the key/value pairs of the events with the given message as maps.
+func (l *recordingLogger) find(msg string) []map[string]any {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var res []map[string]any
+	for _, e := range l.events {
+		if e.msg != msg {
+			continue
+		}
+		kv := make(map[string]any, len(e.keyVals)/2)
+		for i := 0; i+1 < len(e.keyVals); i += 2 {
+			kv[e.keyVals[i].(string)] = e.keyVals[i+1]
+		}
+		res = append(res, kv)
+	}
+	return res
+}
+
+func TestLoggerEvents(t *testing.T) {
+	logger := &recordingLogger{}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, logger)
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Len(t, logger.find("fast storage migration started"), 1)
+	require.Len(t, logger.find("fast storage migration finished"), 1)
+
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	commits := logger.find("committed version")
+	require.Len(t, commits, 3)
+	for i, kv := range commits {
+		require.Equal(t, int64(i+1), kv["version"])
+		require.Positive(t, kv["nodes"])
+		require.Positive(t, kv["bytes"])
+	}
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+
+	started := logger.find("pruning started")
+	require.Len(t, started, 1)
+	require.Equal(t, int64(1), started[0]["from"])
+	require.Equal(t, int64(2), started[0]["to"])
+
+	finished := logger.find("pruning finished")
+	require.Len(t, finished, 1)
+	require.Positive(t, finished[0]["freed"])
+}
+
+func TestNilLogger(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, nil)
+	_, err := tree.Set([]byte("k"), []byte("v"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+}
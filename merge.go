@@ -0,0 +1,60 @@
+package iavl
+
+import (
+	"fmt"
+)
+
+// Merge inserts all the key/value pairs of src into the working tree of dst, i.e. the union of
+// both trees. When a key exists in both, onConflict is given the values of dst and src and
+// returns the value to keep, a nil onConflict keeping the value of src. The result is the same
+// as setting each pair of src in ascending key order with Set, but the pairs are read in order
+// from src and each of them is merged in a single descent of dst, so that the consecutive
+// insertions share the nodes they load and clone along the same paths.
+//
+// src must not be the working tree of dst. The values of src are referenced by dst, as with Set.
+// On error, dst is left partially merged, Rollback discards the changes.
+func Merge(dst *MutableTree, src *ImmutableTree, onConflict func(key, dstVal, srcVal []byte) []byte) error {
+	if dst == nil || src == nil {
+		return fmt.Errorf("nil tree: %w", ErrInvalidInputs)
+	}
+	if src == dst.ImmutableTree {
+		return fmt.Errorf("cannot merge the working tree into itself: %w", ErrInvalidInputs)
+	}
+
+	itr, err := src.Iterator(nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		key, srcVal := itr.Key(), itr.Value()
+		if dst.ImmutableTree.root == nil || onConflict == nil {
+			if _, err := dst.set(key, srcVal); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var resolved []byte
+		root, _, err := dst.recursiveSet(dst.ImmutableTree.root, key, func(existing []byte) []byte {
+			resolved = srcVal
+			if existing != nil {
+				resolved = onConflict(key, existing, srcVal)
+				if resolved == nil {
+					// the error is returned below, keep the existing value meanwhile.
+					return existing
+				}
+			}
+			return resolved
+		})
+		if err != nil {
+			return err
+		}
+		dst.ImmutableTree.root = root
+		if resolved == nil {
+			return fmt.Errorf("conflict resolver returned a nil value for key %X: %w", key, ErrInvalidInputs)
+		}
+	}
+	return itr.Error()
+}
@@ -0,0 +1,159 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// mergeTestTree returns a saved tree with the given key/value pairs, set in ascending order.
+func mergeTestTree(t *testing.T, pairs map[string]string) *MutableTree {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	// the shape of the tree depends on the insertion order.
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, err := tree.Set([]byte(k), []byte(pairs[k]))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	return tree
+}
+
+// bruteForceMerge sets each pair of src in dst, in ascending key order.
+func bruteForceMerge(t *testing.T, dst *MutableTree, src *ImmutableTree, onConflict func(key, dstVal, srcVal []byte) []byte) {
+	_, err := src.Iterate(func(key, srcVal []byte) bool {
+		dstVal, err := dst.Get(key)
+		require.NoError(t, err)
+		value := srcVal
+		if dstVal != nil && onConflict != nil {
+			value = onConflict(key, dstVal, srcVal)
+		}
+		_, err = dst.Set(key, value)
+		require.NoError(t, err)
+		return false
+	})
+	require.NoError(t, err)
+}
+
+func concatConflict(_, dstVal, srcVal []byte) []byte {
+	return append(append([]byte{}, dstVal...), srcVal...)
+}
+
+func TestMerge(t *testing.T) {
+	testcases := map[string]struct {
+		dst, src   map[string]string
+		onConflict func(key, dstVal, srcVal []byte) []byte
+		expected   map[string]string
+	}{
+		"disjoint": {
+			dst:        map[string]string{"a": "1", "c": "3"},
+			src:        map[string]string{"b": "2", "d": "4"},
+			onConflict: concatConflict,
+			expected:   map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+		},
+		"overlapping": {
+			dst:        map[string]string{"a": "1", "b": "2", "c": "3"},
+			src:        map[string]string{"b": "x", "c": "y", "d": "z"},
+			onConflict: concatConflict,
+			expected:   map[string]string{"a": "1", "b": "2x", "c": "3y", "d": "z"},
+		},
+		"overlapping without resolver": {
+			dst:      map[string]string{"a": "1", "b": "2"},
+			src:      map[string]string{"b": "x", "c": "y"},
+			expected: map[string]string{"a": "1", "b": "x", "c": "y"},
+		},
+		"dst kept": {
+			dst:        map[string]string{"a": "1", "b": "2"},
+			src:        map[string]string{"a": "x", "b": "y"},
+			onConflict: func(_, dstVal, _ []byte) []byte { return dstVal },
+			expected:   map[string]string{"a": "1", "b": "2"},
+		},
+		"empty dst": {
+			dst:        map[string]string{},
+			src:        map[string]string{"a": "1", "b": "2"},
+			onConflict: concatConflict,
+			expected:   map[string]string{"a": "1", "b": "2"},
+		},
+		"empty src": {
+			dst:        map[string]string{"a": "1"},
+			src:        map[string]string{},
+			onConflict: concatConflict,
+			expected:   map[string]string{"a": "1"},
+		},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dst, src := mergeTestTree(t, tc.dst), mergeTestTree(t, tc.src)
+			require.NoError(t, Merge(dst, src.ImmutableTree, tc.onConflict))
+
+			merged := make(map[string]string)
+			_, err := dst.Iterate(func(key, value []byte) bool {
+				merged[string(key)] = string(value)
+				return false
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, merged)
+
+			expected := mergeTestTree(t, tc.dst)
+			bruteForceMerge(t, expected, src.ImmutableTree, tc.onConflict)
+			require.Equal(t, expected.WorkingHash(), dst.WorkingHash())
+		})
+	}
+}
+
+func TestMerge_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	dstPairs, srcPairs := make(map[string]string), make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		dstPairs[fmt.Sprintf("key-%05d", r.Intn(5000))] = fmt.Sprintf("dst-%d", i)
+		srcPairs[fmt.Sprintf("key-%05d", r.Intn(5000))] = fmt.Sprintf("src-%d", i)
+	}
+	dst, src := mergeTestTree(t, dstPairs), mergeTestTree(t, srcPairs)
+	expected := mergeTestTree(t, dstPairs)
+
+	// merge a version of src which isn't the latest one as well.
+	_, err := src.Set([]byte("key-99999"), []byte("later"))
+	require.NoError(t, err)
+	_, _, err = src.SaveVersion()
+	require.NoError(t, err)
+	itree, err := src.GetImmutable(1)
+	require.NoError(t, err)
+
+	require.NoError(t, Merge(dst, itree, concatConflict))
+	bruteForceMerge(t, expected, itree, concatConflict)
+	require.Equal(t, expected.WorkingHash(), dst.WorkingHash())
+
+	// the merged tree saves like any other.
+	hash, _, err := dst.SaveVersion()
+	require.NoError(t, err)
+	expectedHash, _, err := expected.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expectedHash, hash)
+	value, err := dst.Get([]byte("key-99999"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestMerge_Invalid(t *testing.T) {
+	dst := mergeTestTree(t, map[string]string{"a": "1"})
+	src := mergeTestTree(t, map[string]string{"a": "2"})
+
+	require.ErrorIs(t, Merge(dst, dst.ImmutableTree, nil), ErrInvalidInputs)
+	require.ErrorIs(t, Merge(nil, src.ImmutableTree, nil), ErrInvalidInputs)
+	err := Merge(dst, src.ImmutableTree, func(_, _, _ []byte) []byte { return nil })
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	value, err := dst.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+}
@@ -0,0 +1,271 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// MultiTree manages the named trees of an application sharing a DB, e.g. the stores of its
+// modules, which it commits together: every Commit saves a version of each tree, and writes
+// them in a single batch, so that the trees are always at the same version, and combines their
+// root hashes into the app hash. The trees share the cache budget and the options of the
+// MultiTree, including its pruning policy.
+//
+// The trees are mounted by Mount before Load, and stored under prefixes of the DB derived from
+// their names, see CommitGroup. A tree mounted after versions were committed starts from the
+// next version. The trees are read and written through Tree; a MultiTree, like its trees, must
+// not be committed concurrently with the writes of the trees.
+type MultiTree struct {
+	db        dbm.DB
+	cacheSize int
+	logger    Logger
+	options   []Option
+
+	mtx     sync.RWMutex
+	group   *CommitGroup            // group of the loaded trees
+	mounted map[string][]Option     // options of the mounted trees, by name
+	names   []string                // names of the loaded trees, in ascending order
+	trees   map[string]*MutableTree // loaded trees, by name
+	pruning PruningOptions
+	version int64
+	hash    []byte
+}
+
+// NewMultiTree returns a MultiTree of trees stored in db, whose node caches hold cacheSize
+// nodes in total, and which are created with the given options.
+func NewMultiTree(db dbm.DB, cacheSize int, lg Logger, options ...Option) *MultiTree {
+	return &MultiTree{
+		db:        db,
+		cacheSize: cacheSize,
+		logger:    ensureLogger(lg),
+		options:   options,
+		mounted:   make(map[string][]Option),
+	}
+}
+
+// Mount adds the tree of the given name, created with the options of the MultiTree followed by
+// the given ones, by the next Load. The name can't be empty, nor mounted twice.
+func (mt *MultiTree) Mount(name string, options ...Option) error {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("empty tree name: %w", ErrInvalidInputs)
+	}
+	if _, ok := mt.mounted[name]; ok {
+		return fmt.Errorf("tree %q is already mounted: %w", name, ErrInvalidInputs)
+	}
+	if mt.trees != nil {
+		return fmt.Errorf("tree %q mounted after Load: %w", name, ErrInvalidInputs)
+	}
+	mt.mounted[name] = options
+	return nil
+}
+
+// Load creates and loads the mounted trees at their latest version, which must be the same for
+// all the trees having versions, and returns it. The trees without versions, e.g. mounted since
+// the last Commit, start from the next version. The cache budget is split evenly between them.
+func (mt *MultiTree) Load() (int64, error) {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+
+	if mt.trees != nil {
+		return 0, fmt.Errorf("multi tree already loaded: %w", ErrInvalidInputs)
+	}
+	if len(mt.mounted) == 0 {
+		return 0, fmt.Errorf("no tree mounted: %w", ErrInvalidInputs)
+	}
+	names := make([]string, 0, len(mt.mounted))
+	for name := range mt.mounted {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	group := NewCommitGroup(mt.db)
+	trees := make(map[string]*MutableTree, len(names))
+	for _, name := range names {
+		prefix, err := encoding.EncodeBytesSlice([]byte(name))
+		if err != nil {
+			return 0, err
+		}
+		options := append(slices.Clip(mt.options), mt.mounted[name]...)
+		tree, err := group.NewMutableTree(prefix, mt.cacheSize/len(names), false, mt.logger, options...)
+		if err != nil {
+			return 0, fmt.Errorf("tree %q: %w", name, err)
+		}
+		trees[name] = tree
+	}
+	mt.group, mt.names, mt.trees = group, names, trees
+	if err := mt.load(); err != nil {
+		mt.group, mt.names, mt.trees = nil, nil, nil
+		return 0, err
+	}
+	for _, name := range names {
+		if err := mt.trees[name].ConfigurePruning(mt.pruning); err != nil {
+			return 0, err
+		}
+	}
+	return mt.version, nil
+}
+
+// load loads the trees at their latest version, and sets the version and the hash.
+func (mt *MultiTree) load() error {
+	version, from := int64(0), ""
+	for _, name := range mt.names {
+		tree := mt.trees[name]
+		latest, err := tree.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load tree %q: %w", name, err)
+		}
+		if latest == 0 {
+			continue
+		}
+		if version != 0 && latest != version {
+			return fmt.Errorf("tree %q is at version %d, but tree %q is at version %d", name, latest, from, version)
+		}
+		version, from = latest, name
+	}
+	for _, name := range mt.names {
+		if tree := mt.trees[name]; tree.Version() == 0 && version > 0 {
+			tree.SetInitialVersion(uint64(version + 1))
+		}
+	}
+	mt.version = version
+	mt.hash = mt.appHash()
+	return nil
+}
+
+// Tree returns the tree of the given name, nil if it isn't loaded.
+func (mt *MultiTree) Tree(name string) *MutableTree {
+	mt.mtx.RLock()
+	defer mt.mtx.RUnlock()
+	return mt.trees[name]
+}
+
+// Names returns the names of the loaded trees, in ascending order.
+func (mt *MultiTree) Names() []string {
+	mt.mtx.RLock()
+	defer mt.mtx.RUnlock()
+	return slices.Clone(mt.names)
+}
+
+// Version returns the latest committed version.
+func (mt *MultiTree) Version() int64 {
+	mt.mtx.RLock()
+	defer mt.mtx.RUnlock()
+	return mt.version
+}
+
+// Hash returns the app hash of the latest committed version, see Commit.
+func (mt *MultiTree) Hash() []byte {
+	mt.mtx.RLock()
+	defer mt.mtx.RUnlock()
+	return mt.hash
+}
+
+// ConfigurePruning sets the pruning policy of all the trees, see MutableTree.ConfigurePruning.
+// The versions are pruned by Commit, and their deletion written along with the version.
+func (mt *MultiTree) ConfigurePruning(opts PruningOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if opts.Async {
+		return fmt.Errorf("the trees of a multi tree are pruned along with their versions: %w", ErrInvalidInputs)
+	}
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+	for _, name := range mt.names {
+		if err := mt.trees[name].ConfigurePruning(opts); err != nil {
+			return err
+		}
+	}
+	mt.pruning = opts
+	return nil
+}
+
+// Commit saves a new version of every tree, writes them in a single synced batch, and returns
+// the app hash of the version with the version. The app hash is the SHA-256 hash of the names
+// and the root hashes of the trees, each encoded as a length-prefixed byte slice, in the order
+// of the names.
+//
+// If a tree fails to save its version, the versions of the trees not written yet are discarded,
+// along with their unsaved changes, and the trees are loaded again at the latest written
+// version. If the batch fails, the version is saved but not written, and the error says so;
+// it is written along with the next one.
+func (mt *MultiTree) Commit() ([]byte, int64, error) {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+
+	if mt.trees == nil {
+		return nil, 0, fmt.Errorf("multi tree not loaded: %w", ErrNotInitalizedTree)
+	}
+	// the first version may be the InitialVersion option.
+	version := int64(0)
+	for i, name := range mt.names {
+		_, saved, err := mt.trees[name].StageSaveVersion()
+		if i == 0 {
+			version = saved
+		} else if err == nil && saved != version {
+			err = fmt.Errorf("saved version %d instead of %d", saved, version)
+		}
+		if err != nil {
+			if discardErr := mt.discard(); discardErr != nil {
+				mt.logger.Error("failed to discard the staged versions", "version", version, "err", discardErr)
+			}
+			return nil, version, fmt.Errorf("failed to save version %d of tree %q: %w", version, name, err)
+		}
+	}
+	mt.version = version
+	mt.hash = mt.appHash()
+	if err := mt.group.Flush(); err != nil {
+		return mt.hash, version, fmt.Errorf("version %d was saved, but writing it failed, it is written by the next Commit: %w", version, err)
+	}
+	return mt.hash, version, nil
+}
+
+// discard drops the staged versions, and loads the trees again.
+func (mt *MultiTree) discard() error {
+	if err := mt.group.discard(); err != nil {
+		return err
+	}
+	if err := mt.load(); err != nil {
+		return err
+	}
+	for _, name := range mt.names {
+		if err := mt.trees[name].ConfigurePruning(mt.pruning); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appHash returns the app hash of the latest saved versions of the trees.
+func (mt *MultiTree) appHash() []byte {
+	var buf bytes.Buffer
+	for _, name := range mt.names {
+		// writing to a bytes.Buffer never fails.
+		_ = encoding.EncodeBytes(&buf, []byte(name))
+		_ = encoding.EncodeBytes(&buf, mt.trees[name].Hash())
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// Close closes the trees, the DB being left open.
+func (mt *MultiTree) Close() error {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+	for _, name := range mt.names {
+		if err := mt.trees[name].Close(); err != nil {
+			return fmt.Errorf("failed to close tree %q: %w", name, err)
+		}
+	}
+	mt.group, mt.names, mt.trees = nil, nil, nil
+	return nil
+}
@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+func TestMultiTree(t *testing.T) {
+	db := dbm.NewMemDB()
+	open := func(names ...string) *MultiTree {
+		mt := NewMultiTree(db, 1000, log.NewNopLogger())
+		for _, name := range names {
+			require.NoError(t, mt.Mount(name))
+		}
+		return mt
+	}
+	// appHash returns the expected app hash of trees, by name in ascending order.
+	appHash := func(names []string, trees ...*MutableTree) []byte {
+		var buf bytes.Buffer
+		for i, name := range names {
+			require.NoError(t, encoding.EncodeBytes(&buf, []byte(name)))
+			require.NoError(t, encoding.EncodeBytes(&buf, trees[i].Hash()))
+		}
+		hash := sha256.Sum256(buf.Bytes())
+		return hash[:]
+	}
+
+	mt := open("staking", "bank")
+	require.ErrorIs(t, mt.Mount("bank"), ErrInvalidInputs)
+	require.ErrorIs(t, mt.Mount(""), ErrInvalidInputs)
+	version, err := mt.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+	require.Equal(t, []string{"bank", "staking"}, mt.Names())
+	require.ErrorIs(t, mt.Mount("gov"), ErrInvalidInputs)
+
+	references := map[string]*MutableTree{
+		"bank":    NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()),
+		"staking": NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()),
+		"gov":     NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()),
+	}
+	set := func(mt *MultiTree, name, key string) {
+		_, err := mt.Tree(name).Set([]byte(key), []byte(name))
+		require.NoError(t, err)
+		_, err = references[name].Set([]byte(key), []byte(name))
+		require.NoError(t, err)
+	}
+	set(mt, "bank", "a")
+	set(mt, "staking", "b")
+	hash, version, err := mt.Commit()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	for _, reference := range references {
+		_, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, appHash(mt.Names(), references["bank"], references["staking"]), hash)
+	require.Equal(t, hash, mt.Hash())
+	require.NoError(t, mt.Close())
+
+	// a tree mounted later starts from the next version.
+	mt = open("bank", "staking", "gov")
+	version, err = mt.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, hash, appHash([]string{"bank", "staking"}, mt.Tree("bank"), mt.Tree("staking")))
+	set(mt, "gov", "c")
+	hash, version, err = mt.Commit()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	for _, name := range mt.Names() {
+		require.EqualValues(t, 2, mt.Tree(name).Version())
+	}
+	references["gov"].SetInitialVersion(2)
+	for _, reference := range references {
+		_, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, appHash(mt.Names(), references["bank"], references["gov"], references["staking"]), hash)
+
+	// a failed commit discards the versions saved by the other trees.
+	errListener := errors.New("listener failed")
+	listener := &testCommitListener{events: &[]commitEvent{}, err: errListener}
+	mt.Tree("staking").AddCommitListener(listener)
+	set(mt, "bank", "d")
+	_, _, err = mt.Commit()
+	require.ErrorIs(t, err, errListener)
+	require.EqualValues(t, 2, mt.Version())
+	require.Equal(t, hash, mt.Hash())
+	for _, name := range mt.Names() {
+		require.EqualValues(t, 2, mt.Tree(name).Version())
+	}
+	value, err := mt.Tree("bank").Get([]byte("d"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	listener.err = nil
+	_, version, err = mt.Commit()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+
+	// the trees are pruned along with their versions.
+	require.ErrorIs(t, mt.ConfigurePruning(PruningOptions{KeepRecent: 1, Async: true}), ErrInvalidInputs)
+	require.NoError(t, mt.ConfigurePruning(PruningOptions{KeepRecent: 1}))
+	_, version, err = mt.Commit()
+	require.NoError(t, err)
+	require.NoError(t, mt.Close())
+	mt = open("bank", "staking", "gov")
+	_, err = mt.Load()
+	require.NoError(t, err)
+	for _, name := range mt.Names() {
+		require.Equal(t, []int{int(version)}, mt.Tree(name).AvailableVersions())
+	}
+}
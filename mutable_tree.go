@@ -2,13 +2,14 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 
-	log "cosmossdk.io/log"
-
+	"github.com/cosmos/iavl/cache"
 	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
@@ -20,8 +21,25 @@ var (
 
 	// ErrKeyDoesNotExist is returned if a key does not exist.
 	ErrKeyDoesNotExist = errors.New("key does not exist")
+
+	// ErrRootHashDoesNotExist is returned if no available version has the requested root hash.
+	ErrRootHashDoesNotExist = errors.New("root hash does not exist")
+
+	// ErrChangeSetUnsorted is returned if the keys of a ChangeSet are not in ascending order.
+	ErrChangeSetUnsorted = errors.New("change set keys are not sorted")
+
+	// ErrChangeSetDuplicateKey is returned if a ChangeSet changes a key more than once.
+	ErrChangeSetDuplicateKey = errors.New("change set has a duplicate key")
+
+	// ErrEmptyKey is returned if a nil or empty key is given, since the keys of a tree can't be
+	// empty. It wraps ErrInvalidInputs.
+	ErrEmptyKey = fmt.Errorf("empty key: %w", ErrInvalidInputs)
 )
 
+// fastStorageMigrationLogInterval is the number of fast nodes written between
+// progress events during the fast storage migration.
+const fastStorageMigrationLogInterval = 100000
+
 type Option func(*Options)
 
 // MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
@@ -33,20 +51,45 @@ type Option func(*Options)
 //
 // The inner ImmutableTree should not be used directly by callers.
 type MutableTree struct {
-	logger log.Logger
-
-	*ImmutableTree                          // The current, working tree.
-	lastSaved                *ImmutableTree // The most recently saved tree.
-	unsavedFastNodeAdditions *sync.Map      // map[string]*FastNode FastNodes that have not yet been saved to disk
-	unsavedFastNodeRemovals  *sync.Map      // map[string]interface{} FastNodes that have not yet been removed from disk
+	logger Logger
+
+	*ImmutableTree                                         // The current, working tree.
+	lastSaved                atomic.Pointer[ImmutableTree] // The most recently saved tree, read lock-free by Snapshot.
+	unsavedFastNodeAdditions *sync.Map                     // map[string]*FastNode FastNodes that have not yet been saved to disk
+	unsavedFastNodeRemovals  *sync.Map                     // map[string]interface{} FastNodes that have not yet been removed from disk
+	unsavedChanges           map[string]unsavedChange      // changes not yet saved, for the latest store, commit listeners and subscribers
+	unsavedTombstones        [][]byte                      // keys soft deleted since the last saved version, see SoftDeleteRetention
+	commitListeners          []CommitListener
+	concurrentSets           *concurrentSets // writes buffered by ConcurrentSet, nil unless the ConcurrentSet option is set
+	pruning                  PruningOptions  // pruning policy applied by SaveVersion, see ConfigurePruning
+	prunedTo                 int64           // the versions before it follow the pruning policy
 	ndb                      *nodeDB
-	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
+	skipFastStorageUpgrade   bool             // If true, the tree will work like no fast storage and always not upgrade fast storage
+	rootHashIndex            map[string]int64 // root hash -> latest version with that root hash, built lazily
+	immutableCache           *immutableCache  // trees recently returned by GetImmutable, nil unless enabled
+	loaded                   atomic.Bool      // set once a version has been loaded, see Health
+	migrationDone            atomic.Int64     // fast nodes written by the last fast storage migration, see MigrationProgress
+	migrationTotal           atomic.Int64     // fast nodes to write by the last fast storage migration
+	nodeKeyMigrationDone     atomic.Int64     // legacy versions rewritten by the last node key migration, see NodeKeyMigrationProgress
+	nodeKeyMigrationTotal    atomic.Int64     // legacy versions to rewrite by the last node key migration
+	migrationWait            chan struct{}    // closed once the background fast storage migration ends
+	migrationErr             error            // error of the background fast storage migration, set before migrationWait is closed
+	unsyncedVersion          int64            // latest version committed without syncing, see Sync
+	lastRepair               *RepairInfo      // operation repaired by the last load, see LastRepair
+	subscriptions            []*subscription  // subscribers to the changes of the saved versions, see Subscribe
+	scrubber                 *scrubber        // running scrubber, see StartScrubber
+	scrubPosition            []byte           // node key of the last node verified by a scrubber
+	scrubMtx                 sync.Mutex       // guards scrubber and scrubPosition
+	lastSet                  *Node            // leaf of the last key set, served by Get while lastSetIn is the working tree
+	lastSetIn                *ImmutableTree   // working tree lastSet was set in
+	commitGroup              *CommitGroup     // group staging the writes, nil unless created by CommitGroup.NewMutableTree
 
 	mtx sync.Mutex
 }
 
 // NewMutableTree returns a new tree with the specified optional options.
-func NewMutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool, lg log.Logger, options ...Option) *MutableTree {
+func NewMutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool, lg Logger, options ...Option) *MutableTree {
+	lg = ensureLogger(lg)
 	opts := DefaultOptions()
 	for _, opt := range options {
 		opt(&opts)
@@ -55,21 +98,61 @@ func NewMutableTree(db dbm.DB, cacheSize int, skipFastStorageUpgrade bool, lg lo
 	ndb := newNodeDB(db, cacheSize, opts, lg)
 	head := &ImmutableTree{ndb: ndb, skipFastStorageUpgrade: skipFastStorageUpgrade}
 
-	return &MutableTree{
+	tree := &MutableTree{
 		logger:                   lg,
 		ImmutableTree:            head,
-		lastSaved:                head.clone(),
 		unsavedFastNodeAdditions: &sync.Map{},
 		unsavedFastNodeRemovals:  &sync.Map{},
 		ndb:                      ndb,
 		skipFastStorageUpgrade:   skipFastStorageUpgrade,
+		immutableCache:           newImmutableCache(opts.ImmutableTreeCacheSize),
 	}
+	tree.setLastSaved(head.clone())
+	if opts.ConcurrentSet {
+		tree.concurrentSets = newConcurrentSets()
+	}
+	return tree
 }
 
-// IsEmpty returns whether or not the tree has any keys. Only trees that are
-// not empty can be saved.
+// IsEmpty returns whether or not the tree has any keys, the tombstones of the SoftDeleteRetention
+// option included. Only trees that are not empty can be saved.
 func (tree *MutableTree) IsEmpty() bool {
-	return tree.ImmutableTree.Size() == 0
+	return tree.root == nil
+}
+
+// SetCache replaces the cache of the tree nodes with c, e.g. to try another cache
+// implementation at runtime. If migrate is true and the current cache implements
+// cache.Enumerator, its nodes are added to c, otherwise c starts cold.
+//
+// The swap happens under the lock guarding every cache access, so immutable trees may keep
+// being queried concurrently, and are served by the old cache until the swap completes. A cache
+// implementing cache.Concurrent, e.g. cache.NewSharded, serves its hits without that lock. As
+// any other MutableTree method, it must not be called concurrently with writes to the tree.
+func (tree *MutableTree) SetCache(c cache.Cache, migrate bool) error {
+	if c == nil {
+		return fmt.Errorf("cache is nil: %w", ErrInvalidInputs)
+	}
+	tree.ndb.setNodeCache(c, migrate)
+	return nil
+}
+
+// CacheStats are the statistics of the caches of a tree, see MutableTree.CacheStats.
+type CacheStats struct {
+	Nodes     cache.Stats
+	FastNodes cache.Stats
+}
+
+// Total returns the statistics of both caches together.
+func (s CacheStats) Total() cache.Stats {
+	return s.Nodes.Add(s.FastNodes)
+}
+
+// CacheStats returns the statistics of the node and fast node caches of the tree, which are
+// counted from its creation, across the caches set by SetCache, whatever their implementation,
+// and shared with the immutable trees of its versions. The Bytes of a cache are only counted
+// with a bytes limit, see cache.NewWithBytesLimit.
+func (tree *MutableTree) CacheStats() CacheStats {
+	return tree.ndb.cacheStats()
 }
 
 // VersionExists returns whether or not a version exists.
@@ -91,7 +174,32 @@ func (tree *MutableTree) VersionExists(version int64) bool {
 		return false
 	}
 
-	return firstVersion <= version && version <= latestVersion
+	if version < firstVersion || version > latestVersion {
+		return false
+	}
+	pruned, err := tree.ndb.isPrunedVersion(version)
+	return err == nil && !pruned
+}
+
+// VersionSizeEstimate estimates how many bytes the given version contributes on disk:
+//   - nodeBytes is the size of the nodes introduced by the version.
+//   - fastNodeBytes is the size of the fast nodes written for the keys set in the version, 0 if
+//     fast storage is disabled. Later versions may overwrite them.
+//   - orphanBytes is the size of the nodes of the previous version which the version orphaned,
+//     i.e. what pruning the previous version frees. It is 0 if the previous version doesn't
+//     exist (anymore).
+//
+// Sizes include the database keys. Legacy versions are not supported, and return an error
+// wrapping ErrVersionDoesNotExist like missing versions.
+func (tree *MutableTree) VersionSizeEstimate(version int64) (nodeBytes, fastNodeBytes, orphanBytes int64, err error) {
+	return tree.ndb.versionSizeEstimate(version)
+}
+
+// UniqueNodeCount counts the nodes of the given version which are unique to it, i.e. orphaned
+// by the next version and freed when the version is pruned, and the ones shared with the next
+// version. All the nodes are shared while the version is the latest one.
+func (tree *MutableTree) UniqueNodeCount(version int64) (unique, shared int64, err error) {
+	return tree.ndb.uniqueNodeCount(version)
 }
 
 // AvailableVersions returns all available versions in ascending order
@@ -123,21 +231,89 @@ func (tree *MutableTree) AvailableVersions() []int {
 		firstVersion = legacyLatestVersion
 	}
 
+	pruned, err := tree.ndb.prunedVersions(firstVersion, latestVersion)
+	if err != nil {
+		return nil
+	}
 	for version := firstVersion; version <= latestVersion; version++ {
-		res = append(res, int(version))
+		if !pruned[version] {
+			res = append(res, int(version))
+		}
 	}
 	return res
 }
 
 // Hash returns the hash of the latest saved version of the tree, as returned
-// by SaveVersion. If no versions have been saved, Hash returns nil.
+// by SaveVersion. If no versions have been saved, or the latest saved version
+// is empty, Hash returns EmptyHash() regardless of the initial version.
 func (tree *MutableTree) Hash() []byte {
-	return tree.lastSaved.Hash()
+	return tree.lastSaved.Load().Hash()
+}
+
+// Snapshot returns the latest saved version of the tree as an ImmutableTree, which is a stable
+// view of it: its reads and proofs are consistent with each other and with its Hash, even while
+// other versions are saved concurrently. Unlike the other methods, it may be called concurrently
+// with the writes to the tree, and doesn't lock. The unsaved changes of the working tree are not
+// included, since its nodes are modified by SaveVersion.
+//
+// The saved nodes are frozen: SaveVersion hashes and writes the new nodes of the working tree,
+// which the saved versions don't reference, copies the ones it must change, and flushes them
+// without holding the lock the readers load their nodes under, so a snapshot of the version
+// before it keeps being served while it hashes and flushes.
+//
+// The snapshot reads the tree nodes rather than the fast storage, which SaveVersion updates to
+// the newer versions. Its version must not be deleted while it is used.
+func (tree *MutableTree) Snapshot() *ImmutableTree {
+	snapshot := tree.lastSaved.Load().clone()
+	snapshot.skipFastStorageUpgrade = true
+	return snapshot
+}
+
+// WorkingSnapshot returns the working tree, with its unsaved changes, as an ImmutableTree which
+// is a stable view of it: the later writes and SaveVersion don't change it, so it may serve
+// reads, e.g. of mempool or simulation queries, concurrently with them without locking the
+// tree. The snapshot shares the saved nodes of the working tree, and only copies the nodes of
+// the unsaved changes, so it costs as much as their number. Its Hash is the WorkingHash, which
+// is computed beforehand, and its Version is that of the latest saved version. The writes
+// buffered by ConcurrentSet aren't included until they are applied.
+//
+// As Snapshot, it reads the tree nodes rather than the fast storage, and the saved version it
+// builds upon must not be deleted while it is used. WorkingSnapshot itself must be called by
+// the goroutine writing to the tree.
+func (tree *MutableTree) WorkingSnapshot() *ImmutableTree {
+	tree.WorkingHash()
+	snapshot := tree.ImmutableTree.clone()
+	snapshot.root = copyUnsavedNodes(snapshot.root)
+	snapshot.skipFastStorageUpgrade = true
+	return snapshot
+}
+
+// copyUnsavedNodes returns a copy of the node whose unsaved descendants are copied as well, so
+// that they are no longer changed by SaveVersion, the saved nodes being shared.
+func copyUnsavedNodes(node *Node) *Node {
+	if node == nil || node.nodeKey != nil {
+		return node
+	}
+	copied := *node
+	copied.leftNode = copyUnsavedNodes(node.leftNode)
+	copied.rightNode = copyUnsavedNodes(node.rightNode)
+	return &copied
+}
+
+// setLastSaved sets the latest saved version of the tree, see Snapshot.
+func (tree *MutableTree) setLastSaved(t *ImmutableTree) {
+	tree.lastSaved.Store(t)
 }
 
-// WorkingHash returns the hash of the current working tree.
+// WorkingHash returns the hash of the current working tree, or EmptyHash() if it has no keys.
+//
+// Hashing is always deferred: Set and Remove never compute hashes, they only clear the hashes
+// of the nodes they replace. The hashes of the new nodes are computed by the first WorkingHash
+// or SaveVersion call, so a block of writes that is hashed once does no incremental hashing,
+// and are computed concurrently with the HashWorkers option. The saved leaves read by the
+// writes are hashed as they are loaded, unless with the LazyHashing option.
 func (tree *MutableTree) WorkingHash() []byte {
-	return tree.root.hashWithCount(tree.WorkingVersion())
+	return tree.hashWorkingTree(tree.WorkingVersion())
 }
 
 func (tree *MutableTree) WorkingVersion() int64 {
@@ -156,8 +332,22 @@ func (tree *MutableTree) String() (string, error) {
 // Set sets a key in the working tree. Nil values are invalid. The given
 // key/value byte slices must not be modified after this call, since they point
 // to slices stored within IAVL. It returns true when an existing value was
-// updated, while false means it was a new key.
+// updated, while false means it was a new key. With the SkipNoOpSets option,
+// setting a key to the value it already has leaves the tree unchanged. An empty key is
+// rejected with ErrEmptyKey, as by the other methods reading or writing a key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+	if err := tree.ndb.checkValue(key, value); err != nil {
+		return false, err
+	}
+	if tree.ndb.opts.SkipNoOpSets && value != nil {
+		unchanged, err := tree.hasValue(key, value)
+		if err != nil || unchanged {
+			return unchanged, err
+		}
+	}
 	updated, err = tree.set(key, value)
 	if err != nil {
 		return false, err
@@ -165,16 +355,136 @@ func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
 	return updated, nil
 }
 
-// Get returns the value of the specified key if it exists, or nil otherwise.
-// The returned value must not be modified, since it may point to data stored within IAVL.
+// SetOutcome tells what a set did to the working tree, see MutableTree.SetResult.
+type SetOutcome uint8
+
+const (
+	// SetInserted means the key was new.
+	SetInserted SetOutcome = iota
+	// SetUpdated means the key existed with another value.
+	SetUpdated
+	// SetUnchanged means the key already had the same value, so the tree was left unchanged.
+	SetUnchanged
+)
+
+// String implements fmt.Stringer.
+func (o SetOutcome) String() string {
+	switch o {
+	case SetInserted:
+		return "inserted"
+	case SetUpdated:
+		return "updated"
+	case SetUnchanged:
+		return "unchanged"
+	default:
+		return fmt.Sprintf("SetOutcome(%d)", uint8(o))
+	}
+}
+
+// SetResult sets a key in the working tree like Set, but tells whether the key was inserted,
+// updated, or already had the same value. In the latter case, the working tree is left as is,
+// without any new node, so the WorkingHash doesn't change and the key isn't part of the changes
+// of the next version.
+func (tree *MutableTree) SetResult(key, value []byte) (SetOutcome, error) {
+	if len(key) == 0 {
+		return SetInserted, ErrEmptyKey
+	}
+	if value == nil {
+		return SetInserted, fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	if err := tree.ndb.checkValue(key, value); err != nil {
+		return SetInserted, err
+	}
+	unchanged, err := tree.hasValue(key, value)
+	if err != nil {
+		return SetInserted, err
+	}
+	if unchanged {
+		return SetUnchanged, nil
+	}
+	updated, err := tree.set(key, value)
+	if err != nil {
+		return SetInserted, err
+	}
+	if updated {
+		return SetUpdated, nil
+	}
+	return SetInserted, nil
+}
+
+// CompareAndSwap sets a key in the working tree to newValue like Set, only if its current value
+// is expected, a nil expected value meaning that the key must be absent, e.g. for optimistic
+// concurrency. It returns whether the key was set. The current value is read in a single
+// descent of the working tree, which is left unchanged if it doesn't match. A key with a
+// tombstone of a tree with soft deletes is absent.
+func (tree *MutableTree) CompareAndSwap(key, expected, newValue []byte) (swapped bool, err error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+	if newValue == nil {
+		return false, fmt.Errorf("attempt to store nil value at key '%s'", key)
+	}
+	if err := tree.ndb.checkValue(key, newValue); err != nil {
+		return false, err
+	}
+	var current []byte
+	if tree.ImmutableTree.root != nil {
+		_, current, err = tree.ImmutableTree.root.get(tree.ImmutableTree, key)
+		if err != nil {
+			return false, err
+		}
+		current = tree.ndb.liveValue(current)
+	}
+	if (expected == nil) != (current == nil) || !bytes.Equal(current, expected) {
+		return false, nil
+	}
+	if tree.ndb.opts.SkipNoOpSets && current != nil && bytes.Equal(current, newValue) {
+		return true, nil
+	}
+	if _, err := tree.set(key, newValue); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasValue returns whether the key has the given value in the working tree.
+func (tree *MutableTree) hasValue(key, value []byte) (bool, error) {
+	if tree.ImmutableTree.root == nil {
+		return false, nil
+	}
+	_, existing, err := tree.ImmutableTree.root.get(tree.ImmutableTree, key)
+	if err != nil {
+		return false, err
+	}
+	return existing != nil && bytes.Equal(existing, value), nil
+}
+
+// Get returns the value of the specified key if it exists, or nil otherwise. A key set to an
+// empty value returns a non-nil empty slice.
+// The returned value is a copy, unless the UnsafeNoCopy option is set.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	value, err := tree.getWorking(key)
+	return tree.ndb.liveValue(value), err
+}
+
+// getWorking is like Get, but returns the tombstones of a tree with soft deletes.
+func (tree *MutableTree) getWorking(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
 	if tree.root == nil {
 		return nil, nil
 	}
 
+	// the leaves are never modified, so the last one set holds the value until it is removed or
+	// the working tree is replaced.
+	if leaf := tree.lastSet; leaf != nil && tree.lastSetIn == tree.ImmutableTree && bytes.Equal(leaf.key, key) {
+		return tree.ndb.copyBytes(leaf.value), nil
+	}
+
 	if !tree.skipFastStorageUpgrade {
 		if fastNode, ok := tree.unsavedFastNodeAdditions.Load(ibytes.UnsafeBytesToStr(key)); ok {
-			return fastNode.(*fastnode.Node).GetValue(), nil
+			return tree.ndb.copyBytes(fastNode.(*fastnode.Node).GetValue()), nil
 		}
 		// check if node was deleted
 		if _, ok := tree.unsavedFastNodeRemovals.Load(string(key)); ok {
@@ -182,7 +492,7 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 		}
 	}
 
-	return tree.ImmutableTree.Get(key)
+	return tree.ImmutableTree.getStored(key)
 }
 
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
@@ -197,14 +507,14 @@ func (tree *MutableTree) Import(version int64) (*Importer, error) {
 	return newImporter(tree, version)
 }
 
-// Iterate iterates over all keys of the tree. The keys and values must not be modified,
-// since they may point to data stored within IAVL. Returns true if stopped by callnack, false otherwise
+// Iterate iterates over all keys of the tree. The keys and values are copies, unless the
+// UnsafeNoCopy option is set. Returns true if stopped by callnack, false otherwise
 func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
 	if tree.root == nil {
 		return false, nil
 	}
 
-	if tree.skipFastStorageUpgrade {
+	if tree.skipFastStorageUpgrade || tree.ndb.opts.Comparator != nil {
 		return tree.ImmutableTree.Iterate(fn)
 	}
 
@@ -216,7 +526,7 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 		return tree.ImmutableTree.Iterate(fn)
 	}
 
-	itr := NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
+	itr := tree.ndb.filterTombstones(NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals))
 	defer itr.Close()
 	for ; itr.Valid(); itr.Next() {
 		if fn(itr.Key(), itr.Value()) {
@@ -226,17 +536,39 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 	return false, nil
 }
 
-// Iterator returns an iterator over the mutable tree.
+// IterateWorking iterates the current state of the tree in ascending key order, i.e. the last
+// saved version with the unsaved changes applied: the keys set since are yielded with their new
+// value, and the keys removed since are skipped. It walks the nodes of the working tree, which
+// shares the unchanged subtrees with the last saved version, so unlike Iterate it doesn't
+// reconcile the fast nodes with the unsaved ones. The iteration stops when fn returns true.
+func (tree *MutableTree) IterateWorking(fn func(key, value []byte) bool) (stopped bool, err error) {
+	if tree.root == nil {
+		return false, nil
+	}
+
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if fn(itr.Key(), itr.Value()) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// Iterator returns an iterator over the mutable tree. The keys and values it returns are
+// copies, unless the UnsafeNoCopy option is set.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
-	if !tree.skipFastStorageUpgrade {
+	if !tree.skipFastStorageUpgrade && tree.ndb.opts.Comparator == nil {
 		isFastCacheEnabled, err := tree.IsFastCacheEnabled()
 		if err != nil {
 			return nil, err
 		}
 
 		if isFastCacheEnabled {
-			return NewUnsavedFastIterator(start, end, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals), nil
+			itr := NewUnsavedFastIterator(start, end, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
+			return tree.ndb.trackIterator(tree.ndb.filterTombstones(itr)), nil
 		}
 	}
 
@@ -252,32 +584,74 @@ func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error)
 		if !tree.skipFastStorageUpgrade {
 			tree.addUnsavedAddition(key, fastnode.NewNode(key, value, tree.version+1))
 		}
-		tree.ImmutableTree.root = NewNode(key, value)
+		tree.addUnsavedChange(key, value, false)
+		tree.ImmutableTree.root = tree.newSetLeaf(key, value)
 		return updated, nil
 	}
 
-	tree.ImmutableTree.root, updated, err = tree.recursiveSet(tree.ImmutableTree.root, key, value)
+	tree.ImmutableTree.root, updated, err = tree.recursiveSet(tree.ImmutableTree.root, key, func([]byte) []byte {
+		return value
+	})
 	return updated, err
 }
 
-func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
+// Append appends suffix to the value of key in the working tree, in a single descent of the
+// tree instead of a Get followed by a Set. If the key doesn't exist, it is created with suffix
+// as its value. It returns the length of the new value. The suffix is copied, so it may be
+// modified after this call.
+func (tree *MutableTree) Append(key, suffix []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+	if suffix == nil {
+		suffix = []byte{}
+	}
+	var newValue []byte
+	appendFn := func(existing []byte) []byte {
+		// never write into the spare capacity of the existing value, it may be shared.
+		newValue = make([]byte, 0, len(existing)+len(suffix))
+		newValue = append(append(newValue, existing...), suffix...)
+		return newValue
+	}
+
+	if tree.ImmutableTree.root == nil {
+		value := appendFn(nil)
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedAddition(key, fastnode.NewNode(key, value, tree.version+1))
+		}
+		tree.addUnsavedChange(key, value, false)
+		tree.ImmutableTree.root = tree.newSetLeaf(key, value)
+		return len(value), nil
+	}
+
+	root, _, err := tree.recursiveSet(tree.ImmutableTree.root, key, appendFn)
+	if err != nil {
+		return 0, err
+	}
+	tree.ImmutableTree.root = root
+	return len(newValue), nil
+}
+
+// recursiveSet sets key to the value returned by valueFn, which is given the current value of
+// the key, or nil if it doesn't exist.
+func (tree *MutableTree) recursiveSet(node *Node, key []byte, valueFn func(existing []byte) []byte) (
 	newSelf *Node, updated bool, err error,
 ) {
 	if node.isLeaf() {
-		return tree.recursiveSetLeaf(node, key, value)
+		return tree.recursiveSetLeaf(node, key, valueFn)
 	}
-	node, err = node.clone(tree)
+	node, err = tree.cloneReplacing(node)
 	if err != nil {
 		return nil, false, err
 	}
 
-	if bytes.Compare(key, node.key) < 0 {
-		node.leftNode, updated, err = tree.recursiveSet(node.leftNode, key, value)
+	if tree.ndb.compare(key, node.key) < 0 {
+		node.leftNode, updated, err = tree.recursiveSet(node.leftNode, key, valueFn)
 		if err != nil {
 			return nil, updated, err
 		}
 	} else {
-		node.rightNode, updated, err = tree.recursiveSet(node.rightNode, key, value)
+		node.rightNode, updated, err = tree.recursiveSet(node.rightNode, key, valueFn)
 		if err != nil {
 			return nil, updated, err
 		}
@@ -297,21 +671,34 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 	return newNode, updated, err
 }
 
-func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, value []byte) (
+func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, valueFn func(existing []byte) []byte) (
 	newSelf *Node, updated bool, err error,
 ) {
+	cmp := tree.ndb.compare(key, node.key)
+	var value []byte
+	if cmp == 0 {
+		existing, err := tree.ndb.leafValue(node)
+		if err != nil {
+			return nil, false, err
+		}
+		value = valueFn(existing)
+	} else {
+		value = valueFn(nil)
+	}
+
 	version := tree.version + 1
 	if !tree.skipFastStorageUpgrade {
 		tree.addUnsavedAddition(key, fastnode.NewNode(key, value, version))
 	}
-	switch bytes.Compare(key, node.key) {
+	tree.addUnsavedChange(key, value, cmp == 0)
+	switch cmp {
 	case -1: // setKey < leafKey
 		return &Node{
 			key:           node.key,
 			subtreeHeight: 1,
 			size:          2,
 			nodeKey:       nil,
-			leftNode:      NewNode(key, value),
+			leftNode:      tree.newSetLeaf(key, value),
 			rightNode:     node,
 		}, false, nil
 	case 1: // setKey > leafKey
@@ -321,16 +708,35 @@ func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, value []byte)
 			size:          2,
 			nodeKey:       nil,
 			leftNode:      node,
-			rightNode:     NewNode(key, value),
+			rightNode:     tree.newSetLeaf(key, value),
 		}, false, nil
 	default:
-		return NewNode(key, value), true, nil
+		return tree.newSetLeaf(key, value), true, nil
 	}
 }
 
+// newSetLeaf returns a new leaf for a key being set, and remembers it for Get.
+func (tree *MutableTree) newSetLeaf(key, value []byte) *Node {
+	leaf := NewNode(key, value)
+	tree.lastSet, tree.lastSetIn = leaf, tree.ImmutableTree
+	tree.ndb.addToBloomFilter(key)
+	return leaf
+}
+
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	if len(key) == 0 {
+		return nil, false, ErrEmptyKey
+	}
+	if tree.ndb.softDeletes() {
+		return tree.softRemove(key)
+	}
+	return tree.remove(key)
+}
+
+// remove removes the key from the working tree, see Remove, even with soft deletes.
+func (tree *MutableTree) remove(key []byte) ([]byte, bool, error) {
 	if tree.root == nil {
 		return nil, false, nil
 	}
@@ -345,6 +751,10 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	if !tree.skipFastStorageUpgrade {
 		tree.addUnsavedRemoval(key)
 	}
+	tree.addUnsavedChange(key, nil, true)
+	if tree.lastSet != nil && bytes.Equal(tree.lastSet.key, key) {
+		tree.lastSet = nil
+	}
 
 	tree.root = newRoot
 	return value, true, nil
@@ -360,7 +770,11 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 	tree.logger.Debug("recursiveRemove", "node", node, "key", key)
 	if node.isLeaf() {
 		if bytes.Equal(key, node.key) {
-			return nil, nil, node.value, true, nil
+			value, err := tree.ndb.leafValue(node)
+			if err != nil {
+				return nil, nil, nil, false, err
+			}
+			return nil, nil, value, true, nil
 		}
 		return node, nil, nil, false, nil
 	}
@@ -371,7 +785,7 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 	}
 
 	// node.key < key; we go to the left to find the key:
-	if bytes.Compare(key, node.key) < 0 {
+	if tree.ndb.compare(key, node.key) < 0 {
 		newLeftNode, newKey, value, removed, err := tree.recursiveRemove(node.leftNode, key)
 		if err != nil {
 			return nil, nil, nil, false, err
@@ -435,6 +849,44 @@ func (tree *MutableTree) Load() (int64, error) {
 
 // Returns the version number of the specific version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	return tree.LoadVersionContext(context.Background(), targetVersion)
+}
+
+// LoadVersionContext is like LoadVersion, but the fast storage migration that it may run stops
+// once ctx is done, returning its error. The progress of the migration is checkpointed, so it
+// resumes on the next load instead of starting over. With the AsyncFastStorageMigration option,
+// the migration runs in the background instead, see WaitForFastStorageMigration.
+func (tree *MutableTree) LoadVersionContext(ctx context.Context, targetVersion int64) (int64, error) {
+	ctx, span := tree.ndb.startSpan(ctx, "iavl.LoadVersion")
+	defer span.End()
+
+	// a failed background migration is retried below.
+	_ = tree.WaitForFastStorageMigration()
+
+	// an operation interrupted by a crash is repaired first, since it may change the versions.
+	repair, err := tree.ndb.repairCommit()
+	if err != nil {
+		return 0, err
+	}
+	tree.lastRepair = repair
+
+	if err := tree.ndb.checkHashScheme(); err != nil {
+		return 0, err
+	}
+	if err := tree.ndb.checkNodeEncoding(); err != nil {
+		return 0, err
+	}
+
+	// the legacy nodes are rewritten before loading the root, which may be one of them.
+	if tree.ndb.opts.MigrateLegacyNodes {
+		tree.ndb.writeMtx.Lock()
+		_, err := tree.ndb.migrateNodeKeys(ctx, &tree.nodeKeyMigrationDone, &tree.nodeKeyMigrationTotal)
+		tree.ndb.writeMtx.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	firstVersion, err := tree.ndb.getFirstVersion()
 	if err != nil {
 		return 0, err
@@ -464,9 +916,17 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 			if !tree.skipFastStorageUpgrade {
 				tree.mtx.Lock()
 				defer tree.mtx.Unlock()
-				_, err := tree.enableFastStorageAndCommitIfNotEnabled()
+				if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
+					return 0, err
+				}
+			}
+			if err := tree.syncLatestStore(); err != nil {
+				return 0, err
+			}
+			if err := tree.syncBloomFilter(); err != nil {
 				return 0, err
 			}
+			tree.loaded.Store(true)
 			return 0, nil
 		}
 		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
@@ -497,43 +957,124 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	}
 
 	tree.ImmutableTree = iTree
-	tree.lastSaved = iTree.clone()
+	tree.setLastSaved(iTree.clone())
+	// the versions may have been written otherwise than by SaveVersion, e.g. by an Importer.
+	tree.rootHashIndex = nil
+
+	if err := tree.syncLatestStore(); err != nil {
+		return 0, err
+	}
+	if err := tree.syncBloomFilter(); err != nil {
+		return 0, err
+	}
+
+	if tree.ndb.opts.CompactOrphans {
+		if _, err := tree.ndb.migrateOrphanFormat(); err != nil {
+			return 0, err
+		}
+	}
 
 	if !tree.skipFastStorageUpgrade {
 		// Attempt to upgrade
-		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
+		if tree.ndb.opts.AsyncFastStorageMigration {
+			if err := tree.startFastStorageMigration(ctx); err != nil {
+				return 0, err
+			}
+		} else if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
 			return 0, err
 		}
 	}
 
+	tree.loaded.Store(true)
 	return latestVersion, nil
 }
 
-// loadVersionForOverwriting attempts to load a tree at a previously committed
-// version, or the latest version below it. Any versions greater than targetVersion will be deleted.
-func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
-	if _, err := tree.LoadVersion(targetVersion); err != nil {
-		return err
-	}
+// deleteVersionsFrom deletes the versions from fromVersion on, and commits the deletion. The
+// fast storage migration which may follow takes writeMtx itself.
+func (tree *MutableTree) deleteVersionsFrom(fromVersion int64) error {
+	tree.ndb.writeMtx.Lock()
+	defer tree.ndb.writeMtx.Unlock()
 
-	if err := tree.ndb.DeleteVersionsFrom(targetVersion + 1); err != nil {
+	tree.immutableCache.reset()
+	if err := tree.ndb.DeleteVersionsFrom(fromVersion); err != nil {
 		return err
 	}
 
 	// Commit the tree rollback first
 	// The fast storage rebuild don't have to be atomic with this,
 	// because it's idempotent and will do again when `LoadVersion`.
-	if err := tree.ndb.Commit(); err != nil {
+	return tree.ndb.Commit()
+}
+
+// loadVersionForOverwriting attempts to load a tree at a previously committed
+// version, or the latest version below it. Any versions greater than targetVersion will be deleted.
+func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
+	if _, err := tree.LoadVersion(targetVersion); err != nil {
+		return err
+	}
+	// the versions can't be deleted under a background migration, which is redone below anyway.
+	_ = tree.WaitForFastStorageMigration()
+	if err := tree.deleteVersionsFrom(targetVersion + 1); err != nil {
 		return err
 	}
 
 	if !tree.skipFastStorageUpgrade {
 		// it'll repopulates the fast node index because of version mismatch.
-		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
+		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background()); err != nil {
 			return err
 		}
 	}
 
+	// the bloom filter dropped along with the versions is rebuilt from the loaded one.
+	return tree.syncBloomFilter()
+}
+
+// UncommitLatest deletes the latest saved version from disk, and loads the version before it
+// as the working tree, discarding any unsaved changes. It returns the version loaded. It fails
+// if the latest version is the only one available, e.g. after pruning. The fast nodes are
+// rebuilt from the loaded version, as in LoadVersionForOverwriting.
+func (tree *MutableTree) UncommitLatest() (previousVersion int64, err error) {
+	latest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	first, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	if latest <= first {
+		return 0, fmt.Errorf("cannot uncommit version %d, no previous version is available: %w", latest, ErrVersionDoesNotExist)
+	}
+
+	previousVersion = latest - 1
+	for previousVersion > first && !tree.VersionExists(previousVersion) {
+		// pruned between retained versions, the first version being retained.
+		previousVersion--
+	}
+	if err := tree.RollbackToVersion(previousVersion); err != nil {
+		return 0, err
+	}
+	return previousVersion, nil
+}
+
+// RollbackToVersion deletes all the saved versions above version from disk, and loads version as
+// the working tree, discarding any unsaved changes, e.g. to recover from a bad upgrade without
+// editing the database by hand. Unlike LoadVersionForOverwriting, version must be available. The
+// fast nodes are rebuilt from the loaded version, as in LoadVersionForOverwriting.
+func (tree *MutableTree) RollbackToVersion(version int64) error {
+	latest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if version > latest || !tree.VersionExists(version) {
+		return fmt.Errorf("cannot roll back to version %d, the latest version being %d: %w", version, latest, ErrVersionDoesNotExist)
+	}
+	if err := tree.LoadVersionForOverwriting(version); err != nil {
+		return err
+	}
+	// the unsaved fast nodes are left by the loading.
+	tree.Rollback()
+	tree.rootHashIndex = nil
 	return nil
 }
 
@@ -550,9 +1091,9 @@ func (tree *MutableTree) IsUpgradeable() (bool, error) {
 
 // enableFastStorageAndCommitIfNotEnabled if nodeDB doesn't mark fast storage as enabled, enable it, and commit the update.
 // Checks whether the fast cache on disk matches latest live state. If not, deletes all existing fast nodes and repopulates them
-// from latest tree.
+// from latest tree. The migration is checkpointed and resumed if it was interrupted, see enableFastStorageAndCommit.
 
-func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error) {
+func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled(ctx context.Context) (bool, error) {
 	isUpgradeable, err := tree.IsUpgradeable()
 	if err != nil {
 		return false, err
@@ -562,44 +1103,109 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 		return false, nil
 	}
 
-	// If there is a mismatch between which fast nodes are on disk and the live state due to temporary
-	// downgrade and subsequent re-upgrade, we cannot know for sure which fast nodes have been removed while downgraded,
-	// Therefore, there might exist stale fast nodes on disk. As a result, to avoid persisting the stale state, it might
-	// be worth to delete the fast nodes from disk.
-	fastItr := NewFastIterator(nil, nil, true, tree.ndb)
-	defer fastItr.Close()
-	var deletedFastNodes uint64
-	for ; fastItr.Valid(); fastItr.Next() {
-		deletedFastNodes++
-		if err := tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
-			return false, err
-		}
-	}
-
-	if err := tree.enableFastStorageAndCommit(); err != nil {
-		tree.ndb.storageVersion = defaultStorageVersionValue
+	tree.ndb.setFastStorageMigrating(true)
+	if err := tree.enableFastStorageAndCommit(ctx, tree.ImmutableTree); err != nil {
+		tree.ndb.endFastStorageMigration(false)
 		return false, err
 	}
+	tree.ndb.endFastStorageMigration(true)
 	return true, nil
 }
 
-func (tree *MutableTree) enableFastStorageAndCommit() error {
-	var err error
+// enableFastStorageAndCommit writes the fast nodes of the tree t. Progress is committed with a
+// checkpoint every FastStorageMigrationChunkSize fast nodes, and the context is only
+// checked at the checkpoints, so that a cancelled migration resumes from where it stopped.
+// Each chunk is written and committed under writeMtx, which is released at the checkpoints,
+// so that the batch isn't shared with a concurrent deletion of versions, e.g. while the
+// migration runs in the background.
+func (tree *MutableTree) enableFastStorageAndCommit(ctx context.Context, t *ImmutableTree) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tree.ndb.writeMtx.Lock()
+	defer tree.ndb.writeMtx.Unlock()
 
-	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	checkpoint, err := tree.ndb.getFastStorageMigrationCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	var start []byte
+	checkpointed := checkpoint != nil
+	if checkpoint != nil && checkpoint.version == t.version {
+		// the stale fast nodes were already deleted, and the fast nodes up to the checkpoint key
+		// written.
+		start = checkpoint.key
+	} else {
+		if checkpoint != nil {
+			tree.logger.Info("discarding fast storage migration checkpoint", "version", checkpoint.version)
+		}
+		checkpoint = &fastStorageMigrationCheckpoint{version: t.version}
+
+		// If there is a mismatch between which fast nodes are on disk and the live state due to temporary
+		// downgrade and subsequent re-upgrade, we cannot know for sure which fast nodes have been removed while downgraded,
+		// Therefore, there might exist stale fast nodes on disk. As a result, to avoid persisting the stale state, it might
+		// be worth to delete the fast nodes from disk.
+		fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+		defer fastItr.Close()
+		for ; fastItr.Valid(); fastItr.Next() {
+			if err := tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the fast nodes of the tombstones are written as well.
+	if t.root != nil {
+		tree.migrationTotal.Store(t.root.size)
+	} else {
+		tree.migrationTotal.Store(0)
+	}
+	tree.migrationDone.Store(checkpoint.upgraded)
+	tree.logger.Info("fast storage migration started", "version", t.version, "resumed", checkpoint.upgraded)
+
+	itr := NewIterator(start, nil, true, t)
 	defer itr.Close()
-	var upgradedFastNodes uint64
+	if start != nil && itr.Valid() && bytes.Equal(itr.Key(), start) {
+		// resume after the checkpoint key, which was already written.
+		itr.Next()
+	}
+	upgradedFastNodes := checkpoint.upgraded
+	chunkSize := tree.ndb.fastStorageMigrationChunkSize()
 	for ; itr.Valid(); itr.Next() {
 		upgradedFastNodes++
-		if err = tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), tree.version)); err != nil {
+		if err = tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), t.version)); err != nil {
 			return err
 		}
+		tree.migrationDone.Store(upgradedFastNodes)
+		if upgradedFastNodes%fastStorageMigrationLogInterval == 0 {
+			tree.logger.Info("fast storage migration progress", "upgraded", upgradedFastNodes)
+		}
+		if upgradedFastNodes%chunkSize == 0 {
+			checkpoint.key, checkpoint.upgraded = itr.Key(), upgradedFastNodes
+			if err := tree.ndb.saveFastStorageMigrationCheckpoint(checkpoint); err != nil {
+				return err
+			}
+			if err := tree.ndb.Commit(); err != nil {
+				return err
+			}
+			checkpointed = true
+			tree.logger.Debug("fast storage migration checkpoint", "upgraded", upgradedFastNodes)
+			// lets the writers waiting for the batch through.
+			tree.ndb.writeMtx.Unlock()
+			tree.ndb.writeMtx.Lock()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
 	}
 
 	if err = itr.Error(); err != nil {
 		return err
 	}
 
+	tree.logger.Info("fast storage migration finished", "upgraded", upgradedFastNodes)
+
 	latestVersion, err := tree.ndb.getLatestVersion()
 	if err != nil {
 		return err
@@ -608,13 +1214,32 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 	if err = tree.ndb.SetFastStorageVersionToBatch(latestVersion); err != nil {
 		return err
 	}
+	if checkpointed {
+		if err := tree.ndb.deleteFastStorageMigrationCheckpoint(); err != nil {
+			return err
+		}
+	}
 
 	return tree.ndb.Commit()
 }
 
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
+// The recently returned trees are cached, see the ImmutableTreeCacheSize option, so the same
+// instance may be returned for the same version.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	return tree.GetImmutableContext(context.Background(), version)
+}
+
+// GetImmutableContext is like GetImmutable, but the load is traced as a child of the span
+// carried by ctx, see the Tracer option.
+func (tree *MutableTree) GetImmutableContext(ctx context.Context, version int64) (*ImmutableTree, error) {
+	_, span := tree.ndb.startSpan(ctx, "iavl.GetImmutable")
+	defer span.End()
+
+	if itree := tree.immutableCache.get(version); itree != nil {
+		return itree, nil
+	}
 	rootNodeKey, err := tree.ndb.GetRoot(version)
 	if err != nil {
 		return nil, err
@@ -628,19 +1253,134 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 		}
 	}
 
-	return &ImmutableTree{
+	itree := &ImmutableTree{
 		root:                   root,
 		ndb:                    tree.ndb,
 		version:                version,
 		skipFastStorageUpgrade: tree.skipFastStorageUpgrade,
-	}, nil
+	}
+	tree.immutableCache.add(itree)
+	return itree, nil
+}
+
+// GetImmutableWarm is like GetImmutable, but also loads the nodes of the given number of top
+// levels of the tree of the version into the node cache, the root being the first one, so that
+// the queries of the version start with warm upper nodes rather than reading them from the
+// database. The levels are loaded breadth first, and no more nodes than the cache holds if it
+// tells its capacity, see cache.Bounded, so that the preload doesn't evict the nodes it loaded.
+func (tree *MutableTree) GetImmutableWarm(version int64, levels int) (*ImmutableTree, error) {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	if err := itree.warm(levels); err != nil {
+		return nil, err
+	}
+	return itree, nil
+}
+
+// GetImmutableByHash loads an ImmutableTree for the given root hash. If several versions share
+// the same root hash (i.e. identical state), the latest one is returned. It returns an error
+// wrapping ErrRootHashDoesNotExist if no available version has the given root hash.
+//
+// The root hash index is built lazily on the first call, by reading the root of every
+// available version, and kept up to date by SaveVersion afterwards. It is only rebuilt if an
+// entry is stale, e.g. due to pruning, so that looking up unknown hashes stays cheap.
+func (tree *MutableTree) GetImmutableByHash(rootHash []byte) (*ImmutableTree, error) {
+	if tree.rootHashIndex == nil {
+		if err := tree.buildRootHashIndex(); err != nil {
+			return nil, err
+		}
+	}
+	version, ok := tree.rootHashIndex[string(rootHash)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %X", ErrRootHashDoesNotExist, rootHash)
+	}
+	itree, err := tree.getImmutableWithHash(version, rootHash)
+	if err != nil || itree != nil {
+		return itree, err
+	}
+
+	// the entry is stale, so rebuild the index.
+	if err := tree.buildRootHashIndex(); err != nil {
+		return nil, err
+	}
+	if version, ok := tree.rootHashIndex[string(rootHash)]; ok {
+		return tree.GetImmutable(version)
+	}
+	return nil, fmt.Errorf("%w: %X", ErrRootHashDoesNotExist, rootHash)
+}
+
+// getImmutableWithHash loads the ImmutableTree at the given version if it still exists and
+// its root hash matches, returning nil otherwise.
+func (tree *MutableTree) getImmutableWithHash(version int64, rootHash []byte) (*ImmutableTree, error) {
+	if !tree.VersionExists(version) {
+		return nil, nil
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(itree.Hash(), rootHash) {
+		return nil, nil
+	}
+	return itree, nil
+}
+
+// VersionsEqual returns whether two versions are identical, by comparing their root hashes, and
+// their sizes as a cross-check, without walking the trees. Since the hashes of the leaves cover
+// the version at which they were set, versions whose keys were set to the same values again are
+// not identical. It returns an error wrapping ErrVersionDoesNotExist if either version doesn't
+// exist, e.g. once pruned.
+func (tree *MutableTree) VersionsEqual(a, b int64) (bool, error) {
+	var roots [2]*ImmutableTree
+	for i, version := range []int64{a, b} {
+		if !tree.VersionExists(version) {
+			return false, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+		}
+		itree, err := tree.GetImmutable(version)
+		if err != nil {
+			return false, err
+		}
+		roots[i] = itree
+	}
+	if !bytes.Equal(roots[0].Hash(), roots[1].Hash()) {
+		return false, nil
+	}
+	if roots[0].Size() != roots[1].Size() {
+		return false, fmt.Errorf("versions %d and %d have the same root hash %X, but %d and %d keys", a, b, roots[0].Hash(), roots[0].Size(), roots[1].Size())
+	}
+	return true, nil
+}
+
+// buildRootHashIndex indexes the root hashes of all available versions. It reads their roots
+// from the node database, so that the immutable trees cached by GetImmutable aren't evicted.
+func (tree *MutableTree) buildRootHashIndex() error {
+	index := make(map[string]int64)
+	for _, version := range tree.AvailableVersions() {
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		if err != nil {
+			return err
+		}
+		hash := tree.ndb.hashScheme().EmptyHash()
+		if rootKey != nil {
+			root, err := tree.ndb.GetNode(rootKey)
+			if err != nil {
+				return err
+			}
+			hash = root.hash
+		}
+		index[string(hash)] = int64(version)
+	}
+	tree.rootHashIndex = index
+	return nil
 }
 
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
 func (tree *MutableTree) Rollback() {
 	if tree.version > 0 {
-		tree.ImmutableTree = tree.lastSaved.clone()
+		tree.ImmutableTree = tree.lastSaved.Load().clone()
 	} else {
 		tree.ImmutableTree = &ImmutableTree{
 			ndb:                    tree.ndb,
@@ -652,11 +1392,19 @@ func (tree *MutableTree) Rollback() {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedChanges = nil
+	tree.unsavedTombstones = nil
+	if tree.concurrentSets != nil {
+		tree.concurrentSets.take()
+	}
 }
 
-// GetVersioned gets the value at the specified key and version. The returned value must not be
-// modified, since it may point to data stored within IAVL.
+// GetVersioned gets the value at the specified key and version. The returned value is a copy,
+// unless the UnsafeNoCopy option is set.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
 	if tree.VersionExists(version) {
 		if !tree.skipFastStorageUpgrade {
 			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
@@ -671,7 +1419,7 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error)
 				}
 
 				if fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= version {
-					return fastNode.GetValue(), nil
+					return tree.ndb.copyBytes(tree.ndb.liveValue(fastNode.GetValue())), nil
 				}
 			}
 		}
@@ -690,9 +1438,33 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error)
 
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
+//
+// An empty tree can be saved as well, e.g. at the initial version: the version is
+// committed with an empty root, becomes queryable, and its hash is EmptyHash().
+//
+// If writing the version fails, it isn't saved and the working tree is left unchanged, so that
+// SaveVersion can be retried.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	return tree.SaveVersionContext(context.Background())
+}
+
+// SaveVersionContext is like SaveVersion, but the save and its phases are traced as children
+// of the span carried by ctx, see the Tracer option.
+func (tree *MutableTree) SaveVersionContext(ctx context.Context) ([]byte, int64, error) {
+	ctx, span := tree.ndb.startSpan(ctx, "iavl.SaveVersion")
+	defer span.End()
+
 	version := tree.WorkingVersion()
 
+	if err := tree.WaitForFastStorageMigration(); err != nil {
+		return nil, version, fmt.Errorf("fast storage migration failed: %w", err)
+	}
+	if err := tree.ApplyConcurrentSets(); err != nil {
+		return nil, version, err
+	}
+	tree.ndb.writeMtx.Lock()
+	defer tree.ndb.writeMtx.Unlock()
+
 	if tree.VersionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
 		// However, the same hash means idempotent (i.e. no-op).
@@ -714,7 +1486,9 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			tree.version = version
 			tree.root = existingRoot
 			tree.ImmutableTree = tree.ImmutableTree.clone()
-			tree.lastSaved = tree.ImmutableTree.clone()
+			tree.setLastSaved(tree.ImmutableTree.clone())
+			tree.unsavedChanges = nil
+			tree.unsavedTombstones = nil
 			return newHash, version, nil
 		}
 
@@ -723,53 +1497,161 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 
 	tree.logger.Debug("SAVE TREE", "version", version)
 
-	// save new fast nodes
-	if !tree.skipFastStorageUpgrade {
+	if err := tree.ndb.checkHashScheme(); err != nil {
+		return nil, version, err
+	}
+	if err := tree.ndb.checkNodeEncoding(); err != nil {
+		return nil, version, err
+	}
+
+	// the writes are discarded and the working tree restored if any of them fails, so that the
+	// version isn't saved and SaveVersion can be retried.
+	var (
+		saved      []savedNode
+		legacyRoot *Node
+		working    *workingState
+		phase      Span
+	)
+	abort := func(err error) error {
+		if phase != nil {
+			phase.End()
+		}
+		if discardErr := tree.discardVersion(saved, legacyRoot); discardErr != nil {
+			tree.logger.Error("failed to discard the writes of the version", "version", version, "err", discardErr)
+		}
+		if working != nil {
+			tree.restoreWorkingState(working)
+		}
+		return err
+	}
+
+	if tree.ndb.softDeletes() {
+		working = tree.workingState()
+		if err := tree.collectTombstones(version); err != nil {
+			return nil, version, abort(err)
+		}
+	}
+
+	// the listeners are notified before anything is written, so that the version isn't committed
+	// if one of them fails.
+	if err := tree.notifyCommitListeners(version); err != nil {
+		return nil, version, abort(err)
+	}
+
+	_, phase = tree.ndb.startSpan(ctx, "iavl.SaveVersion.saveNodes")
+	if err := tree.ndb.beginCommit(commitSave, version, version); err != nil {
+		return nil, version, abort(err)
+	}
+
+	// save new fast nodes, unless they are committed in a batch of their own below.
+	separateFastNodes := !tree.skipFastStorageUpgrade && tree.ndb.opts.SeparateFastNodeBatch
+	if !tree.skipFastStorageUpgrade && !separateFastNodes {
 		if err := tree.saveFastNodeVersion(version); err != nil {
-			return nil, version, err
+			return nil, version, abort(err)
+		}
+	}
+	if tree.ndb.opts.LatestStore {
+		if err := tree.ndb.saveLatestChanges(version, tree.unsavedChanges); err != nil {
+			return nil, version, abort(err)
 		}
 	}
+	if tree.ndb.opts.StoreKeyCounts {
+		if err := tree.ndb.saveKeyCount(version, tree.Size()); err != nil {
+			return nil, version, abort(err)
+		}
+	}
+	if err := tree.ndb.saveBloomFilter(version); err != nil {
+		return nil, version, abort(err)
+	}
 	// save new nodes
+	var savedNodes, savedBytes int
 	if tree.root == nil {
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
-			return nil, 0, err
+			return nil, 0, abort(err)
 		}
 	} else {
 		if tree.root.nodeKey != nil {
 			// it means there are no updated nodes
 			if err := tree.ndb.SaveRoot(version, tree.root.nodeKey); err != nil {
-				return nil, 0, err
+				return nil, 0, abort(err)
 			}
 			// it means the reference node is a legacy node
 			if tree.root.isLegacy {
 				// it will update the legacy node to the new format
-				// which ensures the reference node is not a legacy node
-				tree.root.isLegacy = false
+				// which ensures the reference node is not a legacy node.
+				// The legacy node is shared with the saved versions, so a copy is converted.
+				converted := *tree.root
+				converted.isLegacy = false
+				legacyRoot = tree.root
+				tree.root = &converted
 				if err := tree.ndb.SaveNode(tree.root); err != nil {
-					return nil, 0, fmt.Errorf("failed to save the reference legacy node: %w", err)
+					return nil, 0, abort(fmt.Errorf("failed to save the reference legacy node: %w", err))
 				}
 			}
 		} else {
-			if err := tree.saveNewNodes(version); err != nil {
-				return nil, 0, err
+			var err error
+			savedNodes, savedBytes, saved, err = tree.saveNewNodes(version)
+			if err != nil {
+				return nil, 0, abort(err)
 			}
 		}
 	}
 
+	phase.End()
+
+	_, phase = tree.ndb.startSpan(ctx, "iavl.SaveVersion.commit")
 	if err := tree.ndb.Commit(); err != nil {
-		return nil, version, err
+		return nil, version, abort(err)
+	}
+	if tree.ndb.opts.SyncMode == SyncNone {
+		tree.unsyncedVersion = version
+	} else if tree.ndb.opts.OnFlush != nil && tree.ndb.coalescer == nil {
+		tree.ndb.opts.OnFlush(version)
+	}
+	// the version is committed, so a failure only leaves the fast storage stale.
+	var fastNodesErr error
+	if separateFastNodes && !tree.ndb.isFastStorageStale() {
+		fastNodesErr = tree.ndb.commitFastNodes(tree.getUnsavedFastNodeAdditions(), tree.getUnsavedFastNodeRemovals(), version)
 	}
+	var flushErr error
+	if tree.ndb.coalescer != nil {
+		flushErr = tree.ndb.coalescer.versionSaved(version)
+	}
+	phase.End()
 
 	tree.ndb.resetLatestVersion(version)
+	tree.ndb.bloomFilterSaved(version)
 	tree.version = version
+	tree.logger.Info("committed version", "version", version, "nodes", savedNodes, "bytes", savedBytes)
+	tree.notifySubscribers(version)
 
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
-	tree.lastSaved = tree.ImmutableTree.clone()
+	tree.setLastSaved(tree.ImmutableTree.clone())
+	if tree.rootHashIndex != nil {
+		tree.rootHashIndex[string(tree.Hash())] = version
+	}
 	if !tree.skipFastStorageUpgrade {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedChanges = nil
+	tree.unsavedTombstones = nil
+
+	if fastNodesErr != nil {
+		return nil, version, fmt.Errorf("version %d was saved, but writing its fast nodes failed, the fast storage is rebuilt on the next load: %w", version, fastNodesErr)
+	}
+	if flushErr != nil {
+		return nil, version, fmt.Errorf("version %d was saved, but writing the coalesced versions failed, they are written by the next flush: %w", version, flushErr)
+	}
+	_, phase = tree.ndb.startSpan(ctx, "iavl.SaveVersion.prune")
+	defer phase.End()
+	if err := tree.prune(version); err != nil {
+		return nil, version, fmt.Errorf("version %d was saved, but pruning failed: %w", version, err)
+	}
+	if err := tree.pruneMaxRetained(version); err != nil {
+		return nil, version, fmt.Errorf("version %d was saved, but pruning the versions beyond the cap failed: %w", version, err)
+	}
 
 	return tree.Hash(), version, nil
 }
@@ -835,6 +1717,35 @@ func (tree *MutableTree) addUnsavedRemoval(key []byte) {
 	tree.unsavedFastNodeRemovals.Store(skey, true)
 }
 
+// unsavedChange is the latest change of a key in the working tree.
+type unsavedChange struct {
+	value   []byte // nil if the key was removed
+	existed bool   // whether the key existed in the last saved version
+}
+
+// noop returns true if the key was added and then removed again.
+func (c unsavedChange) noop() bool {
+	return c.value == nil && !c.existed
+}
+
+// addUnsavedChange records a change of the working tree, to write to the latest store and pass
+// to the commit listeners and the subscribers on the next SaveVersion. A nil value records a removal, and existed
+// tells whether the key existed before the change.
+func (tree *MutableTree) addUnsavedChange(key, value []byte, existed bool) {
+	if !tree.ndb.opts.LatestStore && len(tree.commitListeners) == 0 && len(tree.subscriptions) == 0 {
+		return
+	}
+	if tree.unsavedChanges == nil {
+		tree.unsavedChanges = make(map[string]unsavedChange)
+	}
+	change, ok := tree.unsavedChanges[string(key)]
+	if !ok {
+		change.existed = existed
+	}
+	change.value = value
+	tree.unsavedChanges[string(key)] = change
+}
+
 func (tree *MutableTree) saveFastNodeRemovals() error {
 	keysToSort := make([]string, 0)
 	tree.unsavedFastNodeRemovals.Range(func(k, v interface{}) bool {
@@ -851,6 +1762,23 @@ func (tree *MutableTree) saveFastNodeRemovals() error {
 	return nil
 }
 
+// Sync durably writes the versions saved without syncing them with the SyncNone mode, and then
+// calls the OnFlush option with the latest of them. It is a no-op if there is none.
+func (tree *MutableTree) Sync() error {
+	if tree.unsyncedVersion == 0 {
+		return nil
+	}
+	if err := tree.ndb.sync(); err != nil {
+		return err
+	}
+	version := tree.unsyncedVersion
+	tree.unsyncedVersion = 0
+	if tree.ndb.opts.OnFlush != nil {
+		tree.ndb.opts.OnFlush(version)
+	}
+	return nil
+}
+
 // SetInitialVersion sets the initial version of the tree, replacing Options.InitialVersion.
 // It is only used during the initial SaveVersion() call for a tree with no other versions,
 // and is otherwise ignored.
@@ -861,6 +1789,18 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 // DeleteVersionsTo removes versions upto the given version from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
 func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
+	return tree.DeleteVersionsToContext(context.Background(), toVersion)
+}
+
+// DeleteVersionsToContext is like DeleteVersionsTo, but the deletion is traced as a child of
+// the span carried by ctx, see the Tracer option.
+func (tree *MutableTree) DeleteVersionsToContext(ctx context.Context, toVersion int64) error {
+	_, span := tree.ndb.startSpan(ctx, "iavl.DeleteVersionsTo")
+	defer span.End()
+
+	tree.ndb.writeMtx.Lock()
+	defer tree.ndb.writeMtx.Unlock()
+	tree.immutableCache.reset()
 	if err := tree.ndb.DeleteVersionsTo(toVersion); err != nil {
 		return err
 	}
@@ -868,16 +1808,46 @@ func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
 	return tree.ndb.Commit()
 }
 
+// PruneKeepRecent deletes all but the latest n available versions, using DeleteVersionsTo. It
+// is a no-op if there are at most n versions, and PruneKeepRecent(1) keeps only the latest
+// version (but see KeepOnlyLatest for trees with legacy versions).
+func (tree *MutableTree) PruneKeepRecent(n int64) error {
+	if n < 1 {
+		return fmt.Errorf("at least one version must be kept, got %d: %w", n, ErrInvalidInputs)
+	}
+	versions := tree.AvailableVersions()
+	if int64(len(versions)) <= n {
+		return nil
+	}
+	return tree.DeleteVersionsTo(int64(versions[int64(len(versions))-n-1]))
+}
+
+// KeepOnlyLatest deletes every version except the latest one, leaving a tree which only
+// serves queries and proofs for the latest version. Unlike DeleteVersionsTo(latest-1), it
+// also removes the legacy versions synchronously, so that a single version remains once
+// it returns. Fast nodes always reflect the latest version and are kept as they are.
+func (tree *MutableTree) KeepOnlyLatest() error {
+	tree.ndb.writeMtx.Lock()
+	defer tree.ndb.writeMtx.Unlock()
+	tree.immutableCache.reset()
+	if err := tree.ndb.KeepOnlyLatest(); err != nil {
+		return err
+	}
+
+	return tree.ndb.Commit()
+}
+
 // Rotate right and return the new node and orphan.
 func (tree *MutableTree) rotateRight(node *Node) (*Node, error) {
+	tree.ndb.notifyRotation()
 	var err error
 	// TODO: optimize balance & rotate.
-	node, err = node.clone(tree)
+	node, err = tree.cloneReplacing(node)
 	if err != nil {
 		return nil, err
 	}
 
-	newNode, err := node.leftNode.clone(tree)
+	newNode, err := tree.cloneReplacing(node.leftNode)
 	if err != nil {
 		return nil, err
 	}
@@ -900,14 +1870,15 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, error) {
 
 // Rotate left and return the new node and orphan.
 func (tree *MutableTree) rotateLeft(node *Node) (*Node, error) {
+	tree.ndb.notifyRotation()
 	var err error
 	// TODO: optimize balance & rotate.
-	node, err = node.clone(tree)
+	node, err = tree.cloneReplacing(node)
 	if err != nil {
 		return nil, err
 	}
 
-	newNode, err := node.rightNode.clone(tree)
+	newNode, err := tree.cloneReplacing(node.rightNode)
 	if err != nil {
 		return nil, err
 	}
@@ -1001,20 +1972,42 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 	return node, nil
 }
 
+// savedNode is the state of a new node before saveNewNodes assigned its node key, to restore it
+// if the version fails to be saved.
+type savedNode struct {
+	node                      *Node
+	leftNodeKey, rightNodeKey []byte
+	leftNode, rightNode       *Node
+}
+
 // saveNewNodes save new created nodes by the changes of the working tree.
+// It returns the number of saved nodes and their encoded size in bytes, and the nodes whose node
+// key it assigned, even if it fails, see discardVersion.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-func (tree *MutableTree) saveNewNodes(version int64) error {
+func (tree *MutableTree) saveNewNodes(version int64) (int, int, []savedNode, error) {
 	nonce := uint32(0)
 	newNodes := make([]*Node, 0)
+	var saved []savedNode
+	spillThreshold := tree.ndb.opts.SpillThreshold
+	savedNodes, savedBytes, pendingBytes := 0, 0, 0
 	var recursiveAssignKey func(*Node) ([]byte, error)
 	recursiveAssignKey = func(node *Node) ([]byte, error) {
 		if node.nodeKey != nil {
 			if node.nodeKey.nonce != 0 {
+				// hashes the saved leaf for its parent, unless it already is, see LazyHashing.
+				node._hash(node.nodeKey.version, tree.ndb.hashScheme())
 				return node.nodeKey.GetKey(), nil
 			}
 			return node.hash, nil
 		}
+		saved = append(saved, savedNode{
+			node:         node,
+			leftNodeKey:  node.leftNodeKey,
+			rightNodeKey: node.rightNodeKey,
+			leftNode:     node.leftNode,
+			rightNode:    node.rightNode,
+		})
 		nonce++
 		node.nodeKey = &NodeKey{
 			version: version,
@@ -1034,23 +2027,125 @@ func (tree *MutableTree) saveNewNodes(version int64) error {
 			}
 		}
 
-		node._hash(version)
-		newNodes = append(newNodes, node)
+		node._hash(version, tree.ndb.hashScheme())
+		if spillThreshold <= 0 {
+			newNodes = append(newNodes, node)
+			return node.nodeKey.GetKey(), nil
+		}
 
+		// the subtree of the node is written, so the node is written right away, and the
+		// batch spilled once it reaches the threshold, unless the node is the root, which is
+		// written by the commit.
+		node.leftNode, node.rightNode = nil, nil
+		if err := tree.ndb.SaveNode(node); err != nil {
+			return nil, err
+		}
+		size := node.encodedSize()
+		savedNodes++
+		savedBytes += size
+		pendingBytes += size
+		if pendingBytes >= spillThreshold && node != tree.root {
+			if err := tree.ndb.spill(); err != nil {
+				return nil, err
+			}
+			pendingBytes = 0
+		}
 		return node.nodeKey.GetKey(), nil
 	}
 
+	// the nodes are hashed beforehand when it is done concurrently, or timed for the
+	// OperationHook option, the keys being assigned in order below.
+	if tree.ndb.opts.HashWorkers > 1 || tree.ndb.opts.OperationHook != nil {
+		tree.hashWorkingTree(version)
+	}
 	if _, err := recursiveAssignKey(tree.root); err != nil {
-		return err
+		return 0, 0, saved, err
+	}
+	if spillThreshold > 0 {
+		return savedNodes, savedBytes, saved, nil
 	}
 
+	if tree.ndb.opts.SeparateFastNodeBatch {
+		// the nonces are assigned in pre-order, while the nodes are appended in post-order, so
+		// they are sorted to write the node keys in order, but for the root, which is written
+		// last so that the version is only found once all its nodes are written.
+		sort.Slice(newNodes[:len(newNodes)-1], func(i, j int) bool {
+			return newNodes[i].nodeKey.nonce < newNodes[j].nodeKey.nonce
+		})
+	}
 	for _, node := range newNodes {
+		// the node is frozen before SaveNode publishes it to the node cache, where the readers
+		// of the version may find it, see Snapshot.
+		node.leftNode, node.rightNode = nil, nil
 		if err := tree.ndb.SaveNode(node); err != nil {
-			return err
+			return 0, 0, saved, err
 		}
-		node.leftNode, node.rightNode = nil, nil
+		savedBytes += node.encodedSize()
 	}
 
+	return len(newNodes), savedBytes, saved, nil
+}
+
+// discardVersion discards the writes of a version which failed to be saved, and restores the
+// working tree as it was before SaveVersion, given the nodes saveNewNodes assigned a node key to
+// and the legacy root whose copy was converted, if any.
+func (tree *MutableTree) discardVersion(saved []savedNode, legacyRoot *Node) error {
+	nodes := make([]*Node, 0, len(saved)+1)
+	for _, s := range saved {
+		nodes = append(nodes, s.node)
+	}
+	if legacyRoot != nil {
+		nodes = append(nodes, tree.root)
+	}
+	var fastNodeKeys []string
+	if !tree.skipFastStorageUpgrade {
+		for key := range tree.getUnsavedFastNodeAdditions() {
+			fastNodeKeys = append(fastNodeKeys, key)
+		}
+	}
+	err := tree.ndb.discardBatch(nodes, fastNodeKeys)
+
+	for _, s := range saved {
+		s.node.nodeKey = nil
+		s.node.leftNodeKey, s.node.rightNodeKey = s.leftNodeKey, s.rightNodeKey
+		s.node.leftNode, s.node.rightNode = s.leftNode, s.rightNode
+	}
+	if legacyRoot != nil {
+		tree.root = legacyRoot
+	}
+	return err
+}
+
+// ValidateChangeSet checks that cs applies cleanly to the working tree, without applying it: its
+// keys must be sorted in ascending order and unique, so that a key can't be both set and deleted,
+// and the deleted keys must exist in the working tree. It returns ErrChangeSetUnsorted,
+// ErrChangeSetDuplicateKey or ErrKeyDoesNotExist respectively otherwise.
+func (tree *MutableTree) ValidateChangeSet(cs *ChangeSet) error {
+	if cs == nil {
+		return fmt.Errorf("nil change set: %w", ErrInvalidInputs)
+	}
+	for i, pair := range cs.Pairs {
+		if len(pair.Key) == 0 {
+			return fmt.Errorf("pair %d: %w", i, ErrEmptyKey)
+		}
+		if i > 0 {
+			switch cmp := tree.ndb.compare(cs.Pairs[i-1].Key, pair.Key); {
+			case cmp == 0:
+				return fmt.Errorf("key %X at pair %d: %w", pair.Key, i, ErrChangeSetDuplicateKey)
+			case cmp > 0:
+				return fmt.Errorf("key %X at pair %d: %w", pair.Key, i, ErrChangeSetUnsorted)
+			}
+		}
+		if pair.Delete {
+			has, err := tree.Has(pair.Key)
+			if err != nil {
+				return err
+			}
+			if !has {
+				return fmt.Errorf("deleted key %X at pair %d: %w", pair.Key, i, ErrKeyDoesNotExist)
+			}
+		}
+	}
 	return nil
 }
 
@@ -1071,7 +2166,12 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 				return 0, err
 			}
 		} else {
-			if _, err := tree.Set(pair.Key, pair.Value); err != nil {
+			value := pair.Value
+			// a pair decoded from proto3 has a nil value when it was set to an empty value.
+			if value == nil {
+				value = []byte{}
+			}
+			if _, err := tree.Set(pair.Key, value); err != nil {
 				return 0, err
 			}
 		}
@@ -1082,10 +2182,53 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 
 // Close closes the tree.
 func (tree *MutableTree) Close() error {
+	_ = tree.WaitForFastStorageMigration()
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
 	tree.ImmutableTree = nil
-	tree.lastSaved = nil
+	tree.lastSaved.Store(nil)
+	tree.closeSubscriptions()
 	return tree.ndb.Close()
 }
+
+// Reset rebinds the tree to db, after which it behaves as a tree returned by NewMutableTree
+// over db with the same arguments and options, e.g. Load must be called to load its versions.
+// The unsaved changes are discarded, and the caches are emptied but reused, which saves their
+// allocations when many short-lived trees are created, e.g. in tests. The commit listeners, the
+// subscriptions and the pruning policy are kept. The previous db is not closed.
+//
+// It fails if trees of the previous db returned by GetImmutable are still being iterated, and
+// waits for the prefetches and the fast storage migration in progress. The trees returned
+// before Reset must no longer be used.
+func (tree *MutableTree) Reset(db dbm.DB) error {
+	if db == nil {
+		return fmt.Errorf("db is nil: %w", ErrInvalidInputs)
+	}
+	_ = tree.WaitForFastStorageMigration()
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	if err := tree.ndb.reset(db); err != nil {
+		return err
+	}
+	head := &ImmutableTree{ndb: tree.ndb, skipFastStorageUpgrade: tree.skipFastStorageUpgrade}
+	tree.ImmutableTree = head
+	tree.setLastSaved(head.clone())
+	tree.unsavedFastNodeAdditions = &sync.Map{}
+	tree.unsavedFastNodeRemovals = &sync.Map{}
+	tree.unsavedChanges = nil
+	tree.unsavedTombstones = nil
+	if tree.concurrentSets != nil {
+		tree.concurrentSets.take()
+	}
+	tree.prunedTo = 0
+	tree.rootHashIndex = nil
+	tree.immutableCache.reset()
+	tree.loaded.Store(false)
+	tree.migrationDone.Store(0)
+	tree.migrationTotal.Store(0)
+	tree.migrationWait, tree.migrationErr = nil, nil
+	tree.unsyncedVersion = 0
+	return nil
+}
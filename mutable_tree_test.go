@@ -2,16 +2,23 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"cosmossdk.io/log"
+	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
+	ics23 "github.com/cosmos/ics23/go"
 
 	"github.com/cosmos/iavl/internal/encoding"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
@@ -324,6 +331,128 @@ func BenchmarkMutableTree_Set(b *testing.B) {
 	}
 }
 
+// BenchmarkMutableTree_HashingBlock compares a block of writes over the saved keys of a tree,
+// hashed once at the end, with and without the LazyHashing option.
+func BenchmarkMutableTree_HashingBlock(b *testing.B) {
+	const blockSize = 100000
+	keys := make([][]byte, blockSize)
+	for i := range keys {
+		keys[i] = iavlrand.RandBytes(16)
+	}
+
+	for _, bc := range []struct {
+		name string
+		lazy bool
+	}{
+		{"eager", false},
+		{"lazy", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, true, log.NewNopLogger(), LazyHashingOption(bc.lazy))
+			for _, key := range keys {
+				_, err := tree.Set(key, key)
+				require.NoError(b, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j, key := range keys {
+					if j%4 == 0 {
+						_, _, err = tree.Remove(key)
+					} else {
+						_, err = tree.Set(key, keys[(i+j)%blockSize])
+					}
+					require.NoError(b, err)
+				}
+				tree.WorkingHash()
+				tree.Rollback()
+			}
+		})
+	}
+}
+
+// unhashedSavedNodes returns the number of saved nodes of the working tree whose hash isn't
+// computed yet.
+func unhashedSavedNodes(node *Node) int {
+	if node == nil {
+		return 0
+	}
+	if node.nodeKey != nil {
+		if node.hash == nil {
+			return 1
+		}
+		return 0
+	}
+	return unhashedSavedNodes(node.leftNode) + unhashedSavedNodes(node.rightNode)
+}
+
+func TestMutableTree_LazyHashing(t *testing.T) {
+	for _, opts := range [][]Option{
+		{LazyHashingOption(true)},
+		{LazyHashingOption(true), HashWorkersOption(4)},
+	} {
+		eager := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+		lazy := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), opts...)
+
+		r := rand.New(rand.NewSource(7))
+		for v := 0; v < 5; v++ {
+			for i := 0; i < 500; i++ {
+				key := []byte(fmt.Sprintf("key-%d", r.Intn(1000)))
+				for _, tree := range []*MutableTree{eager, lazy} {
+					var err error
+					if i%5 == 0 {
+						_, _, err = tree.Remove(key)
+					} else {
+						_, err = tree.Set(key, []byte(fmt.Sprintf("value-%d-%d", v, i)))
+					}
+					require.NoError(t, err)
+				}
+			}
+			// the saved leaves read by the writes are hashed by WorkingHash only.
+			require.Zero(t, unhashedSavedNodes(eager.root))
+			if v > 0 {
+				require.NotZero(t, unhashedSavedNodes(lazy.root))
+			}
+			require.Equal(t, eager.WorkingHash(), lazy.WorkingHash())
+			require.Zero(t, unhashedSavedNodes(lazy.root))
+
+			// and by SaveVersion.
+			key := []byte(fmt.Sprintf("key-%d", r.Intn(1000)))
+			for _, tree := range []*MutableTree{eager, lazy} {
+				_, err := tree.Set(key, []byte("last"))
+				require.NoError(t, err)
+			}
+			eagerHash, _, err := eager.SaveVersion()
+			require.NoError(t, err)
+			lazyHash, _, err := lazy.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, eagerHash, lazyHash)
+		}
+
+		// the saved version reloads with the same hash, and the unhashed leaves weren't cached
+		// for the proofs.
+		reloaded := NewMutableTree(lazy.ndb.db, 0, false, log.NewNopLogger())
+		_, err := reloaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, eager.Hash(), reloaded.Hash())
+		for i := 0; i < 1000; i += 7 {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			value, err := lazy.Get(key)
+			require.NoError(t, err)
+			proof, err := lazy.GetProof(key)
+			require.NoError(t, err)
+			if value != nil {
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, lazy.Hash(), proof, key, value))
+			} else {
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, lazy.Hash(), proof, key))
+			}
+		}
+	}
+}
+
 func prepareTree(t *testing.T) *MutableTree {
 	mdb := dbm.NewMemDB()
 	tree := NewMutableTree(mdb, 1000, false, log.NewNopLogger())
@@ -733,7 +862,7 @@ func TestUpgradeStorageToFast_LatestVersion_Success(t *testing.T) {
 	isUpgradeable, err := tree.IsUpgradeable()
 	require.True(t, isUpgradeable)
 	require.NoError(t, err)
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 	isUpgradeable, err = tree.IsUpgradeable()
@@ -763,7 +892,7 @@ func TestUpgradeStorageToFast_AlreadyUpgraded_Success(t *testing.T) {
 	isUpgradeable, err := tree.IsUpgradeable()
 	require.True(t, isUpgradeable)
 	require.NoError(t, err)
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 	isFastCacheEnabled, err = tree.IsFastCacheEnabled()
@@ -774,7 +903,7 @@ func TestUpgradeStorageToFast_AlreadyUpgraded_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	// Test enabling fast storage when already enabled
-	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 	isFastCacheEnabled, err = tree.IsFastCacheEnabled()
@@ -820,7 +949,7 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 
 	batchMock := mock.NewMockBatch(ctrl)
 
-	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(2) // storage version, then migration checkpoint
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(1)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
 
@@ -840,7 +969,7 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, isFastCacheEnabled)
 
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.ErrorIs(t, err, expectedError)
 	require.False(t, enabled)
 
@@ -890,7 +1019,7 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 	require.False(t, shouldForce)
 	require.NoError(t, err)
 
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 }
@@ -917,6 +1046,8 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 
 	// dbMock represents the underlying database under the hood of nodeDB
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
+	// no interrupted migration to resume
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(fastStorageMigrationKey))).Return(nil, nil).Times(1)
 
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(2)
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
@@ -940,7 +1071,7 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	batchMock.EXPECT().GetByteSize().Return(100, nil).Times(2)
 	batchMock.EXPECT().Delete(fastKeyFormat.Key(fastNodeKeyToDelete)).Return(nil).Times(1)
 	batchMock.EXPECT().Set(metadataKeyFormat.Key([]byte(storageVersionKey)), updatedExpectedStorageVersion).Return(nil).Times(1)
-	batchMock.EXPECT().Write().Return(nil).Times(1)
+	batchMock.EXPECT().WriteSync().Return(nil).Times(1) // the default SyncBatch mode syncs commits
 	batchMock.EXPECT().Close().Return(nil).Times(1)
 
 	// iterMock is used to mock the underlying db iterator behing fast iterator
@@ -985,12 +1116,12 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	require.NoError(t, err)
 
 	// Actual method under test
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 
 	// Test that second time we call this, force upgrade does not happen
-	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 }
@@ -1142,7 +1273,7 @@ func TestUpgradeStorageToFast_Success(t *testing.T) {
 
 	for _, tt := range tests {
 		tree, mirror := setupTreeAndMirror(t, tt.fields.nodeCount, false)
-		enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+		enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 		require.Nil(t, err)
 		require.True(t, enabled)
 		t.Run(tt.name, func(t *testing.T) {
@@ -1198,7 +1329,7 @@ func TestUpgradeStorageToFast_Delete_Stale_Success(t *testing.T) {
 	for _, tt := range tests {
 		tree, mirror := setupTreeAndMirror(t, tt.fields.nodeCount, false)
 		addStaleKey(tree.ndb, tt.fields.staleCount)
-		enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+		enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 		require.Nil(t, err)
 		require.True(t, enabled)
 		t.Run(tt.name, func(t *testing.T) {
@@ -1450,3 +1581,2004 @@ func TestMutableTreeClose(t *testing.T) {
 
 	require.NoError(t, tree.Close())
 }
+
+func TestMutableTree_EmptyTreeAtInitialVersion(t *testing.T) {
+	emptyHash := sha256.Sum256(nil)
+	require.Equal(t, emptyHash[:], EmptyHash())
+
+	memDB := dbm.NewMemDB()
+	tree := NewMutableTree(memDB, 0, false, log.NewNopLogger(), InitialVersionOption(100))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, EmptyHash(), tree.Hash())
+	require.Equal(t, EmptyHash(), tree.WorkingHash())
+
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 100, version)
+	require.Equal(t, EmptyHash(), hash)
+	require.Equal(t, EmptyHash(), tree.Hash())
+
+	require.True(t, tree.VersionExists(100))
+	require.Equal(t, []int{100}, tree.AvailableVersions())
+	itree, err := tree.GetImmutable(100)
+	require.NoError(t, err)
+	require.Equal(t, EmptyHash(), itree.Hash())
+	require.EqualValues(t, 0, itree.Size())
+	value, err := tree.GetVersioned([]byte("a"), 100)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// the empty hash does not depend on the initial version
+	other := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), InitialVersionOption(7))
+	otherHash, _, err := other.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, hash, otherHash)
+
+	// reloading keeps the empty version and new versions can be built on top of it
+	tree = NewMutableTree(memDB, 0, false, log.NewNopLogger(), InitialVersionOption(100))
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 100, version)
+	require.Equal(t, EmptyHash(), tree.Hash())
+
+	_, err = tree.Set([]byte("a"), []byte{0x01})
+	require.NoError(t, err)
+	hash, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 101, version)
+	require.NotEqual(t, EmptyHash(), hash)
+}
+
+func TestMutableTree_KeepOnlyLatest(t *testing.T) {
+	memDB := dbm.NewMemDB()
+	tree := NewMutableTree(memDB, 0, false, log.NewNopLogger())
+
+	for v := 1; v <= 10; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", (v*7+i)%50)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		if v%3 == 0 {
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hash := tree.Hash()
+	latest, err := tree.GetImmutable(10)
+	require.NoError(t, err)
+	contents := latest.String()
+
+	require.NoError(t, tree.KeepOnlyLatest())
+
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+	require.False(t, tree.VersionExists(9))
+	require.True(t, tree.VersionExists(10))
+	require.Equal(t, hash, tree.Hash())
+
+	// only the nodes of the latest version are left
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, latest.nodeSize())
+
+	// the latest version still answers queries and proofs, also after reloading
+	tree = NewMutableTree(memDB, 0, false, log.NewNopLogger())
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, version)
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+	require.Equal(t, hash, tree.Hash())
+
+	itree, err := tree.GetImmutable(10)
+	require.NoError(t, err)
+	require.Equal(t, contents, itree.String())
+	key, value, err := itree.GetByIndex(0)
+	require.NoError(t, err)
+	proof, err := itree.GetMembershipProof(key)
+	require.NoError(t, err)
+	ok, err := itree.VerifyMembership(proof, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	value2, err := tree.GetVersioned(key, 10)
+	require.NoError(t, err)
+	require.Equal(t, value, value2)
+
+	// calling it again is a no-op
+	require.NoError(t, tree.KeepOnlyLatest())
+	require.Equal(t, []int{10}, tree.AvailableVersions())
+
+	// new versions can be saved on top
+	_, err = tree.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, version)
+	require.Equal(t, []int{10, 11}, tree.AvailableVersions())
+}
+
+func TestMutableTree_GetImmutableByHash(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	var hashes [][]byte
+	save := func() {
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	save() // v1
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	save() // v2
+	save() // v3, identical state to v2
+	require.Equal(t, hashes[1], hashes[2])
+
+	for _, version := range []int64{1, 3} {
+		itree, err := tree.GetImmutableByHash(hashes[version-1])
+		require.NoError(t, err)
+		require.Equal(t, version, itree.Version())
+		require.Equal(t, hashes[version-1], itree.Hash())
+	}
+	itree, err := tree.GetImmutableByHash(hashes[1])
+	require.NoError(t, err)
+	value, err := itree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+
+	// versions saved after the index was built are found too
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	save() // v4
+	itree, err = tree.GetImmutableByHash(hashes[3])
+	require.NoError(t, err)
+	require.EqualValues(t, 4, itree.Version())
+	has, err := itree.Has([]byte("a"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// pruned versions are not found anymore
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	_, err = tree.GetImmutableByHash(hashes[0])
+	require.ErrorIs(t, err, ErrRootHashDoesNotExist)
+
+	_, err = tree.GetImmutableByHash([]byte("unknown"))
+	require.ErrorIs(t, err, ErrRootHashDoesNotExist)
+
+	// the index is built without loading the trees, and unknown hashes don't rebuild it.
+	tree.rootHashIndex = nil
+	tree.immutableCache.reset()
+	_, err = tree.GetImmutableByHash([]byte("unknown"))
+	require.ErrorIs(t, err, ErrRootHashDoesNotExist)
+	for _, version := range tree.AvailableVersions() {
+		require.Nil(t, tree.immutableCache.get(int64(version)))
+	}
+	tree.rootHashIndex["sentinel"] = 1
+	_, err = tree.GetImmutableByHash([]byte("unknown"))
+	require.ErrorIs(t, err, ErrRootHashDoesNotExist)
+	require.Contains(t, tree.rootHashIndex, "sentinel")
+	itree, err = tree.GetImmutableByHash(hashes[3])
+	require.NoError(t, err)
+	require.EqualValues(t, 4, itree.Version())
+}
+
+func TestMutableTree_EmptyKey(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), LatestStoreOption(true), ConcurrentSetOption(true))
+	itree := tree.ImmutableTree
+
+	methods := map[string]func(key []byte) error{
+		"Set":       func(key []byte) error { _, err := tree.Set(key, []byte("value")); return err },
+		"SetResult": func(key []byte) error { _, err := tree.SetResult(key, []byte("value")); return err },
+		"Append":    func(key []byte) error { _, err := tree.Append(key, []byte("value")); return err },
+		"CompareAndSwap": func(key []byte) error {
+			_, err := tree.CompareAndSwap(key, nil, []byte("value"))
+			return err
+		},
+		"Remove": func(key []byte) error { _, _, err := tree.Remove(key); return err },
+		"Get":    func(key []byte) error { _, err := tree.Get(key); return err },
+		"Has":    func(key []byte) error { _, err := tree.Has(key); return err },
+		"ConcurrentSet": func(key []byte) error {
+			return tree.ConcurrentSet(key, []byte("value"))
+		},
+		"GetVersioned":    func(key []byte) error { _, err := tree.GetVersioned(key, 1); return err },
+		"GetLatest":       func(key []byte) error { _, err := tree.GetLatest(key); return err },
+		"GetWithIndex":    func(key []byte) error { _, _, err := tree.GetWithIndex(key); return err },
+		"GetWithVersion":  func(key []byte) error { _, _, err := tree.GetWithVersion(key); return err },
+		"Immutable Get":   func(key []byte) error { _, err := itree.Get(key); return err },
+		"Immutable Has":   func(key []byte) error { _, err := itree.Has(key); return err },
+		"GetProof":        func(key []byte) error { _, err := itree.GetProof(key); return err },
+		"MembershipProof": func(key []byte) error { _, err := itree.GetMembershipProof(key); return err },
+		"NativeProof":     func(key []byte) error { _, err := itree.GetNativeMembershipProof(key); return err },
+		"ValidateChangeSet": func(key []byte) error {
+			return tree.ValidateChangeSet(&ChangeSet{Pairs: []*KVPair{{Key: key, Value: []byte("value")}}})
+		},
+	}
+	check := func() {
+		hash := tree.WorkingHash()
+		for name, method := range methods {
+			for _, key := range [][]byte{nil, {}} {
+				err := method(key)
+				require.ErrorIs(t, err, ErrEmptyKey, "%s(%q)", name, key)
+				require.ErrorIs(t, err, ErrInvalidInputs, "%s(%q)", name, key)
+			}
+		}
+		require.NoError(t, tree.ApplyConcurrentSets())
+		require.Equal(t, hash, tree.WorkingHash())
+		require.Nil(t, tree.unsavedChanges)
+	}
+
+	// the empty keys are rejected whether the tree is empty or not, and leave it unchanged.
+	check()
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err = tree.GetImmutable(1)
+	require.NoError(t, err)
+	check()
+}
+
+func TestMutableTree_VersionsEqual(t *testing.T) {
+	tree := setupMutableTree(false)
+	save := func() {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	save() // v1
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	save() // v2
+	save() // v3, identical state to v2
+	_, err = tree.Set([]byte("b"), []byte("3"))
+	require.NoError(t, err)
+	save() // v4
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	save() // v5, same contents as v2, but set again
+
+	for _, tc := range []struct {
+		a, b  int64
+		equal bool
+	}{
+		{2, 3, true},
+		{3, 2, true},
+		{2, 5, false}, // the hashes of the leaves cover the version they were set at.
+		{4, 4, true},
+		{1, 2, false},
+		{3, 4, false},
+	} {
+		equal, err := tree.VersionsEqual(tc.a, tc.b)
+		require.NoError(t, err)
+		require.Equal(t, tc.equal, equal, "versions %d and %d", tc.a, tc.b)
+	}
+
+	// pruned and missing versions aren't found.
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	for _, versions := range [][2]int64{{1, 3}, {3, 2}, {3, 6}} {
+		_, err = tree.VersionsEqual(versions[0], versions[1])
+		require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	}
+}
+
+func TestMutableTree_Append(t *testing.T) {
+	tree := setupMutableTree(false)
+	manual := setupMutableTree(false)
+
+	// manualAppend is the Get-append-Set equivalent of Append.
+	manualAppend := func(key, suffix []byte) int {
+		value, err := manual.Get(key)
+		require.NoError(t, err)
+		value = append(value, suffix...)
+		_, err = manual.Set(key, value)
+		require.NoError(t, err)
+		return len(value)
+	}
+
+	// appending to an empty tree and to a missing key creates it.
+	n, err := tree.Append([]byte("log"), []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, manualAppend([]byte("log"), []byte("a")))
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i%7))
+		suffix := []byte(fmt.Sprintf("-%d", i))
+		n, err := tree.Append(key, suffix)
+		require.NoError(t, err)
+		require.Equal(t, manualAppend(key, suffix), n)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = manual.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, manual.Hash(), tree.Hash())
+
+	// the saved version is not affected by later appends.
+	suffix := []byte("-more")
+	n, err = tree.Append([]byte("log"), suffix)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	suffix[0] = 'X'
+	value, err := tree.Get([]byte("log"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a-more"), value)
+	value, err = tree.GetVersioned([]byte("log"), version)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), value)
+
+	// an empty suffix creates an empty value.
+	n, err = tree.Append([]byte("empty"), nil)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	value, err = tree.Get([]byte("empty"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{}, value)
+}
+
+func BenchmarkMutableTree_Append(b *testing.B) {
+	const keys = 1000
+	suffix := []byte("0123456789abcdef")
+
+	for _, bc := range []struct {
+		name   string
+		append func(tree *MutableTree, key []byte)
+	}{
+		{"append", func(tree *MutableTree, key []byte) {
+			_, err := tree.Append(key, suffix)
+			require.NoError(b, err)
+		}},
+		{"get-append-set", func(tree *MutableTree, key []byte) {
+			value, err := tree.Get(key)
+			require.NoError(b, err)
+			_, err = tree.Set(key, append(value, suffix...))
+			require.NoError(b, err)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, true, log.NewNopLogger())
+			for i := 0; i < keys*10; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte{})
+				require.NoError(b, err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bc.append(tree, []byte(fmt.Sprintf("key-%d", i%keys)))
+			}
+		})
+	}
+}
+
+// writtenBytesDB counts the bytes set through its batches, by key prefix.
+type writtenBytesDB struct {
+	dbm.DB
+	written map[byte]int64
+}
+
+func (db *writtenBytesDB) NewBatch() dbm.Batch {
+	return &writtenBytesBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+func (db *writtenBytesDB) NewBatchWithSize(size int) dbm.Batch {
+	return &writtenBytesBatch{Batch: db.DB.NewBatchWithSize(size), db: db}
+}
+
+type writtenBytesBatch struct {
+	dbm.Batch
+	db *writtenBytesDB
+}
+
+func (b *writtenBytesBatch) Set(key, value []byte) error {
+	b.db.written[key[0]] += int64(len(key) + len(value))
+	return b.Batch.Set(key, value)
+}
+
+func TestMutableTree_VersionSizeEstimate(t *testing.T) {
+	db := &writtenBytesDB{DB: dbm.NewMemDB(), written: map[byte]int64{}}
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+
+	// withinTolerance asserts that the estimate is within 5% of the actual value.
+	withinTolerance := func(actual, estimate int64) {
+		require.InDelta(t, float64(actual), float64(estimate), 0.05*float64(actual))
+	}
+
+	var prevNodeBytes int64
+	for v := int64(1); v <= 4; v++ {
+		db.written = map[byte]int64{}
+		// every version overwrites all the keys with values of growing size.
+		for i := 0; i < 200; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), bytes.Repeat([]byte{'v'}, int(v)*100))
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, v, version)
+
+		nodeBytes, fastNodeBytes, orphanBytes, err := tree.VersionSizeEstimate(version)
+		require.NoError(t, err)
+		require.Greater(t, nodeBytes, int64(200*v*100))
+		withinTolerance(db.written['s'], nodeBytes)
+		withinTolerance(db.written['f'], fastNodeBytes)
+		if v == 1 {
+			require.Zero(t, orphanBytes)
+		} else {
+			// all the nodes of the previous version are orphaned.
+			withinTolerance(prevNodeBytes, orphanBytes)
+		}
+		prevNodeBytes = nodeBytes
+	}
+
+	// once the previous version is pruned, nothing is left to orphan.
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, _, orphanBytes, err := tree.VersionSizeEstimate(3)
+	require.NoError(t, err)
+	require.Zero(t, orphanBytes)
+
+	_, _, _, err = tree.VersionSizeEstimate(2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, _, _, err = tree.VersionSizeEstimate(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_GetImmutableWarm(t *testing.T) {
+	db := &readCountingDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	query := func(itree *ImmutableTree) int {
+		db.gets = 0
+		_, value, err := itree.GetWithIndex([]byte("key-0500"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value-500"), value)
+		return db.gets
+	}
+
+	db.gets = 0
+	cold, err := NewMutableTree(db, 10000, true, NewNopLogger()).GetImmutable(version)
+	require.NoError(t, err)
+	loadGets := db.gets
+	coldGets := query(cold)
+
+	// the two levels below the root are loaded along with it, and not read by the query.
+	db.gets = 0
+	warm, err := NewMutableTree(db, 10000, true, NewNopLogger()).GetImmutableWarm(version, 3)
+	require.NoError(t, err)
+	require.Equal(t, loadGets+2+4, db.gets)
+	require.Equal(t, coldGets-2, query(warm))
+
+	// the preload doesn't evict the nodes it loaded.
+	db.gets = 0
+	small := NewMutableTree(db, 4, true, NewNopLogger())
+	_, err = small.GetImmutableWarm(version, 10)
+	require.NoError(t, err)
+	require.Equal(t, loadGets+3, db.gets)
+	require.Equal(t, 4, small.ndb.nodeCache.Len())
+	rootKey, err := small.ndb.GetRoot(version)
+	require.NoError(t, err)
+	require.True(t, small.ndb.nodeCache.Has(rootKey))
+
+	// the levels below the leaves are ignored.
+	tiny := NewMutableTree(dbm.NewMemDB(), 100, true, NewNopLogger())
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := tiny.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	_, version, err = tiny.SaveVersion()
+	require.NoError(t, err)
+	_, err = tiny.GetImmutableWarm(version, 10)
+	require.NoError(t, err)
+	require.Equal(t, 5, tiny.ndb.nodeCache.Len())
+
+	_, err = tiny.GetImmutableWarm(version+1, 2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_SetCache(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 1000, true, log.NewNopLogger())
+	for i := 0; i < 500; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.ErrorIs(t, tree.SetCache(nil, false), ErrInvalidInputs)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			itree, err := tree.GetImmutable(version)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for i := r; ; i = (i + 7) % 500 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				value, err := itree.Get([]byte(fmt.Sprintf("key-%03d", i)))
+				if !assert.NoError(t, err) || !assert.Equal(t, []byte(fmt.Sprintf("value-%03d", i)), value) {
+					return
+				}
+			}
+		}(r)
+	}
+
+	for i := 0; i < 50; i++ {
+		migrate := i%2 == 0
+		require.NoError(t, tree.SetCache(cache.New(1000), migrate))
+	}
+	close(done)
+	wg.Wait()
+
+	// a migration keeps the hot nodes, otherwise the new cache starts cold.
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+	require.NoError(t, err)
+	hot := tree.ndb.nodeCache.Len()
+	require.Greater(t, hot, 10)
+	require.NoError(t, tree.SetCache(cache.New(1000), true))
+	require.Equal(t, hot, tree.ndb.nodeCache.Len())
+	require.NoError(t, tree.SetCache(cache.New(10), true))
+	require.Equal(t, 10, tree.ndb.nodeCache.Len())
+	require.NoError(t, tree.SetCache(cache.New(1000), false))
+	require.Zero(t, tree.ndb.nodeCache.Len())
+
+	// the nodes report their encoded size to a cache with a bytes limit.
+	bytesCache := cache.NewWithBytesLimit(1 << 10)
+	require.NoError(t, tree.SetCache(bytesCache, false))
+	_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+	require.NoError(t, err)
+	require.Greater(t, bytesCache.Len(), 10)
+	require.LessOrEqual(t, bytesCache.(cache.ByteBounded).Bytes(), int64(1<<10))
+	require.NoError(t, bytesCache.(cache.ConsistencyChecker).ConsistencyCheck())
+
+	// the tree keeps working with the new cache.
+	_, err = tree.Set([]byte("key-new"), []byte("value-new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("key-250"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-250"), value)
+}
+
+func TestMutableTree_PruneKeepRecent(t *testing.T) {
+	setup := func(t *testing.T, versions int) *MutableTree {
+		tree := setupMutableTree(false)
+		for v := 1; v <= versions; v++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v%4)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+
+	testCases := []struct {
+		keep     int64
+		expected []int
+	}{
+		{20, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{10, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{9, []int{2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{4, []int{7, 8, 9, 10}},
+		{1, []int{10}},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("keep %d", tc.keep), func(t *testing.T) {
+			tree := setup(t, 10)
+			require.NoError(t, tree.PruneKeepRecent(tc.keep))
+			require.Equal(t, tc.expected, tree.AvailableVersions())
+
+			// the retained versions are intact.
+			for _, v := range tc.expected {
+				itree, err := tree.GetImmutable(int64(v))
+				require.NoError(t, err)
+				value, err := itree.Get([]byte(fmt.Sprintf("key-%d", v%4)))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value-%d", v)), value)
+			}
+		})
+	}
+
+	t.Run("repeated", func(t *testing.T) {
+		tree := setup(t, 10)
+		require.NoError(t, tree.PruneKeepRecent(6))
+		require.NoError(t, tree.PruneKeepRecent(6))
+		require.Equal(t, []int{5, 6, 7, 8, 9, 10}, tree.AvailableVersions())
+		require.NoError(t, tree.PruneKeepRecent(2))
+		require.Equal(t, []int{9, 10}, tree.AvailableVersions())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tree := setup(t, 3)
+		require.ErrorIs(t, tree.PruneKeepRecent(0), ErrInvalidInputs)
+		require.ErrorIs(t, tree.PruneKeepRecent(-1), ErrInvalidInputs)
+		require.Equal(t, []int{1, 2, 3}, tree.AvailableVersions())
+	})
+
+	t.Run("empty tree", func(t *testing.T) {
+		require.NoError(t, setupMutableTree(false).PruneKeepRecent(1))
+	})
+}
+
+func TestMutableTree_UncommitLatest(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	var hashes [][]byte
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d-%d", i, v%2)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%d-%d", v, (v+1)%2)))
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	// unsaved changes are discarded along with the latest version.
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+	previous, err := tree.UncommitLatest()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), previous)
+	require.Equal(t, int64(2), tree.Version())
+	require.Equal(t, []int{1, 2}, tree.AvailableVersions())
+	require.False(t, tree.VersionExists(3))
+	require.Equal(t, hashes[1], tree.Hash())
+	require.Equal(t, hashes[1], tree.WorkingHash())
+
+	// neither the nodes nor the fast nodes of version 3 are left on disk.
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyPrefixFormat.KeyInt64(3), func(k, _ []byte) error {
+		return fmt.Errorf("node %X of version 3 was not deleted", k)
+	}))
+	require.NoError(t, tree.ndb.traverseFastNodes(func(k, v []byte) error {
+		fastNode, err := fastnode.DeserializeNode(k[1:], v)
+		require.NoError(t, err)
+		require.LessOrEqual(t, fastNode.GetVersionLastUpdatedAt(), int64(2))
+		return nil
+	}))
+
+	// the working tree serves version 2, with and without the fast storage.
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		for _, suffix := range []int{0, 1} {
+			key := []byte(fmt.Sprintf("key-%d-%d", i, suffix))
+			expected, err := itree.Get(key)
+			require.NoError(t, err)
+			value, err := tree.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expected, value)
+		}
+	}
+	value, err := tree.Get([]byte("key-0-1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-1"), value)
+	has, err := tree.Has([]byte("unsaved"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// version 3 is saved again with other contents, and the state survives a reload.
+	_, err = tree.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.NotEqual(t, hashes[2], hash)
+
+	reloaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	version, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.Equal(t, hash, reloaded.Hash())
+
+	// the only remaining version can't be uncommitted.
+	_, err = reloaded.UncommitLatest()
+	require.NoError(t, err)
+	_, err = reloaded.UncommitLatest()
+	require.NoError(t, err)
+	_, err = reloaded.UncommitLatest()
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Equal(t, []int{1}, reloaded.AvailableVersions())
+	require.Equal(t, hashes[0], reloaded.Hash())
+
+	_, err = setupMutableTree(false).UncommitLatest()
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_RollbackToVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	var hashes [][]byte
+	for v := 1; v <= 5; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte(fmt.Sprintf("value-%d", v)))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("shared"), []byte(fmt.Sprintf("value-%d", v)))
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	require.ErrorIs(t, tree.RollbackToVersion(6), ErrVersionDoesNotExist)
+	require.ErrorIs(t, tree.RollbackToVersion(0), ErrVersionDoesNotExist)
+	require.EqualValues(t, 5, tree.Version())
+
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, tree.RollbackToVersion(2))
+	require.EqualValues(t, 2, tree.Version())
+	require.Equal(t, []int{1, 2}, tree.AvailableVersions())
+	require.Equal(t, hashes[1], tree.Hash())
+	require.Equal(t, hashes[1], tree.WorkingHash())
+	_, err = tree.GetImmutableByHash(hashes[4])
+	require.Error(t, err, "the root hash index is rebuilt without the deleted versions")
+
+	// the fast nodes match version 2, and don't need to be rebuilt on reload.
+	for key, expected := range map[string][]byte{
+		"key-2":   []byte("value-2"),
+		"key-3":   nil,
+		"shared":  []byte("value-2"),
+		"unsaved": nil,
+	} {
+		value, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, expected, value, key)
+	}
+	reloaded := NewMutableTree(db, 0, false, log.NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	upgradeable, err := reloaded.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, upgradeable)
+
+	// rolling back to the latest version only discards the unsaved changes.
+	_, err = reloaded.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+	require.NoError(t, reloaded.RollbackToVersion(2))
+	require.Equal(t, hashes[1], reloaded.WorkingHash())
+	_, version, err = reloaded.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+}
+
+// requireEmptyValue checks that key is set to an empty value in the tree, and absent is not set.
+func requireEmptyValue(t *testing.T, tree interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Iterator(start, end []byte, ascending bool) (dbm.Iterator, error)
+}, key, absent []byte,
+) {
+	value, err := tree.Get(key)
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	require.Empty(t, value)
+	has, err := tree.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	value, err = tree.Get(absent)
+	require.NoError(t, err)
+	require.Nil(t, value)
+	has, err = tree.Has(absent)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	for _, ascending := range []bool{true, false} {
+		itr, err := tree.Iterator(nil, nil, ascending)
+		require.NoError(t, err)
+		values := make(map[string][]byte)
+		for ; itr.Valid(); itr.Next() {
+			values[string(itr.Key())] = itr.Value()
+		}
+		require.NoError(t, itr.Close())
+		require.Contains(t, values, string(key))
+		require.NotNil(t, values[string(key)])
+		require.Empty(t, values[string(key)])
+		require.NotContains(t, values, string(absent))
+	}
+}
+
+func TestMutableTree_EmptyValue(t *testing.T) {
+	key, absent := []byte("empty"), []byte("absent")
+	for _, backend := range []string{"memdb", "goleveldb"} {
+		for _, skipFastStorageUpgrade := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/skipFastStorageUpgrade=%t", backend, skipFastStorageUpgrade), func(t *testing.T) {
+				db, err := dbm.NewDB("test", backend, t.TempDir())
+				require.NoError(t, err)
+				defer db.Close()
+				tree := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger(), LatestStoreOption(true))
+
+				_, err = tree.Set(key, []byte{})
+				require.NoError(t, err)
+				_, err = tree.Set([]byte("other"), []byte("value"))
+				require.NoError(t, err)
+				requireEmptyValue(t, tree, key, absent)
+
+				_, version, err := tree.SaveVersion()
+				require.NoError(t, err)
+				requireEmptyValue(t, tree, key, absent)
+				itree, err := tree.GetImmutable(version)
+				require.NoError(t, err)
+				requireEmptyValue(t, itree, key, absent)
+
+				value, err := tree.GetVersioned(key, version)
+				require.NoError(t, err)
+				require.Equal(t, []byte{}, value)
+				_, value, err = itree.GetWithIndex(key)
+				require.NoError(t, err)
+				require.Equal(t, []byte{}, value)
+				_, value, err = itree.GetByIndex(0)
+				require.NoError(t, err)
+				require.Equal(t, []byte{}, value)
+				value, err = tree.GetLatest(key)
+				require.NoError(t, err)
+				require.Equal(t, []byte{}, value)
+				value, err = tree.GetLatest(absent)
+				require.NoError(t, err)
+				require.Nil(t, value)
+
+				// the empty value is read back from disk by a tree loaded afresh.
+				reloaded := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger(), LatestStoreOption(true))
+				_, err = reloaded.Load()
+				require.NoError(t, err)
+				requireEmptyValue(t, reloaded, key, absent)
+
+				// and through an export and import.
+				exporter, err := itree.Export()
+				require.NoError(t, err)
+				imported := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+				importer, err := imported.Import(version)
+				require.NoError(t, err)
+				for {
+					node, err := exporter.Next()
+					if errors.Is(err, ErrorExportDone) {
+						break
+					}
+					require.NoError(t, err)
+					require.NoError(t, importer.Add(node))
+				}
+				exporter.Close()
+				require.NoError(t, importer.Commit())
+				requireEmptyValue(t, imported, key, absent)
+
+				// and through a change set encoded in proto3.
+				applied := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+				require.NoError(t, tree.TraverseStateChanges(version, version, func(_ int64, cs *ChangeSet) error {
+					bz, err := cs.Marshal()
+					require.NoError(t, err)
+					var decoded ChangeSet
+					require.NoError(t, decoded.Unmarshal(bz))
+					_, err = applied.SaveChangeSet(&decoded)
+					return err
+				}))
+				requireEmptyValue(t, applied, key, absent)
+				require.Equal(t, tree.Hash(), applied.Hash())
+
+				// removing the key makes it absent.
+				_, removed, err := tree.Remove(key)
+				require.NoError(t, err)
+				require.True(t, removed)
+				has, err := tree.Has(key)
+				require.NoError(t, err)
+				require.False(t, has)
+			})
+		}
+	}
+}
+
+func TestMutableTree_ValidateChangeSet(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "c", "e"} {
+		_, err := tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	testcases := map[string]struct {
+		pairs       []*KVPair
+		expectedErr error
+	}{
+		"valid": {[]*KVPair{
+			{Key: []byte("a"), Delete: true},
+			{Key: []byte("b"), Value: []byte("new")},
+			{Key: []byte("c"), Value: []byte("updated")},
+			{Key: []byte("e"), Delete: true},
+		}, nil},
+		"empty":          {nil, nil},
+		"delete missing": {[]*KVPair{{Key: []byte("b"), Delete: true}}, ErrKeyDoesNotExist},
+		"duplicate set": {[]*KVPair{
+			{Key: []byte("b"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("2")},
+		}, ErrChangeSetDuplicateKey},
+		"set and delete": {[]*KVPair{
+			{Key: []byte("c"), Value: []byte("1")},
+			{Key: []byte("c"), Delete: true},
+		}, ErrChangeSetDuplicateKey},
+		"unsorted": {[]*KVPair{
+			{Key: []byte("d"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("2")},
+		}, ErrChangeSetUnsorted},
+		"nil key": {[]*KVPair{{Key: nil, Value: []byte("1")}}, ErrInvalidInputs},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := tree.ValidateChangeSet(&ChangeSet{Pairs: tc.pairs})
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tc.expectedErr)
+			}
+			// the working tree is left untouched.
+			require.Equal(t, hash, tree.WorkingHash())
+		})
+	}
+
+	// the deletes are checked against the working tree, including its unsaved changes.
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.ValidateChangeSet(&ChangeSet{Pairs: []*KVPair{{Key: []byte("a"), Delete: true}}}), ErrKeyDoesNotExist)
+
+	// the change sets of the saved versions are valid.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	replayed := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.TraverseStateChanges(1, 2, func(_ int64, cs *ChangeSet) error {
+		require.NoError(t, replayed.ValidateChangeSet(cs))
+		_, err := replayed.SaveChangeSet(cs)
+		return err
+	}))
+	require.Equal(t, tree.Hash(), replayed.Hash())
+}
+
+// fastNodeBatchDB fails the batches writing fast nodes while failFastNodes is set, and counts
+// the writes of batches whose key is lower than the one of the previous write.
+type fastNodeBatchDB struct {
+	dbm.DB
+	failFastNodes  bool
+	unsortedWrites int
+}
+
+func (db *fastNodeBatchDB) NewBatch() dbm.Batch {
+	return &fastNodeBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+func (db *fastNodeBatchDB) NewBatchWithSize(size int) dbm.Batch {
+	return &fastNodeBatch{Batch: db.DB.NewBatchWithSize(size), db: db}
+}
+
+type fastNodeBatch struct {
+	dbm.Batch
+	db        *fastNodeBatchDB
+	lastKey   []byte
+	fastNodes bool
+}
+
+func (b *fastNodeBatch) record(key []byte) {
+	if bytes.Compare(key, b.lastKey) < 0 {
+		b.db.unsortedWrites++
+	}
+	b.lastKey = key
+	if key[0] == fastKeyFormat.Prefix()[0] {
+		b.fastNodes = true
+	}
+}
+
+func (b *fastNodeBatch) Set(key, value []byte) error {
+	b.record(key)
+	return b.Batch.Set(key, value)
+}
+
+func (b *fastNodeBatch) Delete(key []byte) error {
+	b.record(key)
+	return b.Batch.Delete(key)
+}
+
+func (b *fastNodeBatch) Write() error {
+	if b.fastNodes && b.db.failFastNodes {
+		return errors.New("simulated fast node batch failure")
+	}
+	return b.Batch.Write()
+}
+
+func (b *fastNodeBatch) WriteSync() error {
+	if b.fastNodes && b.db.failFastNodes {
+		return errors.New("simulated fast node batch failure")
+	}
+	return b.Batch.WriteSync()
+}
+
+// requireFastNodesMatch checks that the fast nodes on disk are the pairs of the latest version.
+func requireFastNodesMatch(t *testing.T, tree *MutableTree) {
+	expected := make(map[string]string)
+	tree.ImmutableTree.IterateRange(nil, nil, true, func(key, value []byte) bool {
+		expected[string(key)] = string(value)
+		return false
+	})
+	fastNodes := make(map[string]string)
+	itr := NewFastIterator(nil, nil, true, tree.ndb)
+	for ; itr.Valid(); itr.Next() {
+		fastNodes[string(itr.Key())] = string(itr.Value())
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, expected, fastNodes)
+}
+
+func saveFastNodeBatchTestVersion(t *testing.T, tree *MutableTree, version int) error {
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", (version*7+i)%30)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%d", version%30)))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	return err
+}
+
+func TestMutableTree_SeparateFastNodeBatch(t *testing.T) {
+	db := &fastNodeBatchDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), SeparateFastNodeBatchOption(true))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for version := 1; version <= 5; version++ {
+		require.NoError(t, saveFastNodeBatchTestVersion(t, tree, version))
+		require.NoError(t, saveFastNodeBatchTestVersion(t, reference, version))
+		require.Equal(t, reference.Hash(), tree.Hash())
+		requireFastNodesMatch(t, tree)
+	}
+	require.True(t, tree.ndb.hasUpgradedToFastStorage())
+
+	// the version is committed even if its fast nodes fail to be written, and the fast storage
+	// is then disabled.
+	db.failFastNodes = true
+	err := saveFastNodeBatchTestVersion(t, tree, 6)
+	require.ErrorContains(t, err, "simulated fast node batch failure")
+	require.NoError(t, saveFastNodeBatchTestVersion(t, reference, 6))
+	db.failFastNodes = false
+	require.EqualValues(t, 6, tree.Version())
+	require.Equal(t, reference.Hash(), tree.Hash())
+	require.False(t, tree.ndb.hasUpgradedToFastStorage())
+	for version := 7; version <= 8; version++ {
+		require.NoError(t, saveFastNodeBatchTestVersion(t, tree, version))
+		require.NoError(t, saveFastNodeBatchTestVersion(t, reference, version))
+	}
+	value, err := tree.Get([]byte("key-19"))
+	require.NoError(t, err)
+	expected, err := reference.Get([]byte("key-19"))
+	require.NoError(t, err)
+	require.Equal(t, expected, value)
+
+	// the fast storage is rebuilt on the next load.
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), SeparateFastNodeBatchOption(true))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.True(t, reloaded.ndb.hasUpgradedToFastStorage())
+	require.Equal(t, reference.Hash(), reloaded.Hash())
+	requireFastNodesMatch(t, reloaded)
+	require.NoError(t, saveFastNodeBatchTestVersion(t, reloaded, 9))
+	require.NoError(t, saveFastNodeBatchTestVersion(t, reference, 9))
+	require.Equal(t, reference.Hash(), reloaded.Hash())
+	requireFastNodesMatch(t, reloaded)
+}
+
+func BenchmarkSaveVersion_SeparateFastNodeBatch(b *testing.B) {
+	for _, separate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("separate=%t", separate), func(b *testing.B) {
+			ldb, err := dbm.NewDB("test", "goleveldb", b.TempDir())
+			require.NoError(b, err)
+			defer ldb.Close()
+			db := &fastNodeBatchDB{DB: ldb}
+			tree := NewMutableTree(db, 10000, false, NewNopLogger(), SeparateFastNodeBatchOption(separate))
+			r := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 1000; j++ {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%08d", r.Intn(1000000))), []byte("value"))
+					require.NoError(b, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(b, err)
+			}
+			b.ReportMetric(float64(db.unsortedWrites)/float64(b.N), "unsorted-writes/op")
+		})
+	}
+}
+
+func TestMutableTree_Reset(t *testing.T) {
+	saveVersions := func(tree *MutableTree, prefix string) [][]byte {
+		var hashes [][]byte
+		for v := 0; v < 3; v++ {
+			for i := 0; i < 20; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("%s-%02d", prefix, i)), []byte(fmt.Sprintf("%d-%d", v, i)))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("%s-%02d", prefix, v)))
+			require.NoError(t, err)
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			hashes = append(hashes, hash)
+		}
+		return hashes
+	}
+
+	oldDB := dbm.NewMemDB()
+	tree := NewMutableTree(oldDB, 1000, false, NewNopLogger())
+	oldHashes := saveVersions(tree, "old")
+	// unsaved changes are discarded as well.
+	_, err := tree.Set([]byte("unsaved"), []byte("value"))
+	require.NoError(t, err)
+
+	// the node keys of both DBs are the same, so stale cached nodes would change the hashes.
+	require.NoError(t, tree.Reset(dbm.NewMemDB()))
+	fresh := NewMutableTree(dbm.NewMemDB(), 1000, false, NewNopLogger())
+	require.Zero(t, tree.Version())
+	require.Equal(t, fresh.AvailableVersions(), tree.AvailableVersions())
+	require.Equal(t, fresh.WorkingHash(), tree.WorkingHash())
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+	for _, key := range []string{"old-05", "unsaved"} {
+		value, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Nil(t, value)
+	}
+
+	require.Equal(t, saveVersions(fresh, "new"), saveVersions(tree, "new"))
+	value, err := tree.Get([]byte("old-05"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	_, err = tree.GetImmutable(4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the tree can be reset to a DB with versions, which are then loaded.
+	require.NoError(t, tree.Reset(oldDB))
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, oldHashes[2], tree.WorkingHash())
+	value, err = tree.Get([]byte("old-05"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2-5"), value)
+	value, err = tree.Get([]byte("new-05"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// the versions being exported can't be reset.
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	require.Error(t, tree.Reset(dbm.NewMemDB()))
+	exporter.Close()
+	require.NoError(t, tree.Reset(dbm.NewMemDB()))
+	require.ErrorIs(t, tree.Reset(nil), ErrInvalidInputs)
+}
+
+// spillDB records the largest batch written, and fails the write number failWrite once reached.
+type spillDB struct {
+	dbm.DB
+	writes    int
+	failWrite int
+	maxBatch  int
+}
+
+func (db *spillDB) NewBatch() dbm.Batch {
+	return &spillBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+func (db *spillDB) NewBatchWithSize(size int) dbm.Batch {
+	return &spillBatch{Batch: db.DB.NewBatchWithSize(size), db: db}
+}
+
+type spillBatch struct {
+	dbm.Batch
+	db *spillDB
+}
+
+func (b *spillBatch) record() error {
+	b.db.writes++
+	if b.db.writes == b.db.failWrite {
+		return errors.New("simulated crash")
+	}
+	size, err := b.GetByteSize()
+	if err != nil {
+		return err
+	}
+	b.db.maxBatch = max(b.db.maxBatch, size)
+	return nil
+}
+
+func (b *spillBatch) Write() error {
+	if err := b.record(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func (b *spillBatch) WriteSync() error {
+	if err := b.record(); err != nil {
+		return err
+	}
+	return b.Batch.WriteSync()
+}
+
+func TestMutableTree_SpillThreshold(t *testing.T) {
+	const threshold = 16 << 10
+	setKeys := func(tree *MutableTree, version int) {
+		for i := 0; i < 20000; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", (i*7919)%20000)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+	}
+
+	// the flush threshold is high, so only the spills bound the batches.
+	db := &spillDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 1000, true, NewNopLogger(), SpillThresholdOption(threshold), FlushThresholdOption(64<<20))
+	reference := NewMutableTree(dbm.NewMemDB(), 1000, true, NewNopLogger(), FlushThresholdOption(64<<20))
+	for version := 1; version <= 2; version++ {
+		setKeys(tree, version)
+		setKeys(reference, version)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expected, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expected, hash)
+	}
+	require.Greater(t, db.writes, 10)
+	// a node may be written past the threshold before the spill.
+	require.Less(t, db.maxBatch, 2*threshold)
+
+	// a crash while spilling leaves nodes of the next version but not its root, which is ignored
+	// once reloaded, and then saved again.
+	setKeys(tree, 3)
+	db.failWrite = db.writes + 3
+	_, _, err := tree.SaveVersion()
+	require.Error(t, err)
+	db.failWrite = 0
+
+	tree = NewMutableTree(db, 1000, true, NewNopLogger(), SpillThresholdOption(threshold))
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, reference.Hash(), tree.Hash())
+	require.Equal(t, []int{1, 2}, tree.AvailableVersions())
+
+	setKeys(tree, 3)
+	setKeys(reference, 3)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	expected, _, err := reference.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expected, hash)
+
+	tree = NewMutableTree(db, 1000, true, NewNopLogger())
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, expected, tree.Hash())
+	value, err := tree.Get([]byte("key-00042"))
+	require.NoError(t, err)
+	expectedValue, err := reference.Get([]byte("key-00042"))
+	require.NoError(t, err)
+	require.Equal(t, expectedValue, value)
+}
+
+func TestMutableTree_SetResult(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	outcome, err := tree.SetResult([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.Equal(t, SetInserted, outcome)
+	outcome, err = tree.SetResult([]byte("b"), []byte{})
+	require.NoError(t, err)
+	require.Equal(t, SetInserted, outcome)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	cases := []struct {
+		key, value []byte
+		outcome    SetOutcome
+	}{
+		{[]byte("a"), []byte("1"), SetUnchanged},
+		{[]byte("b"), []byte{}, SetUnchanged},
+		{[]byte("a"), []byte("2"), SetUpdated},
+		{[]byte("a"), []byte("2"), SetUnchanged},
+		{[]byte("b"), []byte("3"), SetUpdated},
+		{[]byte("c"), []byte("4"), SetInserted},
+		{[]byte("c"), []byte("4"), SetUnchanged},
+	}
+	for _, tc := range cases {
+		hash := tree.WorkingHash()
+		root := tree.root
+		outcome, err := tree.SetResult(tc.key, tc.value)
+		require.NoError(t, err)
+		require.Equal(t, tc.outcome, outcome, "setting %s to %q", tc.key, tc.value)
+		value, err := tree.Get(tc.key)
+		require.NoError(t, err)
+		require.Equal(t, tc.value, value)
+		if outcome == SetUnchanged {
+			require.Equal(t, hash, tree.WorkingHash())
+			require.Same(t, root, tree.root)
+		} else {
+			require.NotEqual(t, hash, tree.WorkingHash())
+		}
+	}
+
+	// the unchanged sets are not part of the next version.
+	tree.Rollback()
+	_, err = tree.SetResult([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.NotNil(t, tree.root.nodeKey)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	previous, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, previous.Hash(), hash)
+
+	_, err = tree.SetResult([]byte("d"), nil)
+	require.Error(t, err)
+	require.Equal(t, "unchanged", SetUnchanged.String())
+}
+
+func TestMutableTree_CompareAndSwap(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte{})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	cases := []struct {
+		key, expected, newValue []byte
+		swapped                 bool
+	}{
+		{[]byte("a"), []byte("2"), []byte("3"), false},
+		{[]byte("a"), nil, []byte("3"), false},
+		{[]byte("a"), []byte{}, []byte("3"), false},
+		{[]byte("a"), []byte("1"), []byte("2"), true},
+		{[]byte("b"), nil, []byte("3"), false},
+		{[]byte("b"), []byte{}, []byte("3"), true},
+		{[]byte("c"), []byte("4"), []byte("5"), false},
+		{[]byte("c"), []byte{}, []byte("5"), false},
+		{[]byte("c"), nil, []byte("5"), true},
+		{[]byte("c"), nil, []byte("6"), false},
+	}
+	for _, tc := range cases {
+		hash := tree.WorkingHash()
+		root := tree.root
+		previous, err := tree.Get(tc.key)
+		require.NoError(t, err)
+		swapped, err := tree.CompareAndSwap(tc.key, tc.expected, tc.newValue)
+		require.NoError(t, err)
+		require.Equal(t, tc.swapped, swapped, "swapping %s from %q to %q", tc.key, tc.expected, tc.newValue)
+		value, err := tree.Get(tc.key)
+		require.NoError(t, err)
+		if swapped {
+			require.Equal(t, tc.newValue, value)
+			require.NotEqual(t, hash, tree.WorkingHash())
+		} else {
+			require.Equal(t, previous, value)
+			require.Equal(t, hash, tree.WorkingHash())
+			require.Same(t, root, tree.root)
+		}
+	}
+
+	_, err = tree.CompareAndSwap([]byte("d"), nil, nil)
+	require.Error(t, err)
+	has, err := tree.Has([]byte("d"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+// nodeWritesDB counts the tree nodes written by its batches.
+type nodeWritesDB struct {
+	dbm.DB
+	nodeWrites int
+}
+
+func (db *nodeWritesDB) NewBatch() dbm.Batch {
+	return &nodeWritesBatch{Batch: db.DB.NewBatch(), db: db}
+}
+
+func (db *nodeWritesDB) NewBatchWithSize(size int) dbm.Batch {
+	return &nodeWritesBatch{Batch: db.DB.NewBatchWithSize(size), db: db}
+}
+
+type nodeWritesBatch struct {
+	dbm.Batch
+	db *nodeWritesDB
+}
+
+func (b *nodeWritesBatch) Set(key, value []byte) error {
+	if key[0] == nodeKeyFormat.Prefix()[0] && len(value) > 0 && !bytes.HasPrefix(value, nodeKeyFormat.Prefix()) {
+		b.db.nodeWrites++
+	}
+	return b.Batch.Set(key, value)
+}
+
+func TestMutableTree_SkipNoOpSets(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			db := &nodeWritesDB{DB: dbm.NewMemDB()}
+			tree := NewMutableTree(db, 0, false, NewNopLogger(), SkipNoOpSetsOption(skip))
+			for i := 0; i < 100; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				require.NoError(t, err)
+			}
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			db.nodeWrites = 0
+			for i := 0; i < 100; i++ {
+				updated, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				require.NoError(t, err)
+				require.True(t, updated)
+			}
+			// the leaves are otherwise rewritten at the new version, which changes the hashes.
+			require.Equal(t, skip, bytes.Equal(hash, tree.WorkingHash()))
+			require.Equal(t, skip, tree.root.nodeKey != nil)
+			newHash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, skip, bytes.Equal(hash, newHash))
+			require.Equal(t, skip, db.nodeWrites == 0)
+
+			// the other sets are applied as usual.
+			_, err = tree.Set([]byte("key-00"), []byte("other"))
+			require.NoError(t, err)
+			require.NotEqual(t, hash, tree.WorkingHash())
+		})
+	}
+}
+
+func BenchmarkSet_SkipNoOpSets(b *testing.B) {
+	const size = 10000
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip=%v", skip), func(b *testing.B) {
+			db := &nodeWritesDB{DB: dbm.NewMemDB()}
+			tree := NewMutableTree(db, 10000, false, NewNopLogger(), SkipNoOpSetsOption(skip))
+			keys := make([][]byte, size)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key-%05d", i))
+				_, err := tree.Set(keys[i], keys[i])
+				require.NoError(b, err)
+			}
+			hash, _, err := tree.SaveVersion()
+			require.NoError(b, err)
+			db.nodeWrites = 0
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, key := range keys {
+					if _, err := tree.Set(key, key); err != nil {
+						b.Fatal(err)
+					}
+				}
+				newHash, _, err := tree.SaveVersion()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if skip && !bytes.Equal(hash, newHash) {
+					b.Fatalf("root hash changed from %X to %X", hash, newHash)
+				}
+			}
+			b.StopTimer()
+			if skip && db.nodeWrites != 0 {
+				b.Fatalf("%d nodes written by no-op sets", db.nodeWrites)
+			}
+			b.ReportMetric(float64(db.nodeWrites)/float64(b.N), "node-writes/op")
+		})
+	}
+}
+
+func TestMutableTree_Snapshot(t *testing.T) {
+	const keys = 50
+	tree := NewMutableTree(dbm.NewMemDB(), 1000, false, NewNopLogger())
+	setVersion := func(version int) error {
+		for i := 0; i < keys; i++ {
+			if _, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d-%d", version, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	require.NoError(t, setVersion(1))
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the unsaved changes are not part of the snapshot.
+	require.NoError(t, setVersion(2))
+	snapshot := tree.Snapshot()
+	require.EqualValues(t, 1, snapshot.Version())
+	require.Equal(t, tree.Hash(), snapshot.Hash())
+
+	done := make(chan error)
+	go func() {
+		defer close(done)
+		for version := 2; version <= 20; version++ {
+			if err := setVersion(version); err != nil {
+				done <- err
+				return
+			}
+			if _, _, err := tree.SaveVersion(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	// the snapshots taken while versions are saved are consistent as well.
+	verify := func(snapshot *ImmutableTree) {
+		root := snapshot.Hash()
+		for i := 0; i < keys; i += 7 {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			value, err := snapshot.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d-%d", snapshot.Version(), i)), value)
+			proof, err := snapshot.GetMembershipProof(key)
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value))
+		}
+		require.Equal(t, root, snapshot.Hash())
+	}
+	snapshots := []*ImmutableTree{snapshot}
+	verify(snapshot)
+	for saving := true; saving; {
+		select {
+		case err, ok := <-done:
+			require.NoError(t, err)
+			saving = ok
+		default:
+		}
+		snapshot := tree.Snapshot()
+		snapshots = append(snapshots, snapshot)
+		verify(snapshot)
+	}
+	verify(snapshots[0])
+	require.Greater(t, snapshots[len(snapshots)-1].Version(), snapshots[0].Version())
+
+	for _, snapshot := range snapshots {
+		saved, err := tree.GetImmutable(snapshot.Version())
+		require.NoError(t, err)
+		require.Equal(t, saved.Hash(), snapshot.Hash())
+	}
+}
+
+func TestMutableTree_SnapshotDuringSave(t *testing.T) {
+	const keys = 100
+	for name, opts := range map[string][]Option{
+		"default":      nil,
+		"hash workers": {HashWorkersOption(4)},
+		"spill":        {SpillThresholdOption(200)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := NewFaultInjectingDB()
+			// a single cached node, so that the snapshot loads its nodes from the DB.
+			tree := NewMutableTree(db, 1, true, NewNopLogger(), opts...)
+			setVersion := func(version int) {
+				for i := 0; i < keys; i += version {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", version)))
+					require.NoError(t, err)
+				}
+			}
+			setVersion(1)
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// the snapshot of the version before the one being saved is read while the version
+			// is hashed and flushed.
+			var latest atomic.Int64
+			latest.Store(1)
+			done := make(chan error)
+			go func() {
+				defer close(done)
+				for version := 2; version <= 10; version++ {
+					setVersion(version)
+					if version == 10 {
+						db.DelayFlush(1, time.Second)
+					}
+					if _, _, err := tree.SaveVersion(); err != nil {
+						done <- err
+						return
+					}
+					latest.Store(int64(version))
+				}
+			}()
+			read := func(itree *ImmutableTree) {
+				for i := 0; i < keys; i++ {
+					value, err := itree.Get([]byte(fmt.Sprintf("key-%03d", i)))
+					require.NoError(t, err)
+					require.NotNil(t, value)
+				}
+			}
+			for latest.Load() < 9 {
+				read(tree.Snapshot())
+				itree, err := tree.GetImmutable(latest.Load())
+				require.NoError(t, err)
+				read(itree)
+			}
+			time.Sleep(100 * time.Millisecond)
+			snapshot := tree.Snapshot()
+			started := time.Now()
+			read(snapshot)
+			require.Less(t, time.Since(started), 500*time.Millisecond)
+			require.EqualValues(t, 9, latest.Load(), "the snapshot was read once the version was flushed")
+			require.NoError(t, <-done)
+			require.EqualValues(t, 9, snapshot.Version())
+		})
+	}
+}
+
+func TestMutableTree_WorkingSnapshot(t *testing.T) {
+	const keys = 60
+	type taken struct {
+		snapshot *ImmutableTree
+		hash     []byte
+		state    map[string]string
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 1000, false, NewNopLogger(), NodePoolOption(true), SpillThresholdOption(512))
+	snapshots := make(chan taken, 8)
+	var wg sync.WaitGroup
+	// the readers record the first error of every snapshot, and keep verifying the others.
+	errs := make(chan error, 100)
+	verify := func(s taken) error {
+		if !bytes.Equal(s.hash, s.snapshot.Hash()) {
+			return fmt.Errorf("snapshot hash %X, expected %X", s.snapshot.Hash(), s.hash)
+		}
+		var err error
+		count := 0
+		s.snapshot.IterateRange(nil, nil, true, func(key, value []byte) bool {
+			if s.state[string(key)] != string(value) {
+				err = fmt.Errorf("key %s has value %s, expected %s", key, value, s.state[string(key)])
+				return true
+			}
+			count++
+			return false
+		})
+		if err == nil && count != len(s.state) {
+			err = fmt.Errorf("snapshot has %d keys, expected %d", count, len(s.state))
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range snapshots {
+				if err := verify(s); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	// the snapshots of the working tree aren't changed by the later writes and saves.
+	r := rand.New(rand.NewSource(3))
+	state := make(map[string]string)
+	for version := 1; version <= 10; version++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key-%02d", r.Intn(keys))
+			if r.Intn(3) == 0 {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+				delete(state, key)
+			} else {
+				value := fmt.Sprintf("value-%d-%d", version, i)
+				_, err := tree.Set([]byte(key), []byte(value))
+				require.NoError(t, err)
+				state[key] = value
+			}
+			if i%10 == 9 {
+				snapshot := tree.WorkingSnapshot()
+				require.Equal(t, tree.WorkingHash(), snapshot.Hash())
+				require.Equal(t, tree.Version(), snapshot.Version())
+				copied := make(map[string]string, len(state))
+				for k, v := range state {
+					copied[k] = v
+				}
+				snapshots <- taken{snapshot: snapshot, hash: snapshot.Hash(), state: copied}
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		// the hash of the snapshot taken last is that of the version.
+		require.Equal(t, hash, tree.WorkingSnapshot().Hash())
+	}
+	close(snapshots)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.Equal(t, EmptyHash(), empty.WorkingSnapshot().Hash())
+}
+
+func TestMutableTree_UniqueNodeCount(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// 8 leaves in a tree of height 3 are all at the same depth, on paths of 4 nodes.
+	require.EqualValues(t, 3, tree.Height())
+
+	// updating a leaf orphans its path.
+	_, err = tree.Set([]byte{3}, []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// the next version changes nothing.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// updating all the leaves orphans all the nodes.
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte("all"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for version, expected := range map[int64][2]int64{1: {4, 11}, 2: {0, 15}, 3: {15, 0}, 4: {0, 15}} {
+		unique, shared, err := tree.UniqueNodeCount(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, [2]int64{unique, shared}, "version %d", version)
+	}
+
+	// pruning the first version frees its unique nodes.
+	countNodes := func() (count int64) {
+		require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(_, value []byte) error {
+			if isRef, _ := isReferenceRoot(value); !isRef {
+				count++
+			}
+			return nil
+		}))
+		return count
+	}
+	before := countNodes()
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.Equal(t, before-4, countNodes())
+
+	_, _, err = tree.UniqueNodeCount(1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, _, err = tree.UniqueNodeCount(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_IterateWorking(t *testing.T) {
+	for _, skipFastStorage := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorage=%v", skipFastStorage), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorage, log.NewNopLogger())
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				_, err := tree.Set([]byte(key), []byte("saved-"+key))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			_, err = tree.Set([]byte("b"), []byte("new-b"))
+			require.NoError(t, err)
+			_, _, err = tree.Remove([]byte("c"))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("f"), []byte("new-f"))
+			require.NoError(t, err)
+			// removed and set again.
+			_, _, err = tree.Remove([]byte("d"))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("d"), []byte("new-d"))
+			require.NoError(t, err)
+			// set and removed again.
+			_, err = tree.Set([]byte("g"), []byte("new-g"))
+			require.NoError(t, err)
+			_, _, err = tree.Remove([]byte("g"))
+			require.NoError(t, err)
+
+			var keys, values []string
+			stopped, err := tree.IterateWorking(func(key, value []byte) bool {
+				keys = append(keys, string(key))
+				values = append(values, string(value))
+				return false
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+			require.Equal(t, []string{"a", "b", "d", "e", "f"}, keys)
+			require.Equal(t, []string{"saved-a", "new-b", "new-d", "saved-e", "new-f"}, values)
+
+			// the saved version is unchanged.
+			saved, err := tree.GetImmutable(1)
+			require.NoError(t, err)
+			value, err := saved.Get([]byte("c"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("saved-c"), value)
+
+			keys = nil
+			stopped, err = tree.IterateWorking(func(key, _ []byte) bool {
+				keys = append(keys, string(key))
+				return len(keys) == 2
+			})
+			require.NoError(t, err)
+			require.True(t, stopped)
+			require.Equal(t, []string{"a", "b"}, keys)
+		})
+	}
+}
+
+func TestMutableTree_GetLastSet(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := setupMutableTree(skipFastStorageUpgrade)
+			requireValue := func(key, expected string) {
+				t.Helper()
+				value, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				if expected == "" {
+					require.Nil(t, value)
+				} else {
+					require.Equal(t, []byte(expected), value)
+				}
+			}
+
+			_, err := tree.Set([]byte("k"), []byte("v1"))
+			require.NoError(t, err)
+			require.NotNil(t, tree.lastSet)
+			requireValue("k", "v1")
+
+			// setting other keys, with rebalances, doesn't change the value of the last set.
+			_, err = tree.Set([]byte("k"), []byte("v2"))
+			require.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				_, err = tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("other"))
+				require.NoError(t, err)
+				_, _, err = tree.Remove([]byte(fmt.Sprintf("key-%03d", i/2)))
+				require.NoError(t, err)
+			}
+			requireValue("k", "v2")
+			_, err = tree.Set([]byte("k"), []byte("v3"))
+			require.NoError(t, err)
+			requireValue("k", "v3")
+			_, err = tree.Append([]byte("k"), []byte("+"))
+			require.NoError(t, err)
+			requireValue("k", "v3+")
+
+			// removing it forgets it.
+			_, removed, err := tree.Remove([]byte("k"))
+			require.NoError(t, err)
+			require.True(t, removed)
+			requireValue("k", "")
+
+			_, err = tree.Set([]byte("k"), []byte("v4"))
+			require.NoError(t, err)
+			_, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			requireValue("k", "v4")
+
+			// rolling back or loading a version forgets it.
+			_, err = tree.Set([]byte("k"), []byte("v5"))
+			require.NoError(t, err)
+			tree.Rollback()
+			requireValue("k", "v4")
+			_, err = tree.Set([]byte("k"), []byte("v5"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			requireValue("k", "v5")
+			err = tree.LoadVersionForOverwriting(version)
+			require.NoError(t, err)
+			requireValue("k", "v4")
+
+			tree = setupMutableTree(skipFastStorageUpgrade)
+			_, err = tree.Set([]byte("k"), []byte("v1"))
+			require.NoError(t, err)
+			tree.Rollback()
+			requireValue("k", "")
+		})
+	}
+}
+
+func BenchmarkMutableTree_GetLastSet(b *testing.B) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(b *testing.B) {
+			tree := setupMutableTree(skipFastStorageUpgrade)
+			for i := 0; i < 100000; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%06d", i)), []byte("value"))
+				require.NoError(b, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(b, err)
+			keys := make([][]byte, 1000)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key-%06d", i*97))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%len(keys)]
+				if _, err := tree.Set(key, key); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := tree.Get(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMutableTree_CacheStats(t *testing.T) {
+	nodeHook := &cacheEventCounter{}
+	tree := NewMutableTree(dbm.NewMemDB(), 10, false, log.NewNopLogger(), CacheStatsHooksOption(nodeHook, nil))
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the saved nodes evict each other from the small cache.
+	stats := tree.CacheStats()
+	require.Equal(t, 10, stats.Nodes.Elements)
+	require.NotZero(t, stats.Nodes.Evictions)
+
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, _, err := itree.GetWithIndex([]byte(fmt.Sprintf("key-%03d", i)))
+		require.NoError(t, err)
+	}
+	_, err = itree.Get([]byte("key-050"))
+	require.NoError(t, err)
+	stats = tree.CacheStats()
+	require.NotZero(t, stats.Nodes.Hits)
+	require.NotZero(t, stats.Nodes.Misses)
+	require.NotZero(t, stats.FastNodes.Hits+stats.FastNodes.Misses)
+	require.Equal(t, stats.Nodes.Hits, nodeHook.hits.Load())
+	require.Equal(t, stats.Nodes.Misses, nodeHook.misses.Load())
+	require.Equal(t, stats.Nodes.Evictions, nodeHook.evictions.Load())
+	require.Equal(t, stats.Nodes.Hits+stats.FastNodes.Hits, stats.Total().Hits)
+
+	// the statistics are kept across the caches.
+	require.NoError(t, tree.SetCache(cache.NewWithBytesLimit(1<<20), true))
+	stats = tree.CacheStats()
+	require.Equal(t, nodeHook.hits.Load(), stats.Nodes.Hits)
+	require.Equal(t, 10, stats.Nodes.Elements)
+	require.Positive(t, stats.Nodes.Bytes)
+}
+
+// cacheEventCounter is a cache.StatsHook counting the events.
+type cacheEventCounter struct {
+	hits, misses, evictions atomic.Uint64
+}
+
+func (c *cacheEventCounter) OnHit()      { c.hits.Add(1) }
+func (c *cacheEventCounter) OnMiss()     { c.misses.Add(1) }
+func (c *cacheEventCounter) OnEviction() { c.evictions.Add(1) }
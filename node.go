@@ -5,7 +5,6 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -72,6 +71,7 @@ type Node struct {
 	rightNode     *Node
 	subtreeHeight int8
 	isLegacy      bool
+	external      bool // the value of the leaf is stored apart and isn't loaded, see ExternalValueThreshold
 }
 
 var _ cache.Node = (*Node)(nil)
@@ -94,28 +94,78 @@ func (node *Node) GetKey() []byte {
 	return node.nodeKey.GetKey()
 }
 
+// EncodedSize returns the size of the encoding of the node, so that it can be cached by a cache
+// with a bytes limit, see cache.NewWithBytesLimit.
+func (node *Node) EncodedSize() int {
+	return node.encodedSize()
+}
+
 // MakeNode constructs an *Node from an encoded byte slice.
 func MakeNode(nk, buf []byte) (*Node, error) {
+	return makeNode(nk, buf, nil, HashSHA256)
+}
+
+// makeNode is MakeNode, decoding the value of a leaf with codec if not nil, and hashing a leaf with
+// scheme. The values tagged with the id of their compression are decompressed whatever the codec,
+// see the Compression option.
+func makeNode(nk, buf []byte, codec ValueCodec, scheme HashScheme) (*Node, error) {
+	node, err := makeUnhashedNode(nk, buf, codec, scheme)
+	if err != nil {
+		return nil, err
+	}
+	if node.hash == nil {
+		// ensure take the hash for the leaf node
+		node._hash(node.nodeKey.version, scheme)
+	}
+	return node, nil
+}
+
+// makeUnhashedNode is makeNode without hashing the leaves whose value is at hand, whose hash is
+// left nil, see the LazyHashing option.
+func makeUnhashedNode(nk, buf []byte, codec ValueCodec, scheme HashScheme) (*Node, error) {
+	node, valueHash, err := decodeNode(nk, buf, codec)
+	if err != nil {
+		return nil, err
+	}
+	if valueHash != nil {
+		// the value of the leaf is stored apart, only its hash is at hand.
+		h := scheme.New()
+		if err := node.writeHashBytesWithValueHash(h, node.nodeKey.version, valueHash); err != nil {
+			return nil, err
+		}
+		node.hash = h.Sum(nil)
+	}
+	return node, nil
+}
+
+// decodeNode is makeNode without hashing the leaves, for the callers knowing their hash. It
+// also returns the hash of the value of a leaf stored apart, whose value is left nil, see the
+// ExternalValueThreshold option.
+func decodeNode(nk, buf []byte, codec ValueCodec) (*Node, []byte, error) {
+	if len(buf) > 0 && buf[0]&nodeEncodingV2Tag != 0 {
+		return decodeNodeV2(nk, buf, codec)
+	}
+
 	// Read node header (height, size, key).
 	height, n, err := encoding.DecodeVarint(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.height, %w", err)
+		return nil, nil, fmt.Errorf("decoding node.height, %w", err)
 	}
 	buf = buf[n:]
 	height8 := int8(height)
 	if height != int64(height8) {
-		return nil, errors.New("invalid height, out of int8 range")
+		return nil, nil, errors.New("invalid height, out of int8 range")
 	}
 
 	size, n, err := encoding.DecodeVarint(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.size, %w", err)
+		return nil, nil, fmt.Errorf("decoding node.size, %w", err)
 	}
 	buf = buf[n:]
 
 	key, n, err := encoding.DecodeBytes(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.key, %w", err)
+		return nil, nil, fmt.Errorf("decoding node.key, %w", err)
 	}
 	buf = buf[n:]
 
@@ -128,33 +178,38 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 
 	// Read node body.
 	if node.isLeaf() {
-		val, _, err := encoding.DecodeBytes(buf)
+		val, n, err := encoding.DecodeBytes(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding node.value, %w", err)
+			return nil, nil, fmt.Errorf("decoding node.value, %w", err)
+		}
+		buf = buf[n:]
+		if len(buf) > 0 && buf[0] == externalValueTag {
+			node.external = true
+			return node, val, nil
+		}
+		if node.value, err = decodeValue(val, buf, codec); err != nil {
+			return nil, nil, err
 		}
-		node.value = val
-		// ensure take the hash for the leaf node
-		node._hash(node.nodeKey.version)
 	} else { // Read children.
 		node.hash, n, err = encoding.DecodeBytes(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding node.hash, %w", err)
+			return nil, nil, fmt.Errorf("decoding node.hash, %w", err)
 		}
 		buf = buf[n:]
 
 		mode, n, err := encoding.DecodeVarint(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding mode, %w", err)
+			return nil, nil, fmt.Errorf("decoding mode, %w", err)
 		}
 		buf = buf[n:]
 		if mode < 0 || mode > 3 {
-			return nil, errors.New("invalid mode")
+			return nil, nil, errors.New("invalid mode")
 		}
 
 		if mode&ModeLegacyLeftNode != 0 { // legacy leftNodeKey
 			node.leftNodeKey, n, err = encoding.DecodeBytes(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding legacy node.leftNodeKey, %w", err)
+				return nil, nil, fmt.Errorf("decoding legacy node.leftNodeKey, %w", err)
 			}
 			buf = buf[n:]
 		} else {
@@ -164,24 +219,24 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 			)
 			leftNodeKey.version, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.leftNodeKey.version, %w", err)
+				return nil, nil, fmt.Errorf("decoding node.leftNodeKey.version, %w", err)
 			}
 			buf = buf[n:]
 			nonce, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.leftNodeKey.nonce, %w", err)
+				return nil, nil, fmt.Errorf("decoding node.leftNodeKey.nonce, %w", err)
 			}
 			buf = buf[n:]
 			leftNodeKey.nonce = uint32(nonce)
 			if nonce != int64(leftNodeKey.nonce) {
-				return nil, errors.New("invalid leftNodeKey.nonce, out of int32 range")
+				return nil, nil, errors.New("invalid leftNodeKey.nonce, out of int32 range")
 			}
 			node.leftNodeKey = leftNodeKey.GetKey()
 		}
 		if mode&ModeLegacyRightNode != 0 { // legacy rightNodeKey
 			node.rightNodeKey, _, err = encoding.DecodeBytes(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding legacy node.rightNodeKey, %w", err)
+				return nil, nil, fmt.Errorf("decoding legacy node.rightNodeKey, %w", err)
 			}
 		} else {
 			var (
@@ -190,21 +245,40 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 			)
 			rightNodeKey.version, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.rightNodeKey.version, %w", err)
+				return nil, nil, fmt.Errorf("decoding node.rightNodeKey.version, %w", err)
 			}
 			buf = buf[n:]
 			nonce, _, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.rightNodeKey.nonce, %w", err)
+				return nil, nil, fmt.Errorf("decoding node.rightNodeKey.nonce, %w", err)
 			}
 			rightNodeKey.nonce = uint32(nonce)
 			if nonce != int64(rightNodeKey.nonce) {
-				return nil, errors.New("invalid rightNodeKey.nonce, out of int32 range")
+				return nil, nil, errors.New("invalid rightNodeKey.nonce, out of int32 range")
 			}
 			node.rightNodeKey = rightNodeKey.GetKey()
 		}
 	}
-	return node, nil
+	return node, nil, nil
+}
+
+// decodeValue decodes the value of a leaf written by writeValue, val being followed by tail. The
+// values tagged with the id of their compression are decompressed whatever the codec.
+func decodeValue(val, tail []byte, codec ValueCodec) ([]byte, error) {
+	var err error
+	_, compressed := codec.(compressionCodec)
+	switch {
+	case len(tail) > 0:
+		// the value is followed by the id of its compression.
+		if val, err = Compression(tail[0]).decompress(val); err != nil {
+			return nil, fmt.Errorf("decompressing node.value, %w", err)
+		}
+	case codec != nil && !compressed:
+		if val, err = codec.Decompress(val); err != nil {
+			return nil, fmt.Errorf("decompressing node.value, %w", err)
+		}
+	}
+	return val, nil
 }
 
 // MakeLegacyNode constructs a legacy *Node from an encoded byte slice.
@@ -303,19 +377,25 @@ func (node *Node) clone(tree *MutableTree) (*Node, error) {
 	leftNode := node.leftNode
 	rightNode := node.rightNode
 	if node.nodeKey != nil {
-		leftNode, err = node.getLeftNode(tree.ImmutableTree)
+		leftNode, err = tree.childToWrite(node.leftNode, node.leftNodeKey)
 		if err != nil {
 			return nil, err
 		}
-		rightNode, err = node.getRightNode(tree.ImmutableTree)
+		rightNode, err = tree.childToWrite(node.rightNode, node.rightNodeKey)
 		if err != nil {
 			return nil, err
 		}
-		node.leftNode = nil
-		node.rightNode = nil
+		// the saved nodes may be read concurrently, e.g. by MutableTree.Snapshot, so they are
+		// never written to: SaveVersion detaches their children before saving them.
 	}
 
-	return &Node{
+	var cloned *Node
+	if tree.ndb.opts.NodePool {
+		cloned = getPooledNode()
+	} else {
+		cloned = &Node{}
+	}
+	*cloned = Node{
 		key:           node.key,
 		subtreeHeight: node.subtreeHeight,
 		size:          node.size,
@@ -325,7 +405,22 @@ func (node *Node) clone(tree *MutableTree) (*Node, error) {
 		rightNodeKey:  node.rightNodeKey,
 		leftNode:      leftNode,
 		rightNode:     rightNode,
-	}, nil
+	}
+	return cloned, nil
+}
+
+// childToWrite returns the child of a saved node cloned by a write, given its pointer, if any,
+// and its node key. With the LazyHashing option, a leaf missing from the node cache is loaded
+// without its hash, which is only computed by WorkingHash or SaveVersion if the leaf isn't
+// replaced by the write.
+func (tree *MutableTree) childToWrite(child *Node, nk []byte) (*Node, error) {
+	if child != nil {
+		return child, nil
+	}
+	if tree.ndb.opts.LazyHashing {
+		return tree.ndb.getNode(nk, true)
+	}
+	return tree.ndb.GetNode(nk)
 }
 
 func (node *Node) isLeaf() bool {
@@ -340,7 +435,7 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if node.isLeaf() {
 		return false, nil
 	}
-	if bytes.Compare(key, node.key) < 0 {
+	if t.ndb.compare(key, node.key) < 0 {
 		leftNode, err := node.getLeftNode(t)
 		if err != nil {
 			return false, err
@@ -362,17 +457,18 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 // It's neighbor has index 1 and so on.
 func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte, err error) {
 	if node.isLeaf() {
-		switch bytes.Compare(node.key, key) {
+		switch t.ndb.compare(node.key, key) {
 		case -1:
 			return 1, nil, nil
 		case 1:
 			return 0, nil, nil
 		default:
-			return 0, node.value, nil
+			value, err := t.ndb.leafValue(node)
+			return 0, value, err
 		}
 	}
 
-	if bytes.Compare(key, node.key) < 0 {
+	if t.ndb.compare(key, node.key) < 0 {
 		leftNode, err := node.getLeftNode(t)
 		if err != nil {
 			return 0, nil, err
@@ -398,7 +494,8 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte,
 func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value []byte, err error) {
 	if node.isLeaf() {
 		if index == 0 {
-			return node.key, node.value, nil
+			value, err := t.ndb.leafValue(node)
+			return node.key, value, err
 		}
 		return nil, nil, nil
 	}
@@ -423,13 +520,17 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 
 // Computes the hash of the node without computing its descendants. Must be
 // called on nodes which have descendant node hashes already computed.
-func (node *Node) _hash(version int64) []byte {
+func (node *Node) _hash(version int64, scheme HashScheme) []byte {
 	if node.hash != nil {
 		return node.hash
 	}
+	if node.nodeKey != nil {
+		// a saved leaf loaded without its hash, see the LazyHashing option.
+		version = node.nodeKey.version
+	}
 
-	h := sha256.New()
-	if err := node.writeHashBytes(h, version); err != nil {
+	h := scheme.New()
+	if err := node.writeHashBytes(h, version, scheme); err != nil {
 		return nil
 	}
 	node.hash = h.Sum(nil)
@@ -437,20 +538,32 @@ func (node *Node) _hash(version int64) []byte {
 	return node.hash
 }
 
+// EmptyHash returns the root hash of a tree without any keys, which is the hash of an
+// empty input to conform with RFC-6962. It does not depend on the version of the tree,
+// so empty trees hash identically regardless of their initial version. It is the one of the
+// default HashSHA256 scheme, see HashScheme.EmptyHash.
+func EmptyHash() []byte {
+	return HashSHA256.EmptyHash()
+}
+
 // Hash the node and its descendants recursively. This usually mutates all
 // descendant nodes. Returns the node hash and number of nodes hashed.
 // If the tree is empty (i.e. the node is nil), returns the hash of an empty input,
 // to conform with RFC-6962.
-func (node *Node) hashWithCount(version int64) []byte {
+func (node *Node) hashWithCount(version int64, scheme HashScheme) []byte {
 	if node == nil {
-		return sha256.New().Sum(nil)
+		return scheme.EmptyHash()
 	}
 	if node.hash != nil {
 		return node.hash
 	}
+	if node.nodeKey != nil {
+		// as in _hash.
+		version = node.nodeKey.version
+	}
 
-	h := sha256.New()
-	if err := node.writeHashBytesRecursively(h, version); err != nil {
+	h := scheme.New()
+	if err := node.writeHashBytesRecursively(h, version, scheme); err != nil {
 		// writeHashBytesRecursively doesn't return an error unless h.Write does,
 		// and hash.Hash.Write doesn't.
 		panic(err)
@@ -499,8 +612,19 @@ func (node *Node) validate() error {
 }
 
 // Writes the node's hash to the given io.Writer. This function expects
-// child hashes to be already set.
-func (node *Node) writeHashBytes(w io.Writer, version int64) error {
+// child hashes to be already set. The value of a leaf is hashed with scheme.
+func (node *Node) writeHashBytes(w io.Writer, version int64, scheme HashScheme) error {
+	var valueHash []byte
+	if node.isLeaf() {
+		// Indirection needed to provide proofs without values.
+		// (e.g. ProofLeafNode.ValueHash)
+		valueHash = scheme.Sum(node.value)
+	}
+	return node.writeHashBytesWithValueHash(w, version, valueHash)
+}
+
+// writeHashBytesWithValueHash is writeHashBytes, given the hash of the value of a leaf.
+func (node *Node) writeHashBytesWithValueHash(w io.Writer, version int64, valueHash []byte) error {
 	err := encoding.EncodeVarint(w, int64(node.subtreeHeight))
 	if err != nil {
 		return fmt.Errorf("writing height, %w", err)
@@ -522,11 +646,7 @@ func (node *Node) writeHashBytes(w io.Writer, version int64) error {
 			return fmt.Errorf("writing key, %w", err)
 		}
 
-		// Indirection needed to provide proofs without values.
-		// (e.g. ProofLeafNode.ValueHash)
-		valueHash := sha256.Sum256(node.value)
-
-		err = encoding.Encode32BytesHash(w, valueHash[:])
+		err = encoding.Encode32BytesHash(w, valueHash)
 		if err != nil {
 			return fmt.Errorf("writing value, %w", err)
 		}
@@ -550,10 +670,10 @@ func (node *Node) writeHashBytes(w io.Writer, version int64) error {
 // writeHashBytesRecursively writes the node's hash to the given io.Writer.
 // This function has the side-effect of calling hashWithCount.
 // It only returns an error if w.Write fails.
-func (node *Node) writeHashBytesRecursively(w io.Writer, version int64) error {
-	node.leftNode.hashWithCount(version)
-	node.rightNode.hashWithCount(version)
-	return node.writeHashBytes(w, version)
+func (node *Node) writeHashBytesRecursively(w io.Writer, version int64, scheme HashScheme) error {
+	node.leftNode.hashWithCount(version, scheme)
+	node.rightNode.hashWithCount(version, scheme)
+	return node.writeHashBytes(w, version, scheme)
 }
 
 func (node *Node) encodedSize() int {
@@ -580,6 +700,18 @@ func (node *Node) encodedSize() int {
 
 // Writes the node as a serialized byte slice to the supplied io.Writer.
 func (node *Node) writeBytes(w io.Writer) error {
+	return node.writeBytesWithCodec(w, nil)
+}
+
+// writeBytesWithCodec is writeBytes, encoding the value of a leaf with codec if not nil, see
+// writeValue.
+func (node *Node) writeBytesWithCodec(w io.Writer, codec ValueCodec) error {
+	return node.writeBytesWithValueHash(w, codec, nil)
+}
+
+// writeBytesWithValueHash is writeBytesWithCodec, writing the hash of the value of a leaf stored
+// apart instead of its value if valueHash isn't nil, see the ExternalValueThreshold option.
+func (node *Node) writeBytesWithValueHash(w io.Writer, codec ValueCodec, valueHash []byte) error {
 	if node == nil {
 		return errors.New("cannot write nil node")
 	}
@@ -599,9 +731,17 @@ func (node *Node) writeBytes(w io.Writer) error {
 	}
 
 	if node.isLeaf() {
-		err = encoding.EncodeBytes(w, node.value)
-		if err != nil {
-			return fmt.Errorf("writing value, %w", err)
+		if valueHash == nil {
+			if node.external {
+				return errors.New("writing leaf whose value is stored apart")
+			}
+			return writeValue(w, node.value, codec)
+		}
+		if err = encoding.EncodeBytes(w, valueHash); err != nil {
+			return fmt.Errorf("writing value hash, %w", err)
+		}
+		if _, err = w.Write([]byte{externalValueTag}); err != nil {
+			return fmt.Errorf("writing external value tag, %w", err)
 		}
 	} else {
 		err = encoding.Encode32BytesHash(w, node.hash)
@@ -662,10 +802,42 @@ func (node *Node) writeBytes(w io.Writer) error {
 	return nil
 }
 
+// writeValue writes the value of a leaf, encoded with codec if not nil. The codec of the
+// Compression option is applied only if it makes the value smaller, and the value is then
+// followed by the id of the compression.
+func writeValue(w io.Writer, value []byte, codec ValueCodec) error {
+	compression := CompressionNone
+	if codec != nil {
+		stored, err := codec.Compress(value)
+		if err != nil {
+			return fmt.Errorf("compressing value, %w", err)
+		}
+		c, ok := codec.(compressionCodec)
+		switch {
+		case !ok:
+			value = stored
+		case len(stored) < len(value):
+			value, compression = stored, Compression(c)
+		}
+	}
+	if err := encoding.EncodeBytes(w, value); err != nil {
+		return fmt.Errorf("writing value, %w", err)
+	}
+	if compression != CompressionNone {
+		if _, err := w.Write([]byte{byte(compression)}); err != nil {
+			return fmt.Errorf("writing compression, %w", err)
+		}
+	}
+	return nil
+}
+
 func (node *Node) getLeftNode(t *ImmutableTree) (*Node, error) {
 	if node.leftNode != nil {
 		return node.leftNode, nil
 	}
+	if t.uncached {
+		return t.ndb.getNodeUncached(node.leftNodeKey)
+	}
 	leftNode, err := t.ndb.GetNode(node.leftNodeKey)
 	if err != nil {
 		return nil, err
@@ -677,6 +849,9 @@ func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	if node.rightNode != nil {
 		return node.rightNode, nil
 	}
+	if t.uncached {
+		return t.ndb.getNodeUncached(node.rightNodeKey)
+	}
 	rightNode, err := t.ndb.GetNode(node.rightNodeKey)
 	if err != nil {
 		return nil, err
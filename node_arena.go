@@ -0,0 +1,195 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// nodeArenaSegments is the number of segments of a nodeArena, which are mapped as the previous
+// ones fill up.
+const nodeArenaSegments = 8
+
+// arenaKey is the node key of a node stored in a nodeArena.
+type arenaKey [int64Size + int32Size]byte
+
+// arenaRecord locates the encoding of a node in a nodeArena.
+type arenaRecord struct {
+	segment int32
+	offset  uint32
+	length  uint32
+}
+
+// nodeArena is a cache.SecondaryStore holding the encodings of the nodes evicted from the node
+// cache in anonymous memory mappings, outside the Go heap, see the NodeArenaSize option. The
+// cold nodes then cost the garbage collector nothing, and a node missing from the node cache is
+// decoded from the mapping rather than read from the database.
+//
+// The segments are pinned: the nodes are only appended to them, and are never overwritten, so
+// that a node read back references its encoding in place, its key, value and hash included,
+// without copying it. They stay mapped until the arena is closed along with its nodeDB, as for
+// ArchiveFile, and once they are full the evicted nodes are dropped. The space of the nodes
+// deleted from the arena isn't reclaimed, but a node read back and evicted again is indexed at
+// its encoding again rather than appended. The index holds no pointers, so it isn't scanned by
+// the garbage collector either.
+//
+// nodeArena is not safe for concurrent use, the node cache it backs is guarded by nodeDB.mtx.
+// The nodes read back may be used concurrently though, since their encodings never change.
+type nodeArena struct {
+	segmentSize int
+	segments    [][]byte
+	offset      int // end of the nodes of the last segment
+	index       map[arenaKey]arenaRecord
+	deleted     map[arenaKey]arenaRecord // encodings of the nodes deleted from index
+	scratch     bytes.Buffer
+}
+
+var (
+	_ cache.SecondaryStore = (*nodeArena)(nil)
+	_ cache.Resetter       = (*nodeArena)(nil)
+)
+
+// newNodeArena returns an arena of size bytes, which are mapped one segment at a time.
+func newNodeArena(size int) (*nodeArena, error) {
+	segmentSize := size / nodeArenaSegments
+	if segmentSize <= 0 {
+		return nil, errors.New("node arena too small")
+	}
+	arena := &nodeArena{
+		segmentSize: segmentSize,
+		segments:    make([][]byte, 0, nodeArenaSegments),
+		index:       make(map[arenaKey]arenaRecord),
+		deleted:     make(map[arenaKey]arenaRecord),
+	}
+	if err := arena.grow(); err != nil {
+		return nil, err
+	}
+	return arena, nil
+}
+
+// grow maps the next segment.
+func (a *nodeArena) grow() error {
+	segment, err := mmapAnonymous(a.segmentSize)
+	if err != nil {
+		return err
+	}
+	a.segments = append(a.segments, segment)
+	a.offset = 0
+	return nil
+}
+
+// Put stores the encoding of the node. The legacy nodes, keyed by their hash, aren't stored, nor
+// the nodes larger than a segment, nor the leaves whose value is stored apart, nor any node once
+// the arena is full.
+func (a *nodeArena) Put(n cache.Node) {
+	node, ok := n.(*Node)
+	if !ok || node.isLegacy || node.hash == nil || len(node.GetKey()) != len(arenaKey{}) || a.index == nil {
+		return
+	}
+	if node.external {
+		return
+	}
+	key := arenaKey(node.GetKey())
+	delete(a.index, key)
+	if record, ok := a.deleted[key]; ok {
+		delete(a.deleted, key)
+		if a.holds(record, node) {
+			a.index[key] = record
+			return
+		}
+	}
+
+	a.scratch.Reset()
+	if err := encoding.EncodeBytes(&a.scratch, node.hash); err != nil {
+		return
+	}
+	if err := node.writeBytes(&a.scratch); err != nil {
+		return
+	}
+	record := a.scratch.Bytes()
+	if len(record) > a.segmentSize {
+		return
+	}
+	if a.offset+len(record) > a.segmentSize {
+		if len(a.segments) == nodeArenaSegments {
+			return
+		}
+		if err := a.grow(); err != nil {
+			return
+		}
+	}
+	current := len(a.segments) - 1
+	copy(a.segments[current][a.offset:], record)
+	a.index[key] = arenaRecord{segment: int32(current), offset: uint32(a.offset), length: uint32(len(record))}
+	a.offset += len(record)
+}
+
+// holds returns true if the node was read from the record, its hash referencing it in place.
+func (a *nodeArena) holds(record arenaRecord, node *Node) bool {
+	start := int(record.offset) + encoding.EncodeUvarintSize(uint64(len(node.hash)))
+	return len(node.hash) > 0 && start < int(record.offset+record.length) &&
+		&node.hash[0] == &a.segments[record.segment][start]
+}
+
+// Get decodes the node with the key, if stored, referencing its encoding in place.
+func (a *nodeArena) Get(key []byte) cache.Node {
+	if len(key) != len(arenaKey{}) {
+		return nil
+	}
+	record, ok := a.index[arenaKey(key)]
+	if !ok {
+		return nil
+	}
+	// the capacity is limited, so that appending to the key, value or hash doesn't overwrite the
+	// next node.
+	end := record.offset + record.length
+	buf := a.segments[record.segment][record.offset:end:end]
+	hash, n, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil
+	}
+	node, _, err := decodeNode(key, buf[n:], nil)
+	if err != nil {
+		return nil
+	}
+	node.hash = hash
+	return node
+}
+
+// Delete drops the node with the key. Its space isn't reclaimed, but its encoding is indexed
+// again if the node read from it is stored again.
+func (a *nodeArena) Delete(key []byte) {
+	if len(key) != len(arenaKey{}) {
+		return
+	}
+	if record, ok := a.index[arenaKey(key)]; ok {
+		delete(a.index, arenaKey(key))
+		a.deleted[arenaKey(key)] = record
+	}
+}
+
+// Reset drops all the nodes. Their space isn't reclaimed, since nodes may still reference it.
+func (a *nodeArena) Reset() {
+	clear(a.index)
+	clear(a.deleted)
+}
+
+// Len returns the number of stored nodes.
+func (a *nodeArena) Len() int {
+	return len(a.index)
+}
+
+// close unmaps the segments, after which nothing is stored anymore. The nodes read from the arena
+// must not be used afterwards.
+func (a *nodeArena) close() error {
+	var err error
+	for _, segment := range a.segments {
+		if unmapErr := munmapFile(segment); err == nil {
+			err = unmapErr
+		}
+	}
+	a.segments, a.index, a.deleted = nil, nil, nil
+	return err
+}
@@ -0,0 +1,88 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestNodeArena(t *testing.T) {
+	for name, tc := range map[string]struct {
+		arenaSize int
+		full      bool
+	}{
+		"none":     {},
+		"large": {arenaSize: 1 << 20},
+		"full":  {arenaSize: nodeArenaSegments * 512, full: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			stat := &Statistics{}
+			tree := NewMutableTree(dbm.NewMemDB(), 20, true, log.NewNopLogger(), NodeArenaSizeOption(tc.arenaSize), StatOption(stat))
+			for i := 0; i < 500; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				require.NoError(t, err)
+			}
+			hash, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			read := func() {
+				itree, err := tree.GetImmutable(version)
+				require.NoError(t, err)
+				require.Equal(t, hash, itree.Hash())
+				for i := 0; i < 500; i++ {
+					value, err := itree.Get([]byte(fmt.Sprintf("key-%03d", i)))
+					require.NoError(t, err)
+					require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+				}
+				require.NoError(t, tree.VerifyIntegrity(version, 1))
+			}
+			read()
+			stat.Reset()
+			read()
+
+			if tc.arenaSize == 0 {
+				require.Nil(t, tree.ndb.arena)
+				require.NotZero(t, stat.GetCacheMissCnt())
+				return
+			}
+			// the nodes evicted from the cache are decoded from the arena rather than read from
+			// the DB, unless it is too small to hold them all.
+			arena := tree.ndb.arena
+			if tc.full {
+				require.NotZero(t, stat.GetCacheMissCnt())
+				require.Less(t, arena.Len(), 500)
+				require.Len(t, arena.segments, nodeArenaSegments)
+			} else {
+				require.Zero(t, stat.GetCacheMissCnt())
+				require.Positive(t, arena.Len())
+			}
+
+			// the nodes read back reference their encoding in place, which is indexed again
+			// rather than appended once they are evicted again.
+			for key, record := range arena.index {
+				node := arena.Get(key[:]).(*Node)
+				require.True(t, arena.holds(record, node))
+				arena.Delete(key[:])
+				require.Nil(t, arena.Get(key[:]))
+				segments, offset := len(arena.segments), arena.offset
+				arena.Put(node)
+				require.Equal(t, record, arena.index[key])
+				require.Equal(t, segments, len(arena.segments))
+				require.Equal(t, offset, arena.offset)
+				break
+			}
+			read()
+
+			require.NoError(t, tree.Reset(dbm.NewMemDB()))
+			require.Zero(t, tree.ndb.arena.Len())
+			require.NoError(t, tree.Close())
+			require.Nil(t, tree.ndb.arena)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm compressing the leaf values stored in the nodes, see the
+// Compression option. Its value is the id tagging the nodes it compressed.
+type Compression uint8
+
+const (
+	// CompressionNone stores the values as is.
+	CompressionNone Compression = iota
+	// CompressionSnappy compresses the values with Snappy, which is fast but compresses less.
+	CompressionSnappy
+	// CompressionZstd compresses the values with Zstandard, which compresses more.
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	errZstd     error
+)
+
+// zstdCodec returns the Zstandard encoder and decoder shared by the trees, which are safe for
+// concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, errZstd = zstd.NewWriter(nil); errZstd != nil {
+			return
+		}
+		zstdDecoder, errZstd = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, errZstd
+}
+
+func (c Compression) compress(value []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, value), nil
+	case CompressionZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(value, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d: %w", uint8(c), ErrInvalidInputs)
+	}
+}
+
+func (c Compression) decompress(stored []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return stored, nil
+	case CompressionSnappy:
+		return snappy.Decode(nil, stored)
+	case CompressionZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(stored, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression %d", uint8(c))
+	}
+}
+
+// compressionCodec is the ValueCodec of the Compression option. The node encoding tags the
+// values it compresses with its id, see Node.writeBytesWithCodec, unlike the values of the other
+// codecs, so that they are decoded whatever the options.
+type compressionCodec Compression
+
+func (c compressionCodec) Compress(value []byte) ([]byte, error) {
+	return Compression(c).compress(value)
+}
+
+func (c compressionCodec) Decompress(stored []byte) ([]byte, error) {
+	return Compression(c).decompress(stored)
+}
+
+// valueCodec returns the codec of the leaf values written to the database, nil if none.
+func (ndb *nodeDB) valueCodec() ValueCodec {
+	if ndb.opts.ValueCodec != nil {
+		return ndb.opts.ValueCodec
+	}
+	if ndb.opts.Compression != CompressionNone {
+		return compressionCodec(ndb.opts.Compression)
+	}
+	return nil
+}
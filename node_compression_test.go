@@ -0,0 +1,111 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// storedNodeSize returns the total size of the nodes stored in db.
+func storedNodeSize(t *testing.T, db dbm.DB) int {
+	t.Helper()
+	itr, err := db.Iterator(nodeKeyFormat.Prefix(), []byte{nodeKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer itr.Close()
+	size := 0
+	for ; itr.Valid(); itr.Next() {
+		size += len(itr.Value())
+	}
+	return size
+}
+
+func TestCompression(t *testing.T) {
+	// each version is written with another compression, and read back with any.
+	compressions := []Compression{CompressionNone, CompressionSnappy, CompressionZstd}
+	db := dbm.NewMemDB()
+	referenceDB := dbm.NewMemDB()
+	reference := NewMutableTree(referenceDB, 0, false, log.NewNopLogger())
+	for version, compression := range compressions {
+		tree := NewMutableTree(db, 0, false, log.NewNopLogger(), CompressionOption(compression))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		for _, tree := range []*MutableTree{tree, reference} {
+			for i := 0; i < 100; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", (version*40+i)%150)), codecTestValue(version, i))
+				require.NoError(t, err)
+			}
+			// a short value doesn't compress smaller.
+			_, err := tree.Set([]byte("short"), []byte{byte(version)})
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectedHash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash, compression.String())
+	}
+	require.Less(t, storedNodeSize(t, db), storedNodeSize(t, referenceDB)*2/3)
+
+	for _, compression := range compressions {
+		loaded := NewMutableTree(db, 0, true, log.NewNopLogger(), CompressionOption(compression))
+		version, err := loaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, reference.Hash(), loaded.Hash())
+		for v := int64(1); v <= version; v++ {
+			itree, err := loaded.GetImmutable(v)
+			require.NoError(t, err)
+			expected, err := reference.GetImmutable(v)
+			require.NoError(t, err)
+			require.Equal(t, expected.Hash(), itree.Hash())
+			for _, key := range [][]byte{[]byte("short"), []byte("key-000"), []byte("key-075"), []byte("key-149")} {
+				value, err := itree.Get(key)
+				require.NoError(t, err)
+				expectedValue, err := expected.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, expectedValue, value, "%s, version %d, key %s", compression, v, key)
+			}
+		}
+	}
+}
+
+func TestCompression_NodeEncoding(t *testing.T) {
+	leaf := &Node{key: []byte("key"), value: bytes.Repeat([]byte("value"), 100), size: 1, nodeKey: &NodeKey{version: 1, nonce: 1}}
+	var plain bytes.Buffer
+	require.NoError(t, leaf.writeBytes(&plain))
+
+	for _, compression := range []Compression{CompressionSnappy, CompressionZstd} {
+		var buf bytes.Buffer
+		require.NoError(t, leaf.writeBytesWithCodec(&buf, compressionCodec(compression)))
+		require.Less(t, buf.Len(), plain.Len())
+		// the value is followed by the id of its compression.
+		require.Equal(t, byte(compression), buf.Bytes()[buf.Len()-1])
+		for _, codec := range []ValueCodec{nil, compressionCodec(CompressionSnappy), &gzipCodec{}} {
+			node, err := makeNode(leaf.GetKey(), buf.Bytes(), codec, HashSHA256)
+			require.NoError(t, err)
+			require.Equal(t, leaf.value, node.value)
+		}
+	}
+
+	// the values which don't compress smaller are stored as is.
+	short := &Node{key: []byte("key"), value: []byte("v"), size: 1, nodeKey: &NodeKey{version: 1, nonce: 1}}
+	var expected, buf bytes.Buffer
+	require.NoError(t, short.writeBytes(&expected))
+	require.NoError(t, short.writeBytesWithCodec(&buf, compressionCodec(CompressionZstd)))
+	require.Equal(t, expected.Bytes(), buf.Bytes())
+
+	// the ValueCodec option takes precedence.
+	codec := &gzipCodec{}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), CompressionOption(CompressionSnappy), ValueCodecOption(codec))
+	require.Equal(t, codec, tree.ndb.valueCodec())
+
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), CompressionOption(Compression(9)))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -0,0 +1,248 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+const nodeEncodingKey = "node_encoding"
+
+// NodeEncoding is the format of the nodes written to the DB, see the NodeEncoding option. The
+// nodes of all the encodings are read whatever the option, each node telling its own.
+type NodeEncoding uint8
+
+const (
+	// NodeEncodingV1 is the default encoding, and the encoding of the trees created before the
+	// option.
+	NodeEncodingV1 NodeEncoding = iota
+	// NodeEncodingV2 is a denser encoding: the versions of the children of an inner node are
+	// written as deltas from its own version, which are small, rather than as whole versions,
+	// the heights, sizes and nonces as unsigned varints, and the redundant length of the hash,
+	// the mode of the children and the size of a leaf are dropped. The nodes it can't express,
+	// e.g. with a legacy child, are written with NodeEncodingV1. The releases before the option
+	// can't read its nodes.
+	//
+	// The keys are written whole: their compression relative to the key of the parent is deferred,
+	// as a saved node is shared by the parents of the later versions and read by its node key
+	// alone, without any of them, so it has no single parent to be encoded against.
+	NodeEncodingV2
+)
+
+func (e NodeEncoding) String() string {
+	switch e {
+	case NodeEncodingV1:
+		return "v1"
+	case NodeEncodingV2:
+		return "v2"
+	default:
+		return fmt.Sprintf("NodeEncoding(%d)", uint8(e))
+	}
+}
+
+// nodeEncodingV2Tag is set in the first byte of a node written with NodeEncodingV2, whose other
+// bits are its height. The first byte of a node written with NodeEncodingV1 is the zigzag varint
+// of its non-negative height, whose lowest bit is never set.
+const nodeEncodingV2Tag = 0x01
+
+// maxNodeEncodingV2Height is the highest height of a node written with NodeEncodingV2, which
+// fits in its first byte along with nodeEncodingV2Tag.
+const maxNodeEncodingV2Height = 63
+
+// nodeEncoding returns the encoding of the nodes written: NodeEncodingV2 if it is the option,
+// or if it is recorded in the DB, see checkNodeEncoding.
+func (ndb *nodeDB) nodeEncoding() NodeEncoding {
+	if ndb.opts.NodeEncoding == NodeEncodingV2 || ndb.nodeEncodingV2.Load() {
+		return NodeEncodingV2
+	}
+	return NodeEncodingV1
+}
+
+// checkNodeEncoding reads the encoding recorded in the DB, and records the NodeEncoding option
+// if it is NodeEncodingV2 and none is, so that the tree keeps writing the nodes with it, the DB
+// being unreadable by the releases before the option anyway. The check is done once.
+func (ndb *nodeDB) checkNodeEncoding() error {
+	ndb.mtx.Lock()
+	checked := ndb.nodeEncodingChecked
+	ndb.mtx.Unlock()
+	if checked {
+		return nil
+	}
+
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(nodeEncodingKey)))
+	if err != nil {
+		return err
+	}
+	switch {
+	case bz != nil:
+		if len(bz) != 1 || NodeEncoding(bz[0]) != NodeEncodingV2 {
+			return fmt.Errorf("invalid node encoding %X", bz)
+		}
+		ndb.nodeEncodingV2.Store(true)
+	case ndb.opts.NodeEncoding == NodeEncodingV2:
+		batch := ndb.db.NewBatch()
+		defer batch.Close()
+		if err := batch.Set(metadataKeyFormat.Key([]byte(nodeEncodingKey)), []byte{byte(NodeEncodingV2)}); err != nil {
+			return err
+		}
+		if err := batch.WriteSync(); err != nil {
+			return err
+		}
+		ndb.nodeEncodingV2.Store(true)
+	case ndb.opts.NodeEncoding != NodeEncodingV1:
+		return fmt.Errorf("unknown node encoding %v: %w", ndb.opts.NodeEncoding, ErrInvalidInputs)
+	}
+
+	ndb.mtx.Lock()
+	ndb.nodeEncodingChecked = true
+	ndb.mtx.Unlock()
+	return nil
+}
+
+// writeEncodedBytes is writeBytesWithValueHash, writing the node with NodeEncodingV2 if it is
+// the given encoding and the node can be expressed with it.
+func (node *Node) writeEncodedBytes(w io.Writer, enc NodeEncoding, codec ValueCodec, valueHash []byte) error {
+	if enc != NodeEncodingV2 || !node.canWriteV2() {
+		return node.writeBytesWithValueHash(w, codec, valueHash)
+	}
+
+	height := node.subtreeHeight
+	if _, err := w.Write([]byte{nodeEncodingV2Tag | byte(height)<<1}); err != nil {
+		return fmt.Errorf("writing height, %w", err)
+	}
+	if !node.isLeaf() {
+		if err := encoding.EncodeUvarint(w, uint64(node.size)); err != nil {
+			return fmt.Errorf("writing size, %w", err)
+		}
+	}
+	if err := encoding.EncodeBytes(w, node.key); err != nil {
+		return fmt.Errorf("writing key, %w", err)
+	}
+
+	if node.isLeaf() {
+		// the value is written as with NodeEncodingV1.
+		if valueHash == nil {
+			if node.external {
+				return errors.New("writing leaf whose value is stored apart")
+			}
+			return writeValue(w, node.value, codec)
+		}
+		if err := encoding.EncodeBytes(w, valueHash); err != nil {
+			return fmt.Errorf("writing value hash, %w", err)
+		}
+		if _, err := w.Write([]byte{externalValueTag}); err != nil {
+			return fmt.Errorf("writing external value tag, %w", err)
+		}
+		return nil
+	}
+
+	if len(node.hash) != hashSize {
+		return fmt.Errorf("writing hash of %d bytes", len(node.hash))
+	}
+	if _, err := w.Write(node.hash); err != nil {
+		return fmt.Errorf("writing hash, %w", err)
+	}
+	for _, child := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+		nk := GetNodeKey(child)
+		if err := encoding.EncodeUvarint(w, uint64(node.nodeKey.version-nk.version)); err != nil {
+			return fmt.Errorf("writing the version delta of child node key, %w", err)
+		}
+		if err := encoding.EncodeUvarint(w, uint64(nk.nonce)); err != nil {
+			return fmt.Errorf("writing the nonce of child node key, %w", err)
+		}
+	}
+	return nil
+}
+
+// canWriteV2 returns whether the node can be written with NodeEncodingV2: it isn't legacy, its
+// height fits in the first byte, and its children, if any, aren't legacy and aren't newer than
+// it, so that the deltas of their versions are non-negative.
+func (node *Node) canWriteV2() bool {
+	if node.isLegacy || node.nodeKey == nil || node.subtreeHeight < 0 || node.subtreeHeight > maxNodeEncodingV2Height {
+		return false
+	}
+	if node.isLeaf() {
+		return true
+	}
+	for _, child := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+		if len(child) != 12 || GetNodeKey(child).version > node.nodeKey.version {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeNodeV2 is decodeNode for a node written with NodeEncodingV2.
+func decodeNodeV2(nk, buf []byte, codec ValueCodec) (*Node, []byte, error) {
+	node := &Node{
+		subtreeHeight: int8(buf[0] >> 1),
+		size:          1,
+		nodeKey:       GetNodeKey(nk),
+	}
+	if buf[0]>>1 > maxNodeEncodingV2Height {
+		return nil, nil, errors.New("invalid height, out of the range of the encoding")
+	}
+	buf = buf[1:]
+
+	if !node.isLeaf() {
+		size, n, err := encoding.DecodeUvarint(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding node.size, %w", err)
+		}
+		buf = buf[n:]
+		node.size = int64(size)
+		if node.size < 0 {
+			return nil, nil, errors.New("invalid size, out of int64 range")
+		}
+	}
+
+	key, n, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding node.key, %w", err)
+	}
+	buf = buf[n:]
+	node.key = key
+
+	if node.isLeaf() {
+		val, n, err := encoding.DecodeBytes(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding node.value, %w", err)
+		}
+		buf = buf[n:]
+		if len(buf) > 0 && buf[0] == externalValueTag {
+			node.external = true
+			return node, val, nil
+		}
+		if node.value, err = decodeValue(val, buf, codec); err != nil {
+			return nil, nil, err
+		}
+		return node, nil, nil
+	}
+
+	if len(buf) < hashSize {
+		return nil, nil, errors.New("decoding node.hash, buffer too short")
+	}
+	node.hash, buf = buf[:hashSize], buf[hashSize:]
+	childKeys := make([][]byte, 2)
+	for i := range childKeys {
+		delta, n, err := encoding.DecodeUvarint(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding the version delta of child node key, %w", err)
+		}
+		buf = buf[n:]
+		nonce, n, err := encoding.DecodeUvarint(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding the nonce of child node key, %w", err)
+		}
+		buf = buf[n:]
+		childKey := NodeKey{version: node.nodeKey.version - int64(delta), nonce: uint32(nonce)}
+		if delta > uint64(node.nodeKey.version) || nonce != uint64(childKey.nonce) {
+			return nil, nil, errors.New("invalid child node key, out of range")
+		}
+		childKeys[i] = childKey.GetKey()
+	}
+	node.leftNodeKey, node.rightNodeKey = childKeys[0], childKeys[1]
+	return node, nil, nil
+}
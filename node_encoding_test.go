@@ -0,0 +1,125 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// storedNodeBytes returns the size of the nodes stored in db.
+func storedNodeBytes(t *testing.T, db dbm.DB) int {
+	t.Helper()
+	itr, err := db.Iterator([]byte{nodeKeyFormat.Prefix()[0]}, []byte{nodeKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer itr.Close()
+	size := 0
+	for ; itr.Valid(); itr.Next() {
+		size += len(itr.Value())
+	}
+	return size
+}
+
+func TestNodeEncodingV2_RoundTrip(t *testing.T) {
+	nk := &NodeKey{version: 1_000_000, nonce: 3}
+	for name, node := range map[string]*Node{
+		"leaf": {key: []byte("key"), value: []byte("value"), size: 1, nodeKey: nk},
+		"inner": {
+			key: []byte("key"), hash: bytes.Repeat([]byte{1}, hashSize), size: 1_000, subtreeHeight: 9, nodeKey: nk,
+			leftNodeKey:  (&NodeKey{version: 999_999, nonce: 7}).GetKey(),
+			rightNodeKey: (&NodeKey{version: 1_000_000, nonce: 4}).GetKey(),
+		},
+	} {
+		var v1, v2 bytes.Buffer
+		require.NoError(t, node.writeEncodedBytes(&v1, NodeEncodingV1, nil, nil), name)
+		require.NoError(t, node.writeEncodedBytes(&v2, NodeEncodingV2, nil, nil), name)
+		require.Less(t, v2.Len(), v1.Len(), name)
+		for _, buf := range [][]byte{v1.Bytes(), v2.Bytes()} {
+			decoded, _, err := decodeNode(nk.GetKey(), buf, nil)
+			require.NoError(t, err, name)
+			require.Equal(t, node, decoded, name)
+		}
+	}
+
+	// the nodes v2 can't express are written with v1.
+	legacy := &Node{
+		key: []byte("key"), hash: bytes.Repeat([]byte{1}, hashSize), size: 2, subtreeHeight: 1, nodeKey: nk,
+		leftNodeKey:  bytes.Repeat([]byte{2}, hashSize),
+		rightNodeKey: (&NodeKey{version: 1, nonce: 1}).GetKey(),
+	}
+	var buf bytes.Buffer
+	require.NoError(t, legacy.writeEncodedBytes(&buf, NodeEncodingV2, nil, nil))
+	require.Zero(t, buf.Bytes()[0]&nodeEncodingV2Tag)
+}
+
+func TestNodeEncodingV2(t *testing.T) {
+	// the versions are large, so that their deltas are much shorter.
+	const initialVersion = 10_000_000
+	save := func(tree *MutableTree, version int) []byte {
+		for i := 0; i < 200; i += 1 + version%3 {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", version)))
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		return hash
+	}
+	open := func(db dbm.DB, options ...Option) *MutableTree {
+		options = append(options, InitialVersionOption(initialVersion))
+		tree := NewMutableTree(db, 0, false, log.NewNopLogger(), options...)
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+
+	db, referenceDB := dbm.NewMemDB(), dbm.NewMemDB()
+	tree, reference := open(db), open(referenceDB)
+	var hashes [][]byte
+	for version := 0; version < 6; version++ {
+		if version == 3 {
+			// the encoding is switched on the existing tree.
+			tree = open(db, NodeEncodingOption(NodeEncodingV2))
+		}
+		expected := save(reference, version)
+		require.Equal(t, expected, save(tree, version))
+		hashes = append(hashes, expected)
+	}
+	require.Less(t, storedNodeBytes(t, db), storedNodeBytes(t, referenceDB))
+
+	// the encoding is recorded, so that the tree keeps writing it without the option, and the
+	// nodes of both encodings are read.
+	tree = open(db)
+	require.Equal(t, NodeEncodingV2, tree.ndb.nodeEncoding())
+	require.Equal(t, NodeEncodingV1, reference.ndb.nodeEncoding())
+	for version, hash := range hashes {
+		itree, err := tree.GetImmutable(int64(initialVersion + version))
+		require.NoError(t, err)
+		require.Equal(t, hash, itree.Hash())
+		expected, err := reference.GetImmutable(int64(initialVersion + version))
+		require.NoError(t, err)
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			value, err := itree.Get(key)
+			require.NoError(t, err)
+			expectedValue, err := expected.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value)
+		}
+	}
+
+	// the pruning reformats the roots and deletes the orphans of both encodings.
+	require.NoError(t, tree.DeleteVersionsTo(initialVersion+4))
+	require.NoError(t, reference.DeleteVersionsTo(initialVersion+4))
+	require.Equal(t, save(reference, 6), save(tree, 6))
+	require.NoError(t, tree.DeleteVersionsTo(initialVersion+5))
+	tree = open(db)
+	require.Equal(t, []int{initialVersion + 6}, tree.AvailableVersions())
+	require.Equal(t, reference.Hash(), tree.Hash())
+
+	_, err := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), NodeEncodingOption(3)).Load()
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -0,0 +1,444 @@
+package iavl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+const nodeKeyMigrationKey = "node_key_migration"
+
+// nodeKeyMigrationBatchSize is the number of legacy records deleted per commit by the last step of
+// MigrateNodeKeys.
+const nodeKeyMigrationBatchSize = 10000
+
+// Key Format for the node keys of the legacy nodes rewritten by MigrateNodeKeys, by hash, which
+// are deleted once the migration completes.
+var migratedNodeKeyFormat = keyformat.NewFastPrefixFormatter('h', hashSize) // h<hash>
+
+// NodeKeyMigrationProgress returns the number of legacy versions rewritten so far by the running
+// or last node key migration, and the number of legacy versions it rewrites, see
+// MigrateNodeKeys. Both are 0 if no migration ran. It may be called concurrently with the
+// migration.
+func (tree *MutableTree) NodeKeyMigrationProgress() (done, total int64) {
+	return tree.nodeKeyMigrationDone.Load(), tree.nodeKeyMigrationTotal.Load()
+}
+
+// MigrateNodeKeys rewrites the legacy versions, whose nodes are keyed by their hash and pruned
+// with orphan records, in the node key layout of the versions saved since, in which the nodes are
+// keyed by their version and a nonce, and no orphan record is written. The root hashes don't
+// change. The nodes of the later versions referencing legacy nodes are relinked to their
+// rewritten copies, and the legacy nodes, roots and orphan records are then deleted.
+//
+// The legacy versions are rewritten from the latest one down, each one committed on its own, so
+// that the database always holds legacy versions below the rewritten ones, as after an upgrade,
+// and the migration resumes where it stopped if interrupted, e.g. when ctx is done, whose error
+// is then returned. NodeKeyMigrationProgress reports its progress meanwhile. It returns the number
+// of rewritten versions.
+//
+// It reads all the legacy nodes, so it is meant to be run offline, or see the MigrateLegacyNodes
+// option to run it when loading the tree. The tree is reloaded afterwards, discarding its unsaved
+// changes, since the working tree may use the deleted legacy nodes.
+func (tree *MutableTree) MigrateNodeKeys(ctx context.Context) (int64, error) {
+	tree.ndb.writeMtx.Lock()
+	migrated, err := tree.ndb.migrateNodeKeys(ctx, &tree.nodeKeyMigrationDone, &tree.nodeKeyMigrationTotal)
+	tree.ndb.writeMtx.Unlock()
+	if err != nil {
+		return migrated, err
+	}
+	tree.immutableCache.reset()
+	if tree.loaded.Load() {
+		if _, err := tree.LoadVersionContext(ctx, tree.version); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// nodeKeyMigration holds the state of a run of migrateNodeKeys.
+type nodeKeyMigration struct {
+	ndb    *nodeDB
+	nonces map[int64]uint32 // next nonce of the rewritten nodes, by version
+}
+
+// migrateNodeKeys implements MutableTree.MigrateNodeKeys, counting the rewritten legacy versions
+// in done out of total. The caller holds writeMtx.
+func (ndb *nodeDB) migrateNodeKeys(ctx context.Context, done, total *atomic.Int64) (int64, error) {
+	legacyVersions, err := ndb.legacyVersions()
+	if err != nil {
+		return 0, err
+	}
+	boundary, started, err := ndb.getNodeKeyMigrationBoundary()
+	if err != nil {
+		return 0, err
+	}
+	if !started {
+		hasLegacyNodes, err := ndb.hasPrefix(legacyNodeKeyFormat.Prefix())
+		if err != nil || !hasLegacyNodes {
+			return 0, err
+		}
+		if len(legacyVersions) > 0 {
+			boundary = legacyVersions[len(legacyVersions)-1]
+		}
+		// the boundary is recorded first, so that a resumed migration relinks the same versions.
+		ndb.mtx.Lock()
+		err = ndb.setNodeKeyMigrationBoundaryToBatch(boundary)
+		ndb.mtx.Unlock()
+		if err == nil {
+			err = ndb.Commit()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	done.Store(0)
+	total.Store(int64(len(legacyVersions)))
+	ndb.logger.Info("node key migration started", "legacyVersions", len(legacyVersions))
+
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	m := &nodeKeyMigration{ndb: ndb, nonces: make(map[int64]uint32)}
+	for i := len(legacyVersions) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return done.Load(), err
+		}
+		version := legacyVersions[i]
+		// the versions missing around the legacy versions were pruned, and are marked as such
+		// for VersionExists and getFirstVersion once their legacy neighbours are rewritten.
+		prev, next := version, latest+1
+		if i > 0 {
+			prev = legacyVersions[i-1]
+		}
+		if i < len(legacyVersions)-1 {
+			next = legacyVersions[i+1]
+		}
+		if err := m.migrateVersion(version, prev, next); err != nil {
+			return done.Load(), fmt.Errorf("migrating version %d: %w", version, err)
+		}
+		done.Add(1)
+		if n := done.Load(); n%1000 == 0 {
+			ndb.logger.Info("migrating legacy versions", "migrated", n, "total", len(legacyVersions))
+		}
+	}
+
+	if err := m.relink(ctx, boundary); err != nil {
+		return done.Load(), err
+	}
+
+	for _, prefix := range [][]byte{
+		legacyNodeKeyFormat.Prefix(), legacyOrphanKeyFormat.Key(),
+		compactOrphanKeyFormat.Key(), migratedNodeKeyFormat.Prefix(),
+	} {
+		if err := ndb.deletePrefix(ctx, prefix); err != nil {
+			return done.Load(), err
+		}
+	}
+	ndb.mtx.Lock()
+	err = ndb.batch.Delete(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)))
+	ndb.mtx.Unlock()
+	if err == nil {
+		err = ndb.Commit()
+	}
+	if err != nil {
+		return done.Load(), err
+	}
+	ndb.resetLegacyLatestVersion(-1)
+	ndb.logger.Info("node key migration finished", "migrated", done.Load())
+	return done.Load(), nil
+}
+
+// migrateVersion rewrites the legacy version, and marks the versions missing between the previous
+// and the next available ones as pruned, then commits.
+func (m *nodeKeyMigration) migrateVersion(version, prev, next int64) error {
+	ndb := m.ndb
+	rootHash, err := ndb.db.Get(ndb.legacyRootKey(version))
+	if err != nil {
+		return err
+	}
+	if len(rootHash) == 0 {
+		err = ndb.SaveEmptyRoot(version)
+	} else {
+		var nk []byte
+		if nk, err = m.migrate(rootHash, 0); err == nil {
+			if rootKey := GetNodeKey(nk); rootKey.version != version || rootKey.nonce != 1 {
+				err = ndb.SaveRoot(version, rootKey)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	ndb.mtx.Lock()
+	err = ndb.batch.Delete(ndb.legacyRootKey(version))
+	for v := prev + 1; v < next && err == nil; v++ {
+		if v == version {
+			continue
+		}
+		var has bool
+		if has, err = ndb.hasVersion(v); err == nil && !has {
+			err = ndb.batch.Set(prunedVersionKeyFormat.KeyInt64(v), []byte{})
+		}
+	}
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+	// the cached latest legacy version is the one just rewritten.
+	ndb.resetLegacyLatestVersion(0)
+	return nil
+}
+
+// migrate rewrites the legacy node with the given hash and its descendants in the node key
+// layout, unless they were already, and returns its node key. parentVersion is the version of
+// the parent of the node, 0 for a root.
+func (m *nodeKeyMigration) migrate(hash []byte, parentVersion int64) ([]byte, error) {
+	ndb := m.ndb
+	nk, err := ndb.db.Get(migratedNodeKeyFormat.Key(hash))
+	if err != nil || nk != nil {
+		return nk, err
+	}
+	legacy, err := ndb.GetNode(hash)
+	if err != nil {
+		return nil, err
+	}
+	version := legacy.nodeKey.version
+	node := &Node{
+		key:           legacy.key,
+		value:         legacy.value,
+		hash:          legacy.hash,
+		size:          legacy.size,
+		subtreeHeight: legacy.subtreeHeight,
+	}
+	if !legacy.isLeaf() {
+		if node.leftNodeKey, err = m.migrate(legacy.leftNodeKey, version); err != nil {
+			return nil, err
+		}
+		if node.rightNodeKey, err = m.migrate(legacy.rightNodeKey, version); err != nil {
+			return nil, err
+		}
+	}
+
+	// the root of its own version gets the root key of the version, and only the nodes of
+	// another version than their parent can be such a root.
+	var nonce uint32
+	if parentVersion != version {
+		rootHash, err := ndb.db.Get(ndb.legacyRootKey(version))
+		if err != nil {
+			return nil, err
+		}
+		if rootHash != nil && string(rootHash) == string(hash) {
+			nonce = 1
+		}
+	}
+	if nonce == 0 {
+		if nonce, err = m.nextNonce(version); err != nil {
+			return nil, err
+		}
+	}
+	node.nodeKey = &NodeKey{version: version, nonce: nonce}
+	nk = node.nodeKey.GetKey()
+	if err := ndb.SaveNode(node); err != nil {
+		return nil, err
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return nk, ndb.batch.Set(migratedNodeKeyFormat.Key(hash), nk)
+}
+
+// nextNonce returns the next nonce of the nodes of the version rewritten by the migration, after
+// the ones already stored, e.g. by an interrupted migration. The nonce 1 is the one of the root.
+func (m *nodeKeyMigration) nextNonce(version int64) (uint32, error) {
+	nonce, ok := m.nonces[version]
+	if !ok {
+		nonce = 2
+		itr, err := m.ndb.db.ReverseIterator(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1))
+		if err != nil {
+			return 0, err
+		}
+		if itr.Valid() {
+			if last := GetNodeKey(itr.Key()[1:]).nonce; last >= nonce {
+				nonce = last + 1
+			}
+		}
+		err = itr.Error()
+		itr.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	m.nonces[version] = nonce + 1
+	return nonce, nil
+}
+
+// relink rewrites the nodes of the versions after boundary, which are in the node key layout,
+// referencing legacy nodes, so that they reference their rewritten copies instead. The subtrees
+// of the nodes of a version are visited once, from the first version using them.
+func (m *nodeKeyMigration) relink(ctx context.Context, boundary int64) error {
+	ndb := m.ndb
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	prev := boundary
+	for version := boundary + 1; version <= latest; version++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		has, err := ndb.hasVersion(version)
+		if err != nil {
+			return err
+		}
+		if !has {
+			continue
+		}
+		rootKey, err := ndb.GetRoot(version)
+		if err != nil {
+			return err
+		}
+		if rootKey != nil {
+			if err := m.relinkNode(rootKey, prev); err != nil {
+				return fmt.Errorf("relinking version %d: %w", version, err)
+			}
+		}
+		if err := ndb.Commit(); err != nil {
+			return err
+		}
+		prev = version
+	}
+	return nil
+}
+
+// relinkNode relinks the node with the given node key and its descendants saved after prev, or
+// reformatted from a legacy root, whose node keys have the nonce 0.
+func (m *nodeKeyMigration) relinkNode(nk []byte, prev int64) error {
+	node, err := m.ndb.GetNode(nk)
+	if err != nil {
+		return err
+	}
+	if node.isLeaf() {
+		return nil
+	}
+	children := [2][]byte{node.leftNodeKey, node.rightNodeKey}
+	relinked := false
+	for i, child := range children {
+		if len(child) == hashSize {
+			if children[i], err = m.migrate(child, node.nodeKey.version); err != nil {
+				return err
+			}
+			relinked = true
+			continue
+		}
+		if childKey := GetNodeKey(child); childKey.version > prev || childKey.nonce == 0 {
+			if err := m.relinkNode(child, prev); err != nil {
+				return err
+			}
+		}
+	}
+	if !relinked {
+		return nil
+	}
+	return m.ndb.SaveNode(&Node{
+		key:           node.key,
+		hash:          node.hash,
+		size:          node.size,
+		subtreeHeight: node.subtreeHeight,
+		nodeKey:       node.nodeKey,
+		leftNodeKey:   children[0],
+		rightNodeKey:  children[1],
+	})
+}
+
+// legacyVersions returns the versions with a legacy root, in ascending order.
+func (ndb *nodeDB) legacyVersions() ([]int64, error) {
+	var versions []int64
+	err := ndb.traversePrefix(legacyRootKeyFormat.Key(), func(key, _ []byte) error {
+		var version int64
+		legacyRootKeyFormat.Scan(key, &version)
+		versions = append(versions, version)
+		return nil
+	})
+	return versions, err
+}
+
+// hasPrefix returns whether any key has the given prefix.
+func (ndb *nodeDB) hasPrefix(prefix []byte) (bool, error) {
+	itr, err := ndb.getPrefixIterator(prefix)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	return itr.Valid(), itr.Error()
+}
+
+// deletePrefix deletes the keys with the given prefix, committing every
+// nodeKeyMigrationBatchSize keys.
+func (ndb *nodeDB) deletePrefix(ctx context.Context, prefix []byte) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// the keys are collected before deleting them, since the iterator of some databases
+		// doesn't allow writes.
+		var keys [][]byte
+		itr, err := ndb.getPrefixIterator(prefix)
+		if err != nil {
+			return err
+		}
+		for ; itr.Valid() && len(keys) < nodeKeyMigrationBatchSize; itr.Next() {
+			keys = append(keys, append([]byte(nil), itr.Key()...))
+		}
+		err = itr.Error()
+		if closeErr := itr.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		ndb.mtx.Lock()
+		for _, key := range keys {
+			if err = ndb.batch.Delete(key); err != nil {
+				break
+			}
+		}
+		ndb.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := ndb.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// getNodeKeyMigrationBoundary returns the latest legacy version when the interrupted node key
+// migration started, if any.
+func (ndb *nodeDB) getNodeKeyMigrationBoundary() (int64, bool, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)))
+	if err != nil || bz == nil {
+		return 0, false, err
+	}
+	if len(bz) != int64Size {
+		return 0, false, fmt.Errorf("invalid node key migration boundary %X", bz)
+	}
+	return int64(binary.BigEndian.Uint64(bz)), true, nil
+}
+
+func (ndb *nodeDB) setNodeKeyMigrationBoundaryToBatch(version int64) error {
+	bz := make([]byte, int64Size)
+	binary.BigEndian.PutUint64(bz, uint64(version))
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)), bz)
+}
@@ -0,0 +1,145 @@
+package iavl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// interruptingContext is a context whose Err returns an error once it was called n times.
+type interruptingContext struct {
+	context.Context
+	n int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (c *interruptingContext) Err() error {
+	if c.n <= 0 {
+		return errInterrupted
+	}
+	c.n--
+	return nil
+}
+
+// versionContents returns the root hash and the key/value pairs of every available version.
+func versionContents(t *testing.T, tree *MutableTree) (map[int64][]byte, map[int64]map[string]string) {
+	t.Helper()
+	hashes := make(map[int64][]byte)
+	contents := make(map[int64]map[string]string)
+	for _, version := range tree.AvailableVersions() {
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		hashes[int64(version)] = itree.Hash()
+		kvs := make(map[string]string)
+		_, err = itree.Iterate(func(key, value []byte) bool {
+			kvs[string(key)] = string(value)
+			return false
+		})
+		require.NoError(t, err)
+		contents[int64(version)] = kvs
+	}
+	return hashes, contents
+}
+
+func TestMigrateNodeKeys(t *testing.T) {
+	legacyVersion := 100
+	tree := openLegacyTree(t, legacyVersion)
+	_, err := tree.LoadVersion(int64(legacyVersion))
+	require.NoError(t, err)
+
+	// the new versions reference the legacy nodes, including one without any change.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte(fmt.Sprintf("value-%d-%d", i, j)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hashes, contents := versionContents(t, tree)
+	legacyVersions, err := tree.ndb.legacyVersions()
+	require.NoError(t, err)
+	require.NotEmpty(t, legacyVersions)
+
+	// an interrupted migration leaves the latest legacy versions rewritten, and resumes.
+	migrated, err := tree.MigrateNodeKeys(&interruptingContext{Context: context.Background(), n: 3})
+	require.ErrorIs(t, err, errInterrupted)
+	require.EqualValues(t, 3, migrated)
+	done, total := tree.NodeKeyMigrationProgress()
+	require.EqualValues(t, 3, done)
+	require.EqualValues(t, len(legacyVersions), total)
+	remaining, err := tree.ndb.legacyVersions()
+	require.NoError(t, err)
+	require.Equal(t, legacyVersions[:len(legacyVersions)-3], remaining)
+	partialHashes, partialContents := versionContents(t, tree)
+	require.Equal(t, hashes, partialHashes)
+	require.Equal(t, contents, partialContents)
+
+	migrated, err = tree.MigrateNodeKeys(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, len(legacyVersions)-3, migrated)
+
+	for _, prefix := range [][]byte{
+		legacyNodeKeyFormat.Prefix(), legacyRootKeyFormat.Key(), legacyOrphanKeyFormat.Key(),
+		compactOrphanKeyFormat.Key(), migratedNodeKeyFormat.Prefix(), metadataKeyFormat.Key([]byte(nodeKeyMigrationKey)),
+	} {
+		has, err := tree.ndb.hasPrefix(prefix)
+		require.NoError(t, err)
+		require.False(t, has, "prefix %X", prefix)
+	}
+
+	reloaded := NewMutableTree(tree.ndb.db, 1000, false, tree.logger)
+	latest, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.Version(), latest)
+	require.Equal(t, tree.AvailableVersions(), reloaded.AvailableVersions())
+	migratedHashes, migratedContents := versionContents(t, reloaded)
+	require.Equal(t, hashes, migratedHashes)
+	require.Equal(t, contents, migratedContents)
+	for version := range hashes {
+		require.NoError(t, reloaded.VerifyIntegrity(version, 1))
+	}
+
+	// the migrated versions are pruned as the others.
+	_, err = reloaded.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = reloaded.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, reloaded.DeleteVersionsTo(latest-1))
+	require.Equal(t, []int{int(latest), int(latest + 1)}, reloaded.AvailableVersions())
+	itree, err := reloaded.GetImmutable(latest)
+	require.NoError(t, err)
+	require.Equal(t, hashes[latest], itree.Hash())
+
+	// nothing is left to migrate.
+	migrated, err = reloaded.MigrateNodeKeys(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, migrated)
+}
+
+func TestMigrateNodeKeys_OnLoad(t *testing.T) {
+	legacyVersion := 20
+	tree := openLegacyTree(t, legacyVersion, MigrateLegacyNodesOption(true))
+	legacyTree := NewMutableTree(tree.ndb.db, 1000, false, tree.logger)
+	_, err := legacyTree.Load()
+	require.NoError(t, err)
+	hashes, contents := versionContents(t, legacyTree)
+
+	_, err = tree.Load()
+	require.NoError(t, err)
+	done, total := tree.NodeKeyMigrationProgress()
+	require.Positive(t, total)
+	require.Equal(t, total, done)
+	has, err := tree.ndb.hasPrefix(legacyNodeKeyFormat.Prefix())
+	require.NoError(t, err)
+	require.False(t, has)
+	migratedHashes, migratedContents := versionContents(t, tree)
+	require.Equal(t, hashes, migratedHashes)
+	require.Equal(t, contents, migratedContents)
+}
@@ -0,0 +1,46 @@
+package iavl
+
+import "sync"
+
+// nodePool recycles the transient inner nodes of a working tree when Options.NodePool is set.
+//
+// Ownership model: a node can only be returned to the pool when it has never been persisted
+// (its nodeKey is nil) and it is known to be replaced by a clone during copy-on-write updates,
+// see cloneReplacing. Removals clone nodes before knowing whether the key exists, so they
+// don't release the cloned nodes. Such
+// nodes are only reachable from the working tree of a MutableTree, never from the node cache,
+// the last saved tree or an ImmutableTree returned by GetImmutable, since those only ever
+// reference persisted nodes. After SaveVersion every node of the tree is persisted, so nodes are
+// never pooled across a commit.
+var nodePool = &sync.Pool{
+	New: func() interface{} {
+		return new(Node)
+	},
+}
+
+// getPooledNode returns a zeroed node from the pool.
+func getPooledNode() *Node {
+	return nodePool.Get().(*Node)
+}
+
+// releaseNode returns the given node to the pool if it is safe to do so, i.e. it is a
+// transient node of the working tree which is no longer referenced.
+func (tree *MutableTree) releaseNode(node *Node) {
+	if !tree.ndb.opts.NodePool || node.nodeKey != nil {
+		return
+	}
+	*node = Node{}
+	nodePool.Put(node)
+}
+
+// cloneReplacing clones the given node, which is known to be replaced by its clone in the
+// working tree, and releases it to the pool when it is a transient node.
+// CONTRACT: the given node must not be used afterwards.
+func (tree *MutableTree) cloneReplacing(node *Node) (*Node, error) {
+	cloned, err := node.clone(tree)
+	if err != nil {
+		return nil, err
+	}
+	tree.releaseNode(node)
+	return cloned, nil
+}
@@ -0,0 +1,75 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestNodePool_SameResults(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	pooled := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), NodePoolOption(true))
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+
+	for v := 0; v < 20; v++ {
+		for i := 0; i < 500; i++ {
+			key := []byte(fmt.Sprintf("key-%04d", r.Intn(2000)))
+			if r.Intn(4) == 0 {
+				_, removed1, err := pooled.Remove(key)
+				require.NoError(t, err)
+				_, removed2, err := plain.Remove(key)
+				require.NoError(t, err)
+				require.Equal(t, removed2, removed1)
+				continue
+			}
+			value := []byte(fmt.Sprintf("value-%d-%d", v, i))
+			updated1, err := pooled.Set(key, value)
+			require.NoError(t, err)
+			updated2, err := plain.Set(key, value)
+			require.NoError(t, err)
+			require.Equal(t, updated2, updated1)
+		}
+		require.Equal(t, plain.WorkingHash(), pooled.WorkingHash())
+
+		hash1, version1, err := pooled.SaveVersion()
+		require.NoError(t, err)
+		hash2, version2, err := plain.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, version2, version1)
+		require.Equal(t, hash2, hash1)
+	}
+
+	// all saved versions remain intact
+	for _, version := range plain.AvailableVersions() {
+		itree1, err := pooled.GetImmutable(int64(version))
+		require.NoError(t, err)
+		itree2, err := plain.GetImmutable(int64(version))
+		require.NoError(t, err)
+		require.Equal(t, itree2.Hash(), itree1.Hash())
+		require.Equal(t, itree2.String(), itree1.String())
+	}
+}
+
+func BenchmarkNodePool_SaveVersion(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", enabled), func(b *testing.B) {
+			r := rand.New(rand.NewSource(42))
+			tree := NewMutableTree(dbm.NewMemDB(), 10000, true, log.NewNopLogger(), NodePoolOption(enabled))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 10000; j++ {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%06d", r.Intn(100000))), []byte{byte(j)})
+					require.NoError(b, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
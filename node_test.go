@@ -86,6 +86,17 @@ func TestNode_encode_decode(t *testing.T) {
 			},
 			hash: []byte{0x7f, 0x68, 0x90, 0xca, 0x16, 0xde, 0xa6, 0xe8, 0x89, 0x3d, 0x96, 0xf0, 0xa3, 0xd, 0xa, 0x14, 0xe5, 0x55, 0x59, 0xfc, 0x9b, 0x83, 0x4, 0x91, 0xe3, 0xd2, 0x45, 0x1c, 0x81, 0xf6, 0xd1, 0xe},
 		}, "0002036b65790576616c7565", false},
+		"leaf with empty value": {&Node{
+			subtreeHeight: 0,
+			size:          1,
+			key:           []byte("key"),
+			value:         []byte{},
+			nodeKey: &NodeKey{
+				version: 3,
+				nonce:   1,
+			},
+			hash: []byte{0x46, 0xf5, 0x36, 0x5, 0xd7, 0x35, 0xf4, 0x0, 0x48, 0xb1, 0xdf, 0x73, 0x80, 0x62, 0xb4, 0x52, 0x96, 0xf1, 0x65, 0x16, 0x1f, 0x29, 0xda, 0xa6, 0x33, 0x48, 0x2b, 0x8, 0x63, 0x88, 0xea, 0x70},
+		}, "0002036b657900", false},
 	}
 	for name, tc := range testcases {
 		tc := tc
@@ -234,7 +245,7 @@ func BenchmarkNode_HashNode(b *testing.B) {
 		sub.ReportAllocs()
 		for i := 0; i < sub.N; i++ {
 			h := sha256.New()
-			require.NoError(b, node.writeHashBytes(h, node.nodeKey.version))
+			require.NoError(b, node.writeHashBytes(h, node.nodeKey.version, HashSHA256))
 			_ = h.Sum(nil)
 		}
 	})
@@ -244,7 +255,7 @@ func BenchmarkNode_HashNode(b *testing.B) {
 			h := sha256.New()
 			buf := new(bytes.Buffer)
 			buf.Grow(node.encodedSize())
-			require.NoError(b, node.writeHashBytes(buf, node.nodeKey.version))
+			require.NoError(b, node.writeHashBytes(buf, node.nodeKey.version, HashSHA256))
 			_, err := h.Write(buf.Bytes())
 			require.NoError(b, err)
 			_ = h.Sum(nil)
@@ -255,7 +266,7 @@ func BenchmarkNode_HashNode(b *testing.B) {
 		for i := 0; i < sub.N; i++ {
 			h := sha256.New()
 			buf := new(bytes.Buffer)
-			require.NoError(b, node.writeHashBytes(buf, node.nodeKey.version))
+			require.NoError(b, node.writeHashBytes(buf, node.nodeKey.version, HashSHA256))
 			_, err := h.Write(buf.Bytes())
 			require.NoError(b, err)
 			_ = h.Sum(nil)
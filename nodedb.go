@@ -10,10 +10,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"cosmossdk.io/log"
-
 	"github.com/cosmos/iavl/cache"
 	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
@@ -76,41 +75,132 @@ var (
 var errInvalidFastStorageVersion = fmt.Errorf("fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 
 type nodeDB struct {
-	logger log.Logger
-
-	mtx                 sync.Mutex       // Read/write lock.
-	db                  dbm.DB           // Persistent node storage.
-	batch               dbm.Batch        // Batched writing buffer.
-	opts                Options          // Options to customize for pruning/writing
-	versionReaders      map[int64]uint32 // Number of active version readers
-	storageVersion      string           // Storage version
-	firstVersion        int64            // First version of nodeDB.
-	latestVersion       int64            // Latest version of nodeDB.
-	legacyLatestVersion int64            // Latest version of nodeDB in legacy format.
-	nodeCache           cache.Cache      // Cache for nodes in the regular tree that consists of key-value pairs at any version.
-	fastNodeCache       cache.Cache      // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
-}
-
-func newNodeDB(db dbm.DB, cacheSize int, opts Options, lg log.Logger) *nodeDB {
+	logger Logger
+
+	mtx                  sync.Mutex                  // Read/write lock.
+	db                   dbm.DB                      // Persistent node storage.
+	batch                dbm.Batch                   // Batched writing buffer.
+	opts                 Options                     // Options to customize for pruning/writing
+	versionReaders       map[int64]uint32            // Number of active version readers
+	storageVersion       string                      // Storage version
+	fastStorageMigrating bool                        // Whether the fast storage is being migrated, which disables it.
+	fastStorageStale     bool                        // Whether writing the fast nodes of a version failed, which disables the fast storage until it is migrated again.
+	firstVersion         int64                       // First version of nodeDB.
+	latestVersion        int64                       // Latest version of nodeDB.
+	legacyLatestVersion  int64                       // Latest version of nodeDB in legacy format.
+	nodeCache            cache.Cache                 // Cache for nodes in the regular tree that consists of key-value pairs at any version.
+	fastNodeCache        cache.Cache                 // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+	arena                *nodeArena                  // Off-heap store of the nodes evicted from nodeCache, nil unless the NodeArenaSize option is set.
+	archive              *ArchiveFile                // Archive file the nodes are read from instead of db, see OpenArchiveFile.
+	keys                 *keyInterner                // Keys shared by the nodes read from db, nil unless the InternKeys option is set.
+	bloom                atomic.Pointer[bloomFilter] // Filter of the keys consulted by Get and Has, nil unless the BloomFilterKeys option is set and the tree loaded.
+	coalescer            *coalescingDB               // db when it coalesces the writes of the versions, nil unless the CoalesceWindow option is set.
+	prefetching          sync.WaitGroup              // Prefetches in progress, see ImmutableTree.Prefetch.
+	writeMtx             sync.Mutex                  // Held while writing and committing a version or its deletion, see asyncPruner.
+	prunerMtx            sync.Mutex                  // Guards pruner.
+	pruner               *asyncPruner                // Deletes the versions queued by the async pruning, nil unless running.
+	pendingCommit        bool                        // Whether the batch holds the commit marker of an operation, see beginCommit.
+	hashSchemeChecked    bool                        // Whether the HashScheme option was checked against the DB, see checkHashScheme.
+	nodeEncodingChecked  bool                        // Whether the node encoding recorded in the DB was read, see checkNodeEncoding.
+	nodeEncodingV2       atomic.Bool                 // Whether NodeEncodingV2 is recorded in the DB.
+
+	nodeCacheStats     *cache.Recorder // Statistics of nodeCache, kept when it is replaced.
+	fastNodeCacheStats *cache.Recorder // Statistics of fastNodeCache.
+
+	// concurrentNodeCache is nodeCache if it is safe for concurrent use, so that GetNode serves
+	// its hits without locking mtx. nil otherwise.
+	concurrentNodeCache atomic.Pointer[cache.Cache]
+}
+
+func newNodeDB(db dbm.DB, cacheSize int, opts Options, lg Logger) *nodeDB {
+	opts.SyncMode = opts.syncMode()
+	db = withKeyPrefix(withOperationHook(withRetries(db, opts.DBRetry), opts.OperationHook), opts.KeyPrefix)
 	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
 
 	if err != nil || storeVersion == nil {
 		storeVersion = []byte(defaultStorageVersionValue)
 	}
 
-	return &nodeDB{
+	var coalescer *coalescingDB
+	if opts.CoalesceWindow > 0 {
+		coalescer = newCoalescingDB(db, opts, lg)
+		db = coalescer
+	}
+	batch := NewBatchWithFlusher(db, opts.FlushThreshold)
+	// only SyncAlways syncs the flushes triggered by the threshold, Commit syncs otherwise.
+	batch.syncFlushes = opts.SyncMode == SyncAlways
+
+	nodeCache := cache.New(cacheSize)
+	if opts.NodeCachePolicy != nil {
+		nodeCache = opts.NodeCachePolicy(cacheSize)
+	}
+	if opts.NodeCacheShards > 0 {
+		nodeCache = cache.NewSharded(opts.NodeCacheShards, cacheSize)
+	}
+	var arena *nodeArena
+	if opts.NodeArenaSize > 0 && opts.NodeCachePolicy == nil && opts.NodeCacheShards == 0 {
+		if arena, err = newNodeArena(opts.NodeArenaSize); err != nil {
+			lg.Error("failed to map the node arena, the evicted nodes are dropped", "err", err)
+		} else {
+			nodeCache = cache.NewTiered(cacheSize, arena)
+		}
+	}
+	ndb := &nodeDB{
 		logger:              lg,
 		db:                  db,
-		batch:               NewBatchWithFlusher(db, opts.FlushThreshold),
+		batch:               batch,
 		opts:                opts,
 		firstVersion:        0,
 		latestVersion:       0, // initially invalid
 		legacyLatestVersion: 0,
-		nodeCache:           cache.New(cacheSize),
+		nodeCache:           nodeCache,
+		arena:               arena,
 		fastNodeCache:       cache.New(fastNodeCacheSize),
 		versionReaders:      make(map[int64]uint32, 8),
 		storageVersion:      string(storeVersion),
+		keys:                newKeyInterner(opts.InternKeys),
+		coalescer:           coalescer,
+		nodeCacheStats:      cache.NewRecorder(opts.NodeCacheStatsHook),
+		fastNodeCacheStats:  cache.NewRecorder(opts.FastNodeCacheStatsHook),
 	}
+	ndb.setConcurrentNodeCache(nodeCache)
+	return ndb
+}
+
+// cacheStats returns the statistics of the caches, see MutableTree.CacheStats.
+func (ndb *nodeDB) cacheStats() CacheStats {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return CacheStats{
+		Nodes:     ndb.nodeCacheStats.Stats(ndb.nodeCache),
+		FastNodes: ndb.fastNodeCacheStats.Stats(ndb.fastNodeCache),
+	}
+}
+
+// setConcurrentNodeCache sets concurrentNodeCache from the node cache c.
+func (ndb *nodeDB) setConcurrentNodeCache(c cache.Cache) {
+	if _, ok := c.(cache.Concurrent); ok {
+		ndb.concurrentNodeCache.Store(&c)
+	} else {
+		ndb.concurrentNodeCache.Store(nil)
+	}
+}
+
+// setNodeCache replaces the node cache, see MutableTree.SetCache.
+func (ndb *nodeDB) setNodeCache(c cache.Cache, migrate bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if old, ok := ndb.nodeCache.(cache.Enumerator); migrate && ok {
+		// add the least recently used nodes first, so that the recency order is kept and the
+		// coldest nodes are evicted if the new cache is smaller.
+		nodes := old.Nodes()
+		for i := len(nodes) - 1; i >= 0; i-- {
+			c.Add(nodes[i])
+		}
+	}
+	ndb.nodeCache = c
+	ndb.setConcurrentNodeCache(c)
 }
 
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
@@ -118,6 +208,25 @@ func newNodeDB(db dbm.DB, cacheSize int, opts Options, lg log.Logger) *nodeDB {
 // It is used for both formats of nodes: legacy and new.
 // `legacy`: nk is the hash of the node. `new`: <version><nonce>.
 func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
+	return ndb.getNode(nk, false)
+}
+
+// getNode is GetNode, leaving the hash of a leaf loaded from disk nil if unhashed is true, see
+// the LazyHashing option. Such a leaf isn't cached, as the cached nodes are shared with the
+// readers, which expect their hash.
+func (ndb *nodeDB) getNode(nk []byte, unhashed bool) (*Node, error) {
+	if ndb.archive != nil {
+		// archive files are immutable, so no lock is needed.
+		return ndb.archive.getNode(nk)
+	}
+	if c := ndb.concurrentNodeCache.Load(); c != nil && nk != nil {
+		if cachedNode := (*c).Get(nk); cachedNode != nil {
+			ndb.opts.Stat.IncCacheHitCnt()
+			ndb.nodeCacheStats.RecordHit()
+			return cachedNode.(*Node), nil
+		}
+	}
+
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
@@ -126,7 +235,7 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 	}
 
 	// Check the cache.
-	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+	if cachedNode := ndb.nodeCacheStats.Get(ndb.nodeCache, nk); cachedNode != nil {
 		ndb.opts.Stat.IncCacheHitCnt()
 		return cachedNode.(*Node), nil
 	}
@@ -141,9 +250,10 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 	} else {
 		nodeKey = ndb.nodeKey(nk)
 	}
+	start := time.Now()
 	buf, err := ndb.db.Get(nodeKey)
 	if err != nil {
-		return nil, fmt.Errorf("can't get node %v: %v", nk, err)
+		return nil, fmt.Errorf("can't get node %v: %w", nk, err)
 	}
 	if buf == nil {
 		return nil, fmt.Errorf("Value missing for key %v corresponding to nodeKey %x", nk, nodeKey)
@@ -155,14 +265,25 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
 		}
+	} else if unhashed {
+		node, err = makeUnhashedNode(nk, buf, ndb.valueCodec(), ndb.hashScheme())
+		if err != nil {
+			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+		}
 	} else {
-		node, err = MakeNode(nk, buf)
+		node, err = makeNode(nk, buf, ndb.valueCodec(), ndb.hashScheme())
 		if err != nil {
 			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
 		}
 	}
+	ndb.keys.internNode(node)
+	if hook := ndb.opts.OperationHook; hook != nil {
+		hook.OnNodeLoad(time.Since(start), len(buf))
+	}
 
-	ndb.nodeCache.Add(node)
+	if node.hash != nil {
+		ndb.nodeCacheStats.Add(ndb.nodeCache, node)
+	}
 
 	return node, nil
 }
@@ -179,7 +300,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 		return nil, fmt.Errorf("nodeDB.GetFastNode() requires key, len(key) equals 0")
 	}
 
-	if cachedFastNode := ndb.fastNodeCache.Get(key); cachedFastNode != nil {
+	if cachedFastNode := ndb.fastNodeCacheStats.Get(ndb.fastNodeCache, key); cachedFastNode != nil {
 		ndb.opts.Stat.IncFastCacheHitCnt()
 		return cachedFastNode.(*fastnode.Node), nil
 	}
@@ -199,7 +320,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
-	ndb.fastNodeCache.Add(fastNode)
+	ndb.fastNodeCacheStats.Add(ndb.fastNodeCache, fastNode)
 	return fastNode, nil
 }
 
@@ -216,7 +337,13 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 	var buf bytes.Buffer
 	buf.Grow(node.encodedSize())
 
-	if err := node.writeBytes(&buf); err != nil {
+	external := false
+	if node.isLeaf() && !node.isLegacy {
+		var err error
+		if external, err = ndb.writeLeaf(&buf, node); err != nil {
+			return err
+		}
+	} else if err := node.writeEncodedBytes(&buf, ndb.nodeEncoding(), ndb.valueCodec(), nil); err != nil {
 		return err
 	}
 
@@ -225,7 +352,18 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 	}
 
 	ndb.logger.Debug("BATCH SAVE", "node", node)
-	ndb.nodeCache.Add(node)
+	if external && !node.external {
+		// the cache holds the leaf as it is loaded, without its value.
+		node = &Node{
+			key:           node.key,
+			hash:          node.hash,
+			nodeKey:       node.nodeKey,
+			size:          node.size,
+			subtreeHeight: node.subtreeHeight,
+			external:      true,
+		}
+	}
+	ndb.nodeCacheStats.Add(ndb.nodeCache, node)
 	return nil
 }
 
@@ -250,13 +388,26 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	newVersion, err := ndb.fastStorageVersion(latestVersion)
+	if err != nil {
+		return err
+	}
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+		return err
+	}
+	ndb.storageVersion = newVersion
+	return nil
+}
+
+// fastStorageVersion returns the fast storage version matching the live state at latestVersion.
+func (ndb *nodeDB) fastStorageVersion(latestVersion int64) (string, error) {
 	var newVersion string
 	if ndb.storageVersion >= fastStorageVersionValue {
 		// Storage version should be at index 0 and latest fast cache version at index 1
 		versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
 
 		if len(versions) > 2 {
-			return errInvalidFastStorageVersion
+			return "", errInvalidFastStorageVersion
 		}
 
 		newVersion = versions[0]
@@ -264,22 +415,99 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 		newVersion = fastStorageVersionValue
 	}
 
-	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
+	return newVersion + fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion)), nil
+}
 
-	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+// commitFastNodes writes the fast node changes of latestVersion, once it is committed, in a batch
+// of their own sorted by key, along with the fast storage version, see the SeparateFastNodeBatch
+// option. If it fails, the fast storage is marked as stale, and the fast storage version left
+// on disk makes the next load rebuild it.
+func (ndb *nodeDB) commitFastNodes(additions map[string]*fastnode.Node, removals map[string]interface{}, latestVersion int64) (err error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	defer func() {
+		if err != nil {
+			ndb.fastStorageStale = true
+		}
+	}()
+
+	keys := make([]string, 0, len(additions)+len(removals))
+	for key := range additions {
+		keys = append(keys, key)
+	}
+	for key := range removals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	batch := NewBatchWithFlusher(ndb.db, ndb.opts.FlushThreshold)
+	batch.syncFlushes = ndb.opts.SyncMode == SyncAlways
+	defer batch.Close()
+	for _, key := range keys {
+		node, ok := additions[key]
+		if !ok {
+			if err := batch.Delete(ndb.fastNodeKey([]byte(key))); err != nil {
+				return err
+			}
+			continue
+		}
+		var buf bytes.Buffer
+		buf.Grow(node.EncodedSize())
+		if err := node.WriteBytes(&buf); err != nil {
+			return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
+		}
+		if err := batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	newVersion, err := ndb.fastStorageVersion(latestVersion)
+	if err != nil {
+		return err
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
 		return err
 	}
+	if ndb.opts.SyncMode != SyncNone {
+		err = batch.WriteSync()
+	} else {
+		err = batch.Write()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write fast node batch, %w", err)
+	}
+
 	ndb.storageVersion = newVersion
+	for _, key := range keys {
+		if node, ok := additions[key]; ok {
+			ndb.fastNodeCacheStats.Add(ndb.fastNodeCache, node)
+		} else {
+			ndb.fastNodeCache.Remove([]byte(key))
+		}
+	}
 	return nil
 }
 
+// isFastStorageStale returns whether writing the fast nodes of a version failed, see
+// commitFastNodes.
+func (ndb *nodeDB) isFastStorageStale() bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.fastStorageStale
+}
+
 func (ndb *nodeDB) getStorageVersion() string {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
 	return ndb.storageVersion
 }
 
 // Returns true if the upgrade to latest storage version has been performed, false otherwise.
+// It is false while the fast storage is being migrated or is stale, so that its fast nodes aren't
+// read.
 func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
-	return ndb.getStorageVersion() >= fastStorageVersionValue
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return !ndb.fastStorageMigrating && !ndb.fastStorageStale && ndb.storageVersion >= fastStorageVersionValue
 }
 
 // Returns true if the upgrade to fast storage has occurred but it does not match the live state, false otherwise.
@@ -287,7 +515,7 @@ func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
 // We determine this by checking the version of the live state and the version of the live state when
 // latest storage was updated on disk the last time.
 func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
-	versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
+	versions := strings.Split(ndb.getStorageVersion(), fastStorageVersionDelimiter)
 
 	if len(versions) == 2 {
 		latestVersion, err := ndb.getLatestVersion()
@@ -320,7 +548,7 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
-		ndb.fastNodeCache.Add(node)
+		ndb.fastNodeCacheStats.Add(ndb.fastNodeCache, node)
 	}
 	return nil
 }
@@ -331,18 +559,21 @@ func (ndb *nodeDB) Has(nk []byte) (bool, error) {
 }
 
 // deleteVersion deletes a tree version from disk.
-// deletes orphans
-func (ndb *nodeDB) deleteVersion(version int64) error {
+// deletes orphans, and returns the number of deleted orphans.
+func (ndb *nodeDB) deleteVersion(version int64) (int, error) {
 	rootKey, err := ndb.GetRoot(version)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	freed := 0
+	orphans := ndb.newOrphanDeleter()
 	if err := ndb.traverseOrphans(version, version+1, func(orphan *Node) error {
+		freed++
 		if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
 			// if the orphan is a reformatted root, it can be a legacy root
 			// so it should be removed from the pruning process.
-			if err := ndb.batch.Delete(ndb.legacyNodeKey(orphan.hash)); err != nil {
+			if err := orphans.delete(ndb.legacyNodeKey(orphan.hash)); err != nil {
 				return err
 			}
 		}
@@ -352,13 +583,18 @@ func (ndb *nodeDB) deleteVersion(version int64) error {
 			// applied now due to the batch writing.
 			orphan.nodeKey.nonce = 0
 		}
+		if key := externalValueKey(orphan); key != nil {
+			if err := orphans.delete(key); err != nil {
+				return err
+			}
+		}
 		nk := orphan.GetKey()
 		if orphan.isLegacy {
-			return ndb.batch.Delete(ndb.legacyNodeKey(nk))
+			return orphans.delete(ndb.legacyNodeKey(nk))
 		}
-		return ndb.batch.Delete(ndb.nodeKey(nk))
+		return orphans.delete(ndb.nodeKey(nk))
 	}); err != nil {
-		return err
+		return 0, err
 	}
 
 	literalRootKey := GetRootKey(version)
@@ -366,32 +602,284 @@ func (ndb *nodeDB) deleteVersion(version int64) error {
 		// if the root key is not matched with the literal root key, it means the given root
 		// is a reference root to the previous version.
 		if err := ndb.batch.Delete(ndb.nodeKey(literalRootKey)); err != nil {
-			return err
+			return 0, err
 		}
 	}
 
 	// check if the version is referred by the next version
 	nextRootKey, err := ndb.GetRoot(version + 1)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if bytes.Equal(literalRootKey, nextRootKey) {
 		root, err := ndb.GetNode(nextRootKey)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		// ensure that the given version is not included in the root search
 		if err := ndb.batch.Delete(ndb.nodeKey(literalRootKey)); err != nil {
-			return err
+			return 0, err
 		}
 		// instead, the root should be reformatted to (version, 0)
 		root.nodeKey.nonce = 0
 		if err := ndb.SaveNode(root); err != nil {
+			return 0, err
+		}
+	}
+
+	return freed, nil
+}
+
+// deleteVersionRange deletes the versions from first to toVersion from disk, leaving the same
+// state as calling deleteVersion for each of them in turn, and returns the number of deleted
+// nodes. Rather than diffing every pair of consecutive versions, it reads the nodes of the range
+// in a single iteration, and deletes those the version after the range doesn't refer to, as well
+// as the older nodes it doesn't share with the first version. The older nodes are kept if
+// retainsPrevious is true, i.e. the version before the range is retained and still uses them.
+func (ndb *nodeDB) deleteVersionRange(first, toVersion int64, retainsPrevious bool) (int, error) {
+	nextRootKey, err := ndb.GetRoot(toVersion + 1)
+	if err != nil {
+		return 0, err
+	}
+	live, liveValues, err := ndb.liveRangeNodes(first, toVersion, nextRootKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// the older nodes which are orphaned within the range, unless the previous version uses
+	// them all.
+	freed := 0
+	orphans := ndb.newOrphanDeleter()
+	if !retainsPrevious {
+		if err := ndb.traverseOrphans(first, toVersion+1, func(orphan *Node) error {
+			if !orphan.isLegacy && orphan.nodeKey.version >= first {
+				return nil
+			}
+			freed++
+			if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
+				// if the orphan is a reformatted root, it can be a legacy root
+				if err := orphans.delete(ndb.legacyNodeKey(orphan.hash)); err != nil {
+					return err
+				}
+			}
+			if orphan.nodeKey.nonce == 1 {
+				// the root of a pruned version was reformatted to (version, 0), see below.
+				orphan.nodeKey.nonce = 0
+			}
+			if key := externalValueKey(orphan); key != nil {
+				if err := orphans.delete(key); err != nil {
+					return err
+				}
+			}
+			if orphan.isLegacy {
+				return orphans.delete(ndb.legacyNodeKey(orphan.GetKey()))
+			}
+			return orphans.delete(ndb.nodeKey(orphan.GetKey()))
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	// the nodes and roots of the range. They are collected first, since the batch may be
+	// written to the db while iterating otherwise.
+	var deleted [][]byte
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(first), nodeKeyPrefixFormat.KeyInt64(toVersion+1), func(k, v []byte) error {
+		nk := k[1:]
+		if live[string(nk)] {
+			return nil
+		}
+		// the empty and reference roots aren't nodes.
+		isNode := len(v) > 0
+		if isNode {
+			isRef, _ := isReferenceRoot(v)
+			isNode = !isRef
+		}
+		if isNode {
+			freed++
+			if GetNodeKey(nk).nonce == 0 {
+				// a reformatted root, which can be a legacy root
+				node, err := makeNode(nk, v, ndb.valueCodec(), ndb.hashScheme())
+				if err != nil {
+					return err
+				}
+				deleted = append(deleted, ndb.legacyNodeKey(node.hash))
+			}
+		}
+		deleted = append(deleted, bytes.Clone(k))
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := ndb.traverseRange(valueKeyFormat.Key(first), valueKeyFormat.Key(toVersion+1), func(k, _ []byte) error {
+		if !liveValues[string(k)] {
+			deleted = append(deleted, bytes.Clone(k))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, k := range deleted {
+		if err := orphans.delete(k); err != nil {
+			return 0, err
+		}
+	}
+	if err := ndb.deleteKeyCounts(first, toVersion); err != nil {
+		return 0, err
+	}
+
+	// if the next version refers to the root of a pruned version, the root is reformatted to
+	// (version, 0) to exclude the pruned version from the root search.
+	if nextRootKey != nil && live[string(nextRootKey)] && !bytes.Equal(nextRootKey, GetRootKey(toVersion+1)) {
+		root, err := ndb.GetNode(nextRootKey)
+		if err != nil {
+			return 0, err
+		}
+		if err := ndb.batch.Delete(ndb.nodeKey(nextRootKey)); err != nil {
+			return 0, err
+		}
+		root.nodeKey.nonce = 0
+		if err := ndb.SaveNode(root); err != nil {
+			return 0, err
+		}
+	}
+
+	return freed, nil
+}
+
+// liveRangeNodes returns the keys of the nodes of the versions from first to toVersion which are
+// still in use by the tree of the root nextRootKey, the version after the range, which only
+// refers to older nodes below nodes at least as old, and the keys of the values of those leaves
+// stored apart.
+func (ndb *nodeDB) liveRangeNodes(first, toVersion int64, nextRootKey []byte) (map[string]bool, map[string]bool, error) {
+	live, liveValues := make(map[string]bool), make(map[string]bool)
+	var walk func(nk []byte) error
+	walk = func(nk []byte) error {
+		node, err := ndb.GetNode(nk)
+		if err != nil {
+			return err
+		}
+		if node.isLegacy || node.nodeKey.version < first {
+			return nil
+		}
+		if node.nodeKey.version <= toVersion {
+			live[string(nk)] = true
+			if key := externalValueKey(node); key != nil {
+				liveValues[string(key)] = true
+			}
+		}
+		if node.isLeaf() {
+			return nil
+		}
+		if err := walk(node.leftNodeKey); err != nil {
 			return err
 		}
+		return walk(node.rightNodeKey)
+	}
+	if nextRootKey != nil {
+		if err := walk(nextRootKey); err != nil {
+			return nil, nil, err
+		}
 	}
+	return live, liveValues, nil
+}
 
-	return nil
+// versionSizeEstimate estimates the bytes contributed on disk by the given version, see
+// MutableTree.VersionSizeEstimate.
+func (ndb *nodeDB) versionSizeEstimate(version int64) (nodeBytes, fastNodeBytes, orphanBytes int64, err error) {
+	exists, err := ndb.hasVersion(version)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !exists {
+		return 0, 0, 0, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+	}
+
+	// the nodes of a version are keyed by it, fast nodes are only estimated from its leaves
+	// since they are not indexed by version.
+	withFastNodes := ndb.hasUpgradedToFastStorage()
+	if err := ndb.traversePrefix(nodeKeyPrefixFormat.KeyInt64(version), func(key, value []byte) error {
+		nodeBytes += int64(len(key) + len(value))
+		if len(value) == 0 || !withFastNodes {
+			return nil
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return nil
+		}
+		node, err := makeNode(key[1:], value, ndb.valueCodec(), ndb.hashScheme())
+		if err != nil {
+			return err
+		}
+		if node.isLeaf() {
+			value, err := ndb.leafValue(node)
+			if err != nil {
+				return err
+			}
+			fastNode := fastnode.NewNode(node.key, value, version)
+			fastNodeBytes += int64(len(ndb.fastNodeKey(node.key)) + fastNode.EncodedSize())
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := ndb.traversePrefix(valueKeyFormat.Key(version), func(key, value []byte) error {
+		nodeBytes += int64(len(key) + len(value))
+		return nil
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+
+	// the nodes orphaned by the version are freed once the previous version is pruned.
+	if ok, err := ndb.hasVersion(version - 1); err != nil || !ok {
+		return nodeBytes, fastNodeBytes, 0, err
+	}
+	if err := ndb.traverseOrphans(version-1, version, func(orphan *Node) error {
+		key := ndb.nodeKey(orphan.GetKey())
+		if orphan.isLegacy {
+			key = ndb.legacyNodeKey(orphan.GetKey())
+		}
+		orphanBytes += int64(len(key) + orphan.encodedSize())
+		return nil
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return nodeBytes, fastNodeBytes, orphanBytes, nil
+}
+
+// uniqueNodeCount splits the nodes of the tree of the version into the ones orphaned by the next
+// version and the ones the next version still references.
+func (ndb *nodeDB) uniqueNodeCount(version int64) (unique, shared int64, err error) {
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil {
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			return 0, 0, fmt.Errorf("version %d: %w", version, err)
+		}
+		return 0, 0, err
+	}
+	if rootKey == nil {
+		return 0, 0, nil
+	}
+	root, err := ndb.GetNode(rootKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	// a tree of n leaves has 2n-1 nodes.
+	total := 2*root.size - 1
+
+	if _, err := ndb.GetRoot(version + 1); err != nil {
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			// nothing is orphaned until the next version is saved.
+			return 0, total, nil
+		}
+		return 0, 0, err
+	}
+	if err := ndb.traverseOrphans(version, version+1, func(*Node) error {
+		unique++
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	return unique, total - unique, nil
 }
 
 // deleteLegacyNodes deletes all legacy nodes with the given version from disk.
@@ -418,6 +906,38 @@ func (ndb *nodeDB) deleteLegacyNodes(version int64, nk []byte) error {
 	return ndb.batch.Delete(ndb.legacyNodeKey(nk))
 }
 
+// orphanDeleter deletes the orphans being pruned in the batch, and writes the batch, without
+// syncing it, each time it holds MaxOrphansPerBatch deletions, see Options.MaxOrphansPerBatch.
+// The orphans must not be deleted while iterating the DB, which may not allow writes.
+type orphanDeleter struct {
+	ndb     *nodeDB
+	pending int
+}
+
+func (ndb *nodeDB) newOrphanDeleter() *orphanDeleter {
+	return &orphanDeleter{ndb: ndb}
+}
+
+// delete deletes the key of an orphan.
+func (d *orphanDeleter) delete(key []byte) error {
+	if err := d.ndb.batch.Delete(key); err != nil {
+		return err
+	}
+	maxPending := d.ndb.opts.MaxOrphansPerBatch
+	if maxPending <= 0 {
+		return nil
+	}
+	d.pending++
+	if d.pending < maxPending {
+		return nil
+	}
+	d.pending = 0
+	if err := d.ndb.batch.Write(); err != nil {
+		return fmt.Errorf("failed to write the batch of orphans, %w", err)
+	}
+	return nil
+}
+
 // deleteLegacyVersions deletes all legacy versions from disk.
 func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 	count := 0
@@ -431,16 +951,14 @@ func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 	}
 
 	// Delete orphans for all legacy versions
-	if err := ndb.traversePrefix(legacyOrphanKeyFormat.Key(), func(key, value []byte) error {
+	if err := ndb.traverseLegacyOrphans(func(key []byte, toVersion, fromVersion int64, hash []byte) error {
 		checkDeletePause()
 		if err := ndb.batch.Delete(key); err != nil {
 			return err
 		}
-		var fromVersion, toVersion int64
-		legacyOrphanKeyFormat.Scan(key, &toVersion, &fromVersion)
 		if (fromVersion <= legacyLatestVersion && toVersion < legacyLatestVersion) || fromVersion > legacyLatestVersion {
 			checkDeletePause()
-			return ndb.batch.Delete(ndb.legacyNodeKey(value))
+			return ndb.batch.Delete(ndb.legacyNodeKey(hash))
 		}
 		return nil
 	}); err != nil {
@@ -466,6 +984,18 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 	if latest < fromVersion {
 		return nil
 	}
+	// the versions pruned right before fromVersion are deleted along, so that the previous
+	// version becomes the latest one.
+	for {
+		pruned, err := ndb.isPrunedVersion(fromVersion - 1)
+		if err != nil {
+			return err
+		}
+		if !pruned {
+			break
+		}
+		fromVersion--
+	}
 
 	ndb.mtx.Lock()
 	for v, r := range ndb.versionReaders {
@@ -502,6 +1032,9 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 	}
 
 	// Delete the nodes for new format
+	if err := ndb.beginCommit(commitDeleteFrom, fromVersion, latest); err != nil {
+		return err
+	}
 	err = ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(fromVersion), nodeKeyPrefixFormat.KeyInt64(latest+1), func(k, v []byte) error {
 		return ndb.batch.Delete(k)
 	})
@@ -510,6 +1043,19 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 		return err
 	}
 
+	if err := ndb.deletePrunedVersionMarks(fromVersion, latest); err != nil {
+		return err
+	}
+	if err := ndb.deleteValues(fromVersion, latest); err != nil {
+		return err
+	}
+	if err := ndb.deleteKeyCounts(dumpFromVersion, latest); err != nil {
+		return err
+	}
+	if err := ndb.dropBloomFilter(); err != nil {
+		return err
+	}
+
 	// NOTICE: we don't touch fast node indexes here, because it'll be rebuilt later because of version mismatch.
 
 	ndb.resetLatestVersion(dumpFromVersion - 1)
@@ -519,6 +1065,12 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 
 // DeleteVersionsTo deletes the oldest versions up to the given version from disk.
 func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
+	return ndb.deleteVersionsTo(toVersion, true)
+}
+
+// deleteVersionsTo deletes the oldest versions up to the given version from disk.
+// If asyncLegacy is true, the bulk of the legacy versions is deleted in the background.
+func (ndb *nodeDB) deleteVersionsTo(toVersion int64, asyncLegacy bool) error {
 	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
 	if err != nil {
 		return err
@@ -543,6 +1095,18 @@ func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
 	if latest <= toVersion {
 		return fmt.Errorf("latest version %d is less than or equal to toVersion %d", latest, toVersion)
 	}
+	// the versions pruned right after toVersion are deleted along, so that the next version
+	// becomes the first one.
+	for {
+		pruned, err := ndb.isPrunedVersion(toVersion + 1)
+		if err != nil {
+			return err
+		}
+		if !pruned {
+			break
+		}
+		toVersion++
+	}
 
 	ndb.mtx.Lock()
 	for v, r := range ndb.versionReaders {
@@ -563,20 +1127,66 @@ func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
 		}
 		// reset the legacy latest version forcibly to avoid multiple calls
 		ndb.resetLegacyLatestVersion(-1)
-		go func() {
-			if err := ndb.deleteLegacyVersions(legacyLatestVersion); err != nil {
-				ndb.logger.Error("Error deleting legacy versions", "err", err)
-			}
-		}()
+		if asyncLegacy {
+			go func() {
+				if err := ndb.deleteLegacyVersions(legacyLatestVersion); err != nil {
+					ndb.logger.Error("Error deleting legacy versions", "err", err)
+				}
+			}()
+		} else if err := ndb.deleteLegacyVersions(legacyLatestVersion); err != nil {
+			return err
+		}
 		first = legacyLatestVersion + 1
 	}
 
-	for version := first; version <= toVersion; version++ {
-		if err := ndb.deleteVersion(version); err != nil {
+	ndb.logger.Info("pruning started", "from", first, "to", toVersion)
+
+	if err := ndb.beginCommit(commitDeleteTo, first, toVersion); err != nil {
+		return err
+	}
+	freed, err := ndb.deleteVersionRange(first, toVersion, false)
+	if err != nil {
+		return err
+	}
+	if err := ndb.deletePrunedVersionMarks(first, toVersion); err != nil {
+		return err
+	}
+	ndb.resetFirstVersion(toVersion + 1)
+
+	ndb.logger.Info("pruning finished", "from", first, "to", toVersion, "freed", freed)
+
+	return nil
+}
+
+// KeepOnlyLatest deletes all versions except the latest one from disk, including the legacy
+// versions which are deleted synchronously.
+func (ndb *nodeDB) KeepOnlyLatest() error {
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latest == 0 {
+		return nil
+	}
+
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	if legacyLatestVersion >= latest {
+		return fmt.Errorf("latest version %d is in the legacy format, save a new version first", latest)
+	}
+
+	first, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	if first < latest {
+		if err := ndb.deleteVersionsTo(latest-1, false); err != nil {
 			return err
 		}
-		ndb.resetFirstVersion(version + 1)
 	}
+	ndb.resetFirstVersion(latest)
 
 	return nil
 }
@@ -591,6 +1201,15 @@ func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	return nil
 }
 
+// copyBytes returns a copy of bz to hand out to callers, or bz itself if the UnsafeNoCopy
+// option is set.
+func (ndb *nodeDB) copyBytes(bz []byte) []byte {
+	if bz == nil || (ndb != nil && ndb.opts.UnsafeNoCopy) {
+		return bz
+	}
+	return bytes.Clone(bz)
+}
+
 func (ndb *nodeDB) nodeKey(nk []byte) []byte {
 	return nodeKeyFormat.Key(nk)
 }
@@ -638,6 +1257,13 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 		if err != nil {
 			return 0, err
 		}
+		if !has {
+			// the versions pruned between retained versions are after the first one.
+			has, err = ndb.isPrunedVersion(version)
+			if err != nil {
+				return 0, err
+			}
+		}
 		if has {
 			latestVersion = version
 		} else {
@@ -714,15 +1340,36 @@ func (ndb *nodeDB) getLatestVersion() (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	defer itr.Close()
+	defer func() { itr.Close() }()
 
-	if itr.Valid() {
+	for itr.Valid() {
 		k := itr.Key()
 		var nk []byte
 		nodeKeyFormat.Scan(k, &nk)
-		latestVersion = GetNodeKey(nk).version
-		ndb.resetLatestVersion(latestVersion)
-		return latestVersion, nil
+		nodeKey := GetNodeKey(nk)
+		latestVersion = nodeKey.version
+		// the root is written last, so a version without root was partially written by a
+		// SaveVersion which spilled its nodes, see Options.SpillThreshold.
+		hasRoot := nodeKey.nonce == 1
+		if !hasRoot {
+			var err error
+			if hasRoot, err = ndb.hasVersion(latestVersion); err != nil {
+				return 0, err
+			}
+		}
+		if hasRoot {
+			ndb.resetLatestVersion(latestVersion)
+			return latestVersion, nil
+		}
+		ndb.logger.Info("ignoring partially written version", "version", latestVersion)
+		itr.Close()
+		itr, err = ndb.db.ReverseIterator(
+			nodeKeyPrefixFormat.KeyInt64(int64(1)),
+			nodeKeyPrefixFormat.KeyInt64(latestVersion),
+		)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	if err := itr.Error(); err != nil {
@@ -912,16 +1559,36 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (dbm.Itera
 	return ndb.db.ReverseIterator(startFormatted, endFormatted)
 }
 
-// Write to disk.
+// spill writes the batch without syncing it, ahead of the commit, see Options.SpillThreshold.
+// As Commit, it doesn't hold ndb.mtx while writing.
+func (ndb *nodeDB) spill() error {
+	ndb.mtx.Lock()
+	batch := ndb.batch
+	ndb.mtx.Unlock()
+
+	if err := batch.Write(); err != nil {
+		return fmt.Errorf("failed to spill batch, %w", err)
+	}
+	return nil
+}
+
+// Commit writes the batch to disk, synchronously unless the SyncMode is SyncNone. The batch is
+// guarded by its own lock, so it is written without holding ndb.mtx, and the readers of the
+// saved versions, e.g. a Snapshot, keep loading their nodes while a version is flushed.
 func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	if err := ndb.endCommit(); err != nil {
+		ndb.mtx.Unlock()
+		return err
+	}
+	batch := ndb.batch
+	ndb.mtx.Unlock()
 
 	var err error
-	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
+	if ndb.opts.SyncMode != SyncNone {
+		err = batch.WriteSync()
 	} else {
-		err = ndb.batch.Write()
+		err = batch.Write()
 	}
 	if err != nil {
 		return fmt.Errorf("failed to write batch, %w", err)
@@ -930,12 +1597,75 @@ func (ndb *nodeDB) Commit() error {
 	return nil
 }
 
+// discardBatch discards the pending writes of a version which failed to be saved, and evicts the
+// nodes and the fast nodes saved to the batch from the caches. The writes the batch flushed
+// meanwhile, once it reached the FlushThreshold or the SpillThreshold, are left in the database,
+// but for the root, which is written last, so the version isn't found.
+func (ndb *nodeDB) discardBatch(nodes []*Node, fastNodeKeys []string) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for _, node := range nodes {
+		ndb.nodeCache.Remove(node.GetKey())
+	}
+	for _, key := range fastNodeKeys {
+		ndb.fastNodeCache.Remove([]byte(key))
+	}
+	closeErr := ndb.batch.Close()
+	batch := NewBatchWithFlusher(ndb.db, ndb.opts.FlushThreshold)
+	batch.syncFlushes = ndb.opts.SyncMode == SyncAlways
+	ndb.batch = batch
+	ndb.pendingCommit = false
+
+	// the fast storage version of the version was set along with its fast nodes.
+	storeVersion, err := ndb.db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	if err != nil {
+		return err
+	}
+	if storeVersion == nil {
+		storeVersion = []byte(defaultStorageVersionValue)
+	}
+	ndb.storageVersion = string(storeVersion)
+	return closeErr
+}
+
+// sync syncs the writes committed without syncing. Since empty batches may not be synced, it
+// writes the storage version again in a synced batch of its own.
+func (ndb *nodeDB) sync() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	db := ndb.db
+	if ndb.coalescer != nil {
+		if err := ndb.coalescer.flush(); err != nil {
+			return err
+		}
+		db = ndb.coalescer.DB
+	}
+	batch := db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(ndb.storageVersion)); err != nil {
+		return err
+	}
+	if err := batch.WriteSync(); err != nil {
+		return fmt.Errorf("failed to sync, %w", err)
+	}
+	return nil
+}
+
 func (ndb *nodeDB) incrVersionReaders(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	ndb.versionReaders[version]++
 }
 
+// hasVersionReaders returns whether the version is being read, e.g. by an Exporter.
+func (ndb *nodeDB) hasVersionReaders(version int64) bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.versionReaders[version] > 0
+}
+
 func (ndb *nodeDB) decrVersionReaders(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -1006,6 +1736,8 @@ func (ndb *nodeDB) traverseOrphans(prevVersion, curVersion int64, fn func(*Node)
 
 // Close the nodeDB.
 func (ndb *nodeDB) Close() error {
+	ndb.stopAsyncPruner()
+	ndb.prefetching.Wait()
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
@@ -1015,11 +1747,92 @@ func (ndb *nodeDB) Close() error {
 		}
 		ndb.batch = nil
 	}
+	if ndb.coalescer != nil {
+		if err := ndb.coalescer.flush(); err != nil {
+			return err
+		}
+	}
+	if ndb.arena != nil {
+		if err := ndb.arena.close(); err != nil {
+			return err
+		}
+		ndb.arena = nil
+	}
 
 	// skip the db.Close() since it can be used by other trees
 	return nil
 }
 
+// reset rebinds the nodeDB to db as newNodeDB does, discarding the pending writes and the
+// cached nodes, but keeping the options and the caches, see MutableTree.Reset.
+func (ndb *nodeDB) reset(db dbm.DB) error {
+	ndb.stopAsyncPruner()
+	ndb.prefetching.Wait()
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for v, r := range ndb.versionReaders {
+		if r != 0 {
+			return fmt.Errorf("unable to reset the tree with %d active readers of version %d", r, v)
+		}
+	}
+	for _, c := range []cache.Cache{ndb.nodeCache, ndb.fastNodeCache} {
+		if _, ok := c.(cache.Resetter); !ok {
+			if _, ok := c.(cache.Enumerator); !ok {
+				return fmt.Errorf("cache %T can neither be reset nor enumerated: %w", c, ErrInvalidInputs)
+			}
+		}
+	}
+
+	db = withKeyPrefix(withOperationHook(withRetries(db, ndb.opts.DBRetry), ndb.opts.OperationHook), ndb.opts.KeyPrefix)
+	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	if err != nil || storeVersion == nil {
+		storeVersion = []byte(defaultStorageVersionValue)
+	}
+	if ndb.batch != nil {
+		if err := ndb.batch.Close(); err != nil {
+			return err
+		}
+	}
+	if ndb.coalescer != nil {
+		// the pending versions belong to the previous db.
+		if err := ndb.coalescer.flush(); err != nil {
+			return err
+		}
+		ndb.coalescer = newCoalescingDB(db, ndb.opts, ndb.logger)
+		db = ndb.coalescer
+	}
+	batch := NewBatchWithFlusher(db, ndb.opts.FlushThreshold)
+	batch.syncFlushes = ndb.opts.SyncMode == SyncAlways
+
+	ndb.db = db
+	ndb.batch = batch
+	ndb.storageVersion = string(storeVersion)
+	ndb.fastStorageMigrating = false
+	ndb.fastStorageStale = false
+	ndb.pendingCommit = false
+	ndb.firstVersion = 0
+	ndb.latestVersion = 0
+	ndb.legacyLatestVersion = 0
+	clear(ndb.versionReaders)
+	ndb.keys = newKeyInterner(ndb.opts.InternKeys)
+	ndb.bloom.Store(nil)
+	resetCache(ndb.nodeCache)
+	resetCache(ndb.fastNodeCache)
+	return nil
+}
+
+// resetCache removes all the nodes of c, which implements cache.Resetter or cache.Enumerator.
+func resetCache(c cache.Cache) {
+	if r, ok := c.(cache.Resetter); ok {
+		r.Reset()
+		return
+	}
+	for _, node := range c.(cache.Enumerator).Nodes() {
+		c.Remove(node.GetKey())
+	}
+}
+
 // Utility and test functions
 
 func (ndb *nodeDB) leafNodes() ([]*Node, error) {
@@ -1110,7 +1923,7 @@ func (ndb *nodeDB) traverseNodes(fn func(node *Node) error) error {
 		if isRef, _ := isReferenceRoot(value); isRef {
 			return nil
 		}
-		node, err := MakeNode(key[1:], value)
+		node, err := makeNode(key[1:], value, ndb.valueCodec(), ndb.hashScheme())
 		if err != nil {
 			return err
 		}
@@ -1155,8 +1968,17 @@ func (ndb *nodeDB) traverseStateChanges(startVersion, endVersion int64, fn func(
 	if err != nil && err != ErrVersionDoesNotExist {
 		return err
 	}
+	// the changes of the versions pruned between retained versions are included in those of the
+	// next retained version.
+	pruned, err := ndb.prunedVersions(startVersion, endVersion)
+	if err != nil {
+		return err
+	}
 
 	for version := startVersion; version <= endVersion; version++ {
+		if pruned[version] {
+			continue
+		}
 		root, err := ndb.GetRoot(version)
 		if err != nil {
 			return err
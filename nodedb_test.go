@@ -3,14 +3,20 @@ package iavl
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	log "cosmossdk.io/log"
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/cosmos/iavl/cache"
 	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/mock"
 )
@@ -437,3 +443,480 @@ func TestDeleteVersionsFromNoDeadlock(t *testing.T) {
 	require.Error(t, err, "")
 	require.Contains(t, err.Error(), fmt.Sprintf("unable to delete version %v with 2 active readers", targetVersion+2))
 }
+
+func TestNodeDB_CacheConsistencyUnderConcurrency(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 50, false, log.NewNopLogger())
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				itree, err := tree.GetImmutable(1)
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+				if !assert.NoError(t, err) {
+					return
+				}
+			}
+		}()
+	}
+
+	for v := 0; v < 20; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", (v*50+i)%300)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+
+	require.NoError(t, tree.ndb.nodeCache.(cache.ConsistencyChecker).ConsistencyCheck())
+	require.NoError(t, tree.ndb.fastNodeCache.(cache.ConsistencyChecker).ConsistencyCheck())
+}
+
+// readCountingDB counts the reads of its db, as Gets and iterated keys.
+type readCountingDB struct {
+	dbm.DB
+	gets, iterated int
+}
+
+func (db *readCountingDB) Get(key []byte) ([]byte, error) {
+	db.gets++
+	return db.DB.Get(key)
+}
+
+func (db *readCountingDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	itr, err := db.DB.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingIterator{Iterator: itr, db: db}, nil
+}
+
+type readCountingIterator struct {
+	dbm.Iterator
+	db *readCountingDB
+}
+
+func (itr *readCountingIterator) Next() {
+	itr.db.iterated++
+	itr.Iterator.Next()
+}
+
+// savePruningTestVersions saves versions with random changes to the tree, including versions
+// without changes, whose roots refer to the previous ones, and empty versions.
+func savePruningTestVersions(t require.TestingT, tree *MutableTree, versions int) {
+	r := rand.New(rand.NewSource(1))
+	for v := 1; v <= versions; v++ {
+		switch {
+		case v%97 == 0:
+			_, err := tree.Iterate(func(key, _ []byte) bool {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+				return false
+			})
+			require.NoError(t, err)
+		case v%10 == 5 || v%10 == 6:
+		default:
+			for i := 0; i < 10; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", r.Intn(300))), []byte(fmt.Sprintf("value-%d", v)))
+				require.NoError(t, err)
+			}
+			for i := 0; i < 2; i++ {
+				_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%03d", r.Intn(300))))
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+// deleteVersionsSequentially prunes the versions to toVersion one at a time, as DeleteVersionsTo
+// originally did.
+func deleteVersionsSequentially(tree *MutableTree, toVersion int64) error {
+	first, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	for version := first; version <= toVersion; version++ {
+		if _, err := tree.ndb.deleteVersion(version); err != nil {
+			return err
+		}
+		tree.ndb.resetFirstVersion(version + 1)
+	}
+	return tree.ndb.Commit()
+}
+
+func dumpDB(t *testing.T, db dbm.DB) map[string]string {
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	kvs := make(map[string]string)
+	for ; itr.Valid(); itr.Next() {
+		kvs[string(itr.Key())] = string(itr.Value())
+	}
+	return kvs
+}
+
+func TestDeleteVersionsTo_SameAsSequential(t *testing.T) {
+	const versions = 300
+	for _, prunes := range [][]int64{{versions - 1}, {1, 4, 5, 6, 96, 97, 98, 150, 194, versions - 1}, {14, 16, 24, 120, 255}} {
+		t.Run(fmt.Sprint(prunes), func(t *testing.T) {
+			sequentialDB, batchedDB := dbm.NewMemDB(), dbm.NewMemDB()
+			sequential := NewMutableTree(sequentialDB, 0, false, NewNopLogger())
+			batched := NewMutableTree(batchedDB, 0, false, NewNopLogger())
+			savePruningTestVersions(t, sequential, versions)
+			savePruningTestVersions(t, batched, versions)
+
+			for _, toVersion := range prunes {
+				require.NoError(t, deleteVersionsSequentially(sequential, toVersion))
+				require.NoError(t, batched.DeleteVersionsTo(toVersion))
+				require.Equal(t, dumpDB(t, sequentialDB), dumpDB(t, batchedDB), "after pruning to %d", toVersion)
+				require.Equal(t, sequential.AvailableVersions(), batched.AvailableVersions())
+			}
+
+			// the remaining versions are intact, also once reloaded.
+			reloaded := NewMutableTree(batchedDB, 0, false, NewNopLogger())
+			_, err := reloaded.Load()
+			require.NoError(t, err)
+			for _, version := range reloaded.AvailableVersions() {
+				expected, err := sequential.GetImmutable(int64(version))
+				require.NoError(t, err)
+				itree, err := reloaded.GetImmutable(int64(version))
+				require.NoError(t, err)
+				require.Equal(t, expected.Hash(), itree.Hash())
+				var expectedKeys, keys []string
+				expected.IterateRange(nil, nil, true, func(key, value []byte) bool {
+					expectedKeys = append(expectedKeys, string(key)+"="+string(value))
+					return false
+				})
+				itree.IterateRange(nil, nil, true, func(key, value []byte) bool {
+					keys = append(keys, string(key)+"="+string(value))
+					return false
+				})
+				require.Equal(t, expectedKeys, keys)
+			}
+		})
+	}
+}
+
+// BenchmarkDeleteVersionsTo compares the db reads of pruning 1000 versions at once with those of
+// pruning them one at a time.
+func BenchmarkDeleteVersionsTo(b *testing.B) {
+	const versions = 1001
+	for _, bc := range []struct {
+		name  string
+		prune func(tree *MutableTree, toVersion int64) error
+	}{
+		{"batched", (*MutableTree).DeleteVersionsTo},
+		{"sequential", deleteVersionsSequentially},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var gets, iterated int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := &readCountingDB{DB: dbm.NewMemDB()}
+				tree := NewMutableTree(db, 0, false, NewNopLogger())
+				savePruningTestVersions(b, tree, versions)
+				db.gets, db.iterated = 0, 0
+				b.StartTimer()
+
+				require.NoError(b, bc.prune(tree, versions-1))
+				gets += db.gets
+				iterated += db.iterated
+			}
+			b.ReportMetric(float64(gets)/float64(b.N), "gets/op")
+			b.ReportMetric(float64(iterated)/float64(b.N), "iterated/op")
+		})
+	}
+}
+
+// prefixedKeysDB returns a DB with versions of a tree of n keys sharing a long prefix, as the
+// keys of the stores of an application do, every version setting all the keys. Unlike MemDB,
+// goleveldb returns copies of the values it stores, as the DBs used in production do.
+func prefixedKeysDB(t testing.TB, n, versions int) dbm.DB {
+	db, err := dbm.NewDB("test", "goleveldb", t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	tree := NewMutableTree(db, 0, true, log.NewNopLogger())
+	prefix := "store/bank/balances/cosmos1qypqxpq9qcrsszg2pvxq6rs0zqg3yyc5lzv7xu/"
+	for v := 0; v < versions; v++ {
+		for i := 0; i < n; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("%s%08d", prefix, i)), []byte{byte(i), byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	return db
+}
+
+// loadAllNodes loads a tree from db and caches the nodes of all its versions.
+func loadAllNodes(t testing.TB, db dbm.DB, nodes int, options ...Option) *MutableTree {
+	tree := NewMutableTree(db, nodes, true, log.NewNopLogger(), options...)
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for _, version := range tree.AvailableVersions() {
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		require.NoError(t, err)
+		itr, err := NewNodeIterator(rootKey, tree.ndb)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next(false) {
+		}
+		require.NoError(t, itr.Error())
+	}
+	return tree
+}
+
+func TestInternKeys(t *testing.T) {
+	const n = 1000
+	db := prefixedKeysDB(t, n, 1)
+	plain := loadAllNodes(t, db, 2*n)
+	tree := loadAllNodes(t, db, 2*n, InternKeysOption(4*n))
+
+	// the inner nodes share the keys of the leaves.
+	leaves := make(map[string]*Node)
+	var inner []*Node
+	itr, err := NewNodeIterator(tree.root.GetKey(), tree.ndb)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next(false) {
+		if node := itr.GetNode(); node.isLeaf() {
+			leaves[string(node.key)] = node
+		} else {
+			inner = append(inner, node)
+		}
+	}
+	require.Len(t, leaves, n)
+	for _, node := range inner {
+		require.Same(t, &leaves[string(node.key)].key[0], &node.key[0])
+	}
+
+	// the keys are returned in full, and the hashes and proofs are unchanged.
+	require.Equal(t, plain.Hash(), tree.Hash())
+	var keys [][]byte
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		keys = append(keys, key)
+		return false
+	})
+	require.NoError(t, err)
+	require.Len(t, keys, n)
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i), 0}, value)
+		if i%100 == 0 {
+			proof, err := tree.GetMembershipProof(key)
+			require.NoError(t, err)
+			expected, err := plain.GetMembershipProof(key)
+			require.NoError(t, err)
+			require.Equal(t, expected, proof)
+			ok, err := tree.VerifyMembership(proof, key)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+	}
+
+	// a full table is emptied.
+	interner := newKeyInterner(2)
+	a := interner.intern([]byte("a"))
+	require.Same(t, &a[0], &interner.intern([]byte("a"))[0])
+	interner.intern([]byte("b"))
+	interner.intern([]byte("c"))
+	require.Len(t, interner.keys, 1)
+	require.NotSame(t, &a[0], &interner.intern([]byte("a"))[0])
+	require.Nil(t, (*keyInterner)(nil).intern(nil))
+}
+
+func BenchmarkInternKeys(b *testing.B) {
+	const n, versions = 20000, 5
+	db := prefixedKeysDB(b, n, versions)
+	for _, size := range []int{0, 4 * n} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				tree := loadAllNodes(b, db, 2*n*versions, InternKeysOption(size))
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				runtime.KeepAlive(tree)
+				heap += after.HeapAlloc - before.HeapAlloc
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-bytes/op")
+		})
+	}
+}
+
+func TestNodeDB_KeyPrefix(t *testing.T) {
+	db := dbm.NewMemDB()
+	require.NoError(t, db.Set([]byte("z"), []byte("unrelated")))
+	newTree := func(prefix string) *MutableTree {
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), KeyPrefixOption([]byte(prefix)))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	setVersion := func(version int, trees ...*MutableTree) {
+		for _, tree := range trees {
+			for i := 0; i < 50; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", (version*13+i)%80)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	// snapshot returns the pairs of the DB whose key has the prefix.
+	snapshot := func(prefix string) map[string]string {
+		pairs := make(map[string]string)
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if strings.HasPrefix(string(itr.Key()), prefix) {
+				pairs[string(itr.Key())] = string(itr.Value())
+			}
+		}
+		return pairs
+	}
+
+	a, b := newTree("a/"), newTree("b/")
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for version := 1; version <= 5; version++ {
+		setVersion(version, a, reference)
+		setVersion(version*2, b)
+	}
+	// all the keys of the trees are stored under their prefix.
+	require.Len(t, snapshot(""), len(snapshot("a/"))+len(snapshot("b/"))+1)
+
+	// saving, pruning and reloading a tree leaves the keys of the other one untouched.
+	bKeys, otherKeys := snapshot("b/"), snapshot("z")
+	setVersion(6, a, reference)
+	require.NoError(t, a.DeleteVersionsTo(3))
+	require.NoError(t, reference.DeleteVersionsTo(3))
+	a = newTree("a/")
+	require.EqualValues(t, 6, a.Version())
+	require.Equal(t, reference.Hash(), a.Hash())
+	require.Equal(t, reference.AvailableVersions(), a.AvailableVersions())
+	var pairs, expected []string
+	_, err := a.Iterate(func(key, value []byte) bool {
+		pairs = append(pairs, string(key)+"="+string(value))
+		return false
+	})
+	require.NoError(t, err)
+	_, err = reference.Iterate(func(key, value []byte) bool {
+		expected = append(expected, string(key)+"="+string(value))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, pairs)
+	require.Equal(t, bKeys, snapshot("b/"))
+	require.Equal(t, otherKeys, snapshot("z"))
+
+	b = newTree("b/")
+	require.EqualValues(t, 5, b.Version())
+	require.Equal(t, []int{1, 2, 3, 4, 5}, b.AvailableVersions())
+	require.NoError(t, b.DeleteVersionsTo(4))
+	require.Equal(t, []int{4, 5, 6}, a.AvailableVersions())
+
+	// the keys of a tree aren't visible without its prefix.
+	version, err := NewMutableTree(db, 0, false, NewNopLogger()).Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+}
+
+func TestNodeDB_NodeCacheShards(t *testing.T) {
+	stat := &Statistics{}
+	tree := NewMutableTree(dbm.NewMemDB(), 1000, true, log.NewNopLogger(), NodeCacheShardsOption(4), StatOption(stat))
+	require.Implements(t, (*cache.Concurrent)(nil), tree.ndb.nodeCache)
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the immutable trees are read in parallel from the sharded cache.
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			itree, err := tree.GetImmutable(version)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for i := 0; i < 200; i++ {
+				value, err := itree.Get([]byte(fmt.Sprintf("key-%03d", i)))
+				if !assert.NoError(t, err) || !assert.Equal(t, []byte(fmt.Sprintf("value-%03d", i)), value) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.NotZero(t, stat.GetCacheHitCnt())
+	require.NotNil(t, tree.ndb.concurrentNodeCache.Load())
+
+	// a cache which isn't concurrent is locked again.
+	require.NoError(t, tree.SetCache(cache.New(1000), true))
+	require.Nil(t, tree.ndb.concurrentNodeCache.Load())
+	value, err := tree.Get([]byte("key-100"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-100"), value)
+}
+
+func TestNodeDB_NodeCachePolicy(t *testing.T) {
+	for name, policy := range map[string]cache.Policy{"ARC": cache.NewARC, "2Q": cache.New2Q} {
+		t.Run(name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 50, false, log.NewNopLogger(), NodeCachePolicyOption(policy))
+			reference := NewMutableTree(dbm.NewMemDB(), 50, false, log.NewNopLogger())
+			for version := 0; version < 5; version++ {
+				for i := 0; i < 100; i++ {
+					key := []byte(fmt.Sprintf("key-%03d", (version*37+i)%300))
+					value := []byte(fmt.Sprintf("value-%d-%d", version, i))
+					for _, tree := range []*MutableTree{tree, reference} {
+						_, err := tree.Set(key, value)
+						require.NoError(t, err)
+					}
+				}
+				hash, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				expected, _, err := reference.SaveVersion()
+				require.NoError(t, err)
+				require.Equal(t, expected, hash)
+			}
+			require.LessOrEqual(t, tree.ndb.nodeCache.Len(), 50)
+			require.NoError(t, tree.ndb.nodeCache.(cache.ConsistencyChecker).ConsistencyCheck())
+
+			// a reloaded tree reads its nodes through a cache of the policy too.
+			loaded := NewMutableTree(db, 50, false, log.NewNopLogger(), NodeCachePolicyOption(policy))
+			_, err := loaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, reference.Hash(), loaded.Hash())
+			_, err = loaded.Iterate(func(_, _ []byte) bool { return false })
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package iavl
+
+import (
+	"time"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// OperationHook is notified of the low-level operations of a tree as they are done, with their
+// durations and sizes, e.g. to profile slow commits, see the OperationHook option. The hits and
+// misses of the caches are notified to the NodeCacheStatsHook and FastNodeCacheStatsHook options.
+// It is called from the goroutine doing the operation, possibly concurrently, so it must be fast
+// and safe for concurrent use.
+type OperationHook interface {
+	// OnNodeLoad is called for each node missing from the cache, read from the DB and decoded,
+	// with the size of its encoding.
+	OnNodeLoad(d time.Duration, bytes int)
+	// OnDBRead is called for each get of a key of the DB, with the size of its value, 0 if it
+	// is missing. The iterations are not notified.
+	OnDBRead(d time.Duration, bytes int)
+	// OnDBWrite is called for each batch written to the DB, with its size.
+	OnDBWrite(d time.Duration, bytes int)
+	// OnHash is called each time the new nodes of the working tree are hashed, by WorkingHash
+	// and SaveVersion.
+	OnHash(d time.Duration)
+	// OnRotation is called for each rotation rebalancing the working tree.
+	OnRotation()
+}
+
+// hookedDB notifies an OperationHook of the reads of a DB and of the writes of its batches.
+type hookedDB struct {
+	dbm.DB
+	hook OperationHook
+}
+
+var _ dbm.DB = (*hookedDB)(nil)
+
+// withOperationHook returns db notifying hook of its operations, if it is not nil.
+func withOperationHook(db dbm.DB, hook OperationHook) dbm.DB {
+	if hook == nil {
+		return db
+	}
+	return &hookedDB{DB: db, hook: hook}
+}
+
+// Get implements dbm.DB.
+func (db *hookedDB) Get(key []byte) ([]byte, error) {
+	start := time.Now()
+	value, err := db.DB.Get(key)
+	db.hook.OnDBRead(time.Since(start), len(value))
+	return value, err
+}
+
+// Has implements dbm.DB.
+func (db *hookedDB) Has(key []byte) (bool, error) {
+	start := time.Now()
+	has, err := db.DB.Has(key)
+	db.hook.OnDBRead(time.Since(start), 0)
+	return has, err
+}
+
+// NewBatch implements dbm.DB.
+func (db *hookedDB) NewBatch() dbm.Batch {
+	return &hookedBatch{Batch: db.DB.NewBatch(), hook: db.hook}
+}
+
+// NewBatchWithSize implements dbm.DB.
+func (db *hookedDB) NewBatchWithSize(size int) dbm.Batch {
+	return &hookedBatch{Batch: db.DB.NewBatchWithSize(size), hook: db.hook}
+}
+
+// hookedBatch is a batch of a hookedDB, whose writes are notified.
+type hookedBatch struct {
+	dbm.Batch
+	hook OperationHook
+}
+
+// Write implements dbm.Batch.
+func (b *hookedBatch) Write() error {
+	return b.notify(b.Batch.Write)
+}
+
+// WriteSync implements dbm.Batch.
+func (b *hookedBatch) WriteSync() error {
+	return b.notify(b.Batch.WriteSync)
+}
+
+// notify writes the batch with write, and notifies the hook of its size.
+func (b *hookedBatch) notify(write func() error) error {
+	size, err := b.Batch.GetByteSize()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := write(); err != nil {
+		return err
+	}
+	b.hook.OnDBWrite(time.Since(start), size)
+	return nil
+}
+
+// notifyRotation notifies the OperationHook option, if any, of a rotation.
+func (ndb *nodeDB) notifyRotation() {
+	if hook := ndb.opts.OperationHook; hook != nil {
+		hook.OnRotation()
+	}
+}
+
+// hashWorkingTree hashes the new nodes of the working tree for version, see WorkingHash, and
+// notifies the OperationHook option, if any, of the time taken.
+func (tree *MutableTree) hashWorkingTree(version int64) []byte {
+	start := time.Now()
+	hash := tree.root.hashParallel(version, tree.ndb.hashScheme(), tree.ndb.opts.HashWorkers)
+	if hook := tree.ndb.opts.OperationHook; hook != nil {
+		hook.OnHash(time.Since(start))
+	}
+	return hash
+}
@@ -0,0 +1,91 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// countingOperationHook counts the operations notified, and the bytes they carry.
+type countingOperationHook struct {
+	mtx                                     sync.Mutex
+	loads, reads, writes, hashes, rotations int
+	loadBytes, writeBytes                   int
+}
+
+func (h *countingOperationHook) OnNodeLoad(_ time.Duration, bytes int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.loads++
+	h.loadBytes += bytes
+}
+
+func (h *countingOperationHook) OnDBRead(time.Duration, int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.reads++
+}
+
+func (h *countingOperationHook) OnDBWrite(_ time.Duration, bytes int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.writes++
+	h.writeBytes += bytes
+}
+
+func (h *countingOperationHook) OnHash(time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.hashes++
+}
+
+func (h *countingOperationHook) OnRotation() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.rotations++
+}
+
+func TestOperationHook(t *testing.T) {
+	db := dbm.NewMemDB()
+	hook := &countingOperationHook{}
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), OperationHookOption(hook))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for _, tree := range []*MutableTree{tree, reference} {
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte{byte(i)})
+			require.NoError(t, err)
+		}
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	expected, _, err := reference.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expected, hash, "the hashes don't depend on the hook")
+
+	// the keys set in order are rebalanced, the new nodes hashed and written at once.
+	require.Positive(t, hook.rotations)
+	require.Equal(t, 1, hook.hashes)
+	require.Positive(t, hook.writes)
+	require.Positive(t, hook.writeBytes)
+	require.Zero(t, hook.loads)
+
+	// the nodes missing from the cache are loaded from the DB.
+	hook = &countingOperationHook{}
+	tree = NewMutableTree(db, 0, true, log.NewNopLogger(), OperationHookOption(hook))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	reads, loads := hook.reads, hook.loads
+	require.Positive(t, reads)
+	value, err := tree.ImmutableTree.Get([]byte("key-042"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{42}, value)
+	require.Greater(t, hook.loads, loads)
+	require.Positive(t, hook.loadBytes)
+	require.GreaterOrEqual(t, hook.reads-reads, hook.loads-loads)
+}
@@ -1,6 +1,12 @@
 package iavl
 
-import "sync/atomic"
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosmos/iavl/cache"
+)
 
 // Statisc about db runtime state
 type Statistics struct {
@@ -15,6 +21,9 @@ type Statistics struct {
 
 	// Each time GetFastNode operation miss cache
 	fastCacheMissCnt uint64
+
+	// Each time Get or Has operation is answered by the bloom filter
+	bloomFilterNegativeCnt uint64
 }
 
 func (stat *Statistics) IncCacheHitCnt() {
@@ -45,6 +54,13 @@ func (stat *Statistics) IncFastCacheMissCnt() {
 	atomic.AddUint64(&stat.fastCacheMissCnt, 1)
 }
 
+func (stat *Statistics) IncBloomFilterNegativeCnt() {
+	if stat == nil {
+		return
+	}
+	atomic.AddUint64(&stat.bloomFilterNegativeCnt, 1)
+}
+
 func (stat *Statistics) GetCacheHitCnt() uint64 {
 	return atomic.LoadUint64(&stat.cacheHitCnt)
 }
@@ -61,17 +77,59 @@ func (stat *Statistics) GetFastCacheMissCnt() uint64 {
 	return atomic.LoadUint64(&stat.fastCacheMissCnt)
 }
 
+func (stat *Statistics) GetBloomFilterNegativeCnt() uint64 {
+	return atomic.LoadUint64(&stat.bloomFilterNegativeCnt)
+}
+
 func (stat *Statistics) Reset() {
 	atomic.StoreUint64(&stat.cacheHitCnt, 0)
 	atomic.StoreUint64(&stat.cacheMissCnt, 0)
 	atomic.StoreUint64(&stat.fastCacheHitCnt, 0)
 	atomic.StoreUint64(&stat.fastCacheMissCnt, 0)
+	atomic.StoreUint64(&stat.bloomFilterNegativeCnt, 0)
+}
+
+// SyncMode defines when writes are synchronously flushed to storage, using e.g. the fsync
+// syscall. The zero SyncMode is unset, see Options.Sync.
+type SyncMode uint8
+
+const (
+	// SyncNone never syncs and relies on the OS to flush writes. It is the fastest mode, but
+	// can lose recently committed versions on e.g. power loss.
+	SyncNone SyncMode = iota + 1
+	// SyncBatch syncs once per commit, i.e. once per SaveVersion, while the intermediate
+	// flushes of large batches are not synced. It is the default.
+	SyncBatch
+	// SyncAlways syncs every batch flush, including the intermediate ones.
+	SyncAlways
+)
+
+// String implements fmt.Stringer.
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNone:
+		return "none"
+	case SyncBatch:
+		return "batch"
+	case SyncAlways:
+		return "always"
+	default:
+		return fmt.Sprintf("SyncMode(%d)", uint8(m))
+	}
 }
 
 // Options define tree options.
 type Options struct {
-	// Sync synchronously flushes all writes to storage, using e.g. the fsync syscall.
-	// Disabling this significantly improves performance, but can lose data on e.g. power loss.
+	// SyncMode defines when writes are synchronously flushed to storage. Syncing less often
+	// significantly improves performance, but can lose data on e.g. power loss. If set, it
+	// takes precedence over Sync.
+	SyncMode SyncMode
+
+	// Sync synchronously flushes all writes to storage, using e.g. the fsync syscall. It is
+	// only used if SyncMode is unset, i.e. zero, which DefaultOptions doesn't leave it: the
+	// SyncMode is then SyncBatch if Sync is true, and SyncNone otherwise.
+	//
+	// Deprecated: use SyncMode instead.
 	Sync bool
 
 	// InitialVersion specifies the initial version number. If any versions already exist below
@@ -82,19 +140,312 @@ type Options struct {
 	// When Stat is not nil, statistical logic needs to be executed
 	Stat *Statistics
 
+	// FlushThreshold bounds the size in bytes of the DB batch: the batch is written to the DB,
+	// without syncing unless it is a final commit, each time it reaches the threshold, so that
+	// saving or deleting versions with many writes doesn't build a single giant batch. A version
+	// stays atomic anyway: its writes follow a commit marker, deleted by the final commit, and a
+	// version partially written on a crash is rolled back by the next load, see
+	// MutableTree.LastRepair. 0 or less disables the flushes, the batch being written by the
+	// final commit only.
+	//
 	// Ethereum has found that commit of 100KB is optimal, ref ethereum/go-ethereum#15115
 	FlushThreshold int
+
+	// NodePool recycles the transient nodes created by copy-on-write updates of the working
+	// tree through a sync.Pool, which reduces GC pressure for large change sets. When enabled,
+	// callers must not retain references into the working tree (e.g. MutableTree.ImmutableTree
+	// or an iterator over it) across Set/Remove calls.
+	NodePool bool
+
+	// UnsafeNoCopy makes the read APIs (Get, iteration and proofs) return the key and value
+	// slices stored within IAVL instead of copies of them. It avoids an allocation per returned
+	// slice, but callers must then never modify the returned slices, since that would corrupt
+	// the cached nodes.
+	UnsafeNoCopy bool
+
+	// LatestStore maintains a plain mirror of the key/value pairs at the latest saved version,
+	// updated by every SaveVersion and rebuilt when loading another version. It serves
+	// MutableTree.GetLatest and IterateLatest without going through the tree, at the cost of
+	// writing every change twice.
+	LatestStore bool
+
+	// BloomFilterKeys sizes a bloom filter of the keys of the tree, for this number of keys at
+	// about 1% of false positives, which grow beyond. Get and Has consult it before traversing
+	// the tree, so that most lookups of absent keys load no node. The keys set are added to it,
+	// and the pages of the filter they changed are written along with each version. It is
+	// rebuilt from the latest version when loading a tree saved without it, and when versions
+	// are deleted from the latest one, and only serves the versions saved since it was built.
+	// 0 disables it.
+	BloomFilterKeys int
+
+	// AsyncFastStorageMigration makes loading a version return before the fast storage migration
+	// it may start has finished. The tree serves reads without the fast storage meanwhile, and
+	// SaveVersion waits for the migration to finish.
+	AsyncFastStorageMigration bool
+
+	// ConcurrentSet enables the EXPERIMENTAL MutableTree.ConcurrentSet, which buffers writes
+	// from concurrent goroutines until SaveVersion applies them serially in key order. Only the
+	// buffering is concurrent, not the mutation of the tree.
+	ConcurrentSet bool
+
+	// Comparator orders the keys of the tree instead of the lexicographic order, and so its
+	// iteration, range queries and proofs. Since the root hashes depend on the order, the same
+	// comparator must be given every time the tree is opened. The fast storage then only serves
+	// the lookups of single keys, and the non-membership proofs must be verified with
+	// VerifyNonMembershipWithComparator.
+	Comparator Comparator
+
+	// ImmutableTreeCacheSize is the number of the trees recently returned by
+	// MutableTree.GetImmutable which are kept, and returned again when their version is
+	// requested, instead of loading them anew. 0 disables the cache.
+	ImmutableTreeCacheSize int
+
+	// SeparateFastNodeBatch makes SaveVersion write the fast nodes in a batch of their own, sorted
+	// by key and committed after the batch of the tree nodes, which are written in key order as
+	// well, instead of interleaving both key prefixes in a single batch. This suits the ingestion
+	// of LSM backends better. If the fast node batch fails once the version is committed, the
+	// fast storage is disabled until it is rebuilt by the next load.
+	SeparateFastNodeBatch bool
+
+	// SpillThreshold bounds the size in bytes of the new nodes SaveVersion buffers before writing
+	// them to the DB. The nodes are then written as soon as their subtrees are, and released from
+	// the working tree, and the batch is written to the DB, without syncing, each time it
+	// reaches the threshold, which bounds the memory used to save versions with many writes. The
+	// root of the version is written last, by the final commit, so that a version partially
+	// written on a crash is ignored when loading the tree, and its nodes overwritten when it is
+	// saved again. The tree nodes are then written in the order they are hashed, even with
+	// SeparateFastNodeBatch. 0 disables it.
+	SpillThreshold int
+
+	// SkipNoOpSets makes MutableTree.Set leave the working tree unchanged when a key is set to
+	// the value it already has, instead of rewriting the leaf at the new version along with its
+	// path, which changes the root hash. It saves the writes and hashing of idempotent writes, at
+	// the cost of a lookup of the key per Set.
+	SkipNoOpSets bool
+
+	// CompactOrphans makes loading a version rewrite the orphan records of the legacy versions in
+	// the compact format of MutableTree.MigrateOrphanFormat, resuming a partial migration.
+	CompactOrphans bool
+
+	// MigrateLegacyNodes makes loading a version rewrite the legacy versions in the node key
+	// layout, as MutableTree.MigrateNodeKeys, resuming a partial migration.
+	MigrateLegacyNodes bool
+
+	// OnFlush is called with the version saved by SaveVersion once it is durably written, i.e.
+	// after the synced commit of the version with SyncBatch and SyncAlways. With SyncNone, the
+	// versions are only durable once MutableTree.Sync syncs them, which calls it with the latest
+	// saved version. It lets e.g. an external write-ahead log be truncated up to the version.
+	OnFlush func(version int64)
+
+	// InternKeys is the number of distinct keys interned by the nodes read from the DB, so that
+	// the nodes with equal keys share a single copy of them in memory: every inner node has the
+	// key of a leaf, and a key has a leaf per version it was set at. It reduces the heap used by
+	// the cached nodes of DBs returning copies of the stored values, especially for long keys,
+	// e.g. with long common prefixes, and many versions, at the cost of a lookup per node read.
+	// The keys are stored and hashed as before. Once full, the interned keys are forgotten, and
+	// interned again as they are read. 0 disables it.
+	InternKeys int
+
+	// CoalesceWindow makes the versions saved within the window after a version is saved write
+	// their nodes together, in a single batch written once the window expires, which reduces the
+	// overhead of bursts of small versions, e.g. while catching up. The pending versions are
+	// served from memory meanwhile, and written when the tree is closed, so they are lost on a
+	// crash, as with SyncNone. OnFlush is called once they are written. 0 disables it.
+	CoalesceWindow time.Duration
+
+	// CoalesceMaxVersions bounds the number of versions coalesced by CoalesceWindow: their
+	// writes are written as soon as as many versions are pending. 0 only bounds them by the
+	// window.
+	CoalesceMaxVersions int
+
+	// StoreKeyCounts makes SaveVersion record the number of keys of every version, which
+	// MutableTree.KeyCount then reads without loading the root of the version.
+	StoreKeyCounts bool
+
+	// MaxRetainedVersions caps the number of available versions: SaveVersion deletes the oldest
+	// versions beyond it, which keeps a rolling window of versions without any pruning call. The
+	// versions being read, e.g. by an Exporter, are skipped, the next oldest ones being deleted
+	// instead, so the cap is exceeded while there aren't enough of them. 0 disables it.
+	MaxRetainedVersions int64
+
+	// ValueCodec encodes the leaf values stored in the nodes, e.g. to compress them. The hashes
+	// are computed over the original values, so the root hashes and the proofs don't depend on
+	// it. It must be the same for all the versions of the tree, since the stored values can't
+	// be decoded otherwise. The legacy nodes are not encoded. nil stores the values as is.
+	ValueCodec ValueCodec
+
+	// Tracer starts a span for each traced operation of the tree, e.g. SaveVersion and its
+	// phases. The spans are children of the span carried by the context given to the Context
+	// variants of the operations, e.g. SaveVersionContext. nil doesn't trace anything.
+	Tracer Tracer
+
+	// OperationHook is notified of the node loads, DB reads and writes, hashings and rotations
+	// of the tree, with their durations and sizes, e.g. to profile slow commits. nil doesn't
+	// notify anything.
+	OperationHook OperationHook
+
+	// DBRetry retries the reads and the batch writes of the DB failing with transient errors,
+	// as told by its Retryable predicate, e.g. for a networked DB backend. The other errors are
+	// returned right away. The zero value doesn't retry.
+	DBRetry RetryPolicy
+
+	// MaxOrphansPerBatch bounds the number of the deletions of orphaned nodes which pruning
+	// holds in the pending batch: the batch is written to the DB, without syncing, each time it
+	// holds that many of them, which bounds the memory used to prune the versions orphaning many
+	// nodes. Writing the deletions early is safe for the retained versions, which don't use the
+	// orphans. The orphans of the legacy versions aren't bounded. 0 disables it.
+	MaxOrphansPerBatch int
+
+	// KeyPrefix prefixes all the keys the tree stores in its DB, i.e. its nodes, fast nodes and
+	// metadata, so that several trees can share a DB, each under its own prefix. The iterations
+	// and the pruning of the tree stay within its prefix. The prefixes of the trees sharing a DB
+	// must not be prefixes of one another, and the prefix of a tree must be the same every time
+	// it is opened. nil stores the keys as is.
+	KeyPrefix []byte
+
+	// TrackIteratorLeaks records where each iterator returned by the Iterator methods of the
+	// tree is created, and logs a warning with the stack trace of its creation when it is
+	// garbage-collected without being closed, before closing it. It is a diagnostic aid to find
+	// the leaked iterators, at the cost of capturing a stack trace for each iterator.
+	TrackIteratorLeaks bool
+
+	// IteratorIdleTimeout closes the iterators returned by the Iterator methods of the tree
+	// which aren't used for that long, releasing what they hold: they are then invalid, and
+	// their Error method returns ErrIteratorIdle. 0 disables it.
+	IteratorIdleTimeout time.Duration
+
+	// SoftDeleteRetention enables soft deletes: Remove replaces the value of the key with a
+	// tombstone recording the version deleting it, which is a leaf of the tree, so it is part of
+	// the root hash and is proven with a membership proof by GetProof, see DecodeTombstone. The
+	// reads, e.g. Get, Has, GetWithIndex, Size and the iterators, treat the tombstoned keys as
+	// absent, Size reading the leaves to count them, and MutableTree.GetDeletionInfo tells the
+	// version deleting them. The indexes of GetWithIndex and GetByIndex are the ones of the
+	// leaves, the tombstones included. The tombstones are removed by the SaveVersion of the version SoftDeleteRetention
+	// versions after the one deleting their key. The values of the tombstones can't be set. It
+	// must be enabled every time the tree is opened, since the tombstones would be values
+	// otherwise. 0 disables it.
+	SoftDeleteRetention int64
+
+	// NodeCacheShards splits the node cache into the given number of shards, see
+	// cache.NewSharded, which is then safe for concurrent use: its hits are served without
+	// locking the tree, so that the reads of the immutable trees queried in parallel scale across
+	// cores. The node cache is a single LRU if 0.
+	NodeCacheShards int
+
+	// NodeCachePolicy builds the node cache instead of cache.New, e.g. cache.NewARC or
+	// cache.New2Q for a scan-resistant one when the iterations evict the hot nodes. The shards of
+	// the NodeCacheShards option are LRU, so it is ignored with that option.
+	NodeCachePolicy cache.Policy
+
+	// NodeArenaSize is the size in bytes of an off-heap arena backing the node cache: the nodes
+	// evicted from the cache are kept encoded in anonymous memory mappings, which the garbage
+	// collector doesn't scan, and a node missing from the cache is decoded from there instead of
+	// being read from the DB, which spares the DB gets on archive workloads reading cold
+	// versions. The decoded nodes reference the mappings in place, without copying, so the keys
+	// and hashes read from the tree must not be used once it is closed, nor the values with the
+	// UnsafeNoCopy option. The mappings are never reused, and the evicted nodes are dropped once
+	// the arena is full. It is mapped on the heap where mmap isn't available, and ignored with
+	// the NodeCacheShards or NodeCachePolicy options. 0 disables it.
+	NodeArenaSize int
+
+	// NodeCacheStatsHook is notified of the hits, misses and evictions of the node cache, e.g.
+	// to export them as Prometheus counters, see MutableTree.CacheStats.
+	NodeCacheStatsHook cache.StatsHook
+
+	// FastNodeCacheStatsHook is notified of the hits, misses and evictions of the fast node
+	// cache, as NodeCacheStatsHook.
+	FastNodeCacheStatsHook cache.StatsHook
+
+	// HashWorkers is the number of goroutines hashing the new nodes of a version, by WorkingHash
+	// and SaveVersion, which hash the independent subtrees concurrently on multi-core machines.
+	// The hashes are the same as the sequential ones. 0 or 1 hashes them sequentially.
+	HashWorkers int
+
+	// LazyHashing defers the hashing of the saved leaves read by Set and Remove to WorkingHash
+	// and SaveVersion, along with the one of the new nodes, so that a leaf replaced or removed
+	// by a write is never hashed. Those leaves bypass the node cache, so it suits the blocks
+	// writing many keys that aren't read again before being saved and hashed once. The hashes
+	// are the same as without it.
+	LazyHashing bool
+
+	// ImportWorkers is the number of goroutines hashing, encoding and writing the nodes of an
+	// Import, each with its own batch, so that restoring a large snapshot isn't bound to a single
+	// core on multi-core machines. The node keys are still assigned in the order the nodes are
+	// added, so the imported tree is the same as the sequential one. 0 or 1 imports them
+	// sequentially.
+	ImportWorkers int
+
+	// FastStorageMigrationChunkSize is the number of fast nodes the fast storage migration writes
+	// per chunk, in key order, each chunk being committed with a checkpoint from which an
+	// interrupted migration resumes. Smaller chunks lose less work and keep the batches small,
+	// larger ones commit less often. 0 uses chunks of 10000 fast nodes.
+	FastStorageMigrationChunkSize int64
+
+	// Compression compresses the leaf values stored in the nodes with the given algorithm, e.g.
+	// to shrink large contract states. Each node is tagged with the id of its compression, so
+	// the nodes written with another one, or without compression, e.g. before it was enabled,
+	// are still decoded, and the option may change between versions. A value is stored as is if
+	// it doesn't compress smaller. As with ValueCodec, the hashes are computed over the original
+	// values, and the legacy nodes and the fast nodes are not compressed. It is ignored if the
+	// ValueCodec option is set.
+	Compression Compression
+
+	// ExternalValueThreshold stores the leaf values larger than the given number of bytes apart
+	// from their nodes, which only hold the hash of the value, and reads a value when it is
+	// accessed. The node cache then holds the structure of the tree rather than large values,
+	// and the traversals reading the keys only, e.g. iterating the keys of an older version,
+	// don't read them. A leaf keeps the storage it was saved with, so the option may change
+	// between versions. The values are encoded as the ones of the nodes, and the legacy nodes and
+	// the fast nodes keep their values. 0 disables it.
+	ExternalValueThreshold int
+
+	// HashScheme is the hash function hashing the nodes, e.g. HashBlake3. It is recorded in the
+	// DB by the first SaveVersion, and loading or saving the tree with another scheme returns an
+	// error wrapping ErrHashSchemeMismatch, since the stored hashes couldn't be verified anymore.
+	// The ics23 proofs are verified with HashScheme.ProofSpec, and the native proofs, e.g.
+	// RangeProof, are only produced for the default HashSHA256.
+	HashScheme HashScheme
+
+	// NodeEncoding is the format of the nodes written, e.g. the denser NodeEncodingV2, which
+	// may be set on an existing tree since the nodes of any encoding are read. NodeEncodingV2
+	// is recorded in the DB by the first load or save with it, and the tree then keeps writing
+	// its nodes with it whatever the option. The compression of the keys relative to the key of
+	// the parent isn't implemented, see NodeEncodingV2.
+	NodeEncoding NodeEncoding
 }
 
 // DefaultOptions returns the default options for IAVL.
 func DefaultOptions() Options {
-	return Options{FlushThreshold: 100000}
+	return Options{SyncMode: SyncBatch, FlushThreshold: 100000, ImmutableTreeCacheSize: 4}
 }
 
-// SyncOption sets the Sync option.
+// SyncOption sets the SyncMode option to SyncBatch if sync is true, SyncNone otherwise.
+//
+// Deprecated: use SyncModeOption instead.
 func SyncOption(sync bool) Option {
+	if sync {
+		return SyncModeOption(SyncBatch)
+	}
+	return SyncModeOption(SyncNone)
+}
+
+// syncMode returns the SyncMode of the options, derived from the deprecated Sync option if it
+// is unset.
+func (opts *Options) syncMode() SyncMode {
+	switch {
+	case opts.SyncMode != 0:
+		return opts.SyncMode
+	case opts.Sync:
+		return SyncBatch
+	default:
+		return SyncNone
+	}
+}
+
+// SyncModeOption sets the SyncMode option.
+func SyncModeOption(mode SyncMode) Option {
 	return func(opts *Options) {
-		opts.Sync = sync
+		opts.SyncMode = mode
 	}
 }
 
@@ -118,3 +469,284 @@ func FlushThresholdOption(ft int) Option {
 		opts.FlushThreshold = ft
 	}
 }
+
+// NodePoolOption sets the NodePool option.
+func NodePoolOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.NodePool = enabled
+	}
+}
+
+// UnsafeNoCopyOption sets the UnsafeNoCopy option.
+func UnsafeNoCopyOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.UnsafeNoCopy = enabled
+	}
+}
+
+// LatestStoreOption sets the LatestStore option.
+func LatestStoreOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.LatestStore = enabled
+	}
+}
+
+// BloomFilterKeysOption sets the BloomFilterKeys option.
+func BloomFilterKeysOption(keys int) Option {
+	return func(opts *Options) {
+		opts.BloomFilterKeys = keys
+	}
+}
+
+// AsyncFastStorageMigrationOption sets the AsyncFastStorageMigration option.
+func AsyncFastStorageMigrationOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.AsyncFastStorageMigration = enabled
+	}
+}
+
+// ConcurrentSetOption sets the ConcurrentSet option.
+func ConcurrentSetOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.ConcurrentSet = enabled
+	}
+}
+
+// ComparatorOption sets the Comparator option.
+func ComparatorOption(c Comparator) Option {
+	return func(opts *Options) {
+		opts.Comparator = c
+	}
+}
+
+// ImmutableTreeCacheSizeOption sets the ImmutableTreeCacheSize option.
+func ImmutableTreeCacheSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.ImmutableTreeCacheSize = size
+	}
+}
+
+// SeparateFastNodeBatchOption sets the SeparateFastNodeBatch option.
+func SeparateFastNodeBatchOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.SeparateFastNodeBatch = enabled
+	}
+}
+
+// SpillThresholdOption sets the SpillThreshold option.
+func SpillThresholdOption(threshold int) Option {
+	return func(opts *Options) {
+		opts.SpillThreshold = threshold
+	}
+}
+
+// SkipNoOpSetsOption sets the SkipNoOpSets option.
+func SkipNoOpSetsOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.SkipNoOpSets = enabled
+	}
+}
+
+// CompactOrphansOption sets the CompactOrphans option.
+func CompactOrphansOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.CompactOrphans = enabled
+	}
+}
+
+// MigrateLegacyNodesOption sets the MigrateLegacyNodes option.
+func MigrateLegacyNodesOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.MigrateLegacyNodes = enabled
+	}
+}
+
+// OnFlushOption sets the OnFlush option.
+func OnFlushOption(fn func(version int64)) Option {
+	return func(opts *Options) {
+		opts.OnFlush = fn
+	}
+}
+
+// InternKeysOption sets the InternKeys option.
+func InternKeysOption(size int) Option {
+	return func(opts *Options) {
+		opts.InternKeys = size
+	}
+}
+
+// CoalesceWindowOption sets the CoalesceWindow option.
+func CoalesceWindowOption(window time.Duration) Option {
+	return func(opts *Options) {
+		opts.CoalesceWindow = window
+	}
+}
+
+// CoalesceMaxVersionsOption sets the CoalesceMaxVersions option.
+func CoalesceMaxVersionsOption(n int) Option {
+	return func(opts *Options) {
+		opts.CoalesceMaxVersions = n
+	}
+}
+
+// StoreKeyCountsOption sets the StoreKeyCounts option.
+func StoreKeyCountsOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.StoreKeyCounts = enabled
+	}
+}
+
+// MaxRetainedVersionsOption sets the MaxRetainedVersions option.
+func MaxRetainedVersionsOption(n int64) Option {
+	return func(opts *Options) {
+		opts.MaxRetainedVersions = n
+	}
+}
+
+// ValueCodecOption sets the ValueCodec option.
+func ValueCodecOption(codec ValueCodec) Option {
+	return func(opts *Options) {
+		opts.ValueCodec = codec
+	}
+}
+
+// TracerOption sets the Tracer option.
+func TracerOption(tracer Tracer) Option {
+	return func(opts *Options) {
+		opts.Tracer = tracer
+	}
+}
+
+// OperationHookOption sets the OperationHook option.
+func OperationHookOption(hook OperationHook) Option {
+	return func(opts *Options) {
+		opts.OperationHook = hook
+	}
+}
+
+// DBRetryOption sets the DBRetry option.
+func DBRetryOption(policy RetryPolicy) Option {
+	return func(opts *Options) {
+		opts.DBRetry = policy
+	}
+}
+
+// MaxOrphansPerBatchOption sets the MaxOrphansPerBatch option.
+func MaxOrphansPerBatchOption(n int) Option {
+	return func(opts *Options) {
+		opts.MaxOrphansPerBatch = n
+	}
+}
+
+// KeyPrefixOption sets the KeyPrefix option.
+func KeyPrefixOption(prefix []byte) Option {
+	return func(opts *Options) {
+		opts.KeyPrefix = prefix
+	}
+}
+
+// TrackIteratorLeaksOption sets the TrackIteratorLeaks option.
+func TrackIteratorLeaksOption(track bool) Option {
+	return func(opts *Options) {
+		opts.TrackIteratorLeaks = track
+	}
+}
+
+// IteratorIdleTimeoutOption sets the IteratorIdleTimeout option.
+func IteratorIdleTimeoutOption(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.IteratorIdleTimeout = timeout
+	}
+}
+
+// SoftDeleteRetentionOption sets the SoftDeleteRetention option.
+func SoftDeleteRetentionOption(versions int64) Option {
+	return func(opts *Options) {
+		opts.SoftDeleteRetention = versions
+	}
+}
+
+// NodeCacheShardsOption sets the NodeCacheShards option.
+func NodeCacheShardsOption(shards int) Option {
+	return func(opts *Options) {
+		opts.NodeCacheShards = shards
+	}
+}
+
+// NodeCachePolicyOption sets the NodeCachePolicy option.
+func NodeCachePolicyOption(policy cache.Policy) Option {
+	return func(opts *Options) {
+		opts.NodeCachePolicy = policy
+	}
+}
+
+// NodeArenaSizeOption sets the NodeArenaSize option.
+func NodeArenaSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.NodeArenaSize = size
+	}
+}
+
+// CacheStatsHooksOption sets the NodeCacheStatsHook and FastNodeCacheStatsHook options.
+func CacheStatsHooksOption(nodes, fastNodes cache.StatsHook) Option {
+	return func(opts *Options) {
+		opts.NodeCacheStatsHook = nodes
+		opts.FastNodeCacheStatsHook = fastNodes
+	}
+}
+
+// HashWorkersOption sets the HashWorkers option.
+func HashWorkersOption(workers int) Option {
+	return func(opts *Options) {
+		opts.HashWorkers = workers
+	}
+}
+
+// LazyHashingOption sets the LazyHashing option.
+func LazyHashingOption(lazy bool) Option {
+	return func(opts *Options) {
+		opts.LazyHashing = lazy
+	}
+}
+
+// FastStorageMigrationChunkSizeOption sets the FastStorageMigrationChunkSize option.
+func FastStorageMigrationChunkSizeOption(size int64) Option {
+	return func(opts *Options) {
+		opts.FastStorageMigrationChunkSize = size
+	}
+}
+
+// CompressionOption sets the Compression option.
+func CompressionOption(compression Compression) Option {
+	return func(opts *Options) {
+		opts.Compression = compression
+	}
+}
+
+// ExternalValueThresholdOption sets the ExternalValueThreshold option.
+func ExternalValueThresholdOption(threshold int) Option {
+	return func(opts *Options) {
+		opts.ExternalValueThreshold = threshold
+	}
+}
+
+// ImportWorkersOption sets the ImportWorkers option.
+func ImportWorkersOption(workers int) Option {
+	return func(opts *Options) {
+		opts.ImportWorkers = workers
+	}
+}
+
+// HashSchemeOption sets the HashScheme option.
+func HashSchemeOption(scheme HashScheme) Option {
+	return func(opts *Options) {
+		opts.HashScheme = scheme
+	}
+}
+
+// NodeEncodingOption sets the NodeEncoding option.
+func NodeEncodingOption(enc NodeEncoding) Option {
+	return func(opts *Options) {
+		opts.NodeEncoding = enc
+	}
+}
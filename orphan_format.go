@@ -0,0 +1,186 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// orphanMigrationBatchSize is the number of orphan records rewritten per commit by
+// MigrateOrphanFormat.
+const orphanMigrationBatchSize = 10000
+
+// Key Format for the legacy orphans rewritten by MigrateOrphanFormat. The versions are
+// varint-encoded, and the hash of the orphan isn't repeated in the value, which is empty.
+var compactOrphanKeyFormat = keyformat.NewKeyFormat('c', 0) // c<varint last-version><varint first-version><hash>
+
+// compactOrphanKey returns the compact key of the orphan record of the legacy node with the
+// given hash, which was part of the versions from fromVersion to toVersion.
+func compactOrphanKey(toVersion, fromVersion int64, hash []byte) []byte {
+	key := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(hash))
+	key = append(key, compactOrphanKeyFormat.Prefix()...)
+	key = binary.AppendUvarint(key, uint64(toVersion))
+	key = binary.AppendUvarint(key, uint64(fromVersion))
+	return append(key, hash...)
+}
+
+// parseCompactOrphanKey decodes a key returned by compactOrphanKey.
+func parseCompactOrphanKey(key []byte) (toVersion, fromVersion int64, hash []byte, err error) {
+	if len(key) == 0 || string(key[:1]) != compactOrphanKeyFormat.Prefix() {
+		return 0, 0, nil, fmt.Errorf("invalid compact orphan key %X", key)
+	}
+	bz := key[1:]
+	to, n := binary.Uvarint(bz)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid last version of compact orphan key %X", key)
+	}
+	bz = bz[n:]
+	from, n := binary.Uvarint(bz)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid first version of compact orphan key %X", key)
+	}
+	bz = bz[n:]
+	if len(bz) != hashSize {
+		return 0, 0, nil, fmt.Errorf("invalid hash of compact orphan key %X", key)
+	}
+	return int64(to), int64(from), bz, nil
+}
+
+// traverseLegacyOrphans calls fn with the database key, the versions and the node hash of every
+// orphan record of the legacy versions, in the legacy format and then in the compact one, since
+// a partial migration leaves records in both.
+func (ndb *nodeDB) traverseLegacyOrphans(fn func(key []byte, toVersion, fromVersion int64, hash []byte) error) error {
+	if err := ndb.traversePrefix(legacyOrphanKeyFormat.Key(), func(key, value []byte) error {
+		var toVersion, fromVersion int64
+		legacyOrphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+		return fn(key, toVersion, fromVersion, value)
+	}); err != nil {
+		return err
+	}
+
+	return ndb.traversePrefix(compactOrphanKeyFormat.Key(), func(key, _ []byte) error {
+		toVersion, fromVersion, hash, err := parseCompactOrphanKey(key)
+		if err != nil {
+			return err
+		}
+		return fn(key, toVersion, fromVersion, hash)
+	})
+}
+
+// migrateOrphanFormat rewrites the legacy orphan records in the compact format, committing every
+// orphanMigrationBatchSize records so that an interrupted migration resumes where it stopped. It
+// returns the number of rewritten records.
+func (ndb *nodeDB) migrateOrphanFormat() (int, error) {
+	migrated := 0
+	for {
+		// the records are collected before rewriting them, since the iterator of some databases
+		// doesn't allow writes.
+		var keys, hashes [][]byte
+		itr, err := ndb.getPrefixIterator(legacyOrphanKeyFormat.Key())
+		if err != nil {
+			return migrated, err
+		}
+		for ; itr.Valid() && len(keys) < orphanMigrationBatchSize; itr.Next() {
+			keys = append(keys, append([]byte(nil), itr.Key()...))
+			hashes = append(hashes, append([]byte(nil), itr.Value()...))
+		}
+		err = itr.Error()
+		if closeErr := itr.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return migrated, err
+		}
+		if len(keys) == 0 {
+			return migrated, nil
+		}
+
+		for i, key := range keys {
+			var toVersion, fromVersion int64
+			legacyOrphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+			if err := ndb.batch.Set(compactOrphanKey(toVersion, fromVersion, hashes[i]), []byte{}); err != nil {
+				return migrated, err
+			}
+			if err := ndb.batch.Delete(key); err != nil {
+				return migrated, err
+			}
+		}
+		if err := ndb.Commit(); err != nil {
+			return migrated, err
+		}
+		migrated += len(keys)
+		ndb.logger.Info("migrating orphan records", "migrated", migrated)
+	}
+}
+
+// MigrateOrphanFormat rewrites the orphan records of the legacy versions in a compact format,
+// which takes about half the space: the versions are varint-encoded instead of using 8 bytes
+// each, and the hash of the orphaned node is no longer repeated in the value. The tree doesn't
+// write orphan records for the versions it saves, so only databases with legacy versions have
+// any. The migration commits its progress regularly and can be resumed, and the pruning of the
+// legacy versions reads both formats meanwhile. It returns the number of rewritten records.
+func (tree *MutableTree) MigrateOrphanFormat() (int, error) {
+	return tree.ndb.migrateOrphanFormat()
+}
+
+// RepairOrphans removes the orphan records of the legacy nodes which are still used by an
+// available version after the last version they are recorded in, so that pruning the legacy
+// versions doesn't delete nodes the live versions use. It reads the nodes of all the available
+// versions, each subtree once, and returns the number of removed records.
+func (tree *MutableTree) RepairOrphans() (int, error) {
+	versions := tree.AvailableVersions()
+	// the latest version using each legacy node, by hash.
+	live := make(map[string]int64)
+	visited := make(map[string]struct{})
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := int64(versions[i])
+		rootKey, err := tree.ndb.GetRoot(version)
+		if err != nil {
+			return 0, err
+		}
+		itr, err := NewNodeIterator(rootKey, tree.ndb)
+		if err != nil {
+			return 0, err
+		}
+		for itr.Valid() {
+			node := itr.GetNode()
+			key := string(node.GetKey())
+			if _, ok := visited[key]; ok {
+				// the subtree is used by a later version.
+				itr.Next(true)
+				continue
+			}
+			visited[key] = struct{}{}
+			if node.nodeKey.nonce == 0 {
+				if _, ok := live[string(node.hash)]; !ok {
+					live[string(node.hash)] = version
+				}
+			}
+			itr.Next(false)
+		}
+		if err := itr.Error(); err != nil {
+			return 0, err
+		}
+	}
+
+	var invalid [][]byte
+	if err := tree.ndb.traverseLegacyOrphans(func(key []byte, toVersion, _ int64, hash []byte) error {
+		if version, ok := live[string(hash)]; ok && version > toVersion {
+			tree.logger.Info("removing the orphan record of a live node", "hash", fmt.Sprintf("%X", hash), "orphanedAfter", toVersion, "usedAt", version)
+			invalid = append(invalid, append([]byte(nil), key...))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	for _, key := range invalid {
+		if err := tree.ndb.batch.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return 0, err
+	}
+	return len(invalid), nil
+}
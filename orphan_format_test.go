@@ -0,0 +1,215 @@
+package iavl
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestCompactOrphanKey(t *testing.T) {
+	hash := make([]byte, hashSize)
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+	for _, versions := range [][2]int64{{1, 1}, {300, 2}, {math.MaxInt64, 1 << 40}} {
+		key := compactOrphanKey(versions[0], versions[1], hash)
+		toVersion, fromVersion, h, err := parseCompactOrphanKey(key)
+		require.NoError(t, err)
+		require.Equal(t, versions, [2]int64{toVersion, fromVersion})
+		require.Equal(t, hash, h)
+		require.Less(t, len(key), len(legacyOrphanKeyFormat.Key(versions[0], versions[1], hash)))
+	}
+
+	key := compactOrphanKey(300, 2, hash)
+	for _, invalid := range [][]byte{nil, key[:1], key[:2], key[:len(key)-1], legacyOrphanKeyFormat.Key(int64(1), int64(1), hash)} {
+		_, _, _, err := parseCompactOrphanKey(invalid)
+		require.Error(t, err, "%X", invalid)
+	}
+}
+
+// orphanRecords returns the number and the size of the orphan records in the legacy and the
+// compact format.
+func orphanRecords(t *testing.T, ndb *nodeDB) (legacy, compact, legacyBytes, compactBytes int) {
+	require.NoError(t, ndb.traversePrefix(legacyOrphanKeyFormat.Key(), func(key, value []byte) error {
+		legacy++
+		legacyBytes += len(key) + len(value)
+		return nil
+	}))
+	require.NoError(t, ndb.traversePrefix(compactOrphanKeyFormat.Key(), func(key, value []byte) error {
+		compact++
+		compactBytes += len(key) + len(value)
+		return nil
+	}))
+	return legacy, compact, legacyBytes, compactBytes
+}
+
+func openLegacyTree(t *testing.T, legacyVersion int, options ...Option) *MutableTree {
+	relateDir, err := createLegacyTree(t, fmt.Sprintf("./legacy-%s-%d", dbType, legacyVersion), legacyVersion)
+	require.NoError(t, err)
+	db, err := dbm.NewDB("test", dbType, relateDir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+		require.NoError(t, os.RemoveAll(relateDir))
+	})
+	return NewMutableTree(db, 1000, false, log.NewNopLogger(), options...)
+}
+
+func TestMigrateOrphanFormat(t *testing.T) {
+	legacyVersion := 100
+	tree := openLegacyTree(t, legacyVersion)
+	_, err := tree.LoadVersion(int64(legacyVersion))
+	require.NoError(t, err)
+
+	legacy, compact, legacyBytes, _ := orphanRecords(t, tree.ndb)
+	require.Positive(t, legacy)
+	require.Zero(t, compact)
+
+	migrated, err := tree.MigrateOrphanFormat()
+	require.NoError(t, err)
+	require.Equal(t, legacy, migrated)
+	legacyAfter, compact, _, compactBytes := orphanRecords(t, tree.ndb)
+	require.Zero(t, legacyAfter)
+	require.Equal(t, legacy, compact)
+	require.Less(t, compactBytes, legacyBytes*2/3)
+
+	// write half of the records back in the legacy format, as left by an interrupted migration.
+	i := 0
+	require.NoError(t, tree.ndb.traversePrefix(compactOrphanKeyFormat.Key(), func(key, _ []byte) error {
+		i++
+		if i%2 == 0 {
+			return nil
+		}
+		toVersion, fromVersion, hash, err := parseCompactOrphanKey(key)
+		require.NoError(t, err)
+		require.NoError(t, tree.ndb.batch.Set(legacyOrphanKeyFormat.Key(toVersion, fromVersion, hash), hash))
+		return tree.ndb.batch.Delete(key)
+	}))
+	require.NoError(t, tree.ndb.Commit())
+	legacy, compact, _, _ = orphanRecords(t, tree.ndb)
+	require.Positive(t, legacy)
+	require.Positive(t, compact)
+
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte(fmt.Sprintf("value-%d-%d", i, j)))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// pruning the legacy versions frees their orphans in both formats.
+	require.NoError(t, tree.ndb.deleteVersionsTo(int64(legacyVersion+10), false))
+	require.NoError(t, tree.ndb.Commit())
+	legacy, compact, _, _ = orphanRecords(t, tree.ndb)
+	require.Zero(t, legacy)
+	require.Zero(t, compact)
+
+	// the legacy nodes left are the ones the remaining versions use.
+	used := make(map[string]bool)
+	for _, version := range tree.AvailableVersions() {
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		require.NoError(t, err)
+		itr, err := NewNodeIterator(rootKey, tree.ndb)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next(false) {
+			if node := itr.GetNode(); node.nodeKey.nonce == 0 {
+				used[string(node.hash)] = true
+			}
+		}
+		require.NoError(t, itr.Error())
+	}
+	legacyNodes, err := tree.ndb.legacyNodes()
+	require.NoError(t, err)
+	require.Len(t, legacyNodes, len(used))
+	for _, node := range legacyNodes {
+		require.True(t, used[string(node.hash)])
+	}
+}
+
+func TestCompactOrphansOption(t *testing.T) {
+	legacyVersion := 20
+	tree := openLegacyTree(t, legacyVersion, CompactOrphansOption(true))
+	legacy, _, _, _ := orphanRecords(t, tree.ndb)
+	require.Positive(t, legacy)
+
+	_, err := tree.Load()
+	require.NoError(t, err)
+	legacyAfter, compact, _, _ := orphanRecords(t, tree.ndb)
+	require.Zero(t, legacyAfter)
+	require.Equal(t, legacy, compact)
+}
+
+func TestRepairOrphans(t *testing.T) {
+	legacyVersion := 20
+	tree := openLegacyTree(t, legacyVersion)
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	repaired, err := tree.RepairOrphans()
+	require.NoError(t, err)
+	require.Zero(t, repaired)
+
+	// record two legacy nodes of the latest version as orphaned since the first version.
+	rootKey, err := tree.ndb.GetRoot(tree.Version())
+	require.NoError(t, err)
+	itr, err := NewNodeIterator(rootKey, tree.ndb)
+	require.NoError(t, err)
+	var hashes [][]byte
+	for ; itr.Valid() && len(hashes) < 2; itr.Next(false) {
+		if node := itr.GetNode(); node.nodeKey.nonce == 0 && node.isLeaf() {
+			hashes = append(hashes, node.hash)
+		}
+	}
+	require.NoError(t, itr.Error())
+	require.Len(t, hashes, 2)
+	require.NoError(t, tree.ndb.batch.Set(legacyOrphanKeyFormat.Key(int64(1), int64(1), hashes[0]), hashes[0]))
+	require.NoError(t, tree.ndb.batch.Set(compactOrphanKey(1, 1, hashes[1]), []byte{}))
+	require.NoError(t, tree.ndb.Commit())
+
+	expected := make(map[string]string)
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		expected[string(key)] = string(value)
+		return false
+	})
+	require.NoError(t, err)
+
+	repaired, err = tree.RepairOrphans()
+	require.NoError(t, err)
+	require.Equal(t, 2, repaired)
+	repaired, err = tree.RepairOrphans()
+	require.NoError(t, err)
+	require.Zero(t, repaired)
+
+	// the live nodes survive the pruning of the legacy versions.
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.ndb.deleteVersionsTo(legacyLatestVersion, false))
+	require.NoError(t, tree.ndb.Commit())
+	for _, hash := range hashes {
+		has, err := tree.ndb.db.Has(tree.ndb.legacyNodeKey(hash))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	actual := make(map[string]string)
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		actual[string(key)] = string(value)
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
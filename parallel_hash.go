@@ -0,0 +1,67 @@
+package iavl
+
+import "sync"
+
+// minParallelHashSize is the minimum number of leaves under a node for its two subtrees to be
+// hashed concurrently, below which a goroutine costs more than it saves.
+const minParallelHashSize = 256
+
+// hashParallel computes the hashes of the node and its descendants as hashWithCount, with up to
+// workers goroutines, see the HashWorkers option. The subtrees of a node whose children both
+// need to be hashed are hashed concurrently while a worker is available, so the hashes are the
+// same as the sequential ones, and stay in the nodes as well.
+func (node *Node) hashParallel(version int64, scheme HashScheme, workers int) []byte {
+	if node == nil {
+		return scheme.EmptyHash()
+	}
+	if workers <= 1 {
+		return node.hashWithCount(version, scheme)
+	}
+	node.hashConcurrently(version, scheme, make(chan struct{}, workers-1))
+	return node.hash
+}
+
+// hashConcurrently hashes the node once its children are, hashing the left one in another
+// goroutine if a slot of sem is free.
+func (node *Node) hashConcurrently(version int64, scheme HashScheme, sem chan struct{}) {
+	if node == nil || node.hash != nil {
+		return
+	}
+	if !node.isLeaf() {
+		forked := false
+		if node.size >= minParallelHashSize && node.leftNode != nil && node.rightNode != nil &&
+			node.leftNode.hash == nil && node.rightNode.hash == nil {
+			select {
+			case sem <- struct{}{}:
+				forked = true
+			default:
+			}
+		}
+		if forked {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				node.leftNode.hashConcurrently(version, scheme, sem)
+			}()
+			node.rightNode.hashConcurrently(version, scheme, sem)
+			wg.Wait()
+		} else {
+			node.leftNode.hashConcurrently(version, scheme, sem)
+			node.rightNode.hashConcurrently(version, scheme, sem)
+		}
+	}
+
+	nodeVersion := version
+	if node.nodeKey != nil {
+		// as in _hash.
+		nodeVersion = node.nodeKey.version
+	}
+	h := scheme.New()
+	if err := node.writeHashBytes(h, nodeVersion, scheme); err != nil {
+		// as in hashWithCount.
+		panic(err)
+	}
+	node.hash = h.Sum(nil)
+}
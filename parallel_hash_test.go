@@ -0,0 +1,91 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestHashWorkers(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	sequential := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var trees []*MutableTree
+	for _, workers := range []int{2, 4, 16} {
+		trees = append(trees, NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashWorkersOption(workers)))
+	}
+
+	for version := 1; version <= 8; version++ {
+		// large versions fork subtrees, while the small ones only change a few paths.
+		n := 2000
+		if version%2 == 0 {
+			n = 10
+		}
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key-%d", r.Intn(20000)))
+			value := []byte(fmt.Sprintf("value-%d-%d", version, i))
+			remove := r.Intn(5) == 0
+			for _, tree := range append([]*MutableTree{sequential}, trees...) {
+				var err error
+				if remove {
+					_, _, err = tree.Remove(key)
+				} else {
+					_, err = tree.Set(key, value)
+				}
+				require.NoError(t, err)
+			}
+		}
+		if version%3 == 0 {
+			for _, tree := range trees {
+				require.Equal(t, sequential.WorkingHash(), tree.WorkingHash(), "version %d", version)
+			}
+		}
+		hash, _, err := sequential.SaveVersion()
+		require.NoError(t, err)
+		for _, tree := range trees {
+			parallelHash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, hash, parallelHash, "version %d", version)
+		}
+	}
+
+	// the nodes are saved as by the sequential hashing.
+	for _, tree := range trees {
+		for version := int64(1); version <= 8; version++ {
+			expected, err := sequential.GetImmutable(version)
+			require.NoError(t, err)
+			itree, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+			require.Equal(t, expected.String(), itree.String(), "version %d", version)
+		}
+	}
+}
+
+func TestHashWorkers_Empty(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashWorkersOption(4))
+	require.Equal(t, EmptyHash(), tree.WorkingHash())
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, EmptyHash(), hash)
+}
+
+func BenchmarkSaveVersion_HashWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger(), HashWorkersOption(workers))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 10000; j++ {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%d", r.Int())), []byte("value"))
+					require.NoError(b, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
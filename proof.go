@@ -2,7 +2,6 @@ package iavl
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"sync"
@@ -26,6 +25,9 @@ var (
 
 	// ErrInvalidRoot is returned when the root passed in does not match the proof's.
 	ErrInvalidRoot = fmt.Errorf("invalid root")
+
+	// ErrRootMismatch is returned when the root of a loaded version is not the expected one.
+	ErrRootMismatch = fmt.Errorf("root mismatch")
 )
 
 //----------------------------------------
@@ -61,7 +63,12 @@ func (pin ProofInnerNode) stringIndented(indent string) string {
 }
 
 func (pin ProofInnerNode) Hash(childHash []byte) ([]byte, error) {
-	hasher := sha256.New()
+	return pin.hashWith(HashSHA256, childHash)
+}
+
+// hashWith is Hash with the given hash scheme.
+func (pin ProofInnerNode) hashWith(scheme HashScheme, childHash []byte) ([]byte, error) {
+	hasher := scheme.New()
 
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -131,7 +138,12 @@ func (pln ProofLeafNode) stringIndented(indent string) string {
 }
 
 func (pln ProofLeafNode) Hash() ([]byte, error) {
-	hasher := sha256.New()
+	return pln.hashWith(HashSHA256)
+}
+
+// hashWith is Hash with the given hash scheme.
+func (pln ProofLeafNode) hashWith(scheme HashScheme) ([]byte, error) {
+	hasher := scheme.New()
 
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -191,7 +203,7 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, version int64, path *
 	// left node as part of the path, similarly we don't store the right child info when going down
 	// the right child node. This is done as an optimization since the child info is going to be
 	// already stored in the next ProofInnerNode in PathToLeaf.
-	if bytes.Compare(key, node.key) < 0 {
+	if t.ndb.compare(key, node.key) < 0 {
 		// left side
 		rightNode, err := node.getRightNode(t)
 		if err != nil {
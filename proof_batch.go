@@ -0,0 +1,85 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// errBatchProofComparator is returned for the batch proofs of a tree with the Comparator option,
+// which ics23 verifies as ordered lexicographically.
+var errBatchProofComparator = errors.New("batch proofs are not supported with a custom comparator")
+
+// GetBatchProof returns a single compressed CommitmentProof proving every given key, with a
+// membership proof for the keys in the tree and a non-membership proof for the others, as
+// GetProof. The inner nodes shared by the paths of the keys are stored once, as by
+// ics23.CombineProofs, so proving many keys costs less than their separate proofs. The proof
+// is verified with VerifyBatchProof, or with ics23.BatchVerifyMembership and
+// ics23.BatchVerifyNonMembership.
+func (t *ImmutableTree) GetBatchProof(keys [][]byte) (*ics23.CommitmentProof, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys to prove: %w", ErrInvalidInputs)
+	}
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return nil, errBatchProofComparator
+	}
+	proofs := make([]*ics23.CommitmentProof, 0, len(keys))
+	for _, key := range keys {
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, fmt.Errorf("proving key %X: %w", key, err)
+		}
+		proofs = append(proofs, proof)
+	}
+	return ics23.CombineProofs(proofs)
+}
+
+// VerifyBatchProof returns true iff proof is a batch proof, compressed or not, of every given
+// key against the tree, i.e. of their membership with their value for the keys in the tree,
+// and of their non-membership for the others.
+func (t *ImmutableTree) VerifyBatchProof(proof *ics23.CommitmentProof, keys [][]byte) (bool, error) {
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return false, errBatchProofComparator
+	}
+	items := make(map[string][]byte)
+	var absent [][]byte
+	for _, key := range keys {
+		// the tombstone of a key deleted with soft deletes is proven as well.
+		value, err := t.getStored(key)
+		if err != nil {
+			return false, err
+		}
+		if value == nil {
+			absent = append(absent, key)
+			continue
+		}
+		items[string(key)] = value
+	}
+
+	root := t.Hash()
+	spec, err := t.ndb.hashScheme().ProofSpec()
+	if err != nil {
+		return false, err
+	}
+	if len(items) > 0 && !ics23.BatchVerifyMembership(spec, root, proof, items) {
+		return false, nil
+	}
+	if len(absent) > 0 && !ics23.BatchVerifyNonMembership(spec, root, proof, absent) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// GetVersionedBatchProof gets the batch proof of the given keys at the specified version, see
+// ImmutableTree.GetBatchProof.
+func (tree *MutableTree) GetVersionedBatchProof(keys [][]byte, version int64) (*ics23.CommitmentProof, error) {
+	if !tree.VersionExists(version) {
+		return nil, ErrVersionDoesNotExist
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetBatchProof(keys)
+}
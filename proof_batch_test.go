@@ -0,0 +1,103 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestGetBatchProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 1000; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	// existing and missing keys, with missing ones before the first and after the last key.
+	keys := [][]byte{[]byte("a"), []byte("key-0000"), []byte("key-0101"), []byte("key-0500"), []byte("key-0502"), []byte("key-0998"), []byte("z")}
+	proof, err := itree.GetBatchProof(keys)
+	require.NoError(t, err)
+	require.True(t, ics23.IsCompressed(proof))
+	valid, err := itree.VerifyBatchProof(proof, keys)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = itree.VerifyBatchProof(ics23.Decompress(proof), keys)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// the proof verifies with ics23 alone.
+	root := itree.Hash()
+	require.True(t, ics23.BatchVerifyMembership(ics23.IavlSpec, root, proof, map[string][]byte{
+		"key-0000": []byte("value-0"),
+		"key-0500": []byte("value-500"),
+	}))
+	require.True(t, ics23.BatchVerifyNonMembership(ics23.IavlSpec, root, proof, [][]byte{[]byte("a"), []byte("key-0101"), []byte("z")}))
+	require.False(t, ics23.BatchVerifyMembership(ics23.IavlSpec, root, proof, map[string][]byte{"key-0000": []byte("other")}))
+
+	// the compressed proof is smaller than the separate ones, which share the inner nodes near
+	// the root.
+	separate := 0
+	for _, key := range keys {
+		p, err := itree.GetProof(key)
+		require.NoError(t, err)
+		bz, err := p.Marshal()
+		require.NoError(t, err)
+		separate += len(bz)
+	}
+	bz, err := proof.Marshal()
+	require.NoError(t, err)
+	require.Less(t, len(bz), separate)
+
+	// a proof doesn't verify a key it doesn't cover, nor once the key changed.
+	valid, err = itree.VerifyBatchProof(proof, append(keys, []byte("key-0002")))
+	require.NoError(t, err)
+	require.False(t, valid)
+	_, err = tree.Set([]byte("key-0101"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	latest, err := tree.GetImmutable(version + 1)
+	require.NoError(t, err)
+	valid, err = latest.VerifyBatchProof(proof, keys)
+	require.NoError(t, err)
+	require.False(t, valid)
+
+	versioned, err := tree.GetVersionedBatchProof(keys, version)
+	require.NoError(t, err)
+	require.Equal(t, proof, versioned)
+	_, err = tree.GetVersionedBatchProof(keys, version+2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestGetBatchProof_Invalid(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	_, err = itree.GetBatchProof(nil)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = itree.GetBatchProof([][]byte{[]byte("key"), {}})
+	require.ErrorIs(t, err, ErrEmptyKey)
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err = empty.ImmutableTree.GetBatchProof([][]byte{[]byte("key")})
+	require.Error(t, err)
+
+	numeric := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ComparatorOption(numericComparator))
+	_, err = numeric.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, err = numeric.ImmutableTree.GetBatchProof([][]byte{[]byte("key")})
+	require.ErrorIs(t, err, errBatchProofComparator)
+}
@@ -0,0 +1,409 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// The CBOR form of a proof mirrors its protobuf form: every message is a CBOR map keyed by the
+// protobuf field numbers, with bytes as byte strings, enums as unsigned integers and repeated
+// fields as arrays. As in proto3, fields with zero values are omitted. The encoding is the core
+// deterministic encoding of RFC 8949 (minimal heads, definite lengths, keys in ascending
+// order), so that a given proof always has a single CBOR form.
+
+// ErrInvalidProofCBOR is returned when decoding a malformed or non canonical CBOR proof.
+var ErrInvalidProofCBOR = errors.New("invalid CBOR proof")
+
+// CBOR major types.
+const (
+	cborUint  = 0
+	cborBytes = 2
+	cborArray = 4
+	cborMap   = 5
+)
+
+// MarshalProofCBOR encodes an existence or non-existence proof in deterministic CBOR. Batch
+// and compressed proofs are not supported.
+func MarshalProofCBOR(proof *ics23.CommitmentProof) ([]byte, error) {
+	if proof == nil {
+		return nil, fmt.Errorf("proof is nil: %w", ErrInvalidInputs)
+	}
+	e := &cborEncoder{}
+	switch p := proof.Proof.(type) {
+	case *ics23.CommitmentProof_Exist:
+		e.head(cborMap, 1)
+		e.uint(1)
+		e.existenceProof(p.Exist)
+	case *ics23.CommitmentProof_Nonexist:
+		e.head(cborMap, 1)
+		e.uint(2)
+		e.nonExistenceProof(p.Nonexist)
+	default:
+		return nil, fmt.Errorf("unsupported proof type %T: %w", proof.Proof, ErrInvalidInputs)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalProofCBOR decodes a proof encoded by MarshalProofCBOR. It returns an error wrapping
+// ErrInvalidProofCBOR if bz is not the canonical CBOR form of a proof.
+func UnmarshalProofCBOR(bz []byte) (*ics23.CommitmentProof, error) {
+	d := &cborDecoder{buf: bz}
+	proof := &ics23.CommitmentProof{}
+	err := d.mapFields(func(key uint64) error {
+		if proof.Proof != nil {
+			return fmt.Errorf("%w: more than one proof", ErrInvalidProofCBOR)
+		}
+		switch key {
+		case 1:
+			exist, err := d.existenceProof()
+			proof.Proof = &ics23.CommitmentProof_Exist{Exist: exist}
+			return err
+		case 2:
+			nonexist, err := d.nonExistenceProof()
+			proof.Proof = &ics23.CommitmentProof_Nonexist{Nonexist: nonexist}
+			return err
+		default:
+			return fmt.Errorf("%w: unsupported proof type %d", ErrInvalidProofCBOR, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if proof.Proof == nil {
+		return nil, fmt.Errorf("%w: empty proof", ErrInvalidProofCBOR)
+	}
+	if d.pos != len(d.buf) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidProofCBOR, len(d.buf)-d.pos)
+	}
+	return proof, nil
+}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+// head writes the initial bytes of a data item with the shortest encoding of n.
+func (e *cborEncoder) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), n)
+	}
+}
+
+func (e *cborEncoder) uint(n uint64) {
+	e.head(cborUint, n)
+}
+
+func (e *cborEncoder) bytes(bz []byte) {
+	e.head(cborBytes, uint64(len(bz)))
+	e.buf = append(e.buf, bz...)
+}
+
+// cborMapSize returns the number of true values, i.e. of non-zero fields to encode.
+func cborMapSize(present ...bool) uint64 {
+	n := uint64(0)
+	for _, p := range present {
+		if p {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *cborEncoder) existenceProof(p *ics23.ExistenceProof) {
+	if p == nil {
+		p = &ics23.ExistenceProof{}
+	}
+	e.head(cborMap, cborMapSize(len(p.Key) > 0, len(p.Value) > 0, p.Leaf != nil, len(p.Path) > 0))
+	if len(p.Key) > 0 {
+		e.uint(1)
+		e.bytes(p.Key)
+	}
+	if len(p.Value) > 0 {
+		e.uint(2)
+		e.bytes(p.Value)
+	}
+	if p.Leaf != nil {
+		e.uint(3)
+		e.leafOp(p.Leaf)
+	}
+	if len(p.Path) > 0 {
+		e.uint(4)
+		e.head(cborArray, uint64(len(p.Path)))
+		for _, op := range p.Path {
+			e.innerOp(op)
+		}
+	}
+}
+
+func (e *cborEncoder) nonExistenceProof(p *ics23.NonExistenceProof) {
+	if p == nil {
+		p = &ics23.NonExistenceProof{}
+	}
+	e.head(cborMap, cborMapSize(len(p.Key) > 0, p.Left != nil, p.Right != nil))
+	if len(p.Key) > 0 {
+		e.uint(1)
+		e.bytes(p.Key)
+	}
+	if p.Left != nil {
+		e.uint(2)
+		e.existenceProof(p.Left)
+	}
+	if p.Right != nil {
+		e.uint(3)
+		e.existenceProof(p.Right)
+	}
+}
+
+func (e *cborEncoder) leafOp(op *ics23.LeafOp) {
+	e.head(cborMap, cborMapSize(op.Hash != 0, op.PrehashKey != 0, op.PrehashValue != 0, op.Length != 0, len(op.Prefix) > 0))
+	for i, enum := range []int32{int32(op.Hash), int32(op.PrehashKey), int32(op.PrehashValue), int32(op.Length)} {
+		if enum != 0 {
+			e.uint(uint64(i + 1))
+			e.uint(uint64(enum))
+		}
+	}
+	if len(op.Prefix) > 0 {
+		e.uint(5)
+		e.bytes(op.Prefix)
+	}
+}
+
+func (e *cborEncoder) innerOp(op *ics23.InnerOp) {
+	if op == nil {
+		op = &ics23.InnerOp{}
+	}
+	e.head(cborMap, cborMapSize(op.Hash != 0, len(op.Prefix) > 0, len(op.Suffix) > 0))
+	if op.Hash != 0 {
+		e.uint(1)
+		e.uint(uint64(op.Hash))
+	}
+	if len(op.Prefix) > 0 {
+		e.uint(2)
+		e.bytes(op.Prefix)
+	}
+	if len(op.Suffix) > 0 {
+		e.uint(3)
+		e.bytes(op.Suffix)
+	}
+}
+
+type cborDecoder struct {
+	buf []byte
+	pos int
+}
+
+// head reads the initial bytes of a data item of the given major type, and returns its
+// argument. Only the shortest encoding of the argument is accepted.
+func (d *cborDecoder) head(major byte) (uint64, error) {
+	if d.pos >= len(d.buf) {
+		return 0, fmt.Errorf("%w: unexpected end of input", ErrInvalidProofCBOR)
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	if b>>5 != major {
+		return 0, fmt.Errorf("%w: expected major type %d, got %d", ErrInvalidProofCBOR, major, b>>5)
+	}
+
+	info := b & 0x1f
+	var size int
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, fmt.Errorf("%w: unsupported additional information %d", ErrInvalidProofCBOR, info)
+	}
+	if len(d.buf)-d.pos < size {
+		return 0, fmt.Errorf("%w: unexpected end of input", ErrInvalidProofCBOR)
+	}
+	var n, minimum uint64
+	switch size {
+	case 1:
+		n, minimum = uint64(d.buf[d.pos]), 24
+	case 2:
+		n, minimum = uint64(binary.BigEndian.Uint16(d.buf[d.pos:])), math.MaxUint8+1
+	case 4:
+		n, minimum = uint64(binary.BigEndian.Uint32(d.buf[d.pos:])), math.MaxUint16+1
+	case 8:
+		n, minimum = binary.BigEndian.Uint64(d.buf[d.pos:]), math.MaxUint32+1
+	}
+	d.pos += size
+	if n < minimum {
+		return 0, fmt.Errorf("%w: non minimal encoding of %d", ErrInvalidProofCBOR, n)
+	}
+	return n, nil
+}
+
+func (d *cborDecoder) bytes() ([]byte, error) {
+	n, err := d.head(cborBytes)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end of input", ErrInvalidProofCBOR)
+	}
+	bz := bytes.Clone(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return bz, nil
+}
+
+// enum reads an enum value, which must fit in an int32.
+func (d *cborDecoder) enum() (int32, error) {
+	n, err := d.head(cborUint)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: enum value %d out of range", ErrInvalidProofCBOR, n)
+	}
+	return int32(n), nil
+}
+
+// mapFields reads a map, calling fn to read the value of each key. Keys must be unsigned
+// integers in strictly ascending order.
+func (d *cborDecoder) mapFields(fn func(key uint64) error) error {
+	n, err := d.head(cborMap)
+	if err != nil {
+		return err
+	}
+	var prev uint64
+	for i := uint64(0); i < n; i++ {
+		key, err := d.head(cborUint)
+		if err != nil {
+			return err
+		}
+		if i > 0 && key <= prev {
+			return fmt.Errorf("%w: map keys not in ascending order", ErrInvalidProofCBOR)
+		}
+		prev = key
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unknownCBORField(key uint64) error {
+	return fmt.Errorf("%w: unknown field %d", ErrInvalidProofCBOR, key)
+}
+
+func (d *cborDecoder) existenceProof() (*ics23.ExistenceProof, error) {
+	p := &ics23.ExistenceProof{}
+	err := d.mapFields(func(key uint64) (err error) {
+		switch key {
+		case 1:
+			p.Key, err = d.bytes()
+		case 2:
+			p.Value, err = d.bytes()
+		case 3:
+			p.Leaf, err = d.leafOp()
+		case 4:
+			var n uint64
+			n, err = d.head(cborArray)
+			if err != nil {
+				return err
+			}
+			// every inner op takes at least one byte.
+			if n > uint64(len(d.buf)-d.pos) {
+				return fmt.Errorf("%w: unexpected end of input", ErrInvalidProofCBOR)
+			}
+			p.Path = make([]*ics23.InnerOp, n)
+			for i := range p.Path {
+				if p.Path[i], err = d.innerOp(); err != nil {
+					return err
+				}
+			}
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	return p, err
+}
+
+func (d *cborDecoder) nonExistenceProof() (*ics23.NonExistenceProof, error) {
+	p := &ics23.NonExistenceProof{}
+	err := d.mapFields(func(key uint64) (err error) {
+		switch key {
+		case 1:
+			p.Key, err = d.bytes()
+		case 2:
+			p.Left, err = d.existenceProof()
+		case 3:
+			p.Right, err = d.existenceProof()
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	return p, err
+}
+
+func (d *cborDecoder) leafOp() (*ics23.LeafOp, error) {
+	op := &ics23.LeafOp{}
+	err := d.mapFields(func(key uint64) error {
+		if key == 5 {
+			prefix, err := d.bytes()
+			op.Prefix = prefix
+			return err
+		}
+		if key < 1 || key > 5 {
+			return unknownCBORField(key)
+		}
+		enum, err := d.enum()
+		switch key {
+		case 1:
+			op.Hash = ics23.HashOp(enum)
+		case 2:
+			op.PrehashKey = ics23.HashOp(enum)
+		case 3:
+			op.PrehashValue = ics23.HashOp(enum)
+		case 4:
+			op.Length = ics23.LengthOp(enum)
+		}
+		return err
+	})
+	return op, err
+}
+
+func (d *cborDecoder) innerOp() (*ics23.InnerOp, error) {
+	op := &ics23.InnerOp{}
+	err := d.mapFields(func(key uint64) (err error) {
+		switch key {
+		case 1:
+			var enum int32
+			enum, err = d.enum()
+			op.Hash = ics23.HashOp(enum)
+		case 2:
+			op.Prefix, err = d.bytes()
+		case 3:
+			op.Suffix, err = d.bytes()
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	return op, err
+}
@@ -0,0 +1,113 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProofCBOR_RoundTrip(t *testing.T) {
+	tree := setupMutableTree(false)
+	for i := 0; i < 200; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i += 17 {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		t.Run(string(key), func(t *testing.T) {
+			value, err := tree.Get(key)
+			require.NoError(t, err)
+
+			var proof *ics23.CommitmentProof
+			if value != nil {
+				proof, err = tree.GetMembershipProof(key)
+			} else {
+				proof, err = tree.GetNonMembershipProof(key)
+			}
+			require.NoError(t, err)
+
+			bz, err := MarshalProofCBOR(proof)
+			require.NoError(t, err)
+			decoded, err := UnmarshalProofCBOR(bz)
+			require.NoError(t, err)
+
+			// the decoded proof has the same protobuf encoding, and the same CBOR encoding.
+			expected, err := proof.Marshal()
+			require.NoError(t, err)
+			actual, err := decoded.Marshal()
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			reencoded, err := MarshalProofCBOR(decoded)
+			require.NoError(t, err)
+			require.Equal(t, bz, reencoded)
+
+			if value != nil {
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, decoded, key, value))
+			} else {
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, decoded, key))
+			}
+		})
+	}
+}
+
+func TestProofCBOR_Encoding(t *testing.T) {
+	proof := &ics23.CommitmentProof{
+		Proof: &ics23.CommitmentProof_Exist{Exist: &ics23.ExistenceProof{
+			Key:   []byte("k"),
+			Value: make([]byte, 300),
+			Leaf:  &ics23.LeafOp{Hash: ics23.HashOp_SHA256, Length: ics23.LengthOp_VAR_PROTO},
+			Path:  []*ics23.InnerOp{{Hash: ics23.HashOp_SHA256, Suffix: []byte{0xff}}},
+		}},
+	}
+	bz, err := MarshalProofCBOR(proof)
+	require.NoError(t, err)
+
+	expected := []byte{
+		0xa1, 0x01, // {1: exist
+		0xa4,            // {
+		0x01, 0x41, 'k', // 1: h'6b'
+		0x02, 0x59, 0x01, 0x2c, // 2: 300 bytes
+	}
+	expected = append(expected, make([]byte, 300)...)
+	expected = append(expected,
+		0x03, 0xa2, 0x01, 0x01, 0x04, 0x01, // 3: {1: 1, 4: 1}
+		0x04, 0x81, 0xa2, 0x01, 0x01, 0x03, 0x41, 0xff, // 4: [{1: 1, 3: h'ff'}]
+	)
+	require.Equal(t, expected, bz)
+}
+
+func TestProofCBOR_Invalid(t *testing.T) {
+	testCases := map[string][]byte{
+		"empty":               {},
+		"empty map":           {0xa0},
+		"truncated":           {0xa1, 0x01, 0xa1, 0x01, 0x45, 'k'},
+		"trailing bytes":      {0xa1, 0x01, 0xa0, 0x00},
+		"unknown proof":       {0xa1, 0x03, 0xa0},
+		"unknown field":       {0xa1, 0x01, 0xa1, 0x09, 0x00},
+		"unsorted keys":       {0xa1, 0x01, 0xa2, 0x02, 0x41, 'v', 0x01, 0x41, 'k'},
+		"duplicate keys":      {0xa1, 0x01, 0xa2, 0x01, 0x41, 'k', 0x01, 0x41, 'k'},
+		"non minimal head":    {0xa1, 0x01, 0xa1, 0x01, 0x58, 0x01, 'k'},
+		"indefinite length":   {0xa1, 0x01, 0xbf, 0xff},
+		"wrong type":          {0xa1, 0x01, 0xa1, 0x01, 0x01},
+		"enum out of range":   {0xa1, 0x01, 0xa1, 0x03, 0xa1, 0x01, 0x1a, 0xff, 0xff, 0xff, 0xff},
+		"huge array":          {0xa1, 0x01, 0xa1, 0x04, 0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"huge byte string":    {0xa1, 0x01, 0xa1, 0x01, 0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"two proofs in union": {0xa2, 0x01, 0xa0, 0x02, 0xa0},
+	}
+	for name, bz := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := UnmarshalProofCBOR(bz)
+			require.ErrorIs(t, err, ErrInvalidProofCBOR)
+		})
+	}
+
+	_, err := MarshalProofCBOR(&ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Batch{}})
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = MarshalProofCBOR(nil)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -0,0 +1,66 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RangeCoverVerifier verifies that a sequence of ranges of key/value pairs, e.g. the chunks of a
+// state snapshot, is the whole content of the tree with a given root hash, so that a server
+// can't omit or repeat any pair. Each range is proven by a SparseProof of its keys, as returned
+// by ImmutableTree.SparseRoot, and the ranges must be given in ascending key order.
+//
+// The proofs commit to the positions of the leaves of the keys, so each range must start at
+// the leaf following the last one of the previous range, the first range at the first leaf, and
+// Finish checks that the last range ends at the last leaf.
+type RangeCoverVerifier struct {
+	root []byte
+	next int64 // position of the leaf the next range must start at
+	size int64 // number of leaves of the tree, known once a range is verified
+	done bool
+}
+
+// NewRangeCoverVerifier returns a RangeCoverVerifier of the tree with the given root hash.
+func NewRangeCoverVerifier(root []byte) *RangeCoverVerifier {
+	return &RangeCoverVerifier{root: root}
+}
+
+// Verify verifies the next range of pairs, given in ascending key order with its proof. It
+// returns an error wrapping ErrInvalidProof if the proof doesn't prove the pairs against the
+// root hash, or if the range doesn't start right after the previous one or has a gap. A
+// rejected range leaves the verifier as it was, so that the range can be fetched again.
+func (v *RangeCoverVerifier) Verify(keys, values [][]byte, proof *SparseProof) error {
+	if v.done {
+		return fmt.Errorf("the cover is already finished: %w", ErrInvalidInputs)
+	}
+	positions, size, err := verifySparse(v.root, keys, values, proof)
+	if err != nil {
+		return err
+	}
+	for i, position := range positions {
+		switch expected := v.next + int64(i); {
+		case position < expected:
+			return fmt.Errorf("%w: key %X at leaf %d overlaps the previous ranges, which end before leaf %d",
+				ErrInvalidProof, keys[i], position, expected)
+		case position > expected:
+			return fmt.Errorf("%w: key %X at leaf %d leaves a gap after leaf %d", ErrInvalidProof, keys[i], position, expected-1)
+		}
+	}
+	v.next += int64(len(positions))
+	v.size = size
+	return nil
+}
+
+// Finish checks that the verified ranges reach the last leaf of the tree, or that the tree is
+// empty if no range was verified. It returns an error wrapping ErrInvalidProof otherwise.
+func (v *RangeCoverVerifier) Finish() error {
+	if v.next == 0 {
+		if !bytes.Equal(v.root, EmptyHash()) {
+			return fmt.Errorf("%w: no range of the non-empty tree %X was verified", ErrInvalidProof, v.root)
+		}
+	} else if v.next != v.size {
+		return fmt.Errorf("%w: the ranges end at leaf %d of %d", ErrInvalidProof, v.next-1, v.size)
+	}
+	v.done = true
+	return nil
+}
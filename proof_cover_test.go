@@ -0,0 +1,126 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// coverRange is a range of pairs of a tree, with its proof.
+type coverRange struct {
+	keys, values [][]byte
+	proof        *SparseProof
+}
+
+// proveRanges returns the ranges of the pairs of tree from the given leaf positions, each
+// ending before the next one, and the last one at the last leaf.
+func proveRanges(t *testing.T, tree *ImmutableTree, starts ...int) []coverRange {
+	t.Helper()
+	var keys, values [][]byte
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		keys, values = append(keys, key), append(values, value)
+		return false
+	})
+	require.NoError(t, err)
+	ranges := make([]coverRange, len(starts))
+	for i, start := range starts {
+		end := len(keys)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		ranges[i] = proveRange(t, tree, keys[start:end], values[start:end])
+	}
+	return ranges
+}
+
+func proveRange(t *testing.T, tree *ImmutableTree, keys, values [][]byte) coverRange {
+	t.Helper()
+	_, proof, err := tree.SparseRoot(keys)
+	require.NoError(t, err)
+	return coverRange{keys: keys, values: values, proof: proof}
+}
+
+func TestRangeCoverVerifier(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree := tree.ImmutableTree
+	root := itree.Hash()
+
+	// contiguous ranges covering the tree are accepted, whatever their sizes.
+	for _, starts := range [][]int{{0}, {0, 50, 100, 150}, {0, 1, 2, 199}} {
+		v := NewRangeCoverVerifier(root)
+		for _, r := range proveRanges(t, itree, starts...) {
+			require.NoError(t, v.Verify(r.keys, r.values, r.proof))
+		}
+		require.NoError(t, v.Finish())
+		require.ErrorIs(t, v.Verify(nil, nil, nil), ErrInvalidInputs)
+	}
+
+	ranges := proveRanges(t, itree, 0, 50, 100, 150)
+	for name, tc := range map[string]struct {
+		ranges []coverRange
+	}{
+		"missing range": {ranges: []coverRange{ranges[0], ranges[2], ranges[3]}},
+		"missing first": {ranges: ranges[1:]},
+		"overlap":       {ranges: []coverRange{ranges[0], ranges[1], ranges[1]}},
+		"overlap within": {ranges: []coverRange{ranges[0], proveRange(t, itree,
+			append(ranges[0].keys[40:50:50], ranges[1].keys...), append(ranges[0].values[40:50:50], ranges[1].values...))}},
+		"gap within": {ranges: []coverRange{ranges[0], proveRange(t, itree,
+			append(ranges[1].keys[:10:10], ranges[1].keys[11:]...), append(ranges[1].values[:10:10], ranges[1].values[11:]...))}},
+		"unsorted": {ranges: []coverRange{proveRange(t, itree,
+			[][]byte{ranges[0].keys[1], ranges[0].keys[0]}, [][]byte{ranges[0].values[1], ranges[0].values[0]})}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			v := NewRangeCoverVerifier(root)
+			var err error
+			for _, r := range tc.ranges {
+				if err = v.Verify(r.keys, r.values, r.proof); err != nil {
+					break
+				}
+			}
+			require.ErrorIs(t, err, ErrInvalidProof)
+		})
+	}
+
+	// a rejected range leaves the verifier as it was.
+	v := NewRangeCoverVerifier(root)
+	require.NoError(t, v.Verify(ranges[0].keys, ranges[0].values, ranges[0].proof))
+	require.ErrorIs(t, v.Verify(ranges[2].keys, ranges[2].values, ranges[2].proof), ErrInvalidProof)
+	tampered := append([][]byte{}, ranges[1].values...)
+	tampered[3] = []byte("tampered")
+	require.ErrorIs(t, v.Verify(ranges[1].keys, tampered, ranges[1].proof), ErrInvalidProof)
+	for _, r := range ranges[1:3] {
+		require.NoError(t, v.Verify(r.keys, r.values, r.proof))
+	}
+	// the cover must reach the last leaf.
+	require.ErrorIs(t, v.Finish(), ErrInvalidProof)
+	require.NoError(t, v.Verify(ranges[3].keys, ranges[3].values, ranges[3].proof))
+	require.NoError(t, v.Finish())
+
+	// the ranges of another tree don't verify.
+	require.ErrorIs(t, NewRangeCoverVerifier([]byte("other")).Verify(ranges[0].keys, ranges[0].values, ranges[0].proof), ErrInvalidProof)
+}
+
+func TestRangeCoverVerifier_EmptyTree(t *testing.T) {
+	require.NoError(t, NewRangeCoverVerifier(EmptyHash()).Finish())
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	require.ErrorIs(t, NewRangeCoverVerifier(tree.WorkingHash()).Finish(), ErrInvalidProof)
+
+	// a single leaf is covered by its own range.
+	v := NewRangeCoverVerifier(tree.WorkingHash())
+	r := proveRange(t, tree.ImmutableTree, [][]byte{[]byte("key")}, [][]byte{[]byte("value")})
+	require.NoError(t, v.Verify(r.keys, r.values, r.proof))
+	require.NoError(t, v.Finish())
+}
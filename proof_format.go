@@ -0,0 +1,474 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ProofFormat selects the layout of the proofs returned by GetProofWithFormat.
+type ProofFormat uint8
+
+const (
+	// ProofFormatICS23 is the protobuf encoding of the ics23 CommitmentProof returned by
+	// GetProof. It is the default format.
+	ProofFormatICS23 ProofFormat = iota
+	// ProofFormatLegacy is the layout of the proofs of the releases before ics23, i.e. the
+	// Data of the LegacyProofOp returned by GetLegacyProof, as verified by the old light
+	// clients.
+	ProofFormatLegacy
+)
+
+// String implements fmt.Stringer.
+func (f ProofFormat) String() string {
+	switch f {
+	case ProofFormatICS23:
+		return "ics23"
+	case ProofFormatLegacy:
+		return "legacy"
+	default:
+		return fmt.Sprintf("ProofFormat(%d)", uint8(f))
+	}
+}
+
+// GetProofWithFormat returns the encoding of the proof for the given key in the given format,
+// e.g. to serve the legacy clients during a migration to ics23.
+func (t *ImmutableTree) GetProofWithFormat(key []byte, format ProofFormat) ([]byte, error) {
+	switch format {
+	case ProofFormatICS23:
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, err
+		}
+		return proof.Marshal()
+	case ProofFormatLegacy:
+		op, err := t.GetLegacyProof(key)
+		if err != nil {
+			return nil, err
+		}
+		return op.Data, nil
+	default:
+		return nil, fmt.Errorf("unknown proof format %v: %w", format, ErrInvalidInputs)
+	}
+}
+
+// The types of the legacy proofs of the existence and the absence of a key.
+const (
+	ProofOpIAVLValue   = "iavl:v"
+	ProofOpIAVLAbsence = "iavl:a"
+)
+
+// LegacyProofOp is a proof of the releases before ics23, i.e. the ProofOp of the ValueOp or
+// the AbsenceOp of the RangeProof of a key, byte-identical to the ones of those releases.
+type LegacyProofOp struct {
+	// Type is ProofOpIAVLValue if the key exists, and ProofOpIAVLAbsence otherwise.
+	Type string
+	Key  []byte
+	// Data is the length-prefixed protobuf encoding of the ValueOp or the AbsenceOp.
+	Data []byte
+}
+
+// GetLegacyProof returns the legacy proof of the existence or the absence of key, as
+// GetWithProof returned it before ics23, to verify with VerifyLegacyProof. The proof of an
+// absent key holds the leaf before it and, unless the increment of that leaf key isn't before
+// the one of key, the leaf after it: as with those releases, an absence proof without the leaf
+// after the key doesn't verify unless the key is past the last leaf. It fails with the
+// Comparator option, which the legacy proofs don't support, and for the hash schemes other than
+// HashSHA256.
+func (t *ImmutableTree) GetLegacyProof(key []byte) (*LegacyProofOp, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if t.ndb.opts.Comparator != nil {
+		return nil, fmt.Errorf("legacy proofs aren't supported with a custom comparator: %w", ErrInvalidInputs)
+	}
+	if err := t.ndb.requireSHA256(); err != nil {
+		return nil, err
+	}
+	// computes the hashes of the unsaved nodes, if any.
+	t.Hash()
+	if t.root == nil {
+		return nil, fmt.Errorf("cannot generate the proof with nil root")
+	}
+
+	// the path leads to the leaf of key, or to the one before it, or to the first leaf if key
+	// is before it.
+	path, left, err := t.root.PathToLeaf(t, key, t.version+1)
+	if err != nil && left == nil {
+		return nil, err
+	}
+	exists := err == nil
+	leaf, err := t.legacyLeaf(left)
+	if err != nil {
+		return nil, err
+	}
+	proof := &legacyRangeProof{Leaves: []*legacyProofLeafNode{leaf}}
+	for _, pin := range path {
+		proof.LeftPath = append(proof.LeftPath, newLegacyProofInnerNode(pin))
+	}
+	if !exists && bytes.Compare(left.key, key) < 0 && bytes.Compare(legacyIncr(left.key), legacyIncr(key)) < 0 {
+		// the absence is also proven by the next leaf, if any. The legacy releases proved the
+		// range from key to its increment and left the next leaf out, and the absence unproven,
+		// when the increment of the left key isn't before the one of key.
+		inners, next, err := t.legacyPathToNext(left.key)
+		if err != nil {
+			return nil, err
+		}
+		if next != nil {
+			if leaf, err = t.legacyLeaf(next); err != nil {
+				return nil, err
+			}
+			proof.InnerNodes = []*legacyPathToLeaf{{Inners: inners}}
+			proof.Leaves = append(proof.Leaves, leaf)
+		}
+	}
+
+	op := &LegacyProofOp{Type: ProofOpIAVLValue, Key: key}
+	var msg proto.Message = &legacyValueOp{Proof: proof}
+	if !exists {
+		op.Type, msg = ProofOpIAVLAbsence, &legacyAbsenceOp{Proof: proof}
+	}
+	bz, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	// the encoding is length-prefixed, as the one of amino was.
+	if err := encoding.EncodeBytes(&buf, bz); err != nil {
+		return nil, err
+	}
+	op.Data = buf.Bytes()
+	return op, nil
+}
+
+// legacyLeaf returns the legacy proof leaf of a leaf node.
+func (t *ImmutableTree) legacyLeaf(node *Node) (*legacyProofLeafNode, error) {
+	value, err := t.ndb.leafValue(node)
+	if err != nil {
+		return nil, err
+	}
+	valueHash := sha256.Sum256(value)
+	version := t.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	return &legacyProofLeafNode{Key: node.key, ValueHash: valueHash[:], Version: version}, nil
+}
+
+// legacyIncr returns the increment of key, as the legacy releases computed it: its last byte
+// below 0xFF is incremented and the ones after it are zeroed, and 0x00 is appended to a key of
+// 0xFF bytes.
+func legacyIncr(key []byte) []byte {
+	incr := make([]byte, len(key))
+	copy(incr, key)
+	for i := len(incr) - 1; i >= 0; i-- {
+		if incr[i] < 0xFF {
+			incr[i]++
+			return incr
+		}
+		incr[i] = 0x00
+	}
+	return append(key[:len(key):len(key)], 0x00)
+}
+
+// legacyPathToNext returns the leaf following the one of key, nil if it is the last one, and
+// the inner nodes leading to it from the deepest node whose left subtree holds key, which
+// aren't in the path to key: its right child and the left children below it, with the hashes
+// of their right children. The legacy releases looked up the first leaf from the increment of
+// the left key instead, which skipped the keys between an absent key ending with 0xFF bytes and
+// that increment: the proofs of those keys differ.
+func (t *ImmutableTree) legacyPathToNext(key []byte) ([]*legacyProofInnerNode, *Node, error) {
+	var fork *Node
+	for node := t.root; !node.isLeaf(); {
+		var err error
+		if bytes.Compare(key, node.key) < 0 {
+			fork = node
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if fork == nil {
+		return nil, nil, nil
+	}
+	node, err := fork.getRightNode(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	inners := []*legacyProofInnerNode{}
+	for !node.isLeaf() {
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		version := t.version + 1
+		if node.nodeKey != nil {
+			version = node.nodeKey.version
+		}
+		inners = append(inners, &legacyProofInnerNode{
+			Height: int32(node.subtreeHeight), Size: node.size, Version: version, Right: rightNode.hash,
+		})
+		if node, err = node.getLeftNode(t); err != nil {
+			return nil, nil, err
+		}
+	}
+	return inners, node, nil
+}
+
+// VerifyLegacyProof verifies the legacy proof returned by GetLegacyProof against the root hash
+// of a tree, as the releases before ics23 did: that key has the given value for a proof of
+// type ProofOpIAVLValue, and that it is absent for a proof of type ProofOpIAVLAbsence, whose
+// value must be nil. It returns an error wrapping ErrInvalidProof if the proof doesn't verify.
+func VerifyLegacyProof(op *LegacyProofOp, root, value []byte) error {
+	if op == nil {
+		return fmt.Errorf("nil proof: %w", ErrInvalidInputs)
+	}
+	bz, n, err := encoding.DecodeBytes(op.Data)
+	if err != nil {
+		return fmt.Errorf("decoding proof: %w: %w", ErrInvalidProof, err)
+	}
+	if n != len(op.Data) {
+		return fmt.Errorf("%d trailing bytes after the proof: %w", len(op.Data)-n, ErrInvalidProof)
+	}
+	var proof *legacyRangeProof
+	switch op.Type {
+	case ProofOpIAVLValue:
+		msg := &legacyValueOp{}
+		if err := proto.Unmarshal(bz, msg); err != nil {
+			return fmt.Errorf("decoding proof: %w: %w", ErrInvalidProof, err)
+		}
+		proof = msg.Proof
+	case ProofOpIAVLAbsence:
+		msg := &legacyAbsenceOp{}
+		if err := proto.Unmarshal(bz, msg); err != nil {
+			return fmt.Errorf("decoding proof: %w: %w", ErrInvalidProof, err)
+		}
+		proof = msg.Proof
+	default:
+		return fmt.Errorf("unknown proof type %q: %w", op.Type, ErrInvalidInputs)
+	}
+	if proof == nil {
+		return fmt.Errorf("proof of an empty tree: %w", ErrInvalidProof)
+	}
+
+	computed, treeEnd, err := proof.computeRootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return fmt.Errorf("proof doesn't lead to root %X: %w", root, ErrInvalidProof)
+	}
+	if op.Type == ProofOpIAVLValue {
+		return proof.verifyItem(op.Key, value)
+	}
+	if value != nil {
+		return fmt.Errorf("value of an absent key: %w", ErrInvalidInputs)
+	}
+	return proof.verifyAbsence(op.Key, treeEnd)
+}
+
+// computeRootHash computes the root hash of the legacy range proof, as the releases before
+// ics23 did, and whether its last leaf is the last one of the tree.
+func (p *legacyRangeProof) computeRootHash() (root []byte, treeEnd bool, err error) {
+	if len(p.Leaves) == 0 {
+		return nil, false, fmt.Errorf("no leaves: %w", ErrInvalidProof)
+	}
+	if len(p.InnerNodes)+1 != len(p.Leaves) {
+		return nil, false, fmt.Errorf("%d inner paths for %d leaves: %w", len(p.InnerNodes), len(p.Leaves), ErrInvalidProof)
+	}
+	leaves, inners := p.Leaves, p.InnerNodes
+
+	// computes the hash of path with the next leaf, verifying the inner paths of the following
+	// leaves against the right hashes of path, from the leaf up. rightmost tells whether path
+	// starts at the right edge of the tree.
+	var compute func(path legacyPath, rightmost bool) (hash []byte, treeEnd, done bool, err error)
+	compute = func(path legacyPath, rightmost bool) ([]byte, bool, bool, error) {
+		leaf := leaves[0]
+		leaves = leaves[1:]
+		hash, err := ProofLeafNode{Key: leaf.Key, ValueHash: leaf.ValueHash, Version: leaf.Version}.Hash()
+		if err != nil {
+			return nil, false, false, err
+		}
+		if hash, err = path.computeRootHash(hash); err != nil {
+			return nil, false, false, err
+		}
+		if len(leaves) == 0 {
+			return hash, rightmost && path.isRightmost(), true, nil
+		}
+
+		for len(path) > 0 {
+			last := path[len(path)-1]
+			path = path[:len(path)-1]
+			if len(last.Right) == 0 {
+				continue
+			}
+			if len(inners) == 0 {
+				return nil, false, false, fmt.Errorf("missing inner path: %w", ErrInvalidProof)
+			}
+			next := inners[0]
+			inners = inners[1:]
+			derived, treeEnd, done, err := compute(next.Inners, rightmost && path.isRightmost())
+			if err != nil {
+				return nil, treeEnd, false, err
+			}
+			if !bytes.Equal(derived, last.Right) {
+				return nil, treeEnd, false, fmt.Errorf("intermediate hash %X doesn't match %X: %w", derived, last.Right, ErrInvalidProof)
+			}
+			if done {
+				return hash, treeEnd, true, nil
+			}
+		}
+		return hash, false, false, nil
+	}
+
+	root, treeEnd, done, err := compute(p.LeftPath, true)
+	if err != nil {
+		return nil, treeEnd, err
+	}
+	if !done {
+		return nil, treeEnd, fmt.Errorf("leaves left over: %w", ErrInvalidProof)
+	}
+	return root, treeEnd, nil
+}
+
+// verifyItem checks that key has the given value in the verified proof.
+func (p *legacyRangeProof) verifyItem(key, value []byte) error {
+	i := sort.Search(len(p.Leaves), func(i int) bool {
+		return bytes.Compare(key, p.Leaves[i].Key) <= 0
+	})
+	if i >= len(p.Leaves) || !bytes.Equal(p.Leaves[i].Key, key) {
+		return fmt.Errorf("leaf of key %X not in the proof: %w", key, ErrInvalidProof)
+	}
+	valueHash := sha256.Sum256(value)
+	if !bytes.Equal(p.Leaves[i].ValueHash, valueHash[:]) {
+		return fmt.Errorf("value hash of key %X doesn't match: %w", key, ErrInvalidProof)
+	}
+	return nil
+}
+
+// verifyAbsence checks that key is absent from the verified proof, whose last leaf is the last
+// one of the tree if treeEnd is true.
+func (p *legacyRangeProof) verifyAbsence(key []byte, treeEnd bool) error {
+	if cmp := bytes.Compare(key, p.Leaves[0].Key); cmp < 0 {
+		if legacyPath(p.LeftPath).isLeftmost() {
+			return nil
+		}
+		return fmt.Errorf("absence of key %X not proven by the left path: %w", key, ErrInvalidProof)
+	} else if cmp == 0 {
+		return fmt.Errorf("absence of key %X disproven by the first leaf: %w", key, ErrInvalidProof)
+	}
+	if len(p.LeftPath) == 0 || legacyPath(p.LeftPath).isRightmost() {
+		return nil
+	}
+	for _, leaf := range p.Leaves[1:] {
+		switch cmp := bytes.Compare(key, leaf.Key); {
+		case cmp < 0:
+			return nil
+		case cmp == 0:
+			return fmt.Errorf("absence of key %X disproven by a leaf: %w", key, ErrInvalidProof)
+		}
+	}
+	if treeEnd {
+		return nil
+	}
+	return fmt.Errorf("absence of key %X not proven by the right leaf: %w", key, ErrInvalidProof)
+}
+
+// legacyPath is the path of the inner nodes from the root of a legacy range proof.
+type legacyPath []*legacyProofInnerNode
+
+// computeRootHash returns the hash of the root of the path leading to the given hash.
+func (path legacyPath) computeRootHash(hash []byte) ([]byte, error) {
+	for i := len(path) - 1; i >= 0; i-- {
+		pin := path[i]
+		var err error
+		hash, err = ProofInnerNode{
+			Height: int8(pin.Height), Size: pin.Size, Version: pin.Version, Left: pin.Left, Right: pin.Right,
+		}.Hash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+		}
+	}
+	return hash, nil
+}
+
+// isLeftmost returns whether the path only goes down to the left children.
+func (path legacyPath) isLeftmost() bool {
+	for _, pin := range path {
+		if len(pin.Left) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isRightmost returns whether the path only goes down to the right children.
+func (path legacyPath) isRightmost() bool {
+	for _, pin := range path {
+		if len(pin.Right) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The protobuf messages of the legacy proofs, as defined by the releases before ics23.
+
+type legacyValueOp struct {
+	Proof *legacyRangeProof `protobuf:"bytes,1,opt,name=proof,proto3" json:"proof,omitempty"`
+}
+
+type legacyAbsenceOp struct {
+	Proof *legacyRangeProof `protobuf:"bytes,1,opt,name=proof,proto3" json:"proof,omitempty"`
+}
+
+type legacyRangeProof struct {
+	LeftPath   []*legacyProofInnerNode `protobuf:"bytes,1,rep,name=left_path,json=leftPath,proto3" json:"left_path,omitempty"`
+	InnerNodes []*legacyPathToLeaf     `protobuf:"bytes,2,rep,name=inner_nodes,json=innerNodes,proto3" json:"inner_nodes,omitempty"`
+	Leaves     []*legacyProofLeafNode  `protobuf:"bytes,3,rep,name=leaves,proto3" json:"leaves,omitempty"`
+}
+
+type legacyPathToLeaf struct {
+	Inners []*legacyProofInnerNode `protobuf:"bytes,1,rep,name=inners,proto3" json:"inners,omitempty"`
+}
+
+type legacyProofInnerNode struct {
+	Height  int32  `protobuf:"zigzag32,1,opt,name=height,proto3" json:"height,omitempty"`
+	Size    int64  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Version int64  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Left    []byte `protobuf:"bytes,4,opt,name=left,proto3" json:"left,omitempty"`
+	Right   []byte `protobuf:"bytes,5,opt,name=right,proto3" json:"right,omitempty"`
+}
+
+type legacyProofLeafNode struct {
+	Key       []byte `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	ValueHash []byte `protobuf:"bytes,2,opt,name=value_hash,json=valueHash,proto3" json:"value_hash,omitempty"`
+	Version   int64  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+// newLegacyProofInnerNode returns the legacy proof inner node of pin.
+func newLegacyProofInnerNode(pin ProofInnerNode) *legacyProofInnerNode {
+	return &legacyProofInnerNode{
+		Height: int32(pin.Height), Size: pin.Size, Version: pin.Version, Left: pin.Left, Right: pin.Right,
+	}
+}
+
+func (m *legacyValueOp) Reset()           { *m = legacyValueOp{} }
+func (m *legacyValueOp) String() string   { return proto.CompactTextString(m) }
+func (*legacyValueOp) ProtoMessage()      {}
+func (m *legacyAbsenceOp) Reset()         { *m = legacyAbsenceOp{} }
+func (m *legacyAbsenceOp) String() string { return proto.CompactTextString(m) }
+func (*legacyAbsenceOp) ProtoMessage()    {}
+
+var (
+	_ proto.Message = (*legacyValueOp)(nil)
+	_ proto.Message = (*legacyAbsenceOp)(nil)
+)
@@ -0,0 +1,141 @@
+package iavl
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cosmossdk.io/log"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+const legacyProofsGolden = "legacy_proofs.golden"
+
+// setupProofFormatTree builds a small deterministic tree over a few versions.
+func setupProofFormatTree(t *testing.T) *ImmutableTree {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := v; i < 16; i += 2 {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d-%d", i, v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	return itree
+}
+
+// readLegacyProofs reads the root hash and the legacy proofs of the golden file, which were
+// captured with a release before ics23.
+func readLegacyProofs(t *testing.T) ([]byte, []*LegacyProofOp) {
+	f, err := os.Open(filepath.Join("testdata", legacyProofsGolden))
+	require.NoError(t, err)
+	defer f.Close()
+	var (
+		root   []byte
+		proofs []*LegacyProofOp
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "#"):
+		case fields[0] == "root":
+			root, err = hex.DecodeString(fields[1])
+			require.NoError(t, err)
+		default:
+			data, err := hex.DecodeString(fields[2])
+			require.NoError(t, err)
+			proofs = append(proofs, &LegacyProofOp{Type: fields[1], Key: []byte(fields[0]), Data: data})
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return root, proofs
+}
+
+func TestProofFormat_LegacyGolden(t *testing.T) {
+	tree := setupProofFormatTree(t)
+	root, proofs := readLegacyProofs(t)
+	require.Equal(t, root, tree.Hash())
+	require.Len(t, proofs, 7)
+
+	for _, expected := range proofs {
+		// the historical proofs verify against the tree, but for the absence of key07a, whose
+		// proof lacks the leaf after it with the historical releases too.
+		value, err := tree.Get(expected.Key)
+		require.NoError(t, err)
+		if string(expected.Key) == "key07a" {
+			require.ErrorIs(t, VerifyLegacyProof(expected, root, value), ErrInvalidProof)
+		} else {
+			require.NoError(t, VerifyLegacyProof(expected, root, value), "key %s", expected.Key)
+		}
+		require.Equal(t, value == nil, expected.Type == ProofOpIAVLAbsence)
+
+		// and the tree reproduces them byte for byte.
+		proof, err := tree.GetLegacyProof(expected.Key)
+		require.NoError(t, err)
+		require.Equal(t, expected, proof, "key %s", expected.Key)
+		bz, err := tree.GetProofWithFormat(expected.Key, ProofFormatLegacy)
+		require.NoError(t, err)
+		require.Equal(t, expected.Data, bz)
+	}
+}
+
+func TestProofFormat_LegacyVerify(t *testing.T) {
+	tree := setupProofFormatTree(t)
+	root := tree.Hash()
+
+	proof, err := tree.GetLegacyProof([]byte("key05"))
+	require.NoError(t, err)
+	require.NoError(t, VerifyLegacyProof(proof, root, []byte("value05-1")))
+	require.ErrorIs(t, VerifyLegacyProof(proof, root, []byte("value05-0")), ErrInvalidProof)
+	require.ErrorIs(t, VerifyLegacyProof(proof, tree.root.key, []byte("value05-1")), ErrInvalidProof)
+	require.ErrorIs(t, VerifyLegacyProof(&LegacyProofOp{Type: ProofOpIAVLValue, Key: []byte("key07"), Data: proof.Data}, root, []byte("value07-1")), ErrInvalidProof)
+
+	absence, err := tree.GetLegacyProof([]byte("key0:a"))
+	require.NoError(t, err)
+	require.NoError(t, VerifyLegacyProof(absence, root, nil))
+	// the absence proof of a key doesn't prove the absence of its neighbors.
+	for _, key := range []string{"key09", "key10", "key10a"} {
+		require.ErrorIs(t, VerifyLegacyProof(&LegacyProofOp{Type: ProofOpIAVLAbsence, Key: []byte(key), Data: absence.Data}, root, nil), ErrInvalidProof, key)
+	}
+
+	corrupted := &LegacyProofOp{Type: proof.Type, Key: proof.Key, Data: append([]byte{}, proof.Data...)}
+	corrupted.Data[len(corrupted.Data)/2] ^= 0xff
+	require.Error(t, VerifyLegacyProof(corrupted, root, []byte("value05-1")))
+}
+
+func TestProofFormat_ICS23(t *testing.T) {
+	tree := setupProofFormatTree(t)
+	root := tree.Hash()
+
+	for _, key := range []string{"key00", "key08", "key15", "key07a", "a", "z"} {
+		bz, err := tree.GetProofWithFormat([]byte(key), ProofFormatICS23)
+		require.NoError(t, err)
+		expected, err := tree.GetProof([]byte(key))
+		require.NoError(t, err)
+		proof := &ics23.CommitmentProof{}
+		require.NoError(t, proof.Unmarshal(bz))
+		require.Equal(t, expected, proof)
+
+		if proof.GetExist() != nil {
+			value, err := tree.Get([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, []byte(key), value))
+		} else {
+			require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, []byte(key)))
+		}
+	}
+
+	_, err := tree.GetProofWithFormat([]byte("key00"), ProofFormat(7))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 
@@ -12,6 +13,9 @@ GetMembershipProof will produce a CommitmentProof that the given key (and querie
 If the key doesn't exist in the tree, this will return an error.
 */
 func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
 	exist, err := t.createExistenceProof(key)
 	if err != nil {
 		return nil, err
@@ -26,27 +30,36 @@ func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof,
 
 // VerifyMembership returns true iff proof is an ExistenceProof for the given key.
 func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
-	val, err := t.Get(key)
+	// the tombstone of a key deleted with soft deletes is proven as well.
+	val, err := t.getStored(key)
 	if err != nil {
 		return false, err
 	}
 	root := t.Hash()
+	spec, err := t.ndb.hashScheme().ProofSpec()
+	if err != nil {
+		return false, err
+	}
 
-	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
+	return ics23.VerifyMembership(spec, root, proof, key, val), nil
 }
 
 /*
 GetNonMembershipProof will produce a CommitmentProof that the given key doesn't exist in the iavl tree.
-If the key exists in the tree, this will return an error.
+If the key exists in the tree, this will return an error. The tombstone of a key deleted with the
+SoftDeleteRetention option is in the tree, and is proven with a membership proof instead.
 */
 func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
 	// idx is one node right of what we want....
 	var err error
-	idx, val, err := t.GetWithIndex(key)
+	idx, val, err := t.getWithIndexStored(key)
 	if err != nil {
 		return nil, err
 	}
 
+	if _, ok := DecodeTombstone(val); ok && t.ndb.softDeletes() {
+		return nil, fmt.Errorf("cannot create NonExistanceProof when Key is soft-deleted, its tombstone is in State")
+	}
 	if val != nil {
 		return nil, fmt.Errorf("cannot create NonExistanceProof when Key in State")
 	}
@@ -91,28 +104,59 @@ func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProo
 // VerifyNonMembership returns true iff proof is a NonExistenceProof for the given key.
 func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
 	root := t.Hash()
+	spec, err := t.ndb.hashScheme().ProofSpec()
+	if err != nil {
+		return false, err
+	}
+	if t.ndb.opts.Comparator != nil {
+		nonexist := ics23.Decompress(proof).GetNonexist()
+		if nonexist == nil || !bytes.Equal(nonexist.Key, key) {
+			return false, nil
+		}
+		return verifyNonExistence(spec, t.ndb.opts.Comparator, root, nonexist) == nil, nil
+	}
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return ics23.VerifyNonMembership(spec, root, proof, key), nil
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
-// existence proof, if that's what it is.
+// existence proof, if that's what it is. The key and value of the proof are copies, unless the
+// UnsafeNoCopy option is set.
 func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
+	proof, err := t.createSharedExistenceProof(key)
+	if proof != nil {
+		proof.Key, proof.Value = t.ndb.copyBytes(proof.Key), t.ndb.copyBytes(proof.Value)
+	}
+	return proof, err
+}
+
+// createSharedExistenceProof is like createExistenceProof, but the key and value of the proof
+// point to the data stored within IAVL. It returns an error wrapping ErrHashSchemeUnsupported if
+// ics23 can't express the HashScheme of the tree.
+func (t *ImmutableTree) createSharedExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
+	hashOp, err := t.ndb.hashScheme().hashOp()
+	if err != nil {
+		return nil, err
+	}
 	t.Hash()
 	path, node, err := t.root.PathToLeaf(t, key, t.version+1)
 	nodeVersion := t.version + 1
 	if node.nodeKey != nil {
 		nodeVersion = node.nodeKey.version
 	}
+	value, valueErr := t.ndb.leafValue(node)
+	if err == nil {
+		err = valueErr
+	}
 	return &ics23.ExistenceProof{
 		Key:   node.key,
-		Value: node.value,
-		Leaf:  convertLeafOp(nodeVersion),
-		Path:  convertInnerOps(path),
+		Value: value,
+		Leaf:  convertLeafOp(nodeVersion, hashOp),
+		Path:  convertInnerOps(path, hashOp),
 	}, err
 }
 
-func convertLeafOp(version int64) *ics23.LeafOp {
+func convertLeafOp(version int64, hashOp ics23.HashOp) *ics23.LeafOp {
 	var varintBuf [binary.MaxVarintLen64]byte
 	// this is adapted from iavl/proof.go:proofLeafNode.Hash()
 	prefix := convertVarIntToBytes(0, varintBuf)
@@ -120,18 +164,18 @@ func convertLeafOp(version int64) *ics23.LeafOp {
 	prefix = append(prefix, convertVarIntToBytes(version, varintBuf)...)
 
 	return &ics23.LeafOp{
-		Hash:         ics23.HashOp_SHA256,
-		PrehashValue: ics23.HashOp_SHA256,
+		Hash:         hashOp,
+		PrehashValue: hashOp,
 		Length:       ics23.LengthOp_VAR_PROTO,
 		Prefix:       prefix,
 	}
 }
 
 // we cannot get the proofInnerNode type, so we need to do the whole path in one function
-func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
+func convertInnerOps(path PathToLeaf, hashOp ics23.HashOp) []*ics23.InnerOp {
 	steps := make([]*ics23.InnerOp, 0, len(path))
 
-	// lengthByte is the length prefix prepended to each of the sha256 sub-hashes
+	// lengthByte is the length prefix prepended to each of the 32-byte sub-hashes
 	var lengthByte byte = 0x20
 
 	var varintBuf [binary.MaxVarintLen64]byte
@@ -160,7 +204,7 @@ func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
 		}
 
 		op := &ics23.InnerOp{
-			Hash:   ics23.HashOp_SHA256,
+			Hash:   hashOp,
 			Prefix: prefix,
 			Suffix: suffix,
 		}
@@ -174,8 +218,13 @@ func convertVarIntToBytes(orig int64, buf [binary.MaxVarintLen64]byte) []byte {
 	return buf[:n]
 }
 
-// GetProof gets the proof for the given key.
+// GetProof gets the proof for the given key. A key deleted with the SoftDeleteRetention option
+// gets the membership proof of its tombstone, whose value is told apart with DecodeTombstone,
+// as VerifyProof expects.
 func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
 	if t.root == nil {
 		return nil, fmt.Errorf("cannot generate the proof with nil root")
 	}
@@ -184,6 +233,13 @@ func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !exist && t.ndb.softDeletes() {
+		_, value, err := t.root.get(t, key)
+		if err != nil {
+			return nil, err
+		}
+		exist = value != nil
+	}
 
 	if exist {
 		return t.GetMembershipProof(key)
@@ -210,3 +266,22 @@ func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.Co
 	}
 	return nil, ErrVersionDoesNotExist
 }
+
+// GetMembershipProofForVersion gets the proof for the given key at the specified version, as
+// GetVersionedProof does, i.e. a membership proof if the key exists and a non-membership proof
+// otherwise. The root hash of the version is first checked to be expectedRoot, so that no proof
+// is produced for an unexpected root, e.g. on corruption, an error wrapping ErrRootMismatch
+// being returned instead.
+func (tree *MutableTree) GetMembershipProofForVersion(key []byte, version int64, expectedRoot []byte) (*ics23.CommitmentProof, error) {
+	if !tree.VersionExists(version) {
+		return nil, ErrVersionDoesNotExist
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	if root := t.Hash(); !bytes.Equal(root, expectedRoot) {
+		return nil, fmt.Errorf("%w: version %d has root %X, expected %X", ErrRootMismatch, version, root, expectedRoot)
+	}
+	return t.GetProof(key)
+}
@@ -251,7 +251,7 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 
 	for i := 0; i < b.N; i++ {
 		for _, version := range versions {
-			sink = convertLeafOp(version)
+			sink = convertLeafOp(version, ics23.HashOp_SHA256)
 		}
 	}
 	if sink == nil {
@@ -259,3 +259,48 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestGetMembershipProofForVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	_, err := tree.Set([]byte("k1"), []byte("v1"))
+	require.NoError(t, err)
+	root1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k2"), []byte("v2"))
+	require.NoError(t, err)
+	root2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		key     []byte
+		version int64
+		root    []byte
+		exists  bool
+		err     error
+	}{
+		"membership":                 {key: []byte("k1"), version: 1, root: root1, exists: true},
+		"non-membership":             {key: []byte("k2"), version: 1, root: root1},
+		"membership, wrong root":     {key: []byte("k1"), version: 1, root: root2, err: ErrRootMismatch},
+		"non-membership, wrong root": {key: []byte("k2"), version: 1, root: root2, err: ErrRootMismatch},
+		"nil root":                   {key: []byte("k2"), version: 2, err: ErrRootMismatch},
+		"missing version":            {key: []byte("k1"), version: 3, root: root2, err: ErrVersionDoesNotExist},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			proof, err := tree.GetMembershipProofForVersion(tc.key, tc.version, tc.root)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				require.Nil(t, proof)
+				return
+			}
+			require.NoError(t, err)
+			if tc.exists {
+				value, err := tree.GetVersioned(tc.key, tc.version)
+				require.NoError(t, err)
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tc.root, proof, tc.key, value))
+			} else {
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, tc.root, proof, tc.key))
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// errKeyRangeProofComparator is returned for the key range proofs of a tree with the Comparator
+// option, whose keys are verified as ordered lexicographically.
+var errKeyRangeProofComparator = errors.New("key range proofs are not supported with a custom comparator")
+
+// KeyRangeProof proves that Keys are exactly the keys in [Start, End) of a version of a tree,
+// with their Values, i.e. an authenticated range query. It bundles the existence proofs of the
+// keys with those of the neighbours of the range, the greatest key before Start and the first
+// key from End, which prove that no key is missing before the first key and after the last one
+// as a NonExistenceProof does, each proof being the left neighbour of the next one.
+//
+// A page of a paginated range read has its End set to the first key after the page, so the next
+// page starts from there, see ImmutableTree.GetKeyRangeProof.
+type KeyRangeProof struct {
+	// Start and End are the bounds of the proven range, nil bounds being open.
+	Start []byte `json:"start,omitempty"`
+	End   []byte `json:"end,omitempty"`
+	// Keys and Values are the key/value pairs in the range, in ascending key order. The
+	// tombstones of the keys deleted with the SoftDeleteRetention option are proven as values.
+	Keys   [][]byte `json:"keys"`
+	Values [][]byte `json:"values"`
+	// Proofs are the existence proofs of Keys.
+	Proofs []*ics23.ExistenceProof `json:"proofs"`
+	// Left is the existence proof of the greatest key before Start, nil if there is none.
+	Left *ics23.ExistenceProof `json:"left,omitempty"`
+	// Right is the existence proof of the first key from End, nil if there is none.
+	Right *ics23.ExistenceProof `json:"right,omitempty"`
+}
+
+// GetKeyRangeProof returns a KeyRangeProof of the key/value pairs in [start, end), nil bounds
+// being open. If limit is positive and the range has more keys, the proof covers the first limit
+// ones only, and its End is the first key after them, from which the next page starts. It
+// returns an error wrapping ErrHashSchemeUnsupported if ics23 can't express the HashScheme of
+// the tree.
+func (t *ImmutableTree) GetKeyRangeProof(start, end []byte, limit int) (*KeyRangeProof, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("range start %X after end %X: %w", start, end, ErrInvalidInputs)
+	}
+	if t.ndb != nil && t.ndb.opts.Comparator != nil {
+		return nil, errKeyRangeProofComparator
+	}
+	if _, err := t.ndb.hashScheme().hashOp(); err != nil {
+		return nil, err
+	}
+	proof := &KeyRangeProof{Start: start, End: end, Keys: [][]byte{}, Values: [][]byte{}, Proofs: []*ics23.ExistenceProof{}}
+	if t.root == nil {
+		return proof, nil
+	}
+
+	index := int64(0)
+	if start != nil {
+		var err error
+		if index, _, err = t.GetWithIndex(start); err != nil {
+			return nil, err
+		}
+	}
+	if index > 0 {
+		key, _, err := t.GetByIndex(index - 1)
+		if err != nil {
+			return nil, err
+		}
+		if proof.Left, err = t.createExistenceProof(key); err != nil {
+			return nil, err
+		}
+	}
+	for ; index < t.root.size; index++ {
+		key, _, err := t.GetByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if limit > 0 && len(proof.Keys) == limit {
+			proof.End = t.ndb.copyBytes(key)
+			break
+		}
+		existence, err := t.createExistenceProof(key)
+		if err != nil {
+			return nil, err
+		}
+		proof.Keys = append(proof.Keys, existence.Key)
+		proof.Values = append(proof.Values, existence.Value)
+		proof.Proofs = append(proof.Proofs, existence)
+	}
+	if index < t.root.size {
+		key, _, err := t.GetByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		if proof.Right, err = t.createExistenceProof(key); err != nil {
+			return nil, err
+		}
+	}
+	return proof, nil
+}
+
+// GetVersionedKeyRangeProof gets the key range proof of [start, end) at the specified version,
+// see ImmutableTree.GetKeyRangeProof.
+func (tree *MutableTree) GetVersionedKeyRangeProof(start, end []byte, limit int, version int64) (*KeyRangeProof, error) {
+	if !tree.VersionExists(version) {
+		return nil, ErrVersionDoesNotExist
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetKeyRangeProof(start, end, limit)
+}
+
+// Verify checks that the proof is valid for the tree with the given root hash, whose nodes are
+// hashed with scheme: that Keys are exactly the keys in [Start, End), with their Values. It
+// returns an error wrapping ErrInvalidProof otherwise.
+func (p *KeyRangeProof) Verify(root []byte, scheme HashScheme) error {
+	if p == nil {
+		return fmt.Errorf("nil key range proof: %w", ErrInvalidInputs)
+	}
+	spec, err := scheme.ProofSpec()
+	if err != nil {
+		return err
+	}
+	if len(p.Keys) != len(p.Values) || len(p.Keys) != len(p.Proofs) {
+		return fmt.Errorf("%d keys, %d values and %d proofs: %w", len(p.Keys), len(p.Values), len(p.Proofs), ErrInvalidProof)
+	}
+	if p.Start != nil && p.End != nil && bytes.Compare(p.Start, p.End) > 0 {
+		return fmt.Errorf("range start %X after end %X: %w", p.Start, p.End, ErrInvalidProof)
+	}
+
+	for i, key := range p.Keys {
+		if p.Start != nil && bytes.Compare(key, p.Start) < 0 || p.End != nil && bytes.Compare(key, p.End) >= 0 {
+			return fmt.Errorf("key %X out of the range: %w", key, ErrInvalidProof)
+		}
+		if i > 0 && bytes.Compare(p.Keys[i-1], key) >= 0 {
+			return fmt.Errorf("key %X not after %X: %w", key, p.Keys[i-1], ErrInvalidProof)
+		}
+		if proof := p.Proofs[i]; proof == nil || !bytes.Equal(proof.Key, key) {
+			return fmt.Errorf("no existence proof of key %X: %w", key, ErrInvalidProof)
+		}
+		if err := p.Proofs[i].Verify(spec, root, key, p.Values[i]); err != nil {
+			return fmt.Errorf("key %X: %w: %w", key, ErrInvalidProof, err)
+		}
+	}
+	if p.Left != nil {
+		if p.Start == nil || bytes.Compare(p.Left.Key, p.Start) >= 0 {
+			return fmt.Errorf("left neighbour %X not before the range: %w", p.Left.Key, ErrInvalidProof)
+		}
+		if err := p.Left.Verify(spec, root, p.Left.Key, p.Left.Value); err != nil {
+			return fmt.Errorf("left neighbour: %w: %w", ErrInvalidProof, err)
+		}
+	}
+	if p.Right != nil {
+		if p.End == nil || bytes.Compare(p.Right.Key, p.End) < 0 {
+			return fmt.Errorf("right neighbour %X not after the range: %w", p.Right.Key, ErrInvalidProof)
+		}
+		if err := p.Right.Verify(spec, root, p.Right.Key, p.Right.Value); err != nil {
+			return fmt.Errorf("right neighbour: %w: %w", ErrInvalidProof, err)
+		}
+	}
+
+	// the proven leaves are consecutive, and reach the edges of the tree without a neighbour.
+	chain := make([]*ics23.ExistenceProof, 0, len(p.Proofs)+2)
+	if p.Left != nil {
+		chain = append(chain, p.Left)
+	}
+	chain = append(chain, p.Proofs...)
+	if p.Right != nil {
+		chain = append(chain, p.Right)
+	}
+	if len(chain) == 0 {
+		if !bytes.Equal(root, scheme.EmptyHash()) {
+			return fmt.Errorf("no key proven in the non-empty tree %X: %w", root, ErrInvalidProof)
+		}
+		return nil
+	}
+	if p.Left == nil && !ics23.IsLeftMost(spec.InnerSpec, chain[0].Path) {
+		return fmt.Errorf("keys before the first key %X: %w", chain[0].Key, ErrInvalidProof)
+	}
+	if last := chain[len(chain)-1]; p.Right == nil && !ics23.IsRightMost(spec.InnerSpec, last.Path) {
+		return fmt.Errorf("keys after the last key %X: %w", last.Key, ErrInvalidProof)
+	}
+	for i := 1; i < len(chain); i++ {
+		if !ics23.IsLeftNeighbor(spec.InnerSpec, chain[i-1].Path, chain[i].Path) {
+			return fmt.Errorf("keys between %X and %X: %w", chain[i-1].Key, chain[i].Key, ErrInvalidProof)
+		}
+	}
+	return nil
+}
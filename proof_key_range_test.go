@@ -0,0 +1,90 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestKeyRangeProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	empty, err := tree.GetKeyRangeProof(nil, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, empty.Verify(tree.WorkingHash(), HashSHA256))
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	for i := 0; i < 100; i += 2 {
+		_, err := tree.Set(key(i), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	root, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Error(t, empty.Verify(root, HashSHA256))
+
+	for _, tc := range []struct {
+		start, end []byte
+		first, n   int
+	}{
+		{nil, nil, 0, 50},
+		{key(10), key(20), 10, 5},
+		{key(11), key(21), 12, 5},
+		{key(11), key(12), 0, 0},
+		{nil, key(7), 0, 4},
+		{key(93), nil, 94, 3},
+		{key(98), nil, 98, 1},
+		{key(99), nil, 0, 0},
+	} {
+		proof, err := tree.GetVersionedKeyRangeProof(tc.start, tc.end, 0, version)
+		require.NoError(t, err)
+		require.Len(t, proof.Keys, tc.n)
+		for i, k := range proof.Keys {
+			require.Equal(t, key(tc.first+2*i), k)
+		}
+		require.NoError(t, proof.Verify(root, HashSHA256), "[%s, %s)", tc.start, tc.end)
+	}
+
+	// the pages of a paginated read cover the tree.
+	var keys [][]byte
+	var start []byte
+	for {
+		page, err := tree.GetKeyRangeProof(start, nil, 7)
+		require.NoError(t, err)
+		require.NoError(t, page.Verify(root, HashSHA256))
+		keys = append(keys, page.Keys...)
+		if page.End == nil {
+			break
+		}
+		require.Len(t, page.Keys, 7)
+		require.Equal(t, page.Right.Key, page.End)
+		start = page.End
+	}
+	require.Len(t, keys, 50)
+
+	// a tampered proof is rejected.
+	tamper := map[string]func(p *KeyRangeProof){
+		"value": func(p *KeyRangeProof) { p.Values[1] = []byte("other") },
+		"omitted key": func(p *KeyRangeProof) {
+			p.Keys, p.Values, p.Proofs = append(p.Keys[:1:1], p.Keys[2:]...), append(p.Values[:1:1], p.Values[2:]...), append(p.Proofs[:1:1], p.Proofs[2:]...)
+		},
+		"omitted right":  func(p *KeyRangeProof) { p.Right = nil },
+		"omitted left":   func(p *KeyRangeProof) { p.Left = nil },
+		"narrowed range": func(p *KeyRangeProof) { p.End = p.Keys[2] },
+		"widened range":  func(p *KeyRangeProof) { p.End = key(60) },
+		"missing proof":  func(p *KeyRangeProof) { p.Proofs = p.Proofs[1:] },
+	}
+	for name, fn := range tamper {
+		proof, err := tree.GetKeyRangeProof(key(10), key(20), 0)
+		require.NoError(t, err)
+		fn(proof)
+		require.ErrorIs(t, proof.Verify(root, HashSHA256), ErrInvalidProof, name)
+	}
+
+	_, err = tree.GetKeyRangeProof(key(20), key(10), 0)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.GetVersionedKeyRangeProof(nil, nil, 0, version+1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
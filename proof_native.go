@@ -0,0 +1,50 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// GetNativeMembershipProof returns a proof that key exists in the tree, to verify with
+// VerifyMembershipNative. It is the RangeProof of the range of the key alone.
+func (t *ImmutableTree) GetNativeMembershipProof(key []byte) (*RangeProof, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if err := t.ndb.requireSHA256(); err != nil {
+		return nil, err
+	}
+	// computes the hashes of the unsaved nodes, if any.
+	t.Hash()
+	if t.root == nil {
+		return nil, fmt.Errorf("empty tree: %w", ErrKeyDoesNotExist)
+	}
+	path, node, err := t.root.PathToLeaf(t, key, t.version+1)
+	if err != nil {
+		return nil, fmt.Errorf("key %X: %w", key, ErrKeyDoesNotExist)
+	}
+	version := t.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	return &RangeProof{Path: path, Version: version}, nil
+}
+
+// VerifyMembershipNative verifies that key has the given value in the tree with the given root
+// hash, with a RangeProof of the key alone, as returned by GetNativeMembershipProof. It only
+// relies on the hashing of the IAVL nodes, and agrees with the verification of the equivalent
+// ics23 proof, for the clients which can't depend on ics23.
+func VerifyMembershipNative(root, key, value []byte, proof *RangeProof) error {
+	if key == nil || value == nil {
+		return fmt.Errorf("nil key or value: %w", ErrInvalidInputs)
+	}
+	if proof == nil {
+		return fmt.Errorf("nil proof: %w", ErrInvalidInputs)
+	}
+	valueHash := sha256.Sum256(value)
+	leafHash, err := ProofLeafNode{Key: key, ValueHash: valueHash[:], Version: proof.Version}.Hash()
+	if err != nil {
+		return err
+	}
+	return proof.Verify(root, leafHash)
+}
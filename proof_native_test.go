@@ -0,0 +1,109 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// nativeToICS23 converts a proof of VerifyMembershipNative to the equivalent ics23 proof.
+func nativeToICS23(key, value []byte, proof *RangeProof) *ics23.CommitmentProof {
+	return &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: &ics23.ExistenceProof{
+		Key:   key,
+		Value: value,
+		Leaf:  convertLeafOp(proof.Version, ics23.HashOp_SHA256),
+		Path:  convertInnerOps(proof.Path, ics23.HashOp_SHA256),
+	}}}
+}
+
+func TestVerifyMembershipNative(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// the keys updated in the working tree are proven at the working version.
+	_, err = tree.Set([]byte("key-100"), []byte("new"))
+	require.NoError(t, err)
+	root := tree.WorkingHash()
+
+	// agree checks that the native and the ics23 verifications agree, and returns their result.
+	agree := func(root, key, value []byte, proof *RangeProof) bool {
+		native := VerifyMembershipNative(root, key, value, proof)
+		if native != nil {
+			require.ErrorIs(t, native, ErrInvalidProof)
+		}
+		converted := ics23.VerifyMembership(ics23.IavlSpec, root, nativeToICS23(key, value, proof), key, value)
+		require.Equal(t, native == nil, converted, "key %s", key)
+		return converted
+	}
+
+	for _, i := range []int{0, 1, 57, 100, 199} {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		value, err := tree.Get(key)
+		require.NoError(t, err)
+		proof, err := tree.ImmutableTree.GetNativeMembershipProof(key)
+		require.NoError(t, err)
+		require.True(t, agree(root, key, value, proof))
+
+		// the proof is the ics23 one.
+		expected, err := tree.GetMembershipProof(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, nativeToICS23(key, value, proof))
+
+		// and so is the range proof of the key alone.
+		leaf, rangeProof, err := tree.ImmutableTree.RangeHash(key, append(key, 0))
+		require.NoError(t, err)
+		require.Equal(t, proof, rangeProof)
+		require.NoError(t, rangeProof.Verify(root, leaf))
+
+		require.False(t, agree(root, key, append(value, 'x'), proof))
+		require.False(t, agree(root, []byte("key-xxx"), value, proof))
+		require.False(t, agree([]byte("wrong root"), key, value, proof))
+
+		tampered := []func(p *RangeProof){
+			func(p *RangeProof) { p.Version++ },
+			func(p *RangeProof) { p.Path[0].Size++ },
+			func(p *RangeProof) { p.Path[len(p.Path)-1].Version-- },
+			func(p *RangeProof) { p.Path[len(p.Path)/2].Height++ },
+			func(p *RangeProof) { p.Path = p.Path[1:] },
+			func(p *RangeProof) {
+				pin := &p.Path[len(p.Path)-1]
+				if pin.Left != nil {
+					pin.Left = append([]byte{}, pin.Left...)
+					pin.Left[0] ^= 1
+				} else {
+					pin.Right = append([]byte{}, pin.Right...)
+					pin.Right[0] ^= 1
+				}
+			},
+		}
+		for j, tamper := range tampered {
+			p, err := tree.ImmutableTree.GetNativeMembershipProof(key)
+			require.NoError(t, err)
+			tamper(p)
+			require.False(t, agree(root, key, value, p), "tamper %d", j)
+		}
+	}
+
+	// a tree of a single leaf has an empty path.
+	single := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	_, err = single.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	proof, err := single.ImmutableTree.GetNativeMembershipProof([]byte("key"))
+	require.NoError(t, err)
+	require.Empty(t, proof.Path)
+	require.NoError(t, VerifyMembershipNative(single.WorkingHash(), []byte("key"), []byte("value"), proof))
+
+	_, err = tree.ImmutableTree.GetNativeMembershipProof([]byte("missing"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	require.ErrorIs(t, VerifyMembershipNative(root, nil, []byte("value"), proof), ErrInvalidInputs)
+	require.ErrorIs(t, VerifyMembershipNative(root, []byte("key"), []byte("value"), nil), ErrInvalidInputs)
+}
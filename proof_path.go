@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"strings"
 )
@@ -53,3 +55,99 @@ func (pl PathToLeaf) Index() (idx int64) {
 	}
 	return idx
 }
+
+// PathDirection is the side of an inner node that a path goes down to.
+type PathDirection uint8
+
+const (
+	// PathLeft means the path goes down to the left child.
+	PathLeft PathDirection = iota
+	// PathRight means the path goes down to the right child.
+	PathRight
+)
+
+// String implements fmt.Stringer.
+func (d PathDirection) String() string {
+	switch d {
+	case PathLeft:
+		return "left"
+	case PathRight:
+		return "right"
+	default:
+		return fmt.Sprintf("PathDirection(%d)", uint8(d))
+	}
+}
+
+// PathStep is an inner node of the path from the root of a tree to a leaf, with the hash of
+// the child the path doesn't go down to. Its hash is the hash of a ProofInnerNode with the same
+// height, size and version, and the sibling hash on the other side of the direction.
+type PathStep struct {
+	SiblingHash []byte        `json:"sibling_hash"`
+	Direction   PathDirection `json:"direction"`
+	Height      int8          `json:"height"`
+	Size        int64         `json:"size"`
+	Version     int64         `json:"version"`
+}
+
+// ProofPath is the path from the root of a tree to the leaf of a key, as returned by
+// ImmutableTree.GetProofPath, for the verifiers of custom proofs.
+type ProofPath struct {
+	// Steps are the inner nodes of the path, from the root to the leaf.
+	Steps []PathStep `json:"steps"`
+	// Leaf is the leaf at the end of the path. For an absent key, it is the leaf next to which
+	// the key would be, either before or after it.
+	Leaf ProofLeafNode `json:"leaf"`
+	// Absent tells whether the key is absent from the tree.
+	Absent bool `json:"absent"`
+}
+
+// GetProofPath returns the path from the root of the tree to the leaf of key, or to the leaf
+// where key would be if it is absent. It returns an error wrapping ErrKeyDoesNotExist if the
+// tree is empty.
+func (t *ImmutableTree) GetProofPath(key []byte) (*ProofPath, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if err := t.ndb.requireSHA256(); err != nil {
+		return nil, err
+	}
+	// computes the hashes of the unsaved nodes, if any.
+	t.Hash()
+	if t.root == nil {
+		return nil, fmt.Errorf("empty tree: %w", ErrKeyDoesNotExist)
+	}
+
+	version := func(node *Node) int64 {
+		if node.nodeKey == nil {
+			return t.version + 1
+		}
+		return node.nodeKey.version
+	}
+	path := &ProofPath{}
+	node := t.root
+	for !node.isLeaf() {
+		step := PathStep{Height: node.subtreeHeight, Size: node.size, Version: version(node)}
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return nil, err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return nil, err
+		}
+		if t.ndb.compare(key, node.key) < 0 {
+			step.Direction, step.SiblingHash, node = PathLeft, rightNode.hash, leftNode
+		} else {
+			step.Direction, step.SiblingHash, node = PathRight, leftNode.hash, rightNode
+		}
+		path.Steps = append(path.Steps, step)
+	}
+	value, err := t.ndb.leafValue(node)
+	if err != nil {
+		return nil, err
+	}
+	valueHash := sha256.Sum256(value)
+	path.Leaf = ProofLeafNode{Key: t.ndb.copyBytes(node.key), ValueHash: valueHash[:], Version: version(node)}
+	path.Absent = !bytes.Equal(node.key, key)
+	return path, nil
+}
@@ -0,0 +1,99 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// proofPathRoot returns the root hash of the path, as a custom verifier would compute it.
+func proofPathRoot(t *testing.T, path *ProofPath) []byte {
+	t.Helper()
+	hash, err := path.Leaf.Hash()
+	require.NoError(t, err)
+	for i := len(path.Steps) - 1; i >= 0; i-- {
+		step := path.Steps[i]
+		pin := ProofInnerNode{Height: step.Height, Size: step.Size, Version: step.Version}
+		if step.Direction == PathLeft {
+			pin.Right = step.SiblingHash
+		} else {
+			pin.Left = step.SiblingHash
+		}
+		hash, err = pin.Hash(hash)
+		require.NoError(t, err)
+	}
+	return hash
+}
+
+func TestGetProofPath(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i*2)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// the path of the unsaved nodes is returned as well.
+	_, err = tree.Set([]byte("key-050"), []byte("updated"))
+	require.NoError(t, err)
+
+	saved, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	for _, itree := range []*ImmutableTree{saved, tree.ImmutableTree} {
+		for _, i := range []int{0, 50, 51, 99, 198, 199, 300} {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			path, err := itree.GetProofPath(key)
+			require.NoError(t, err)
+			require.Equal(t, itree.Hash(), proofPathRoot(t, path))
+
+			// the working tree isn't in the fast storage, so the value is read from the nodes.
+			_, value, err := itree.GetWithIndex(key)
+			require.NoError(t, err)
+			require.Equal(t, value == nil, path.Absent, "key %s", key)
+			if value != nil {
+				require.Equal(t, string(key), string(path.Leaf.Key))
+				valueHash := sha256.Sum256(value)
+				require.EqualValues(t, valueHash[:], path.Leaf.ValueHash)
+			}
+			// the steps go from the root to the leaf.
+			require.Equal(t, itree.Height(), path.Steps[0].Height)
+			require.EqualValues(t, itree.Size(), path.Steps[0].Size)
+			for j := 1; j < len(path.Steps); j++ {
+				require.Less(t, path.Steps[j].Height, path.Steps[j-1].Height)
+			}
+		}
+	}
+
+	// an absent key leads to a neighbouring leaf.
+	path, err := saved.GetProofPath([]byte("key-051"))
+	require.NoError(t, err)
+	require.True(t, path.Absent)
+	require.Contains(t, []string{"key-050", "key-052"}, string(path.Leaf.Key))
+	path, err = saved.GetProofPath([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, path.Absent)
+	require.Equal(t, "key-000", string(path.Leaf.Key))
+	for _, step := range path.Steps {
+		require.Equal(t, PathLeft, step.Direction)
+	}
+
+	// a single leaf has no step.
+	single := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	_, err = single.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	path, err = single.ImmutableTree.GetProofPath([]byte("key"))
+	require.NoError(t, err)
+	require.Empty(t, path.Steps)
+	require.False(t, path.Absent)
+	require.Equal(t, single.WorkingHash(), proofPathRoot(t, path))
+
+	_, err = NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).ImmutableTree.GetProofPath([]byte("key"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	_, err = saved.GetProofPath(nil)
+	require.ErrorIs(t, err, ErrEmptyKey)
+}
@@ -0,0 +1,140 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// RangeProof ties the hash of the subtree covering a key range, as returned by
+// ImmutableTree.RangeHash, to the root hash of the tree.
+type RangeProof struct {
+	// Path are the inner nodes from the root to the subtree, as in the PathToLeaf of a proof.
+	Path PathToLeaf `json:"path"`
+	// Version is the version of the subtree if it is a leaf, 0 otherwise.
+	Version int64 `json:"version,omitempty"`
+}
+
+// Verify checks that rangeHash is the hash of a subtree of the tree with the given root hash.
+func (p *RangeProof) Verify(root, rangeHash []byte) error {
+	if p == nil {
+		return fmt.Errorf("nil range proof: %w", ErrInvalidInputs)
+	}
+	hash := rangeHash
+	for i := len(p.Path) - 1; i >= 0; i-- {
+		var err error
+		if hash, err = p.Path[i].Hash(hash); err != nil {
+			return fmt.Errorf("inner node %d: %w: %w", i, ErrInvalidProof, err)
+		}
+	}
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("range hash doesn't lead to root %X: %w", root, ErrInvalidProof)
+	}
+	return nil
+}
+
+// RangeHash returns the hash of the smallest subtree covering the keys in [start, end), nil
+// bounds being open, and a RangeProof tying it to the root hash of the tree. The subtree may
+// cover keys around the range, but the key/value pairs in the range can't change without the
+// range hash changing. The range hash of the full range is the root hash, and the range hash of
+// a range without any key is the hash of an empty tree, with a nil proof since there is no
+// subtree to prove.
+func (t *ImmutableTree) RangeHash(start, end []byte) ([]byte, *RangeProof, error) {
+	node, proof, err := t.rangeSubtree(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if node == nil {
+		empty := sha256.Sum256(nil)
+		return empty[:], nil, nil
+	}
+	return node.hash, proof, nil
+}
+
+// rangeSubtree returns the smallest subtree covering the keys in [start, end) and its
+// RangeProof, see RangeHash, or nil if there is no key in the range.
+func (t *ImmutableTree) rangeSubtree(start, end []byte) (*Node, *RangeProof, error) {
+	if err := t.ndb.requireSHA256(); err != nil {
+		return nil, nil, err
+	}
+	if start != nil && end != nil && t.ndb.compare(start, end) >= 0 {
+		return nil, nil, fmt.Errorf("start %X is not before end %X: %w", start, end, ErrInvalidInputs)
+	}
+	// computes the hashes of the unsaved nodes, if any.
+	t.Hash()
+
+	first, last, err := t.rangeBounds(start, end)
+	if err != nil || first == nil {
+		return nil, nil, err
+	}
+
+	// descends from the root as long as the first and the last keys are on the same side.
+	var path PathToLeaf
+	node := t.root
+	for node.subtreeHeight > 0 {
+		version := t.version + 1
+		if node.nodeKey != nil {
+			version = node.nodeKey.version
+		}
+		pin := ProofInnerNode{Height: node.subtreeHeight, Size: node.size, Version: version}
+		if left := t.ndb.compare(first, node.key) < 0; left != (t.ndb.compare(last, node.key) < 0) {
+			break
+		} else if left {
+			rightNode, err := node.getRightNode(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			pin.Right = rightNode.hash
+			node, err = node.getLeftNode(t)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			leftNode, err := node.getLeftNode(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			pin.Left = leftNode.hash
+			node, err = node.getRightNode(t)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		path = append(path, pin)
+	}
+	proof := &RangeProof{Path: path}
+	if node.isLeaf() {
+		proof.Version = t.version + 1
+		if node.nodeKey != nil {
+			proof.Version = node.nodeKey.version
+		}
+	}
+	return node, proof, nil
+}
+
+// rangeBounds returns the first and the last keys in [start, end), nil if there is none. The
+// tombstones of the SoftDeleteRetention option aren't keys.
+func (t *ImmutableTree) rangeBounds(start, end []byte) (first, last []byte, err error) {
+	if t.root == nil {
+		return nil, nil, nil
+	}
+	for _, ascending := range []bool{true, false} {
+		itr := t.ndb.filterTombstones(NewIterator(start, end, ascending, t))
+		if itr.Valid() {
+			if ascending {
+				first = itr.Key()
+			} else {
+				last = itr.Key()
+			}
+		}
+		err := itr.Error()
+		itr.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			return nil, nil, nil
+		}
+	}
+	return first, last, nil
+}
@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestRangeHash(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+
+	for _, save := range []bool{false, true} {
+		t.Run(fmt.Sprintf("saved=%v", save), func(t *testing.T) {
+			if save {
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+			root := tree.WorkingHash()
+
+			hash, proof, err := tree.ImmutableTree.RangeHash([]byte("key-020"), []byte("key-030"))
+			require.NoError(t, err)
+			require.NotEqual(t, root, hash)
+			require.NotEmpty(t, proof.Path)
+			require.NoError(t, proof.Verify(root, hash))
+
+			// the range hash is stable.
+			again, _, err := tree.ImmutableTree.RangeHash([]byte("key-020"), []byte("key-030"))
+			require.NoError(t, err)
+			require.Equal(t, hash, again)
+
+			// a wrong range hash or root doesn't verify.
+			require.ErrorIs(t, proof.Verify(root, root), ErrInvalidProof)
+			require.ErrorIs(t, proof.Verify(hash, hash), ErrInvalidProof)
+
+			// the full range is the root.
+			full, proof, err := tree.ImmutableTree.RangeHash(nil, nil)
+			require.NoError(t, err)
+			require.Equal(t, root, full)
+			require.Empty(t, proof.Path)
+			require.NoError(t, proof.Verify(root, full))
+
+			// a single key is its leaf.
+			leaf, proof, err := tree.ImmutableTree.RangeHash([]byte("key-042"), []byte("key-042\x00"))
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(root, leaf))
+			value, err := tree.Get([]byte("key-042"))
+			require.NoError(t, err)
+			valueHash := sha256.Sum256(value)
+			version := tree.Version()
+			if !save {
+				version++
+			}
+			expected, err := ProofLeafNode{Key: []byte("key-042"), ValueHash: valueHash[:], Version: version}.Hash()
+			require.NoError(t, err)
+			require.Equal(t, expected, leaf)
+
+			// an empty range is the hash of an empty tree.
+			empty, proof, err := tree.ImmutableTree.RangeHash([]byte("key-042\x00"), []byte("key-043"))
+			require.NoError(t, err)
+			require.Equal(t, NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).WorkingHash(), empty)
+			require.Nil(t, proof)
+		})
+	}
+
+	// changing a key in the range changes the range hash, but not the hash of another range.
+	hash, _, err := tree.ImmutableTree.RangeHash([]byte("key-020"), []byte("key-030"))
+	require.NoError(t, err)
+	other, _, err := tree.ImmutableTree.RangeHash([]byte("key-070"), []byte("key-080"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-025"), []byte("changed"))
+	require.NoError(t, err)
+	changed, proof, err := tree.ImmutableTree.RangeHash([]byte("key-020"), []byte("key-030"))
+	require.NoError(t, err)
+	require.NotEqual(t, hash, changed)
+	require.NoError(t, proof.Verify(tree.WorkingHash(), changed))
+	otherAfter, _, err := tree.ImmutableTree.RangeHash([]byte("key-070"), []byte("key-080"))
+	require.NoError(t, err)
+	require.Equal(t, other, otherAfter)
+
+	_, _, err = tree.ImmutableTree.RangeHash([]byte("b"), []byte("a"))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	require.ErrorIs(t, (*RangeProof)(nil).Verify(hash, hash), ErrInvalidInputs)
+}
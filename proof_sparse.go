@@ -0,0 +1,212 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+// SparseProof proves several keys at once against the root hash of a tree. It is the tree
+// pruned to the paths leading to the keys, so that the inner nodes the paths share are only
+// included once. SparseProof proofs are created by ImmutableTree.SparseRoot and verified by
+// VerifySparse.
+type SparseProof struct {
+	// Nodes are the nodes of the pruned tree, in pre-order.
+	Nodes []SparseProofNode `json:"nodes"`
+}
+
+// SparseProofNode is a node of a SparseProof, either an inner node followed by its left and
+// right subtrees, a leaf of a proven key, or the hash of a pruned subtree.
+type SparseProofNode struct {
+	// Height is the height of an inner node, 0 for a leaf or a pruned subtree.
+	Height  int8  `json:"height"`
+	Size    int64 `json:"size"`
+	Version int64 `json:"version"`
+	// Index is the position of the key of a leaf among the proven keys.
+	Index int `json:"index"`
+	// Hash is the hash of a pruned subtree, nil for the other nodes.
+	Hash []byte `json:"hash,omitempty"`
+}
+
+// SparseRoot returns the root hash of the tree and a SparseProof of the given keys against it,
+// which must all exist. The keys may be given in any order, VerifySparse is then given their
+// values in the same order.
+func (t *ImmutableTree) SparseRoot(keys [][]byte) ([]byte, *SparseProof, error) {
+	if err := t.ndb.requireSHA256(); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("no key to prove: %w", ErrInvalidInputs)
+	}
+	sorted := make([]sparseKey, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			return nil, nil, fmt.Errorf("nil key: %w", ErrInvalidInputs)
+		}
+		sorted[i] = sparseKey{key: key, index: i}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return t.ndb.compare(sorted[i].key, sorted[j].key) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if t.ndb.compare(sorted[i-1].key, sorted[i].key) == 0 {
+			return nil, nil, fmt.Errorf("duplicate key %X: %w", sorted[i].key, ErrInvalidInputs)
+		}
+	}
+	// computes the hashes of the unsaved nodes, if any.
+	root := t.Hash()
+	if t.root == nil {
+		return nil, nil, fmt.Errorf("empty tree: %w", ErrKeyDoesNotExist)
+	}
+
+	proof := &SparseProof{}
+	if err := t.sparseProof(t.root, sorted, proof); err != nil {
+		return nil, nil, err
+	}
+	return root, proof, nil
+}
+
+// sparseKey is a key to prove, with its position among the keys given to SparseRoot.
+type sparseKey struct {
+	key   []byte
+	index int
+}
+
+// sparseProof appends the nodes of the subtree of node to the proof, given the sorted keys of
+// the subtree to prove, pruning the subtrees without any of them.
+func (t *ImmutableTree) sparseProof(node *Node, keys []sparseKey, proof *SparseProof) error {
+	if len(keys) == 0 {
+		proof.Nodes = append(proof.Nodes, SparseProofNode{Hash: node.hash})
+		return nil
+	}
+	version := t.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	if node.isLeaf() {
+		for _, k := range keys {
+			if t.ndb.compare(k.key, node.key) != 0 {
+				return fmt.Errorf("key %X: %w", k.key, ErrKeyDoesNotExist)
+			}
+		}
+		proof.Nodes = append(proof.Nodes, SparseProofNode{Version: version, Index: keys[0].index})
+		return nil
+	}
+
+	proof.Nodes = append(proof.Nodes, SparseProofNode{Height: node.subtreeHeight, Size: node.size, Version: version})
+	// the keys lower than node.key are in the left subtree, the others in the right one.
+	split := sort.Search(len(keys), func(i int) bool {
+		return t.ndb.compare(keys[i].key, node.key) >= 0
+	})
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return err
+	}
+	if err := t.sparseProof(leftNode, keys[:split], proof); err != nil {
+		return err
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return err
+	}
+	return t.sparseProof(rightNode, keys[split:], proof)
+}
+
+// VerifySparse verifies that the keys have the given values in the tree with the given root
+// hash, given a SparseProof of them. The keys must be given in the order they were given to
+// SparseRoot. It returns an error wrapping ErrInvalidProof if the proof doesn't prove all the
+// keys with their values against root.
+func VerifySparse(root []byte, keys, values [][]byte, proof *SparseProof) error {
+	_, _, err := verifySparse(root, keys, values, proof)
+	return err
+}
+
+// verifySparse verifies a SparseProof as VerifySparse does, and returns the positions of the
+// leaves of the keys among the leaves of the tree, and the number of leaves of the tree.
+func verifySparse(root []byte, keys, values [][]byte, proof *SparseProof) (positions []int64, size int64, err error) {
+	if proof == nil || len(keys) == 0 || len(keys) != len(values) {
+		return nil, 0, fmt.Errorf("%w: a proof and as many values as keys are needed", ErrInvalidInputs)
+	}
+	v := sparseVerifier{keys: keys, values: values, positions: make([]int64, len(keys)), nodes: proof.Nodes}
+	for i := range v.positions {
+		v.positions[i] = -1
+	}
+	hash, size, err := v.hash()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(v.nodes) > 0 {
+		return nil, 0, fmt.Errorf("%w: %d trailing nodes", ErrInvalidProof, len(v.nodes))
+	}
+	for i, position := range v.positions {
+		if position < 0 {
+			return nil, 0, fmt.Errorf("%w: key %X is not proven", ErrInvalidProof, keys[i])
+		}
+	}
+	if !bytes.Equal(hash, root) {
+		return nil, 0, fmt.Errorf("%w: root hash %X doesn't match %X", ErrInvalidProof, hash, root)
+	}
+	return v.positions, size, nil
+}
+
+// sparseVerifier computes the root hash of a SparseProof, consuming its nodes.
+type sparseVerifier struct {
+	keys, values [][]byte
+	// positions are the positions of the leaves of the proven keys within the subtree being
+	// verified, -1 for the keys not proven yet.
+	positions []int64
+	proven    []int // indices of the proven keys, in leaf order
+	nodes     []SparseProofNode
+}
+
+// hash returns the hash of the next subtree of the proof, and its number of leaves, -1 for a
+// pruned subtree. The size of a pruned subtree is inferred from the size of its parent, which
+// its hash commits to.
+func (v *sparseVerifier) hash() ([]byte, int64, error) {
+	if len(v.nodes) == 0 {
+		return nil, 0, fmt.Errorf("%w: missing nodes", ErrInvalidProof)
+	}
+	node := v.nodes[0]
+	v.nodes = v.nodes[1:]
+
+	switch {
+	case node.Hash != nil:
+		return node.Hash, -1, nil
+	case node.Height == 0:
+		if node.Index < 0 || node.Index >= len(v.keys) || v.positions[node.Index] >= 0 {
+			return nil, 0, fmt.Errorf("%w: invalid leaf index %d", ErrInvalidProof, node.Index)
+		}
+		v.positions[node.Index] = 0
+		v.proven = append(v.proven, node.Index)
+		valueHash := sha256.Sum256(v.values[node.Index])
+		hash, err := ProofLeafNode{Key: v.keys[node.Index], ValueHash: valueHash[:], Version: node.Version}.Hash()
+		return hash, 1, err
+	case node.Height > 0:
+		left, leftSize, err := v.hash()
+		if err != nil {
+			return nil, 0, err
+		}
+		rightProven := len(v.proven)
+		right, rightSize, err := v.hash()
+		if err != nil {
+			return nil, 0, err
+		}
+		if leftSize < 0 && rightSize >= 0 {
+			leftSize = node.Size - rightSize
+		}
+		if leftSize >= 0 {
+			if leftSize < 1 || leftSize >= node.Size {
+				return nil, 0, fmt.Errorf("%w: inconsistent size %d of inner node", ErrInvalidProof, node.Size)
+			}
+			// the leaves of the right subtree follow the ones of the left subtree.
+			for _, i := range v.proven[rightProven:] {
+				v.positions[i] += leftSize
+			}
+		}
+		hash, err := ProofInnerNode{Height: node.Height, Size: node.Size, Version: node.Version, Left: left}.Hash(right)
+		return hash, node.Size, err
+	default:
+		return nil, 0, fmt.Errorf("%w: negative height %d", ErrInvalidProof, node.Height)
+	}
+}
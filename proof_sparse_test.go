@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseRoot(t *testing.T) {
+	tree, allkeys, err := BuildTree(500, 0)
+	require.NoError(t, err)
+
+	// the keys are proven in any order, against the working tree and then the saved one.
+	keys := [][]byte{GetKey(allkeys, Right), GetKey(allkeys, Left), GetKey(allkeys, Middle)}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], err = tree.Get(key)
+		require.NoError(t, err)
+	}
+	for _, save := range []bool{false, true} {
+		t.Run(fmt.Sprintf("saved=%v", save), func(t *testing.T) {
+			if save {
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+			}
+			root, proof, err := tree.ImmutableTree.SparseRoot(keys)
+			require.NoError(t, err)
+			require.Equal(t, tree.WorkingHash(), root)
+			require.NoError(t, VerifySparse(root, keys, values, proof))
+
+			// the shared inner nodes are only included once.
+			separate := 0
+			for _, key := range keys {
+				_, single, err := tree.ImmutableTree.SparseRoot([][]byte{key})
+				require.NoError(t, err)
+				separate += len(single.Nodes)
+			}
+			require.Less(t, len(proof.Nodes), separate)
+
+			// a tampered value doesn't verify.
+			tampered := append([][]byte{}, values...)
+			tampered[1] = append(append([]byte{}, values[1]...), 'x')
+			require.ErrorIs(t, VerifySparse(root, keys, tampered, proof), ErrInvalidProof)
+
+			// swapped keys don't verify either.
+			swappedKeys := [][]byte{keys[1], keys[0], keys[2]}
+			swappedValues := [][]byte{values[1], values[0], values[2]}
+			require.ErrorIs(t, VerifySparse(root, swappedKeys, swappedValues, proof), ErrInvalidProof)
+
+			// nor a wrong root, or a subset of the keys.
+			require.ErrorIs(t, VerifySparse([]byte("wrong root"), keys, values, proof), ErrInvalidProof)
+			require.ErrorIs(t, VerifySparse(root, keys[:2], values[:2], proof), ErrInvalidProof)
+			require.ErrorIs(t, VerifySparse(root, keys, values[:2], proof), ErrInvalidInputs)
+		})
+	}
+
+	_, _, err = tree.ImmutableTree.SparseRoot([][]byte{keys[0], GetNonKey(allkeys, Middle)})
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	_, _, err = tree.ImmutableTree.SparseRoot([][]byte{keys[0], keys[0]})
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, _, err = tree.ImmutableTree.SparseRoot(nil)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -0,0 +1,100 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// Protobuf tags (field number << 3 | wire type 2) of the length-delimited fields written by
+// WriteMembershipProof.
+const (
+	commitmentProofExistTag = 0x0a // CommitmentProof.exist = 1
+	existenceProofKeyTag    = 0x0a // ExistenceProof.key = 1
+	existenceProofValueTag  = 0x12 // ExistenceProof.value = 2
+	existenceProofLeafTag   = 0x1a // ExistenceProof.leaf = 3
+	existenceProofPathTag   = 0x22 // ExistenceProof.path = 4
+)
+
+// WriteMembershipProof writes the protobuf encoding of the membership proof for the given key to
+// w, byte-identical to marshaling the CommitmentProof returned by GetMembershipProof. The proof
+// is written incrementally, and in particular the value is written as is, so that the encoded
+// proof is never held in memory as a whole. If the key doesn't exist in the tree, an error is
+// returned and nothing is written.
+func (t *ImmutableTree) WriteMembershipProof(key []byte, w io.Writer) error {
+	if t.root == nil {
+		return fmt.Errorf("cannot generate the proof with nil root")
+	}
+	exist, err := t.createSharedExistenceProof(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeProtoFieldHeader(w, commitmentProofExistTag, exist.Size()); err != nil {
+		return err
+	}
+	if err := writeProtoBytesField(w, existenceProofKeyTag, exist.Key); err != nil {
+		return err
+	}
+	if err := writeProtoBytesField(w, existenceProofValueTag, exist.Value); err != nil {
+		return err
+	}
+	if exist.Leaf != nil {
+		if err := writeProtoMessageField(w, existenceProofLeafTag, exist.Leaf); err != nil {
+			return err
+		}
+	}
+	for _, op := range exist.Path {
+		if err := writeProtoMessageField(w, existenceProofPathTag, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoMessage is implemented by the gogoproto generated ics23 messages.
+type protoMessage interface {
+	Size() int
+	Marshal() ([]byte, error)
+}
+
+var (
+	_ protoMessage = (*ics23.LeafOp)(nil)
+	_ protoMessage = (*ics23.InnerOp)(nil)
+)
+
+// writeProtoFieldHeader writes the tag and the length prefix of a length-delimited field.
+func writeProtoFieldHeader(w io.Writer, tag byte, size int) error {
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = tag
+	n := binary.PutUvarint(buf[1:], uint64(size))
+	_, err := w.Write(buf[:1+n])
+	return err
+}
+
+// writeProtoBytesField writes a bytes field, which is omitted if empty as in proto3.
+func writeProtoBytesField(w io.Writer, tag byte, bz []byte) error {
+	if len(bz) == 0 {
+		return nil
+	}
+	if err := writeProtoFieldHeader(w, tag, len(bz)); err != nil {
+		return err
+	}
+	_, err := w.Write(bz)
+	return err
+}
+
+// writeProtoMessageField writes an embedded message field.
+func writeProtoMessageField(w io.Writer, tag byte, msg protoMessage) error {
+	bz, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeProtoFieldHeader(w, tag, len(bz)); err != nil {
+		return err
+	}
+	_, err = w.Write(bz)
+	return err
+}
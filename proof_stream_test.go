@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestWriteMembershipProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for i := 0; i < 100; i++ {
+		// include one large value to exercise multi-byte length prefixes
+		value := []byte(fmt.Sprintf("value-%d", i))
+		if i == 42 {
+			value = bytes.Repeat([]byte{0xab}, 1<<20)
+		}
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), value)
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("empty"), []byte{})
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	for _, key := range []string{"key-000", "key-042", "key-063", "key-099", "empty"} {
+		t.Run(key, func(t *testing.T) {
+			proof, err := itree.GetMembershipProof([]byte(key))
+			require.NoError(t, err)
+			expected, err := proof.Marshal()
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			require.NoError(t, itree.WriteMembershipProof([]byte(key), &buf))
+			require.Equal(t, expected, buf.Bytes())
+
+			var decoded ics23.CommitmentProof
+			require.NoError(t, decoded.Unmarshal(buf.Bytes()))
+			value, err := itree.Get([]byte(key))
+			require.NoError(t, err)
+			if len(value) == 0 {
+				// ics23 refuses to verify empty values
+				return
+			}
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, itree.Hash(), &decoded, []byte(key), value))
+		})
+	}
+
+	var buf bytes.Buffer
+	require.Error(t, itree.WriteMembershipProof([]byte("missing"), &buf))
+	require.Zero(t, buf.Len())
+}
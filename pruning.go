@@ -0,0 +1,401 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// The versions pruned between retained versions are marked, so that the gaps they leave are
+// told apart from the versions before the first one or after the latest one.
+var prunedVersionKeyFormat = keyformat.NewFastPrefixFormatter('p', int64Size) // p<version>
+
+// PruningOptions is a pruning policy applied by SaveVersion, see MutableTree.ConfigurePruning.
+type PruningOptions struct {
+	// KeepRecent is the number of most recent versions retained, at least 1.
+	KeepRecent int64
+	// KeepEvery retains the older versions which are a multiple of it, e.g. as snapshots. 0
+	// retains none of them.
+	KeepEvery int64
+	// Interval only prunes on the versions which are a multiple of it, which deletes the pruned
+	// versions in larger runs. 0 prunes on every version.
+	Interval int64
+	// Async deletes the pruned versions in a background goroutine instead of in SaveVersion,
+	// which only queues them, see MutableTree.WaitForPruning.
+	Async bool
+	// RateLimit is the maximum number of versions deleted per second by the async pruning. 0
+	// doesn't limit it.
+	RateLimit int
+}
+
+// validate checks the policy, the zero value being valid and disabling the pruning.
+func (p PruningOptions) validate() error {
+	if p == (PruningOptions{}) {
+		return nil
+	}
+	if p.KeepRecent < 1 {
+		return fmt.Errorf("at least one recent version must be kept, got %d: %w", p.KeepRecent, ErrInvalidInputs)
+	}
+	if p.KeepEvery < 0 {
+		return fmt.Errorf("KeepEvery must not be negative, got %d: %w", p.KeepEvery, ErrInvalidInputs)
+	}
+	if p.Interval < 0 {
+		return fmt.Errorf("Interval must not be negative, got %d: %w", p.Interval, ErrInvalidInputs)
+	}
+	if p.RateLimit < 0 {
+		return fmt.Errorf("RateLimit must not be negative, got %d: %w", p.RateLimit, ErrInvalidInputs)
+	}
+	return nil
+}
+
+// retains returns whether the policy retains the version, given the latest version.
+func (p PruningOptions) retains(version, latest int64) bool {
+	return version > latest-p.KeepRecent || (p.KeepEvery > 0 && version%p.KeepEvery == 0)
+}
+
+// ConfigurePruning sets the pruning policy applied after every SaveVersion: the KeepRecent most
+// recent versions are retained, along with the versions which are a multiple of KeepEvery, and
+// all the other versions are deleted. The zero PruningOptions disables the pruning, which is the
+// default.
+//
+// The versions are pruned from the first version, so the policy also applies to the versions
+// saved before it was configured, on the next SaveVersion. Pruning leaves gaps between the
+// retained versions, which AvailableVersions and VersionExists take into account. Legacy
+// versions are only pruned once all the versions up to them can be.
+//
+// With Async, SaveVersion queues the versions to delete, and a background goroutine deletes
+// them one at a time, at most RateLimit per second, so that pruning many versions doesn't
+// delay the commits. WaitForPruning waits for the queued versions, e.g. before shutting down;
+// the versions still queued when the tree is closed or the policy is changed are pruned again
+// once the policy applies.
+func (tree *MutableTree) ConfigurePruning(opts PruningOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	tree.ndb.stopAsyncPruner()
+	tree.pruning = opts
+	tree.prunedTo = 0
+	return nil
+}
+
+// prune applies the pruning policy once latest is saved.
+func (tree *MutableTree) prune(latest int64) error {
+	if tree.pruning == (PruningOptions{}) {
+		return nil
+	}
+	if tree.pruning.Interval > 0 && latest%tree.pruning.Interval != 0 {
+		return nil
+	}
+	var pruner *asyncPruner
+	if tree.pruning.Async {
+		pruner = tree.ndb.startAsyncPruner(tree.pruning.RateLimit, tree.immutableCache.reset)
+	}
+	first, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	// the versions before prunedTo already follow the policy, unless the pruning restarts.
+	from := max(first, tree.prunedTo)
+	to := latest - tree.pruning.KeepRecent
+
+	if to >= from {
+		tree.immutableCache.reset()
+	}
+	// delete the runs of versions which aren't retained, up to the next retained version.
+	for version := from; version <= to; {
+		if tree.pruning.retains(version, latest) {
+			version++
+			continue
+		}
+		runEnd := version
+		for runEnd < to && !tree.pruning.retains(runEnd+1, latest) {
+			runEnd++
+		}
+		switch {
+		case pruner != nil:
+			pruner.enqueue(version, runEnd)
+		case version == first:
+			if err := tree.ndb.DeleteVersionsTo(runEnd); err != nil {
+				return err
+			}
+		case runEnd <= legacyLatestVersion:
+			// the legacy versions can only be pruned from the first one.
+		default:
+			if err := tree.ndb.deleteVersionsBetween(max(version, legacyLatestVersion+1), runEnd); err != nil {
+				return err
+			}
+		}
+		version = runEnd + 1
+	}
+	if to >= from {
+		tree.prunedTo = to + 1
+	}
+	if pruner != nil {
+		return nil
+	}
+	return tree.ndb.Commit()
+}
+
+// PruneDryRun reports what DeleteVersionsTo(target) would delete, without deleting anything: the
+// available versions it would remove, in ascending order, and an estimate of the bytes it would
+// free, i.e. the size of the nodes which the later versions don't use, including their database
+// keys. The nodes of the legacy versions, which DeleteVersionsTo deletes in the background, are
+// not estimated. It fails as DeleteVersionsTo would, e.g. if target isn't before the latest
+// version or a version to remove is being read.
+func (tree *MutableTree) PruneDryRun(target int64) (removedVersions []int64, estimatedBytesFreed int64, err error) {
+	toVersion, estimatedBytesFreed, err := tree.ndb.pruneDryRun(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, version := range tree.AvailableVersions() {
+		if int64(version) > toVersion {
+			break
+		}
+		removedVersions = append(removedVersions, int64(version))
+	}
+	return removedVersions, estimatedBytesFreed, nil
+}
+
+// pruneMaxRetained deletes the oldest versions as long as more than MaxRetainedVersions versions
+// are available once latest is saved. The versions being read, e.g. by an Exporter, are skipped.
+// The legacy versions can only be pruned from the first one, so they are deleted at once, and
+// retained beyond the cap until they can all be.
+func (tree *MutableTree) pruneMaxRetained(latest int64) error {
+	maxRetained := tree.ndb.opts.MaxRetainedVersions
+	if maxRetained <= 0 {
+		return nil
+	}
+	versions := tree.AvailableVersions()
+	excess := int64(len(versions)) - maxRetained
+	if excess <= 0 {
+		return nil
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	tree.immutableCache.reset()
+
+	// whether the versions before the current one are all deleted.
+	first := true
+	if legacyLatestVersion > 0 {
+		var legacy int64
+		read := false
+		for _, version := range versions {
+			if int64(version) > legacyLatestVersion {
+				break
+			}
+			legacy++
+			read = read || tree.ndb.hasVersionReaders(int64(version))
+		}
+		switch {
+		case legacy == 0:
+		case read:
+			first = false
+		case legacy > excess:
+			// the legacy versions are deleted once they can all be.
+			return nil
+		default:
+			if err := tree.ndb.DeleteVersionsTo(legacyLatestVersion); err != nil {
+				return err
+			}
+			excess -= legacy
+		}
+		versions = versions[legacy:]
+	}
+	for _, v := range versions {
+		version := int64(v)
+		if excess == 0 || version == latest {
+			break
+		}
+		if tree.ndb.hasVersionReaders(version) {
+			first = false
+			continue
+		}
+		if first {
+			if err := tree.ndb.DeleteVersionsTo(version); err != nil {
+				return err
+			}
+		} else if err := tree.ndb.deleteVersionsBetween(version, version); err != nil {
+			return err
+		}
+		excess--
+	}
+	return tree.ndb.Commit()
+}
+
+// deleteVersionsBetween deletes the versions from fromVersion to toVersion, which must be
+// between two retained versions, and marks them as pruned.
+func (ndb *nodeDB) deleteVersionsBetween(fromVersion, toVersion int64) error {
+	// the nodes of the versions already pruned right before fromVersion may only be used by
+	// the range, so the range is extended over them.
+	for {
+		pruned, err := ndb.isPrunedVersion(fromVersion - 1)
+		if err != nil {
+			return err
+		}
+		if !pruned {
+			break
+		}
+		fromVersion--
+	}
+
+	ndb.mtx.Lock()
+	for v, r := range ndb.versionReaders {
+		if v >= fromVersion && v <= toVersion && r != 0 {
+			ndb.mtx.Unlock()
+			return fmt.Errorf("unable to delete version %d with %d active readers", v, r)
+		}
+	}
+	ndb.mtx.Unlock()
+
+	ndb.logger.Info("pruning started", "from", fromVersion, "to", toVersion)
+	if err := ndb.beginCommit(commitDeleteBetween, fromVersion, toVersion); err != nil {
+		return err
+	}
+	freed, err := ndb.deleteVersionRange(fromVersion, toVersion, true)
+	if err != nil {
+		return err
+	}
+	for version := fromVersion; version <= toVersion; version++ {
+		if err := ndb.batch.Set(prunedVersionKeyFormat.KeyInt64(version), []byte{}); err != nil {
+			return err
+		}
+	}
+	ndb.logger.Info("pruning finished", "from", fromVersion, "to", toVersion, "freed", freed)
+	return nil
+}
+
+// isPrunedVersion returns whether the version was pruned between retained versions.
+func (ndb *nodeDB) isPrunedVersion(version int64) (bool, error) {
+	return ndb.db.Has(prunedVersionKeyFormat.KeyInt64(version))
+}
+
+// prunedVersions returns the set of versions pruned between fromVersion and toVersion, inclusive.
+func (ndb *nodeDB) prunedVersions(fromVersion, toVersion int64) (map[int64]bool, error) {
+	pruned := make(map[int64]bool)
+	if err := ndb.traverseRange(prunedVersionKeyFormat.KeyInt64(fromVersion), prunedVersionKeyFormat.KeyInt64(toVersion+1), func(k, _ []byte) error {
+		pruned[int64(binary.BigEndian.Uint64(k[1:]))] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// deletePrunedVersionMarks deletes the marks of the pruned versions from fromVersion to
+// toVersion, inclusive, once they are no longer between retained versions.
+func (ndb *nodeDB) deletePrunedVersionMarks(fromVersion, toVersion int64) error {
+	pruned, err := ndb.prunedVersions(fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+	for version := range pruned {
+		if err := ndb.batch.Delete(prunedVersionKeyFormat.KeyInt64(version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneDryRun estimates the bytes deleteVersionsTo(toVersion) would free, following its steps
+// without deleting anything, and returns the version it would delete up to, which is extended
+// over the versions pruned right after toVersion, or 0 if it would delete nothing.
+func (ndb *nodeDB) pruneDryRun(toVersion int64) (int64, int64, error) {
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if legacyLatestVersion > toVersion {
+		return 0, 0, nil
+	}
+	first, err := ndb.getFirstVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if latest <= toVersion {
+		return 0, 0, fmt.Errorf("latest version %d is less than or equal to toVersion %d", latest, toVersion)
+	}
+	for {
+		pruned, err := ndb.isPrunedVersion(toVersion + 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !pruned {
+			break
+		}
+		toVersion++
+	}
+
+	ndb.mtx.Lock()
+	for v, r := range ndb.versionReaders {
+		if v >= first && v <= toVersion && r != 0 {
+			ndb.mtx.Unlock()
+			return 0, 0, fmt.Errorf("unable to delete version %d with %d active readers", v, r)
+		}
+	}
+	ndb.mtx.Unlock()
+	if legacyLatestVersion >= first {
+		first = legacyLatestVersion + 1
+	}
+
+	// the older nodes orphaned within the range, the nodes and roots of the range which the next
+	// version doesn't use, their key counts and the marks of the pruned versions, see
+	// deleteVersionRange.
+	var freed int64
+	if err := ndb.traverseOrphans(first, toVersion+1, func(orphan *Node) error {
+		if !orphan.isLegacy && orphan.nodeKey.version >= first {
+			return nil
+		}
+		key := ndb.nodeKey(orphan.GetKey())
+		if orphan.isLegacy {
+			key = ndb.legacyNodeKey(orphan.GetKey())
+		}
+		freed += int64(len(key) + orphan.encodedSize())
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	nextRootKey, err := ndb.GetRoot(toVersion + 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	live, liveValues, err := ndb.liveRangeNodes(first, toVersion, nextRootKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(first), nodeKeyPrefixFormat.KeyInt64(toVersion+1), func(k, v []byte) error {
+		if !live[string(k[1:])] {
+			freed += int64(len(k) + len(v))
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	if err := ndb.traverseRange(valueKeyFormat.Key(first), valueKeyFormat.Key(toVersion+1), func(k, v []byte) error {
+		if !liveValues[string(k)] {
+			freed += int64(len(k) + len(v))
+		}
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	for _, format := range []*keyformat.FastPrefixFormatter{keyCountKeyFormat, prunedVersionKeyFormat} {
+		if err := ndb.traverseRange(format.KeyInt64(first), format.KeyInt64(toVersion+1), func(k, v []byte) error {
+			freed += int64(len(k) + len(v))
+			return nil
+		}); err != nil {
+			return 0, 0, err
+		}
+	}
+	return toVersion, freed, nil
+}
@@ -0,0 +1,392 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// expectedRetainedVersions returns the versions the pruning policy retains from first to latest.
+func expectedRetainedVersions(opts PruningOptions, first, latest int64) []int {
+	var versions []int
+	for v := first; v <= latest; v++ {
+		if opts.retains(v, latest) {
+			versions = append(versions, int(v))
+		}
+	}
+	return versions
+}
+
+// savePolicyTestVersion saves a version with a few changes, and some versions without any in
+// order to have roots referring to the previous ones.
+func savePolicyTestVersion(t *testing.T, trees ...*MutableTree) {
+	for _, tree := range trees {
+		v := tree.WorkingVersion()
+		if v%4 != 3 {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v%7)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte(fmt.Sprintf("version-%d", v)), []byte("value"))
+			require.NoError(t, err)
+			if v%3 == 0 {
+				_, _, err = tree.Remove([]byte(fmt.Sprintf("version-%d", v-2)))
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+// requirePrunedConsistently checks that the retained versions match those of the tree saved
+// without pruning, and that exactly the nodes they use are left on disk.
+func requirePrunedConsistently(t *testing.T, tree, reference *MutableTree, db dbm.DB) {
+	expectedKeys := make(map[string]bool)
+	var walk func(nk []byte)
+	walk = func(nk []byte) {
+		node, err := tree.ndb.GetNode(nk)
+		require.NoError(t, err)
+		expectedKeys[string(nodeKeyFormat.Key(node.GetKey()))] = true
+		if !node.isLeaf() {
+			walk(node.leftNodeKey)
+			walk(node.rightNodeKey)
+		}
+	}
+	for _, version := range tree.AvailableVersions() {
+		expectedKeys[string(nodeKeyFormat.Key(GetRootKey(int64(version))))] = true
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		require.NoError(t, err)
+		if rootKey != nil {
+			walk(rootKey)
+		}
+
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		expected, err := reference.GetImmutable(int64(version))
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash(), "version %d", version)
+		var expectedPairs, pairs []string
+		expected.IterateRange(nil, nil, true, func(key, value []byte) bool {
+			expectedPairs = append(expectedPairs, string(key)+"="+string(value))
+			return false
+		})
+		itree.IterateRange(nil, nil, true, func(key, value []byte) bool {
+			pairs = append(pairs, string(key)+"="+string(value))
+			return false
+		})
+		require.Equal(t, expectedPairs, pairs, "version %d", version)
+	}
+
+	keys := make(map[string]bool)
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(k, _ []byte) error {
+		keys[string(k)] = true
+		return nil
+	}))
+	require.Equal(t, expectedKeys, keys)
+}
+
+func TestConfigurePruning(t *testing.T) {
+	opts := PruningOptions{KeepRecent: 3, KeepEvery: 5}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(opts))
+
+	for latest := int64(1); latest <= 60; latest++ {
+		savePolicyTestVersion(t, tree, reference)
+		expected := expectedRetainedVersions(opts, 1, latest)
+		require.Equal(t, expected, tree.AvailableVersions(), "latest %d", latest)
+		for v := int64(1); v <= latest; v++ {
+			require.Equal(t, opts.retains(v, latest), tree.VersionExists(v), "version %d", v)
+		}
+	}
+	require.Equal(t, []int{5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 58, 59, 60}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+
+	_, err := tree.GetImmutable(12)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the gaps are found again once reloaded.
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.AvailableVersions(), reloaded.AvailableVersions())
+	require.False(t, reloaded.VersionExists(4))
+	require.False(t, reloaded.VersionExists(57))
+	_, err = reloaded.LoadVersion(12)
+	require.Error(t, err)
+	_, err = reloaded.LoadVersion(25)
+	require.NoError(t, err)
+
+	// the state changes of a retained version include those of the versions pruned before it.
+	var changed []int64
+	require.NoError(t, tree.TraverseStateChanges(1, 60, func(version int64, _ *ChangeSet) error {
+		changed = append(changed, version)
+		return nil
+	}))
+	require.Equal(t, []int64{5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 58, 59, 60}, changed)
+}
+
+func TestConfigurePruning_ExistingVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 23; i++ {
+		savePolicyTestVersion(t, tree, reference)
+	}
+
+	// the policy applies to the versions saved before it was configured.
+	opts := PruningOptions{KeepRecent: 2, KeepEvery: 10}
+	require.NoError(t, tree.ConfigurePruning(opts))
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{10, 20, 23, 24}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+
+	// restarting with another policy prunes the versions it no longer retains.
+	opts = PruningOptions{KeepRecent: 1, KeepEvery: 20}
+	require.NoError(t, tree.ConfigurePruning(opts))
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{20, 25}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+
+	// the other deletions skip the gaps.
+	for i := 0; i < 16; i++ {
+		savePolicyTestVersion(t, tree, reference)
+	}
+	require.Equal(t, []int{20, 40, 41}, tree.AvailableVersions())
+	previous, err := tree.UncommitLatest()
+	require.NoError(t, err)
+	require.Equal(t, int64(40), previous)
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{}))
+	_, err = reference.UncommitLatest()
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		savePolicyTestVersion(t, tree, reference)
+	}
+	require.Equal(t, []int{20, 40, 41, 42, 43}, tree.AvailableVersions())
+	require.NoError(t, tree.DeleteVersionsTo(20))
+	require.Equal(t, []int{40, 41, 42, 43}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+	require.NoError(t, tree.LoadVersionForOverwriting(40))
+	require.Equal(t, []int{40}, tree.AvailableVersions())
+}
+
+func TestConfigurePruning_Interval(t *testing.T) {
+	opts := PruningOptions{KeepRecent: 2, Interval: 10}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.ConfigurePruning(opts))
+
+	for i := 0; i < 9; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}, tree.AvailableVersions())
+	// the versions are only pruned on the multiples of the interval.
+	for i := 0; i < 6; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Equal(t, []int{9, 10, 11, 12, 13, 14, 15}, tree.AvailableVersions())
+	for i := 0; i < 5; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	require.Equal(t, []int{19, 20}, tree.AvailableVersions())
+}
+
+func TestConfigurePruning_Invalid(t *testing.T) {
+	tree := setupMutableTree(false)
+	require.ErrorIs(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 0, KeepEvery: 5}), ErrInvalidInputs)
+	require.ErrorIs(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1, KeepEvery: -1}), ErrInvalidInputs)
+	require.ErrorIs(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1, Interval: -1}), ErrInvalidInputs)
+	require.ErrorIs(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1, Async: true, RateLimit: -1}), ErrInvalidInputs)
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{KeepRecent: 1}))
+	require.NoError(t, tree.ConfigurePruning(PruningOptions{}))
+}
+
+func TestMaxRetainedVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), MaxRetainedVersionsOption(4))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for latest := 1; latest <= 20; latest++ {
+		savePolicyTestVersion(t, tree, reference)
+		expected := []int{}
+		for v := max(1, latest-3); v <= latest; v++ {
+			expected = append(expected, v)
+		}
+		require.Equal(t, expected, tree.AvailableVersions(), "latest %d", latest)
+	}
+	requirePrunedConsistently(t, tree, reference, db)
+
+	// a version being read is retained, the next oldest ones being pruned instead, and it is
+	// pruned once it is no longer read.
+	pinned, err := tree.GetImmutable(17)
+	require.NoError(t, err)
+	exporter, err := pinned.Export()
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		savePolicyTestVersion(t, tree, reference)
+	}
+	require.Equal(t, []int{17, 21, 22, 23}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+	exporter.Close()
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{21, 22, 23, 24}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+
+	// the cap is exceeded while the older versions are all being read.
+	var exporters []*Exporter
+	for _, version := range []int64{21, 22, 23} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		exporter, err := itree.Export()
+		require.NoError(t, err)
+		exporters = append(exporters, exporter)
+	}
+	tree.ndb.incrVersionReaders(24)
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{21, 22, 23, 24, 25}, tree.AvailableVersions())
+	tree.ndb.decrVersionReaders(24)
+	for _, exporter := range exporters {
+		exporter.Close()
+	}
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{23, 24, 25, 26}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+
+	// the cap applies to the versions saved before it was set.
+	db = dbm.NewMemDB()
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	reference = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		savePolicyTestVersion(t, tree, reference)
+	}
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), MaxRetainedVersionsOption(2))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	savePolicyTestVersion(t, tree, reference)
+	require.Equal(t, []int{10, 11}, tree.AvailableVersions())
+	requirePrunedConsistently(t, tree, reference, db)
+}
+
+func TestMaxRetainedVersions_Legacy(t *testing.T) {
+	legacyVersion := 10
+	tree := openLegacyTree(t, legacyVersion, MaxRetainedVersionsOption(8))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	legacy := len(tree.AvailableVersions())
+	require.Positive(t, legacy)
+
+	// the legacy versions are retained until they can all be deleted.
+	for i := 0; i < 7; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.Len(t, tree.AvailableVersions(), legacy+i+1)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{11, 12, 13, 14, 15, 16, 17, 18}, tree.AvailableVersions())
+}
+
+func TestMaxOrphansPerBatch(t *testing.T) {
+	const maxOrphans = 100
+	setKeys := func(version int, trees ...*MutableTree) {
+		for _, tree := range trees {
+			for i := 0; i < 2000; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	for _, option := range []int{0, maxOrphans} {
+		// the flush threshold is high, so only the orphans bound the batches.
+		db := &spillDB{DB: dbm.NewMemDB()}
+		tree := NewMutableTree(db, 0, true, NewNopLogger(), MaxOrphansPerBatchOption(option), FlushThresholdOption(64<<20))
+		reference := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+		// every version orphans all the nodes of the previous one.
+		for version := 1; version <= 4; version++ {
+			setKeys(version, tree, reference)
+		}
+
+		db.writes = 0
+		require.NoError(t, tree.DeleteVersionsTo(2))
+		if option == 0 {
+			require.Equal(t, 1, db.writes)
+		} else {
+			// the nodes of two versions are deleted, with the commit.
+			require.GreaterOrEqual(t, db.writes, 2*4000/maxOrphans)
+		}
+		require.Equal(t, []int{3, 4}, tree.AvailableVersions())
+		requirePrunedConsistently(t, tree, reference, db)
+
+		// the tree is pruned further once reloaded.
+		setKeys(5, tree, reference)
+		tree = NewMutableTree(db, 0, true, NewNopLogger(), MaxOrphansPerBatchOption(option))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		require.NoError(t, tree.DeleteVersionsTo(4))
+		require.Equal(t, []int{5}, tree.AvailableVersions())
+		requirePrunedConsistently(t, tree, reference, db)
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		savePolicyTestVersion(t, tree)
+	}
+	// versions pruned right after the target are deleted along.
+	require.NoError(t, tree.ndb.deleteVersionsBetween(11, 12))
+	require.NoError(t, tree.ndb.Commit())
+
+	dbBytes := func() (size int64) {
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			size += int64(len(itr.Key()) + len(itr.Value()))
+		}
+		return size
+	}
+	for _, target := range []int64{5, 10, 15} {
+		before := tree.AvailableVersions()
+		size := dbBytes()
+		removed, estimate, err := tree.PruneDryRun(target)
+		require.NoError(t, err)
+		// nothing is deleted by the dry run.
+		require.Equal(t, before, tree.AvailableVersions())
+		require.Equal(t, size, dbBytes())
+
+		require.NoError(t, tree.DeleteVersionsTo(target))
+		after := tree.AvailableVersions()
+		require.Equal(t, intsToInt64s(before[:len(before)-len(after)]), removed, "target %d", target)
+		freed := size - dbBytes()
+		require.Positive(t, freed)
+		require.InDelta(t, float64(freed), float64(estimate), 0.05*float64(freed), "target %d", target)
+	}
+	require.Equal(t, 16, tree.AvailableVersions()[0])
+
+	// the dry run fails as the deletion would.
+	_, _, err := tree.PruneDryRun(20)
+	require.Error(t, err)
+	tree.ndb.incrVersionReaders(17)
+	_, _, err = tree.PruneDryRun(18)
+	require.Error(t, err)
+	tree.ndb.decrVersionReaders(17)
+	removed, _, err := tree.PruneDryRun(18)
+	require.NoError(t, err)
+	require.Equal(t, []int64{16, 17, 18}, removed)
+}
+
+// intsToInt64s converts versions returned by AvailableVersions to the versions of PruneDryRun.
+func intsToInt64s(versions []int) []int64 {
+	res := make([]int64, len(versions))
+	for i, v := range versions {
+		res[i] = int64(v)
+	}
+	return res
+}
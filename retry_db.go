@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"time"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// RetryPolicy retries the operations of the DB failing with transient errors, see the DBRetry
+// option.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is attempted before its error is
+	// returned. 0 and 1 disable the retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each next one.
+	Backoff time.Duration
+	// Retryable reports whether an error is transient, so that the operation is retried. The
+	// other errors are returned right away. nil disables the retries.
+	Retryable func(err error) bool
+}
+
+// enabled returns whether the policy retries any operation.
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1 && p.Retryable != nil
+}
+
+// do runs op until it succeeds, fails with an error which isn't retryable, or was attempted
+// MaxAttempts times, and returns its last error.
+func (p RetryPolicy) do(op func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !p.Retryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryingDB retries the operations of a DB with a RetryPolicy. The reads are retried, as well
+// as the creation of the iterators, but not the iterations themselves, which can't be resumed.
+// The writes are only retried when a batch is written: writing the same batch again is
+// idempotent, since it sets and deletes the same keys, so a batch partially written by a failed
+// attempt is only written once.
+type retryingDB struct {
+	dbm.DB
+	policy RetryPolicy
+}
+
+var _ dbm.DB = (*retryingDB)(nil)
+
+// withRetries returns db retrying its operations with the policy, if it is enabled.
+func withRetries(db dbm.DB, policy RetryPolicy) dbm.DB {
+	if !policy.enabled() {
+		return db
+	}
+	return &retryingDB{DB: db, policy: policy}
+}
+
+// Get implements dbm.DB.
+func (db *retryingDB) Get(key []byte) (value []byte, err error) {
+	err = db.policy.do(func() error {
+		value, err = db.DB.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Has implements dbm.DB.
+func (db *retryingDB) Has(key []byte) (has bool, err error) {
+	err = db.policy.do(func() error {
+		has, err = db.DB.Has(key)
+		return err
+	})
+	return has, err
+}
+
+// Iterator implements dbm.DB.
+func (db *retryingDB) Iterator(start, end []byte) (itr dbm.Iterator, err error) {
+	err = db.policy.do(func() error {
+		itr, err = db.DB.Iterator(start, end)
+		return err
+	})
+	return itr, err
+}
+
+// ReverseIterator implements dbm.DB.
+func (db *retryingDB) ReverseIterator(start, end []byte) (itr dbm.Iterator, err error) {
+	err = db.policy.do(func() error {
+		itr, err = db.DB.ReverseIterator(start, end)
+		return err
+	})
+	return itr, err
+}
+
+// NewBatch implements dbm.DB.
+func (db *retryingDB) NewBatch() dbm.Batch {
+	return &retryingBatch{Batch: db.DB.NewBatch(), policy: db.policy}
+}
+
+// NewBatchWithSize implements dbm.DB.
+func (db *retryingDB) NewBatchWithSize(size int) dbm.Batch {
+	return &retryingBatch{Batch: db.DB.NewBatchWithSize(size), policy: db.policy}
+}
+
+// retryingBatch is a batch of a retryingDB, whose writes are retried.
+type retryingBatch struct {
+	dbm.Batch
+	policy RetryPolicy
+}
+
+// Write implements dbm.Batch.
+func (b *retryingBatch) Write() error {
+	return b.policy.do(b.Batch.Write)
+}
+
+// WriteSync implements dbm.Batch.
+func (b *retryingBatch) WriteSync() error {
+	return b.policy.do(b.Batch.WriteSync)
+}
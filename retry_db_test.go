@@ -0,0 +1,168 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+var (
+	errTransient = errors.New("transient error")
+	errPermanent = errors.New("permanent error")
+)
+
+// flakyDB fails the reads and the batch writes with err, the given number of times, counting
+// the failed attempts.
+type flakyDB struct {
+	*dbm.MemDB
+
+	mtx      sync.Mutex
+	err      error
+	failures int
+	failed   int
+}
+
+// fail fails the next n operations with err.
+func (db *flakyDB) fail(n int, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.failures, db.err, db.failed = n, err, 0
+}
+
+// attempt returns the error an attempt fails with, if any.
+func (db *flakyDB) attempt() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.failures == 0 {
+		return nil
+	}
+	db.failures--
+	db.failed++
+	return db.err
+}
+
+func (db *flakyDB) Get(key []byte) ([]byte, error) {
+	if err := db.attempt(); err != nil {
+		return nil, err
+	}
+	return db.MemDB.Get(key)
+}
+
+func (db *flakyDB) NewBatch() dbm.Batch {
+	return &flakyBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *flakyDB) NewBatchWithSize(size int) dbm.Batch {
+	return &flakyBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type flakyBatch struct {
+	dbm.Batch
+	db *flakyDB
+}
+
+func (b *flakyBatch) Write() error {
+	if err := b.db.attempt(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func (b *flakyBatch) WriteSync() error {
+	if err := b.db.attempt(); err != nil {
+		return err
+	}
+	return b.Batch.WriteSync()
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	Backoff:     time.Millisecond,
+	Retryable:   func(err error) bool { return errors.Is(err, errTransient) },
+}
+
+func setRetryVersion(t *testing.T, tree *MutableTree, version int) {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", (version*7+i)%40)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+		require.NoError(t, err)
+	}
+}
+
+func TestDBRetry(t *testing.T) {
+	db := &flakyDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), DBRetryOption(testRetryPolicy))
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		setRetryVersion(t, tree, version)
+		setRetryVersion(t, reference, version)
+
+		// the commit succeeds once the transient failures are over.
+		db.fail(3, errTransient)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, 3, db.failed)
+		expectedHash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash)
+	}
+
+	// the reads are retried as well.
+	loaded := NewMutableTree(db, 0, true, log.NewNopLogger(), DBRetryOption(testRetryPolicy))
+	db.fail(3, errTransient)
+	version, err := loaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, reference.Hash(), loaded.Hash())
+	for i := 0; i < 40; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		db.fail(2, errTransient)
+		value, err := loaded.GetVersioned(key, 2)
+		require.NoError(t, err)
+		expected, err := reference.GetVersioned(key, 2)
+		require.NoError(t, err)
+		require.Equal(t, expected, value)
+	}
+}
+
+func TestDBRetry_Failure(t *testing.T) {
+	for name, tc := range map[string]struct {
+		options  []Option
+		failures int
+		err      error
+		attempts int
+	}{
+		"permanent":    {options: []Option{DBRetryOption(testRetryPolicy)}, failures: 1, err: errPermanent, attempts: 1},
+		"exhausted":    {options: []Option{DBRetryOption(testRetryPolicy)}, failures: 4, err: errTransient, attempts: 4},
+		"no retry":     {failures: 1, err: errTransient, attempts: 1},
+		"no predicate": {options: []Option{DBRetryOption(RetryPolicy{MaxAttempts: 4})}, failures: 1, err: errTransient, attempts: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := &flakyDB{MemDB: dbm.NewMemDB()}
+			tree := NewMutableTree(db, 0, false, log.NewNopLogger(), tc.options...)
+			setRetryVersion(t, tree, 1)
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// the commit fails without retrying more, and can be retried once the DB recovers.
+			setRetryVersion(t, tree, 2)
+			db.fail(tc.failures, tc.err)
+			_, _, err = tree.SaveVersion()
+			require.ErrorIs(t, err, tc.err)
+			require.Equal(t, tc.attempts, db.failed)
+			require.EqualValues(t, 1, tree.Version())
+
+			db.fail(0, nil)
+			_, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.EqualValues(t, 2, version)
+		})
+	}
+}
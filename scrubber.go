@@ -0,0 +1,318 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrScrubberRunning is returned when starting a scrubber while another one is running.
+var ErrScrubberRunning = errors.New("scrubber is already running")
+
+// scrubChunkSize is the number of nodes the scrubber reads per iteration of the database, so
+// that it doesn't hold an iterator open for long.
+const scrubChunkSize = 100
+
+// ScrubOptions configure the scrubber started by MutableTree.StartScrubber.
+type ScrubOptions struct {
+	// NodesPerSecond bounds the rate at which the nodes are verified, so that the scrubber
+	// doesn't impact serving. It must be positive.
+	NodesPerSecond int
+	// OnCorruption is called with the node key of every node which fails verification, and the
+	// reason. It is called from the scrubber goroutine.
+	OnCorruption func(nodeKey []byte, err error)
+	// From is the node key to start after, e.g. the ScrubPosition of a previous run. The
+	// scrubber starts after the position of the last scrubber of the tree if nil, and from the
+	// first node if there is none.
+	From []byte
+}
+
+// scrubber is a running scrubber, see StartScrubber.
+type scrubber struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartScrubber starts a background goroutine which continuously verifies the nodes stored for
+// all the versions, and calls opts.OnCorruption for every node which can't be decoded or whose
+// hash doesn't match its children's. It reads the nodes from the database, bypassing the caches,
+// at most opts.NodesPerSecond per second, and starts over from the first node after the last
+// one. The nodes of the legacy versions are not verified. StopScrubber stops it, and
+// ScrubPosition returns the last verified node, from which a scrubber resumes.
+func (tree *MutableTree) StartScrubber(opts ScrubOptions) error {
+	if opts.NodesPerSecond <= 0 {
+		return fmt.Errorf("scrub rate must be positive, got %d: %w", opts.NodesPerSecond, ErrInvalidInputs)
+	}
+	if opts.OnCorruption == nil {
+		return fmt.Errorf("nil corruption callback: %w", ErrInvalidInputs)
+	}
+
+	tree.scrubMtx.Lock()
+	defer tree.scrubMtx.Unlock()
+	if tree.scrubber != nil {
+		return ErrScrubberRunning
+	}
+	if opts.From != nil {
+		tree.scrubPosition = bytes.Clone(opts.From)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scrubber{cancel: cancel, done: make(chan struct{})}
+	tree.scrubber = s
+	go func() {
+		defer close(s.done)
+		tree.scrub(ctx, opts)
+	}()
+	return nil
+}
+
+// StopScrubber stops the scrubber started by StartScrubber and waits for it to exit. It is a
+// no-op if none is running.
+func (tree *MutableTree) StopScrubber() {
+	tree.scrubMtx.Lock()
+	s := tree.scrubber
+	tree.scrubber = nil
+	tree.scrubMtx.Unlock()
+	if s != nil {
+		s.cancel()
+		<-s.done
+	}
+}
+
+// ScrubPosition returns the node key of the last node verified by the scrubber, nil if none.
+func (tree *MutableTree) ScrubPosition() []byte {
+	tree.scrubMtx.Lock()
+	defer tree.scrubMtx.Unlock()
+	return bytes.Clone(tree.scrubPosition)
+}
+
+func (tree *MutableTree) scrub(ctx context.Context, opts ScrubOptions) {
+	ticker := time.NewTicker(time.Second / time.Duration(opts.NodesPerSecond))
+	defer ticker.Stop()
+
+	for {
+		tree.scrubMtx.Lock()
+		position := tree.scrubPosition
+		tree.scrubMtx.Unlock()
+
+		nodes, err := tree.ndb.scrubChunk(position)
+		if err != nil {
+			tree.logger.Error("scrubber failed to read the nodes", "err", err)
+		}
+		if len(nodes) == 0 {
+			// starts over, or retries a failed read, at the next tick.
+			tree.scrubMtx.Lock()
+			tree.scrubPosition = nil
+			tree.scrubMtx.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		for _, node := range nodes {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := tree.ndb.scrubNode(node.nodeKey, node.value); err != nil {
+				opts.OnCorruption(bytes.Clone(node.nodeKey), err)
+			}
+			tree.scrubMtx.Lock()
+			tree.scrubPosition = node.nodeKey
+			tree.scrubMtx.Unlock()
+		}
+	}
+}
+
+// scrubbedNode is a node read by the scrubber, before it is verified.
+type scrubbedNode struct {
+	nodeKey []byte
+	value   []byte
+}
+
+// scrubChunk reads the next scrubChunkSize nodes after the given node key, from the first one
+// if nil. The empty and reference roots are skipped.
+func (ndb *nodeDB) scrubChunk(after []byte) ([]scrubbedNode, error) {
+	start := nodeKeyFormat.Prefix()
+	if after != nil {
+		// the smallest key after it.
+		start = append(ndb.nodeKey(after), 0)
+	}
+	end := []byte{nodeKeyFormat.Prefix()[0] + 1}
+	itr, err := ndb.db.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var nodes []scrubbedNode
+	for ; itr.Valid() && len(nodes) < scrubChunkSize; itr.Next() {
+		value := itr.Value()
+		if len(value) == 0 {
+			continue
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			continue
+		}
+		nodes = append(nodes, scrubbedNode{nodeKey: bytes.Clone(itr.Key()[1:]), value: bytes.Clone(value)})
+	}
+	return nodes, itr.Error()
+}
+
+// scrubNode verifies a node read from the database: that it decodes, and for an inner node that
+// its hash is the one of its children read from the database as well. Nodes deleted by pruning
+// meanwhile are not reported.
+func (ndb *nodeDB) scrubNode(nk, value []byte) error {
+	node, err := makeNode(nk, value, ndb.valueCodec(), ndb.hashScheme())
+	if err != nil {
+		return err
+	}
+	if node.isLeaf() {
+		// the hash of a leaf is computed from its contents, so its parent verifies it, but for
+		// the value stored apart, which is verified against the hash the leaf holds.
+		if !node.external {
+			return nil
+		}
+		if err := ndb.scrubValue(node, value); err != nil {
+			if exists, existsErr := ndb.db.Has(ndb.nodeKey(nk)); existsErr == nil && !exists {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+
+	var hashes [2][]byte
+	for i, childKey := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+		child, err := ndb.readNode(childKey)
+		if err != nil {
+			if exists, existsErr := ndb.db.Has(ndb.nodeKey(nk)); existsErr == nil && !exists {
+				return nil
+			}
+			return fmt.Errorf("child %X: %w", childKey, err)
+		}
+		hashes[i] = child.hash
+	}
+	hash, err := ProofInnerNode{
+		Height:  node.subtreeHeight,
+		Size:    node.size,
+		Version: node.nodeKey.version,
+		Left:    hashes[0],
+	}.hashWith(ndb.hashScheme(), hashes[1])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, node.hash) {
+		return fmt.Errorf("hash %X doesn't match the hash %X of the children", node.hash, hash)
+	}
+	return nil
+}
+
+// readNode reads and decodes a node from the database as GetNode does, but bypassing the cache.
+func (ndb *nodeDB) readNode(nk []byte) (*Node, error) {
+	if len(nk) == hashSize {
+		buf, err := ndb.db.Get(ndb.legacyNodeKey(nk))
+		if err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			return nil, fmt.Errorf("legacy node %X is missing", nk)
+		}
+		return MakeLegacyNode(nk, buf)
+	}
+	buf, err := ndb.db.Get(ndb.nodeKey(nk))
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("node %X is missing", nk)
+	}
+	return makeNode(nk, buf, ndb.valueCodec(), ndb.hashScheme())
+}
+
+// RecomputeVersionHash recomputes the hashes of the nodes of the given version bottom-up, from
+// the nodes stored in the database rather than the cached ones, and rewrites the nodes whose
+// stored hash is stale, e.g. after the database was repaired by hand, along with their size and
+// height, which are re-derived from their children as well. It returns the root hash
+// of the version, and whether any node was rewritten, which is never the case for a healthy
+// version. The versions sharing the rewritten nodes are repaired along. The legacy nodes are
+// keyed by their hash, so their hashes are trusted. It reads all the nodes of the version, so
+// it is meant to be run offline, and the tree is reloaded, discarding its unsaved changes, if
+// its latest version is repaired.
+func (tree *MutableTree) RecomputeVersionHash(version int64) (newHash []byte, changed bool, err error) {
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, false, err
+	}
+	if rootKey == nil {
+		return tree.ndb.hashScheme().EmptyHash(), false, nil
+	}
+
+	repaired := 0
+	newHash, _, _, err = tree.ndb.recomputeHash(rootKey, &repaired)
+	if err != nil {
+		return nil, false, err
+	}
+	if repaired == 0 {
+		return newHash, false, nil
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return nil, false, err
+	}
+	tree.logger.Info("repaired stale node hashes", "version", version, "nodes", repaired)
+	tree.immutableCache.reset()
+	if version == tree.version {
+		if _, err := tree.LoadVersion(version); err != nil {
+			return nil, false, err
+		}
+	}
+	return newHash, true, nil
+}
+
+// recomputeHash recomputes the hash, size and height of the node with the given node key and of
+// its descendants, read from the database, saves the nodes whose stored ones differ, counting
+// them in repaired, and returns them.
+func (ndb *nodeDB) recomputeHash(nk []byte, repaired *int) ([]byte, int64, int8, error) {
+	node, err := ndb.readNode(nk)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	// the hash of a leaf is computed from its contents when it is read.
+	if node.isLegacy || node.isLeaf() {
+		return node.hash, node.size, node.subtreeHeight, nil
+	}
+
+	left, leftSize, leftHeight, err := ndb.recomputeHash(node.leftNodeKey, repaired)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	right, rightSize, rightHeight, err := ndb.recomputeHash(node.rightNodeKey, repaired)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size, height := leftSize+rightSize, maxInt8(leftHeight, rightHeight)+1
+	hash, err := ProofInnerNode{
+		Height:  height,
+		Size:    size,
+		Version: node.nodeKey.version,
+		Left:    left,
+	}.hashWith(ndb.hashScheme(), right)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if bytes.Equal(hash, node.hash) && size == node.size && height == node.subtreeHeight {
+		return hash, size, height, nil
+	}
+	node.hash, node.size, node.subtreeHeight = hash, size, height
+	if err := ndb.SaveNode(node); err != nil {
+		return nil, 0, 0, err
+	}
+	*repaired++
+	return hash, size, height, nil
+}
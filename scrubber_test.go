@@ -0,0 +1,196 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"cosmossdk.io/log"
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// scrubReports records the nodes reported by a scrubber.
+type scrubReports struct {
+	mtx   sync.Mutex
+	nodes map[string]error
+}
+
+func (r *scrubReports) report(nodeKey []byte, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.nodes[string(nodeKey)] = err
+}
+
+func (r *scrubReports) reported() map[string]error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	nodes := make(map[string]error, len(r.nodes))
+	for k, v := range r.nodes {
+		nodes[k] = v
+	}
+	return nodes
+}
+
+func TestScrubber(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	before := runtime.NumGoroutine()
+
+	// a healthy tree isn't reported, and the scrubber resumes where it stopped.
+	reports := &scrubReports{nodes: map[string]error{}}
+	require.NoError(t, tree.StartScrubber(ScrubOptions{NodesPerSecond: 10000, OnCorruption: reports.report}))
+	require.ErrorIs(t, tree.StartScrubber(ScrubOptions{NodesPerSecond: 10000, OnCorruption: reports.report}), ErrScrubberRunning)
+	time.Sleep(50 * time.Millisecond)
+	tree.StopScrubber()
+	position := tree.ScrubPosition()
+	require.NotNil(t, position)
+	require.Empty(t, reports.reported())
+
+	// corrupt the value of a leaf of the first version, which its parent doesn't match anymore.
+	rootKey, err := tree.ndb.GetRoot(1)
+	require.NoError(t, err)
+	root, err := tree.ndb.GetNode(rootKey)
+	require.NoError(t, err)
+	parent := root
+	for {
+		left, err := parent.getLeftNode(tree.ImmutableTree)
+		require.NoError(t, err)
+		if left.isLeaf() {
+			break
+		}
+		parent = left
+	}
+	leaf, err := tree.ndb.readNode(parent.leftNodeKey)
+	require.NoError(t, err)
+	leaf.value = []byte("corrupted")
+	leaf.hash = nil
+	var buf bytes.Buffer
+	require.NoError(t, leaf.writeBytes(&buf))
+	require.NoError(t, db.Set(tree.ndb.nodeKey(parent.leftNodeKey), buf.Bytes()))
+
+	reports = &scrubReports{nodes: map[string]error{}}
+	require.NoError(t, tree.StartScrubber(ScrubOptions{NodesPerSecond: 10000, OnCorruption: reports.report}))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(reports.reported()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tree.StopScrubber()
+	tree.StopScrubber()
+	reported := reports.reported()
+	require.Len(t, reported, 1)
+	require.Contains(t, reported, string(parent.GetKey()))
+
+	// no goroutine is left.
+	deadline = time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before)
+
+	// resuming after the last node restarts from the first one.
+	reports = &scrubReports{nodes: map[string]error{}}
+	require.NoError(t, tree.StartScrubber(ScrubOptions{NodesPerSecond: 10000, OnCorruption: reports.report, From: []byte{0xff}}))
+	deadline = time.Now().Add(5 * time.Second)
+	for len(reports.reported()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tree.StopScrubber()
+	require.Len(t, reports.reported(), 1)
+
+	require.ErrorIs(t, tree.StartScrubber(ScrubOptions{OnCorruption: reports.report}), ErrInvalidInputs)
+	require.ErrorIs(t, tree.StartScrubber(ScrubOptions{NodesPerSecond: 1}), ErrInvalidInputs)
+}
+
+func TestRecomputeVersionHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger())
+	hashes := map[int64][]byte{}
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+
+	// a healthy version is left untouched.
+	for version, expected := range hashes {
+		hash, changed, err := tree.RecomputeVersionHash(version)
+		require.NoError(t, err)
+		require.False(t, changed)
+		require.Equal(t, expected, hash)
+	}
+
+	// corrupt the stored hash of the root of version 2, and of an inner node of version 3.
+	corrupt := func(nk []byte) {
+		node, err := tree.ndb.readNode(nk)
+		require.NoError(t, err)
+		node.hash = bytes.Repeat([]byte{0xab}, hashSize)
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		require.NoError(t, db.Set(tree.ndb.nodeKey(nk), buf.Bytes()))
+	}
+	rootKey, err := tree.ndb.GetRoot(2)
+	require.NoError(t, err)
+	corrupt(rootKey)
+	rootKey, err = tree.ndb.GetRoot(3)
+	require.NoError(t, err)
+	root, err := tree.ndb.readNode(rootKey)
+	require.NoError(t, err)
+	corrupt(root.leftNodeKey)
+
+	tree = NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	require.NotEqual(t, hashes[2], itree.Hash())
+
+	for _, version := range []int64{2, 3} {
+		hash, changed, err := tree.RecomputeVersionHash(version)
+		require.NoError(t, err)
+		require.True(t, changed, "version %d", version)
+		require.Equal(t, hashes[version], hash)
+		_, changed, err = tree.RecomputeVersionHash(version)
+		require.NoError(t, err)
+		require.False(t, changed)
+	}
+	// the latest version is reloaded.
+	require.Equal(t, hashes[3], tree.Hash())
+
+	// the repaired versions are read and proven with their fresh hashes.
+	tree = NewMutableTree(db, 0, false, log.NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for version, expected := range hashes {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, itree.Hash())
+		for _, key := range [][]byte{[]byte("key-00"), []byte("key-25"), []byte("key-49")} {
+			proof, err := itree.GetMembershipProof(key)
+			require.NoError(t, err)
+			value, err := itree.Get(key)
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, expected, proof, key, value), "version %d", version)
+		}
+	}
+
+	_, _, err = tree.RecomputeVersionHash(4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
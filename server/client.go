@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cosmos/iavl"
+	iavlproto "github.com/cosmos/iavl/server/proto"
+)
+
+// Client queries a tree served by a Server. A version of 0 is the latest saved version of the
+// tree. The errors for a missing version wrap iavl.ErrVersionDoesNotExist, and the ones for
+// invalid arguments, e.g. an empty key, wrap iavl.ErrInvalidInputs.
+type Client struct {
+	query iavlproto.QueryClient
+}
+
+// NewClient returns a Client querying the server at the other end of conn.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{query: iavlproto.NewQueryClient(conn)}
+}
+
+// Get returns the value of key at the version, nil if the key isn't in the tree.
+func (c *Client) Get(ctx context.Context, version int64, key []byte) ([]byte, error) {
+	res, err := c.query.Get(ctx, &iavlproto.GetRequest{Version: version, Key: key})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return foundValue(res.Found, res.Value), nil
+}
+
+// GetWithProof returns the value of key at the version, nil if the key isn't in the tree, with
+// its proof, of membership or of non-membership. The proof should be verified against a root
+// hash the caller trusts, e.g. with ics23.VerifyMembership and ics23.IavlSpec, since it is only
+// as trustworthy as the server otherwise.
+func (c *Client) GetWithProof(ctx context.Context, version int64, key []byte) ([]byte, *ics23.CommitmentProof, error) {
+	res, err := c.query.GetWithProof(ctx, &iavlproto.GetWithProofRequest{Version: version, Key: key})
+	if err != nil {
+		return nil, nil, fromStatus(err)
+	}
+	proof := &ics23.CommitmentProof{}
+	if err := proof.Unmarshal(res.Proof); err != nil {
+		return nil, nil, fmt.Errorf("invalid proof of key %X: %w", key, err)
+	}
+	return foundValue(res.Found, res.Value), proof, nil
+}
+
+// Range calls fn with the key-value pairs of the keys in [start, end) at the version, in
+// ascending key order or descending if ascending is false, until fn returns false or limit
+// pairs were passed, 0 for no limit. A nil start or end leaves that side unbounded.
+func (c *Client) Range(ctx context.Context, version int64, start, end []byte, ascending bool, limit uint32, fn func(key, value []byte) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.query.Range(ctx, &iavlproto.RangeRequest{
+		Version:    version,
+		Start:      start,
+		End:        end,
+		Descending: !ascending,
+		Limit:      limit,
+	})
+	if err != nil {
+		return fromStatus(err)
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		if !fn(res.Key, res.Value) {
+			return nil
+		}
+	}
+}
+
+// Versions returns the available versions in ascending order.
+func (c *Client) Versions(ctx context.Context) ([]int64, error) {
+	res, err := c.query.Versions(ctx, &iavlproto.VersionsRequest{})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return res.Versions, nil
+}
+
+// LatestVersion returns the latest saved version, 0 if none was saved.
+func (c *Client) LatestVersion(ctx context.Context) (int64, error) {
+	res, err := c.query.Versions(ctx, &iavlproto.VersionsRequest{})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+	return res.Latest, nil
+}
+
+// Root returns the root hash of the version, and the version itself, which is the latest one
+// if version is 0.
+func (c *Client) Root(ctx context.Context, version int64) ([]byte, int64, error) {
+	res, err := c.query.Root(ctx, &iavlproto.RootRequest{Version: version})
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+	return res.Hash, res.Version, nil
+}
+
+// foundValue returns the value of a response, nil if the key wasn't found and non-nil if it was,
+// since an empty value is decoded as nil.
+func foundValue(found bool, value []byte) []byte {
+	switch {
+	case !found:
+		return nil
+	case value == nil:
+		return []byte{}
+	default:
+		return value
+	}
+}
+
+// fromStatus converts a gRPC status error of the server into an error wrapping the matching
+// error of the tree, see toStatus.
+func fromStatus(err error) error {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return fmt.Errorf("%s: %w", status.Convert(err).Message(), iavl.ErrInvalidInputs)
+	case codes.NotFound:
+		return fmt.Errorf("%s: %w", status.Convert(err).Message(), iavl.ErrVersionDoesNotExist)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,151 @@
+// Package server serves the reads of an IAVL tree over gRPC, so that light services can query
+// a store remotely, e.g. for its values and their proofs, without linking the whole node. The
+// Query service is defined in proto/query.proto, and Client is its Go client.
+package server
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cosmos/iavl"
+	iavlproto "github.com/cosmos/iavl/server/proto"
+)
+
+// Server implements the Query service over a tree. The queries read the saved versions only, the
+// latest one being a snapshot, see MutableTree.Snapshot, so they may be served concurrently with
+// the writes to the tree.
+type Server struct {
+	iavlproto.UnimplementedQueryServer
+
+	tree *iavl.MutableTree
+}
+
+var _ iavlproto.QueryServer = (*Server)(nil)
+
+// NewServer returns a Server querying the tree.
+func NewServer(tree *iavl.MutableTree) *Server {
+	return &Server{tree: tree}
+}
+
+// Register registers the Query service of the server with the gRPC server.
+func (s *Server) Register(gs *grpc.Server) {
+	iavlproto.RegisterQueryServer(gs, s)
+}
+
+// Get implements the Get method of the Query service.
+func (s *Server) Get(_ context.Context, req *iavlproto.GetRequest) (*iavlproto.GetResponse, error) {
+	t, err := s.immutable(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	value, err := t.Get(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &iavlproto.GetResponse{Version: t.Version(), Found: value != nil, Value: value}, nil
+}
+
+// GetWithProof implements the GetWithProof method of the Query service.
+func (s *Server) GetWithProof(_ context.Context, req *iavlproto.GetWithProofRequest) (*iavlproto.GetWithProofResponse, error) {
+	t, err := s.immutable(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	value, err := t.Get(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	proof, err := t.GetProof(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	bz, err := proof.Marshal()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &iavlproto.GetWithProofResponse{Version: t.Version(), Found: value != nil, Value: value, Proof: bz}, nil
+}
+
+// Range implements the Range method of the Query service.
+func (s *Server) Range(req *iavlproto.RangeRequest, stream iavlproto.Query_RangeServer) error {
+	t, err := s.immutable(req.Version)
+	if err != nil {
+		return err
+	}
+	itr, err := t.Iterator(nonEmpty(req.Start), nonEmpty(req.End), !req.Descending)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer itr.Close()
+
+	for n := uint32(0); itr.Valid() && (req.Limit == 0 || n < req.Limit); n++ {
+		if err := stream.Send(&iavlproto.RangeResponse{Version: t.Version(), Key: itr.Key(), Value: itr.Value()}); err != nil {
+			return err
+		}
+		itr.Next()
+	}
+	return toStatus(itr.Error())
+}
+
+// Versions implements the Versions method of the Query service.
+func (s *Server) Versions(context.Context, *iavlproto.VersionsRequest) (*iavlproto.VersionsResponse, error) {
+	available := s.tree.AvailableVersions()
+	res := &iavlproto.VersionsResponse{Versions: make([]int64, len(available))}
+	for i, version := range available {
+		res.Versions[i] = int64(version)
+	}
+	if len(available) > 0 {
+		res.Latest = res.Versions[len(available)-1]
+	}
+	return res, nil
+}
+
+// Root implements the Root method of the Query service.
+func (s *Server) Root(_ context.Context, req *iavlproto.RootRequest) (*iavlproto.RootResponse, error) {
+	t, err := s.immutable(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &iavlproto.RootResponse{Version: t.Version(), Hash: t.Hash()}, nil
+}
+
+// immutable returns the tree of the version, the latest saved one if 0.
+func (s *Server) immutable(version int64) (*iavl.ImmutableTree, error) {
+	if version == 0 {
+		return s.tree.Snapshot(), nil
+	}
+	if !s.tree.VersionExists(version) {
+		return nil, status.Errorf(codes.NotFound, "version %d: %v", version, iavl.ErrVersionDoesNotExist)
+	}
+	t, err := s.tree.GetImmutable(version)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return t, nil
+}
+
+// toStatus converts an error of the tree into a gRPC status error, nil if err is nil.
+func toStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, iavl.ErrInvalidInputs):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, iavl.ErrVersionDoesNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// nonEmpty returns nil for an empty range bound, which leaves that side unbounded.
+func nonEmpty(bz []byte) []byte {
+	if len(bz) == 0 {
+		return nil
+	}
+	return bz
+}
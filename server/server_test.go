@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// setupServer serves a tree with versions 1 and 2 of the keys k00 to k09 over an in-memory
+// connection, and returns the tree and a client of the server.
+func setupServer(t *testing.T) (*iavl.MutableTree, *Client) {
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	for version := 1; version <= 2; version++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	NewServer(tree).Register(gs)
+	go gs.Serve(lis) //nolint:errcheck
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return tree, NewClient(conn)
+}
+
+func TestClient_Get(t *testing.T) {
+	_, client := setupServer(t)
+	ctx := context.Background()
+
+	value, err := client.Get(ctx, 0, []byte("k03"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2-3"), value)
+
+	value, err = client.Get(ctx, 1, []byte("k03"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1-3"), value)
+
+	value, err = client.Get(ctx, 0, []byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	_, err = client.Get(ctx, 3, []byte("k03"))
+	require.ErrorIs(t, err, iavl.ErrVersionDoesNotExist)
+	_, err = client.Get(ctx, 0, nil)
+	require.ErrorIs(t, err, iavl.ErrInvalidInputs)
+}
+
+func TestClient_GetWithProof(t *testing.T) {
+	tree, client := setupServer(t)
+	ctx := context.Background()
+
+	root, version, err := client.Root(ctx, 1)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, itree.Hash(), root)
+
+	value, proof, err := client.GetWithProof(ctx, 1, []byte("k05"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1-5"), value)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, []byte("k05"), value))
+
+	value, proof, err = client.GetWithProof(ctx, 1, []byte("k10"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, []byte("k10")))
+
+	root, version, err = client.Root(ctx, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, tree.Hash(), root)
+}
+
+func TestClient_Range(t *testing.T) {
+	_, client := setupServer(t)
+	ctx := context.Background()
+
+	var keys []string
+	collect := func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}
+	require.NoError(t, client.Range(ctx, 1, []byte("k02"), []byte("k05"), true, 0, collect))
+	require.Equal(t, []string{"k02", "k03", "k04"}, keys)
+
+	keys = nil
+	require.NoError(t, client.Range(ctx, 0, nil, nil, false, 3, collect))
+	require.Equal(t, []string{"k09", "k08", "k07"}, keys)
+
+	// the iteration stops once fn returns false.
+	keys = nil
+	require.NoError(t, client.Range(ctx, 0, nil, nil, true, 0, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 2
+	}))
+	require.Equal(t, []string{"k00", "k01"}, keys)
+
+	require.ErrorIs(t, client.Range(ctx, 5, nil, nil, true, 0, collect), iavl.ErrVersionDoesNotExist)
+}
+
+func TestClient_Versions(t *testing.T) {
+	tree, client := setupServer(t)
+	ctx := context.Background()
+
+	versions, err := client.Versions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2}, versions)
+
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	versions, err = client.Versions(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, versions)
+	latest, err := client.LatestVersion(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, latest)
+}
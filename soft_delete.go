@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// tombstoneKeyFormat indexes the tombstones by the version deleting their key, so that they
+// are collected without iterating the tree, see the SoftDeleteRetention option. An entry is
+// only a hint: the tombstone is collected if the key still has it.
+var tombstoneKeyFormat = keyformat.NewKeyFormat('d', int64Size, 0) // d<version><key>
+
+// tombstonePrefix starts the values of the tombstones, which are followed by the big-endian
+// version deleting the key.
+var tombstonePrefix = []byte("\x00iavl/tombstone\x00")
+
+// tombstoneValue returns the value of the tombstone of a key deleted by the version.
+func tombstoneValue(version int64) []byte {
+	return binary.BigEndian.AppendUint64(bytes.Clone(tombstonePrefix), uint64(version))
+}
+
+// DecodeTombstone returns the version deleting a key if value is the value of its tombstone, see
+// the SoftDeleteRetention option, e.g. to check the deletion of a key with a membership proof.
+func DecodeTombstone(value []byte) (deletedVersion int64, ok bool) {
+	if len(value) != len(tombstonePrefix)+int64Size || !bytes.HasPrefix(value, tombstonePrefix) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(value[len(tombstonePrefix):])), true
+}
+
+// softDeletes returns whether the tree keeps a tombstone for the removed keys.
+func (ndb *nodeDB) softDeletes() bool {
+	return ndb.opts.SoftDeleteRetention > 0
+}
+
+// liveValue returns value, or nil if it is the value of a tombstone of a tree with soft deletes.
+func (ndb *nodeDB) liveValue(value []byte) []byte {
+	if !ndb.softDeletes() {
+		return value
+	}
+	if _, ok := DecodeTombstone(value); ok {
+		return nil
+	}
+	return value
+}
+
+// isTombstone returns whether value is the value of a tombstone of a tree with soft deletes.
+func (ndb *nodeDB) isTombstone(value []byte) bool {
+	if !ndb.softDeletes() {
+		return false
+	}
+	_, ok := DecodeTombstone(value)
+	return ok
+}
+
+// filterTombstones returns itr skipping the tombstones, if the tree has soft deletes.
+func (ndb *nodeDB) filterTombstones(itr dbm.Iterator) dbm.Iterator {
+	if !ndb.softDeletes() {
+		return itr
+	}
+	// keep is called with itr at the key, so it can check its value.
+	return NewFilterIterator(itr, func([]byte) bool {
+		_, ok := DecodeTombstone(itr.Value())
+		return !ok
+	}, nil)
+}
+
+// checkValue refuses to set the value of a tombstone in a tree with soft deletes, since the key
+// would then be deleted.
+func (ndb *nodeDB) checkValue(key, value []byte) error {
+	if _, ok := DecodeTombstone(value); ok && ndb.softDeletes() {
+		return fmt.Errorf("the value of key %X is reserved for tombstones: %w", key, ErrInvalidInputs)
+	}
+	return nil
+}
+
+// GetDeletionInfo returns the version which deleted the key, if it has a tombstone in the
+// working tree, see the SoftDeleteRetention option. The version is the one being saved for a
+// key removed since the last saved version. It returns false if the key isn't deleted, i.e. it
+// has a value or was never set, or its tombstone was collected.
+func (tree *MutableTree) GetDeletionInfo(key []byte) (deletedVersion int64, deleted bool, err error) {
+	if len(key) == 0 {
+		return 0, false, ErrEmptyKey
+	}
+	if tree.root == nil {
+		return 0, false, nil
+	}
+	_, value, err := tree.root.get(tree.ImmutableTree, key)
+	if err != nil {
+		return 0, false, err
+	}
+	deletedVersion, deleted = DecodeTombstone(value)
+	return deletedVersion, deleted, nil
+}
+
+// softRemove replaces the value of the key with a tombstone of the version being saved, and
+// returns the value it had, if it wasn't removed already.
+func (tree *MutableTree) softRemove(key []byte) ([]byte, bool, error) {
+	value, err := tree.Get(key)
+	if err != nil || value == nil {
+		return nil, false, err
+	}
+	if _, err := tree.set(key, tombstoneValue(tree.WorkingVersion())); err != nil {
+		return nil, false, err
+	}
+	tree.unsavedTombstones = append(tree.unsavedTombstones, bytes.Clone(key))
+	return value, true, nil
+}
+
+// collectTombstones removes the tombstones of the keys deleted by the versions which are at
+// least SoftDeleteRetention versions before the given one, before it is saved, and indexes the
+// tombstones of the keys it deletes.
+func (tree *MutableTree) collectTombstones(version int64) error {
+	ndb := tree.ndb
+	for _, key := range tree.unsavedTombstones {
+		if err := ndb.batch.Set(tombstoneKeyFormat.Key(version, key), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	expiredVersion := version - ndb.opts.SoftDeleteRetention
+	if expiredVersion < 1 {
+		return nil
+	}
+	var expired [][]byte
+	err := ndb.traverseRange(tombstoneKeyFormat.Key(), tombstoneKeyFormat.Key(expiredVersion+1), func(k, _ []byte) error {
+		expired = append(expired, bytes.Clone(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		var (
+			deletedVersion int64
+			key            []byte
+		)
+		tombstoneKeyFormat.Scan(k, &deletedVersion, &key)
+		current, deleted, err := tree.GetDeletionInfo(key)
+		if err != nil {
+			return err
+		}
+		// the key may have been set again since, or deleted again by a later version.
+		if deleted && current == deletedVersion {
+			if _, _, err := tree.remove(key); err != nil {
+				return err
+			}
+		}
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workingState is the working tree and its unsaved changes, which collectTombstones changes by
+// removing the keys of the expired tombstones, so that SaveVersion restores them if it fails.
+type workingState struct {
+	root              *Node
+	lastSet           *Node
+	fastNodeAdditions *sync.Map
+	fastNodeRemovals  *sync.Map
+	changes           map[string]unsavedChange
+}
+
+// workingState returns a copy of the working tree and its unsaved changes. The tree itself isn't
+// copied, since removing a key clones the nodes it changes.
+func (tree *MutableTree) workingState() *workingState {
+	state := &workingState{
+		root:              tree.root,
+		lastSet:           tree.lastSet,
+		fastNodeAdditions: &sync.Map{},
+		fastNodeRemovals:  &sync.Map{},
+	}
+	tree.unsavedFastNodeAdditions.Range(func(k, v interface{}) bool {
+		state.fastNodeAdditions.Store(k, v)
+		return true
+	})
+	tree.unsavedFastNodeRemovals.Range(func(k, v interface{}) bool {
+		state.fastNodeRemovals.Store(k, v)
+		return true
+	})
+	if tree.unsavedChanges != nil {
+		state.changes = make(map[string]unsavedChange, len(tree.unsavedChanges))
+		for k, c := range tree.unsavedChanges {
+			state.changes[k] = c
+		}
+	}
+	return state
+}
+
+// restoreWorkingState restores the working tree and its unsaved changes of state.
+func (tree *MutableTree) restoreWorkingState(state *workingState) {
+	tree.root = state.root
+	tree.lastSet = state.lastSet
+	tree.unsavedFastNodeAdditions = state.fastNodeAdditions
+	tree.unsavedFastNodeRemovals = state.fastNodeRemovals
+	tree.unsavedChanges = state.changes
+}
@@ -0,0 +1,217 @@
+package iavl
+
+import (
+	"errors"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// requireIteratedKeys checks that the iterators of the tree yield the keys.
+func requireIteratedKeys(t *testing.T, tree *MutableTree, keys ...string) {
+	t.Helper()
+	var iterated []string
+	_, err := tree.Iterate(func(key, _ []byte) bool {
+		iterated = append(iterated, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, keys, iterated)
+
+	iterated = nil
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		iterated = append(iterated, string(itr.Key()))
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, keys, iterated)
+}
+
+func TestSoftDelete(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), SoftDeleteRetentionOption(2))
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	value, removed, err := tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, "value-b", string(value))
+	_, removed, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, removed)
+	deletedVersion, deleted, err := tree.GetDeletionInfo([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	require.EqualValues(t, 2, deletedVersion)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the tombstoned key is absent, but still a leaf of the tree.
+	value, err = tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	has, err := tree.Has([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, has)
+	value, err = tree.GetVersioned([]byte("b"), 2)
+	require.NoError(t, err)
+	require.Nil(t, value)
+	value, err = tree.GetVersioned([]byte("b"), 1)
+	require.NoError(t, err)
+	require.Equal(t, "value-b", string(value))
+	requireIteratedKeys(t, tree, "a", "c")
+	require.EqualValues(t, 2, tree.Size())
+
+	// the tombstone is a leaf, but none of the read paths returns its value.
+	itree, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	index, value, err := itree.GetWithIndex([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.EqualValues(t, 1, index)
+	key, value, err := itree.GetByIndex(1)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(key))
+	require.Nil(t, value)
+	value, version, err := itree.GetWithVersion([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.EqualValues(t, 2, version)
+	var ranged []string
+	itree.IterateRange(nil, nil, true, func(key, _ []byte) bool {
+		ranged = append(ranged, string(key))
+		return false
+	})
+	require.Equal(t, []string{"a", "c"}, ranged)
+	sample, err := itree.Sample(3, 1)
+	require.NoError(t, err)
+	require.Len(t, sample, 2)
+
+	// the deletion is proven by the membership proof of the tombstone, which GetProof gives.
+	proof, err := itree.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	ok, err := itree.VerifyMembership(proof, []byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	deletedVersion, deleted = DecodeTombstone(proof.GetExist().Value)
+	require.True(t, deleted)
+	require.EqualValues(t, 2, deletedVersion)
+	proof, err = itree.GetProof([]byte("b"))
+	require.NoError(t, err)
+	require.NotNil(t, proof.GetExist())
+	ok, err = itree.VerifyProof(proof, []byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = itree.GetNonMembershipProof([]byte("b"))
+	require.Error(t, err)
+
+	_, err = tree.Set([]byte("d"), tombstoneValue(3))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+
+	// c is deleted, then set again, so its tombstone isn't collected.
+	_, _, err = tree.Remove([]byte("c"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, deleted, err = tree.GetDeletionInfo([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	_, err = tree.Set([]byte("c"), []byte("again"))
+	require.NoError(t, err)
+	_, deleted, err = tree.GetDeletionInfo([]byte("c"))
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	// the tombstone of b is collected by the version 2 versions after the one deleting it.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, deleted, err = tree.GetDeletionInfo([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, deleted)
+	require.EqualValues(t, 2, tree.Size())
+	itree, err = tree.GetImmutable(3)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, itree.Size())
+	for version := 0; version < 2; version++ {
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	value, err = tree.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, "again", string(value))
+
+	// a tree reopened with soft deletes sees the same keys.
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	loaded := NewMutableTree(db, 0, false, log.NewNopLogger(), SoftDeleteRetentionOption(2))
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	requireIteratedKeys(t, loaded, "c")
+	deletedVersion, deleted, err = loaded.GetDeletionInfo([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+	require.EqualValues(t, 7, deletedVersion)
+
+	// a tombstoned key is absent for a compare-and-swap.
+	swapped, err := loaded.CompareAndSwap([]byte("a"), nil, []byte("again"))
+	require.NoError(t, err)
+	require.True(t, swapped)
+	requireIteratedKeys(t, loaded, "a", "c")
+}
+
+func TestSoftDelete_SaveVersionError(t *testing.T) {
+	db := dbm.NewMemDB()
+	var events []commitEvent
+	errListener := errors.New("stream unavailable")
+	listener := &testCommitListener{name: "listener", events: &events}
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), SoftDeleteRetentionOption(1))
+	tree.AddCommitListener(listener)
+	for _, key := range []string{"a", "b"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the version 3 collects the tombstone of b, but fails: the working tree is left unchanged.
+	_, err = tree.Set([]byte("c"), []byte("value-c"))
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+	listener.err = errListener
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errListener)
+	require.Equal(t, hash, tree.WorkingHash())
+	require.EqualValues(t, 3, tree.WorkingVersion())
+	_, deleted, err := tree.GetDeletionInfo([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	// and saving it again collects the tombstone once.
+	listener.err = nil
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	_, deleted, err = tree.GetDeletionInfo([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, deleted)
+	requireIteratedKeys(t, tree, "a", "c")
+	require.Equal(t, []*KVPair{
+		{Key: []byte("b"), Delete: true},
+		{Key: []byte("c"), Value: []byte("value-c")},
+	}, events[len(events)-1].cs.Pairs)
+}
@@ -0,0 +1,95 @@
+package iavl
+
+import (
+	"bytes"
+)
+
+// subscriptionBufferSize is the number of changes buffered by a subscription, see Subscribe.
+const subscriptionBufferSize = 1024
+
+// KVChange is the change of a key in a saved version, emitted to the subscribers of its prefix,
+// see MutableTree.Subscribe.
+type KVChange struct {
+	Version int64
+	Key     []byte
+	Value   []byte // new value of the key, nil if it was deleted
+	Delete  bool
+}
+
+// subscription is a subscriber to the changes of the keys with a prefix.
+type subscription struct {
+	prefix []byte
+	ch     chan KVChange
+}
+
+// Subscribe returns a channel receiving the changes of the keys with the given prefix in every
+// version saved from now on, e.g. to feed an indexer, once the version is committed: a set for
+// every key added or updated, and a delete for every key removed, in key order, in the order of
+// the Comparator option if set. A nil prefix matches every key. The keys and values must not be
+// modified.
+//
+// The changes are buffered, and SaveVersion never waits for the subscriber: a subscriber too
+// slow to keep up is dropped, and its channel closed, so that it catches up, e.g. by diffing
+// the last version it received against the latest one with DiffVersions, before subscribing
+// again. The channel is closed as well by Unsubscribe and Close. Only the changes made after the
+// subscription are tracked, and Subscribe must not be called concurrently with the writes.
+func (tree *MutableTree) Subscribe(prefix []byte) <-chan KVChange {
+	sub := &subscription{prefix: bytes.Clone(prefix), ch: make(chan KVChange, subscriptionBufferSize)}
+	tree.subscriptions = append(tree.subscriptions, sub)
+	return sub.ch
+}
+
+// Unsubscribe stops the subscription of the channel returned by Subscribe, and closes it. It
+// does nothing if the channel was already closed.
+func (tree *MutableTree) Unsubscribe(ch <-chan KVChange) {
+	for i, sub := range tree.subscriptions {
+		if sub.ch == ch {
+			close(sub.ch)
+			tree.subscriptions = append(tree.subscriptions[:i], tree.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// notifySubscribers emits the unsaved changes of the working tree, once committed as version,
+// to the subscribers, and drops the subscribers whose buffer is full.
+func (tree *MutableTree) notifySubscribers(version int64) {
+	if len(tree.subscriptions) == 0 {
+		return
+	}
+	cs := tree.unsavedChangeSet()
+	subscriptions := tree.subscriptions[:0]
+	for _, sub := range tree.subscriptions {
+		if sub.send(version, cs) {
+			subscriptions = append(subscriptions, sub)
+			continue
+		}
+		tree.logger.Error("dropping subscriber too slow to keep up", "prefix", sub.prefix, "version", version)
+		close(sub.ch)
+	}
+	clear(tree.subscriptions[len(subscriptions):])
+	tree.subscriptions = subscriptions
+}
+
+// send emits the changes of the subscribed keys, and returns false if the buffer is full.
+func (sub *subscription) send(version int64, cs *ChangeSet) bool {
+	for _, pair := range cs.Pairs {
+		if !bytes.HasPrefix(pair.Key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.ch <- KVChange{Version: version, Key: pair.Key, Value: pair.Value, Delete: pair.Delete}:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// closeSubscriptions closes the channels of all the subscriptions.
+func (tree *MutableTree) closeSubscriptions() {
+	for _, sub := range tree.subscriptions {
+		close(sub.ch)
+	}
+	tree.subscriptions = nil
+}
@@ -0,0 +1,136 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// receiveChanges returns the changes buffered in ch.
+func receiveChanges(ch <-chan KVChange) []KVChange {
+	var changes []KVChange
+	for {
+		select {
+		case change, ok := <-ch:
+			if !ok {
+				return changes
+			}
+			changes = append(changes, change)
+		default:
+			return changes
+		}
+	}
+}
+
+// requireClosed requires ch to be closed once drained.
+func requireClosed(t *testing.T, ch <-chan KVChange) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		default:
+			require.FailNow(t, "channel not closed")
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a/0"), []byte("before"))
+	require.NoError(t, err)
+
+	all := tree.Subscribe(nil)
+	prefixed := tree.Subscribe([]byte("a/"))
+
+	for _, key := range []string{"b/1", "a/2", "a/1"} {
+		_, err := tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	require.Empty(t, receiveChanges(all))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the change made before the subscriptions isn't tracked.
+	require.Equal(t, []KVChange{
+		{Version: 1, Key: []byte("a/1"), Value: []byte("a/1")},
+		{Version: 1, Key: []byte("a/2"), Value: []byte("a/2")},
+		{Version: 1, Key: []byte("b/1"), Value: []byte("b/1")},
+	}, receiveChanges(all))
+	require.Equal(t, []KVChange{
+		{Version: 1, Key: []byte("a/1"), Value: []byte("a/1")},
+		{Version: 1, Key: []byte("a/2"), Value: []byte("a/2")},
+	}, receiveChanges(prefixed))
+
+	// deletes, and keys added then removed within the version.
+	_, _, err = tree.Remove([]byte("a/1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a/3"), []byte("a/3"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a/3"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b/1"), []byte("b/1'"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, []KVChange{
+		{Version: 2, Key: []byte("a/1"), Delete: true},
+		{Version: 2, Key: []byte("b/1"), Value: []byte("b/1'")},
+	}, receiveChanges(all))
+	require.Equal(t, []KVChange{
+		{Version: 2, Key: []byte("a/1"), Delete: true},
+	}, receiveChanges(prefixed))
+
+	// Unsubscribe closes the channel and stops the changes.
+	tree.Unsubscribe(prefixed)
+	requireClosed(t, prefixed)
+	tree.Unsubscribe(prefixed)
+	_, err = tree.Set([]byte("a/4"), []byte("a/4"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, receiveChanges(all), 1)
+
+	// Close closes the remaining channels.
+	require.NoError(t, tree.Close())
+	requireClosed(t, all)
+}
+
+func TestSubscribe_FailedSaveVersion(t *testing.T) {
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	ch := tree.Subscribe(nil)
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	db.DelayFlush(1, 0)
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Empty(t, receiveChanges(ch))
+}
+
+func TestSubscribe_SlowSubscriber(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	slow := tree.Subscribe(nil)
+	fast := tree.Subscribe(nil)
+
+	for version := 0; version < 2; version++ {
+		for i := 0; i < subscriptionBufferSize*3/4; i++ {
+			_, err := tree.Set(i2b(version*subscriptionBufferSize+i), []byte{1})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Len(t, receiveChanges(fast), subscriptionBufferSize*3/4)
+	}
+
+	// the slow subscriber is dropped once its buffer is full.
+	require.Len(t, tree.subscriptions, 1)
+	changes := receiveChanges(slow)
+	require.Len(t, changes, subscriptionBufferSize)
+	requireClosed(t, slow)
+}
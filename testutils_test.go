@@ -74,7 +74,7 @@ func N(l, r interface{}) *Node {
 func T(n *Node) (*MutableTree, error) {
 	t := getTestTree(0)
 
-	n.hashWithCount(t.version + 1)
+	n.hashWithCount(t.version+1, HashSHA256)
 	t.root = n
 	return t, nil
 }
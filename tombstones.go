@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// GetImmutableWithTombstones returns the tree of the given version as GetImmutable does, and an
+// iterator over the keys deleted by this version, i.e. present in the previous version but not
+// in this one, in ascending order, with their values in the previous version. The deleted keys
+// are derived from the leaves orphaned by the version, so the previous version must still be
+// available, unless the version is the first one of the tree, which deletes nothing.
+func (tree *MutableTree) GetImmutableWithTombstones(version int64) (*ImmutableTree, dbm.Iterator, error) {
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prev, err := tree.previousVersion(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev == 0 {
+		return itree, &tombstoneIterator{}, nil
+	}
+
+	// the orphaned leaves are visited in ascending order of their keys.
+	itr := &tombstoneIterator{}
+	err = tree.ndb.traverseOrphans(prev, version, func(orphan *Node) error {
+		if !orphan.isLeaf() {
+			return nil
+		}
+		// a leaf is also orphaned when its value is updated.
+		exists, err := itree.Has(orphan.key)
+		if err != nil || exists {
+			return err
+		}
+		value, err := tree.ndb.leafValue(orphan)
+		if err != nil {
+			return err
+		}
+		itr.keys = append(itr.keys, tree.ndb.copyBytes(orphan.key))
+		itr.values = append(itr.values, tree.ndb.copyBytes(value))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return itree, itr, nil
+}
+
+// previousVersion returns the version before the given existing one, which must still be
+// available, or 0 if the version is the first one of the tree.
+func (tree *MutableTree) previousVersion(version int64) (int64, error) {
+	first := int64(1)
+	if tree.ndb.opts.InitialVersion > 0 {
+		first = int64(tree.ndb.opts.InitialVersion)
+	}
+	if version <= first {
+		return 0, nil
+	}
+	if !tree.VersionExists(version - 1) {
+		return 0, fmt.Errorf("previous version %d of version %d: %w", version-1, version, ErrVersionDoesNotExist)
+	}
+	return version - 1, nil
+}
+
+// tombstoneIterator is a dbm.Iterator over the keys deleted by a version, see
+// GetImmutableWithTombstones.
+type tombstoneIterator struct {
+	keys   [][]byte
+	values [][]byte
+	i      int
+}
+
+var _ dbm.Iterator = (*tombstoneIterator)(nil)
+
+// Domain implements dbm.Iterator. The deleted keys are not bounded.
+func (iter *tombstoneIterator) Domain() ([]byte, []byte) {
+	return nil, nil
+}
+
+// Valid implements dbm.Iterator.
+func (iter *tombstoneIterator) Valid() bool {
+	return iter.i < len(iter.keys)
+}
+
+// Next implements dbm.Iterator.
+func (iter *tombstoneIterator) Next() {
+	if iter.Valid() {
+		iter.i++
+	}
+}
+
+// Key implements dbm.Iterator. It returns the deleted key.
+func (iter *tombstoneIterator) Key() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.keys[iter.i]
+}
+
+// Value implements dbm.Iterator. It returns the value of the key in the previous version.
+func (iter *tombstoneIterator) Value() []byte {
+	if !iter.Valid() {
+		return nil
+	}
+	return iter.values[iter.i]
+}
+
+// Error implements dbm.Iterator.
+func (iter *tombstoneIterator) Error() error {
+	return nil
+}
+
+// Close implements dbm.Iterator.
+func (iter *tombstoneIterator) Close() error {
+	iter.keys, iter.values = nil, nil
+	return nil
+}
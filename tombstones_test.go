@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// tombstones returns the keys and values of a tombstone iterator.
+func tombstones(t *testing.T, itr dbm.Iterator) (keys, values []string) {
+	t.Helper()
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+		values = append(values, string(itr.Value()))
+	}
+	require.NoError(t, itr.Error())
+	return keys, values
+}
+
+func TestGetImmutableWithTombstones(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, log.NewNopLogger())
+			for i := 0; i < 50; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			// deletes some keys, updates and adds others.
+			for _, i := range []int{42, 3, 17, 18, 0} {
+				_, removed, err := tree.Remove([]byte(fmt.Sprintf("key-%02d", i)))
+				require.NoError(t, err)
+				require.True(t, removed)
+			}
+			for _, key := range []string{"key-05", "key-18", "key-99"} {
+				_, err := tree.Set([]byte(key), []byte("new"))
+				require.NoError(t, err)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			itree, itr, err := tree.GetImmutableWithTombstones(2)
+			require.NoError(t, err)
+			require.EqualValues(t, 2, itree.Version())
+			has, err := itree.Has([]byte("key-42"))
+			require.NoError(t, err)
+			require.False(t, has)
+			keys, values := tombstones(t, itr)
+			require.Equal(t, []string{"key-00", "key-03", "key-17", "key-42"}, keys)
+			require.Equal(t, []string{"value-0", "value-3", "value-17", "value-42"}, values)
+
+			// the first version and a version without changes delete nothing.
+			for _, version := range []int64{1, 3} {
+				_, itr, err := tree.GetImmutableWithTombstones(version)
+				require.NoError(t, err)
+				keys, _ := tombstones(t, itr)
+				require.Empty(t, keys)
+			}
+
+			// removing all the keys deletes them all.
+			itree, err = tree.GetImmutable(3)
+			require.NoError(t, err)
+			var remaining []string
+			_, err = itree.Iterate(func(key, _ []byte) bool {
+				remaining = append(remaining, string(key))
+				return false
+			})
+			require.NoError(t, err)
+			for _, key := range remaining {
+				_, _, err := tree.Remove([]byte(key))
+				require.NoError(t, err)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			_, itr, err = tree.GetImmutableWithTombstones(4)
+			require.NoError(t, err)
+			keys, _ = tombstones(t, itr)
+			require.Equal(t, remaining, keys)
+
+			// the previous version is needed.
+			require.NoError(t, tree.DeleteVersionsTo(2))
+			_, _, err = tree.GetImmutableWithTombstones(3)
+			require.ErrorIs(t, err, ErrVersionDoesNotExist)
+			_, _, err = tree.GetImmutableWithTombstones(5)
+			require.ErrorIs(t, err, ErrVersionDoesNotExist)
+		})
+	}
+}
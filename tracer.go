@@ -0,0 +1,40 @@
+package iavl
+
+import "context"
+
+// Tracer starts the spans of the operations of a tree, see the Tracer option. It is typically
+// an adapter to a tracing library, e.g. OpenTelemetry.
+//
+// The spans are named after the operations: "iavl.SaveVersion", with the child spans
+// "iavl.SaveVersion.saveNodes", "iavl.SaveVersion.commit" and "iavl.SaveVersion.prune" of
+// its phases, "iavl.GetImmutable", "iavl.DeleteVersionsTo" and "iavl.LoadVersion".
+type Tracer interface {
+	// StartSpan starts a span, as a child of the span carried by ctx if any, and returns the
+	// context carrying the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation, started by a Tracer.
+type Span interface {
+	// End ends the span. It is called exactly once.
+	End()
+}
+
+// noopTracer is the Tracer used when none is set, which doesn't trace anything.
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span with the tracer of the tree.
+func (ndb *nodeDB) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if ndb.opts.Tracer == nil {
+		return noopTracer{}.StartSpan(ctx, name)
+	}
+	return ndb.opts.Tracer.StartSpan(ctx, name)
+}
@@ -0,0 +1,129 @@
+package iavl
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+type spanKey struct{}
+
+// recordingTracer records the spans started and ended, with the name of their parent span.
+type recordingTracer struct {
+	mtx   sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent string
+	ended  int
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	span := &recordedSpan{tracer: t, name: name}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordedSpan) End() {
+	s.tracer.mtx.Lock()
+	defer s.tracer.mtx.Unlock()
+	s.ended++
+}
+
+// started returns the spans started and their parent, in order, and checks they all ended once.
+func (t *recordingTracer) started(tb testing.TB) []string {
+	tb.Helper()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	names := make([]string, 0, len(t.spans))
+	for _, span := range t.spans {
+		require.Equal(tb, 1, span.ended, "span %s", span.name)
+		names = append(names, span.parent+">"+span.name)
+	}
+	t.spans = nil
+	return names
+}
+
+func TestTracer_SaveVersion(t *testing.T) {
+	tracer := &recordingTracer{}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger(), TracerOption(tracer))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+
+	ctx, root := tracer.StartSpan(context.Background(), "root")
+	_, version, err := tree.SaveVersionContext(ctx)
+	require.NoError(t, err)
+	root.End()
+	require.Equal(t, []string{
+		">root",
+		"root>iavl.SaveVersion",
+		"iavl.SaveVersion>iavl.SaveVersion.saveNodes",
+		"iavl.SaveVersion>iavl.SaveVersion.commit",
+		"iavl.SaveVersion>iavl.SaveVersion.prune",
+	}, tracer.started(t))
+
+	_, err = tree.GetImmutable(version)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("other"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(version))
+	require.Equal(t, []string{
+		">iavl.GetImmutable",
+		">iavl.SaveVersion",
+		"iavl.SaveVersion>iavl.SaveVersion.saveNodes",
+		"iavl.SaveVersion>iavl.SaveVersion.commit",
+		"iavl.SaveVersion>iavl.SaveVersion.prune",
+		">iavl.DeleteVersionsTo",
+	}, tracer.started(t))
+}
+
+func TestTracer_SaveVersionFailure(t *testing.T) {
+	tracer := &recordingTracer{}
+	db := NewFaultInjectingDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), TracerOption(tracer))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+
+	// the spans are ended whichever phase fails.
+	db.FailWrite(nodeKeyFormat.Prefix(), 1)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, []string{
+		">iavl.SaveVersion",
+		"iavl.SaveVersion>iavl.SaveVersion.saveNodes",
+	}, tracer.started(t))
+
+	db.DelayFlush(1, 0)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, []string{
+		">iavl.SaveVersion",
+		"iavl.SaveVersion>iavl.SaveVersion.saveNodes",
+		"iavl.SaveVersion>iavl.SaveVersion.commit",
+	}, tracer.started(t))
+}
+
+func TestTracer_Default(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersionContext(context.Background())
+	require.NoError(t, err)
+	_, err = tree.GetImmutableContext(context.Background(), version)
+	require.NoError(t, err)
+}
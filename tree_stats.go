@@ -0,0 +1,178 @@
+package iavl
+
+import (
+	"fmt"
+	"math"
+)
+
+// TreeStats describes the shape and the contents of a tree, see ImmutableTree.Stats and
+// ImmutableTree.SampleStats.
+type TreeStats struct {
+	LeafCount  int64
+	InnerCount int64
+	NodeCount  int64
+	Height     int64
+	// MaxLeafDepth and AvgLeafDepth are the maximum and average number of edges between the
+	// root and the leaves.
+	MaxLeafDepth float64
+	AvgLeafDepth float64
+	// NodesByHeight is the number of nodes by subtree height, the leaves being at 0.
+	NodesByHeight []int64
+	// NodesByVersion is the number of nodes by the version which saved them, e.g. to tell how
+	// much of the tree a pruning of the older versions would keep. The unsaved nodes of a
+	// working tree are counted in the next version.
+	NodesByVersion map[int64]int64
+	// KeyBytes and ValueBytes are the total sizes of the keys and the values of the leaves.
+	KeyBytes   int64
+	ValueBytes int64
+	// Samples is the number of leaves sampled by SampleStats, 0 if the statistics are exact.
+	Samples int64
+}
+
+// treeStatsAccumulator sums the weighted contributions of the visited nodes to the statistics:
+// 1 for the nodes of a full walk, and the inverse of the probability of visiting them for the
+// nodes of the paths sampled by SampleStats.
+type treeStatsAccumulator struct {
+	byHeight   []float64
+	byVersion  map[int64]float64
+	keyBytes   float64
+	valueBytes float64
+	depthSum   float64
+	maxDepth   int64
+}
+
+func (acc *treeStatsAccumulator) addNode(t *ImmutableTree, node *Node, weight float64) {
+	acc.byHeight[node.subtreeHeight] += weight
+	version := t.version + 1
+	if node.nodeKey != nil {
+		version = node.nodeKey.version
+	}
+	acc.byVersion[version] += weight
+}
+
+func (acc *treeStatsAccumulator) addLeaf(node *Node, value []byte, depth int64, weight float64) {
+	acc.keyBytes += weight * float64(len(node.key))
+	acc.valueBytes += weight * float64(len(value))
+	acc.depthSum += weight * float64(depth)
+	if depth > acc.maxDepth {
+		acc.maxDepth = depth
+	}
+}
+
+// Stats returns the statistics of the tree, walking the whole tree, which loads every node. The
+// counts and the height are read from the root. See SampleStats for an estimate reading fewer
+// nodes.
+func (t *ImmutableTree) Stats() (TreeStats, error) {
+	if t.root == nil {
+		return TreeStats{}, nil
+	}
+	acc := t.newStatsAccumulator()
+	if err := t.walkStats(t.root, 0, acc); err != nil {
+		return TreeStats{}, err
+	}
+	return t.treeStats(acc, 0), nil
+}
+
+// SampleStats estimates the statistics of the tree from the paths from the root to the given
+// number of leaves, evenly spaced by index, so that the estimate is deterministic. Each node of
+// a path contributes the inverse of the probability that the path of a leaf goes through it to
+// the estimated counts, and each sampled leaf contributes its share of the leaves to the
+// estimated sizes and depths. MaxLeafDepth is the maximum depth of the sampled leaves. The
+// counts and the height read from the root are exact. The statistics are exact, as Stats, if
+// samples is at least the number of leaves.
+func (t *ImmutableTree) SampleStats(samples int64) (TreeStats, error) {
+	if samples <= 0 {
+		return TreeStats{}, fmt.Errorf("%d samples: %w", samples, ErrInvalidInputs)
+	}
+	if t.root == nil || samples >= t.root.size {
+		return t.Stats()
+	}
+	acc := t.newStatsAccumulator()
+	leaves := t.root.size
+	for i := int64(0); i < samples; i++ {
+		// the middle of the i-th of samples equal ranges of leaves.
+		index := (2*i + 1) * leaves / (2 * samples)
+		node, depth := t.root, int64(0)
+		for {
+			acc.addNode(t, node, float64(leaves)/float64(samples*node.size))
+			if node.isLeaf() {
+				value, err := t.ndb.leafValue(node)
+				if err != nil {
+					return TreeStats{}, err
+				}
+				acc.addLeaf(node, value, depth, float64(leaves)/float64(samples))
+				break
+			}
+			leftNode, err := node.getLeftNode(t)
+			if err != nil {
+				return TreeStats{}, err
+			}
+			if index < leftNode.size {
+				node = leftNode
+			} else {
+				index -= leftNode.size
+				if node, err = node.getRightNode(t); err != nil {
+					return TreeStats{}, err
+				}
+			}
+			depth++
+		}
+	}
+	return t.treeStats(acc, samples), nil
+}
+
+func (t *ImmutableTree) newStatsAccumulator() *treeStatsAccumulator {
+	return &treeStatsAccumulator{
+		byHeight:  make([]float64, t.root.subtreeHeight+1),
+		byVersion: make(map[int64]float64),
+	}
+}
+
+// treeStats returns the statistics accumulated in acc, rounding the estimates.
+func (t *ImmutableTree) treeStats(acc *treeStatsAccumulator, samples int64) TreeStats {
+	stats := TreeStats{
+		LeafCount:      t.root.size,
+		InnerCount:     t.root.size - 1,
+		NodeCount:      2*t.root.size - 1,
+		Height:         int64(t.root.subtreeHeight),
+		MaxLeafDepth:   float64(acc.maxDepth),
+		AvgLeafDepth:   acc.depthSum / float64(t.root.size),
+		NodesByHeight:  make([]int64, len(acc.byHeight)),
+		NodesByVersion: make(map[int64]int64, len(acc.byVersion)),
+		KeyBytes:       int64(math.Round(acc.keyBytes)),
+		ValueBytes:     int64(math.Round(acc.valueBytes)),
+		Samples:        samples,
+	}
+	for height, count := range acc.byHeight {
+		stats.NodesByHeight[height] = int64(math.Round(count))
+	}
+	for version, count := range acc.byVersion {
+		stats.NodesByVersion[version] = int64(math.Round(count))
+	}
+	return stats
+}
+
+// walkStats adds node, which is at the given depth, and its descendants to acc.
+func (t *ImmutableTree) walkStats(node *Node, depth int64, acc *treeStatsAccumulator) error {
+	acc.addNode(t, node, 1)
+	if node.isLeaf() {
+		value, err := t.ndb.leafValue(node)
+		if err != nil {
+			return err
+		}
+		acc.addLeaf(node, value, depth, 1)
+		return nil
+	}
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return err
+	}
+	if err := t.walkStats(leftNode, depth+1, acc); err != nil {
+		return err
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return err
+	}
+	return t.walkStats(rightNode, depth+1, acc)
+}
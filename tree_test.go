@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"runtime"
@@ -1919,3 +1920,411 @@ func TestWorkingHashWithInitialVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, commitHash1, commitHash)
 }
+
+func TestReturnedSlicesAreCopies(t *testing.T) {
+	// scribble overwrites a returned slice in place.
+	scribble := func(bz []byte) {
+		for i := range bz {
+			bz[i] = 'X'
+		}
+	}
+
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 100, skipFastStorageUpgrade, log.NewNopLogger())
+			for i := 0; i < 20; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%02d", i)))
+				require.NoError(t, err)
+			}
+			_, version, err := tree.SaveVersion()
+			require.NoError(t, err)
+			// an unsaved addition on top of the saved version
+			_, err = tree.Set([]byte("key-20"), []byte("value-20"))
+			require.NoError(t, err)
+			hash := tree.WorkingHash()
+
+			itree, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+
+			value, err := tree.Get([]byte("key-03"))
+			require.NoError(t, err)
+			scribble(value)
+			value, err = tree.Get([]byte("key-20"))
+			require.NoError(t, err)
+			scribble(value)
+			value, err = itree.Get([]byte("key-04"))
+			require.NoError(t, err)
+			scribble(value)
+			value, err = tree.GetVersioned([]byte("key-05"), version)
+			require.NoError(t, err)
+			scribble(value)
+			_, value, err = itree.GetWithIndex([]byte("key-06"))
+			require.NoError(t, err)
+			scribble(value)
+			key, value, err := itree.GetByIndex(7)
+			require.NoError(t, err)
+			scribble(key)
+			scribble(value)
+
+			_, err = tree.Iterate(func(key, value []byte) bool {
+				scribble(key)
+				scribble(value)
+				return false
+			})
+			require.NoError(t, err)
+			itree.IterateRange(nil, nil, true, func(key, value []byte) bool {
+				scribble(key)
+				scribble(value)
+				return false
+			})
+			itree.IterateRangeInclusive(nil, nil, true, func(key, value []byte, _ int64) bool {
+				scribble(key)
+				scribble(value)
+				return false
+			})
+			itr, err := itree.Iterator(nil, nil, true)
+			require.NoError(t, err)
+			for ; itr.Valid(); itr.Next() {
+				scribble(itr.Key())
+				scribble(itr.Value())
+			}
+			require.NoError(t, itr.Close())
+
+			proof, err := itree.GetMembershipProof([]byte("key-08"))
+			require.NoError(t, err)
+			scribble(proof.GetExist().Key)
+			scribble(proof.GetExist().Value)
+
+			for i := 0; i <= 20; i++ {
+				value, err := tree.Get([]byte(fmt.Sprintf("key-%02d", i)))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value-%02d", i)), value)
+			}
+			require.Equal(t, hash, tree.WorkingHash())
+
+			// the saved nodes are still intact once reloaded from the caches
+			itree, err = tree.GetImmutable(version)
+			require.NoError(t, err)
+			for i := 0; i < 20; i++ {
+				key, value, err := itree.GetByIndex(int64(i))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("key-%02d", i)), key)
+				require.Equal(t, []byte(fmt.Sprintf("value-%02d", i)), value)
+			}
+		})
+	}
+}
+
+func TestUnsafeNoCopy(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 100, false, log.NewNopLogger(), UnsafeNoCopyOption(true))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// without copies, the same internal slice is returned every time.
+	value1, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	value2, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value1)
+	require.Same(t, &value1[0], &value2[0])
+}
+
+func TestImmutableTreeStats(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	stats, err := tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, TreeStats{}, stats)
+
+	// keys are inserted in order, so the tree shapes below are fixed.
+	set := func(n int) {
+		for i := int(tree.Size()); i < n; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte("value"))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	set(1)
+	stats, err = tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, TreeStats{
+		LeafCount: 1, NodeCount: 1, NodesByHeight: []int64{1}, NodesByVersion: map[int64]int64{1: 1},
+		KeyBytes: 8, ValueBytes: 5,
+	}, stats)
+
+	// a root with a leaf on its left and an inner node with two leaves on its right.
+	set(3)
+	stats, err = tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, TreeStats{
+		LeafCount: 3, InnerCount: 2, NodeCount: 5, Height: 2, MaxLeafDepth: 2, AvgLeafDepth: 5.0 / 3,
+		NodesByHeight: []int64{3, 1, 1}, NodesByVersion: map[int64]int64{1: 1, 2: 4}, KeyBytes: 24, ValueBytes: 15,
+	}, stats)
+
+	// a complete tree of 4 leaves.
+	set(4)
+	stats, err = tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, TreeStats{
+		LeafCount: 4, InnerCount: 3, NodeCount: 7, Height: 2, MaxLeafDepth: 2, AvgLeafDepth: 2,
+		NodesByHeight: []int64{4, 2, 1}, NodesByVersion: map[int64]int64{1: 1, 2: 2, 3: 4}, KeyBytes: 32, ValueBytes: 20,
+	}, stats)
+
+	// a larger tree is balanced: the leaves are within the AVL height bound of the root, and
+	// the same statistics are computed once the version is reloaded from disk.
+	set(1000)
+	stats, err = tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), stats.LeafCount)
+	require.Equal(t, int64(999), stats.InnerCount)
+	require.Equal(t, int64(tree.Height()), stats.Height)
+	require.Equal(t, float64(stats.Height), stats.MaxLeafDepth)
+	require.LessOrEqual(t, stats.MaxLeafDepth, 1.44*math.Log2(1000+2))
+	require.GreaterOrEqual(t, stats.AvgLeafDepth, math.Log2(1000))
+	require.LessOrEqual(t, stats.AvgLeafDepth, stats.MaxLeafDepth)
+	require.Equal(t, int64(1000*8), stats.KeyBytes)
+	require.Equal(t, int64(1000*5), stats.ValueBytes)
+	var byHeight, byVersion int64
+	for _, count := range stats.NodesByHeight {
+		byHeight += count
+	}
+	for _, count := range stats.NodesByVersion {
+		byVersion += count
+	}
+	require.Equal(t, int64(1999), byHeight)
+	require.Equal(t, int64(1999), byVersion)
+	require.Equal(t, int64(1000), stats.NodesByHeight[0])
+
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	loaded, err := itree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, stats, loaded)
+
+	// the sampled statistics estimate the exact ones, and are the same every time.
+	_, err = itree.SampleStats(0)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	exact, err := itree.SampleStats(1000)
+	require.NoError(t, err)
+	require.Equal(t, stats, exact)
+	sampled, err := itree.SampleStats(100)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), sampled.Samples)
+	require.Equal(t, stats.LeafCount, sampled.LeafCount)
+	require.Equal(t, stats.Height, sampled.Height)
+	require.Equal(t, stats.KeyBytes, sampled.KeyBytes)
+	require.Equal(t, stats.ValueBytes, sampled.ValueBytes)
+	require.Equal(t, stats.NodesByHeight[0], sampled.NodesByHeight[0])
+	require.InDelta(t, stats.AvgLeafDepth, sampled.AvgLeafDepth, 1)
+	require.LessOrEqual(t, sampled.MaxLeafDepth, stats.MaxLeafDepth)
+	for height, count := range stats.NodesByHeight {
+		require.InDelta(t, count, sampled.NodesByHeight[height], 0.2*float64(count)+2, "height %d", height)
+	}
+	var sampledNodes int64
+	for _, count := range sampled.NodesByVersion {
+		sampledNodes += count
+	}
+	require.InDelta(t, 1999, sampledNodes, 100)
+	again, err := itree.SampleStats(100)
+	require.NoError(t, err)
+	require.Equal(t, sampled, again)
+}
+
+func TestImmutableTreeGetWithVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	save := func(sets map[string]string, removes ...string) {
+		for key, value := range sets {
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+		}
+		for _, key := range removes {
+			_, _, err := tree.Remove([]byte(key))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	save(map[string]string{"a": "a1", "b": "b1", "c": "c1"})
+	save(map[string]string{"b": "b2"})
+	save(map[string]string{"d": "d3"}, "c")
+	save(map[string]string{"a": "a4", "c": "c4"})
+	save(map[string]string{"e": "e5"})
+
+	testCases := []struct {
+		version int64
+		key     string
+		value   string
+		last    int64
+	}{
+		{1, "a", "a1", 1},
+		{1, "b", "b1", 1},
+		{1, "d", "", 0},
+		{2, "b", "b2", 2},
+		{3, "a", "a1", 1},
+		{3, "c", "", 0},
+		{3, "d", "d3", 3},
+		{5, "a", "a4", 4},
+		{5, "b", "b2", 2},
+		{5, "c", "c4", 4},
+		{5, "d", "d3", 3},
+		{5, "e", "e5", 5},
+		{5, "f", "", 0},
+	}
+	for _, tc := range testCases {
+		itree, err := tree.GetImmutable(tc.version)
+		require.NoError(t, err)
+		value, last, err := itree.GetWithVersion([]byte(tc.key))
+		require.NoError(t, err)
+		require.Equal(t, tc.last, last, "version %d key %s", tc.version, tc.key)
+		if tc.value == "" {
+			require.Nil(t, value)
+		} else {
+			require.Equal(t, []byte(tc.value), value)
+		}
+	}
+
+	// the keys set in the working tree are reported at the working version.
+	_, err := tree.Set([]byte("b"), []byte("b6"))
+	require.NoError(t, err)
+	value, last, err := tree.GetWithVersion([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("b6"), value)
+	require.Equal(t, int64(6), last)
+	_, last, err = tree.GetWithVersion([]byte("e"))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), last)
+
+	value, last, err = NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger()).GetWithVersion([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.Zero(t, last)
+}
+
+func TestImmutableTreeSample(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	sample, err := tree.Sample(10, 1)
+	require.NoError(t, err)
+	require.Empty(t, sample)
+
+	for i := 0; i < 500; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	sample, err = tree.Sample(50, 42)
+	require.NoError(t, err)
+	require.Len(t, sample, 50)
+	seen := make(map[string]bool)
+	for i, pair := range sample {
+		require.False(t, seen[string(pair.Key)], "duplicate key %s", pair.Key)
+		seen[string(pair.Key)] = true
+		if i > 0 {
+			require.Less(t, string(sample[i-1].Key), string(pair.Key))
+		}
+		value, err := tree.Get(pair.Key)
+		require.NoError(t, err)
+		require.Equal(t, value, pair.Value)
+	}
+
+	// the same seed gives the same sample, also from a tree loaded from disk, while another
+	// seed gives a different one.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	again, err := itree.Sample(50, 42)
+	require.NoError(t, err)
+	require.Equal(t, sample, again)
+	other, err := tree.Sample(50, 43)
+	require.NoError(t, err)
+	require.NotEqual(t, sample, other)
+
+	sample, err = tree.Sample(0, 42)
+	require.NoError(t, err)
+	require.Empty(t, sample)
+	sample, err = tree.Sample(1000, 42)
+	require.NoError(t, err)
+	require.Len(t, sample, 500)
+	for i, pair := range sample {
+		require.Equal(t, []byte(fmt.Sprintf("key-%04d", i)), pair.Key)
+	}
+	_, err = tree.Sample(-1, 42)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
+
+func TestImmutableTreePrefetch(t *testing.T) {
+	db := &readCountingDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, log.NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	start, end := []byte("key-0200"), []byte("key-0400")
+
+	iterate := func(tree *MutableTree) (keys []string, gets int) {
+		db.gets = 0
+		tree.IterateRange(start, end, true, func(key, _ []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		return keys, db.gets
+	}
+
+	cold := NewMutableTree(db, 10000, true, log.NewNopLogger())
+	_, err = cold.Load()
+	require.NoError(t, err)
+	expected, gets := iterate(cold)
+	require.Len(t, expected, 200)
+	require.Greater(t, gets, 200)
+
+	// the iteration after a prefetch reads the nodes from the cache.
+	warm := NewMutableTree(db, 10000, true, log.NewNopLogger())
+	_, err = warm.Load()
+	require.NoError(t, err)
+	warm.Prefetch(start, end)
+	warm.ndb.prefetching.Wait()
+	keys, gets := iterate(warm)
+	require.Equal(t, expected, keys)
+	require.Zero(t, gets)
+
+	// prefetches run alongside other reads.
+	concurrent := NewMutableTree(dbm.NewMemDB(), 100, true, log.NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := concurrent.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = concurrent.SaveVersion()
+	require.NoError(t, err)
+	itree, err := concurrent.GetImmutable(version)
+	require.NoError(t, err)
+	done := make(chan []string)
+	for i := 0; i < 4; i++ {
+		itree.Prefetch(nil, nil)
+		go func() {
+			var keys []string
+			itree.IterateRange(start, end, true, func(key, _ []byte) bool {
+				keys = append(keys, string(key))
+				return false
+			})
+			done <- keys
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		require.Equal(t, expected, <-done)
+	}
+
+	// the unsaved working tree isn't prefetched, nor are the nodes which can't be read.
+	_, err = concurrent.Set([]byte("key-0300"), []byte("updated"))
+	require.NoError(t, err)
+	concurrent.Prefetch(nil, nil)
+	_, _, err = concurrent.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, concurrent.DeleteVersionsTo(version))
+	itree.Prefetch(nil, nil)
+	require.NoError(t, concurrent.Close())
+}
@@ -29,7 +29,7 @@ type UnsavedFastIterator struct {
 	ndb          *nodeDB
 	nextKey      []byte
 	nextVal      []byte
-	fastIterator dbm.Iterator
+	fastIterator *FastIterator
 
 	nextUnsavedNodeIdx       int
 	unsavedFastNodeAdditions *sync.Map // map[string]*FastNode
@@ -122,12 +122,12 @@ func (iter *UnsavedFastIterator) Valid() bool {
 
 // Key implements dbm.Iterator
 func (iter *UnsavedFastIterator) Key() []byte {
-	return iter.nextKey
+	return iter.ndb.copyBytes(iter.nextKey)
 }
 
 // Value implements dbm.Iterator
 func (iter *UnsavedFastIterator) Value() []byte {
-	return iter.nextVal
+	return iter.ndb.copyBytes(iter.nextVal)
 }
 
 // Next implements dbm.Iterator
@@ -140,7 +140,7 @@ func (iter *UnsavedFastIterator) Next() {
 		return
 	}
 
-	diskKey := iter.fastIterator.Key()
+	diskKey := iter.fastIterator.key()
 	diskKeyStr := ibytes.UnsafeBytesToStr(diskKey)
 	if iter.fastIterator.Valid() && iter.nextUnsavedNodeIdx < len(iter.unsavedFastNodesToSort) {
 		value, ok := iter.unsavedFastNodeRemovals.Load(diskKeyStr)
@@ -176,8 +176,8 @@ func (iter *UnsavedFastIterator) Next() {
 			return
 		}
 		// Disk node is next
-		iter.nextKey = iter.fastIterator.Key()
-		iter.nextVal = iter.fastIterator.Value()
+		iter.nextKey = iter.fastIterator.key()
+		iter.nextVal = iter.fastIterator.value()
 
 		iter.fastIterator.Next()
 		return
@@ -193,8 +193,8 @@ func (iter *UnsavedFastIterator) Next() {
 			return
 		}
 
-		iter.nextKey = iter.fastIterator.Key()
-		iter.nextVal = iter.fastIterator.Value()
+		iter.nextKey = iter.fastIterator.key()
+		iter.nextVal = iter.fastIterator.value()
 
 		iter.fastIterator.Next()
 		return
@@ -217,6 +217,26 @@ func (iter *UnsavedFastIterator) Next() {
 	iter.nextVal = nil
 }
 
+// Seek implements Seeker. The unsaved fast nodes, already sorted, are searched for key.
+func (iter *UnsavedFastIterator) Seek(key []byte) {
+	if iter.ndb == nil || iter.unsavedFastNodeAdditions == nil || iter.unsavedFastNodeRemovals == nil || iter.fastIterator.closed {
+		return
+	}
+	iter.fastIterator.Seek(key)
+	iter.nextUnsavedNodeIdx = 0
+	if len(key) > 0 {
+		keyStr := ibytes.UnsafeBytesToStr(key)
+		iter.nextUnsavedNodeIdx = sort.Search(len(iter.unsavedFastNodesToSort), func(i int) bool {
+			if iter.ascending {
+				return iter.unsavedFastNodesToSort[i] >= keyStr
+			}
+			return iter.unsavedFastNodesToSort[i] <= keyStr
+		})
+	}
+	iter.nextKey, iter.nextVal = nil, nil
+	iter.Next()
+}
+
 // Close implements dbm.Iterator
 func (iter *UnsavedFastIterator) Close() error {
 	iter.valid = false
@@ -0,0 +1,10 @@
+package iavl
+
+// ValueCodec encodes the leaf values written to the database, and decodes them when the nodes
+// are read, see the ValueCodec option.
+type ValueCodec interface {
+	// Compress returns the stored form of a value.
+	Compress(value []byte) ([]byte, error)
+	// Decompress returns the value of its stored form, as given to Compress.
+	Decompress(stored []byte) ([]byte, error)
+}
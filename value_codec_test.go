@@ -0,0 +1,128 @@
+package iavl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// gzipCodec compresses the values with gzip, and counts the values it compressed.
+type gzipCodec struct {
+	compressed int
+}
+
+func (c *gzipCodec) Compress(value []byte) ([]byte, error) {
+	c.compressed++
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) Decompress(stored []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// codecTestValue returns a redundant value, as a JSON blob would be.
+func codecTestValue(version, i int) []byte {
+	return []byte(fmt.Sprintf(`{"version":%d,"index":%d,"data":"%s"}`, version, i, strings.Repeat("abcd", 50)))
+}
+
+func TestValueCodec(t *testing.T) {
+	codec := &gzipCodec{}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, log.NewNopLogger(), ValueCodecOption(codec))
+	referenceDB := dbm.NewMemDB()
+	reference := NewMutableTree(referenceDB, 0, false, log.NewNopLogger())
+	for version := 0; version < 3; version++ {
+		for _, tree := range []*MutableTree{tree, reference} {
+			for i := 0; i < 100; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", (version*40+i)%150)), codecTestValue(version, i))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.Remove([]byte(fmt.Sprintf("key-%03d", version*7)))
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectedHash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash)
+	}
+	require.Positive(t, codec.compressed)
+
+	// the leaves are stored compressed.
+	size := func(db dbm.DB) int {
+		itr, err := db.Iterator(nodeKeyFormat.Prefix(), []byte{nodeKeyFormat.Prefix()[0] + 1})
+		require.NoError(t, err)
+		defer itr.Close()
+		size := 0
+		for ; itr.Valid(); itr.Next() {
+			size += len(itr.Value())
+		}
+		return size
+	}
+	require.Less(t, size(db), size(referenceDB)/2)
+
+	// the values are decompressed once the nodes are read again, from a tree without cache.
+	loaded := NewMutableTree(db, 0, true, log.NewNopLogger(), ValueCodecOption(codec))
+	version, err := loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, reference.Hash(), loaded.Hash())
+	for v := int64(1); v <= version; v++ {
+		itree, err := loaded.GetImmutable(v)
+		require.NoError(t, err)
+		expected, err := reference.GetImmutable(v)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash())
+		for i := 0; i < 150; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			value, err := itree.Get(key)
+			require.NoError(t, err)
+			expectedValue, err := expected.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value)
+		}
+	}
+
+	// the proofs carry the original values, and verify against the same root hash.
+	latest, err := loaded.GetImmutable(version)
+	require.NoError(t, err)
+	for _, key := range [][]byte{[]byte("key-010"), []byte("key-149"), []byte("key-000")} {
+		proof, err := latest.GetProof(key)
+		require.NoError(t, err)
+		value, err := reference.Get(key)
+		require.NoError(t, err)
+		if value != nil {
+			ok, err := latest.VerifyMembership(proof, key)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, value, proof.GetExist().Value)
+		} else {
+			ok, err := latest.VerifyNonMembership(proof, key)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		expectedProof, err := reference.GetProof(key)
+		require.NoError(t, err)
+		require.Equal(t, expectedProof, proof)
+	}
+}
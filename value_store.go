@@ -0,0 +1,108 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+	"github.com/cosmos/iavl/keyformat"
+)
+
+// externalValueTag follows the hash of the value in the encoding of a leaf whose value is stored
+// apart, see the ExternalValueThreshold option, where the id of the compression of an inline
+// value is.
+const externalValueTag = 0xff
+
+// valueKeyFormat stores the values of the leaves stored apart, by the version of the leaf, which
+// is kept when a root is reformatted by the pruning, unlike its nonce.
+var valueKeyFormat = keyformat.NewKeyFormat('v', int64Size, 0) // v<version><key>
+
+// externalValueKey returns the key of the value of a leaf stored apart, nil if the node isn't
+// one. Such a leaf is loaded without its value.
+func externalValueKey(node *Node) []byte {
+	if !node.external {
+		return nil
+	}
+	return valueKeyFormat.Key(node.nodeKey.version, node.key)
+}
+
+// leafValue returns the value of a leaf, read from the DB if it is stored apart.
+func (ndb *nodeDB) leafValue(node *Node) ([]byte, error) {
+	key := externalValueKey(node)
+	if key == nil {
+		return node.value, nil
+	}
+	bz, err := ndb.db.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't get the value of leaf %v: %w", node.nodeKey, err)
+	}
+	if bz == nil {
+		return nil, fmt.Errorf("value missing for leaf %v", node.nodeKey)
+	}
+	val, n, err := encoding.DecodeBytes(bz)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the value of leaf %v, %w", node.nodeKey, err)
+	}
+	return decodeValue(val, bz[n:], ndb.valueCodec())
+}
+
+// writeLeaf writes the encoding of a leaf, whose value is added to the batch apart if it is
+// larger than the ExternalValueThreshold option. A leaf whose value is already stored apart,
+// e.g. a root reformatted by the pruning, keeps it. It returns whether the value is apart.
+func (ndb *nodeDB) writeLeaf(w io.Writer, node *Node) (bool, error) {
+	value := node.value
+	switch {
+	case node.external:
+		var err error
+		if value, err = ndb.leafValue(node); err != nil {
+			return false, err
+		}
+	case ndb.opts.ExternalValueThreshold <= 0 || len(value) <= ndb.opts.ExternalValueThreshold:
+		return false, node.writeEncodedBytes(w, ndb.nodeEncoding(), ndb.valueCodec(), nil)
+	default:
+		var record bytes.Buffer
+		if err := writeValue(&record, value, ndb.valueCodec()); err != nil {
+			return false, err
+		}
+		if err := ndb.batch.Set(valueKeyFormat.Key(node.nodeKey.version, node.key), record.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	return true, node.writeEncodedBytes(w, ndb.nodeEncoding(), ndb.valueCodec(), ndb.hashScheme().Sum(value))
+}
+
+// deleteValues deletes the values stored apart of the leaves of the versions from fromVersion
+// to toVersion, e.g. along with the nodes of the versions deleted from the latest one.
+func (ndb *nodeDB) deleteValues(fromVersion, toVersion int64) error {
+	var keys [][]byte
+	if err := ndb.traverseRange(valueKeyFormat.Key(fromVersion), valueKeyFormat.Key(toVersion+1), func(k, _ []byte) error {
+		keys = append(keys, bytes.Clone(k))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubValue verifies that the value of a leaf stored apart, decoded from buf, matches the hash
+// of the value the leaf holds, since the hash of the leaf is computed from it.
+func (ndb *nodeDB) scrubValue(node *Node, buf []byte) error {
+	_, valueHash, err := decodeNode(node.nodeKey.GetKey(), buf, ndb.valueCodec())
+	if err != nil {
+		return err
+	}
+	value, err := ndb.leafValue(node)
+	if err != nil {
+		return err
+	}
+	if hash := ndb.hashScheme().Sum(value); !bytes.Equal(hash, valueHash) {
+		return fmt.Errorf("hash %X of the value stored apart doesn't match the hash %X of the leaf", hash, valueHash)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// storedValueCount returns the number of values stored apart in db.
+func storedValueCount(t *testing.T, db dbm.DB) int {
+	t.Helper()
+	itr, err := db.Iterator(valueKeyFormat.Key(), []byte{valueKeyFormat.Prefix()[0] + 1})
+	require.NoError(t, err)
+	defer itr.Close()
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	return count
+}
+
+func TestExternalValues(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	// the values of the keys but every fifth one are stored apart.
+	value := func(version, i int) []byte {
+		if i%5 == 0 {
+			return []byte{byte(version)}
+		}
+		return bytes.Repeat([]byte{byte(version), byte(i)}, 32)
+	}
+	db := dbm.NewMemDB()
+	open := func() *MutableTree {
+		tree := NewMutableTree(db, 0, true, log.NewNopLogger(), ExternalValueThresholdOption(16), CompressionOption(CompressionSnappy))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	tree := open()
+	reference := NewMutableTree(dbm.NewMemDB(), 0, true, log.NewNopLogger())
+	for version := 1; version <= 4; version++ {
+		for _, tree := range []*MutableTree{tree, reference} {
+			for i := version; i < 100; i += version {
+				_, err := tree.Set(key(i), value(version, i))
+				require.NoError(t, err)
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectedHash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash)
+	}
+	// a value stored apart is read back from the working tree.
+	_, err := tree.Set(key(1), value(5, 1))
+	require.NoError(t, err)
+	got, err := tree.Get(key(1))
+	require.NoError(t, err)
+	require.Equal(t, value(5, 1), got)
+	tree.Rollback()
+
+	requireVersion := func(tree *MutableTree, version int64) {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		expected, err := reference.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), itree.Hash())
+		itr, err := itree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		expectedItr, err := expected.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		for ; expectedItr.Valid(); expectedItr.Next() {
+			require.True(t, itr.Valid())
+			require.Equal(t, expectedItr.Key(), itr.Key())
+			require.Equal(t, expectedItr.Value(), itr.Value())
+			itr.Next()
+		}
+		require.False(t, itr.Valid())
+		require.NoError(t, itr.Close())
+
+		proof, err := itree.GetMembershipProof(key(3))
+		require.NoError(t, err)
+		ok, err := itree.VerifyMembership(proof, key(3))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// the loaded leaves don't hold the values stored apart.
+	tree = open()
+	for version := int64(1); version <= 4; version++ {
+		requireVersion(tree, version)
+	}
+	_, leaf, err := tree.root.PathToLeaf(tree.ImmutableTree, key(1), tree.version)
+	require.NoError(t, err)
+	require.True(t, leaf.external)
+	require.Nil(t, leaf.value)
+	_, leaf, err = tree.root.PathToLeaf(tree.ImmutableTree, key(5), tree.version)
+	require.NoError(t, err)
+	require.False(t, leaf.external)
+
+	// the values are deleted along with the versions, but the ones still in use.
+	count := storedValueCount(t, db)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.Less(t, storedValueCount(t, db), count)
+	requireVersion(tree, 4)
+	count = storedValueCount(t, db)
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	require.Less(t, storedValueCount(t, db), count)
+	requireVersion(tree, 3)
+
+	// the root of a single leaf keeps its value when it is reformatted by the pruning.
+	db = dbm.NewMemDB()
+	tree = open()
+	_, err = tree.Set(key(1), value(1, 1))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	tree = open()
+	got, err = tree.Get(key(1))
+	require.NoError(t, err)
+	require.Equal(t, value(1, 1), got)
+	require.Equal(t, 1, storedValueCount(t, db))
+}
@@ -0,0 +1,225 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A version diff holds the changes transforming a version of a tree into a later one, version by
+// version, since the hashes of the nodes depend on the version they were saved by, between a
+// header and an end marker:
+//
+//	header:  versionDiffMagic, from version, to version, from root hash, to root hash
+//	version: version, then its changes in ascending key order, each either
+//	         versionDiffSet, key, value or versionDiffDelete, key, ended by versionDiffEnd
+//	end:     versionDiffEnd instead of a version
+//
+// Versions are uvarints, and byte slices are prefixed with their uvarint length.
+var versionDiffMagic = []byte("IAVLDIF1")
+
+const (
+	versionDiffEnd    = 0
+	versionDiffSet    = 1
+	versionDiffDelete = 2
+)
+
+// ErrInvalidVersionDiff is returned when applying a corrupted version diff, or one which doesn't
+// start from the current version of the tree.
+var ErrInvalidVersionDiff = errors.New("invalid version diff")
+
+// EncodeVersionDiff writes to w the changed leaves transforming fromVersion into the later
+// toVersion, with the root hashes of both, to replicate the tree with ApplyVersionDiff. The
+// changes are read version by version, so all the versions in between must still be available,
+// and not pruned while the diff is written.
+func (tree *MutableTree) EncodeVersionDiff(fromVersion, toVersion int64, w io.Writer) error {
+	if fromVersion >= toVersion {
+		return fmt.Errorf("version %d isn't after version %d: %w", toVersion, fromVersion, ErrInvalidInputs)
+	}
+	for version := fromVersion; version <= toVersion; version++ {
+		if !tree.VersionExists(version) {
+			return fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+		}
+	}
+	from, err := tree.GetImmutable(fromVersion)
+	if err != nil {
+		return err
+	}
+	to, err := tree.GetImmutable(toVersion)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(nil), versionDiffMagic...)
+	header = binary.AppendUvarint(header, uint64(fromVersion))
+	header = binary.AppendUvarint(header, uint64(toVersion))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if err := writeDelimited(w, from.Hash()); err != nil {
+		return err
+	}
+	if err := writeDelimited(w, to.Hash()); err != nil {
+		return err
+	}
+
+	err = tree.ndb.traverseStateChanges(fromVersion+1, toVersion, func(version int64, changeSet *ChangeSet) error {
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(version))); err != nil {
+			return err
+		}
+		for _, pair := range changeSet.Pairs {
+			if pair.Delete {
+				if _, err := w.Write([]byte{versionDiffDelete}); err != nil {
+					return err
+				}
+				if err := writeDelimited(w, pair.Key); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write([]byte{versionDiffSet}); err != nil {
+				return err
+			}
+			if err := writeKV(w, pair.Key, pair.Value); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write([]byte{versionDiffEnd})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{versionDiffEnd})
+	return err
+}
+
+// ApplyVersionDiff applies a diff written by EncodeVersionDiff to the tree, which must be at the
+// from version of the diff, with its root hash, and without unsaved changes. The versions of the
+// diff are saved as they are applied, and the root hash of the last one is returned if it is the
+// to root hash of the diff. ErrInvalidVersionDiff is returned otherwise, the versions applied so
+// far being saved, so that they can be deleted with DeleteVersionsFrom. The changes of each
+// version are applied in ascending key order, and the shape of the tree, so its hash, depends on
+// the order of the writes: the root hashes match if the source tree wrote them in that order
+// too, as the Cosmos SDK does. The diff is read with a buffer, unless r is an io.ByteReader, so
+// r may be read past its end.
+func (tree *MutableTree) ApplyVersionDiff(r io.Reader) (newRoot []byte, err error) {
+	br, ok := r.(versionDiffReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	magic := make([]byte, len(versionDiffMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("%w: reading the magic: %w", ErrInvalidVersionDiff, err)
+	}
+	if !bytes.Equal(magic, versionDiffMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidVersionDiff)
+	}
+	fromVersion, err := readVersionDiffVersion(br)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := readVersionDiffVersion(br)
+	if err != nil {
+		return nil, err
+	}
+	fromRoot, err := readVersionDiffBytes(br)
+	if err != nil {
+		return nil, err
+	}
+	toRoot, err := readVersionDiffBytes(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if tree.root != nil && tree.root.nodeKey == nil {
+		return nil, fmt.Errorf("cannot apply a version diff with uncommitted changes")
+	}
+	if tree.Version() != fromVersion || !bytes.Equal(tree.Hash(), fromRoot) {
+		return nil, fmt.Errorf("%w: the diff starts from version %d with hash %X, the tree is at version %d with hash %X",
+			ErrInvalidVersionDiff, fromVersion, fromRoot, tree.Version(), tree.Hash())
+	}
+
+	for {
+		version, err := readVersionDiffVersion(br)
+		if err != nil {
+			return nil, err
+		}
+		if version == versionDiffEnd {
+			break
+		}
+		if version != tree.Version()+1 || version > toVersion {
+			return nil, fmt.Errorf("%w: version %d doesn't follow version %d", ErrInvalidVersionDiff, version, tree.Version())
+		}
+		var changeSet ChangeSet
+		for {
+			op, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("%w: reading a change of version %d: %w", ErrInvalidVersionDiff, version, err)
+			}
+			if op == versionDiffEnd {
+				break
+			}
+			if op != versionDiffSet && op != versionDiffDelete {
+				return nil, fmt.Errorf("%w: unknown change %d of version %d", ErrInvalidVersionDiff, op, version)
+			}
+			pair := &KVPair{Delete: op == versionDiffDelete}
+			if pair.Key, err = readVersionDiffBytes(br); err != nil {
+				return nil, err
+			}
+			if !pair.Delete {
+				if pair.Value, err = readVersionDiffBytes(br); err != nil {
+					return nil, err
+				}
+			}
+			changeSet.Pairs = append(changeSet.Pairs, pair)
+		}
+		if _, err := tree.SaveChangeSet(&changeSet); err != nil {
+			return nil, fmt.Errorf("applying version %d: %w", version, err)
+		}
+	}
+
+	if tree.Version() != toVersion || !bytes.Equal(tree.Hash(), toRoot) {
+		return nil, fmt.Errorf("%w: the diff ends at version %d with hash %X, the tree is at version %d with hash %X",
+			ErrInvalidVersionDiff, toVersion, toRoot, tree.Version(), tree.Hash())
+	}
+	return tree.Hash(), nil
+}
+
+// versionDiffReader is the reader a version diff is read from.
+type versionDiffReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readVersionDiffVersion reads a version of a version diff.
+func readVersionDiffVersion(r versionDiffReader) (int64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: reading a version: %w", ErrInvalidVersionDiff, err)
+	}
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: invalid version %d", ErrInvalidVersionDiff, v)
+	}
+	return int64(v), nil
+}
+
+// readVersionDiffBytes reads a byte slice of a version diff, prefixed with its length.
+func readVersionDiffBytes(r versionDiffReader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading a length: %w", ErrInvalidVersionDiff, err)
+	}
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: invalid length %d", ErrInvalidVersionDiff, size)
+	}
+	bz := make([]byte, size)
+	if _, err := io.ReadFull(r, bz); err != nil {
+		return nil, fmt.Errorf("%w: reading %d bytes: %w", ErrInvalidVersionDiff, size, err)
+	}
+	return bz, nil
+}
@@ -0,0 +1,105 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cosmossdk.io/log"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// importVersion returns a new tree imported from the given version of tree.
+func importVersion(t *testing.T, tree *MutableTree, version int64) *MutableTree {
+	t.Helper()
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	imported := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	importer, err := imported.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	return imported
+}
+
+func TestVersionDiff(t *testing.T) {
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for version := 1; version <= 5; version++ {
+		// the changes are written in ascending key order, as the diff applies them.
+		_, err := source.Set([]byte(fmt.Sprintf("empty-%d", version)), []byte{})
+		require.NoError(t, err)
+		for i := 0; i < 50; i += 1 + version%3 {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			if (i+version)%4 == 0 {
+				_, _, err = source.Remove(key)
+			} else {
+				_, err = source.Set(key, []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			}
+			require.NoError(t, err)
+		}
+		_, _, err = source.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	replica := importVersion(t, source, 2)
+	var diff bytes.Buffer
+	require.NoError(t, source.EncodeVersionDiff(2, 5, &diff))
+	encoded := bytes.Clone(diff.Bytes())
+	root, err := replica.ApplyVersionDiff(&diff)
+	require.NoError(t, err)
+	require.Equal(t, source.Hash(), root)
+	require.EqualValues(t, 5, replica.Version())
+	for version := int64(3); version <= 5; version++ {
+		expected, err := source.GetImmutable(version)
+		require.NoError(t, err)
+		actual, err := replica.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), actual.Hash(), "version %d", version)
+	}
+
+	// the diff only applies to the from version.
+	_, err = replica.ApplyVersionDiff(bytes.NewReader(encoded))
+	require.ErrorIs(t, err, ErrInvalidVersionDiff)
+	require.EqualValues(t, 5, replica.Version())
+
+	truncated := importVersion(t, source, 2)
+	_, err = truncated.ApplyVersionDiff(bytes.NewReader(encoded[:len(encoded)-10]))
+	require.ErrorIs(t, err, ErrInvalidVersionDiff)
+	corrupted := importVersion(t, source, 2)
+	_, err = corrupted.ApplyVersionDiff(bytes.NewReader(append([]byte("IAVLDIF0"), encoded[8:]...)))
+	require.ErrorIs(t, err, ErrInvalidVersionDiff)
+	require.EqualValues(t, 2, corrupted.Version())
+
+	// the root doesn't match if the changes weren't written in ascending key order.
+	unordered := NewMutableTree(dbm.NewMemDB(), 0, false, log.NewNopLogger())
+	for version := 1; version <= 2; version++ {
+		for i := 20; i > 0; i-- {
+			_, err = unordered.Set([]byte(fmt.Sprintf("key-%02d", i*version)), []byte{byte(version)})
+			require.NoError(t, err)
+		}
+		_, _, err = unordered.SaveVersion()
+		require.NoError(t, err)
+	}
+	diff.Reset()
+	require.NoError(t, unordered.EncodeVersionDiff(1, 2, &diff))
+	_, err = importVersion(t, unordered, 1).ApplyVersionDiff(&diff)
+	require.ErrorIs(t, err, ErrInvalidVersionDiff)
+
+	require.ErrorIs(t, source.EncodeVersionDiff(3, 3, &diff), ErrInvalidInputs)
+	require.ErrorIs(t, source.EncodeVersionDiff(4, 6, &diff), ErrVersionDoesNotExist)
+}
@@ -0,0 +1,76 @@
+package iavl
+
+import (
+	"fmt"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// IterateVersion returns an iterator over the keys in [start, end) of any available version,
+// e.g. to scan an old version for an export or an audit, which reads the nodes straight from
+// the database instead of going through the node cache, so that the scan doesn't evict the hot
+// nodes of the latest version. The iteration holds the nodes on the path to the current key
+// only, so its memory is bounded by the height of the tree whatever the size of the version.
+// A nil start or end leaves that side unbounded, as in Iterator, and the keys and values are
+// copies, unless the UnsafeNoCopy option is set.
+//
+// The version is protected from deletion until the iterator is closed, and an error reading a
+// node, e.g. a missing one, stops the iteration and is returned by its Error method.
+func (tree *MutableTree) IterateVersion(version int64, start, end []byte, ascending bool) (dbm.Iterator, error) {
+	if !tree.VersionExists(version) {
+		return nil, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+	}
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	t := &ImmutableTree{
+		ndb:                    tree.ndb,
+		version:                version,
+		skipFastStorageUpgrade: true,
+		uncached:               true,
+	}
+	if rootKey != nil {
+		if t.root, err = tree.ndb.getNodeUncached(rootKey); err != nil {
+			return nil, err
+		}
+	}
+
+	tree.ndb.incrVersionReaders(version)
+	itr := &versionIterator{
+		Iterator: tree.ndb.filterTombstones(NewIterator(start, end, ascending, t)),
+		ndb:      tree.ndb,
+		version:  version,
+	}
+	return tree.ndb.trackIterator(itr), nil
+}
+
+// versionIterator is the iterator returned by IterateVersion, which releases its version once
+// closed.
+type versionIterator struct {
+	dbm.Iterator
+	ndb     *nodeDB
+	version int64
+	closed  bool
+}
+
+func (itr *versionIterator) Close() error {
+	if !itr.closed {
+		itr.closed = true
+		itr.ndb.decrVersionReaders(itr.version)
+	}
+	return itr.Iterator.Close()
+}
+
+// getNodeUncached returns the node with the given key as GetNode does, but without reading or
+// adding it to the node cache.
+func (ndb *nodeDB) getNodeUncached(nk []byte) (*Node, error) {
+	if ndb.archive != nil {
+		// archive files aren't cached.
+		return ndb.archive.getNode(nk)
+	}
+	if nk == nil {
+		return nil, ErrNodeMissingNodeKey
+	}
+	return ndb.readNode(nk)
+}
@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestIterateVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 100, false, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 300; i += version {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d-%d", version, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		start, end []byte
+		ascending  bool
+	}{
+		{nil, nil, true},
+		{nil, nil, false},
+		{[]byte("key-100"), []byte("key-200"), true},
+		{[]byte("key-100"), []byte("key-200"), false},
+		{[]byte("key-299"), nil, true},
+		{[]byte("z"), nil, true},
+	} {
+		var expected []KVPair
+		require.False(t, itree.IterateRange(tc.start, tc.end, tc.ascending, func(key, value []byte) bool {
+			expected = append(expected, KVPair{Key: key, Value: value})
+			return false
+		}))
+		stats := tree.CacheStats().Nodes
+		itr, err := tree.IterateVersion(1, tc.start, tc.end, tc.ascending)
+		require.NoError(t, err)
+		for _, pair := range expected {
+			require.True(t, itr.Valid())
+			require.Equal(t, pair.Key, itr.Key())
+			require.Equal(t, pair.Value, itr.Value())
+			itr.Next()
+		}
+		require.False(t, itr.Valid())
+		require.NoError(t, itr.Error())
+		require.NoError(t, itr.Close())
+		// the node cache is left untouched.
+		require.Equal(t, stats, tree.CacheStats().Nodes)
+	}
+
+	// the version can't be deleted while it is iterated.
+	itr, err := tree.IterateVersion(1, nil, nil, true)
+	require.NoError(t, err)
+	require.Error(t, tree.DeleteVersionsTo(1))
+	require.NoError(t, itr.Close())
+	require.NoError(t, itr.Close())
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	_, err = tree.IterateVersion(1, nil, nil, true)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestIterateVersion_MissingNode(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the missing node stops the iteration with an error.
+	root, err := tree.ndb.readNode(GetRootKey(version))
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(nodeKeyFormat.Key(root.rightNodeKey)))
+	itr, err := tree.IterateVersion(version, nil, nil, true)
+	require.NoError(t, err)
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.Less(t, count, 100)
+	require.Error(t, itr.Error())
+	require.Error(t, itr.Close())
+}
@@ -0,0 +1,137 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// VersionedValue is the value a key was set to by a version, nil if the version deleted it, see
+// MutableTree.GetVersionedRange.
+type VersionedValue struct {
+	Version int64
+	Value   []byte
+}
+
+// GetVersionedRange returns the history of the key over the versions from fromVersion to
+// toVersion inclusive, in ascending version order: first the value the key has at fromVersion,
+// if any, with the version which set it, which may be before fromVersion, and then every
+// version of the range which changed the value of the key, with its new value, nil for a
+// deletion. The versions which set the key to the value it already had are skipped. The
+// versions of the range must be available.
+//
+// The history is read from the versions of the nodes rather than by getting the key at each
+// version: a leaf is unchanged since the version it was written at, and a key is absent from
+// every version which shares the subtree the key would be in, so a lookup skips all the versions
+// between changes of the key, or of its neighbours.
+func (tree *MutableTree) GetVersionedRange(key []byte, fromVersion, toVersion int64) ([]VersionedValue, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if fromVersion <= 0 || fromVersion > toVersion {
+		return nil, fmt.Errorf("invalid version range %d to %d: %w", fromVersion, toVersion, ErrInvalidInputs)
+	}
+	if !tree.VersionExists(fromVersion) {
+		return nil, fmt.Errorf("version %d: %w", fromVersion, ErrVersionDoesNotExist)
+	}
+
+	// the states of the key, from the latest, each held since the version of the state.
+	var states []VersionedValue
+	for version := toVersion; version >= fromVersion; {
+		if !tree.VersionExists(version) {
+			return nil, fmt.Errorf("version %d: %w", version, ErrVersionDoesNotExist)
+		}
+		value, since, err := tree.keyState(key, version)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, VersionedValue{Version: since, Value: value})
+		version = since - 1
+	}
+	// the value at fromVersion may have been set again to the same value, before fromVersion.
+	for oldest := &states[len(states)-1]; oldest.Value != nil && tree.VersionExists(oldest.Version-1); {
+		value, since, err := tree.keyState(key, oldest.Version-1)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil || !bytes.Equal(value, oldest.Value) {
+			break
+		}
+		oldest.Version = since
+	}
+
+	var history []VersionedValue
+	for i := len(states) - 1; i >= 0; i-- {
+		state := states[i]
+		if len(history) == 0 && state.Value == nil {
+			continue // the key is absent at fromVersion.
+		}
+		if len(history) > 0 {
+			last := history[len(history)-1].Value
+			if (last == nil) == (state.Value == nil) && bytes.Equal(last, state.Value) {
+				continue
+			}
+		}
+		history = append(history, state)
+	}
+	return history, nil
+}
+
+// keyState returns the value of the key at the version, nil if absent, and the earliest version
+// the key is known to have had this state since: the version of its leaf if present, and the
+// version of the deepest node of its path whose subtree holds keys both before and after it if
+// absent, the key being absent from all the versions which share the subtree since the keys of
+// a subtree are contiguous, or else the version of the root.
+func (tree *MutableTree) keyState(key []byte, version int64) ([]byte, int64, error) {
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rootKey == nil {
+		return nil, version, nil
+	}
+	node, err := tree.ndb.GetNode(rootKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	t := &ImmutableTree{ndb: tree.ndb, version: version, skipFastStorageUpgrade: true}
+	since := node.nodeKey.version
+	// the deepest nodes of the path holding a key after the key, and before it.
+	var after, before *Node
+	for !node.isLeaf() {
+		parent := node
+		if tree.ndb.compare(key, node.key) < 0 {
+			after = node // its right subtree starts with its key.
+			node, err = node.getLeftNode(t)
+		} else {
+			before = node
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		// once the path turned right, every deeper node holds a key before the key, the first
+		// key of the subtree turned to being before it.
+		if before != nil {
+			before = parent
+		}
+	}
+
+	switch tree.ndb.compare(node.key, key) {
+	case 0:
+		value, err := tree.ndb.leafValue(node)
+		if err != nil {
+			return nil, 0, err
+		}
+		return tree.ndb.liveValue(tree.ndb.copyBytes(value)), node.nodeKey.version, nil
+	case 1:
+		if before != nil {
+			since = before.nodeKey.version
+		}
+	default:
+		if after != nil {
+			since = after.nodeKey.version
+		}
+	}
+	return nil, since, nil
+}
@@ -0,0 +1,131 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// versionedRangeNaive returns the history of GetVersionedRange by getting the key at each version.
+func versionedRangeNaive(t *testing.T, tree *MutableTree, key []byte, from, to int64) []VersionedValue {
+	var all []VersionedValue
+	var last []byte
+	for version := int64(1); version <= to; version++ {
+		value, err := tree.GetVersioned(key, version)
+		require.NoError(t, err)
+		if (last == nil) != (value == nil) || string(last) != string(value) {
+			all = append(all, VersionedValue{Version: version, Value: value})
+		}
+		last = value
+	}
+	var history []VersionedValue
+	for i, change := range all {
+		switch {
+		case change.Version > from:
+			history = append(history, change)
+		case change.Value != nil && (i+1 == len(all) || all[i+1].Version > from):
+			history = append(history, change) // the value at from.
+		}
+	}
+	return history
+}
+
+func TestGetVersionedRange(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for version := 1; version <= 20; version++ {
+		// the neighbours of the key change at every version.
+		_, err := tree.Set([]byte(fmt.Sprintf("a%02d", version)), []byte{1})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte(fmt.Sprintf("z%02d", version)), []byte{1})
+		require.NoError(t, err)
+		switch version {
+		case 2, 15:
+			_, err = tree.Set([]byte("k"), []byte(fmt.Sprintf("v%d", version)))
+		case 5:
+			_, err = tree.Set([]byte("k"), []byte("v5"))
+		case 7:
+			_, err = tree.Set([]byte("k"), []byte("v5"))
+		case 10, 18:
+			_, _, err = tree.Remove([]byte("k"))
+		}
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	history, err := tree.GetVersionedRange([]byte("k"), 1, 20)
+	require.NoError(t, err)
+	require.Equal(t, []VersionedValue{
+		{Version: 2, Value: []byte("v2")},
+		{Version: 5, Value: []byte("v5")},
+		{Version: 10},
+		{Version: 15, Value: []byte("v15")},
+		{Version: 18},
+	}, history)
+
+	// the value at the start of the range comes with the version which set it.
+	history, err = tree.GetVersionedRange([]byte("k"), 8, 16)
+	require.NoError(t, err)
+	require.Equal(t, []VersionedValue{
+		{Version: 5, Value: []byte("v5")},
+		{Version: 10},
+		{Version: 15, Value: []byte("v15")},
+	}, history)
+
+	history, err = tree.GetVersionedRange([]byte("k"), 11, 14)
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	_, err = tree.GetVersionedRange([]byte("k"), 5, 21)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.GetVersionedRange([]byte("k"), 5, 4)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.GetVersionedRange(nil, 1, 4)
+	require.ErrorIs(t, err, ErrEmptyKey)
+
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	_, err = tree.GetVersionedRange([]byte("k"), 3, 20)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	history, err = tree.GetVersionedRange([]byte("k"), 4, 6)
+	require.NoError(t, err)
+	require.Equal(t, []VersionedValue{
+		{Version: 2, Value: []byte("v2")},
+		{Version: 5, Value: []byte("v5")},
+	}, history)
+}
+
+func TestGetVersionedRange_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	const versions, keys = 40, 30
+	for version := 1; version <= versions; version++ {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("key%02d", r.Intn(keys)))
+			var err error
+			if r.Intn(3) == 0 {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, []byte{byte(r.Intn(3))})
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// the keys outside the range of the tree too.
+	for i := -1; i <= keys; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		for n := 0; n < 5; n++ {
+			from := int64(r.Intn(versions)) + 1
+			to := from + int64(r.Intn(versions-int(from)+1))
+			history, err := tree.GetVersionedRange(key, from, to)
+			require.NoError(t, err)
+			require.Equal(t, versionedRangeNaive(t, tree, key, from, to), history, "key %s from %d to %d", key, from, to)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package iavl
+
+// NodeInfo describes an inner node visited by ImmutableTree.Walk.
+type NodeInfo struct {
+	// Key is the smallest key of the right subtree, which splits the keys of the node.
+	Key []byte
+	// Height is the height of the subtree, 1 for the parents of leaves.
+	Height int8
+	// Size is the number of leaves of the subtree, the tombstones of the soft deletes included.
+	Size int64
+	// Version is the version the node was saved at, 0 if it is unsaved.
+	Version int64
+	// Hash is the hash of the node, nil if it is unsaved.
+	Hash []byte
+}
+
+// Visitor is called by ImmutableTree.Walk for the nodes of the tree, in pre-order.
+type Visitor interface {
+	// VisitInner is called for an inner node before its subtrees, which are only walked if it
+	// returns true.
+	VisitInner(node NodeInfo) (descend bool)
+	// VisitLeaf is called for each leaf walked, in ascending key order. The walk stops if it
+	// returns true.
+	VisitLeaf(key, value []byte) (stop bool)
+}
+
+// Walk walks the tree depth-first, calling the visitor for each node, and letting it skip
+// subtrees, e.g. for analytics needing more than the leaves. The keys, values and hashes are
+// copies, unless the UnsafeNoCopy option is set. It returns whether the visitor stopped the
+// walk, and the error of loading a node, if any.
+func (t *ImmutableTree) Walk(visitor Visitor) (stopped bool, err error) {
+	if t.root == nil {
+		return false, nil
+	}
+	return t.walk(t.root, visitor)
+}
+
+func (t *ImmutableTree) walk(node *Node, visitor Visitor) (stopped bool, err error) {
+	if node.isLeaf() {
+		value, err := t.ndb.leafValue(node)
+		if err != nil {
+			return false, err
+		}
+		if t.ndb.isTombstone(value) {
+			// the tombstones of the soft deletes are skipped, though counted by the sizes.
+			return false, nil
+		}
+		return visitor.VisitLeaf(t.ndb.copyBytes(node.key), t.ndb.copyBytes(value)), nil
+	}
+	info := NodeInfo{
+		Key:    t.ndb.copyBytes(node.key),
+		Height: node.subtreeHeight,
+		Size:   node.size,
+		Hash:   t.ndb.copyBytes(node.hash),
+	}
+	if node.nodeKey != nil {
+		info.Version = node.nodeKey.version
+	}
+	if !visitor.VisitInner(info) {
+		return false, nil
+	}
+
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return false, err
+	}
+	if stopped, err := t.walk(leftNode, visitor); stopped || err != nil {
+		return stopped, err
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return false, err
+	}
+	return t.walk(rightNode, visitor)
+}
@@ -0,0 +1,109 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// leafCounter counts the leaves and the inner nodes walked.
+type leafCounter struct {
+	leaves, inner int
+	keys          []string
+}
+
+func (c *leafCounter) VisitInner(NodeInfo) bool {
+	c.inner++
+	return true
+}
+
+func (c *leafCounter) VisitLeaf(key, _ []byte) bool {
+	c.leaves++
+	c.keys = append(c.keys, string(key))
+	return false
+}
+
+// subtreePruner skips the subtrees of the inner nodes splitting at a given key.
+type subtreePruner struct {
+	leafCounter
+	pruned NodeInfo
+	split  []byte
+}
+
+func (p *subtreePruner) VisitInner(node NodeInfo) bool {
+	if bytes.Equal(node.Key, p.split) && node.Height > 1 && p.pruned.Key == nil {
+		p.pruned = node
+		return false
+	}
+	return p.leafCounter.VisitInner(node)
+}
+
+// leafStopper stops the walk after a number of leaves.
+type leafStopper struct {
+	leafCounter
+	limit int
+}
+
+func (s *leafStopper) VisitLeaf(key, value []byte) bool {
+	s.leafCounter.VisitLeaf(key, value)
+	return s.leaves == s.limit
+}
+
+func TestImmutableTreeWalk(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		keys = append(keys, key)
+		_, err := tree.Set([]byte(key), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	counter := &leafCounter{}
+	stopped, err := itree.Walk(counter)
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, keys, counter.keys)
+	require.Equal(t, 99, counter.inner)
+
+	// the leaves of a pruned subtree aren't visited.
+	pruner := &subtreePruner{split: []byte(keys[50])}
+	_, err = itree.Walk(pruner)
+	require.NoError(t, err)
+	require.NotNil(t, pruner.pruned.Key)
+	require.Equal(t, version, pruner.pruned.Version)
+	require.Len(t, pruner.pruned.Hash, hashSize)
+	require.EqualValues(t, 100, int64(pruner.leaves)+pruner.pruned.Size)
+	var prunedKeys []string
+	itree.IterateRange(nil, nil, true, func(key, _ []byte) bool {
+		if !slices.Contains(pruner.keys, string(key)) {
+			prunedKeys = append(prunedKeys, string(key))
+		}
+		return false
+	})
+	require.Len(t, prunedKeys, int(pruner.pruned.Size))
+	require.Contains(t, prunedKeys, keys[50])
+
+	// the walk stops early.
+	stopper := &leafStopper{limit: 10}
+	stopped, err = itree.Walk(stopper)
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, keys[:10], stopper.keys)
+
+	// an empty tree has no node to visit.
+	counter = &leafCounter{}
+	stopped, err = NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).Walk(counter)
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Zero(t, counter.leaves+counter.inner)
+}